@@ -2,15 +2,19 @@ package api
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/tls"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"strconv"
 	"sync"
 	"time"
 
-	auth "github.com/abbot/go-http-auth"
 	"github.com/gorilla/mux"
 
+	"github.com/reviewboard/rb-gateway/api/credentials"
 	"github.com/reviewboard/rb-gateway/api/tokens"
 	"github.com/reviewboard/rb-gateway/config"
 	"github.com/reviewboard/rb-gateway/repositories"
@@ -45,6 +49,36 @@ type API struct {
 	// The server router.
 	router *mux.Router
 
+	// The router wrapped with the configured middleware.
+	handler http.Handler
+
+	// The recorder for debugging requests, if recording is enabled.
+	recorder *recorder
+
+	// The request processing times since the server started.
+	metrics *requestMetrics
+
+	// The state of the `ratelimit` middleware, which is kept across reloads.
+	rateLimits *rateLimits
+
+	// The memory in use by the contents being sent to clients.
+	memory *memoryBudget
+
+	// The store of large files that clients are redirected to, if redirects
+	// are enabled.
+	blobs *blobStore
+
+	// The object storage that archives and blobs are uploaded to, if it is
+	// configured.
+	objects *objectStore
+
+	// The key for signing blob URLs if the configuration does not provide
+	// one.
+	blobKey []byte
+
+	// The cached language breakdowns of commits.
+	languages *languageCache
+
 	// A lock for reading from/writing to the hook store.
 	hookStoreLock sync.RWMutex
 
@@ -54,51 +88,142 @@ type API struct {
 	// The token store.
 	tokenStore tokens.TokenStore
 
-	// The authenticator for requesting tokens.
-	authenticator *auth.BasicAuth
+	// The provider that checks the credentials for requesting tokens.
+	credentials credentials.Provider
+
+	// The external endpoint that makes authorization decisions, if it is
+	// configured.
+	callout *authCallout
+
+	// The verifier for OpenID Connect bearer tokens, if they are accepted.
+	oidc *oidcVerifier
+
+	// A lock for reading from/writing to unavailable.
+	unavailableLock sync.RWMutex
+
+	// The names of the repositories that are unavailable.
+	unavailable map[string]bool
+
+	// A lock for reading from/writing to dispatchEvent and enqueueEvent.
+	dispatchLock sync.RWMutex
+
+	// The function that delivers events, if they are accepted.
+	dispatchEvent EventDispatcher
+
+	// The function that queues events posted by hooks to be delivered in
+	// the background, if they are accepted.
+	enqueueEvent EventDispatcher
 }
 
 // Return a new router for the API.
 func New(cfg *config.Config) (*API, error) {
 	api := API{
-		config:        &config.Config{},
-		router:        mux.NewRouter(),
-		authenticator: auth.NewBasicAuthenticator("RB Gateway", nil),
+		config:      &config.Config{},
+		router:      mux.NewRouter(),
+		metrics:     newRequestMetrics(),
+		rateLimits:  newRateLimits(),
+		memory:      &memoryBudget{},
+		blobKey:     make([]byte, 32),
+		languages:   newLanguageCache(languageCacheSize),
+		unavailable: make(map[string]bool),
+	}
+
+	if _, err := rand.Read(api.blobKey); err != nil {
+		return nil, fmt.Errorf("Could not generate a key for blob URLs: %s", err.Error())
 	}
 
 	if err := api.setConfigUnsafe(cfg); err != nil {
 		return nil, err
 	}
 
+	api.router.Use(withRouteTiming)
+
+	api.router.Path("/session").
+		Methods("GET").
+		HandlerFunc(api.getSession)
+
 	api.router.Path("/session").
-		Methods("GET", "POST").
-		HandlerFunc(api.authenticator.Wrap(api.getSession))
+		Methods("POST").
+		HandlerFunc(api.withBasicAuth(api.createSession))
 
 	// The following routes all require token authorization.
-	repoRouter := api.router.PathPrefix("/repos/{repo}").Subrouter()
-	repoRouter.Use(api.withAuthorizationRequired)
+	api.router.Path("/session/delegate").
+		Methods("POST").
+		Handler(api.withAuthorizationRequired(http.HandlerFunc(api.delegateSession)))
+
+	api.router.Path("/debug/recordings").
+		Methods("GET").
+		Handler(api.withAuthorizationRequired(api.withManagementRole(api.withUnrestrictedToken(http.HandlerFunc(api.getRecordings)))))
+
+	api.router.Path(blobRoutePrefix+"/{hash:[0-9a-f]{64}}").
+		Methods("GET", "HEAD").
+		HandlerFunc(api.getBlob)
+
+	api.router.Path("/auth-callout/cache").
+		Methods("DELETE").
+		Handler(api.withAuthorizationRequired(api.withManagementRole(api.withUnrestrictedToken(http.HandlerFunc(api.invalidateCalloutCache)))))
+
+	api.router.Path("/debug/metrics").
+		Methods("GET").
+		Handler(api.withAuthorizationRequired(api.withManagementRole(api.withUnrestrictedToken(http.HandlerFunc(api.getMetrics)))))
+
+	// Repository names may contain slashes (e.g., `team/project`), so the
+	// repository is part of each route rather than the prefix. Routes are
+	// matched in order, so a route must come before any route whose path is a
+	// suffix of its own (e.g., `/search/commits` before `/commits`), and the
+	// repository root must come last. Otherwise, the repository would match
+	// part of the rest of the path. Refs may also contain slashes (e.g.,
+	// `feature/x`).
+	repoRouter := api.router.PathPrefix("/repos").Subrouter()
+	repoRouter.Use(api.withRepositoryAuthorization)
 	repoRouter.Use(api.withRepository)
+	repoRouter.Use(api.withAuthCallout)
 
 	addRoutes(repoRouter, []routingEntry{
-		{[]string{"GET"}, "/branches", http.HandlerFunc(api.getBranches)},
-		{[]string{"GET"}, "/branches/{branch}/commits", http.HandlerFunc(api.getCommits)},
-		{[]string{"GET"}, "/commits/{commit-id}", http.HandlerFunc(api.getCommit)},
-		{[]string{"GET"}, "/commits/{commit-id}/path/{path}", http.HandlerFunc(api.getFileByCommit)},
-		{[]string{"HEAD"}, "/commits/{commit-id}/path/{path}", http.HandlerFunc(api.getFileExistsByCommit)},
-		{[]string{"GET"}, "/file/{file-id}", http.HandlerFunc(api.getFile)},
-		{[]string{"HEAD"}, "/file/{file-id}", http.HandlerFunc(api.getFileExists)},
-		{[]string{"GET"}, "/path", http.HandlerFunc(api.getPath)},
+		{[]string{"GET"}, "/{repo:.+}/branches", http.HandlerFunc(api.getBranches)},
+		{[]string{"GET"}, "/{repo:.+}/branches/{branch}/commits", http.HandlerFunc(api.getCommits)},
+		{[]string{"GET"}, "/{repo:.+}/branches/{branch}/path/{path:.+}/log", http.HandlerFunc(api.getFileLog)},
+		{[]string{"GET"}, "/{repo:.+}/search/commits", http.HandlerFunc(api.searchCommits)},
+		{[]string{"GET"}, "/{repo:.+}/commits", http.HandlerFunc(api.getCommitRange)},
+		{[]string{"GET"}, "/{repo:.+}/commits/{commit-id}", api.withMemoryBudget(http.HandlerFunc(api.getCommit))},
+		{[]string{"POST"}, applyCheckPath, api.withMemoryBudget(http.HandlerFunc(api.checkPatch))},
+		{[]string{"GET"}, "/{repo:.+}/commits/{commit-id}/archive", api.withMemoryBudget(http.HandlerFunc(api.getArchive))},
+		{[]string{"GET"}, "/{repo:.+}/commits/{commit-id}/languages", http.HandlerFunc(api.getLanguages)},
+		{[]string{"GET"}, "/{repo:.+}/commits/{commit-id}/notes", http.HandlerFunc(api.getNotes)},
+		{[]string{"GET"}, "/{repo:.+}/commits/{commit-id}/owners", http.HandlerFunc(api.getCommitOwners)},
+		{[]string{"GET"}, "/{repo:.+}/commits/{commit-id}/path/{path}", api.withMemoryBudget(http.HandlerFunc(api.getFileByCommit))},
+		{[]string{"HEAD"}, "/{repo:.+}/commits/{commit-id}/path/{path}", http.HandlerFunc(api.getFileExistsByCommit)},
+		{[]string{"GET"}, "/{repo:.+}/file/{file-id}", api.withMemoryBudget(http.HandlerFunc(api.getFile))},
+		{[]string{"HEAD"}, "/{repo:.+}/file/{file-id}", http.HandlerFunc(api.getFileExists)},
+		{[]string{"GET"}, "/{repo:.+}/merge-base", http.HandlerFunc(api.getMergeBase)},
+		{[]string{"GET"}, "/{repo:.+}/path", http.HandlerFunc(api.getPath)},
+		{[]string{"GET"}, "/{repo:.+}/refs", http.HandlerFunc(api.getRefs)},
+		{[]string{"GET"}, "/{repo:.+}/refs/{ref:.+}/owners", http.HandlerFunc(api.getOwnersByRef)},
+		{[]string{"GET"}, "/{repo:.+}/refs/{ref:.+}/path/{path}", api.withMemoryBudget(http.HandlerFunc(api.getFileByRef))},
+		{[]string{"HEAD"}, "/{repo:.+}/refs/{ref:.+}/path/{path}", http.HandlerFunc(api.getFileExistsByRef)},
+		{[]string{"POST"}, hookEventsPath, http.HandlerFunc(api.postHookEvent)},
+		{[]string{"GET"}, "/{repo:.+}/push-payload", api.withWriteRole(api.withMemoryBudget(http.HandlerFunc(api.getPushPayload)))},
+		{[]string{"POST"}, "/{repo:.+}/push-payload", api.withWriteRole(api.withMemoryBudget(http.HandlerFunc(api.replayPushPayload)))},
+		{[]string{"POST"}, "/{repo:.+}/test-event", http.HandlerFunc(api.testEvent)},
+		{[]string{"GET"}, "/{repo:.+}", http.HandlerFunc(api.getRepository)},
 	})
 
 	hookRouter := api.router.PathPrefix("/webhooks").Subrouter()
 	hookRouter.Use(api.withAuthorizationRequired)
+	hookRouter.Use(api.withManagementRole)
+	hookRouter.Use(api.withUnrestrictedToken)
+	hookRouter.Use(api.withAuthCallout)
 
 	addRoutes(hookRouter, []routingEntry{
 		{[]string{"GET"}, "", http.HandlerFunc(api.getHooks)},
 		{[]string{"POST"}, "", http.HandlerFunc(api.createHook)},
+		{[]string{"GET"}, "/dead-letters", http.HandlerFunc(api.getDeadLetters)},
+		{[]string{"DELETE"}, "/dead-letters/{letter-id}", http.HandlerFunc(api.deleteDeadLetter)},
+		{[]string{"POST"}, "/dead-letters/{letter-id}/redrive", http.HandlerFunc(api.redriveDeadLetter)},
 		{[]string{"GET"}, "/{hook-id}", http.HandlerFunc(api.getHook)},
 		{[]string{"DELETE"}, "/{hook-id}", http.HandlerFunc(api.deleteHook)},
 		{[]string{"PATCH"}, "/{hook-id}", http.HandlerFunc(api.updateHook)},
+		{[]string{"POST"}, "/{hook-id}/rotate-secret", http.HandlerFunc(api.rotateHookSecret)},
 	})
 
 	return &api, nil
@@ -113,6 +238,12 @@ func (api *API) SetConfig(newConfig *config.Config) error {
 	api.configLock.Lock()
 	defer api.configLock.Unlock()
 
+	// The server may still be running, so any sessions created since the
+	// token store was loaded must be saved before it is replaced.
+	if err := api.tokenStore.Save(); err != nil {
+		log.Printf("Could not save sessions: %s", err.Error())
+	}
+
 	return api.setConfigUnsafe(newConfig)
 }
 
@@ -132,7 +263,7 @@ func (api *API) setConfigUnsafe(newConfig *config.Config) error {
 		return err
 	}
 
-	provider, err := newHtpasswdSecretProvider(newConfig.HtpasswdPath)
+	provider, err := credentials.New(newConfig)
 	if err != nil {
 		return err
 	}
@@ -142,10 +273,39 @@ func (api *API) setConfigUnsafe(newConfig *config.Config) error {
 		return err
 	}
 
+	handler, err := buildMiddlewareChain(newConfig, api.router, api.rateLimits)
+	if err != nil {
+		return err
+	}
+
+	// The recorder is kept across reloads, so that its recordings are not
+	// discarded.
+	recorder := api.recorder
+	if recorder == nil {
+		recorder = newRecorder(newConfig.Recording)
+	} else if newConfig.Recording.SampleRate > 0 {
+		recorder.configure(newConfig.Recording)
+	} else {
+		recorder = nil
+	}
+
+	if recorder != nil {
+		handler = recorder.wrap(handler)
+	}
+
+	handler = newTimingMiddleware(newConfig, api.metrics)(handler)
+	handler = newForwardedForMiddleware(newConfig)(handler)
+
 	api.tokenStore = tokenStore
-	api.authenticator.Secrets = provider
+	api.credentials = provider
+	api.callout = newAuthCallout(newConfig.AuthCallout)
+	api.oidc = newOidcVerifier(newConfig.Oidc)
+	api.objects = newObjectStore(newConfig.ObjectStorage)
+	api.blobs = newBlobStore(newConfig.BlobRedirect, api.blobKey, api.objects, newConfig.ExternalUrl)
 	api.config = newConfig
 	api.hookStore = hookStore
+	api.handler = handler
+	api.recorder = recorder
 	return nil
 }
 
@@ -159,8 +319,8 @@ func (api *API) Shutdown(server *http.Server) error {
 	cancel()
 
 	/*
-	 * We have to acquire the lock here because the goroutine in api.Serve()
-	 * acquires the read portion of the lock.
+	 * We have to acquire the lock here because requests still being handled
+	 * acquire the read portion of the lock.
 	 */
 	api.configLock.Lock()
 	defer api.configLock.Unlock()
@@ -168,63 +328,289 @@ func (api *API) Shutdown(server *http.Server) error {
 	return api.tokenStore.Save()
 }
 
+// Serve the API on the configured port.
+//
+// If the port cannot be bound or the server fails, the process exits.
 func (api *API) Serve() *http.Server {
+	api.configLock.RLock()
+	addr := fmt.Sprintf(":%d", api.config.Port)
+	api.configLock.RUnlock()
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatal("ListenAndServe:", err)
+	}
+
+	server, errors := api.ServeListener(listener)
+
+	go func() {
+		if err, ok := <-errors; ok {
+			log.Fatal("ListenAndServe:", err)
+		}
+	}()
+
+	return server
+}
+
+// Serve the API on the given listener.
+//
+// Unlike Serve, errors from the server are not fatal. Instead, they are sent
+// on the returned channel, which is closed once the server stops.
+//
+// The configuration is only locked while handling each request, so SetConfig
+// may be called while the server is running. Changes to the TLS and
+// `proxyProtocol` settings do not take effect until the server is restarted.
+func (api *API) ServeListener(listener net.Listener) (*http.Server, <-chan error) {
 	server := http.Server{
-		Addr:    fmt.Sprintf(":%d", api.config.Port),
-		Handler: loggingMiddleware(api.router),
+		Handler: api,
 	}
 
+	api.configLock.RLock()
+	proxyProtocol := api.config.ProxyProtocol
+	tlsConfig := api.config.TLS
+	api.configLock.RUnlock()
+
+	if proxyProtocol {
+		listener = &proxyProtocolListener{
+			Listener: listener,
+			trusted:  api.isTrustedProxy,
+		}
+	}
+
+	errors := make(chan error, 1)
+
 	go func() {
-		api.configLock.RLock()
-		defer api.configLock.RUnlock()
+		defer close(errors)
 
 		var err error
-		if api.config.UseTLS {
-			err = server.ListenAndServeTLS(api.config.SSLCertificate, api.config.SSLKey)
+		if tlsConfig.Enabled {
+			if tlsConfig.ClientCAPath != "" {
+				clientCAs, err := tlsConfig.LoadClientCAs()
+				if err != nil {
+					listener.Close()
+					errors <- err
+					return
+				}
+
+				server.TLSConfig = &tls.Config{
+					ClientCAs:  clientCAs,
+					ClientAuth: tls.RequireAndVerifyClientCert,
+				}
+			}
+
+			err = server.ServeTLS(listener, tlsConfig.Certificate, tlsConfig.Key)
 		} else {
-			err = server.ListenAndServe()
+			err = server.Serve(listener)
 		}
 
 		if err != http.ErrServerClosed {
-			log.Fatal("ListenAndServe:", err)
+			errors <- err
 		}
 	}()
 
-	return &server
+	return &server, errors
 }
 
 // A middleware for wrapping routes that require a repository.
 //
 // If the requested repository exists, it will be provided through the context
-// as `"repo"`. Otherwise, an appropriate error will be returned.
+// as `"repo"`. Otherwise, an appropriate error will be returned. Repositories
+// that have been marked unavailable receive an HTTP 503. If the request is
+// being timed, the repository records how long each operation takes. This must
+// be used after `withAuthorizationRequired`.
 func (api *API) withRepository(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		repoName := mux.Vars(r)["repo"]
+		info := r.Context().Value("token").(*tokens.Info)
 
 		var repo repositories.Repository
-		var exists bool
 
 		if len(repoName) == 0 {
 			http.Error(w, "Repository not provided.", http.StatusBadRequest)
-		} else if repo, exists = api.config.Repositories[repoName]; !exists {
-			http.Error(w, "Repository not found.", http.StatusNotFound)
+		} else if repo = api.config.FindRepository(repoName); repo == nil {
+			if similar := api.config.SimilarRepositoryName(repoName); similar != "" {
+				http.Error(w,
+					fmt.Sprintf(`Repository not found. Repository names are case-sensitive; did you mean "%s"?`, similar),
+					http.StatusNotFound)
+			} else {
+				http.Error(w, "Repository not found.", http.StatusNotFound)
+			}
+		} else if !info.AllowsRepository(repo.GetName()) {
+			http.Error(w, "This token cannot access this repository.", http.StatusForbidden)
+		} else if api.repositoryUnavailable(repo.GetName()) {
+			if interval := api.config.RepositoryCheckInterval; interval > 0 {
+				w.Header().Set("Retry-After", strconv.Itoa(interval))
+			}
+
+			http.Error(w, "Repository is unavailable.", http.StatusServiceUnavailable)
 		} else {
+			if timing := requestTimingFrom(r); timing != nil {
+				repo = &timedRepository{
+					Repository: repo,
+					timing:     timing,
+				}
+			}
+
 			ctx := context.WithValue(r.Context(), "repo", repo)
 			next.ServeHTTP(w, r.WithContext(ctx))
 		}
 	})
 }
 
+// A middleware for wrapping routes that require token authorization.
+//
+// If the token is valid, its information will be provided through the
+// context as `"token"`. Read-only tokens and tokens with the reader role may
+// only be used for requests that read data (see `isReadRequest`), and tokens
+// with the hook role may only be used to post hook events.
+//
+// If `tls.clientCertIdentity` is configured, requests without a token are
+// authorized by their client certificate instead, as if they presented a
+// token for the certificate's user. It is read-only unless
+// `tls.clientCertRoles` gives the user the manager role. If `oidc` is configured,
+// they may instead present an OpenID Connect bearer token, which grants the
+// access of the user's groups.
 func (api *API) withAuthorizationRequired(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if api.tokenStore.Get(r) == nil {
+		token := api.tokenStore.Get(r)
+		var info *tokens.Info
+
+		if token != nil {
+			info = api.tokenStore.Info(*token)
+		} else if r.Header.Get(PrivateTokenHeader) == "" {
+			if bearer := bearerToken(r); bearer != "" && api.oidc != nil {
+				var err error
+				if info, err = api.oidc.Verify(bearer); err == errOidcUnavailable {
+					http.Error(w, "Bearer tokens cannot be checked right now.", http.StatusServiceUnavailable)
+					return
+				} else if err != nil {
+					log.Printf("Refusing bearer token for %s %s: %s", r.Method, r.URL.Path, err.Error())
+				}
+			} else {
+				info = api.clientCertInfo(r)
+			}
+		}
+
+		if info == nil {
 			http.Error(w, "Authorization failed.", http.StatusUnauthorized)
+		} else if !tokenAllowsRoute(info, r) {
+			http.Error(w, "This token can only be used by repository hooks.", http.StatusForbidden)
+		} else if (info.ReadOnly || api.isReader(info)) && !isReadRequest(r) {
+			http.Error(w, "This token is read-only.", http.StatusForbidden)
+		} else if takeIdentityRateLimit(w, r, info, token) {
+			ctx := context.WithValue(r.Context(), "token", info)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		}
+	})
+}
+
+// A middleware for wrapping routes under a repository.
+//
+// This is like `withAuthorizationRequired`, except that requests that only read
+// data (see `isReadRequest`) from public repositories do not require a token.
+// Such requests are handled as if they presented a read-only token for only
+// that repository.
+func (api *API) withRepositoryAuthorization(next http.Handler) http.Handler {
+	authorized := api.withAuthorizationRequired(next)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		repoName := mux.Vars(r)["repo"]
+		if repo := api.config.FindRepository(repoName); repo != nil {
+			repoName = repo.GetName()
+		}
+
+		if r.Header.Get(PrivateTokenHeader) == "" &&
+			(api.oidc == nil || bearerToken(r) == "") &&
+			api.clientCertUser(r) == "" &&
+			isReadRequest(r) &&
+			api.config.PublicRepositories[repoName] {
+			info := &tokens.Info{
+				Repositories: []string{repoName},
+				ReadOnly:     true,
+			}
+
+			ctx := context.WithValue(r.Context(), "token", info)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		} else {
+			authorized.ServeHTTP(w, r)
+		}
+	})
+}
+
+// A middleware for wrapping routes that manage the server (e.g., webhooks).
+//
+// Tokens with the reader role cannot access these routes. This must be used
+// after `withAuthorizationRequired`.
+func (api *API) withManagementRole(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if info := r.Context().Value("token").(*tokens.Info); api.isReader(info) {
+			http.Error(w, "This token can only read repository data.", http.StatusForbidden)
 		} else {
 			next.ServeHTTP(w, r)
 		}
 	})
 }
 
+// A middleware for wrapping routes that may only be used by tokens that can
+// write to repositories, even when they only read data (e.g., because they are
+// expensive).
+//
+// Read-only tokens, tokens with the reader role, and requests without a token
+// for public repositories cannot access these routes. This must be used after
+// `withAuthorizationRequired` or `withRepositoryAuthorization`.
+func (api *API) withWriteRole(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if info := r.Context().Value("token").(*tokens.Info); info.ReadOnly || api.isReader(info) {
+			http.Error(w, "This token is read-only.", http.StatusForbidden)
+		} else {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// Return whether or not the address belongs to a trusted proxy.
+//
+// Unlike request handlers, this is called without the configuration locked,
+// so it acquires the lock itself.
+func (api *API) isTrustedProxy(ip net.IP) bool {
+	api.configLock.RLock()
+	defer api.configLock.RUnlock()
+
+	return api.config.IsTrustedProxy(ip)
+}
+
+// Return whether or not the token has the reader role.
+//
+// Tokens created for users who have since been added to `readOnlyUsers` are
+// also treated as readers.
+func (api *API) isReader(info *tokens.Info) bool {
+	return info.Role == tokens.RoleReader ||
+		(info.User != "" && api.config.IsReadOnlyUser(info.User))
+}
+
+// A middleware for wrapping routes that are not specific to a repository.
+//
+// Tokens restricted to specific repositories cannot access these routes. This
+// must be used after `withAuthorizationRequired`.
+func (api *API) withUnrestrictedToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if info := r.Context().Value("token").(*tokens.Info); !info.Unrestricted() {
+			http.Error(w, "This token is restricted to specific repositories.", http.StatusForbidden)
+		} else {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// Return a link to a path on the server.
+//
+// If `externalUrl` is configured, the link is absolute, so that it works for
+// clients that reach the server through a proxy. Otherwise, the path is
+// returned unchanged.
+func (api *API) externalLink(path string) string {
+	return api.config.ExternalUrl + path
+}
+
 // Serve a request.
 //
 // This is only meant for unit tests since it acquires a lock for every request
@@ -233,7 +619,7 @@ func (api *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	api.configLock.RLock()
 	defer api.configLock.RUnlock()
 
-	loggingMiddleware(api.router).ServeHTTP(w, r)
+	api.handler.ServeHTTP(w, r)
 }
 
 // Return the token store.
@@ -242,3 +628,11 @@ func (api *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 func (api *API) GetTokenStore() *tokens.TokenStore {
 	return &api.tokenStore
 }
+
+// Return the number of configured webhooks.
+func (api *API) NumWebhooks() int {
+	api.hookStoreLock.RLock()
+	defer api.hookStoreLock.RUnlock()
+
+	return len(api.hookStore)
+}
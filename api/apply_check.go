@@ -0,0 +1,97 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"github.com/reviewboard/rb-gateway/repositories"
+)
+
+// The path of the route that checks whether a patch applies, under `/repos`.
+//
+// Although this route is a POST, it only reads the repository. See
+// isReadRequest().
+const applyCheckPath = "/{repo:.+}/commits/{commit-id}/apply-check"
+
+// Return whether or not a patch applies cleanly at a commit.
+//
+// The body is a unified diff, as created by `git diff` or `hg diff`, and is
+// checked with `git apply --check`, so the Git executable must be installed.
+// The response says whether every file in the diff applies and, for each file
+// that does not, why not, including the line that each conflicting hunk was
+// expected at and the lines it expected to find there. The commit may also be
+// a symbolic ref.
+//
+// This returns an HTTP 400 if the diff cannot be parsed, or an HTTP 503 if
+// the configured `memoryBudget` is exhausted.
+//
+// URL: `/repos/<repo>/commits/<commit-id>/apply-check`
+func (api *API) checkPatch(w http.ResponseWriter, r *http.Request) {
+	repo := r.Context().Value("repo").(repositories.Repository)
+	commitId := mux.Vars(r)["commit-id"]
+
+	if len(commitId) == 0 {
+		http.Error(w, "Commit ID not specified.", http.StatusBadRequest)
+		return
+	}
+
+	body, ok := api.readRequestBody(w, r)
+	if !ok || !reserveMemory(w, r, int64(len(body))) {
+		return
+	}
+
+	resolved, err := repo.ResolveRef(commitId)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Could not find commit \"%s\": %s", commitId, err.Error()),
+			http.StatusNotFound)
+		return
+	}
+
+	check, err := repo.CheckPatch(resolved, body)
+	if _, invalid := err.(*repositories.InvalidPatchErr); invalid || err == repositories.EmptyPatchErr {
+		http.Error(w, fmt.Sprintf("Could not parse patch: %s", err.Error()), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(w, fmt.Sprintf("Could not check patch at commit \"%s\": %s", commitId, err.Error()),
+			http.StatusInternalServerError)
+		return
+	}
+
+	response, err := json.Marshal(struct {
+		Commit string `json:"commit"`
+		*repositories.PatchCheck
+	}{resolved, check})
+	if err != nil {
+		log.Printf("Could not serialize patch check: %s", err.Error())
+		http.Error(w, "An unexpected error occurred.", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(response)
+}
+
+// Return whether or not a request only reads data.
+//
+// GET and HEAD requests only read data, as do requests to check whether a
+// patch applies, which are POSTs only because they have a body.
+func isReadRequest(r *http.Request) bool {
+	if r.Method == "GET" || r.Method == "HEAD" {
+		return true
+	} else if r.Method != "POST" {
+		return false
+	}
+
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return false
+	}
+
+	template, err := route.GetPathTemplate()
+	return err == nil && strings.HasSuffix(template, applyCheckPath)
+}
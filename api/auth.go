@@ -1,58 +1,40 @@
 package api
 
 import (
-	"encoding/csv"
-	"errors"
-	"os"
+	"log"
+	"net/http"
 
 	auth "github.com/abbot/go-http-auth"
 )
 
-// Create a new secret provider for htpasswd files.
-//
-// Unlike `auth.HtpasswdFileProvider`, this loads the entire file up front and
-// (therefore) does not handle reloads. The one provided by `go-http-auth` does
-// not do any I/O upfront and will trigger a `panic` if we attempt to
-// authenticate and the file does not exist.
-//
-// If the user wants to reload the `htpasswd` file, they need to trigger a full
-// config reload (e.g., with `SIGHUP`).
-func newHtpasswdSecretProvider(path string) (auth.SecretProvider, error) {
-	f, err := os.Open(path)
-	if err != nil {
-		return nil, err
-	}
-
-	defer f.Close()
+// The realm presented to clients that must authenticate with basic auth.
+const basicAuthRealm = "RB Gateway"
 
-	csv := csv.NewReader(f)
-	csv.Comma = ':'
-	csv.Comment = '#'
-	csv.TrimLeadingSpace = true
-
-	records, err := csv.ReadAll()
-	if err != nil {
-		return nil, err
-	}
+// Wrap a handler that requires basic auth credentials.
+//
+// The credentials are checked by the configured provider. If they are missing
+// or incorrect, the client is asked to authenticate. If the provider cannot
+// check them (e.g., its backend is unavailable), the error is logged and the
+// request fails, rather than being treated as a failed login.
+func (api *API) withBasicAuth(handler auth.AuthenticatedHandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username, password, ok := r.BasicAuth()
 
-	secrets := make(map[string]string)
-	for _, record := range records {
-		if len(record) != 2 {
-			return nil, errors.New("Malformed htpasswd file")
+		if ok {
+			var err error
+			if ok, err = api.credentials.Authenticate(username, password); err != nil {
+				log.Printf(`Could not check the credentials for user "%s": %s`, username, err.Error())
+				http.Error(w, "An unexpected error occurred.", http.StatusInternalServerError)
+				return
+			}
 		}
 
-		secrets[record[0]] = record[1]
-	}
-
-	provider := func(user, realm string) string {
-		secret, ok := secrets[user]
-
-		if ok {
-			return secret
-		} else {
-			return ""
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Basic realm="`+basicAuthRealm+`"`)
+			http.Error(w, "401 Unauthorized", http.StatusUnauthorized)
+			return
 		}
-	}
 
-	return provider, nil
+		handler(w, &auth.AuthenticatedRequest{Request: *r, Username: username})
+	}
 }
@@ -0,0 +1,31 @@
+package api
+
+// Mark a repository as unavailable.
+//
+// Requests for the repository receive an HTTP 503 until it is marked
+// available again. This is used when the repository's path has disappeared
+// (e.g., because the file system it is on was unmounted), so that clients are
+// told to retry rather than that the repository does not exist. The reason is
+// not given to clients, since it may reveal paths on the server.
+func (api *API) SetRepositoryUnavailable(name string) {
+	api.unavailableLock.Lock()
+	defer api.unavailableLock.Unlock()
+
+	api.unavailable[name] = true
+}
+
+// Mark a repository as available again.
+func (api *API) SetRepositoryAvailable(name string) {
+	api.unavailableLock.Lock()
+	defer api.unavailableLock.Unlock()
+
+	delete(api.unavailable, name)
+}
+
+// Return whether or not a repository is unavailable.
+func (api *API) repositoryUnavailable(name string) bool {
+	api.unavailableLock.RLock()
+	defer api.unavailableLock.RUnlock()
+
+	return api.unavailable[name]
+}
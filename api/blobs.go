@@ -0,0 +1,377 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/reviewboard/rb-gateway/config"
+	"github.com/reviewboard/rb-gateway/repositories"
+)
+
+const (
+	// The route that serves blobs when no base URL is configured.
+	blobRoutePrefix = "/blobs"
+
+	// The prefix of temporary files in the blob cache directory.
+	blobTempPrefix = ".blob-"
+
+	// How often unused blobs are removed.
+	blobSweepInterval = time.Hour
+)
+
+// A store of large files that clients are redirected to.
+//
+// Each blob is named for a key derived from the ID of the object it holds
+// (e.g., a Git blob ID, or a commit and path), so that a file that is already
+// stored can be redirected to without reading it, and is only stored once.
+// Files without such an ID are named for the SHA-256 hash of their contents.
+// Clients are redirected to a signed URL for the blob that expires after the
+// configured TTL. Blobs are served by `getBlob`, or by an external server at
+// the configured base URL that is populated from the cache directory.
+//
+// If object storage is configured, blobs are also uploaded to it in the
+// background. Once a blob has been uploaded, clients are redirected to a
+// pre-signed URL for it instead.
+type blobStore struct {
+	config  config.BlobRedirectConfig
+	key     []byte
+	objects *objectStore
+
+	lock      sync.Mutex
+	lastSweep time.Time
+}
+
+// Return a new blob store for the configuration.
+//
+// If the configuration has no secret, URLs are signed with `defaultKey`. If it
+// has no base URL, blobs are served by `getBlob` under `externalUrl`, which may
+// be empty for URLs relative to the server. If redirects are disabled, nil is
+// returned.
+func newBlobStore(cfg config.BlobRedirectConfig, defaultKey []byte, objects *objectStore, externalUrl string) *blobStore {
+	if !cfg.Enabled() {
+		return nil
+	}
+
+	key := defaultKey
+	if cfg.Secret != "" {
+		key = []byte(cfg.Secret)
+	}
+
+	if cfg.BaseUrl == "" {
+		cfg.BaseUrl = externalUrl + blobRoutePrefix
+	}
+
+	return &blobStore{
+		config:  cfg,
+		key:     key,
+		objects: objects,
+	}
+}
+
+// Return whether or not a file of the given size should be redirected.
+//
+// Files of unknown size (i.e., a negative size) are never redirected.
+func (s *blobStore) shouldRedirect(size int64) bool {
+	return s != nil && size >= 0 && size >= s.config.MinSize
+}
+
+// Return the key of the blob holding an object.
+//
+// The parts identify the object, and must identify the same contents forever
+// (e.g., the kind of ID and a full object ID). The key is hashed so that it
+// has the same form as a content hash.
+func blobKey(parts ...string) string {
+	hash := sha256.Sum256([]byte(strings.Join(parts, "\x00")))
+	return hex.EncodeToString(hash[:])
+}
+
+// Return the key of the blob holding a file, identified by its object ID.
+//
+// Only full object IDs identify the same contents forever, so an empty key is
+// returned for other IDs, and for repositories whose file IDs are paths.
+func fileBlobKey(repo repositories.Repository, objectId string) string {
+	if !hasFileObjectIds(repo) || !isFullId(objectId) {
+		return ""
+	}
+
+	return blobKey("file", repo.GetScm(), objectId)
+}
+
+// Return the key of the blob holding a file at a commit.
+//
+// A file at a full commit ID always has the same contents. An empty key is
+// returned for other commit IDs.
+func commitFileBlobKey(repo repositories.Repository, commitId, path string) string {
+	if !isFullId(commitId) {
+		return ""
+	}
+
+	return blobKey("commit", repo.GetScm(), commitId, path)
+}
+
+// Return the key of the blob holding a large file.
+func largeFileBlobKey(largeFile *repositories.LargeFile) string {
+	return blobKey("largefile", largeFile.Id)
+}
+
+// Return the object storage key of the blob with the given key.
+func blobObjectKey(key string) string {
+	return "blobs/" + key
+}
+
+// Return the path of the blob with the given key.
+func (s *blobStore) path(key string) string {
+	return filepath.Join(s.config.CacheDir, key)
+}
+
+// Return the URL of a stored blob, or an empty string if it is not stored.
+//
+// A blob in the cache directory is marked as used, since blobs that were used
+// recently are not removed, and so must not be removed while a new URL for
+// it is still valid.
+func (s *blobStore) locate(key string) (string, error) {
+	if s.objects != nil {
+		objectKey := blobObjectKey(key)
+
+		if exists, err := s.objects.exists(objectKey); err != nil {
+			log.Printf(`Could not check for object "%s": %s`, objectKey, err.Error())
+		} else if exists {
+			return s.objects.presign(objectKey), nil
+		}
+	}
+
+	now := time.Now()
+	if err := os.Chtimes(s.path(key), now, now); os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+
+	return s.url(key), nil
+}
+
+// Write the contents of a reader to the store under a key, unless a blob with
+// the key is already stored, returning the URL of the blob.
+//
+// If the key is empty, the blob is named for the hash of its contents. If
+// object storage is configured, the blob is uploaded to it in the background,
+// and is served from the cache directory until it has been uploaded.
+func (s *blobStore) store(key string, reader io.Reader) (string, error) {
+	if key != "" {
+		if url, err := s.locate(key); err != nil || url != "" {
+			return url, err
+		}
+	}
+
+	if err := os.MkdirAll(s.config.CacheDir, 0700); err != nil {
+		return "", err
+	}
+
+	temp, err := ioutil.TempFile(s.config.CacheDir, blobTempPrefix)
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(temp, hash), reader)
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		os.Remove(temp.Name())
+		return "", err
+	}
+
+	if key == "" {
+		key = hex.EncodeToString(hash.Sum(nil))
+	}
+
+	path := s.path(key)
+
+	if _, err = os.Stat(path); err == nil {
+		os.Remove(temp.Name())
+
+		now := time.Now()
+		if err = os.Chtimes(path, now, now); err != nil {
+			return "", err
+		}
+	} else if err = os.Rename(temp.Name(), path); err != nil {
+		os.Remove(temp.Name())
+		return "", err
+	}
+
+	if s.objects != nil {
+		header := http.Header{}
+		header.Set("Content-Type", "application/octet-stream")
+
+		s.objects.uploadInBackground(blobObjectKey(key), header, func(w io.Writer) error {
+			file, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+
+			_, err = io.Copy(w, file)
+			return err
+		})
+	}
+
+	s.sweep()
+	return s.url(key), nil
+}
+
+// Remove the blobs that have not been used within the configured maximum
+// age.
+//
+// This only scans the cache directory once per `blobSweepInterval`.
+func (s *blobStore) sweep() {
+	now := time.Now()
+
+	s.lock.Lock()
+	if now.Sub(s.lastSweep) < blobSweepInterval {
+		s.lock.Unlock()
+		return
+	}
+	s.lastSweep = now
+	s.lock.Unlock()
+
+	entries, err := ioutil.ReadDir(s.config.CacheDir)
+	if err != nil {
+		log.Printf(`Could not read blob cache directory "%s": %s`, s.config.CacheDir, err.Error())
+		return
+	}
+
+	maxAge := time.Duration(s.config.MaxAge) * time.Second
+	for _, entry := range entries {
+		if !entry.IsDir() && now.Sub(entry.ModTime()) > maxAge {
+			os.Remove(filepath.Join(s.config.CacheDir, entry.Name()))
+		}
+	}
+}
+
+// Return the signature for a blob URL.
+func (s *blobStore) sign(hash string, expires int64) string {
+	mac := hmac.New(sha256.New, s.key)
+	fmt.Fprintf(mac, "%s:%d", hash, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Return a signed URL for the blob with the given hash in the cache
+// directory.
+func (s *blobStore) url(hash string) string {
+	expires := time.Now().Add(time.Duration(s.config.TTL) * time.Second).Unix()
+
+	return fmt.Sprintf("%s/%s?expires=%d&signature=%s", s.config.BaseUrl, hash, expires, s.sign(hash, expires))
+}
+
+// Return whether or not a blob URL's signature is valid and unexpired.
+func (s *blobStore) verify(hash, expires, signature string) bool {
+	expiresAt, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || time.Now().Unix() > expiresAt {
+		return false
+	}
+
+	return hmac.Equal([]byte(signature), []byte(s.sign(hash, expiresAt)))
+}
+
+// Redirect the client to a blob with the given contents, if they are large
+// enough.
+//
+// The blob is stored under the key (see blobKey()), and the contents are only
+// read if it is not already stored. If the key is empty, the contents are
+// always read and the blob is named for their hash.
+//
+// If true is returned, a response has been written: either the redirect or,
+// if the contents could not be stored, an error. Otherwise, the caller must
+// send the contents itself.
+func (api *API) redirectToBlob(w http.ResponseWriter, r *http.Request, key string, reader io.Reader, size int64) bool {
+	if !api.blobs.shouldRedirect(size) {
+		return false
+	}
+
+	url, err := api.blobs.store(key, reader)
+	if err != nil {
+		log.Printf("Could not store blob: %s", err.Error())
+		http.Error(w, "An unexpected error occurred.", http.StatusInternalServerError)
+		return true
+	}
+
+	http.Redirect(w, r, url, http.StatusFound)
+	return true
+}
+
+// Redirect the client to a blob that is already stored under the key, if the
+// file is large enough.
+//
+// This lets a file be redirected to before it is read. If false is returned,
+// nothing has been written, and the caller must send the file itself (or
+// store it with redirectToBlob()).
+func (api *API) redirectToStoredBlob(w http.ResponseWriter, r *http.Request, key string, size int64) bool {
+	if key == "" || !api.blobs.shouldRedirect(size) {
+		return false
+	}
+
+	url, err := api.blobs.locate(key)
+	if err != nil {
+		log.Printf("Could not check for blob: %s", err.Error())
+		return false
+	} else if url == "" {
+		return false
+	}
+
+	http.Redirect(w, r, url, http.StatusFound)
+	return true
+}
+
+// Return a blob that a client was redirected to.
+//
+// No token is required, since only clients that were authorized to read the
+// file are given a signed URL for it. This returns an HTTP 403 if the URL's
+// signature is invalid or has expired, and single byte ranges are supported
+// via the `Range` header.
+//
+// URL: `/blobs/<hash>?expires=<expires>&signature=<signature>`
+func (api *API) getBlob(w http.ResponseWriter, r *http.Request) {
+	hash := mux.Vars(r)["hash"]
+	query := r.URL.Query()
+
+	if api.blobs == nil {
+		http.Error(w, "Blob redirects are not enabled.", http.StatusNotFound)
+		return
+	} else if !api.blobs.verify(hash, query.Get("expires"), query.Get("signature")) {
+		http.Error(w, "This blob URL is invalid or has expired.", http.StatusForbidden)
+		return
+	}
+
+	file, err := os.Open(api.blobs.path(hash))
+	if err != nil {
+		http.Error(w, "Blob not found.", http.StatusNotFound)
+		return
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		log.Printf(`Could not read blob "%s": %s`, hash, err.Error())
+		http.Error(w, "An unexpected error occurred.", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, r, "", stat.ModTime(), file)
+}
@@ -0,0 +1,275 @@
+package api
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/reviewboard/rb-gateway/api/tokens"
+	"github.com/reviewboard/rb-gateway/config"
+	"github.com/reviewboard/rb-gateway/repositories"
+	"github.com/reviewboard/rb-gateway/repositories/hooks"
+)
+
+const (
+	// The action for requests that read repository data.
+	calloutActionRead = "read"
+
+	// The action for requests under a repository that change something
+	// (e.g., sending a test event).
+	calloutActionWrite = "write"
+
+	// The action for requests that manage the server (e.g., webhooks).
+	calloutActionManage = "manage"
+
+	// The maximum size of a response from the auth callout, in bytes.
+	maxCalloutResponseSize = 64 * 1024
+)
+
+// A request for an authorization decision, as sent to the auth callout.
+type calloutRequest struct {
+	// The hex-encoded SHA-256 hash of the token, so that the endpoint can
+	// tell tokens apart without being able to use them. This is empty for
+	// anonymous requests for public repositories.
+	Token string `json:"token"`
+
+	// The user the token was created for, if any.
+	User string `json:"user"`
+
+	// The name of the repository, if the request is for one.
+	Repository string `json:"repository,omitempty"`
+
+	// What the request does (`read`, `write`, or `manage`).
+	Action string `json:"action"`
+
+	// The method and path of the request.
+	Method string `json:"method"`
+	Path   string `json:"path"`
+}
+
+// An authorization decision from the auth callout.
+type calloutResponse struct {
+	// Whether or not the request is allowed.
+	Allow bool `json:"allow"`
+
+	// An optional explanation for the client when the request is denied.
+	Reason string `json:"reason"`
+}
+
+// Statistics for the auth callout since the configuration was loaded.
+type AuthCalloutMetrics struct {
+	// The requests made to the endpoint.
+	Requests LatencyMetrics `json:"requests"`
+
+	// The number of requests to the endpoint that did not return a decision.
+	Errors int64 `json:"errors"`
+
+	// The number of decisions that were and were not found in the cache.
+	CacheHits   int64 `json:"cache_hits"`
+	CacheMisses int64 `json:"cache_misses"`
+
+	// The number of decisions in the cache.
+	CacheEntries int `json:"cache_entries"`
+}
+
+// A client for an external endpoint that makes authorization decisions.
+//
+// Tokens are still checked by rb-gateway first. The callout can only deny
+// requests that the token would allow, not allow requests it would deny.
+type authCallout struct {
+	config config.AuthCalloutConfig
+	client *http.Client
+
+	// The cached decisions, if caching is enabled.
+	cache *calloutCache
+
+	// A lock for reading from/writing to metrics.
+	lock    sync.Mutex
+	metrics AuthCalloutMetrics
+}
+
+// Return a new auth callout for the configuration.
+//
+// If the auth callout is disabled, nil is returned.
+func newAuthCallout(cfg config.AuthCalloutConfig) *authCallout {
+	if !cfg.Enabled() {
+		return nil
+	}
+
+	callout := &authCallout{
+		config: cfg,
+		client: &http.Client{
+			Timeout: time.Duration(cfg.Timeout) * time.Second,
+		},
+	}
+
+	if cfg.CacheTTL > 0 {
+		callout.cache = newCalloutCache(time.Duration(cfg.CacheTTL)*time.Second, cfg.CacheSize)
+	}
+
+	return callout
+}
+
+// Return the decision for a request.
+//
+// Cached decisions are used if possible. Otherwise, the endpoint is asked and
+// its decision is cached. Failures are not cached, so that the endpoint is
+// asked again on the next request.
+func (c *authCallout) decide(request calloutRequest) (calloutResponse, error) {
+	key := calloutCacheKey{request.Token, request.User, request.Repository, request.Action}
+
+	if c.cache != nil {
+		decision, ok := c.cache.get(key)
+
+		c.lock.Lock()
+		if ok {
+			c.metrics.CacheHits++
+		} else {
+			c.metrics.CacheMisses++
+		}
+		c.lock.Unlock()
+
+		if ok {
+			return decision, nil
+		}
+	}
+
+	start := time.Now()
+	decision, err := c.check(request)
+
+	c.lock.Lock()
+	c.metrics.Requests.add(time.Since(start))
+	if err != nil {
+		c.metrics.Errors++
+	}
+	c.lock.Unlock()
+
+	if err == nil && c.cache != nil {
+		c.cache.put(key, decision)
+	}
+
+	return decision, err
+}
+
+// Return a copy of the metrics.
+func (c *authCallout) snapshot() AuthCalloutMetrics {
+	c.lock.Lock()
+	metrics := c.metrics
+	c.lock.Unlock()
+
+	if c.cache != nil {
+		metrics.CacheEntries = c.cache.len()
+	}
+
+	return metrics
+}
+
+// Ask the endpoint whether a request is allowed.
+func (c *authCallout) check(request calloutRequest) (calloutResponse, error) {
+	var decision calloutResponse
+
+	body, err := json.Marshal(request)
+	if err != nil {
+		return decision, err
+	}
+
+	r, err := http.NewRequest("POST", c.config.Url, bytes.NewReader(body))
+	if err != nil {
+		return decision, err
+	}
+
+	r.Header.Set("Content-Type", "application/json")
+
+	if c.config.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(c.config.Secret))
+		mac.Write(body)
+		r.Header.Set(hooks.SignatureHeaderSHA256, hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	rsp, err := c.client.Do(r)
+	if err != nil {
+		return decision, err
+	}
+
+	defer rsp.Body.Close()
+
+	if rsp.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, io.LimitReader(rsp.Body, maxCalloutResponseSize))
+		return decision, fmt.Errorf("unexpected response status %d", rsp.StatusCode)
+	}
+
+	if err = json.NewDecoder(io.LimitReader(rsp.Body, maxCalloutResponseSize)).Decode(&decision); err != nil {
+		return decision, fmt.Errorf("could not parse response: %s", err.Error())
+	}
+
+	return decision, nil
+}
+
+// A middleware that asks the auth callout whether each request is allowed.
+//
+// This does nothing unless `authCallout` is configured. It must be used after
+// `withAuthorizationRequired` and, for routes under a repository, after
+// `withRepository`, so that the decision is only requested for requests that
+// the token allows.
+func (api *API) withAuthCallout(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if api.callout == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		request := calloutRequest{
+			User:   r.Context().Value("token").(*tokens.Info).User,
+			Action: calloutActionManage,
+			Method: r.Method,
+			Path:   r.URL.Path,
+		}
+
+		if token := api.tokenStore.Get(r); token != nil {
+			hash := sha256.Sum256([]byte(*token))
+			request.Token = hex.EncodeToString(hash[:])
+		} else if bearer := bearerToken(r); bearer != "" && api.oidc != nil {
+			hash := sha256.Sum256([]byte(bearer))
+			request.Token = hex.EncodeToString(hash[:])
+		}
+
+		if repo, ok := r.Context().Value("repo").(repositories.Repository); ok {
+			request.Repository = repo.GetName()
+
+			if isReadRequest(r) {
+				request.Action = calloutActionRead
+			} else {
+				request.Action = calloutActionWrite
+			}
+		}
+
+		decision, err := api.callout.decide(request)
+		if err != nil {
+			log.Printf(`Could not check authorization for %s %s: %s`, r.Method, r.URL.Path, err.Error())
+
+			if !api.config.AuthCallout.FailOpen {
+				http.Error(w, "Could not check authorization.", http.StatusServiceUnavailable)
+				return
+			}
+		} else if !decision.Allow {
+			reason := decision.Reason
+			if reason == "" {
+				reason = "Access denied."
+			}
+
+			http.Error(w, reason, http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
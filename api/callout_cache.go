@@ -0,0 +1,155 @@
+package api
+
+import (
+	"container/list"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// The request attributes that a cached decision from the auth callout
+// applies to.
+//
+// The user is part of the key because requests authenticated by client
+// certificate have no token, so the token alone does not tell them apart.
+type calloutCacheKey struct {
+	token      string
+	user       string
+	repository string
+	action     string
+}
+
+// A decision in the calloutCache.
+type calloutCacheEntry struct {
+	key      calloutCacheKey
+	decision calloutResponse
+	expires  time.Time
+}
+
+// A cache of decisions from the auth callout.
+//
+// Decisions are keyed by token, user, repository, and action, so requests that
+// only differ by path (e.g., reading two files from the same repository) share
+// a decision. Decisions expire after a fixed time, and the least recently used
+// decision is evicted once the cache is full.
+type calloutCache struct {
+	lock    sync.Mutex
+	ttl     time.Duration
+	size    int
+	order   *list.List
+	entries map[calloutCacheKey]*list.Element
+}
+
+// Create a new cache holding up to `size` decisions for `ttl` each.
+func newCalloutCache(ttl time.Duration, size int) *calloutCache {
+	return &calloutCache{
+		ttl:     ttl,
+		size:    size,
+		order:   list.New(),
+		entries: make(map[calloutCacheKey]*list.Element),
+	}
+}
+
+// Return the cached decision for a request, if there is one.
+func (c *calloutCache) get(key calloutCacheKey) (calloutResponse, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		return calloutResponse{}, false
+	}
+
+	entry := element.Value.(*calloutCacheEntry)
+	if !time.Now().Before(entry.expires) {
+		c.order.Remove(element)
+		delete(c.entries, key)
+		return calloutResponse{}, false
+	}
+
+	c.order.MoveToFront(element)
+	return entry.decision, true
+}
+
+// Cache the decision for a request.
+func (c *calloutCache) put(key calloutCacheKey, decision calloutResponse) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	entry := &calloutCacheEntry{key, decision, time.Now().Add(c.ttl)}
+
+	if element, ok := c.entries[key]; ok {
+		element.Value = entry
+		c.order.MoveToFront(element)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(entry)
+
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*calloutCacheEntry).key)
+	}
+}
+
+// Remove cached decisions.
+//
+// Only decisions for the given token hash and repository are removed. If
+// either is empty, decisions for any token or repository are removed. The
+// number of decisions removed is returned.
+func (c *calloutCache) invalidate(token, repository string) int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	removed := 0
+	for key, element := range c.entries {
+		if (token == "" || key.token == token) && (repository == "" || key.repository == repository) {
+			c.order.Remove(element)
+			delete(c.entries, key)
+			removed++
+		}
+	}
+
+	return removed
+}
+
+// Return the number of cached decisions.
+func (c *calloutCache) len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.order.Len()
+}
+
+// Remove cached decisions from the auth callout.
+//
+// The `token` (the hex-encoded SHA-256 hash of a token, as sent to the
+// callout) and `repository` query parameters limit the decisions that are
+// removed. Without them, every decision is removed.
+//
+// This returns an HTTP 404 if the auth callout is not configured to cache
+// decisions.
+//
+// URL: `/auth-callout/cache`
+func (api *API) invalidateCalloutCache(w http.ResponseWriter, r *http.Request) {
+	if api.callout == nil || api.callout.cache == nil {
+		http.Error(w, "Decisions from the auth callout are not cached.", http.StatusNotFound)
+		return
+	}
+
+	query := r.URL.Query()
+	removed := api.callout.cache.invalidate(query.Get("token"), query.Get("repository"))
+
+	response, err := json.Marshal(map[string]int{"invalidated": removed})
+	if err != nil {
+		log.Printf("Could not serialize response: %s", err.Error())
+		http.Error(w, "An unexpected error occurred.", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(response)
+}
@@ -0,0 +1,204 @@
+package api_test
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/reviewboard/rb-gateway/api"
+	"github.com/reviewboard/rb-gateway/config"
+	"github.com/reviewboard/rb-gateway/repositories/hooks"
+)
+
+func TestAuthCallout(t *testing.T) {
+	assert := assert.New(t)
+
+	testSetup := setupRoutesTest(t)
+	defer testSetup.cleanup(t)
+
+	secret := strings.Repeat("s", 20)
+
+	var lock sync.Mutex
+	var requests []map[string]string
+	broken := false
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		assert.Nil(err)
+
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(body)
+		assert.Equal(hex.EncodeToString(mac.Sum(nil)), r.Header.Get(hooks.SignatureHeaderSHA256))
+
+		var request map[string]string
+		assert.Nil(json.Unmarshal(body, &request))
+
+		lock.Lock()
+		requests = append(requests, request)
+		fail := broken
+		lock.Unlock()
+
+		if fail {
+			http.Error(w, "Oops", http.StatusInternalServerError)
+		} else if request["action"] == "read" {
+			w.Write([]byte(`{"allow": true}`))
+		} else {
+			w.Write([]byte(`{"allow": false, "reason": "Ask an administrator."}`))
+		}
+	}))
+	defer server.Close()
+
+	testSetup.config.AuthCallout = config.AuthCalloutConfig{
+		Url:     server.URL,
+		Secret:  secret,
+		Timeout: 5,
+	}
+
+	handler, err := api.New(testSetup.config)
+	assert.Nil(err)
+
+	// Creating a session does not use the callout.
+	rsp := serveRequest(t, handler, "POST", "/session", "", nil)
+	assert.Equal(http.StatusOK, rsp.Code)
+
+	var session api.Session
+	assert.Nil(json.Unmarshal(rsp.Body.Bytes(), &session))
+	assert.Equal(0, len(requests))
+
+	tokenHash := sha256.Sum256([]byte(session.PrivateToken))
+
+	rsp = serveRequest(t, handler, "GET", "/repos/repo/branches", session.PrivateToken, nil)
+	assert.Equal(http.StatusOK, rsp.Code)
+
+	rsp = serveRequest(t, handler, "GET", "/webhooks", session.PrivateToken, nil)
+	assert.Equal(http.StatusForbidden, rsp.Code)
+	assert.Equal("Ask an administrator.\n", rsp.Body.String())
+
+	assert.Equal([]map[string]string{
+		{
+			"token":      hex.EncodeToString(tokenHash[:]),
+			"user":       "username",
+			"repository": "repo",
+			"action":     "read",
+			"method":     "GET",
+			"path":       "/repos/repo/branches",
+		},
+		{
+			"token":  hex.EncodeToString(tokenHash[:]),
+			"user":   "username",
+			"action": "manage",
+			"method": "GET",
+			"path":   "/webhooks",
+		},
+	}, requests)
+
+	// Requests the token does not allow are refused without asking.
+	rsp = serveRequest(t, handler, "GET", "/repos/repo/branches", strings.Repeat("x", len(session.PrivateToken)), nil)
+	assert.Equal(http.StatusUnauthorized, rsp.Code)
+	assert.Equal(2, len(requests))
+
+	// Requests are refused when no decision can be made, unless the callout
+	// fails open.
+	lock.Lock()
+	broken = true
+	lock.Unlock()
+
+	rsp = serveRequest(t, handler, "GET", "/repos/repo/branches", session.PrivateToken, nil)
+	assert.Equal(http.StatusServiceUnavailable, rsp.Code)
+
+	testSetup.config.AuthCallout.FailOpen = true
+	handler, err = api.New(testSetup.config)
+	assert.Nil(err)
+
+	rsp = serveRequest(t, handler, "POST", "/session", "", nil)
+	assert.Nil(json.Unmarshal(rsp.Body.Bytes(), &session))
+
+	rsp = serveRequest(t, handler, "GET", "/repos/repo/branches", session.PrivateToken, nil)
+	assert.Equal(http.StatusOK, rsp.Code)
+}
+
+func TestAuthCalloutCache(t *testing.T) {
+	assert := assert.New(t)
+
+	testSetup := setupRoutesTest(t)
+	defer testSetup.cleanup(t)
+
+	var lock sync.Mutex
+	calls := 0
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		calls++
+		lock.Unlock()
+
+		w.Write([]byte(`{"allow": true}`))
+	}))
+	defer server.Close()
+
+	numCalls := func() int {
+		lock.Lock()
+		defer lock.Unlock()
+
+		return calls
+	}
+
+	testSetup.config.AuthCallout = config.AuthCalloutConfig{
+		Url:       server.URL,
+		Timeout:   5,
+		CacheTTL:  60,
+		CacheSize: 10,
+	}
+
+	handler, err := api.New(testSetup.config)
+	assert.Nil(err)
+
+	token, err := (*handler.GetTokenStore()).New()
+	assert.Nil(err)
+
+	// Requests for the same repository and action share a decision.
+	for _, url := range []string{"/repos/repo/branches", "/repos/repo/refs", "/repos/repo/branches"} {
+		rsp := serveRequest(t, handler, "GET", url, *token, nil)
+		assert.Equal(http.StatusOK, rsp.Code)
+	}
+
+	assert.Equal(1, numCalls())
+
+	rsp := serveRequest(t, handler, "GET", "/webhooks", *token, nil)
+	assert.Equal(http.StatusOK, rsp.Code)
+	assert.Equal(2, numCalls())
+
+	rsp = serveRequest(t, handler, "GET", "/debug/metrics", *token, nil)
+	assert.Equal(http.StatusOK, rsp.Code)
+
+	var metrics api.Metrics
+	assert.Nil(json.Unmarshal(rsp.Body.Bytes(), &metrics))
+	if assert.NotNil(metrics.AuthCallout) {
+		assert.Equal(int64(2), metrics.AuthCallout.Requests.Count)
+		assert.Equal(int64(0), metrics.AuthCallout.Errors)
+		assert.Equal(int64(2), metrics.AuthCallout.CacheHits)
+		assert.Equal(int64(2), metrics.AuthCallout.CacheMisses)
+		assert.Equal(2, metrics.AuthCallout.CacheEntries)
+	}
+
+	// Invalidating the decisions for a repository leaves the others.
+	rsp = serveRequest(t, handler, "DELETE", "/auth-callout/cache?repository=repo", *token, nil)
+	assert.Equal(http.StatusOK, rsp.Code)
+	assert.JSONEq(`{"invalidated": 1}`, rsp.Body.String())
+
+	serveRequest(t, handler, "GET", "/repos/repo/branches", *token, nil)
+	serveRequest(t, handler, "GET", "/webhooks", *token, nil)
+	assert.Equal(3, numCalls())
+
+	rsp = serveRequest(t, handler, "DELETE", "/auth-callout/cache", *token, nil)
+	assert.Equal(http.StatusOK, rsp.Code)
+	assert.JSONEq(`{"invalidated": 2}`, rsp.Body.String())
+}
@@ -0,0 +1,242 @@
+package api
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/reviewboard/rb-gateway/config"
+)
+
+// Create a middleware that compresses responses with gzip.
+//
+// Responses are compressed when the client accepts gzip in its
+// `Accept-Encoding` header, their content type is one of the configured
+// `compression.contentTypes`, and they are at least `compression.minSize`
+// bytes. Responses that are already encoded or that contain a byte range are
+// sent as-is.
+func newGzipMiddleware(cfg *config.Config) (Middleware, error) {
+	level := cfg.Compression.Level
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+
+	// Validate the level up front, since the writers are created lazily.
+	if _, err := gzip.NewWriterLevel(ioutil.Discard, level); err != nil {
+		return nil, err
+	}
+
+	contentTypes := make(map[string]bool, len(cfg.Compression.ContentTypes))
+	for _, contentType := range cfg.Compression.ContentTypes {
+		contentTypes[strings.ToLower(contentType)] = true
+	}
+
+	writers := &sync.Pool{
+		New: func() interface{} {
+			writer, _ := gzip.NewWriterLevel(ioutil.Discard, level)
+			return writer
+		},
+	}
+
+	minSize := cfg.Compression.MinSize
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			writer := &gzipResponseWriter{
+				ResponseWriter: w,
+				writers:        writers,
+				contentTypes:   contentTypes,
+				minSize:        minSize,
+				acceptsGzip:    acceptsGzip(r.Header.Get("Accept-Encoding")),
+			}
+			defer writer.close()
+
+			next.ServeHTTP(writer, r)
+		})
+	}, nil
+}
+
+// Return whether or not an `Accept-Encoding` header allows gzip.
+//
+// A quality given for gzip itself takes precedence over one given for `*`, so
+// `gzip;q=0, *` does not allow gzip.
+func acceptsGzip(header string) bool {
+	gzipQuality := -1.0
+	anyQuality := -1.0
+
+	for _, coding := range strings.Split(header, ",") {
+		params := strings.Split(coding, ";")
+		name := strings.ToLower(strings.TrimSpace(params[0]))
+
+		if name != "gzip" && name != "*" {
+			continue
+		}
+
+		quality := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					quality = q
+				}
+			}
+		}
+
+		if name == "gzip" {
+			gzipQuality = quality
+		} else {
+			anyQuality = quality
+		}
+	}
+
+	if gzipQuality >= 0 {
+		return gzipQuality > 0
+	}
+
+	return anyQuality > 0
+}
+
+// A specialized `http.ResponseWriter` that compresses the response.
+//
+// The headers are held back until `minSize` bytes have been written or the
+// response has finished, so that small responses are sent uncompressed.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	writers      *sync.Pool
+	contentTypes map[string]bool
+	minSize      int
+	acceptsGzip  bool
+
+	status  int
+	buffer  []byte
+	decided bool
+	gzip    *gzip.Writer
+}
+
+// Record the status code, which is written once the response is known to be
+// compressed or not.
+func (g *gzipResponseWriter) WriteHeader(status int) {
+	if g.status == 0 {
+		g.status = status
+	}
+}
+
+// Write the given content to the client.
+func (g *gzipResponseWriter) Write(content []byte) (int, error) {
+	if g.status == 0 {
+		g.status = http.StatusOK
+	}
+
+	if g.decided {
+		if g.gzip != nil {
+			return g.gzip.Write(content)
+		}
+
+		return g.ResponseWriter.Write(content)
+	}
+
+	g.buffer = append(g.buffer, content...)
+	if len(g.buffer) < g.minSize {
+		return len(content), nil
+	}
+
+	if err := g.flushBuffer(); err != nil {
+		return 0, err
+	}
+
+	return len(content), nil
+}
+
+// Return whether or not the response's content type may be compressed.
+//
+// Responses of these types vary on `Accept-Encoding`, even if they are too
+// small to be compressed.
+func (g *gzipResponseWriter) compressible() bool {
+	if g.status == http.StatusNoContent || g.status == http.StatusNotModified {
+		return false
+	}
+
+	mediaType, _, err := mime.ParseMediaType(g.Header().Get("Content-Type"))
+	return err == nil && g.contentTypes[strings.ToLower(mediaType)]
+}
+
+// Decide whether to compress the response and write the headers.
+func (g *gzipResponseWriter) writeHeader(compress bool) {
+	header := g.Header()
+
+	if g.compressible() {
+		header.Add("Vary", "Accept-Encoding")
+	}
+
+	compress = compress &&
+		g.acceptsGzip &&
+		g.compressible() &&
+		header.Get("Content-Encoding") == "" &&
+		header.Get("Content-Range") == ""
+
+	if compress {
+		header.Del("Content-Length")
+		header.Set("Content-Encoding", "gzip")
+
+		// The compressed content differs from the uncompressed content, so it
+		// can only weakly match the ETag.
+		if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			header.Set("ETag", "W/"+etag)
+		}
+
+		g.gzip = g.writers.Get().(*gzip.Writer)
+		g.gzip.Reset(g.ResponseWriter)
+	}
+
+	g.decided = true
+	g.ResponseWriter.WriteHeader(g.status)
+}
+
+// Write the headers and any buffered content.
+//
+// This is called once the buffer has reached `minSize`, so the response is
+// compressed if it is eligible.
+func (g *gzipResponseWriter) flushBuffer() error {
+	g.writeHeader(true)
+
+	buffer := g.buffer
+	g.buffer = nil
+
+	var err error
+	if g.gzip != nil {
+		_, err = g.gzip.Write(buffer)
+	} else {
+		_, err = g.ResponseWriter.Write(buffer)
+	}
+
+	return err
+}
+
+// Finish the response once the handler has returned.
+//
+// Responses that never reached `minSize` are sent uncompressed.
+func (g *gzipResponseWriter) close() {
+	if !g.decided {
+		if g.status == 0 {
+			// The handler wrote nothing, so the default response is sent.
+			return
+		}
+
+		g.writeHeader(false)
+		if len(g.buffer) > 0 {
+			g.ResponseWriter.Write(g.buffer)
+			g.buffer = nil
+		}
+	}
+
+	if g.gzip != nil {
+		g.gzip.Close()
+		g.gzip.Reset(ioutil.Discard)
+		g.writers.Put(g.gzip)
+		g.gzip = nil
+	}
+}
@@ -0,0 +1,100 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/reviewboard/rb-gateway/repositories"
+)
+
+const (
+	// The `Cache-Control` header for content that can never change.
+	immutableCacheControl = "private, max-age=31536000, immutable"
+
+	// The `Cache-Control` header for content that may be cached, but must be
+	// revalidated before it is used.
+	revalidateCacheControl = "private, no-cache"
+
+	// The version of the commit representation, which is part of its ETag.
+	//
+	// This must be incremented whenever the fields of a commit change, so
+	// that clients do not keep using cached commits in the old format.
+	commitETagVersion = 1
+)
+
+var (
+	// A pattern matching full commit and object IDs.
+	fullIdPattern = regexp.MustCompile(`^[0-9a-f]{40}$`)
+)
+
+// Return whether or not an ID is a full commit or object ID.
+//
+// Content identified by a full ID never changes, unlike content identified by
+// a symbolic ref or an abbreviated ID.
+func isFullId(id string) bool {
+	return fullIdPattern.MatchString(id)
+}
+
+// Return whether or not the repository's file IDs are object IDs.
+//
+// Mercurial file IDs are paths, whose contents change between commits.
+func hasFileObjectIds(repo repositories.Repository) bool {
+	return repo.GetScm() == "git"
+}
+
+// Return the ETag for a file at a commit.
+//
+// Paths may contain characters that cannot appear in an ETag, so they are
+// hashed.
+func fileETag(commitId, path string) string {
+	hash := sha256.Sum256([]byte(commitId + "\x00" + path))
+	return fmt.Sprintf(`"%s"`, hex.EncodeToString(hash[:]))
+}
+
+// Return the ETag for a commit.
+func commitETag(commitId string) string {
+	return fmt.Sprintf(`"%d-%s"`, commitETagVersion, commitId)
+}
+
+// Write an HTTP 304 if the request's `If-None-Match` header matches the ETag.
+//
+// If true is returned, the response has been written. This should be checked
+// before the content is loaded, so that it does not have to be.
+func writeNotModified(w http.ResponseWriter, r *http.Request, etag, cacheControl string) bool {
+	if etag == "" || !etagMatches(r.Header.Get("If-None-Match"), etag) {
+		return false
+	}
+
+	setCacheHeaders(w, etag, cacheControl)
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// Set the caching headers for a successful response.
+//
+// Nothing is set if the ETag is empty (i.e., the response cannot be cached).
+func setCacheHeaders(w http.ResponseWriter, etag, cacheControl string) {
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Cache-Control", cacheControl)
+	}
+}
+
+// Return whether or not an `If-None-Match` header matches the ETag.
+//
+// As required by RFC 7232, weak comparison is used. A `*` is not matched,
+// since the content has not been loaded to tell whether it exists.
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+
+	return false
+}
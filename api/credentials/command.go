@@ -0,0 +1,74 @@
+package credentials
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/kballard/go-shellquote"
+
+	"github.com/reviewboard/rb-gateway/config"
+)
+
+func init() {
+	Register("command", newCommandProvider)
+}
+
+// A provider that runs an external command to check credentials.
+//
+// The username and password are written to the command's standard input, one
+// per line, so that they do not appear in the process list. The credentials
+// are accepted if the command exits with status 0 and rejected if it exits
+// with status 1. Any other outcome (including timing out) is an error.
+type commandProvider struct {
+	// The command and its arguments.
+	args []string
+
+	// How long the command may run.
+	timeout time.Duration
+}
+
+// Create a provider for the configured command.
+func newCommandProvider(cfg *config.Config) (Provider, error) {
+	args, err := shellquote.Split(cfg.AuthProvider.Command)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse authProvider.command: %s", err.Error())
+	} else if len(args) == 0 {
+		return nil, errors.New("authProvider.command is required for the command provider.")
+	}
+
+	return &commandProvider{
+		args:    args,
+		timeout: time.Duration(cfg.AuthProvider.Timeout) * time.Second,
+	}, nil
+}
+
+// Return whether or not the command accepts the credentials.
+func (p *commandProvider) Authenticate(username, password string) (bool, error) {
+	if strings.ContainsAny(username, "\r\n") || strings.ContainsAny(password, "\r\n") {
+		return false, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, p.args[0], p.args[1:]...)
+	cmd.Stdin = strings.NewReader(username + "\n" + password + "\n")
+
+	err := cmd.Run()
+	if err == nil {
+		return true, nil
+	} else if ctx.Err() == context.DeadlineExceeded {
+		return false, fmt.Errorf("%s timed out after %s", p.args[0], p.timeout)
+	}
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+		return false, nil
+	}
+
+	return false, fmt.Errorf("Could not run %s: %s", p.args[0], err.Error())
+}
@@ -0,0 +1,87 @@
+// Package credentials checks the usernames and passwords that clients use to
+// create sessions.
+//
+// Each way of checking credentials is a Provider, created by a Factory that is
+// registered under the name used for it in the `authProvider.type`
+// configuration key.
+package credentials
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/reviewboard/rb-gateway/config"
+)
+
+// The provider used when the configuration does not name one.
+const DefaultProvider = "htpasswd"
+
+// A source of credentials for basic auth.
+type Provider interface {
+	// Return whether or not the password is correct for the user.
+	//
+	// An error is returned if the credentials could not be checked (e.g., the
+	// backend could not be reached), as opposed to being incorrect.
+	Authenticate(username, password string) (bool, error)
+}
+
+// A function that creates a provider from the configuration.
+type Factory func(cfg *config.Config) (Provider, error)
+
+var (
+	// A lock for reading from/writing to factories.
+	factoriesLock sync.RWMutex
+
+	// The registered factories, by provider name.
+	factories = make(map[string]Factory)
+)
+
+// Register a factory for a provider.
+//
+// This is meant to be called from `init` functions. Registering two factories
+// under the same name is a programming error, so it panics.
+func Register(name string, factory Factory) {
+	factoriesLock.Lock()
+	defer factoriesLock.Unlock()
+
+	if _, ok := factories[name]; ok {
+		panic(fmt.Sprintf(`credentials: provider "%s" is already registered`, name))
+	}
+
+	factories[name] = factory
+}
+
+// Return the names of the registered providers, in sorted order.
+func Providers() []string {
+	factoriesLock.RLock()
+	defer factoriesLock.RUnlock()
+
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// Create the provider named in the configuration.
+func New(cfg *config.Config) (Provider, error) {
+	name := cfg.AuthProvider.Type
+	if name == "" {
+		name = DefaultProvider
+	}
+
+	factoriesLock.RLock()
+	factory, ok := factories[name]
+	factoriesLock.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf(`Unknown authProvider.type "%s"; expected one of: %s.`,
+			name, strings.Join(Providers(), ", "))
+	}
+
+	return factory(cfg)
+}
@@ -0,0 +1,332 @@
+package credentials_test
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/reviewboard/rb-gateway/api/credentials"
+	"github.com/reviewboard/rb-gateway/config"
+	"github.com/reviewboard/rb-gateway/helpers"
+)
+
+// Testing the htpasswd provider, which is used by default.
+func TestHtpasswdProvider(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg := config.Config{}
+	helpers.CreateTestHtpasswd(t, "username", "password", &cfg)
+	defer os.Remove(cfg.HtpasswdPath)
+
+	provider, err := credentials.New(&cfg)
+	assert.Nil(err)
+
+	ok, err := provider.Authenticate("username", "password")
+	assert.Nil(err)
+	assert.True(ok)
+
+	ok, err = provider.Authenticate("username", "wrong")
+	assert.Nil(err)
+	assert.False(ok)
+
+	ok, err = provider.Authenticate("nobody", "password")
+	assert.Nil(err)
+	assert.False(ok)
+
+	cfg.HtpasswdPath = filepath.Join(filepath.Dir(cfg.HtpasswdPath), "does-not-exist")
+	_, err = credentials.New(&cfg)
+	assert.NotNil(err)
+}
+
+// Testing the env provider.
+func TestEnvProvider(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg := config.Config{
+		AuthProvider: config.AuthProviderConfig{
+			Type:             "env",
+			UsernameVariable: "RBGATEWAY_TEST_USERNAME",
+			PasswordVariable: "RBGATEWAY_TEST_PASSWORD",
+		},
+	}
+
+	defer os.Unsetenv("RBGATEWAY_TEST_USERNAME")
+	defer os.Unsetenv("RBGATEWAY_TEST_PASSWORD")
+
+	os.Setenv("RBGATEWAY_TEST_USERNAME", "username")
+
+	_, err := credentials.New(&cfg)
+	assert.EqualError(err, "The RBGATEWAY_TEST_PASSWORD environment variable is not set.")
+
+	os.Setenv("RBGATEWAY_TEST_PASSWORD", "password")
+
+	provider, err := credentials.New(&cfg)
+	assert.Nil(err)
+
+	ok, err := provider.Authenticate("username", "password")
+	assert.Nil(err)
+	assert.True(ok)
+
+	ok, err = provider.Authenticate("username", "wrong")
+	assert.Nil(err)
+	assert.False(ok)
+
+	ok, err = provider.Authenticate("other", "password")
+	assert.Nil(err)
+	assert.False(ok)
+}
+
+// Testing the command provider.
+func TestCommandProvider(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "rb-gateway-credentials-")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	script := filepath.Join(dir, "check-password")
+	assert.Nil(ioutil.WriteFile(script, []byte(`#!/bin/sh
+read username
+read password
+
+case "$username:$password" in
+    username:password) exit 0 ;;
+    broken:*) exit 2 ;;
+    *) exit 1 ;;
+esac
+`), 0755))
+
+	cfg := config.Config{
+		AuthProvider: config.AuthProviderConfig{
+			Type:    "command",
+			Command: script,
+			Timeout: 10,
+		},
+	}
+
+	provider, err := credentials.New(&cfg)
+	assert.Nil(err)
+
+	ok, err := provider.Authenticate("username", "password")
+	assert.Nil(err)
+	assert.True(ok)
+
+	ok, err = provider.Authenticate("username", "wrong")
+	assert.Nil(err)
+	assert.False(ok)
+
+	ok, err = provider.Authenticate("username", "password\nusername")
+	assert.Nil(err)
+	assert.False(ok)
+
+	_, err = provider.Authenticate("broken", "password")
+	assert.NotNil(err)
+
+	cfg.AuthProvider.Command = ""
+	_, err = credentials.New(&cfg)
+	assert.NotNil(err)
+}
+
+// Read a BER element from an LDAP message.
+func readBerElement(t *testing.T, data []byte) (byte, []byte, []byte) {
+	t.Helper()
+
+	tag, length, data := data[0], int(data[1]), data[2:]
+	if length&0x80 != 0 {
+		numBytes := length & 0x7f
+		length = 0
+		for _, b := range data[:numBytes] {
+			length = length<<8 | int(b)
+		}
+
+		data = data[numBytes:]
+	}
+
+	return tag, data[:length], data[length:]
+}
+
+// Serve binds on a fake LDAP server.
+//
+// The DN of each bind is sent to the channel. Binds as `username` with the
+// password `password` succeed, binds as `broken` fail with an error, and all
+// others are rejected.
+func serveLdap(t *testing.T, listener net.Listener, dns chan<- string) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			defer conn.Close()
+
+			request := make([]byte, 4096)
+			n, err := conn.Read(request)
+			if err != nil {
+				return
+			}
+
+			// SEQUENCE { messageID, BindRequest { version, name, simple } }
+			_, message, _ := readBerElement(t, request[:n])
+			_, _, rest := readBerElement(t, message)
+			_, bind, _ := readBerElement(t, rest)
+			_, _, rest = readBerElement(t, bind)
+			_, dn, rest := readBerElement(t, rest)
+			_, password, _ := readBerElement(t, rest)
+
+			dns <- string(dn)
+
+			code := byte(49)
+			if string(dn) == "uid=username,ou=people,dc=example,dc=com" && string(password) == "password" {
+				code = 0
+			} else if string(dn) == "uid=broken,ou=people,dc=example,dc=com" {
+				code = 52
+			}
+
+			// Active Directory always uses long-form lengths.
+			conn.Write([]byte{
+				0x30, 0x84, 0x00, 0x00, 0x00, 0x0c,
+				0x02, 0x01, 0x01,
+				0x61, 0x07, 0x0a, 0x01, code, 0x04, 0x00, 0x04, 0x00,
+			})
+
+			io.Copy(ioutil.Discard, conn)
+		}()
+	}
+}
+
+// Testing the ldap provider.
+func TestLdapProvider(t *testing.T) {
+	assert := assert.New(t)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(err)
+	defer listener.Close()
+
+	dns := make(chan string, 10)
+	go serveLdap(t, listener, dns)
+
+	cfg := config.Config{
+		AuthProvider: config.AuthProviderConfig{
+			Type:       "ldap",
+			LdapUrl:    "ldap://" + listener.Addr().String(),
+			LdapBindDN: "uid={username},ou=people,dc=example,dc=com",
+			Timeout:    10,
+
+			// The fake server does not support StartTLS.
+			LdapAllowInsecure: true,
+		},
+	}
+
+	provider, err := credentials.New(&cfg)
+	assert.Nil(err)
+
+	ok, err := provider.Authenticate("username", "password")
+	assert.Nil(err)
+	assert.True(ok)
+	assert.Equal("uid=username,ou=people,dc=example,dc=com", <-dns)
+
+	ok, err = provider.Authenticate("username", "wrong")
+	assert.Nil(err)
+	assert.False(ok)
+	assert.Equal("uid=username,ou=people,dc=example,dc=com", <-dns)
+
+	// Special characters in usernames are escaped, so that they cannot
+	// change the DN.
+	ok, err = provider.Authenticate("username,ou=admins", "password")
+	assert.Nil(err)
+	assert.False(ok)
+	assert.Equal(`uid=username\,ou\=admins,ou=people,dc=example,dc=com`, <-dns)
+
+	_, err = provider.Authenticate("broken", "password")
+	assert.NotNil(err)
+	assert.Equal("uid=broken,ou=people,dc=example,dc=com", <-dns)
+
+	// An empty password would be an anonymous bind, so it is rejected
+	// without contacting the server.
+	ok, err = provider.Authenticate("username", "")
+	assert.Nil(err)
+	assert.False(ok)
+	assert.Equal(0, len(dns))
+
+	for _, invalid := range []config.AuthProviderConfig{
+		{Type: "ldap", LdapBindDN: "uid={username},dc=example,dc=com"},
+		{Type: "ldap", LdapUrl: "ldap://ldap.example.com", LdapBindDN: "uid=username,dc=example,dc=com"},
+		{Type: "ldap", LdapUrl: "http://ldap.example.com", LdapBindDN: "uid={username},dc=example,dc=com"},
+		{Type: "ldap", LdapUrl: "ldap://ldap.example.com", LdapBindDN: "uid={username},dc=example,dc=com"},
+		{Type: "ldap", LdapUrl: "ldaps://ldap.example.com", LdapBindDN: "uid={username},dc=example,dc=com", LdapStartTLS: true},
+		{Type: "ldap", LdapUrl: "ldaps://ldap.example.com", LdapBindDN: "uid={username},dc=example,dc=com", LdapCAPath: "/does/not/exist"},
+	} {
+		_, err = credentials.New(&config.Config{AuthProvider: invalid})
+		assert.NotNil(err)
+	}
+}
+
+// Testing the pam provider.
+func TestPamProvider(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "rb-gateway-credentials-")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	cfg := config.Config{
+		AuthProvider: config.AuthProviderConfig{
+			Type:       "pam",
+			PamService: "rb-gateway",
+			Timeout:    10,
+		},
+	}
+
+	path := os.Getenv("PATH")
+	defer os.Setenv("PATH", path)
+	os.Setenv("PATH", dir)
+
+	_, err = credentials.New(&cfg)
+	assert.NotNil(err)
+
+	assert.Nil(ioutil.WriteFile(filepath.Join(dir, "pamtester"), []byte(`#!/bin/sh
+read password
+
+case "$1:$2:$3:$password" in
+    rb-gateway:username:authenticate:password) exit 0 ;;
+    *:broken:*) exit 2 ;;
+    *) exit 1 ;;
+esac
+`), 0755))
+
+	provider, err := credentials.New(&cfg)
+	assert.Nil(err)
+
+	ok, err := provider.Authenticate("username", "password")
+	assert.Nil(err)
+	assert.True(ok)
+
+	ok, err = provider.Authenticate("username", "wrong")
+	assert.Nil(err)
+	assert.False(ok)
+
+	ok, err = provider.Authenticate("-v", "password")
+	assert.Nil(err)
+	assert.False(ok)
+
+	_, err = provider.Authenticate("broken", "password")
+	assert.NotNil(err)
+}
+
+// Testing that unknown providers are rejected.
+func TestUnknownProvider(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg := config.Config{
+		AuthProvider: config.AuthProviderConfig{Type: "kerberos"},
+	}
+
+	_, err := credentials.New(&cfg)
+	assert.EqualError(err, `Unknown authProvider.type "kerberos"; expected one of: command, env, htpasswd, ldap, pam.`)
+}
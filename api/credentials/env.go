@@ -0,0 +1,51 @@
+package credentials
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"os"
+
+	"github.com/reviewboard/rb-gateway/config"
+)
+
+func init() {
+	Register("env", newEnvProvider)
+}
+
+// A provider that accepts a single username and password, read from
+// environment variables.
+//
+// This is meant for deployments where credentials are injected by a secret
+// manager rather than written to disk. The variables are read when the
+// configuration is loaded.
+type envProvider struct {
+	username string
+	password string
+}
+
+// Create a provider for the credentials in the configured environment
+// variables.
+func newEnvProvider(cfg *config.Config) (Provider, error) {
+	provider := &envProvider{
+		username: os.Getenv(cfg.AuthProvider.UsernameVariable),
+		password: os.Getenv(cfg.AuthProvider.PasswordVariable),
+	}
+
+	if provider.username == "" {
+		return nil, fmt.Errorf("The %s environment variable is not set.", cfg.AuthProvider.UsernameVariable)
+	}
+
+	if provider.password == "" {
+		return nil, fmt.Errorf("The %s environment variable is not set.", cfg.AuthProvider.PasswordVariable)
+	}
+
+	return provider, nil
+}
+
+// Return whether or not the username and password match the configured ones.
+func (p *envProvider) Authenticate(username, password string) (bool, error) {
+	usernameMatches := subtle.ConstantTimeCompare([]byte(username), []byte(p.username))
+	passwordMatches := subtle.ConstantTimeCompare([]byte(password), []byte(p.password))
+
+	return usernameMatches&passwordMatches == 1, nil
+}
@@ -0,0 +1,78 @@
+package credentials
+
+import (
+	"encoding/csv"
+	"errors"
+	"net/http"
+	"os"
+
+	auth "github.com/abbot/go-http-auth"
+
+	"github.com/reviewboard/rb-gateway/config"
+)
+
+func init() {
+	Register("htpasswd", newHtpasswdProvider)
+}
+
+// A provider that checks credentials against an htpasswd file.
+//
+// Unlike `auth.HtpasswdFileProvider`, this loads the entire file up front and
+// (therefore) does not handle reloads. The one provided by `go-http-auth` does
+// not do any I/O upfront and will trigger a `panic` if we attempt to
+// authenticate and the file does not exist.
+//
+// If the user wants to reload the `htpasswd` file, they need to trigger a full
+// config reload (e.g., with `SIGHUP`).
+type htpasswdProvider struct {
+	// The authenticator that compares passwords to their hashes.
+	//
+	// `go-http-auth` does not export its hash comparisons, so passwords are
+	// checked by building a request for it to authenticate.
+	authenticator *auth.BasicAuth
+}
+
+// Create a provider for the configured htpasswd file.
+func newHtpasswdProvider(cfg *config.Config) (Provider, error) {
+	f, err := os.Open(cfg.HtpasswdPath)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	csv := csv.NewReader(f)
+	csv.Comma = ':'
+	csv.Comment = '#'
+	csv.TrimLeadingSpace = true
+
+	records, err := csv.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	secrets := make(map[string]string)
+	for _, record := range records {
+		if len(record) != 2 {
+			return nil, errors.New("Malformed htpasswd file")
+		}
+
+		secrets[record[0]] = record[1]
+	}
+
+	secretProvider := func(user, realm string) string {
+		return secrets[user]
+	}
+
+	return &htpasswdProvider{
+		authenticator: auth.NewBasicAuthenticator("", secretProvider),
+	}, nil
+}
+
+// Return whether or not the password matches the user's hash.
+func (p *htpasswdProvider) Authenticate(username, password string) (bool, error) {
+	r := &http.Request{Header: make(http.Header)}
+	r.SetBasicAuth(username, password)
+
+	return p.authenticator.CheckAuth(r) != "", nil
+}
@@ -0,0 +1,176 @@
+package credentials
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+
+	"github.com/reviewboard/rb-gateway/config"
+)
+
+// The placeholder for the username in `authProvider.ldapBindDN`.
+const ldapUsernamePlaceholder = "{username}"
+
+func init() {
+	Register("ldap", newLdapProvider)
+}
+
+// A provider that checks credentials by binding to an LDAP server as the user.
+//
+// The user's DN is formed from the configured template, so no search is
+// performed and no service account is needed. Each check uses a new
+// connection, which is closed once the bind completes.
+type ldapProvider struct {
+	// The URL of the server.
+	url string
+
+	// Whether or not an `ldap://` connection is upgraded with StartTLS.
+	startTLS bool
+
+	// The TLS settings for `ldaps://` and StartTLS connections.
+	tlsConfig *tls.Config
+
+	// The template for the DN to bind as.
+	bindDN string
+
+	// How long connecting and binding may take.
+	timeout time.Duration
+}
+
+// Create a provider for the configured LDAP server.
+//
+// Passwords are only sent over TLS (`ldaps://` or StartTLS), unless
+// `authProvider.ldapAllowInsecure` is set.
+func newLdapProvider(cfg *config.Config) (Provider, error) {
+	settings := cfg.AuthProvider
+
+	if settings.LdapUrl == "" {
+		return nil, errors.New("authProvider.ldapUrl is required for the ldap provider.")
+	} else if !strings.Contains(settings.LdapBindDN, ldapUsernamePlaceholder) {
+		return nil, fmt.Errorf("authProvider.ldapBindDN must contain %s.", ldapUsernamePlaceholder)
+	}
+
+	u, err := url.Parse(settings.LdapUrl)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse authProvider.ldapUrl: %s", err.Error())
+	}
+
+	switch u.Scheme {
+	case "ldap":
+		if !settings.LdapStartTLS {
+			if !settings.LdapAllowInsecure {
+				return nil, errors.New("authProvider.ldapUrl must be an ldaps:// URL, or authProvider.ldapStartTLS must be set, so that passwords are not sent in cleartext. Set authProvider.ldapAllowInsecure to allow this anyway.")
+			}
+
+			log.Printf("Warning: Passwords are sent to the LDAP server %s in cleartext, since authProvider.ldapAllowInsecure is set.", u.Host)
+		}
+
+	case "ldaps":
+		if settings.LdapStartTLS {
+			return nil, errors.New("authProvider.ldapStartTLS cannot be used with an ldaps:// URL.")
+		}
+
+	default:
+		return nil, fmt.Errorf(`authProvider.ldapUrl must be an ldap:// or ldaps:// URL, not "%s".`, settings.LdapUrl)
+	}
+
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf(`authProvider.ldapUrl has no host: "%s".`, settings.LdapUrl)
+	}
+
+	provider := &ldapProvider{
+		url:      (&url.URL{Scheme: u.Scheme, Host: u.Host}).String(),
+		startTLS: settings.LdapStartTLS,
+		bindDN:   settings.LdapBindDN,
+		timeout:  time.Duration(settings.Timeout) * time.Second,
+		tlsConfig: &tls.Config{
+			ServerName: u.Hostname(),
+		},
+	}
+
+	if settings.LdapCAPath != "" {
+		pem, err := ioutil.ReadFile(settings.LdapCAPath)
+		if err != nil {
+			return nil, fmt.Errorf("Could not read authProvider.ldapCAPath: %s", err.Error())
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("authProvider.ldapCAPath %s contains no certificates.", settings.LdapCAPath)
+		}
+
+		provider.tlsConfig.RootCAs = pool
+	}
+
+	return provider, nil
+}
+
+// Return whether or not the LDAP server accepts a bind as the user.
+func (p *ldapProvider) Authenticate(username, password string) (bool, error) {
+	// LDAP servers treat a bind with an empty password as an anonymous bind,
+	// which succeeds for any DN.
+	if username == "" || password == "" {
+		return false, nil
+	}
+
+	conn, err := ldap.DialURL(p.url,
+		ldap.DialWithDialer(&net.Dialer{Timeout: p.timeout}),
+		ldap.DialWithTLSConfig(p.tlsConfig))
+	if err != nil {
+		return false, fmt.Errorf("Could not connect to LDAP server %s: %s", p.url, err.Error())
+	}
+	defer conn.Close()
+
+	conn.SetTimeout(p.timeout)
+
+	if p.startTLS {
+		if err = conn.StartTLS(p.tlsConfig); err != nil {
+			return false, fmt.Errorf("Could not start TLS with LDAP server %s: %s", p.url, err.Error())
+		}
+	}
+
+	dn := strings.Replace(p.bindDN, ldapUsernamePlaceholder, escapeLdapDNValue(username), -1)
+
+	err = conn.Bind(dn, password)
+	if err == nil {
+		return true, nil
+	} else if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		return false, nil
+	}
+
+	return false, fmt.Errorf("LDAP server %s could not bind: %s", p.url, err.Error())
+}
+
+// Escape a value for use in a DN, as described in RFC 4514.
+func escapeLdapDNValue(value string) string {
+	var escaped strings.Builder
+
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+
+		switch {
+		case c == 0:
+			escaped.WriteString(`\00`)
+
+		case strings.IndexByte(`"+,;<=>\`, c) != -1,
+			i == 0 && (c == ' ' || c == '#'),
+			i == len(value)-1 && c == ' ':
+			escaped.WriteByte('\\')
+			escaped.WriteByte(c)
+
+		default:
+			escaped.WriteByte(c)
+		}
+	}
+
+	return escaped.String()
+}
@@ -0,0 +1,87 @@
+package credentials
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/reviewboard/rb-gateway/config"
+)
+
+// The program that the `pam` provider runs to check credentials.
+//
+// rb-gateway is built without cgo, so it cannot call libpam directly.
+// `pamtester` is packaged by most distributions, and runs a PAM conversation
+// that reads the password from its standard input.
+const pamHelper = "pamtester"
+
+func init() {
+	Register("pam", newPamProvider)
+}
+
+// A provider that checks credentials with PAM.
+//
+// Each check runs `pamtester <service> <username> authenticate` with the
+// password on its standard input, so that the password does not appear in the
+// process list. The credentials are accepted if it exits with status 0 and
+// rejected if it exits with status 1. Any other outcome (including timing out)
+// is an error.
+//
+// The PAM service (e.g., `/etc/pam.d/rb-gateway`) determines how credentials
+// are checked. Modules that read `/etc/shadow` (such as `pam_unix`) require
+// rb-gateway to run as a user that can read it.
+type pamProvider struct {
+	// The path to the helper program.
+	helper string
+
+	// The PAM service to authenticate with.
+	service string
+
+	// How long the helper may run.
+	timeout time.Duration
+}
+
+// Create a provider for the configured PAM service.
+func newPamProvider(cfg *config.Config) (Provider, error) {
+	helper, err := exec.LookPath(pamHelper)
+	if err != nil {
+		return nil, fmt.Errorf("The pam provider requires %s to be installed: %s", pamHelper, err.Error())
+	}
+
+	return &pamProvider{
+		helper:  helper,
+		service: cfg.AuthProvider.PamService,
+		timeout: time.Duration(cfg.AuthProvider.Timeout) * time.Second,
+	}, nil
+}
+
+// Return whether or not PAM accepts the credentials.
+func (p *pamProvider) Authenticate(username, password string) (bool, error) {
+	// Usernames starting with a dash would be parsed as options.
+	if username == "" || strings.HasPrefix(username, "-") || strings.ContainsAny(password, "\r\n") {
+		return false, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, p.helper, p.service, username, "authenticate")
+	cmd.Stdin = strings.NewReader(password + "\n")
+
+	err := cmd.Run()
+	if err == nil {
+		return true, nil
+	} else if ctx.Err() == context.DeadlineExceeded {
+		return false, fmt.Errorf("%s timed out after %s", pamHelper, p.timeout)
+	}
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+		return false, nil
+	}
+
+	return false, fmt.Errorf("Could not run %s: %s", pamHelper, err.Error())
+}
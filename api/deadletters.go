@@ -0,0 +1,144 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/gorilla/mux"
+
+	"github.com/reviewboard/rb-gateway/repositories"
+	"github.com/reviewboard/rb-gateway/repositories/hooks"
+)
+
+// The response to a request to redrive a dead letter.
+type redriveResponse struct {
+	// Whether or not the payload was delivered.
+	Delivered bool `json:"delivered"`
+
+	// The dead letter, updated with the new error, if the payload could not
+	// be delivered.
+	DeadLetter *hooks.DeadLetter `json:"dead_letter,omitempty"`
+
+	// The error that occurred while delivering the payload, if any.
+	Error string `json:"error,omitempty"`
+}
+
+// Return the dead letter store.
+func (api *API) deadLetters() *hooks.DeadLetterStore {
+	return api.config.DeadLetterStore()
+}
+
+// Load the dead letter named in the request, writing an error if it cannot be
+// loaded.
+func (api *API) loadDeadLetter(w http.ResponseWriter, r *http.Request) (*hooks.DeadLetter, bool) {
+	letterId := mux.Vars(r)["letter-id"]
+
+	letter, err := api.deadLetters().Load(letterId)
+	if err != nil {
+		if os.IsNotExist(err) {
+			http.Error(w, "No such dead letter", http.StatusNotFound)
+		} else {
+			log.Printf(`Could not load dead letter "%s": %s`, letterId, err.Error())
+			http.Error(w, "An unexpected error occurred.", http.StatusInternalServerError)
+		}
+
+		return nil, false
+	}
+
+	return letter, true
+}
+
+// Return the webhook payloads that could not be delivered.
+//
+// URL: `/webhooks/dead-letters`
+func (api *API) getDeadLetters(w http.ResponseWriter, r *http.Request) {
+	letters, err := api.deadLetters().List()
+	if err != nil {
+		log.Println("Could not list dead letters: ", err.Error())
+		http.Error(w, "An unexpected error occurred.", http.StatusInternalServerError)
+		return
+	}
+
+	writeList(w, r, "dead_letters", letters, completePage(len(letters)))
+}
+
+// Deliver a webhook payload that could not be delivered again.
+//
+// The payload is delivered exactly as it was originally sent, but is signed
+// with the webhook's current secret. If the delivery succeeds, the dead letter
+// is removed. Otherwise, the response has an HTTP 502 and includes the updated
+// dead letter. If the dead letter is already being redriven, the response has
+// an HTTP 409.
+//
+// URL: `/webhooks/dead-letters/<letter-id>/redrive`
+func (api *API) redriveDeadLetter(w http.ResponseWriter, r *http.Request) {
+	letter, ok := api.loadDeadLetter(w, r)
+	if !ok {
+		return
+	}
+
+	api.hookStoreLock.RLock()
+	hook, exists := api.hookStore[letter.HookId]
+	api.hookStoreLock.RUnlock()
+
+	var repo repositories.Repository
+
+	if !exists {
+		http.Error(w, fmt.Sprintf(`Webhook "%s" no longer exists.`, letter.HookId), http.StatusBadRequest)
+		return
+	} else if repo = api.config.FindRepository(letter.Repository); repo == nil {
+		http.Error(w, fmt.Sprintf(`Repository "%s" no longer exists.`, letter.Repository), http.StatusBadRequest)
+		return
+	}
+
+	dispatcher := api.config.NewDispatcher(1)
+	dispatcher.DeadLetters = api.deadLetters()
+
+	response := redriveResponse{Delivered: true}
+	status := http.StatusOK
+
+	if err := dispatcher.Redrive(letter, *hook, repo); os.IsNotExist(err) {
+		http.Error(w, "The dead letter is being redriven or has been removed.", http.StatusConflict)
+		return
+	} else if err != nil {
+		response = redriveResponse{
+			DeadLetter: letter,
+			Error:      err.Error(),
+		}
+		status = http.StatusBadGateway
+	}
+
+	rsp, err := json.Marshal(response)
+	if err != nil {
+		log.Printf("Could not serialize redrive response: %s", err.Error())
+		http.Error(w, "An unexpected error occurred.", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(rsp)
+}
+
+// Discard a webhook payload that could not be delivered.
+//
+// URL: `/webhooks/dead-letters/<letter-id>`
+func (api *API) deleteDeadLetter(w http.ResponseWriter, r *http.Request) {
+	letterId := mux.Vars(r)["letter-id"]
+
+	if err := api.deadLetters().Remove(letterId); err != nil {
+		if os.IsNotExist(err) {
+			http.Error(w, "No such dead letter", http.StatusNotFound)
+		} else {
+			log.Printf(`Could not remove dead letter "%s": %s`, letterId, err.Error())
+			http.Error(w, "An unexpected error occurred.", http.StatusInternalServerError)
+		}
+
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,309 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/reviewboard/rb-gateway/repositories"
+	"github.com/reviewboard/rb-gateway/repositories/events"
+	"github.com/reviewboard/rb-gateway/repositories/hooks"
+)
+
+const (
+	// The default number of commits in a test event.
+	defaultTestEventCommits = 3
+
+	// The maximum number of commits in a push payload created for a range of
+	// commits.
+	maxPushPayloadCommits = 1000
+)
+
+// The optional body of a request to test-fire an event.
+type testEventRequest struct {
+	// The branch to take the commits from.
+	//
+	// If empty, the most recently committed-to branch is used.
+	Branch string `json:"branch"`
+
+	// The number of commits to include.
+	Commits int `json:"commits"`
+}
+
+// The response to a request to test-fire an event.
+type testEventResponse struct {
+	// The event that was dispatched.
+	Event string `json:"event"`
+
+	// The payload that was dispatched.
+	Payload events.PushPayload `json:"payload"`
+
+	// The error that occurred while delivering the webhooks, if any.
+	Error string `json:"error,omitempty"`
+}
+
+// Dispatch a push event for the repository's latest commits to its webhooks.
+//
+// The request body may contain a JSON object with a `branch` to take the
+// commits from (by default, the most recently committed-to branch) and the
+// number of `commits` to include (by default, 3). The payload is delivered
+// to every enabled webhook for the repository's push events, exactly as it
+// would be for a real push, and delivery statuses are recorded. Operators are
+// not notified of failures.
+//
+// The response contains the payload. If any webhook could not be delivered,
+// the response has an HTTP 502 and includes the error.
+//
+// URL: `/repos/<repo>/test-event`
+func (api *API) testEvent(w http.ResponseWriter, r *http.Request) {
+	repo := r.Context().Value("repo").(repositories.Repository)
+
+	request := testEventRequest{
+		Commits: defaultTestEventCommits,
+	}
+
+	body, ok := api.readRequestBody(w, r)
+	if !ok {
+		return
+	} else if len(body) != 0 {
+		if err := json.Unmarshal(body, &request); err != nil {
+			http.Error(w, fmt.Sprintf("Could not parse request body: %s", err.Error()), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if request.Commits <= 0 || request.Commits > repositories.CommitsPageSize {
+		http.Error(w,
+			fmt.Sprintf("commits must be between 1 and %d.", repositories.CommitsPageSize),
+			http.StatusBadRequest)
+		return
+	}
+
+	payload, err := newTestPushPayload(repo, request.Branch, request.Commits)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if api.config.ExternalUrl != "" {
+		payload = payload.WithLinks(api.config.ExternalUrl)
+	}
+
+	api.hookStoreLock.RLock()
+	store := make(hooks.WebhookStore, len(api.hookStore))
+	for id, hook := range api.hookStore {
+		store[id] = hook
+	}
+	api.hookStoreLock.RUnlock()
+
+	dispatcher := api.config.NewDispatcher(api.config.WebhookWorkers)
+
+	// The payload is reserved before it is delivered, so that a request
+	// refused for lack of memory has no effect.
+	data, err := events.MarshalPayload(payload)
+	if err != nil {
+		log.Printf("Could not serialize push payload: %s", err.Error())
+		http.Error(w, "An unexpected error occurred.", http.StatusInternalServerError)
+		return
+	} else if !reserveMemory(w, r, int64(len(data))) {
+		return
+	}
+
+	response := testEventResponse{
+		Event:   events.PushEvent,
+		Payload: payload,
+	}
+
+	status := http.StatusOK
+	if err = dispatcher.InvokeAllHooks(store, events.PushEvent, repo, payload); err != nil {
+		response.Error = err.Error()
+		status = http.StatusBadGateway
+	}
+
+	rsp, err := json.Marshal(response)
+	if err != nil {
+		log.Printf("Could not serialize test event: %s", err.Error())
+		http.Error(w, "An unexpected error occurred.", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(rsp)
+}
+
+// Create a push payload from the latest commits on a branch.
+//
+// If `branch` is empty, the most recently committed-to branch is used. The
+// commits are listed oldest first, as they are in the payload of a real push.
+func newTestPushPayload(repo repositories.Repository, branch string, count int) (events.PushPayload, error) {
+	payload := events.PushPayload{
+		Repository: repo.GetName(),
+	}
+
+	if branch == "" {
+		branches, err := repo.GetBranches(repositories.BranchSortDate)
+		if err != nil {
+			return payload, fmt.Errorf("Could not get branches: %s", err.Error())
+		} else if len(branches) == 0 {
+			return payload, errors.New("Repository has no branches.")
+		}
+
+		branch = branches[len(branches)-1].Name
+	}
+
+	commits, err := repo.GetCommits(branch, "", repositories.CommitOrderDefault, repositories.CommitFilter{})
+	if err != nil {
+		return payload, fmt.Errorf(`Could not get commits for branch "%s": %s`, branch, err.Error())
+	} else if len(commits) == 0 {
+		return payload, fmt.Errorf(`Branch "%s" has no commits.`, branch)
+	}
+
+	if len(commits) > count {
+		commits = commits[:count]
+	}
+
+	payload.Commits = make([]events.PushPayloadCommit, 0, len(commits))
+	for i := len(commits) - 1; i >= 0; i-- {
+		commit := commits[i]
+
+		payload.Commits = append(payload.Commits, events.PushPayloadCommit{
+			Id:             commit.Id,
+			Message:        commit.Message,
+			Author:         commit.Author,
+			AuthorEmail:    commit.AuthorEmail,
+			Date:           commit.Date,
+			Committer:      commit.Committer,
+			CommitterEmail: commit.CommitterEmail,
+			CommitterDate:  commit.CommitterDate,
+			Target: events.PushPayloadCommitTarget{
+				Branch: branch,
+			},
+		})
+	}
+
+	return payload, nil
+}
+
+// Return the push payload for the commits between two revisions.
+//
+// The commits reachable from `new` but not from `old` are included, exactly
+// as they would be in the payload of a push that moved a branch from `old` to
+// `new`. Both revisions may be commit IDs or symbolic refs, and `new` should
+// be a branch name so that the commits target that branch. The payload is
+// returned as it is sent to webhooks, so it can be inspected or replayed
+// (e.g., with `trigger-webhooks --payload-file`) without access to the
+// repository's host.
+//
+// Only tokens that can write to the repository may create payloads, and a
+// range of more than `maxPushPayloadCommits` commits results in an HTTP 400.
+// The payload is created before its size is known, so the memory budget is
+// only checked once it has been created.
+//
+// URL: `/repos/<repo>/push-payload?old=<rev>&new=<rev>`
+func (api *API) getPushPayload(w http.ResponseWriter, r *http.Request) {
+	repo := r.Context().Value("repo").(repositories.Repository)
+
+	payload, ok := api.buildPushPayload(w, r, repo)
+	if !ok {
+		return
+	}
+
+	if api.config.ExternalUrl != "" {
+		payload = payload.WithLinks(api.config.ExternalUrl)
+	}
+
+	rsp, err := events.MarshalPayload(payload)
+	if err != nil {
+		log.Printf("Could not serialize push payload: %s", err.Error())
+		http.Error(w, "An unexpected error occurred.", http.StatusInternalServerError)
+		return
+	} else if !reserveMemory(w, r, int64(len(rsp))) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(rsp)
+}
+
+// Deliver the push payload for the commits between two revisions to webhooks.
+//
+// The payload is created as it is for `getPushPayload` and delivered exactly as
+// it would be for a real push (see `SetEventDispatcher`), so that pushes that
+// webhooks missed can be sent again without running `trigger-webhooks` on the
+// repository's host.
+//
+// The response is the same as for `testEvent`. If any webhook could not be
+// delivered, the response has an HTTP 502 and includes the error. The same
+// restrictions apply as for `getPushPayload`.
+//
+// URL: `/repos/<repo>/push-payload?old=<rev>&new=<rev>`
+func (api *API) replayPushPayload(w http.ResponseWriter, r *http.Request) {
+	repo := r.Context().Value("repo").(repositories.Repository)
+
+	dispatch, _ := api.eventDispatchers()
+	if dispatch == nil {
+		http.Error(w, "This server cannot deliver events.", http.StatusServiceUnavailable)
+		return
+	}
+
+	payload, ok := api.buildPushPayload(w, r, repo)
+	if !ok {
+		return
+	}
+
+	response := testEventResponse{
+		Event:   events.PushEvent,
+		Payload: payload,
+	}
+
+	status := http.StatusOK
+
+	// Dispatching relies on the repository's type (e.g., to update the
+	// commit index), so the repository from the request context, which may
+	// be timed, cannot be used.
+	if err := dispatch(api.config, api.config.FindRepository(repo.GetName()), events.PushEvent, payload); err != nil {
+		response.Error = err.Error()
+		status = http.StatusBadGateway
+	}
+
+	if api.config.ExternalUrl != "" {
+		response.Payload = payload.WithLinks(api.config.ExternalUrl)
+	}
+
+	rsp, err := json.Marshal(response)
+	if err != nil {
+		log.Printf("Could not serialize push payload: %s", err.Error())
+		http.Error(w, "An unexpected error occurred.", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(rsp)
+}
+
+// Create the push payload for the `old` and `new` revisions in a request.
+//
+// If the revisions are missing or invalid, an error is written and false is
+// returned.
+func (api *API) buildPushPayload(w http.ResponseWriter, r *http.Request, repo repositories.Repository) (events.PushPayload, bool) {
+	query := r.URL.Query()
+	oldRev := query.Get("old")
+	newRev := query.Get("new")
+
+	if oldRev == "" || newRev == "" {
+		http.Error(w, "Both revisions (old and new) must be specified.", http.StatusBadRequest)
+		return events.PushPayload{}, false
+	}
+
+	payload, err := repo.ParseCommitRange(events.PushEvent, oldRev, newRev, maxPushPayloadCommits)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Could not create push payload: %s", err.Error()), http.StatusBadRequest)
+		return events.PushPayload{}, false
+	}
+
+	return payload.(events.PushPayload), true
+}
@@ -0,0 +1,153 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"github.com/reviewboard/rb-gateway/api/tokens"
+	"github.com/reviewboard/rb-gateway/config"
+	"github.com/reviewboard/rb-gateway/repositories"
+	"github.com/reviewboard/rb-gateway/repositories/events"
+)
+
+// The path of the route that hooks post events to, under `/repos`.
+//
+// Tokens with the hook role can only be used for this route.
+const hookEventsPath = "/{repo:.+}/hook-events/{event}"
+
+// A function that delivers an event to the webhooks that match the repository
+// and event.
+//
+// See `gateway.DispatchEvent()`.
+type EventDispatcher func(cfg *config.Config, repository repositories.Repository, event string, payload events.Payload) error
+
+// The body of a request to deliver an event from a hook.
+type hookEventRequest struct {
+	// The input that the SCM gave the hook (e.g., the refs that were updated
+	// for a Git `post-receive` hook).
+	Input string `json:"input"`
+
+	// The environment variables that the SCM gave the hook (e.g., `HG_NODE`
+	// for a Mercurial `changegroup` hook).
+	Env map[string]string `json:"env"`
+}
+
+// Set the functions that deliver events posted by hooks.
+//
+// Gating events (e.g., `pre-push`) are delivered with `dispatch`, since the
+// hook must wait for the result. Other events are passed to `enqueue`, which
+// must deliver them in the background and return without waiting (see
+// `gateway.EventQueue`). Until they are set, events posted by hooks are
+// refused.
+func (api *API) SetEventDispatcher(dispatch, enqueue EventDispatcher) {
+	api.dispatchLock.Lock()
+	defer api.dispatchLock.Unlock()
+
+	api.dispatchEvent = dispatch
+	api.enqueueEvent = enqueue
+}
+
+// Return the functions that deliver events posted by hooks.
+func (api *API) eventDispatchers() (dispatch, enqueue EventDispatcher) {
+	api.dispatchLock.RLock()
+	defer api.dispatchLock.RUnlock()
+
+	return api.dispatchEvent, api.enqueueEvent
+}
+
+// Parse an event posted by a repository hook and deliver it to webhooks.
+//
+// This is used by hooks that are installed with `hooks.mode` set to `api`, so
+// that they do not need to read the configuration or webhook store. The body
+// is a JSON object with the hook's `input` and `env`, which are parsed exactly
+// as `trigger-webhooks` would parse them in the hook.
+//
+// Gating events (e.g., `pre-push`) are delivered before responding: an HTTP
+// 204 is returned once the webhooks have accepted the event, or an HTTP 403
+// if a webhook rejected it, in which case the hook should reject the
+// operation. Other events are queued to be delivered in the background, so
+// that pushes do not wait for webhooks, and an HTTP 202 is returned. If the
+// queue is full, an HTTP 503 is returned.
+//
+// URL: `/repos/<repo>/hook-events/<event>`
+func (api *API) postHookEvent(w http.ResponseWriter, r *http.Request) {
+	repo := r.Context().Value("repo").(repositories.Repository)
+	event := mux.Vars(r)["event"]
+
+	// The configuration is read-locked while the request is handled (see
+	// ServeHTTP), but queued events are delivered after it is unlocked, so
+	// they are given the configuration as it is now.
+	cfg := api.config
+	dispatch, enqueue := api.eventDispatchers()
+
+	if !events.IsValidEvent(event) {
+		http.Error(w, fmt.Sprintf(`Unknown event: "%s".`, event), http.StatusBadRequest)
+		return
+	} else if dispatch == nil || enqueue == nil {
+		http.Error(w, "This server cannot deliver hook events.", http.StatusServiceUnavailable)
+		return
+	}
+
+	var request hookEventRequest
+
+	body, ok := api.readRequestBody(w, r)
+	if !ok {
+		return
+	} else if err := json.Unmarshal(body, &request); err != nil {
+		http.Error(w, fmt.Sprintf("Could not parse request body: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	getenv := func(key string) string {
+		return request.Env[key]
+	}
+
+	payload, err := repo.ParseHookEvent(event, strings.NewReader(request.Input), getenv)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Could not parse event payload: %s", err.Error()), http.StatusBadRequest)
+		return
+	} else if payload == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	// Dispatching relies on the repository's type (e.g., to update the
+	// commit index), so the repository from the request context, which may
+	// be timed, cannot be used.
+	repository := cfg.FindRepository(repo.GetName())
+
+	if !events.IsGatingEvent(event) {
+		if err = enqueue(cfg, repository, event, payload); err != nil {
+			log.Printf(`Could not queue "%s" event for repository "%s": %s`, event, repo.GetName(), err.Error())
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		} else {
+			w.WriteHeader(http.StatusAccepted)
+		}
+	} else if err = dispatch(cfg, repository, event, payload); err != nil {
+		http.Error(w, fmt.Sprintf("Push rejected: %s", err.Error()), http.StatusForbidden)
+	} else {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// Return whether or not a request may use a token.
+//
+// Tokens with the hook role can only be used to post hook events.
+func tokenAllowsRoute(info *tokens.Info, r *http.Request) bool {
+	if info.Role != tokens.RoleHook {
+		return true
+	}
+
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return false
+	}
+
+	template, err := route.GetPathTemplate()
+	return err == nil && strings.HasSuffix(template, hookEventsPath)
+}
@@ -0,0 +1,99 @@
+package api_test
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/reviewboard/rb-gateway/api"
+	"github.com/reviewboard/rb-gateway/api/tokens"
+	"github.com/reviewboard/rb-gateway/config"
+	"github.com/reviewboard/rb-gateway/repositories"
+	"github.com/reviewboard/rb-gateway/repositories/events"
+)
+
+func TestHookEventsAPI(t *testing.T) {
+	assert := assert.New(t)
+
+	testSetup := setupRoutesTest(t)
+	defer testSetup.cleanup(t)
+
+	handler, err := api.New(testSetup.config)
+	assert.Nil(err)
+
+	store := *handler.GetTokenStore()
+	token, err := store.NewWithOptions(tokens.Options{
+		Repositories: []string{"repo"},
+		Role:         tokens.RoleHook,
+	})
+	assert.Nil(err)
+
+	body, err := json.Marshal(map[string]string{
+		"input": fmt.Sprintf("%040d %s refs/heads/test-branch\n", 0, testSetup.branch.Hash().String()),
+	})
+	assert.Nil(err)
+
+	// Until a dispatcher is set, events cannot be delivered.
+	rsp := serveRequest(t, handler, "POST", "/repos/repo/hook-events/push", *token, body)
+	assert.Equal(http.StatusServiceUnavailable, rsp.Code)
+
+	var queued []events.Payload
+	var queueErr error
+
+	// Only gating events (e.g., Mercurial's `pre-push`) are delivered before
+	// responding, and Git has none.
+	dispatch := func(cfg *config.Config, repository repositories.Repository, event string, payload events.Payload) error {
+		assert.Fail("Unexpected dispatch of %s event", event)
+		return nil
+	}
+
+	enqueue := func(cfg *config.Config, repository repositories.Repository, event string, payload events.Payload) error {
+		assert.Equal("repo", repository.GetName())
+		assert.Equal(events.PushEvent, event)
+
+		if queueErr == nil {
+			queued = append(queued, payload)
+		}
+
+		return queueErr
+	}
+
+	handler.SetEventDispatcher(dispatch, enqueue)
+
+	// Push events are queued rather than delivered before responding.
+	rsp = serveRequest(t, handler, "POST", "/repos/repo/hook-events/push", *token, body)
+	assert.Equal(http.StatusAccepted, rsp.Code)
+
+	if assert.Equal(1, len(queued)) {
+		payload := queued[0].(events.PushPayload)
+		assert.Equal("repo", payload.Repository)
+		if assert.NotEmpty(payload.Commits) {
+			assert.Equal(testSetup.branch.Hash().String(), payload.Commits[len(payload.Commits)-1].Id)
+		}
+	}
+
+	queueErr = errors.New("queue is full")
+
+	rsp = serveRequest(t, handler, "POST", "/repos/repo/hook-events/push", *token, body)
+	assert.Equal(http.StatusServiceUnavailable, rsp.Code)
+
+	rsp = serveRequest(t, handler, "POST", "/repos/repo/hook-events/does-not-exist", *token, body)
+	assert.Equal(http.StatusBadRequest, rsp.Code)
+
+	rsp = serveRequest(t, handler, "POST", "/repos/repo/hook-events/push", *token, []byte("not json"))
+	assert.Equal(http.StatusBadRequest, rsp.Code)
+
+	// Hook tokens cannot be used for anything else.
+	rsp = serveRequest(t, handler, "GET", "/repos/repo/branches", *token, nil)
+	assert.Equal(http.StatusForbidden, rsp.Code)
+	assert.Contains(rsp.Body.String(), "repository hooks")
+
+	rsp = serveRequest(t, handler, "POST", "/repos/repo/test-event", *token, nil)
+	assert.Equal(http.StatusForbidden, rsp.Code)
+
+	assert.Equal(1, len(queued))
+}
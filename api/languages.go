@@ -0,0 +1,132 @@
+package api
+
+import (
+	"container/list"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/gorilla/mux"
+
+	"github.com/reviewboard/rb-gateway/repositories"
+)
+
+const (
+	// The number of commits whose language breakdowns are cached.
+	languageCacheSize = 256
+
+	// The version of the language breakdown, which is part of its ETag.
+	//
+	// This must be incremented whenever the detected languages change, so
+	// that clients do not keep using cached breakdowns.
+	languagesETagVersion = 1
+)
+
+// A cache of the language breakdowns of commits.
+//
+// Breakdowns are keyed by repository path and commit ID, since the tree at a
+// commit never changes. The least recently used breakdown is evicted once the
+// cache is full.
+type languageCache struct {
+	lock    sync.Mutex
+	size    int
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+// An entry in the languageCache.
+type languageCacheEntry struct {
+	key       string
+	languages []repositories.LanguageStats
+}
+
+// Create a new language cache holding up to `size` breakdowns.
+func newLanguageCache(size int) *languageCache {
+	return &languageCache{
+		size:    size,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// Return the language breakdown of the tree at a commit.
+//
+// The commit must be a full commit ID. The breakdown is computed if it is not
+// cached.
+func (c *languageCache) get(repo repositories.Repository, commitId string) ([]repositories.LanguageStats, error) {
+	key := repo.GetPath() + "\x00" + commitId
+
+	c.lock.Lock()
+	if element, ok := c.entries[key]; ok {
+		c.order.MoveToFront(element)
+		c.lock.Unlock()
+		return element.Value.(*languageCacheEntry).languages, nil
+	}
+	c.lock.Unlock()
+
+	sizes, err := repo.GetFileSizes(commitId)
+	if err != nil {
+		return nil, err
+	}
+
+	languages := repositories.CountLanguages(sizes)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if _, ok := c.entries[key]; !ok {
+		c.entries[key] = c.order.PushFront(&languageCacheEntry{key, languages})
+
+		if c.order.Len() > c.size {
+			oldest := c.order.Back()
+			c.order.Remove(oldest)
+			delete(c.entries, oldest.Value.(*languageCacheEntry).key)
+		}
+	}
+
+	return languages, nil
+}
+
+// Return the ETag for the language breakdown of a commit.
+func languagesETag(commitId string) string {
+	return fmt.Sprintf(`"languages-%d-%s"`, languagesETagVersion, commitId)
+}
+
+// Return the size of the files of each language in the tree at a commit.
+//
+// Languages are detected from file names, and files whose language is unknown
+// are not counted. The languages are sorted by size, largest first. The
+// commit may also be a symbolic ref. Breakdowns are cached per commit.
+//
+// If the commit ID is a full ID, the response has an ETag, and an HTTP 304 is
+// returned if the request's `If-None-Match` header matches it.
+//
+// URL: `/repos/<repo>/commits/<commit-id>/languages`
+func (api *API) getLanguages(w http.ResponseWriter, r *http.Request) {
+	repo := r.Context().Value("repo").(repositories.Repository)
+	commitId := mux.Vars(r)["commit-id"]
+
+	var etag string
+	if isFullId(commitId) {
+		etag = languagesETag(commitId)
+	}
+
+	var resolved string
+	var languages []repositories.LanguageStats
+	var err error
+
+	if len(commitId) == 0 {
+		http.Error(w, "Commit ID not specified.", http.StatusBadRequest)
+	} else if writeNotModified(w, r, etag, revalidateCacheControl) {
+		return
+	} else if resolved, err = repo.ResolveRef(commitId); err != nil {
+		http.Error(w, fmt.Sprintf("Could not find commit \"%s\": %s", commitId, err.Error()),
+			http.StatusNotFound)
+	} else if languages, err = api.languages.get(repo, resolved); err != nil {
+		http.Error(w, fmt.Sprintf("Could not get the files at commit \"%s\": %s", commitId, err.Error()),
+			http.StatusInternalServerError)
+	} else {
+		setCacheHeaders(w, etag, revalidateCacheControl)
+		writeList(w, r, "", languages, completePage(len(languages)))
+	}
+}
@@ -0,0 +1,108 @@
+package api
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/reviewboard/rb-gateway/repositories"
+)
+
+// The header identifying a response that contains a large file (e.g., a Git
+// LFS object) in place of the pointer to it.
+const largeFileHeader = "X-RBG-Large-File"
+
+// Return the large file that a file being read points to, if any.
+//
+// Only files small enough to be pointers are read. Since the reader cannot be
+// rewound, a reader for the file's contents is also returned, which must be
+// used in place of the original, along with the ID of the large file that
+// the file points to, if it is a pointer (see `largeFileETag()`).
+func openLargeFile(repo repositories.Repository, reader io.Reader, size int64) (*repositories.LargeFile, io.Reader, string, error) {
+	if size < 0 || !mayBeLargeFilePointer(repo, size) {
+		return nil, reader, "", nil
+	}
+
+	contents, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	largeFile, err := repo.OpenLargeFile(contents)
+	return largeFile, bytes.NewReader(contents), largeFilePointerId(repo, contents), err
+}
+
+// Return whether or not a file of the given size may be a pointer to a large
+// file, in which case it must be read to tell.
+func mayBeLargeFilePointer(repo repositories.Repository, size int64) bool {
+	return repo.GetFeatures().LargeFiles && size < repositories.MaxLargeFilePointerSize
+}
+
+// Return the ID of the large file that a file's contents point to, if large
+// files are enabled for the repository and the contents are a pointer.
+func largeFilePointerId(repo repositories.Repository, contents []byte) string {
+	if !repo.GetFeatures().LargeFiles {
+		return ""
+	}
+
+	return repositories.LargeFilePointerId(repo.GetScm(), contents)
+}
+
+// Close a large file, if there is one.
+func closeLargeFile(largeFile *repositories.LargeFile) {
+	if largeFile != nil {
+		largeFile.Close()
+	}
+}
+
+// Return the ETag for a file in a repository before the file is read.
+//
+// Pointers are only replaced by large files if `largeFiles` is enabled for
+// the repository, so the ETags of files in such repositories are marked, and
+// a response cached before the setting was changed is not reused.
+func largeFilesETag(repo repositories.Repository, etag string) string {
+	if etag == "" || !repo.GetFeatures().LargeFiles {
+		return etag
+	}
+
+	return strings.TrimSuffix(etag, `"`) + `-lfs"`
+}
+
+// Return the ETag and `Cache-Control` header for a file once it has been
+// checked for a pointer to a large file.
+//
+// Whether a pointer is replaced by its large file depends on whether the
+// large file is in the local store, which can change. The ETag of a pointer
+// therefore includes the ID of its large file and whether the large file was
+// found, and a pointer whose large file was not found must be revalidated,
+// since the large file may be added to the store later. Other files keep the
+// ETag from `largeFilesETag()`.
+func largeFileETag(etag, cacheControl, pointerId string, largeFile *repositories.LargeFile) (string, string) {
+	if etag == "" || pointerId == "" {
+		return etag, cacheControl
+	}
+
+	etag = strings.TrimSuffix(etag, `"`) + "-" + pointerId
+
+	if largeFile == nil {
+		return etag + `-missing"`, revalidateCacheControl
+	}
+
+	return etag + `"`, cacheControl
+}
+
+// Send a large file to the client in place of the pointer to it.
+//
+// The file is streamed from disk, so it is not reserved against the memory
+// budget, but it is subject to the configured `maxFileSize` and blob
+// redirects like any other file.
+func (api *API) writeLargeFile(w http.ResponseWriter, r *http.Request, largeFile *repositories.LargeFile, etag, cacheControl string) {
+	if api.checkFileSize(w, largeFile.Size) && !api.redirectToBlob(w, r, largeFileBlobKey(largeFile), largeFile, largeFile.Size) {
+		setCacheHeaders(w, etag, cacheControl)
+		w.Header().Set(largeFileHeader, largeFile.Id)
+		w.Header().Set("Content-Type", "application/octet-stream")
+		writeStream(w, r, largeFile, largeFile.Size)
+	}
+}
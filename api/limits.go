@@ -0,0 +1,62 @@
+package api
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+// Read the request body, subject to the configured `maxRequestBodySize`.
+//
+// If the body cannot be read or is too large, an error response is written
+// and false is returned. A missing body is read as empty.
+func (api *API) readRequestBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	if r.Body == nil {
+		return nil, true
+	}
+
+	limit := api.config.MaxRequestBodySize
+	if limit > 0 && r.ContentLength > limit {
+		writeBodyTooLarge(w, limit)
+		return nil, false
+	}
+
+	reader := io.Reader(r.Body)
+	if limit > 0 {
+		reader = io.LimitReader(r.Body, limit+1)
+	}
+
+	body, err := ioutil.ReadAll(reader)
+	if err != nil {
+		http.Error(w, "Could not read request body.", http.StatusBadRequest)
+		return nil, false
+	} else if limit > 0 && int64(len(body)) > limit {
+		writeBodyTooLarge(w, limit)
+		return nil, false
+	}
+
+	return body, true
+}
+
+// Write an error for a request body that is over the limit.
+func writeBodyTooLarge(w http.ResponseWriter, limit int64) {
+	http.Error(w,
+		fmt.Sprintf("Request body is too large; the limit is %d bytes.", limit),
+		http.StatusRequestEntityTooLarge)
+}
+
+// Check a file against the configured `maxFileSize` before it is sent.
+//
+// If the file is too large, an error response is written and false is
+// returned. Files of unknown size (i.e., a negative size) are allowed.
+func (api *API) checkFileSize(w http.ResponseWriter, size int64) bool {
+	if limit := api.config.MaxFileSize; limit > 0 && size > limit {
+		http.Error(w,
+			fmt.Sprintf("File is too large (%d bytes); the limit is %d bytes.", size, limit),
+			http.StatusNotAcceptable)
+		return false
+	}
+
+	return true
+}
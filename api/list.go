@@ -0,0 +1,153 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"strconv"
+
+	"github.com/reviewboard/rb-gateway/repositories"
+)
+
+// Information about a page of a list response.
+type listPage struct {
+	// The total number of items in the list, or -1 if it is unknown (e.g.,
+	// because counting them would require walking the entire history).
+	TotalCount int
+
+	// Whether or not there are more items after this page.
+	HasMore bool
+
+	// The URL of the next page, if there is one that can be requested.
+	Next string
+}
+
+// Return a page describing a complete list of `count` items.
+func completePage(count int) listPage {
+	return listPage{TotalCount: count}
+}
+
+// Return a page describing a page of commits.
+//
+// The total number of commits is unknown. If the page is full, there may be
+// more commits. If `startParam` is given, the next page is requested by
+// starting at the parent of the last commit.
+func (api *API) commitsPage(r *http.Request, commits []repositories.CommitInfo, startParam string) listPage {
+	page := listPage{
+		TotalCount: -1,
+		HasMore:    len(commits) >= repositories.CommitsPageSize,
+	}
+
+	if page.HasMore {
+		if last := commits[len(commits)-1]; last.ParentId == "" {
+			page.HasMore = false
+		} else if startParam != "" {
+			page.Next = api.externalLink(withQueryParam(r, startParam, last.ParentId))
+		}
+	}
+
+	return page
+}
+
+// Write a list of items as a response.
+//
+// Pagination is always described by the `X-Total-Count` header (when the
+// total is known) and a `Link` header with a `rel="next"` URL (when there is
+// a next page).
+//
+// If `key` is empty, the items are written as a JSON array, unless the
+// `envelope` query parameter is true. Otherwise, or in that case, they are
+// written in an object under `key` (or `items`) along with `total_count`,
+// `has_more`, and `next`. Bare arrays are kept as the default because
+// existing clients, such as Review Board, expect them.
+func writeList(w http.ResponseWriter, r *http.Request, key string, items interface{}, page listPage) {
+	if page.TotalCount >= 0 {
+		w.Header().Set("X-Total-Count", strconv.Itoa(page.TotalCount))
+	}
+
+	if page.Next != "" {
+		w.Header().Set("Link", fmt.Sprintf(`<%s>; rel="next"`, page.Next))
+	}
+
+	if key == "" {
+		if envelope, _ := strconv.ParseBool(r.URL.Query().Get("envelope")); envelope {
+			key = "items"
+		}
+	}
+
+	// Nil slices must be written as empty arrays, not null.
+	if value := reflect.ValueOf(items); value.Kind() == reflect.Slice && value.IsNil() {
+		items = reflect.MakeSlice(value.Type(), 0, 0).Interface()
+	}
+
+	var body interface{} = items
+	if key != "" {
+		envelope := map[string]interface{}{
+			key:           items,
+			"total_count": nil,
+			"has_more":    page.HasMore,
+			"next":        nil,
+		}
+
+		if page.TotalCount >= 0 {
+			envelope["total_count"] = page.TotalCount
+		}
+
+		if page.Next != "" {
+			envelope["next"] = page.Next
+		}
+
+		body = envelope
+	}
+
+	response, err := json.Marshal(body)
+	if err != nil {
+		log.Printf("Could not serialize list: %s", err.Error())
+		http.Error(w, "An unexpected error occurred.", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(response)
+}
+
+// Parse the `sort` and `order` query parameters of a list request.
+//
+// `sorts` maps each supported value of `sort` to whether it is descending by
+// default. If `sort` is omitted, an empty field is returned. `order` may be
+// `asc` or `desc`.
+func parseSort(r *http.Request, sorts map[string]bool) (field string, descending bool, err error) {
+	query := r.URL.Query()
+	field = query.Get("sort")
+
+	if field != "" {
+		var ok bool
+		if descending, ok = sorts[field]; !ok {
+			return "", false, fmt.Errorf(`Unsupported sort "%s".`, field)
+		}
+	}
+
+	switch order := query.Get("order"); order {
+	case "":
+	case "asc":
+		descending = false
+	case "desc":
+		descending = true
+	default:
+		return "", false, fmt.Errorf(`Unsupported order "%s"; expected "asc" or "desc".`, order)
+	}
+
+	return field, descending, nil
+}
+
+// Return the URL of the current request with a query parameter replaced.
+func withQueryParam(r *http.Request, name, value string) string {
+	u := *r.URL
+	query := u.Query()
+	query.Set(name, value)
+	u.RawQuery = query.Encode()
+
+	return u.RequestURI()
+}
@@ -0,0 +1,124 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"sync"
+)
+
+// The number of seconds clients are asked to wait when the memory budget is
+// exhausted.
+const memoryBudgetRetryAfter = "1"
+
+// An estimate of the memory used by the contents being sent to clients.
+//
+// This is shared by all requests and kept across configuration reloads, since
+// requests that started before a reload are still in flight.
+type memoryBudget struct {
+	lock  sync.Mutex
+	inUse int64
+}
+
+// Add to the memory in use.
+func (b *memoryBudget) add(size int64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.inUse += size
+}
+
+// Return whether or not the memory in use is under the limit.
+func (b *memoryBudget) available(limit int64) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return b.inUse < limit
+}
+
+// Reserve memory if it fits under the limit, returning whether or not it was
+// reserved.
+//
+// A reservation larger than the limit is still made if no memory is in use,
+// so that a single large object can be sent.
+func (b *memoryBudget) reserve(size, limit int64) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.inUse > 0 && b.inUse+size > limit {
+		return false
+	}
+
+	b.inUse += size
+	return true
+}
+
+// The memory charged to a request.
+//
+// A charge is provided through the request context as `"memory"`.
+type memoryCharge struct {
+	budget *memoryBudget
+	limit  int64
+	size   int64
+}
+
+// Reserve memory for contents that a request is about to load.
+//
+// This must be called before the contents are loaded, with their size. If the
+// budget does not have room for them, an HTTP 503 is written and false is
+// returned. The memory is released once the request has been handled.
+// Requests that are not subject to the budget always succeed. Contents that
+// are streamed to the client without being loaded (e.g., large files) are not
+// reserved.
+func reserveMemory(w http.ResponseWriter, r *http.Request, size int64) bool {
+	charge, ok := r.Context().Value("memory").(*memoryCharge)
+	if !ok || size <= 0 {
+		return true
+	}
+
+	if !charge.budget.reserve(size, charge.limit) {
+		writeMemoryBudgetExhausted(w)
+		return false
+	}
+
+	charge.size += size
+	return true
+}
+
+// Write the response for a request refused because the memory budget is
+// exhausted.
+func writeMemoryBudgetExhausted(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", memoryBudgetRetryAfter)
+	http.Error(w, "The server is too busy to send this content. Try again later.", http.StatusServiceUnavailable)
+}
+
+// A middleware for wrapping routes that load large objects (e.g., files and
+// diffs) into memory.
+//
+// If the memory in use by other requests exceeds the configured
+// `memoryBudget`, an HTTP 503 is returned. Otherwise, the memory the route
+// reserves with `reserveMemory` counts against the budget until the response
+// has been written, and the route returns an HTTP 503 if there is no room
+// for it. A single object larger than the budget is still sent if no others
+// are in flight.
+func (api *API) withMemoryBudget(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit := api.config.MemoryBudget
+		if limit <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if !api.memory.available(limit) {
+			writeMemoryBudgetExhausted(w)
+			return
+		}
+
+		charge := &memoryCharge{budget: api.memory, limit: limit}
+		defer func() {
+			api.memory.add(-charge.size)
+		}()
+
+		ctx := context.WithValue(r.Context(), "memory", charge)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
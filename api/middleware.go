@@ -1,13 +1,100 @@
 package api
 
 import (
+	"fmt"
 	"log"
 	"net/http"
+	"sync"
 	"time"
+
+	"github.com/reviewboard/rb-gateway/config"
 )
 
 const timeLayout = "02/Jan/2006:15:04:05 -0700"
 
+// A middleware wraps a handler with additional behaviour.
+type Middleware func(next http.Handler) http.Handler
+
+// A function that creates a middleware for the given configuration.
+//
+// It is called whenever the configuration is loaded. If it returns an error,
+// the configuration will be rejected.
+type MiddlewareFactory func(cfg *config.Config) (Middleware, error)
+
+var (
+	middlewareLock      sync.RWMutex
+	middlewareFactories = map[string]MiddlewareFactory{
+		"gzip":    newGzipMiddleware,
+		"headers": newHeadersMiddleware,
+		"logging": newLoggingMiddleware,
+	}
+)
+
+// The name of the built-in rate limiting middleware.
+//
+// Unlike other middleware, its state is kept across reloads, so it is created
+// by buildMiddlewareChain rather than by a factory.
+const rateLimitMiddleware = "ratelimit"
+
+// Register a middleware that can be enabled with the `middleware`
+// configuration option.
+//
+// This allows builds of rb-gateway to provide their own middleware. It should
+// be called before the API is created (e.g., from an `init` function). An
+// error is returned if a middleware is already registered with the name.
+func RegisterMiddleware(name string, factory MiddlewareFactory) error {
+	middlewareLock.Lock()
+	defer middlewareLock.Unlock()
+
+	if _, ok := middlewareFactories[name]; ok || name == rateLimitMiddleware {
+		return fmt.Errorf(`Middleware "%s" is already registered.`, name)
+	}
+
+	middlewareFactories[name] = factory
+	return nil
+}
+
+// Wrap a handler with the middleware enabled in the configuration.
+//
+// The first middleware in the configuration is the outermost, i.e., it sees
+// each request first and each response last. The `ratelimit` middleware uses
+// the given limits, which are kept across reloads.
+func buildMiddlewareChain(cfg *config.Config, handler http.Handler, limits *rateLimits) (http.Handler, error) {
+	middlewareLock.RLock()
+	defer middlewareLock.RUnlock()
+
+	seen := make(map[string]bool, len(cfg.Middleware))
+	chain := make([]Middleware, 0, len(cfg.Middleware))
+
+	for _, name := range cfg.Middleware {
+		factory, ok := middlewareFactories[name]
+		if name == rateLimitMiddleware {
+			factory, ok = limits.newMiddleware, true
+		}
+
+		if !ok {
+			return nil, fmt.Errorf(`Unknown middleware "%s".`, name)
+		} else if seen[name] {
+			return nil, fmt.Errorf(`Middleware "%s" is enabled more than once.`, name)
+		}
+
+		seen[name] = true
+
+		middleware, err := factory(cfg)
+		if err != nil {
+			return nil, fmt.Errorf(`Could not create middleware "%s": %s`, name, err.Error())
+		}
+
+		chain = append(chain, middleware)
+	}
+
+	for i := len(chain) - 1; i >= 0; i-- {
+		handler = chain[i](handler)
+	}
+
+	return handler, nil
+}
+
 // A specialized `http.ResponseWriter` for logging.
 type loggingResponseWriter struct {
 	http.ResponseWriter
@@ -27,22 +114,82 @@ func (l *loggingResponseWriter) Write(content []byte) (int, error) {
 	return l.ResponseWriter.Write(content)
 }
 
-// A middleware that provides logging for each HTTP request.
-func loggingMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		logger := loggingResponseWriter{
-			ResponseWriter: w,
-			status:         200,
-			contentLen:     0,
-		}
-		next.ServeHTTP(&logger, r)
-		log.Printf("%s - - [%s] \"%s %s %s\" %d %d",
-			r.RemoteAddr,
-			time.Now().Format(timeLayout),
-			r.Method,
-			r.URL,
-			r.Proto,
-			logger.status,
-			logger.contentLen)
-	})
+// Create a middleware that provides logging for each HTTP request.
+//
+// Each request is logged in the Common Log Format, followed by the time taken
+// to process it. The `requestLogging` configuration controls how much is
+// logged for each route: nothing at all, or, at the debug level, the route,
+// repository, and (redacted) request and response headers as well.
+func newLoggingMiddleware(cfg *config.Config) (Middleware, error) {
+	settings := cfg.RequestLogging
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			logger := loggingResponseWriter{
+				ResponseWriter: w,
+				status:         200,
+				contentLen:     0,
+			}
+			next.ServeHTTP(&logger, r)
+
+			route, repository := unmatchedRoute, ""
+			if timing := requestTimingFrom(r); timing != nil {
+				route, repository = timing.target()
+			}
+
+			level := settings.LevelFor(route)
+			if level == config.RequestLogLevelNone {
+				return
+			}
+
+			log.Printf("%s - - [%s] \"%s %s %s\" %d %d %s",
+				r.RemoteAddr,
+				time.Now().Format(timeLayout),
+				r.Method,
+				r.URL,
+				r.Proto,
+				logger.status,
+				logger.contentLen,
+				formatMilliseconds(time.Since(start)))
+
+			if level == config.RequestLogLevelDebug {
+				logRequestMetadata(r, route, repository, logger.Header())
+			}
+		})
+	}, nil
+}
+
+// Log the metadata of a request and its response.
+//
+// Secrets in the headers are redacted, as they are for recorded requests.
+func logRequestMetadata(r *http.Request, route string, repository string, responseHeaders http.Header) {
+	log.Printf(`Request metadata: "%s %s": route="%s" repository="%s" remote=%s content_length=%d headers=%v response_headers=%v`,
+		r.Method,
+		r.URL.Path,
+		route,
+		repository,
+		r.RemoteAddr,
+		r.ContentLength,
+		redactHeaders(r.Header),
+		redactHeaders(responseHeaders))
+}
+
+// Create a middleware that adds the configured `responseHeaders` to every
+// response.
+func newHeadersMiddleware(cfg *config.Config) (Middleware, error) {
+	headers := make(http.Header, len(cfg.ResponseHeaders))
+	for name, value := range cfg.ResponseHeaders {
+		headers.Set(name, value)
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for name, values := range headers {
+				w.Header()[name] = values
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}, nil
 }
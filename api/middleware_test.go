@@ -0,0 +1,291 @@
+package api_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/reviewboard/rb-gateway/api"
+	"github.com/reviewboard/rb-gateway/api/tokens"
+	"github.com/reviewboard/rb-gateway/config"
+	"github.com/reviewboard/rb-gateway/helpers"
+)
+
+func init() {
+	for _, name := range []string{"test-first", "test-second"} {
+		name := name
+		err := api.RegisterMiddleware(name, func(_ *config.Config) (api.Middleware, error) {
+			return func(next http.Handler) http.Handler {
+				return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					w.Header().Add("X-Test-Middleware", name)
+					next.ServeHTTP(w, r)
+				})
+			}, nil
+		})
+
+		if err != nil {
+			panic(err)
+		}
+	}
+}
+
+func TestRegisterMiddlewareDuplicate(t *testing.T) {
+	assert := assert.New(t)
+
+	err := api.RegisterMiddleware("logging", func(_ *config.Config) (api.Middleware, error) {
+		return nil, nil
+	})
+	assert.NotNil(err)
+}
+
+func TestMiddlewareOrder(t *testing.T) {
+	assert := assert.New(t)
+
+	testSetup := setupRoutesTest(t)
+	defer testSetup.cleanup(t)
+
+	testSetup.config.Middleware = []string{"test-second", "test-first"}
+
+	rsp := testRoute(t, testSetup.config, "/repos/repo/branches", "GET", nil)
+	assert.Equal(http.StatusOK, rsp.Code)
+	assert.Equal([]string{"test-second", "test-first"}, rsp.Header()["X-Test-Middleware"])
+}
+
+func TestHeadersMiddleware(t *testing.T) {
+	assert := assert.New(t)
+
+	testSetup := setupRoutesTest(t)
+	defer testSetup.cleanup(t)
+
+	testSetup.config.Middleware = []string{"logging", "headers"}
+	testSetup.config.ResponseHeaders = map[string]string{
+		"x-frame-options": "DENY",
+	}
+
+	rsp := testRoute(t, testSetup.config, "/repos/does-not-exist/branches", "GET", nil)
+	assert.Equal(http.StatusNotFound, rsp.Code)
+	assert.Equal("DENY", rsp.Header().Get("X-Frame-Options"))
+}
+
+func TestLoggingMiddleware(t *testing.T) {
+	assert := assert.New(t)
+
+	testSetup := setupRoutesTest(t)
+	defer testSetup.cleanup(t)
+
+	var output bytes.Buffer
+	log.SetOutput(&output)
+	defer log.SetOutput(os.Stderr)
+
+	testSetup.config.Middleware = []string{"logging"}
+	testSetup.config.RequestLogging = config.RequestLoggingConfig{
+		Level: config.RequestLogLevelNormal,
+		Routes: map[string]string{
+			"GET /repos/{repo:.+}/branches": config.RequestLogLevelNone,
+			"GET /repos/{repo:.+}/path":     config.RequestLogLevelDebug,
+		},
+	}
+
+	rsp := testRoute(t, testSetup.config, "/repos/repo/branches", "GET", nil)
+	assert.Equal(http.StatusOK, rsp.Code)
+	assert.Equal("", output.String())
+
+	rsp = testRoute(t, testSetup.config, "/repos/does-not-exist/branches", "GET", nil)
+	assert.Equal(http.StatusNotFound, rsp.Code)
+	assert.Equal("", output.String())
+
+	rsp = testRoute(t, testSetup.config, "/does-not-exist", "GET", nil)
+	assert.Equal(http.StatusNotFound, rsp.Code)
+	assert.Contains(output.String(), `"GET /does-not-exist HTTP/1.1" 404`)
+	assert.NotContains(output.String(), "Request metadata")
+
+	output.Reset()
+
+	rsp = testRoute(t, testSetup.config, "/repos/repo/path?format=json", "GET", nil)
+	assert.Equal(http.StatusOK, rsp.Code)
+	assert.Contains(output.String(), `"GET /repos/repo/path?format=json HTTP/1.1" 200`)
+	assert.Contains(output.String(), `Request metadata: "GET /repos/repo/path": route="GET /repos/{repo:.+}/path" repository="repo"`)
+	assert.Contains(output.String(), "Private-Token:[[REDACTED]]")
+
+	output.Reset()
+
+	testSetup.config.RequestLogging.Level = config.RequestLogLevelNone
+
+	rsp = testRoute(t, testSetup.config, "/does-not-exist", "GET", nil)
+	assert.Equal(http.StatusNotFound, rsp.Code)
+	assert.Equal("", output.String())
+}
+
+func TestMiddlewareInvalid(t *testing.T) {
+	assert := assert.New(t)
+
+	testSetup := setupRoutesTest(t)
+	defer testSetup.cleanup(t)
+
+	for _, middleware := range [][]string{
+		{"does-not-exist"},
+		{"logging", "logging"},
+	} {
+		testSetup.config.Middleware = middleware
+
+		handler, err := api.New(testSetup.config)
+		assert.Nil(handler)
+		assert.NotNil(err)
+	}
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	assert := assert.New(t)
+
+	testSetup := setupRoutesTest(t)
+	defer testSetup.cleanup(t)
+
+	testSetup.config.Middleware = []string{"ratelimit"}
+	testSetup.config.RateLimit = config.RateLimitConfig{
+		PerIp:    config.RateLimit{RequestsPerSecond: 0.001, Burst: 4},
+		PerToken: config.RateLimit{RequestsPerSecond: 0.001, Burst: 2},
+	}
+
+	handler, err := api.New(testSetup.config)
+	assert.Nil(err)
+
+	tokenStore := handler.GetTokenStore()
+	firstToken, err := (*tokenStore).New()
+	assert.Nil(err)
+	secondToken, err := (*tokenStore).New()
+	assert.Nil(err)
+
+	request := func(token, remoteAddr string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest("GET", "/repos/repo/branches", nil)
+		request.RemoteAddr = remoteAddr
+		request.Header.Set(api.PrivateTokenHeader, token)
+
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, request)
+
+		return response
+	}
+
+	// Each token has its own limit.
+	assert.Equal(http.StatusOK, request(*firstToken, "192.0.2.1:1234").Code)
+	assert.Equal(http.StatusOK, request(*firstToken, "192.0.2.1:1234").Code)
+
+	rsp := request(*firstToken, "192.0.2.1:1234")
+	assert.Equal(http.StatusTooManyRequests, rsp.Code)
+	assert.Equal("1000", rsp.Header().Get("Retry-After"))
+
+	assert.Equal(http.StatusOK, request(*secondToken, "192.0.2.1:1234").Code)
+
+	// Each address has its own limit, regardless of the token used.
+	assert.Equal(http.StatusTooManyRequests, request(*secondToken, "192.0.2.1:5678").Code)
+	assert.Equal(http.StatusTooManyRequests, request("", "192.0.2.1:1234").Code)
+	assert.Equal(http.StatusUnauthorized, request("", "192.0.2.2:1234").Code)
+
+	// Tokens created for the same user share the user's limit.
+	firstUserToken, err := (*tokenStore).NewWithOptions(tokens.Options{User: "user"})
+	assert.Nil(err)
+	secondUserToken, err := (*tokenStore).NewWithOptions(tokens.Options{User: "user"})
+	assert.Nil(err)
+
+	assert.Equal(http.StatusOK, request(*firstUserToken, "192.0.2.3:1234").Code)
+	assert.Equal(http.StatusOK, request(*secondUserToken, "192.0.2.4:1234").Code)
+	assert.Equal(http.StatusTooManyRequests, request(*firstUserToken, "192.0.2.5:1234").Code)
+
+	// Limits are kept when the configuration is reloaded.
+	assert.Nil(handler.SetConfig(testSetup.config))
+
+	tokenStore = handler.GetTokenStore()
+	thirdUserToken, err := (*tokenStore).NewWithOptions(tokens.Options{User: "user"})
+	assert.Nil(err)
+
+	assert.Equal(http.StatusTooManyRequests, request(*thirdUserToken, "192.0.2.6:1234").Code)
+	assert.Equal(http.StatusTooManyRequests, request("", "192.0.2.1:1234").Code)
+}
+
+func TestGzipMiddleware(t *testing.T) {
+	assert := assert.New(t)
+
+	testSetup := setupRoutesTest(t)
+	defer testSetup.cleanup(t)
+
+	testSetup.config.Middleware = []string{"gzip"}
+	testSetup.config.Compression = config.CompressionConfig{
+		MinSize:      1,
+		ContentTypes: []string{"application/json"},
+	}
+
+	handler, err := api.New(testSetup.config)
+	assert.Nil(err)
+
+	token, err := (*handler.GetTokenStore()).New()
+	assert.Nil(err)
+
+	request := func(url, acceptEncoding string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest("GET", url, nil)
+		request.Header.Set(api.PrivateTokenHeader, *token)
+		request.Header.Set("Accept-Encoding", acceptEncoding)
+
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, request)
+
+		return response
+	}
+
+	uncompressed := request("/repos/repo/branches", "")
+	assert.Equal(http.StatusOK, uncompressed.Code)
+	assert.Equal("", uncompressed.Header().Get("Content-Encoding"))
+	assert.Equal("Accept-Encoding", uncompressed.Header().Get("Vary"))
+
+	rsp := request("/repos/repo/branches", "deflate, gzip;q=0.5")
+	assert.Equal(http.StatusOK, rsp.Code)
+	assert.Equal("gzip", rsp.Header().Get("Content-Encoding"))
+	assert.Equal("Accept-Encoding", rsp.Header().Get("Vary"))
+
+	reader, err := gzip.NewReader(rsp.Body)
+	if assert.Nil(err) {
+		body, err := ioutil.ReadAll(reader)
+		assert.Nil(err)
+		assert.Equal(uncompressed.Body.String(), string(body))
+	}
+
+	rsp = request("/repos/repo/branches", "gzip;q=0")
+	assert.Equal(http.StatusOK, rsp.Code)
+	assert.Equal("", rsp.Header().Get("Content-Encoding"))
+
+	rsp = request("/repos/repo/branches", "gzip;q=0, *")
+	assert.Equal(http.StatusOK, rsp.Code)
+	assert.Equal("", rsp.Header().Get("Content-Encoding"))
+
+	rsp = request("/repos/repo/branches", "*;q=0.5")
+	assert.Equal(http.StatusOK, rsp.Code)
+	assert.Equal("gzip", rsp.Header().Get("Content-Encoding"))
+
+	// Files are not compressed, since they are not of a configured type.
+	fileId := helpers.GetRepositoryFileId(t, testSetup.rawRepo, "README").String()
+	rsp = request(fmt.Sprintf("/repos/repo/file/%s", fileId), "gzip")
+	assert.Equal(http.StatusOK, rsp.Code)
+	assert.Equal("", rsp.Header().Get("Content-Encoding"))
+	assert.Equal("", rsp.Header().Get("Vary"))
+
+	// Responses smaller than the minimum size are not compressed.
+	testSetup.config.Compression.MinSize = 1 << 20
+
+	handler, err = api.New(testSetup.config)
+	assert.Nil(err)
+
+	token, err = (*handler.GetTokenStore()).New()
+	assert.Nil(err)
+
+	rsp = request("/repos/repo/branches", "gzip")
+	assert.Equal(http.StatusOK, rsp.Code)
+	assert.Equal("", rsp.Header().Get("Content-Encoding"))
+	assert.Equal(uncompressed.Body.String(), rsp.Body.String())
+}
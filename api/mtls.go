@@ -0,0 +1,60 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/reviewboard/rb-gateway/api/tokens"
+	"github.com/reviewboard/rb-gateway/config"
+)
+
+// Return the user identified by the request's client certificate.
+//
+// Only certificates that were verified against `tls.clientCAPath` are used.
+// If `tls.clientCertIdentity` is not configured, or the certificate does not
+// have the configured name, an empty string is returned.
+//
+// Like request handlers, this must be called with the configuration locked,
+// as it is while ServeHTTP handles the request.
+func (api *API) clientCertUser(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return ""
+	}
+
+	cert := r.TLS.VerifiedChains[0][0]
+
+	switch api.config.TLS.ClientCertIdentity {
+	case config.ClientCertIdentityCN:
+		return cert.Subject.CommonName
+
+	case config.ClientCertIdentitySAN:
+		if len(cert.DNSNames) > 0 {
+			return cert.DNSNames[0]
+		} else if len(cert.EmailAddresses) > 0 {
+			return cert.EmailAddresses[0]
+		}
+	}
+
+	return ""
+}
+
+// Return the access granted by the request's client certificate, or nil if
+// it does not identify a user.
+//
+// Users only have full access when `tls.clientCertRoles` gives them the
+// manager role. Otherwise, they can only read repository data. This must be
+// called with the configuration locked (see clientCertUser()).
+func (api *API) clientCertInfo(r *http.Request) *tokens.Info {
+	user := api.clientCertUser(r)
+	if user == "" {
+		return nil
+	}
+
+	info := &tokens.Info{User: user}
+
+	if api.config.TLS.ClientCertRoles[user] != config.RoleManager {
+		info.ReadOnly = true
+		info.Role = tokens.RoleReader
+	}
+
+	return info
+}
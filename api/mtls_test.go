@@ -0,0 +1,302 @@
+package api_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/reviewboard/rb-gateway/api"
+	"github.com/reviewboard/rb-gateway/config"
+)
+
+// Create a certificate signed by `parent` (or self-signed, if it is nil).
+func createTestCertificate(t *testing.T, template *x509.Certificate, parent *tls.Certificate) tls.Certificate {
+	t.Helper()
+	assert := assert.New(t)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(err)
+
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+
+	parentCert, parentKey := template, interface{}(key)
+	if parent != nil {
+		parentCert = parent.Leaf
+		parentKey = parent.PrivateKey
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parentCert, &key.PublicKey, parentKey)
+	assert.Nil(err)
+
+	leaf, err := x509.ParseCertificate(der)
+	assert.Nil(err)
+
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}
+}
+
+// Write a certificate and its key to PEM files.
+func writeTestCertificate(t *testing.T, cert tls.Certificate, certPath, keyPath string) {
+	t.Helper()
+	assert := assert.New(t)
+
+	assert.Nil(ioutil.WriteFile(certPath,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600))
+
+	if keyPath != "" {
+		der, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+		assert.Nil(err)
+		assert.Nil(ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600))
+	}
+}
+
+func TestClientCertificates(t *testing.T) {
+	assert := assert.New(t)
+
+	testSetup := setupRoutesTest(t)
+	defer testSetup.cleanup(t)
+
+	dir, err := ioutil.TempDir("", "rb-gateway-mtls-")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	ca := createTestCertificate(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+
+	serverCert := createTestCertificate(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "rb-gateway"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, &ca)
+
+	clientCert := createTestCertificate(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "reviewboard"},
+		DNSNames:    []string{"reviews.example.com"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, &ca)
+
+	untrustedCert := createTestCertificate(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "reviewboard"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, nil)
+
+	writeTestCertificate(t, ca, filepath.Join(dir, "ca.pem"), "")
+	writeTestCertificate(t, serverCert, filepath.Join(dir, "server.pem"), filepath.Join(dir, "server.key"))
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Leaf)
+
+	serve := func(identity string, roles map[string]string) (*http.Server, string) {
+		testSetup.config.TLS = config.TLSConfig{
+			Enabled:            true,
+			Certificate:        filepath.Join(dir, "server.pem"),
+			Key:                filepath.Join(dir, "server.key"),
+			ClientCAPath:       filepath.Join(dir, "ca.pem"),
+			ClientCertIdentity: identity,
+			ClientCertRoles:    roles,
+		}
+
+		handler, err := api.New(testSetup.config)
+		assert.Nil(err)
+
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.Nil(err)
+
+		server, _ := handler.ServeListener(listener)
+		return server, "https://" + listener.Addr().String()
+	}
+
+	request := func(baseUrl, path string, cert *tls.Certificate) (int, error) {
+		tlsConfig := &tls.Config{RootCAs: roots}
+		if cert != nil {
+			tlsConfig.Certificates = []tls.Certificate{*cert}
+		}
+
+		client := http.Client{
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		}
+
+		rsp, err := client.Get(baseUrl + path)
+		if err != nil {
+			return 0, err
+		}
+
+		rsp.Body.Close()
+		return rsp.StatusCode, nil
+	}
+
+	// Certificates that identify users can be used instead of tokens. Their
+	// users can only read unless they are given the manager role.
+	server, baseUrl := serve(config.ClientCertIdentityCN, nil)
+
+	status, err := request(baseUrl, "/repos/repo/branches", &clientCert)
+	assert.Nil(err)
+	assert.Equal(http.StatusOK, status)
+
+	status, err = request(baseUrl, "/webhooks", &clientCert)
+	assert.Nil(err)
+	assert.Equal(http.StatusForbidden, status)
+
+	server.Close()
+
+	server, baseUrl = serve(config.ClientCertIdentityCN, map[string]string{"reviewboard": config.RoleManager})
+
+	status, err = request(baseUrl, "/webhooks", &clientCert)
+	assert.Nil(err)
+	assert.Equal(http.StatusOK, status)
+
+	// Clients without a trusted certificate cannot connect.
+	_, err = request(baseUrl, "/repos/repo/branches", nil)
+	assert.NotNil(err)
+
+	_, err = request(baseUrl, "/repos/repo/branches", &untrustedCert)
+	assert.NotNil(err)
+
+	server.Close()
+
+	// The users of certificates are subject to readOnlyUsers.
+	testSetup.config.ReadOnlyUsers = []string{"reviews.example.com"}
+	server, baseUrl = serve(config.ClientCertIdentitySAN, map[string]string{"reviews.example.com": config.RoleManager})
+
+	status, err = request(baseUrl, "/webhooks", &clientCert)
+	assert.Nil(err)
+	assert.Equal(http.StatusForbidden, status)
+
+	server.Close()
+
+	// Otherwise, certificates are required in addition to tokens.
+	server, baseUrl = serve("", nil)
+	defer server.Close()
+
+	status, err = request(baseUrl, "/repos/repo/branches", &clientCert)
+	assert.Nil(err)
+	assert.Equal(http.StatusUnauthorized, status)
+}
+
+func TestClientCertificatesAuthCalloutCache(t *testing.T) {
+	assert := assert.New(t)
+
+	testSetup := setupRoutesTest(t)
+	defer testSetup.cleanup(t)
+
+	dir, err := ioutil.TempDir("", "rb-gateway-mtls-")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	ca := createTestCertificate(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+
+	serverCert := createTestCertificate(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "rb-gateway"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, &ca)
+
+	aliceCert := createTestCertificate(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "alice"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, &ca)
+
+	bobCert := createTestCertificate(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "bob"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, &ca)
+
+	writeTestCertificate(t, ca, filepath.Join(dir, "ca.pem"), "")
+	writeTestCertificate(t, serverCert, filepath.Join(dir, "server.pem"), filepath.Join(dir, "server.key"))
+
+	// The callout only allows alice.
+	callout := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			User string `json:"user"`
+		}
+		assert.Nil(json.NewDecoder(r.Body).Decode(&request))
+
+		if request.User == "alice" {
+			w.Write([]byte(`{"allow": true}`))
+		} else {
+			w.Write([]byte(`{"allow": false}`))
+		}
+	}))
+	defer callout.Close()
+
+	testSetup.config.AuthCallout = config.AuthCalloutConfig{
+		Url:       callout.URL,
+		Timeout:   5,
+		CacheTTL:  60,
+		CacheSize: 10,
+	}
+	testSetup.config.TLS = config.TLSConfig{
+		Enabled:            true,
+		Certificate:        filepath.Join(dir, "server.pem"),
+		Key:                filepath.Join(dir, "server.key"),
+		ClientCAPath:       filepath.Join(dir, "ca.pem"),
+		ClientCertIdentity: config.ClientCertIdentityCN,
+	}
+
+	handler, err := api.New(testSetup.config)
+	assert.Nil(err)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(err)
+
+	server, _ := handler.ServeListener(listener)
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Leaf)
+
+	request := func(cert tls.Certificate) int {
+		client := http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{
+					RootCAs:      roots,
+					Certificates: []tls.Certificate{cert},
+				},
+			},
+		}
+
+		rsp, err := client.Get("https://" + listener.Addr().String() + "/repos/repo/branches")
+		if !assert.Nil(err) {
+			return 0
+		}
+
+		rsp.Body.Close()
+		return rsp.StatusCode
+	}
+
+	// A decision cached for one certificate user is not used for another.
+	assert.Equal(http.StatusOK, request(aliceCert))
+	assert.Equal(http.StatusForbidden, request(bobCert))
+	assert.Equal(http.StatusOK, request(aliceCert))
+	assert.Equal(http.StatusForbidden, request(bobCert))
+}
@@ -0,0 +1,403 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/reviewboard/rb-gateway/config"
+)
+
+const (
+	// The algorithm used to sign requests to object storage.
+	objectSigningAlgorithm = "AWS4-HMAC-SHA256"
+
+	// The format of the timestamps in signed requests.
+	objectTimeLayout = "20060102T150405Z"
+
+	// The payload hash for requests whose payload is not signed.
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+)
+
+// A client for S3-compatible object storage.
+//
+// Requests are signed with AWS Signature Version 4, which S3 and compatible
+// services (e.g., MinIO and Ceph) all accept. Objects are never removed by
+// rb-gateway, so the bucket should have a lifecycle rule that expires them.
+//
+// Objects are uploaded in the background, so that requests do not wait on
+// the storage service.
+type objectStore struct {
+	config config.ObjectStorageConfig
+	client *http.Client
+
+	// The keys of the objects being uploaded in the background.
+	lock      sync.Mutex
+	uploading map[string]struct{}
+
+	// The current time, which is replaced in tests.
+	now func() time.Time
+}
+
+// Return a new object store for the configuration.
+//
+// If object storage is disabled, nil is returned.
+func newObjectStore(cfg config.ObjectStorageConfig) *objectStore {
+	if !cfg.Enabled() {
+		return nil
+	}
+
+	return &objectStore{
+		config: cfg,
+		client: &http.Client{
+			Timeout: time.Duration(cfg.Timeout) * time.Second,
+		},
+		uploading: make(map[string]struct{}),
+		now:       time.Now,
+	}
+}
+
+// Return the URL of the object with the given key.
+func (s *objectStore) url(key string) *url.URL {
+	endpoint, _ := url.Parse(s.config.Endpoint)
+	path := "/" + s.config.Prefix + key
+
+	if s.config.PathStyle {
+		path = "/" + s.config.Bucket + path
+	} else {
+		endpoint.Host = s.config.Bucket + "." + endpoint.Host
+	}
+
+	return &url.URL{
+		Scheme:  endpoint.Scheme,
+		Host:    endpoint.Host,
+		Path:    strings.TrimSuffix(endpoint.Path, "/") + path,
+		RawPath: escapeObjectPath(strings.TrimSuffix(endpoint.Path, "/") + path),
+	}
+}
+
+// Return whether or not an object exists.
+func (s *objectStore) exists(key string) (bool, error) {
+	request, err := http.NewRequest("HEAD", s.url(key).String(), nil)
+	if err != nil {
+		return false, err
+	}
+
+	s.sign(request, sha256Hex(nil))
+
+	response, err := s.client.Do(request)
+	if err != nil {
+		return false, err
+	}
+	response.Body.Close()
+
+	switch response.StatusCode {
+	case http.StatusOK:
+		return true, nil
+
+	case http.StatusNotFound:
+		return false, nil
+
+	default:
+		return false, fmt.Errorf(`Could not check for object "%s": %s`, key, response.Status)
+	}
+}
+
+// Upload a file as an object.
+//
+// The payload hash is the hex-encoded SHA-256 hash of the file's contents.
+// The headers (e.g., `Content-Type`) are stored with the object and sent to
+// clients that download it.
+func (s *objectStore) upload(key string, file *os.File, size int64, payloadHash string, header http.Header) error {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	request, err := http.NewRequest("PUT", s.url(key).String(), ioutil.NopCloser(file))
+	if err != nil {
+		return err
+	}
+
+	request.ContentLength = size
+	for name, values := range header {
+		request.Header[name] = values
+	}
+
+	s.sign(request, payloadHash)
+
+	response, err := s.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(response.Body, 1024))
+		return fmt.Errorf(`Could not upload object "%s": %s: %s`, key, response.Status, strings.TrimSpace(string(body)))
+	}
+
+	return nil
+}
+
+// Sign a request by adding its `Authorization` header.
+func (s *objectStore) sign(request *http.Request, payloadHash string) {
+	now := s.now().UTC()
+
+	request.Header.Set("X-Amz-Date", now.Format(objectTimeLayout))
+	request.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{
+		"host": request.URL.Host,
+	}
+	for name := range request.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(request.Header.Get(name))
+	}
+
+	signedHeaders, canonicalHeaders := canonicalObjectHeaders(headers)
+	canonicalRequest := strings.Join([]string{
+		request.Method,
+		request.URL.EscapedPath(),
+		"",
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	request.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		objectSigningAlgorithm,
+		s.config.AccessKeyId,
+		s.scope(now),
+		signedHeaders,
+		s.signature(now, canonicalRequest)))
+}
+
+// Return a pre-signed URL for downloading an object.
+//
+// The URL is valid for the configured `urlTTL`.
+func (s *objectStore) presign(key string) string {
+	now := s.now().UTC()
+	objectUrl := s.url(key)
+
+	query := url.Values{
+		"X-Amz-Algorithm":     {objectSigningAlgorithm},
+		"X-Amz-Credential":    {fmt.Sprintf("%s/%s", s.config.AccessKeyId, s.scope(now))},
+		"X-Amz-Date":          {now.Format(objectTimeLayout)},
+		"X-Amz-Expires":       {fmt.Sprintf("%d", s.config.UrlTTL)},
+		"X-Amz-SignedHeaders": {"host"},
+	}
+	canonicalQuery := canonicalObjectQuery(query)
+
+	signedHeaders, canonicalHeaders := canonicalObjectHeaders(map[string]string{
+		"host": objectUrl.Host,
+	})
+	canonicalRequest := strings.Join([]string{
+		"GET",
+		objectUrl.EscapedPath(),
+		canonicalQuery,
+		canonicalHeaders,
+		signedHeaders,
+		unsignedPayload,
+	}, "\n")
+
+	objectUrl.RawQuery = fmt.Sprintf("%s&X-Amz-Signature=%s", canonicalQuery, s.signature(now, canonicalRequest))
+	return objectUrl.String()
+}
+
+// Return the credential scope for requests signed at the given time.
+func (s *objectStore) scope(now time.Time) string {
+	return fmt.Sprintf("%s/%s/s3/aws4_request", now.Format("20060102"), s.config.Region)
+}
+
+// Return the signature of a canonical request.
+func (s *objectStore) signature(now time.Time, canonicalRequest string) string {
+	stringToSign := strings.Join([]string{
+		objectSigningAlgorithm,
+		now.Format(objectTimeLayout),
+		s.scope(now),
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := []byte("AWS4" + s.config.SecretAccessKey)
+	for _, part := range []string{now.Format("20060102"), s.config.Region, "s3", "aws4_request"} {
+		key = hmacSha256(key, part)
+	}
+
+	return hex.EncodeToString(hmacSha256(key, stringToSign))
+}
+
+// Return the signed header names and the canonical headers for a request.
+//
+// The header names must already be lowercase.
+func canonicalObjectHeaders(headers map[string]string) (string, string) {
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonical strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&canonical, "%s:%s\n", name, headers[name])
+	}
+
+	return strings.Join(names, ";"), canonical.String()
+}
+
+// Return the canonical form of a query string, with sorted and escaped keys
+// and values.
+func canonicalObjectQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(keys))
+	for _, key := range keys {
+		for _, value := range query[key] {
+			pairs = append(pairs, escapeObjectComponent(key)+"="+escapeObjectComponent(value))
+		}
+	}
+
+	return strings.Join(pairs, "&")
+}
+
+// Escape an object path, leaving its slashes intact.
+func escapeObjectPath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		segments[i] = escapeObjectComponent(segment)
+	}
+
+	return strings.Join(segments, "/")
+}
+
+// Escape every character of a string except those unreserved by RFC 3986, as
+// required for signing.
+func escapeObjectComponent(s string) string {
+	var escaped strings.Builder
+	for _, b := range []byte(s) {
+		if ('A' <= b && b <= 'Z') || ('a' <= b && b <= 'z') || ('0' <= b && b <= '9') ||
+			b == '-' || b == '.' || b == '_' || b == '~' {
+			escaped.WriteByte(b)
+		} else {
+			fmt.Fprintf(&escaped, "%%%02X", b)
+		}
+	}
+
+	return escaped.String()
+}
+
+// Return the hex-encoded SHA-256 hash of some data.
+func sha256Hex(data []byte) string {
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
+
+// Return the HMAC-SHA256 of a message.
+func hmacSha256(key []byte, message string) []byte {
+	mac := hmac.New(sha256.New, key)
+	io.WriteString(mac, message)
+	return mac.Sum(nil)
+}
+
+// Upload the contents of a reader to object storage, unless an object with
+// the key already exists.
+//
+// The contents are written to a temporary file first, since the upload must
+// be signed with their hash and length.
+func (s *objectStore) uploadIfMissing(key string, header http.Header, write func(w io.Writer) error) error {
+	exists, err := s.exists(key)
+	if err != nil {
+		return err
+	} else if exists {
+		return nil
+	}
+
+	temp, err := ioutil.TempFile("", "rb-gateway-object-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+	defer temp.Close()
+
+	hash := sha256.New()
+	counter := &countingWriter{}
+	if err = write(io.MultiWriter(temp, hash, counter)); err != nil {
+		return err
+	}
+
+	return s.upload(key, temp, counter.count, hex.EncodeToString(hash.Sum(nil)), header)
+}
+
+// Upload an object in the background, unless it is already stored or being
+// uploaded.
+//
+// The contents are written by `write`, which is called from another
+// goroutine. Failures are logged, and the upload is attempted again the next
+// time the object is requested.
+func (s *objectStore) uploadInBackground(key string, header http.Header, write func(w io.Writer) error) {
+	s.lock.Lock()
+	if _, uploading := s.uploading[key]; uploading {
+		s.lock.Unlock()
+		return
+	}
+	s.uploading[key] = struct{}{}
+	s.lock.Unlock()
+
+	go func() {
+		defer func() {
+			s.lock.Lock()
+			delete(s.uploading, key)
+			s.lock.Unlock()
+		}()
+
+		if err := s.uploadIfMissing(key, header, write); err != nil {
+			log.Printf(`Could not upload object "%s": %s`, key, err.Error())
+		}
+	}()
+}
+
+// A writer that counts the bytes written to it.
+type countingWriter struct {
+	count int64
+}
+
+func (c *countingWriter) Write(content []byte) (int, error) {
+	c.count += int64(len(content))
+	return len(content), nil
+}
+
+// Redirect the client to an archive in object storage.
+//
+// If true is returned, the archive is stored and the client has been
+// redirected to it. Otherwise, the caller must send the archive itself. If
+// object storage is configured for archives, the archive is uploaded in the
+// background so that later requests are redirected.
+func (api *API) redirectToArchive(w http.ResponseWriter, r *http.Request, key string, header http.Header, write func(w io.Writer) error) bool {
+	if api.objects == nil || !api.config.ObjectStorage.Archives {
+		return false
+	}
+
+	if exists, err := api.objects.exists(key); err != nil {
+		log.Printf(`Could not check for archive "%s": %s`, key, err.Error())
+		return false
+	} else if !exists {
+		api.objects.uploadInBackground(key, header, write)
+		return false
+	}
+
+	http.Redirect(w, r, api.objects.presign(key), http.StatusFound)
+	return true
+}
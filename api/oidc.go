@@ -0,0 +1,409 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc"
+	"gopkg.in/square/go-jose.v2"
+
+	"github.com/reviewboard/rb-gateway/api/tokens"
+	"github.com/reviewboard/rb-gateway/config"
+)
+
+const (
+	// How long the issuer's keys are used before they are fetched again.
+	oidcKeysTTL = time.Hour
+
+	// The least time between fetches of the issuer's keys.
+	//
+	// Tokens signed with an unknown key cause the keys to be fetched again,
+	// in case the issuer has rotated them. This keeps clients from making
+	// rb-gateway fetch them on every request.
+	oidcMinRefreshInterval = time.Minute
+
+	// The largest key set that is read.
+	maxOidcResponseSize = 1 << 20
+)
+
+// The algorithms that tokens may be signed with.
+//
+// These are the asymmetric algorithms that OpenID Connect issuers use. In
+// particular, `none` and the HMAC algorithms are refused, since the keys are
+// public.
+var oidcSigningAlgs = []string{
+	oidc.RS256, oidc.RS384, oidc.RS512,
+	oidc.PS256, oidc.PS384, oidc.PS512,
+	oidc.ES256, oidc.ES384, oidc.ES512,
+}
+
+// An error indicating that a bearer token could not be checked, as opposed
+// to being invalid.
+var errOidcUnavailable = errors.New("The OpenID Connect issuer's keys are unavailable.")
+
+// Checks OpenID Connect bearer tokens and maps them to token information.
+//
+// Tokens are parsed and their claims are checked by go-oidc. The issuer's keys
+// are fetched when they are first needed, and are then cached, so that they
+// can still be used while the issuer is unavailable. The verifier is also the
+// key set that go-oidc checks signatures with.
+type oidcVerifier struct {
+	config   config.OidcConfig
+	client   *http.Client
+	verifier *oidc.IDTokenVerifier
+
+	// A lock for reading from/writing to the fields below.
+	//
+	// It is never held while the keys are being fetched, so that a slow
+	// issuer only delays the requests that need its keys.
+	lock sync.Mutex
+
+	// The URL of the issuer's keys, once it is known.
+	jwksUrl string
+
+	// The issuer's keys.
+	keys []jose.JSONWebKey
+
+	// When the keys were last fetched, successfully or not.
+	fetched time.Time
+
+	// Closed when the keys currently being fetched, if any, have been
+	// fetched.
+	fetching chan struct{}
+}
+
+// Return a new verifier for the configuration.
+//
+// If bearer tokens are not accepted, nil is returned.
+func newOidcVerifier(cfg config.OidcConfig) *oidcVerifier {
+	if !cfg.Enabled() {
+		return nil
+	}
+
+	v := &oidcVerifier{
+		config:  cfg,
+		client:  &http.Client{Timeout: time.Duration(cfg.Timeout) * time.Second},
+		jwksUrl: cfg.JwksUrl,
+	}
+
+	// go-oidc has no allowance for clock differences, so its clock is set
+	// back instead. It allows a minute of difference for `nbf` by itself.
+	skew := time.Duration(cfg.ClockSkew) * time.Second
+
+	v.verifier = oidc.NewVerifier(cfg.Issuer, v, &oidc.Config{
+		ClientID:             cfg.Audience,
+		SupportedSigningAlgs: oidcSigningAlgs,
+		Now: func() time.Time {
+			return time.Now().Add(-skew)
+		},
+	})
+
+	return v
+}
+
+// Return the bearer token in the request's `Authorization` header, if any.
+func bearerToken(r *http.Request) string {
+	parts := strings.SplitN(r.Header.Get("Authorization"), " ", 2)
+	if len(parts) != 2 || !strings.EqualFold(parts[0], "Bearer") {
+		return ""
+	}
+
+	return strings.TrimSpace(parts[1])
+}
+
+// Check a bearer token and return the access it grants.
+//
+// If the issuer's keys cannot be fetched, errOidcUnavailable is returned.
+// Any other error means that the token is invalid or grants no access.
+func (v *oidcVerifier) Verify(raw string) (*tokens.Info, error) {
+	jws, err := jose.ParseSigned(raw)
+	if err != nil {
+		return nil, fmt.Errorf("Bearer token is not a JSON Web Token: %s", err.Error())
+	} else if len(jws.Signatures) != 1 {
+		return nil, errors.New("Bearer token must have exactly one signature.")
+	}
+
+	if err = v.refreshKeys(jws.Signatures[0].Header.KeyID); err != nil {
+		return nil, err
+	}
+
+	token, err := v.verifier.Verify(context.Background(), raw)
+	if err != nil {
+		return nil, fmt.Errorf("Bearer token is invalid: %s", err.Error())
+	}
+
+	var claims map[string]interface{}
+	if err = token.Claims(&claims); err != nil {
+		return nil, fmt.Errorf("Could not parse bearer token claims: %s", err.Error())
+	}
+
+	return v.grantAccess(token, claims)
+}
+
+// Return the access granted by a token that has been verified.
+//
+// Members of several groups have the combined access of all of them. Groups
+// only grant more than reading when their role is RoleManager.
+func (v *oidcVerifier) grantAccess(token *oidc.IDToken, claims map[string]interface{}) (*tokens.Info, error) {
+	user, _ := claims[v.config.UsernameClaim].(string)
+	if user == "" {
+		return nil, fmt.Errorf(`Bearer token has no "%s" claim.`, v.config.UsernameClaim)
+	}
+
+	info := &tokens.Info{
+		Created: token.IssuedAt.UTC(),
+		Expires: token.Expiry.UTC(),
+		User:    user,
+	}
+
+	matched := false
+	manager := false
+	unrestricted := false
+	repos := make(map[string]bool)
+
+	for group, access := range v.config.Groups {
+		if group != "*" && !containsClaim(claims[v.config.GroupsClaim], group) {
+			continue
+		}
+
+		matched = true
+		manager = manager || access.Role == config.RoleManager
+
+		if len(access.Repositories) == 0 {
+			unrestricted = true
+		}
+
+		for _, repo := range access.Repositories {
+			repos[repo] = true
+		}
+	}
+
+	if !matched {
+		return nil, fmt.Errorf(`User "%s" is not in any group with access.`, user)
+	}
+
+	if !manager {
+		info.ReadOnly = true
+		info.Role = tokens.RoleReader
+	}
+
+	if !unrestricted {
+		for repo := range repos {
+			info.Repositories = append(info.Repositories, repo)
+		}
+
+		sort.Strings(info.Repositories)
+	}
+
+	return info, nil
+}
+
+// Verify the signature of a token against the cached keys, returning its
+// payload.
+//
+// This implements oidc.KeySet. It never fetches keys; see refreshKeys().
+func (v *oidcVerifier) VerifySignature(ctx context.Context, raw string) ([]byte, error) {
+	jws, err := jose.ParseSigned(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	v.lock.Lock()
+	keys := v.keys
+	v.lock.Unlock()
+
+	kid := jws.Signatures[0].Header.KeyID
+
+	for _, key := range keys {
+		if kid != "" && key.KeyID != kid {
+			continue
+		}
+
+		if payload, err := jws.Verify(&key); err == nil {
+			return payload, nil
+		}
+	}
+
+	if kid != "" {
+		return nil, fmt.Errorf(`no key with ID "%s" matches the signature`, kid)
+	}
+
+	return nil, errors.New("no key matches the signature")
+}
+
+// Make sure the keys that may have signed a token with the given key ID have
+// been fetched.
+//
+// If no key has the ID, the keys are fetched again, in case the issuer has
+// rotated them. Tokens without a key ID may have been signed by any key. Only
+// one request fetches the keys at a time; the others use the keys they have,
+// or wait for them if there are none yet.
+func (v *oidcVerifier) refreshKeys(kid string) error {
+	v.lock.Lock()
+
+	since := time.Since(v.fetched)
+	stale := v.fetched.IsZero() || since >= oidcKeysTTL ||
+		(!hasOidcKey(v.keys, kid) && since >= oidcMinRefreshInterval)
+
+	fetch := stale && v.fetching == nil
+	if fetch {
+		v.fetching = make(chan struct{})
+		v.fetched = time.Now()
+	}
+
+	fetching := v.fetching
+	wait := fetching != nil && (stale || len(v.keys) == 0)
+	v.lock.Unlock()
+
+	if fetch {
+		v.fetchKeys(fetching)
+	} else if wait {
+		<-fetching
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if len(v.keys) == 0 {
+		return errOidcUnavailable
+	}
+
+	return nil
+}
+
+// Return whether or not a key has the given ID. Any key matches an empty ID.
+func hasOidcKey(keys []jose.JSONWebKey, kid string) bool {
+	for _, key := range keys {
+		if kid == "" || key.KeyID == kid {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Fetch the issuer's keys, and then close the channel.
+//
+// If the keys cannot be fetched, the previous keys are kept, so that an outage
+// of the issuer does not lock everyone out.
+func (v *oidcVerifier) fetchKeys(done chan struct{}) {
+	defer close(done)
+
+	keys, jwksUrl, err := v.loadKeys()
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	v.fetching = nil
+
+	if err != nil {
+		log.Printf("Could not fetch OpenID Connect keys: %s", err.Error())
+		return
+	}
+
+	v.keys = keys
+	v.jwksUrl = jwksUrl
+}
+
+// Load the issuer's keys, discovering where they are first if necessary.
+//
+// The keys are returned along with the URL they were loaded from.
+func (v *oidcVerifier) loadKeys() ([]jose.JSONWebKey, string, error) {
+	v.lock.Lock()
+	jwksUrl := v.jwksUrl
+	v.lock.Unlock()
+
+	if jwksUrl == "" {
+		ctx := oidc.ClientContext(context.Background(), v.client)
+
+		provider, err := oidc.NewProvider(ctx, v.config.Issuer)
+		if err != nil {
+			return nil, "", err
+		}
+
+		var discovery struct {
+			JwksUri string `json:"jwks_uri"`
+		}
+
+		if err = provider.Claims(&discovery); err != nil {
+			return nil, "", err
+		} else if discovery.JwksUri == "" {
+			return nil, "", fmt.Errorf("The discovery document for %s has no jwks_uri.", v.config.Issuer)
+		}
+
+		jwksUrl = discovery.JwksUri
+	}
+
+	rsp, err := v.client.Get(jwksUrl)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rsp.Body.Close()
+
+	if rsp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("%s returned %s", jwksUrl, rsp.Status)
+	}
+
+	content, err := ioutil.ReadAll(io.LimitReader(rsp.Body, maxOidcResponseSize))
+	if err != nil {
+		return nil, "", err
+	}
+
+	// Each key is parsed separately, so that a key rb-gateway cannot use does
+	// not keep it from using the others.
+	var keySet struct {
+		Keys []json.RawMessage `json:"keys"`
+	}
+
+	if err = json.Unmarshal(content, &keySet); err != nil {
+		return nil, "", fmt.Errorf("Could not parse %s: %s", jwksUrl, err.Error())
+	}
+
+	keys := []jose.JSONWebKey{}
+	for _, raw := range keySet.Keys {
+		var key jose.JSONWebKey
+
+		if err := key.UnmarshalJSON(raw); err != nil {
+			log.Printf("Ignoring OpenID Connect key from %s: %s", jwksUrl, err.Error())
+		} else if key.Use != "" && key.Use != "sig" {
+			continue
+		} else if !key.IsPublic() || !key.Valid() {
+			log.Printf(`Ignoring OpenID Connect key "%s": it is not a valid public key`, key.KeyID)
+		} else {
+			keys = append(keys, key)
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil, "", fmt.Errorf("%s has no usable signing keys", jwksUrl)
+	}
+
+	return keys, jwksUrl, nil
+}
+
+// Return whether or not a claim is, or is a list containing, the value.
+func containsClaim(claim interface{}, value string) bool {
+	switch claim := claim.(type) {
+	case string:
+		return claim == value
+
+	case []interface{}:
+		for _, item := range claim {
+			if item == value {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,302 @@
+package api_test
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/reviewboard/rb-gateway/api"
+	"github.com/reviewboard/rb-gateway/config"
+)
+
+// Encode a value as a base64url JSON segment of a JSON Web Token.
+func encodeJwtSegment(t *testing.T, value interface{}) string {
+	t.Helper()
+
+	content, err := json.Marshal(value)
+	assert.Nil(t, err)
+
+	return base64.RawURLEncoding.EncodeToString(content)
+}
+
+// Create a JSON Web Token signed with RS256 or ES256, depending on the key.
+func signTestJwt(t *testing.T, key crypto.Signer, kid string, claims map[string]interface{}) string {
+	t.Helper()
+	assert := assert.New(t)
+
+	alg := "RS256"
+	if _, ok := key.(*ecdsa.PrivateKey); ok {
+		alg = "ES256"
+	}
+
+	signed := encodeJwtSegment(t, map[string]string{"alg": alg, "kid": kid, "typ": "JWT"}) +
+		"." + encodeJwtSegment(t, claims)
+	digest := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+	var err error
+
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+		assert.Nil(err)
+
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		assert.Nil(err)
+
+		signature = make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// Serve a request with a bearer token.
+func serveBearerRequest(t *testing.T, handler *api.API, method, url, token string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	request, err := http.NewRequest(method, url, nil)
+	assert.Nil(t, err)
+
+	request.Header.Set("Authorization", "Bearer "+token)
+
+	response := httptest.NewRecorder()
+	handler.ServeHTTP(response, request)
+
+	return response
+}
+
+func TestOidcBearerTokens(t *testing.T) {
+	assert := assert.New(t)
+
+	testSetup := setupRoutesTest(t)
+	defer testSetup.cleanup(t)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(err)
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(err)
+
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(err)
+
+	var lock sync.Mutex
+	keyFetches := 0
+	available := true
+
+	var issuer string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		if !available {
+			http.Error(w, "Down for maintenance", http.StatusServiceUnavailable)
+			return
+		}
+
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(map[string]string{
+				"issuer":   issuer,
+				"jwks_uri": issuer + "/keys",
+			})
+
+		case "/keys":
+			keyFetches++
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"keys": []map[string]string{
+					{
+						"kty": "RSA",
+						"kid": "rsa-key",
+						"use": "sig",
+						"n":   base64.RawURLEncoding.EncodeToString(rsaKey.N.Bytes()),
+						"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(rsaKey.E)).Bytes()),
+					},
+					{
+						"kty": "EC",
+						"kid": "ec-key",
+						"crv": "P-256",
+						"x":   base64.RawURLEncoding.EncodeToString(ecKey.X.Bytes()),
+						"y":   base64.RawURLEncoding.EncodeToString(ecKey.Y.Bytes()),
+					},
+				},
+			})
+
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	issuer = server.URL
+
+	testSetup.config.Oidc = config.OidcConfig{
+		Issuer:        issuer,
+		Audience:      "rb-gateway",
+		UsernameClaim: "preferred_username",
+		GroupsClaim:   "groups",
+		Groups: map[string]config.OidcGroupAccess{
+			"developers": {Role: config.RoleManager},
+			"auditors":   {Repositories: []string{"repo"}},
+			"contractors": {
+				Repositories: []string{"other-repo"},
+				Role:         config.RoleManager,
+			},
+			"staff": {Role: config.RoleReader},
+		},
+		ClockSkew: 60,
+		Timeout:   5,
+	}
+
+	handler, err := api.New(testSetup.config)
+	assert.Nil(err)
+
+	claims := func(groups ...string) map[string]interface{} {
+		return map[string]interface{}{
+			"iss":                issuer,
+			"aud":                []string{"other-client", "rb-gateway"},
+			"sub":                "1234",
+			"preferred_username": "jdoe",
+			"groups":             groups,
+			"iat":                time.Now().Unix(),
+			"exp":                time.Now().Add(time.Hour).Unix(),
+		}
+	}
+
+	// Members of an unrestricted group have full access, with tokens signed
+	// by either key.
+	for _, token := range []string{
+		signTestJwt(t, rsaKey, "rsa-key", claims("developers")),
+		signTestJwt(t, ecKey, "ec-key", claims("developers")),
+		signTestJwt(t, rsaKey, "", claims("developers")),
+	} {
+		rsp := serveBearerRequest(t, handler, "GET", "/repos/repo/branches", token)
+		assert.Equal(http.StatusOK, rsp.Code)
+
+		rsp = serveBearerRequest(t, handler, "GET", "/webhooks", token)
+		assert.Equal(http.StatusOK, rsp.Code)
+	}
+
+	assert.Equal(1, keyFetches)
+
+	// Groups restrict access to their repositories, and only grant more than
+	// reading when they have the manager role.
+	token := signTestJwt(t, rsaKey, "rsa-key", claims("auditors"))
+
+	rsp := serveBearerRequest(t, handler, "GET", "/repos/repo/branches", token)
+	assert.Equal(http.StatusOK, rsp.Code)
+
+	rsp = serveBearerRequest(t, handler, "GET", "/webhooks", token)
+	assert.Equal(http.StatusForbidden, rsp.Code)
+
+	rsp = serveBearerRequest(t, handler, "POST", "/repos/repo/test-event", token)
+	assert.Equal(http.StatusForbidden, rsp.Code)
+	assert.Equal("This token is read-only.\n", rsp.Body.String())
+
+	token = signTestJwt(t, rsaKey, "rsa-key", claims("staff"))
+
+	rsp = serveBearerRequest(t, handler, "GET", "/repos/repo/branches", token)
+	assert.Equal(http.StatusOK, rsp.Code)
+
+	rsp = serveBearerRequest(t, handler, "GET", "/webhooks", token)
+	assert.Equal(http.StatusForbidden, rsp.Code)
+
+	rsp = serveBearerRequest(t, handler, "POST", "/repos/repo/test-event", token)
+	assert.Equal(http.StatusForbidden, rsp.Code)
+
+	token = signTestJwt(t, rsaKey, "rsa-key", claims("contractors"))
+	rsp = serveBearerRequest(t, handler, "GET", "/repos/repo/branches", token)
+	assert.Equal(http.StatusForbidden, rsp.Code)
+
+	// Members of several groups have the combined access of all of them.
+	token = signTestJwt(t, rsaKey, "rsa-key", claims("staff", "developers"))
+	rsp = serveBearerRequest(t, handler, "GET", "/webhooks", token)
+	assert.Equal(http.StatusOK, rsp.Code)
+
+	// Tokens are refused if anything about them is wrong.
+	noGroups := claims("visitors")
+
+	wrongIssuer := claims("developers")
+	wrongIssuer["iss"] = "https://evil.example.com"
+
+	wrongAudience := claims("developers")
+	wrongAudience["aud"] = "other-client"
+
+	expired := claims("developers")
+	expired["exp"] = time.Now().Add(-2 * time.Minute).Unix()
+
+	notYetValid := claims("developers")
+	notYetValid["nbf"] = time.Now().Add(time.Hour).Unix()
+
+	noUser := claims("developers")
+	delete(noUser, "preferred_username")
+
+	valid := signTestJwt(t, rsaKey, "rsa-key", claims("developers"))
+	unsigned := encodeJwtSegment(t, map[string]string{"alg": "none"}) + "." +
+		encodeJwtSegment(t, claims("developers")) + "."
+
+	for _, token := range []string{
+		signTestJwt(t, rsaKey, "rsa-key", noGroups),
+		signTestJwt(t, rsaKey, "rsa-key", wrongIssuer),
+		signTestJwt(t, rsaKey, "rsa-key", wrongAudience),
+		signTestJwt(t, rsaKey, "rsa-key", expired),
+		signTestJwt(t, rsaKey, "rsa-key", notYetValid),
+		signTestJwt(t, rsaKey, "rsa-key", noUser),
+		signTestJwt(t, otherKey, "rsa-key", claims("developers")),
+		signTestJwt(t, ecKey, "rsa-key", claims("developers")),
+		valid[:len(valid)-4] + "AAAA",
+		unsigned,
+		"not-a-jwt",
+	} {
+		rsp := serveBearerRequest(t, handler, "GET", "/repos/repo/branches", token)
+		assert.Equal(http.StatusUnauthorized, rsp.Code, token)
+	}
+
+	// A token signed with an unknown key makes the keys be fetched again, but
+	// not more than once a minute.
+	token = signTestJwt(t, otherKey, "new-key", claims("developers"))
+
+	rsp = serveBearerRequest(t, handler, "GET", "/repos/repo/branches", token)
+	assert.Equal(http.StatusUnauthorized, rsp.Code)
+	assert.Equal(1, keyFetches)
+
+	// Keys that have been fetched are used while the issuer is unavailable,
+	// but tokens cannot be checked until they have been fetched once.
+	lock.Lock()
+	available = false
+	lock.Unlock()
+
+	rsp = serveBearerRequest(t, handler, "GET", "/repos/repo/branches", valid)
+	assert.Equal(http.StatusOK, rsp.Code)
+
+	handler, err = api.New(testSetup.config)
+	assert.Nil(err)
+
+	rsp = serveBearerRequest(t, handler, "GET", "/repos/repo/branches", valid)
+	assert.Equal(http.StatusServiceUnavailable, rsp.Code)
+
+	// Bearer tokens are ignored when OpenID Connect is not configured.
+	testSetup.config.Oidc = config.OidcConfig{}
+
+	handler, err = api.New(testSetup.config)
+	assert.Nil(err)
+
+	rsp = serveBearerRequest(t, handler, "GET", "/repos/repo/branches", valid)
+	assert.Equal(http.StatusUnauthorized, rsp.Code)
+}
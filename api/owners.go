@@ -0,0 +1,129 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"github.com/reviewboard/rb-gateway/repositories"
+)
+
+// The owners of a set of paths.
+type ownersResponse struct {
+	// The path of the owners file that was used, or an empty string if the
+	// repository has none.
+	OwnersFile string `json:"owners_file"`
+
+	// Every owner of any of the paths, sorted and without duplicates.
+	Owners []string `json:"owners"`
+
+	// The owners of each path.
+	Paths []pathOwners `json:"paths"`
+}
+
+// The owners of a single path.
+type pathOwners struct {
+	Path   string   `json:"path"`
+	Owners []string `json:"owners"`
+}
+
+// Write the owners of a set of paths, according to the owners file at a
+// commit.
+func (api *API) writeOwners(w http.ResponseWriter, repo repositories.Repository, commitId string, paths []string) {
+	ownersPath, ownersFile, err := repositories.LoadOwnersFile(repo, commitId, api.config.OwnersFiles)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Could not load the owners file at commit \"%s\": %s", commitId, err.Error()),
+			http.StatusInternalServerError)
+		return
+	}
+
+	if ownersFile == nil {
+		ownersFile = repositories.ParseOwnersFile(nil)
+	}
+
+	response := ownersResponse{
+		OwnersFile: ownersPath,
+		Owners:     ownersFile.OwnersOf(paths),
+		Paths:      make([]pathOwners, 0, len(paths)),
+	}
+
+	for _, path := range paths {
+		response.Paths = append(response.Paths, pathOwners{path, ownersFile.Owners(path)})
+	}
+
+	body, err := json.Marshal(response)
+	if err != nil {
+		log.Printf("Could not serialize owners: %s", err.Error())
+		http.Error(w, "An unexpected error occurred.", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+// Return the owners of the files changed by a commit.
+//
+// Owners are read from the first of the configured `ownersFiles` (e.g.,
+// `CODEOWNERS`) that exists at the commit. The commit may also be a symbolic
+// ref.
+//
+// URL: `/repos/<repo>/commits/<commit-id>/owners`
+func (api *API) getCommitOwners(w http.ResponseWriter, r *http.Request) {
+	repo := r.Context().Value("repo").(repositories.Repository)
+	commitId := mux.Vars(r)["commit-id"]
+
+	var resolved string
+	var paths []string
+	var err error
+
+	if len(commitId) == 0 {
+		http.Error(w, "Commit ID not specified.", http.StatusBadRequest)
+	} else if resolved, err = repo.ResolveRef(commitId); err != nil {
+		http.Error(w, fmt.Sprintf("Could not find commit \"%s\": %s", commitId, err.Error()),
+			http.StatusNotFound)
+	} else if paths, err = repo.GetChangedFiles(resolved); err != nil {
+		http.Error(w, fmt.Sprintf("Could not get the files changed by commit \"%s\": %s", commitId, err.Error()),
+			http.StatusInternalServerError)
+	} else {
+		api.writeOwners(w, repo, resolved, paths)
+	}
+}
+
+// Return the owners of the given paths at a ref.
+//
+// The paths are given by one or more `path` query parameters. Owners are read
+// from the first of the configured `ownersFiles` (e.g., `CODEOWNERS`) that
+// exists at the ref. The paths do not need to exist at the ref, so that the
+// owners of new files can be found.
+//
+// URL: `/repos/<repo>/refs/<ref>/owners?path=<path>`
+func (api *API) getOwnersByRef(w http.ResponseWriter, r *http.Request) {
+	repo := r.Context().Value("repo").(repositories.Repository)
+	ref := mux.Vars(r)["ref"]
+
+	paths := []string{}
+	for _, path := range r.URL.Query()["path"] {
+		if path = strings.TrimPrefix(path, "/"); path != "" {
+			paths = append(paths, path)
+		}
+	}
+
+	var resolved string
+	var err error
+
+	if len(ref) == 0 {
+		http.Error(w, "Ref not specified.", http.StatusBadRequest)
+	} else if len(paths) == 0 {
+		http.Error(w, "No paths specified.", http.StatusBadRequest)
+	} else if resolved, err = repo.ResolveRef(ref); err != nil {
+		http.Error(w, fmt.Sprintf("Could not find ref \"%s\": %s", ref, err.Error()),
+			http.StatusNotFound)
+	} else {
+		api.writeOwners(w, repo, resolved, paths)
+	}
+}
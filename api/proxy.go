@@ -0,0 +1,283 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/reviewboard/rb-gateway/config"
+)
+
+const (
+	// The header listing the addresses that a request was forwarded for.
+	forwardedForHeader = "X-Forwarded-For"
+
+	// How long a trusted proxy has to send the PROXY protocol header.
+	proxyHeaderTimeout = 5 * time.Second
+
+	// The maximum length of a version 1 PROXY protocol header, including the
+	// trailing CRLF.
+	maxProxyHeaderV1Size = 107
+)
+
+// The signature that begins a version 2 PROXY protocol header.
+var proxyHeaderV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// Create a middleware that replaces the address of requests from trusted
+// proxies with the address of the client they were forwarded for.
+//
+// The `X-Forwarded-For` header is read from right to left, skipping the
+// addresses of trusted proxies, so that a client cannot choose its own address
+// by sending the header itself. The middleware that run after this one (e.g.,
+// logging and rate limiting) see the client's address.
+func newForwardedForMiddleware(cfg *config.Config) Middleware {
+	return func(next http.Handler) http.Handler {
+		if len(cfg.TrustedProxyNets) == 0 {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if client := forwardedClient(cfg, r); client != "" {
+				r = r.WithContext(r.Context())
+				r.RemoteAddr = client
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Return the address of the client that a trusted proxy forwarded a request
+// for.
+//
+// If the request did not come from a trusted proxy or does not say who it
+// was forwarded for, an empty string is returned.
+func forwardedClient(cfg *config.Config, r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	if ip := net.ParseIP(host); ip == nil || !cfg.IsTrustedProxy(ip) {
+		return ""
+	}
+
+	addrs := []string{}
+	for _, value := range r.Header.Values(forwardedForHeader) {
+		addrs = append(addrs, strings.Split(value, ",")...)
+	}
+
+	client := ""
+	for i := len(addrs) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(addrs[i]))
+		if ip == nil {
+			break
+		}
+
+		client = ip.String()
+		if !cfg.IsTrustedProxy(ip) {
+			break
+		}
+	}
+
+	return client
+}
+
+// A listener that reads the PROXY protocol header sent by trusted proxies.
+//
+// Connections from trusted proxies must begin with a version 1 or 2 header,
+// whose source address becomes the address of the connection. Connections
+// from other addresses are accepted unchanged.
+type proxyProtocolListener struct {
+	net.Listener
+
+	// Return whether or not an address belongs to a trusted proxy.
+	trusted func(ip net.IP) bool
+}
+
+// Accept the next connection.
+func (l *proxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); !ok || !l.trusted(addr.IP) {
+		return conn, nil
+	}
+
+	return &proxyProtocolConn{Conn: conn}, nil
+}
+
+// A connection from a trusted proxy that begins with a PROXY protocol header.
+//
+// The header is read the first time the connection is used, rather than when
+// it is accepted, so that a slow proxy does not hold up other connections.
+type proxyProtocolConn struct {
+	net.Conn
+
+	once   sync.Once
+	reader *bufio.Reader
+
+	// The address of the client, if the header provided one.
+	remoteAddr net.Addr
+
+	// The error reading the header, if any.
+	err error
+}
+
+// Read the PROXY protocol header, if it has not been read yet.
+func (c *proxyProtocolConn) readHeader() {
+	c.once.Do(func() {
+		c.reader = bufio.NewReader(c.Conn)
+
+		c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		c.remoteAddr, c.err = readProxyHeader(c.reader)
+		c.Conn.SetReadDeadline(time.Time{})
+
+		if c.err != nil {
+			log.Printf("Invalid PROXY protocol header from %s: %s", c.Conn.RemoteAddr(), c.err.Error())
+			c.Conn.Close()
+		}
+	})
+}
+
+// Read data from the connection, after the PROXY protocol header.
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+
+	return c.reader.Read(b)
+}
+
+// Return the address of the client that the proxy forwarded the connection
+// for.
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+
+	return c.Conn.RemoteAddr()
+}
+
+// Read a version 1 or 2 PROXY protocol header.
+//
+// The source address from the header is returned. If the header does not
+// provide one (e.g., for health checks made by the proxy itself), nil is
+// returned instead.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	signature, err := r.Peek(len(proxyHeaderV2Signature))
+	if err != nil {
+		return nil, err
+	}
+
+	if bytes.Equal(signature, proxyHeaderV2Signature) {
+		return readProxyHeaderV2(r)
+	}
+
+	return readProxyHeaderV1(r)
+}
+
+// Read a version 1 (text) PROXY protocol header.
+//
+// The header is of the form `PROXY TCP4 <src> <dst> <src port> <dst port>`.
+func readProxyHeaderV1(r *bufio.Reader) (net.Addr, error) {
+	line := make([]byte, 0, maxProxyHeaderV1Size)
+
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) == maxProxyHeaderV1Size {
+			return nil, errors.New("header is too long")
+		}
+
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+
+		line = append(line, c)
+	}
+
+	fields := strings.Split(strings.TrimSuffix(string(line), "\r\n"), " ")
+	if fields[0] != "PROXY" || len(fields) < 2 {
+		return nil, errors.New("missing PROXY header")
+	}
+
+	if fields[1] == "UNKNOWN" {
+		return nil, nil
+	} else if (fields[1] != "TCP4" && fields[1] != "TCP6") || len(fields) != 6 {
+		return nil, fmt.Errorf("malformed header %q", string(line))
+	}
+
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("malformed header %q", string(line))
+	}
+
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// Read a version 2 (binary) PROXY protocol header.
+func readProxyHeaderV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, len(proxyHeaderV2Signature)+4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	versionCommand := header[12]
+	family := header[13]
+	length := binary.BigEndian.Uint16(header[14:])
+
+	if versionCommand>>4 != 2 {
+		return nil, fmt.Errorf("unsupported version %d", versionCommand>>4)
+	}
+
+	addresses := make([]byte, length)
+	if _, err := io.ReadFull(r, addresses); err != nil {
+		return nil, err
+	}
+
+	// The LOCAL command is used for connections made by the proxy itself.
+	if versionCommand&0xf == 0 {
+		return nil, nil
+	} else if versionCommand&0xf != 1 {
+		return nil, fmt.Errorf("unsupported command %d", versionCommand&0xf)
+	}
+
+	switch family {
+	case 0x11: // TCP over IPv4.
+		if length < 12 {
+			return nil, errors.New("truncated addresses")
+		}
+
+		return &net.TCPAddr{
+			IP:   net.IP(addresses[0:4]),
+			Port: int(binary.BigEndian.Uint16(addresses[8:10])),
+		}, nil
+
+	case 0x21: // TCP over IPv6.
+		if length < 36 {
+			return nil, errors.New("truncated addresses")
+		}
+
+		return &net.TCPAddr{
+			IP:   net.IP(addresses[0:16]),
+			Port: int(binary.BigEndian.Uint16(addresses[32:34])),
+		}, nil
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,141 @@
+package api_test
+
+import (
+	"bufio"
+	"encoding/binary"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/reviewboard/rb-gateway/api"
+	"github.com/reviewboard/rb-gateway/config"
+)
+
+func TestForwardedFor(t *testing.T) {
+	assert := assert.New(t)
+
+	testSetup := setupRoutesTest(t)
+	defer testSetup.cleanup(t)
+
+	var err error
+	testSetup.config.TrustedProxies = []string{"10.0.0.0/8", "192.0.2.1"}
+	testSetup.config.TrustedProxyNets, err = config.ParseTrustedProxies(testSetup.config.TrustedProxies)
+	assert.Nil(err)
+
+	testSetup.config.Middleware = []string{"ratelimit"}
+	testSetup.config.RateLimit = config.RateLimitConfig{
+		PerIp:    config.RateLimit{RequestsPerSecond: 0.001, Burst: 1},
+		PerToken: config.RateLimit{RequestsPerSecond: 1000, Burst: 1000},
+	}
+
+	handler, err := api.New(testSetup.config)
+	assert.Nil(err)
+
+	token, err := (*handler.GetTokenStore()).New()
+	assert.Nil(err)
+
+	request := func(remoteAddr string, forwardedFor ...string) int {
+		request := httptest.NewRequest("GET", "/repos/repo/branches", nil)
+		request.RemoteAddr = remoteAddr
+		request.Header.Set(api.PrivateTokenHeader, *token)
+
+		for _, value := range forwardedFor {
+			request.Header.Add("X-Forwarded-For", value)
+		}
+
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, request)
+
+		return response.Code
+	}
+
+	// Requests forwarded by a trusted proxy are limited by the client's
+	// address, skipping any other trusted proxies.
+	assert.Equal(http.StatusOK, request("192.0.2.1:1234", "203.0.113.1"))
+	assert.Equal(http.StatusOK, request("192.0.2.1:1234", "203.0.113.2, 10.1.2.3"))
+	assert.Equal(http.StatusTooManyRequests, request("192.0.2.1:1234", "203.0.113.2"))
+	assert.Equal(http.StatusTooManyRequests, request("10.1.2.3:1234", "198.51.100.1, 203.0.113.1"))
+	assert.Equal(http.StatusOK, request("10.1.2.3:1234", "203.0.113.3", "10.4.5.6"))
+
+	// Clients cannot choose their own address through the header.
+	assert.Equal(http.StatusOK, request("198.51.100.2:1234", "203.0.113.4"))
+	assert.Equal(http.StatusTooManyRequests, request("198.51.100.2:1234", "203.0.113.5"))
+}
+
+func TestProxyProtocol(t *testing.T) {
+	assert := assert.New(t)
+
+	testSetup := setupRoutesTest(t)
+	defer testSetup.cleanup(t)
+
+	var err error
+	testSetup.config.ProxyProtocol = true
+	testSetup.config.TrustedProxies = []string{"127.0.0.1"}
+	testSetup.config.TrustedProxyNets, err = config.ParseTrustedProxies(testSetup.config.TrustedProxies)
+	assert.Nil(err)
+
+	testSetup.config.Middleware = []string{"ratelimit"}
+	testSetup.config.RateLimit = config.RateLimitConfig{
+		PerIp:    config.RateLimit{RequestsPerSecond: 0.001, Burst: 1},
+		PerToken: config.RateLimit{RequestsPerSecond: 1000, Burst: 1000},
+	}
+
+	handler, err := api.New(testSetup.config)
+	assert.Nil(err)
+
+	token, err := (*handler.GetTokenStore()).New()
+	assert.Nil(err)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(err)
+
+	server, _ := handler.ServeListener(listener)
+	defer server.Close()
+
+	request := func(header []byte) int {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if !assert.Nil(err) {
+			return 0
+		}
+
+		defer conn.Close()
+
+		request, err := http.NewRequest("GET", "/repos/repo/branches", nil)
+		assert.Nil(err)
+		request.Header.Set(api.PrivateTokenHeader, *token)
+
+		conn.Write(header)
+		if err = request.Write(conn); err != nil {
+			return 0
+		}
+
+		response, err := http.ReadResponse(bufio.NewReader(conn), request)
+		if err != nil {
+			return 0
+		}
+
+		response.Body.Close()
+		return response.StatusCode
+	}
+
+	v2Header := func(src net.IP) []byte {
+		header := []byte("\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x0c")
+		header = append(header, src.To4()...)
+		header = append(header, 127, 0, 0, 1)
+		header = append(header, 0, 0, 0, 0)
+		binary.BigEndian.PutUint16(header[len(header)-4:], 4321)
+		binary.BigEndian.PutUint16(header[len(header)-2:], 80)
+		return header
+	}
+
+	assert.Equal(http.StatusOK, request([]byte("PROXY TCP4 203.0.113.1 127.0.0.1 4321 80\r\n")))
+	assert.Equal(http.StatusTooManyRequests, request([]byte("PROXY TCP4 203.0.113.1 127.0.0.1 4322 80\r\n")))
+	assert.Equal(http.StatusOK, request(v2Header(net.ParseIP("203.0.113.2"))))
+	assert.Equal(http.StatusTooManyRequests, request(v2Header(net.ParseIP("203.0.113.1"))))
+
+	// Connections from trusted proxies must begin with a header.
+	assert.Equal(0, request(nil))
+}
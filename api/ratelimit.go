@@ -0,0 +1,200 @@
+package api
+
+import (
+	"context"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/reviewboard/rb-gateway/api/tokens"
+	"github.com/reviewboard/rb-gateway/config"
+)
+
+// How often idle buckets are discarded.
+const rateLimitSweepInterval = time.Minute
+
+// A set of token buckets, one per key (e.g., per client address).
+type rateLimiter struct {
+	lock      sync.Mutex
+	rate      float64
+	burst     float64
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+
+	// The current time. This can be replaced in tests.
+	now func() time.Time
+}
+
+// A token bucket.
+//
+// The bucket holds up to `burst` tokens and is refilled at `rate` tokens per
+// second. Each request takes a token.
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// Create a new rate limiter with the given limit.
+func newRateLimiter(limit config.RateLimit) *rateLimiter {
+	return &rateLimiter{
+		rate:    limit.RequestsPerSecond,
+		burst:   float64(limit.Burst),
+		buckets: make(map[string]*tokenBucket),
+		now:     time.Now,
+	}
+}
+
+// Change the limit.
+//
+// The buckets are kept, so clients that have been limited remain limited
+// until their buckets are refilled at the new rate.
+func (l *rateLimiter) configure(limit config.RateLimit) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.rate = limit.RequestsPerSecond
+	l.burst = float64(limit.Burst)
+}
+
+// Take a token from the key's bucket.
+//
+// If the bucket is empty, false is returned along with how long the caller
+// must wait before a token will be available.
+func (l *rateLimiter) take(key string) (bool, time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := l.now()
+	l.sweepUnsafe(now)
+
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: l.burst, updated: now}
+		l.buckets[key] = bucket
+	} else {
+		bucket.tokens = math.Min(l.burst, bucket.tokens+now.Sub(bucket.updated).Seconds()*l.rate)
+		bucket.updated = now
+	}
+
+	if bucket.tokens < 1 {
+		wait := time.Duration((1 - bucket.tokens) / l.rate * float64(time.Second))
+		return false, wait
+	}
+
+	bucket.tokens--
+	return true, 0
+}
+
+// Discard buckets that would have been refilled, since they are
+// indistinguishable from new buckets.
+//
+// This keeps the limiter from growing without bound as new clients are seen.
+// It must be called with the lock held.
+func (l *rateLimiter) sweepUnsafe(now time.Time) {
+	if now.Sub(l.lastSweep) < rateLimitSweepInterval {
+		return
+	}
+
+	l.lastSweep = now
+
+	for key, bucket := range l.buckets {
+		if bucket.tokens+now.Sub(bucket.updated).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// The state of the `ratelimit` middleware.
+//
+// This is kept across reloads of the configuration (see buildMiddlewareChain),
+// so that clients cannot reset their limits by waiting for a reload.
+type rateLimits struct {
+	// The limiter for each client address.
+	perIp *rateLimiter
+
+	// The limiter for each authenticated identity.
+	perIdentity *rateLimiter
+}
+
+// Create the state of the `ratelimit` middleware.
+func newRateLimits() *rateLimits {
+	return &rateLimits{
+		perIp:       newRateLimiter(config.RateLimit{}),
+		perIdentity: newRateLimiter(config.RateLimit{}),
+	}
+}
+
+// Create a middleware that limits the rate of requests.
+//
+// Every request counts against the limit for its client address. Requests
+// that are authorized also count against the limit for their identity (see
+// takeIdentityRateLimit). Requests over either limit receive a 429 response
+// with a `Retry-After` header.
+func (limits *rateLimits) newMiddleware(cfg *config.Config) (Middleware, error) {
+	limits.perIp.configure(cfg.RateLimit.PerIp)
+	limits.perIdentity.configure(cfg.RateLimit.PerToken)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			host, _, err := net.SplitHostPort(r.RemoteAddr)
+			if err != nil {
+				host = r.RemoteAddr
+			}
+
+			if allowed, wait := limits.perIp.take(host); !allowed {
+				writeTooManyRequests(w, wait)
+				return
+			}
+
+			// The identity is not known until the request is authorized,
+			// so its limit is taken then.
+			ctx := context.WithValue(r.Context(), "rateLimiter", limits.perIdentity)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}, nil
+}
+
+// Take a token from the bucket for the identity of an authorized request.
+//
+// Requests are limited by the user they were authorized for or, for tokens
+// that were not created for a user, by the token. Since the token has been
+// checked, clients cannot escape the limit by varying the header. If the
+// request is over the limit, a 429 response is written and false is returned.
+//
+// If the `ratelimit` middleware is not enabled, every request is allowed.
+func takeIdentityRateLimit(w http.ResponseWriter, r *http.Request, info *tokens.Info, token *string) bool {
+	limiter, _ := r.Context().Value("rateLimiter").(*rateLimiter)
+	if limiter == nil {
+		return true
+	}
+
+	var key string
+	if info.User != "" {
+		key = "user:" + info.User
+	} else if token != nil {
+		key = "token:" + *token
+	} else {
+		return true
+	}
+
+	allowed, wait := limiter.take(key)
+	if !allowed {
+		writeTooManyRequests(w, wait)
+	}
+
+	return allowed
+}
+
+// Write a 429 response telling the client how long to wait.
+func writeTooManyRequests(w http.ResponseWriter, wait time.Duration) {
+	retryAfter := int(math.Ceil(wait.Seconds()))
+	if retryAfter < 1 {
+		retryAfter = 1
+	}
+
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	http.Error(w, "Too many requests.", http.StatusTooManyRequests)
+}
@@ -0,0 +1,397 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/reviewboard/rb-gateway/config"
+)
+
+const (
+	// The value that replaces secrets in recordings and API responses.
+	redactedValue = "[REDACTED]"
+
+	// The prefix of routes that are never recorded.
+	debugPathPrefix = "/debug/"
+)
+
+var (
+	// Headers whose values are redacted in recordings, in canonical form.
+	redactedHeaders = map[string]bool{
+		"Authorization": true,
+		"Cookie":        true,
+		http.CanonicalHeaderKey(PrivateTokenHeader): true,
+		"Set-Cookie": true,
+	}
+
+	// JSON object keys whose values are redacted in recorded bodies.
+	redactedJSONKeys = map[string]bool{
+		"password":       true,
+		"previousSecret": true,
+		"private_token":  true,
+		"secret":         true,
+	}
+
+	// A pattern matching the values of redactedJSONKeys in JSON that cannot
+	// be parsed (e.g., because the body was truncated).
+	redactedJSONPattern = regexp.MustCompile(`"(password|previousSecret|private_token|secret)"\s*:\s*"(?:[^"\\]|\\.)*"?`)
+
+	// A pattern matching objects of webhook headers in JSON that cannot be
+	// parsed. Header values are redacted, since they are often credentials
+	// (e.g., `Authorization`).
+	redactedHeadersPattern = regexp.MustCompile(`"headers"\s*:\s*\{(?:[^"}]|"(?:[^"\\]|\\.)*"?)*\}?`)
+)
+
+// A recorded HTTP request.
+type RecordedRequest struct {
+	Method        string      `json:"method"`
+	Url           string      `json:"url"`
+	RemoteAddr    string      `json:"remote_addr"`
+	Headers       http.Header `json:"headers"`
+	Body          string      `json:"body"`
+	BodyTruncated bool        `json:"body_truncated"`
+}
+
+// A recorded HTTP response.
+type RecordedResponse struct {
+	Status        int         `json:"status"`
+	Headers       http.Header `json:"headers"`
+	Body          string      `json:"body"`
+	BodyTruncated bool        `json:"body_truncated"`
+}
+
+// A recorded request and its response.
+type Recording struct {
+	// When the request was received.
+	Time time.Time `json:"time"`
+
+	// How long it took to handle the request, in milliseconds.
+	Duration float64 `json:"duration_ms"`
+
+	Request  RecordedRequest  `json:"request"`
+	Response RecordedResponse `json:"response"`
+}
+
+// A ring buffer of recent requests and responses.
+//
+// Only a sampled fraction of requests are recorded, and secrets (e.g.,
+// credentials, session tokens, and webhook secrets and headers) are redacted.
+// The recorder is kept when the configuration is reloaded (see configure()),
+// so that reloading does not discard the recordings.
+type recorder struct {
+	// A lock for reading from/writing to the fields below.
+	lock       sync.Mutex
+	recordings []Recording
+	next       int
+	full       bool
+
+	sampleRate  float64
+	maxBodySize int
+}
+
+// Return a new recorder for the configuration.
+//
+// If recording is disabled, nil is returned.
+func newRecorder(cfg config.RecordingConfig) *recorder {
+	if cfg.SampleRate <= 0 {
+		return nil
+	}
+
+	return &recorder{
+		recordings:  make([]Recording, cfg.Size),
+		sampleRate:  cfg.SampleRate,
+		maxBodySize: cfg.MaxBodySize,
+	}
+}
+
+// Apply new settings, keeping as many of the most recent recordings as fit.
+func (rec *recorder) configure(cfg config.RecordingConfig) {
+	rec.lock.Lock()
+	defer rec.lock.Unlock()
+
+	recordings := rec.snapshotUnsafe()
+	if len(recordings) > cfg.Size {
+		recordings = recordings[len(recordings)-cfg.Size:]
+	}
+
+	rec.recordings = make([]Recording, cfg.Size)
+	copy(rec.recordings, recordings)
+	rec.next = len(recordings) % cfg.Size
+	rec.full = len(recordings) == cfg.Size
+
+	rec.sampleRate = cfg.SampleRate
+	rec.maxBodySize = cfg.MaxBodySize
+}
+
+// Return whether or not to record a request and, if so, how much of each body
+// to record.
+func (rec *recorder) sample() (bool, int) {
+	rec.lock.Lock()
+	defer rec.lock.Unlock()
+
+	return rand.Float64() < rec.sampleRate, rec.maxBodySize
+}
+
+// Add a recording, discarding the oldest if the buffer is full.
+func (rec *recorder) add(recording Recording) {
+	rec.lock.Lock()
+	defer rec.lock.Unlock()
+
+	rec.recordings[rec.next] = recording
+	rec.next = (rec.next + 1) % len(rec.recordings)
+	if rec.next == 0 {
+		rec.full = true
+	}
+}
+
+// Return the recordings, oldest first.
+func (rec *recorder) snapshot() []Recording {
+	rec.lock.Lock()
+	defer rec.lock.Unlock()
+
+	return rec.snapshotUnsafe()
+}
+
+// Return the recordings, oldest first.
+//
+// The caller must hold the lock.
+func (rec *recorder) snapshotUnsafe() []Recording {
+	if !rec.full {
+		return append([]Recording{}, rec.recordings[:rec.next]...)
+	}
+
+	recordings := make([]Recording, 0, len(rec.recordings))
+	recordings = append(recordings, rec.recordings[rec.next:]...)
+	return append(recordings, rec.recordings[:rec.next]...)
+}
+
+// Wrap a handler so that a sample of its requests and responses are recorded.
+func (rec *recorder) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, debugPathPrefix) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		sampled, maxBodySize := rec.sample()
+		if !sampled {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		start := time.Now()
+
+		var requestBody *capturingReadCloser
+		if r.Body != nil {
+			requestBody = &capturingReadCloser{
+				ReadCloser: r.Body,
+				buffer:     limitedBuffer{limit: maxBodySize},
+			}
+			r.Body = requestBody
+		}
+
+		response := &capturingResponseWriter{
+			ResponseWriter: w,
+			status:         http.StatusOK,
+			buffer:         limitedBuffer{limit: maxBodySize},
+		}
+
+		recording := Recording{
+			Time: start,
+			Request: RecordedRequest{
+				Method:     r.Method,
+				Url:        r.URL.String(),
+				RemoteAddr: r.RemoteAddr,
+				Headers:    redactHeaders(r.Header),
+			},
+		}
+
+		next.ServeHTTP(response, r)
+
+		if requestBody != nil {
+			recording.Request.Body = redactBody(requestBody.buffer.Bytes())
+			recording.Request.BodyTruncated = requestBody.buffer.truncated
+		}
+
+		if response.headers == nil {
+			response.headers = redactHeaders(w.Header())
+		}
+
+		recording.Duration = float64(time.Since(start)) / float64(time.Millisecond)
+		recording.Response = RecordedResponse{
+			Status:        response.status,
+			Headers:       response.headers,
+			Body:          redactBody(response.buffer.Bytes()),
+			BodyTruncated: response.buffer.truncated,
+		}
+
+		rec.add(recording)
+	})
+}
+
+// Return the recorded requests and responses, oldest first.
+//
+// This returns an HTTP 404 if recording is disabled.
+//
+// URL: `/debug/recordings`
+func (api *API) getRecordings(w http.ResponseWriter, r *http.Request) {
+	rec := api.recorder
+	if rec == nil {
+		http.Error(w, "Recording is not enabled.", http.StatusNotFound)
+		return
+	}
+
+	response, err := json.Marshal(rec.snapshot())
+	if err != nil {
+		log.Printf("Could not serialize recordings: %s", err.Error())
+		http.Error(w, "An unexpected error occurred.", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(response)
+}
+
+// A buffer that keeps at most `limit` bytes.
+type limitedBuffer struct {
+	bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+// Write as much of the content as fits.
+//
+// This never fails, so that it can be used to capture streams without
+// interrupting them.
+func (b *limitedBuffer) Write(content []byte) (int, error) {
+	if remaining := b.limit - b.Len(); remaining < len(content) {
+		b.truncated = true
+		if remaining > 0 {
+			b.Buffer.Write(content[:remaining])
+		}
+	} else {
+		b.Buffer.Write(content)
+	}
+
+	return len(content), nil
+}
+
+// A request body that captures the content read from it.
+type capturingReadCloser struct {
+	io.ReadCloser
+	buffer limitedBuffer
+}
+
+// Read from the body, capturing the content.
+func (c *capturingReadCloser) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.buffer.Write(p[:n])
+	return n, err
+}
+
+// A specialized `http.ResponseWriter` that captures the response.
+type capturingResponseWriter struct {
+	http.ResponseWriter
+	status  int
+	headers http.Header
+	buffer  limitedBuffer
+}
+
+// Write the header for the given status code.
+func (c *capturingResponseWriter) WriteHeader(status int) {
+	if c.headers == nil {
+		c.status = status
+		c.headers = redactHeaders(c.Header())
+	}
+
+	c.ResponseWriter.WriteHeader(status)
+}
+
+// Write the given content to the client.
+func (c *capturingResponseWriter) Write(content []byte) (int, error) {
+	if c.headers == nil {
+		c.headers = redactHeaders(c.Header())
+	}
+
+	c.buffer.Write(content)
+	return c.ResponseWriter.Write(content)
+}
+
+// Send any buffered content to the client, for streamed responses.
+func (c *capturingResponseWriter) Flush() {
+	if c.headers == nil {
+		c.headers = redactHeaders(c.Header())
+	}
+
+	if flusher, ok := c.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Return a copy of the headers with secrets redacted.
+func redactHeaders(headers http.Header) http.Header {
+	redacted := make(http.Header, len(headers))
+
+	for name, values := range headers {
+		if redactedHeaders[http.CanonicalHeaderKey(name)] {
+			redacted[name] = []string{redactedValue}
+		} else {
+			redacted[name] = append([]string{}, values...)
+		}
+	}
+
+	return redacted
+}
+
+// Return a body with secrets redacted.
+//
+// Secrets can only be found in JSON bodies. If the body cannot be parsed as
+// JSON (e.g., because it was truncated or is file contents), anything that
+// looks like a secret is redacted textually.
+func redactBody(body []byte) string {
+	var value interface{}
+	if err := json.Unmarshal(body, &value); err == nil {
+		if redacted, err := json.Marshal(redactJSON(value)); err == nil {
+			return string(redacted)
+		}
+	}
+
+	redacted := redactedJSONPattern.ReplaceAllString(string(body), `"$1":"`+redactedValue+`"`)
+	return redactedHeadersPattern.ReplaceAllString(redacted, `"headers":"`+redactedValue+`"`)
+}
+
+// Redact the secrets in a decoded JSON value.
+//
+// The values of `headers` objects (i.e., the headers that webhooks send) are
+// redacted, but their names are kept.
+func redactJSON(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		for key, child := range value {
+			if redactedJSONKeys[key] {
+				value[key] = redactedValue
+			} else if headers, ok := child.(map[string]interface{}); ok && key == "headers" {
+				for name := range headers {
+					headers[name] = redactedValue
+				}
+			} else {
+				value[key] = redactJSON(child)
+			}
+		}
+
+	case []interface{}:
+		for i, child := range value {
+			value[i] = redactJSON(child)
+		}
+	}
+
+	return value
+}
@@ -0,0 +1,174 @@
+package api_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/reviewboard/rb-gateway/api"
+	"github.com/reviewboard/rb-gateway/config"
+	"github.com/reviewboard/rb-gateway/repositories/events"
+	"github.com/reviewboard/rb-gateway/repositories/hooks"
+)
+
+// Make a request to an existing API instance.
+func serveRequest(t *testing.T, handler *api.API, method, url, token string, body []byte) *httptest.ResponseRecorder {
+	t.Helper()
+	assert := assert.New(t)
+
+	request, err := http.NewRequest(method, url, bytes.NewReader(body))
+	assert.Nil(err)
+
+	if token != "" {
+		request.Header.Set(api.PrivateTokenHeader, token)
+	} else {
+		request.SetBasicAuth("username", "password")
+	}
+
+	response := httptest.NewRecorder()
+	handler.ServeHTTP(response, request)
+
+	return response
+}
+
+func TestRecordings(t *testing.T) {
+	assert := assert.New(t)
+
+	testSetup := setupRoutesTest(t)
+	defer testSetup.cleanup(t)
+
+	testSetup.config.Recording = config.RecordingConfig{
+		SampleRate:  1,
+		Size:        2,
+		MaxBodySize: 1024,
+	}
+
+	handler, err := api.New(testSetup.config)
+	assert.Nil(err)
+
+	rsp := serveRequest(t, handler, "GET", "/session", "", nil)
+	assert.Equal(http.StatusOK, rsp.Code)
+
+	var session api.Session
+	assert.Nil(json.Unmarshal(rsp.Body.Bytes(), &session))
+
+	hook := hooks.Webhook{
+		Id:      "test-hook-3",
+		Url:     "http://example.com/3/",
+		Secret:  "a very very secret thing",
+		Headers: map[string]string{"Authorization": "Bearer another secret"},
+		Enabled: true,
+		Events:  []string{events.PushEvent},
+		Repos:   []string{testSetup.repo.Name},
+	}
+
+	body, err := json.Marshal(hook)
+	assert.Nil(err)
+
+	rsp = serveRequest(t, handler, "POST", "/webhooks", session.PrivateToken, body)
+	assert.Equal(http.StatusCreated, rsp.Code)
+
+	rsp = serveRequest(t, handler, "GET", "/repos/repo/branches", session.PrivateToken, nil)
+	assert.Equal(http.StatusOK, rsp.Code)
+
+	rsp = serveRequest(t, handler, "GET", "/debug/recordings", session.PrivateToken, nil)
+	assert.Equal(http.StatusOK, rsp.Code)
+
+	// Secrets must not appear anywhere in the recordings.
+	assert.NotContains(rsp.Body.String(), session.PrivateToken)
+	assert.NotContains(rsp.Body.String(), hook.Secret)
+	assert.NotContains(rsp.Body.String(), "another secret")
+
+	var recordings []api.Recording
+	assert.Nil(json.Unmarshal(rsp.Body.Bytes(), &recordings))
+
+	// Only the two most recent requests are kept, oldest first, and the
+	// request for the recordings is not itself recorded.
+	assert.Equal(2, len(recordings))
+
+	assert.Equal("POST", recordings[0].Request.Method)
+	assert.Equal("/webhooks", recordings[0].Request.Url)
+	assert.Equal("[REDACTED]", recordings[0].Request.Headers.Get(api.PrivateTokenHeader))
+	assert.Equal(http.StatusCreated, recordings[0].Response.Status)
+
+	var recordedHook map[string]interface{}
+	assert.Nil(json.Unmarshal([]byte(recordings[0].Request.Body), &recordedHook))
+	assert.Equal("[REDACTED]", recordedHook["secret"])
+	assert.Equal(map[string]interface{}{"Authorization": "[REDACTED]"}, recordedHook["headers"])
+	assert.Equal(hook.Url, recordedHook["url"])
+
+	assert.Equal("GET", recordings[1].Request.Method)
+	assert.Equal("/repos/repo/branches", recordings[1].Request.Url)
+	assert.Equal(http.StatusOK, recordings[1].Response.Status)
+	assert.Equal("application/json", recordings[1].Response.Headers.Get("Content-Type"))
+	assert.Contains(recordings[1].Response.Body, "test-branch")
+	assert.False(recordings[1].Response.BodyTruncated)
+
+	// Recordings are kept when the configuration is reloaded. The token store
+	// is in memory, so a new session is needed.
+	testSetup.config.Recording.Size = 3
+	assert.Nil(handler.SetConfig(testSetup.config))
+
+	rsp = serveRequest(t, handler, "GET", "/session", "", nil)
+	assert.Equal(http.StatusOK, rsp.Code)
+	assert.Nil(json.Unmarshal(rsp.Body.Bytes(), &session))
+
+	rsp = serveRequest(t, handler, "GET", "/debug/recordings", session.PrivateToken, nil)
+	assert.Equal(http.StatusOK, rsp.Code)
+
+	recordings = nil
+	assert.Nil(json.Unmarshal(rsp.Body.Bytes(), &recordings))
+	assert.Equal(3, len(recordings))
+	assert.Equal("/webhooks", recordings[0].Request.Url)
+	assert.Equal("/repos/repo/branches", recordings[1].Request.Url)
+	assert.Equal("/session", recordings[2].Request.Url)
+}
+
+func TestRecordingsTruncated(t *testing.T) {
+	assert := assert.New(t)
+
+	testSetup := setupRoutesTest(t)
+	defer testSetup.cleanup(t)
+
+	testSetup.config.Recording = config.RecordingConfig{
+		SampleRate:  1,
+		Size:        10,
+		MaxBodySize: 40,
+	}
+
+	handler, err := api.New(testSetup.config)
+	assert.Nil(err)
+
+	rsp := serveRequest(t, handler, "GET", "/session", "", nil)
+	assert.Equal(http.StatusOK, rsp.Code)
+
+	var session api.Session
+	assert.Nil(json.Unmarshal(rsp.Body.Bytes(), &session))
+
+	rsp = serveRequest(t, handler, "GET", "/debug/recordings", session.PrivateToken, nil)
+	assert.Equal(http.StatusOK, rsp.Code)
+
+	var recordings []api.Recording
+	assert.Nil(json.Unmarshal(rsp.Body.Bytes(), &recordings))
+	assert.Equal(1, len(recordings))
+
+	// The truncated body cannot be parsed, but the token is still redacted.
+	assert.True(recordings[0].Response.BodyTruncated)
+	assert.False(strings.Contains(recordings[0].Response.Body, session.PrivateToken[:10]))
+	assert.Contains(recordings[0].Response.Body, "[REDACTED]")
+}
+
+func TestRecordingsDisabled(t *testing.T) {
+	testSetup := setupRoutesTest(t)
+	defer testSetup.cleanup(t)
+
+	assert.Equal(t,
+		http.StatusNotFound,
+		testRoute(t, testSetup.config, "/debug/recordings", "GET", nil).Code,
+	)
+}
@@ -2,33 +2,192 @@ package api
 
 import (
 	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	auth "github.com/abbot/go-http-auth"
 	"github.com/gorilla/mux"
 
+	"github.com/reviewboard/rb-gateway/api/tokens"
 	"github.com/reviewboard/rb-gateway/repositories"
 	"github.com/reviewboard/rb-gateway/repositories/hooks"
 )
 
-// Return a session given basic auth credentials.
+// Return the session for the token presented in the request.
+//
+// For compatibility with older versions of Review Board, a request without a
+// token is handled as a request to create a session with basic auth
+// credentials.
+//
+// URL: `/session`
+func (api *API) getSession(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get(PrivateTokenHeader) == "" {
+		api.withBasicAuth(api.createSession)(w, r)
+		return
+	}
+
+	token := api.tokenStore.Get(r)
+	var info *tokens.Info
+
+	if token != nil {
+		info = api.tokenStore.Info(*token)
+	}
+
+	if info == nil {
+		http.Error(w, "Authorization failed.", http.StatusUnauthorized)
+		return
+	}
+
+	writeSession(w, newSession(*token, info))
+}
+
+// Create a session given basic auth credentials.
+//
+// The request body may contain a JSON object with a `ttl` (in seconds),
+// `repositories`, and `read_only` to restrict the created token.
+//
+// Tokens created for users listed in `readOnlyUsers` are always read-only and
+// have the reader role, which cannot manage webhooks.
+//
+// This returns an HTTP 403 if token creation is disabled.
 //
 // URL: `/session`
-func (api *API) getSession(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
-	token, err := api.tokenStore.New()
+func (api *API) createSession(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+	if api.config.DisableTokenCreation {
+		http.Error(w, "Token creation is disabled.", http.StatusForbidden)
+		return
+	}
+
+	var request sessionRequest
+
+	if body, ok := api.readRequestBody(w, &r.Request); !ok {
+		return
+	} else if len(bytes.TrimSpace(body)) != 0 {
+		if err := json.Unmarshal(body, &request); err != nil {
+			http.Error(w, fmt.Sprintf("Could not parse request body: %s", err.Error()), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if request.TTL < 0 || request.TTL > maxSessionTTL {
+		http.Error(w, fmt.Sprintf("ttl must be between 0 and %d.", maxSessionTTL), http.StatusBadRequest)
+		return
+	}
+
+	for _, repo := range request.Repositories {
+		if _, exists := api.config.Repositories[repo]; !exists {
+			http.Error(w, fmt.Sprintf(`Unknown repository "%s".`, repo), http.StatusBadRequest)
+			return
+		}
+	}
+
+	opts := tokens.Options{
+		TTL:          time.Duration(request.TTL) * time.Second,
+		Repositories: request.Repositories,
+		ReadOnly:     request.ReadOnly,
+		User:         r.Username,
+	}
+
+	if api.config.IsReadOnlyUser(r.Username) {
+		opts.ReadOnly = true
+		opts.Role = tokens.RoleReader
+	}
+
+	token, err := api.tokenStore.NewWithOptions(opts)
 
 	if err != nil {
 		log.Printf("Could not create session: %s", err.Error())
 		http.Error(w, "Could not create session", http.StatusInternalServerError)
+		return
+	}
+
+	writeSession(w, newSession(*token, api.tokenStore.Info(*token)))
+}
+
+// Create a short-lived, read-only token for a single repository.
+//
+// This allows a long-lived token to hand a narrowly scoped token to something
+// less trusted (e.g., a CI job). The request body is a JSON object with a
+// `repository` that the presenting token can access and an optional `ttl` (in
+// seconds). The token never outlives the presenting token.
+//
+// This returns an HTTP 403 if token creation is disabled.
+//
+// URL: `/session/delegate`
+func (api *API) delegateSession(w http.ResponseWriter, r *http.Request) {
+	parent := r.Context().Value("token").(*tokens.Info)
+
+	if api.config.DisableTokenCreation {
+		http.Error(w, "Token creation is disabled.", http.StatusForbidden)
+		return
+	}
+
+	var request delegateRequest
+
+	body, ok := api.readRequestBody(w, r)
+	if !ok {
+		return
+	} else if err := json.Unmarshal(body, &request); err != nil {
+		http.Error(w, fmt.Sprintf("Could not parse request body: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	maxTTL := api.config.MaxDelegatedTokenDuration()
+
+	if request.Repository == "" {
+		http.Error(w, "repository is required.", http.StatusBadRequest)
+		return
+	} else if _, exists := api.config.Repositories[request.Repository]; !exists {
+		http.Error(w, fmt.Sprintf(`Unknown repository "%s".`, request.Repository), http.StatusBadRequest)
+		return
+	} else if !parent.AllowsRepository(request.Repository) {
+		http.Error(w, "This token cannot access this repository.", http.StatusForbidden)
+		return
+	} else if request.TTL < 0 || request.TTL > int64(maxTTL/time.Second) {
+		// The TTL is checked before it is converted, since a large TTL
+		// would overflow.
+		http.Error(w, fmt.Sprintf("ttl must be between 0 and %d.", int64(maxTTL/time.Second)), http.StatusBadRequest)
+		return
+	}
+
+	ttl := time.Duration(request.TTL) * time.Second
+
+	if ttl == 0 {
+		ttl = defaultDelegatedTokenTTL
+		if ttl > maxTTL {
+			ttl = maxTTL
+		}
 	}
 
-	session := Session{
-		PrivateToken: *token,
+	token, err := api.tokenStore.NewWithOptions(tokens.Options{
+		TTL:          ttl,
+		NotAfter:     parent.Expires,
+		Repositories: []string{request.Repository},
+		ReadOnly:     true,
+		User:         parent.User,
+		Role:         parent.Role,
+	})
+
+	if err != nil {
+		log.Printf("Could not create session: %s", err.Error())
+		http.Error(w, "Could not create session", http.StatusInternalServerError)
+		return
 	}
 
+	writeSession(w, newSession(*token, api.tokenStore.Info(*token)))
+}
+
+// Write a session to the response.
+func writeSession(w http.ResponseWriter, session Session) {
 	json, err := json.Marshal(&session)
 	if err != nil {
 		log.Printf("Could not serialize session: %s", err.Error())
@@ -42,66 +201,345 @@ func (api *API) getSession(w http.ResponseWriter, r *auth.AuthenticatedRequest)
 
 // Return the branches in the repository.
 //
-// URL: `/repos/<repo>/branches`
+// Branches can be sorted by `name` or `last-commit-date` (newest first by
+// default). Branches with the same last commit date are ordered by name, in
+// the same direction as the sort. If `sort` is omitted, they are returned in
+// the order the SCM lists them.
+//
+// URL: `/repos/<repo>/branches?sort=<sort>&order=<asc|desc>`
 func (_ *API) getBranches(w http.ResponseWriter, r *http.Request) {
 	repo := r.Context().Value("repo").(repositories.Repository)
 
-	var branches []repositories.Branch
-	var response []byte
-	var err error
+	field, descending, err := parseSort(r, map[string]bool{
+		string(repositories.BranchSortName): false,
+		string(repositories.BranchSortDate): true,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	if branches, err = repo.GetBranches(); err != nil {
+	if branches, err := repo.GetBranches(repositories.BranchSort(field)); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
-	} else if response, err = json.Marshal(branches); err != nil {
-		log.Printf("Could not serialize branches: %s", err.Error())
-		http.Error(w, "An unexpected error occurred.", http.StatusInternalServerError)
 	} else {
-		w.Header().Set("Content-Type", "application/json")
-		w.Write(response)
+		if descending {
+			for i, j := 0, len(branches)-1; i < j; i, j = i+1, j-1 {
+				branches[i], branches[j] = branches[j], branches[i]
+			}
+		}
+
+		writeList(w, r, "", branches, completePage(len(branches)))
+	}
+}
+
+// Return the refs in the repository and a cursor for detecting changes.
+//
+// The cursor is derived from the names and IDs of all refs, so it changes
+// whenever a ref is created, moved, or deleted. If the `since_cursor` query
+// parameter matches the current cursor, an HTTP 304 will be returned without
+// a body.
+//
+// URL: `/repos/<repo>/refs?since_cursor=<cursor>`
+func (_ *API) getRefs(w http.ResponseWriter, r *http.Request) {
+	repo := r.Context().Value("repo").(repositories.Repository)
+	sinceCursor := r.URL.Query().Get("since_cursor")
+
+	refs, err := repo.GetRefs()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	sort.Slice(refs, func(i, j int) bool {
+		if refs[i].Type != refs[j].Type {
+			return refs[i].Type < refs[j].Type
+		}
+
+		return refs[i].Name < refs[j].Name
+	})
+
+	cursor := refsCursor(refs)
+	if sinceCursor != "" && sinceCursor == cursor {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	response, err := json.Marshal(struct {
+		Cursor string             `json:"cursor"`
+		Refs   []repositories.Ref `json:"refs"`
+	}{cursor, refs})
+	if err != nil {
+		log.Printf("Could not serialize refs: %s", err.Error())
+		http.Error(w, "An unexpected error occurred.", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(response)
+}
+
+// Compute a cursor for the given (sorted) refs.
+func refsCursor(refs []repositories.Ref) string {
+	hash := sha1.New()
+	for _, ref := range refs {
+		fmt.Fprintf(hash, "%s\x1f%s\x1f%s\x1e", ref.Type, ref.Name, ref.Id)
 	}
+
+	return hex.EncodeToString(hash.Sum(nil))
 }
 
 // Return the commits for a branch.
 //
-// URL: `/repos/<repo>/branches/<branch>/commits?start=<start>`
-func (_ *API) getCommits(w http.ResponseWriter, r *http.Request) {
+// Commits are always listed newest first, but can be sorted by `date` or
+// `topological` order. If `sort` is omitted, the SCM's default order is
+// used.
+//
+// Only commits whose author's name or email address contains `author`
+// (ignoring case) are listed, if it is given. Likewise, `since` and `until`
+// limit the commits to those authored in that range (inclusive), given as
+// RFC 3339 timestamps or `YYYY-MM-DD` dates in UTC. A date for `until`
+// includes the whole day. With any of these filters, at most 10,000 commits
+// are searched for matches, so fewer than a page may be listed.
+//
+// URL: `/repos/<repo>/branches/<branch>/commits?start=<start>&sort=<sort>&author=<author>&since=<date>&until=<date>`
+func (api *API) getCommits(w http.ResponseWriter, r *http.Request) {
 	repo := r.Context().Value("repo").(repositories.Repository)
 	params := mux.Vars(r)
 	branch := params["branch"]
 	start := r.URL.Query().Get("start")
 
+	field, descending, err := parseSort(r, map[string]bool{
+		string(repositories.CommitOrderDate):        true,
+		string(repositories.CommitOrderTopological): true,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if !descending && r.URL.Query().Get("order") != "" {
+		http.Error(w, "Commits can only be listed newest first.", http.StatusBadRequest)
+		return
+	}
+
+	filter := repositories.CommitFilter{
+		Author: r.URL.Query().Get("author"),
+	}
+
+	dates := []struct {
+		param string
+		date  *time.Time
+	}{
+		{"since", &filter.Since},
+		{"until", &filter.Until},
+	}
+
+	for _, d := range dates {
+		if raw := r.URL.Query().Get(d.param); raw != "" {
+			if *d.date, err = parseCommitDate(raw, d.param == "until"); err != nil {
+				http.Error(w, fmt.Sprintf("Invalid value for %s: \"%s\".", d.param, raw), http.StatusBadRequest)
+				return
+			}
+		}
+	}
+
 	var commits []repositories.CommitInfo
-	var response []byte
-	var err error
 
 	if len(branch) == 0 {
 		http.Error(w, "Branch not specified.", http.StatusBadRequest)
-	} else if commits, err = repo.GetCommits(branch, start); err != nil {
+	} else if commits, err = repo.GetCommits(branch, start, repositories.CommitOrder(field), filter); err != nil {
 		http.Error(w, fmt.Sprintf("Could not get branches: %s", err.Error()),
 			http.StatusBadRequest)
-	} else if response, err = json.Marshal(commits); err != nil {
-		log.Printf("Could not serialize commits: %s", err.Error())
+	} else {
+		writeList(w, r, "", commits, api.commitsPage(r, commits, "start"))
+	}
+}
+
+// Parse an RFC 3339 timestamp or a `YYYY-MM-DD` date, which is taken to be
+// midnight UTC, or the last moment of the day if `endOfDay` is true.
+func parseCommitDate(value string, endOfDay bool) (time.Time, error) {
+	if date, err := time.Parse("2006-01-02", value); err == nil {
+		if endOfDay {
+			date = date.AddDate(0, 0, 1).Add(-time.Nanosecond)
+		}
+
+		return date, nil
+	}
+
+	return time.Parse(time.RFC3339, value)
+}
+
+// Return the commits between two revisions.
+//
+// The result includes all commits reachable from `until` that are not
+// reachable from `since`, newest first.
+//
+// URL: `/repos/<repo>/commits?since=<since>&until=<until>`
+func (_ *API) getCommitRange(w http.ResponseWriter, r *http.Request) {
+	repo := r.Context().Value("repo").(repositories.Repository)
+	query := r.URL.Query()
+	since := query.Get("since")
+	until := query.Get("until")
+
+	var commits []repositories.CommitInfo
+	var err error
+
+	if len(since) == 0 {
+		http.Error(w, "Since revision not specified.", http.StatusBadRequest)
+	} else if len(until) == 0 {
+		http.Error(w, "Until revision not specified.", http.StatusBadRequest)
+	} else if commits, err = repo.GetCommitRange(since, until); err != nil {
+		http.Error(w, fmt.Sprintf("Could not get commits: %s", err.Error()),
+			http.StatusBadRequest)
+	} else {
+		writeList(w, r, "", commits, completePage(len(commits)))
+	}
+}
+
+// Return the best common ancestor of two revisions.
+//
+// This is the commit that a diff between the revisions should be based on.
+// If they have no common ancestor, `merge_base` is null.
+//
+// URL: `/repos/<repo>/merge-base?a=<a>&b=<b>`
+func (_ *API) getMergeBase(w http.ResponseWriter, r *http.Request) {
+	repo := r.Context().Value("repo").(repositories.Repository)
+	query := r.URL.Query()
+	a := query.Get("a")
+	b := query.Get("b")
+
+	if len(a) == 0 || len(b) == 0 {
+		http.Error(w, "Both revisions (a and b) must be specified.", http.StatusBadRequest)
+		return
+	}
+
+	base, err := repo.GetMergeBase(a, b)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Could not get merge base: %s", err.Error()),
+			http.StatusBadRequest)
+		return
+	}
+
+	var mergeBase *string
+	if base != "" {
+		mergeBase = &base
+	}
+
+	response, err := json.Marshal(struct {
+		MergeBase *string `json:"merge_base"`
+	}{mergeBase})
+
+	if err != nil {
+		log.Printf("Could not serialize merge base: %s", err.Error())
 		http.Error(w, "An unexpected error occurred.", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(response)
+}
+
+// Return the commits on a branch that changed a path.
+//
+// Renames and copies of files are followed. Each commit has the `path` the
+// file had at that commit, its `status` (e.g., `modified` or `renamed`), and,
+// if it was renamed or copied, the `old_path` it came from.
+//
+// URL: `/repos/<repo>/branches/<branch>/path/<path>/log`
+func (api *API) getFileLog(w http.ResponseWriter, r *http.Request) {
+	repo := r.Context().Value("repo").(repositories.Repository)
+	params := mux.Vars(r)
+	branch := params["branch"]
+	path := params["path"]
+
+	var entries []repositories.FileLogEntry
+	var err error
+
+	if len(branch) == 0 {
+		http.Error(w, "Branch not specified.", http.StatusBadRequest)
+	} else if len(path) == 0 {
+		http.Error(w, "File path not specified.", http.StatusBadRequest)
+	} else if entries, err = repo.GetFileLog(branch, path); err != nil {
+		http.Error(w, fmt.Sprintf("Could not get log for \"%s\": %s", path, err.Error()),
+			http.StatusBadRequest)
 	} else {
-		w.Header().Set("Content-Type", "application/json")
-		w.Write(response)
+		commits := make([]repositories.CommitInfo, 0, len(entries))
+		for _, entry := range entries {
+			commits = append(commits, entry.CommitInfo)
+		}
+
+		writeList(w, r, "", entries, api.commitsPage(r, commits, ""))
+	}
+}
+
+// Return the commits whose messages contain the query text.
+//
+// If the `authors` query parameter is set (e.g., to `1` or `true`), commits
+// whose author contains the text are also returned, and if `paths` is set,
+// commits that changed a file whose path contains the text are also returned.
+// If `branch` is omitted, all branches are searched.
+//
+// URL: `/repos/<repo>/search/commits?q=<text>&branch=<branch>&authors=<bool>&paths=<bool>`
+func (api *API) searchCommits(w http.ResponseWriter, r *http.Request) {
+	repo := r.Context().Value("repo").(repositories.Repository)
+	query := r.URL.Query()
+	text := query.Get("q")
+	branch := query.Get("branch")
+
+	var authors, paths bool
+	var commits []repositories.CommitInfo
+	var err error
+
+	if rawAuthors := query.Get("authors"); rawAuthors != "" {
+		if authors, err = strconv.ParseBool(rawAuthors); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid value for authors: \"%s\".", rawAuthors), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if rawPaths := query.Get("paths"); rawPaths != "" {
+		if paths, err = strconv.ParseBool(rawPaths); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid value for paths: \"%s\".", rawPaths), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if len(text) == 0 {
+		http.Error(w, "Search text not specified.", http.StatusBadRequest)
+	} else if commits, err = repo.SearchCommits(text, branch, authors, paths); err != nil {
+		http.Error(w, fmt.Sprintf("Could not search commits: %s", err.Error()),
+			http.StatusBadRequest)
+	} else {
+		writeList(w, r, "", commits, api.commitsPage(r, commits, ""))
 	}
 }
 
 // Return a commit.
 //
+// If the commit is requested by its full ID, the response has an ETag, and an
+// HTTP 304 is returned if the request's `If-None-Match` header matches it.
+// This returns an HTTP 503 if the configured `memoryBudget` is exhausted. The
+// size of a commit's diff is not known until it has been generated, so it is
+// reserved against the budget afterwards.
+//
 // URL: `/repos/<repo>/commit/<commit-id>`
 func (_ *API) getCommit(w http.ResponseWriter, r *http.Request) {
 	repo := r.Context().Value("repo").(repositories.Repository)
 	params := mux.Vars(r)
 	commitId := params["commit-id"]
 
+	var etag string
+	if isFullId(commitId) {
+		etag = commitETag(commitId)
+	}
+
 	var commit *repositories.Commit
 	var response []byte
 	var err error
 
 	if len(commitId) == 0 {
 		http.Error(w, "Commit ID not specified.", http.StatusBadRequest)
+	} else if writeNotModified(w, r, etag, revalidateCacheControl) {
+		return
 	} else if commit, err = repo.GetCommit(commitId); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	} else if commit == nil {
@@ -109,6 +547,101 @@ func (_ *API) getCommit(w http.ResponseWriter, r *http.Request) {
 	} else if response, err = json.Marshal(*commit); err != nil {
 		log.Printf("Could not serialize commit \"%s\" in repo \"%s\": %s", commit.Id, repo.GetName(), err.Error())
 		http.Error(w, "An unexpected error occurred.", http.StatusInternalServerError)
+	} else if reserveMemory(w, r, int64(len(commit.Diff)+len(response))) {
+		setCacheHeaders(w, etag, revalidateCacheControl)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(response)
+	}
+}
+
+// Return an archive of the files at a commit.
+//
+// The archive is streamed to the client. The `format` query parameter may be
+// `tar.gz` (the default) or `zip`. Every file in the archive is placed in a
+// directory named after the repository and the abbreviated commit ID.
+//
+// If object storage is configured for archives, the archive is uploaded (if it
+// has not been already) and the client is redirected to it instead. This
+// returns an HTTP 503 if the configured `memoryBudget` is exhausted.
+//
+// URL: `/repos/<repo>/commits/<commit-id>/archive?format=<format>`
+func (api *API) getArchive(w http.ResponseWriter, r *http.Request) {
+	repo := r.Context().Value("repo").(repositories.Repository)
+	commitId := mux.Vars(r)["commit-id"]
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = repositories.ArchiveFormatTarGz
+	}
+
+	if len(commitId) == 0 {
+		http.Error(w, "Commit ID not specified.", http.StatusBadRequest)
+		return
+	} else if !repositories.IsValidArchiveFormat(format) {
+		http.Error(w, fmt.Sprintf("Unsupported archive format \"%s\".", format), http.StatusBadRequest)
+		return
+	}
+
+	resolved, err := repo.ResolveRef(commitId)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Could not find commit \"%s\": %s", commitId, err.Error()),
+			http.StatusNotFound)
+		return
+	}
+
+	shortId := resolved
+	if len(shortId) > 12 {
+		shortId = shortId[:12]
+	}
+
+	// Grouped repository names (e.g., `team/project`) contain slashes, which
+	// cannot appear in a file name.
+	name := fmt.Sprintf("%s-%s", strings.ReplaceAll(repo.GetName(), "/", "-"), shortId)
+
+	header := http.Header{}
+	header.Set("Content-Type", repositories.ArchiveContentType(format))
+	header.Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.%s\"", name, format))
+
+	key := fmt.Sprintf("archives/%s/%s.%s", repo.GetName(), resolved, format)
+	if api.redirectToArchive(w, r, key, header, func(w io.Writer) error {
+		return repo.WriteArchive(w, resolved, format, name)
+	}) {
+		return
+	}
+
+	for name, values := range header {
+		w.Header()[name] = values
+	}
+
+	// The response has already started by the time an error can occur, so
+	// it can only be logged.
+	if err = repo.WriteArchive(w, resolved, format, name); err != nil {
+		log.Printf("Could not write archive of commit \"%s\" in repo \"%s\": %s",
+			resolved, repo.GetName(), err.Error())
+	}
+}
+
+// Return the notes attached to a commit.
+//
+// URL: `/repos/<repo>/commits/<commit-id>/notes`
+func (_ *API) getNotes(w http.ResponseWriter, r *http.Request) {
+	repo := r.Context().Value("repo").(repositories.Repository)
+	commitId := mux.Vars(r)["commit-id"]
+
+	var notes []repositories.Note
+	var response []byte
+	var err error
+
+	if len(commitId) == 0 {
+		http.Error(w, "Commit ID not specified.", http.StatusBadRequest)
+	} else if notes, err = repo.GetNotes(commitId); err == repositories.UnsupportedErr {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	} else if err != nil {
+		http.Error(w, fmt.Sprintf("Could not get notes for commit \"%s\": %s", commitId, err.Error()),
+			http.StatusNotFound)
+	} else if response, err = json.Marshal(notes); err != nil {
+		log.Printf("Could not serialize notes: %s", err.Error())
+		http.Error(w, "An unexpected error occurred.", http.StatusInternalServerError)
 	} else {
 		w.Header().Set("Content-Type", "application/json")
 		w.Write(response)
@@ -117,22 +650,67 @@ func (_ *API) getCommit(w http.ResponseWriter, r *http.Request) {
 
 // Return the contents of a file (identified by an object ID) in a repository.
 //
+// The file is streamed to the client and single byte ranges are supported via
+// the `Range` header. This returns an HTTP 406 if the file is larger than the
+// configured `maxFileSize`, or an HTTP 503 if the configured `memoryBudget` is
+// exhausted. If blob redirects are enabled, large files are redirected to a
+// signed blob URL instead. If `largeFiles` is enabled for the repository, a
+// pointer to a large file (e.g., a Git LFS pointer) is replaced by the large
+// file.
+//
+// If the file ID is a full object ID, the response has an ETag and can be
+// cached indefinitely, and an HTTP 304 is returned if the request's
+// `If-None-Match` header matches the ETag. The ETag of a pointer identifies
+// the large file it was replaced by, and a pointer whose large file is not
+// available must be revalidated.
+//
 // URL: `/repos/<repo>/file/<file-id>`
-func (_ *API) getFile(w http.ResponseWriter, r *http.Request) {
+func (api *API) getFile(w http.ResponseWriter, r *http.Request) {
 	repo := r.Context().Value("repo").(repositories.Repository)
 	objectId := mux.Vars(r)["file-id"]
 
-	var contents []byte
+	var etag string
+	if hasFileObjectIds(repo) && isFullId(objectId) {
+		etag = largeFilesETag(repo, fmt.Sprintf(`"%s"`, objectId))
+	}
+
+	cacheControl := immutableCacheControl
+
+	var reader io.ReadCloser
+	var size int64
 	var err error
 
 	if len(objectId) == 0 {
 		http.Error(w, "File ID not specified.", http.StatusBadRequest)
-	} else if contents, err = repo.GetFile(objectId); err != nil {
+	} else if writeNotModified(w, r, etag, immutableCacheControl) {
+		return
+	} else if reader, size, err = repo.OpenFile(objectId); err != nil {
 		http.Error(w, fmt.Sprintf("Could not get file \"%s\": %s", objectId, err.Error()),
 			http.StatusNotFound)
 	} else {
-		w.Header().Set("Content-Type", "application/octet-stream")
-		w.Write(contents)
+		defer reader.Close()
+
+		if !reserveMemory(w, r, size) {
+			return
+		}
+
+		largeFile, contents, pointerId, err := openLargeFile(repo, reader, size)
+		if largeFile != nil {
+			defer largeFile.Close()
+		}
+
+		if err != nil {
+			log.Printf("Could not open large file for file \"%s\": %s", objectId, err.Error())
+			http.Error(w, "An unexpected error occurred.", http.StatusInternalServerError)
+		} else if etag, cacheControl = largeFileETag(etag, cacheControl, pointerId, largeFile); writeNotModified(w, r, etag, cacheControl) {
+			return
+		} else if largeFile != nil {
+			api.writeLargeFile(w, r, largeFile, etag, cacheControl)
+		} else if api.checkFileSize(w, size) && !api.redirectToBlob(w, r, fileBlobKey(repo, objectId), contents, size) {
+			setCacheHeaders(w, etag, cacheControl)
+			w.Header().Set("Content-Type", "application/octet-stream")
+			writeStream(w, r, contents, size)
+		}
 	}
 }
 
@@ -160,27 +738,86 @@ func (_ *API) getFileExists(w http.ResponseWriter, r *http.Request) {
 
 // Return the contents of a file (at a specific commit) in a repository.
 //
+// This returns an HTTP 406 if the file is larger than the configured
+// `maxFileSize`, which is checked before the file is read, or an HTTP 503 if
+// the configured `memoryBudget` is exhausted. If blob redirects are enabled,
+// large files are redirected to a signed blob URL instead. If `largeFiles` is
+// enabled for the repository, a pointer to a large file is replaced by the
+// large file.
+//
+// The mode and type of the file (e.g., `120000` and `symlink`) are returned
+// in the `X-RBG-File-Mode` and `X-RBG-File-Type` headers. A symlink's contents
+// are the path it points to, unless the `follow_symlinks` query parameter is
+// set, in which case the file it points to is returned and its path is in the
+// `X-RBG-File-Path` header. Symlinks that point outside of the repository
+// return an HTTP 404.
+//
+// If the commit ID is a full ID, the response has an ETag and can be cached
+// indefinitely, and an HTTP 304 is returned if the request's `If-None-Match`
+// header matches the ETag.
+//
 // URL: `/repos/<repo>/commits/<commit-id>/path/<path>`
-func (_ *API) getFileByCommit(w http.ResponseWriter, r *http.Request) {
+func (api *API) getFileByCommit(w http.ResponseWriter, r *http.Request) {
 	repo := r.Context().Value("repo").(repositories.Repository)
 	params := mux.Vars(r)
 
 	commitId := params["commit-id"]
 	path := params["path"]
+	followSymlinks, _ := strconv.ParseBool(r.URL.Query().Get("follow_symlinks"))
 
+	var etag string
+	if isFullId(commitId) {
+		etag = largeFilesETag(repo, symlinkFileETag(commitId, path, followSymlinks))
+	}
+
+	cacheControl := immutableCacheControl
+
+	var resolved string
+	var mode repositories.FileMode
+	var size int64
 	var contents []byte
+	var largeFile *repositories.LargeFile
 	var err error
 
 	if len(commitId) == 0 {
 		http.Error(w, "Commit ID not specified.", http.StatusBadRequest)
 	} else if len(path) == 0 {
 		http.Error(w, "File path not specified.", http.StatusBadRequest)
-	} else if contents, err = repo.GetFileByCommit(commitId, path); err != nil {
+	} else if writeNotModified(w, r, etag, immutableCacheControl) {
+		return
+	} else if resolved, mode, err = resolveFileMode(repo, commitId, path, followSymlinks); err != nil {
 		http.Error(w,
 			fmt.Sprintf("Could not get file \"%s\" at commit \"%s\": %s",
 				path, commitId, err.Error()),
 			http.StatusNotFound)
-	} else {
+	} else if size, err = repo.GetFileSizeByCommit(commitId, resolved); err != nil {
+		http.Error(w,
+			fmt.Sprintf("Could not get file \"%s\" at commit \"%s\": %s",
+				resolved, commitId, err.Error()),
+			http.StatusNotFound)
+	} else if !api.checkFileSize(w, size) {
+		return
+	} else if !mayBeLargeFilePointer(repo, size) && api.redirectToStoredBlob(w, r, commitFileBlobKey(repo, commitId, resolved), size) {
+		return
+	} else if !reserveMemory(w, r, size) {
+		return
+	} else if contents, err = repo.GetFileByCommit(commitId, resolved); err != nil {
+		http.Error(w,
+			fmt.Sprintf("Could not get file \"%s\" at commit \"%s\": %s",
+				resolved, commitId, err.Error()),
+			http.StatusNotFound)
+	} else if largeFile, err = repo.OpenLargeFile(contents); err != nil {
+		log.Printf("Could not open large file for \"%s\" at commit \"%s\": %s", resolved, commitId, err.Error())
+		http.Error(w, "An unexpected error occurred.", http.StatusInternalServerError)
+	} else if etag, cacheControl = largeFileETag(etag, cacheControl, largeFilePointerId(repo, contents), largeFile); writeNotModified(w, r, etag, cacheControl) {
+		closeLargeFile(largeFile)
+	} else if largeFile != nil {
+		defer largeFile.Close()
+		setFileModeHeaders(w, resolved, mode, followSymlinks)
+		api.writeLargeFile(w, r, largeFile, etag, cacheControl)
+	} else if !api.redirectToBlob(w, r, commitFileBlobKey(repo, commitId, resolved), bytes.NewReader(contents), int64(len(contents))) {
+		setFileModeHeaders(w, resolved, mode, followSymlinks)
+		setCacheHeaders(w, etag, cacheControl)
 		w.Header().Set("Content-Type", "application/octet-stream")
 		w.Write(contents)
 	}
@@ -215,49 +852,256 @@ func (_ *API) getFileExistsByCommit(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// Return the contents of a file (at a symbolic ref) in a repository.
+//
+// The ref may be a branch, bookmark, or tag name, or a commit ID. This returns
+// an HTTP 406 if the file is larger than the configured `maxFileSize`, which
+// is checked before the file is read, or an HTTP 503 if the configured
+// `memoryBudget` is exhausted. If blob redirects
+// are enabled, large files are redirected to a signed blob URL instead. If
+// `largeFiles` is enabled for the repository, a pointer to a large file is
+// replaced by the large file.
+//
+// As with `/repos/<repo>/commits/<commit-id>/path/<path>`, the mode and type
+// of the file are returned in headers, and symlinks are followed if the
+// `follow_symlinks` query parameter is set.
+//
+// The response has an ETag for the file at the commit the ref resolves to, and
+// an HTTP 304 is returned if the request's `If-None-Match` header matches it.
+// Refs can move, so clients must revalidate cached responses.
+//
+// URL: `/repos/<repo>/refs/<ref>/path/<path>`
+func (api *API) getFileByRef(w http.ResponseWriter, r *http.Request) {
+	repo := r.Context().Value("repo").(repositories.Repository)
+	params := mux.Vars(r)
+
+	ref := params["ref"]
+	path := params["path"]
+	followSymlinks, _ := strconv.ParseBool(r.URL.Query().Get("follow_symlinks"))
+
+	cacheControl := revalidateCacheControl
+
+	var commitId string
+	var etag string
+	var resolved string
+	var mode repositories.FileMode
+	var size int64
+	var contents []byte
+	var largeFile *repositories.LargeFile
+	var err error
+
+	if len(ref) == 0 {
+		http.Error(w, "Ref not specified.", http.StatusBadRequest)
+	} else if len(path) == 0 {
+		http.Error(w, "File path not specified.", http.StatusBadRequest)
+	} else if commitId, err = repo.ResolveRef(ref); err != nil {
+		http.Error(w,
+			fmt.Sprintf("Could not resolve ref \"%s\": %s", ref, err.Error()),
+			http.StatusNotFound)
+	} else if etag = largeFilesETag(repo, symlinkFileETag(commitId, path, followSymlinks)); writeNotModified(w, r, etag, cacheControl) {
+		return
+	} else if resolved, mode, err = resolveFileMode(repo, commitId, path, followSymlinks); err != nil {
+		http.Error(w,
+			fmt.Sprintf("Could not get file \"%s\" at ref \"%s\": %s",
+				path, ref, err.Error()),
+			http.StatusNotFound)
+	} else if size, err = repo.GetFileSizeByCommit(commitId, resolved); err != nil {
+		http.Error(w,
+			fmt.Sprintf("Could not get file \"%s\" at ref \"%s\": %s",
+				resolved, ref, err.Error()),
+			http.StatusNotFound)
+	} else if !api.checkFileSize(w, size) {
+		return
+	} else if !mayBeLargeFilePointer(repo, size) && api.redirectToStoredBlob(w, r, commitFileBlobKey(repo, commitId, resolved), size) {
+		return
+	} else if !reserveMemory(w, r, size) {
+		return
+	} else if contents, err = repo.GetFileByCommit(commitId, resolved); err != nil {
+		http.Error(w,
+			fmt.Sprintf("Could not get file \"%s\" at ref \"%s\": %s",
+				resolved, ref, err.Error()),
+			http.StatusNotFound)
+	} else if largeFile, err = repo.OpenLargeFile(contents); err != nil {
+		log.Printf("Could not open large file for \"%s\" at ref \"%s\": %s", resolved, ref, err.Error())
+		http.Error(w, "An unexpected error occurred.", http.StatusInternalServerError)
+	} else if etag, cacheControl = largeFileETag(etag, cacheControl, largeFilePointerId(repo, contents), largeFile); writeNotModified(w, r, etag, cacheControl) {
+		closeLargeFile(largeFile)
+	} else if largeFile != nil {
+		defer largeFile.Close()
+		setFileModeHeaders(w, resolved, mode, followSymlinks)
+		api.writeLargeFile(w, r, largeFile, etag, cacheControl)
+	} else if !api.redirectToBlob(w, r, commitFileBlobKey(repo, commitId, resolved), bytes.NewReader(contents), int64(len(contents))) {
+		setFileModeHeaders(w, resolved, mode, followSymlinks)
+		setCacheHeaders(w, etag, cacheControl)
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(contents)
+	}
+}
+
+// Return whether or not a file (at a symbolic ref) exists in the repository.
+//
+// URL: `/repos/<repo>/refs/<ref>/path/<path>`
+func (_ *API) getFileExistsByRef(w http.ResponseWriter, r *http.Request) {
+	repo := r.Context().Value("repo").(repositories.Repository)
+	params := mux.Vars(r)
+
+	ref := params["ref"]
+	path := params["path"]
+
+	var commitId string
+	var exists bool
+	var err error
+
+	if len(ref) == 0 {
+		http.Error(w, "Ref not specified.", http.StatusBadRequest)
+	} else if len(path) == 0 {
+		http.Error(w, "File path not specified.", http.StatusBadRequest)
+	} else if commitId, err = repo.ResolveRef(ref); err != nil {
+		w.WriteHeader(http.StatusNotFound)
+	} else if exists, err = repo.FileExistsByCommit(commitId, path); err != nil {
+		http.Error(w,
+			fmt.Sprintf("Could not find file \"%s\" at ref \"%s\": %s",
+				path, ref, err.Error()),
+			http.StatusBadRequest)
+	} else if !exists {
+		w.WriteHeader(http.StatusNotFound)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// Return information about a repository, including its supported features.
+//
+// URL: `/repos/<repo>`
+func (_ *API) getRepository(w http.ResponseWriter, r *http.Request) {
+	repo := r.Context().Value("repo").(repositories.Repository)
+
+	response, err := json.Marshal(struct {
+		Name     string                `json:"name"`
+		Scm      string                `json:"scm"`
+		Features repositories.Features `json:"features"`
+	}{
+		Name:     repo.GetName(),
+		Scm:      repo.GetScm(),
+		Features: repo.GetFeatures(),
+	})
+
+	if err != nil {
+		log.Printf("Could not serialize repository: %s", err.Error())
+		http.Error(w, "An unexpected error occurred.", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(response)
+}
+
 // Return an HTTP OK if the user can access the repository.
 //
 // Review Board has shipped with rb-gateway support requiring this endpoint to
 // confirm access to the repository. However, all it does is check for a 200 OK.
 //
 // Since this is behind the authorization middleware, we can always just return
-// 200 OK.
+// 200 OK. If `legacyCompat` is enabled, the body is the path of the
+// repository's `info/refs` file, as it was in rb-gateway 1.0.
 //
 // URL: `/repos/<repo>/path`
-func (_ *API) getPath(w http.ResponseWriter, r *http.Request) {
+func (api *API) getPath(w http.ResponseWriter, r *http.Request) {
+	if !api.config.LegacyCompat {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	repo := r.Context().Value("repo").(repositories.Repository)
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(strings.TrimRight(repo.GetPath(), "/") + "/info/refs"))
+}
+
+// A webhook as it is returned by the API.
+//
+// Secrets can be set, but are never read back. The only time a secret is
+// returned is when rotateHookSecret() generates it.
+type webhookResource struct {
+	*hooks.Webhook
+
+	// These hide the webhook's secrets. They are left empty, and so are
+	// omitted, except for the secret returned by rotateHookSecret().
+	Secret         string `json:"secret,omitempty"`
+	PreviousSecret string `json:"previousSecret,omitempty"`
+
+	// These hide the values of the webhook's headers and its basic
+	// authentication password, which are credentials as well.
+	Headers   map[string]string       `json:"headers,omitempty"`
+	BasicAuth *hooks.WebhookBasicAuth `json:"basicAuth,omitempty"`
+}
+
+// Return the API resource for a webhook, with its credentials redacted.
+func newWebhookResource(hook *hooks.Webhook) webhookResource {
+	resource := webhookResource{Webhook: hook}
+
+	if len(hook.Headers) != 0 {
+		resource.Headers = make(map[string]string, len(hook.Headers))
+		for name := range hook.Headers {
+			resource.Headers[name] = redactedValue
+		}
+	}
+
+	if hook.BasicAuth != nil {
+		resource.BasicAuth = &hooks.WebhookBasicAuth{
+			Username: hook.BasicAuth.Username,
+			Password: redactedValue,
+		}
+	}
+
+	return resource
 }
 
+// Return the webhooks.
+//
+// Secrets are not included. Webhooks can be sorted by `id` (the default) or `enabled`. Ties are broken
+// by ID.
+//
+// URL: `/webhooks?sort=<sort>&order=<asc|desc>`
 func (api *API) getHooks(w http.ResponseWriter, r *http.Request) {
+	field, descending, err := parseSort(r, map[string]bool{
+		"id":      false,
+		"enabled": false,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	api.hookStoreLock.RLock()
 	defer api.hookStoreLock.RUnlock()
 
-	buffer := bytes.NewBufferString(`{"webhooks":[`)
-	first := true
-
+	webhooks := make([]*hooks.Webhook, 0, len(api.hookStore))
 	for _, hook := range api.hookStore {
-		if first {
-			first = false
-		} else {
-			buffer.WriteString(",")
-		}
+		webhooks = append(webhooks, hook)
+	}
 
-		b, err := json.Marshal(hook)
-		if err != nil {
-			log.Printf("Could not serialize hooks: %s", err.Error())
-			http.Error(w, "An unexpected error occurred.", http.StatusInternalServerError)
-			return
+	sort.Slice(webhooks, func(i, j int) bool {
+		a, b := webhooks[i], webhooks[j]
+		if descending {
+			a, b = b, a
 		}
 
-		buffer.Write(b)
-	}
+		if field == "enabled" && a.Enabled != b.Enabled {
+			return !a.Enabled
+		}
 
-	buffer.WriteString("]}")
+		return a.Id < b.Id
+	})
 
-	w.WriteHeader(http.StatusOK)
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(buffer.Bytes())
+	resources := make([]webhookResource, len(webhooks))
+	for i, hook := range webhooks {
+		resources[i] = newWebhookResource(hook)
+	}
 
+	writeList(w, r, "webhooks", resources, completePage(len(webhooks)))
 }
 
 func (api *API) createHook(w http.ResponseWriter, r *http.Request) {
@@ -266,7 +1110,10 @@ func (api *API) createHook(w http.ResponseWriter, r *http.Request) {
 
 	var hook hooks.Webhook
 
-	if err := json.NewDecoder(r.Body).Decode(&hook); err != nil {
+	body, ok := api.readRequestBody(w, r)
+	if !ok {
+		return
+	} else if err := json.Unmarshal(body, &hook); err != nil {
 		http.Error(w,
 			fmt.Sprintf("Could not parse request body: %s", err.Error()),
 			http.StatusBadRequest)
@@ -280,11 +1127,17 @@ func (api *API) createHook(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := hook.Validate(api.config.RepositorySet()); err != nil {
+	if err := hook.Validate(api.config.RepositorySet(), api.config.WebhookSecrets()); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
+	if err := hook.EncryptSecrets(api.config.SecretsKey); err != nil {
+		log.Println("Could not encrypt webhook secret: ", err.Error())
+		http.Error(w, "An unexpected error occurred.", http.StatusInternalServerError)
+		return
+	}
+
 	api.hookStore[hook.Id] = &hook
 	if err := api.hookStore.Save(api.config.WebhookStorePath); err != nil {
 		// If we cannot save the store, revert our state so that we stay
@@ -309,7 +1162,17 @@ func (api *API) getHook(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	b, err := json.Marshal(hook)
+	statusStore := hooks.DeliveryStatusStore{Dir: api.config.WebhookStatusPath}
+	status, err := statusStore.Load(hook.Id)
+	if err != nil {
+		log.Printf(`Could not load delivery status for hook "%s": %s`, hook.Id, err.Error())
+		status = &hooks.HookStatus{}
+	}
+
+	b, err := json.Marshal(struct {
+		webhookResource
+		DeliveryStatus *hooks.HookStatus `json:"delivery_status"`
+	}{newWebhookResource(hook), status})
 	if err != nil {
 		log.Printf("Could not serialize hooks: %s", err.Error())
 		http.Error(w, "An unexpected error occurred.", http.StatusInternalServerError)
@@ -330,6 +1193,7 @@ func (api *API) deleteHook(w http.ResponseWriter, r *http.Request) {
 	var hook *hooks.Webhook
 	if hook = api.hookStore[hookId]; hook == nil {
 		http.Error(w, "No such webhook", http.StatusNotFound)
+		return
 	}
 
 	delete(api.hookStore, hookId)
@@ -340,6 +1204,11 @@ func (api *API) deleteHook(w http.ResponseWriter, r *http.Request) {
 		api.hookStore[hookId] = hook
 		http.Error(w, "An unexpected error occurred.", http.StatusInternalServerError)
 	} else {
+		statusStore := hooks.DeliveryStatusStore{Dir: api.config.WebhookStatusPath}
+		if err := statusStore.Remove(hookId); err != nil {
+			log.Printf(`Could not remove delivery status for hook "%s": %s`, hookId, err.Error())
+		}
+
 		w.WriteHeader(http.StatusNoContent)
 	}
 }
@@ -358,15 +1227,27 @@ func (api *API) updateHook(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var parsedRequest struct {
-		Id      *string  `json:"id"`
-		Url     *string  `json:"url,omitempty"`
-		Secret  *string  `json:"secret,omitempty"`
-		Enabled *bool    `json:"enabled"`
-		Events  []string `json:"events"`
-		Repos   []string `json:"repos"`
+		Id        *string  `json:"id"`
+		Url       *string  `json:"url,omitempty"`
+		Secret    *string  `json:"secret,omitempty"`
+		Enabled   *bool    `json:"enabled"`
+		Events    []string `json:"events"`
+		Repos     []string `json:"repos"`
+		Bookmarks []string `json:"bookmarks"`
+		Branches  []string `json:"branches"`
+
+		SignatureAlgorithm *string                 `json:"signatureAlgorithm"`
+		Headers            map[string]string       `json:"headers"`
+		BasicAuth          *hooks.WebhookBasicAuth `json:"basicAuth"`
+		Timeout            *int                    `json:"timeout"`
+		Format             *string                 `json:"format"`
+		Type               *string                 `json:"type"`
 	}
 
-	if err := json.NewDecoder(r.Body).Decode(&parsedRequest); err != nil {
+	body, ok := api.readRequestBody(w, r)
+	if !ok {
+		return
+	} else if err := json.Unmarshal(body, &parsedRequest); err != nil {
 		http.Error(w,
 			fmt.Sprintf("Could not parse request body: %s", err.Error()),
 			http.StatusBadRequest)
@@ -374,12 +1255,24 @@ func (api *API) updateHook(w http.ResponseWriter, r *http.Request) {
 	}
 
 	updatedHook := hooks.Webhook{
-		Id:      hook.Id,
-		Url:     hook.Url,
-		Secret:  hook.Secret,
-		Enabled: hook.Enabled,
-		Events:  hook.Events[:],
-		Repos:   hook.Repos[:],
+		Id:        hook.Id,
+		Url:       hook.Url,
+		Secret:    hook.Secret,
+		Enabled:   hook.Enabled,
+		Events:    hook.Events[:],
+		Repos:     hook.Repos[:],
+		Bookmarks: hook.Bookmarks[:],
+		Branches:  hook.Branches[:],
+
+		SignatureAlgorithm: hook.SignatureAlgorithm,
+		Headers:            hook.Headers,
+		BasicAuth:          hook.BasicAuth,
+		Timeout:            hook.Timeout,
+		Format:             hook.Format,
+		Type:               hook.Type,
+
+		PreviousSecret:        hook.PreviousSecret,
+		PreviousSecretExpires: hook.PreviousSecretExpires,
 	}
 
 	if parsedRequest.Id != nil {
@@ -391,8 +1284,11 @@ func (api *API) updateHook(w http.ResponseWriter, r *http.Request) {
 		updatedHook.Url = *parsedRequest.Url
 	}
 
+	// Setting the secret directly ends any rotation in progress.
 	if parsedRequest.Secret != nil {
 		updatedHook.Secret = *parsedRequest.Secret
+		updatedHook.PreviousSecret = ""
+		updatedHook.PreviousSecretExpires = nil
 	}
 
 	if parsedRequest.Enabled != nil {
@@ -407,11 +1303,54 @@ func (api *API) updateHook(w http.ResponseWriter, r *http.Request) {
 		updatedHook.Repos = parsedRequest.Repos
 	}
 
-	if err := updatedHook.Validate(api.config.RepositorySet()); err != nil {
+	if parsedRequest.Bookmarks != nil {
+		updatedHook.Bookmarks = parsedRequest.Bookmarks
+	}
+
+	if parsedRequest.Branches != nil {
+		updatedHook.Branches = parsedRequest.Branches
+	}
+
+	if parsedRequest.SignatureAlgorithm != nil {
+		updatedHook.SignatureAlgorithm = *parsedRequest.SignatureAlgorithm
+	}
+
+	if parsedRequest.Headers != nil {
+		updatedHook.Headers = parsedRequest.Headers
+	}
+
+	// Basic authentication can be removed by providing an empty username.
+	if parsedRequest.BasicAuth != nil {
+		if parsedRequest.BasicAuth.Username == "" {
+			updatedHook.BasicAuth = nil
+		} else {
+			updatedHook.BasicAuth = parsedRequest.BasicAuth
+		}
+	}
+
+	if parsedRequest.Timeout != nil {
+		updatedHook.Timeout = *parsedRequest.Timeout
+	}
+
+	if parsedRequest.Format != nil {
+		updatedHook.Format = *parsedRequest.Format
+	}
+
+	if parsedRequest.Type != nil {
+		updatedHook.Type = *parsedRequest.Type
+	}
+
+	if err := updatedHook.Validate(api.config.RepositorySet(), api.config.WebhookSecrets()); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
+	if err := updatedHook.EncryptSecrets(api.config.SecretsKey); err != nil {
+		log.Println("Could not encrypt webhook secret: ", err.Error())
+		http.Error(w, "An unexpected error occurred.", http.StatusInternalServerError)
+		return
+	}
+
 	api.hookStore[hook.Id] = &updatedHook
 	if err := api.hookStore.Save(api.config.WebhookStorePath); err != nil {
 		// If we cannot save the store, revert our state so that we stay
@@ -421,7 +1360,7 @@ func (api *API) updateHook(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "An unexpected error occurred.", http.StatusInternalServerError)
 	} else {
 		var b []byte
-		if b, err = json.MarshalIndent(updatedHook, "", "  "); err != nil {
+		if b, err = json.MarshalIndent(newWebhookResource(&updatedHook), "", "  "); err != nil {
 			http.Error(w, "An unexpected error occurred.", http.StatusInternalServerError)
 			return
 		}
@@ -431,3 +1370,76 @@ func (api *API) updateHook(w http.ResponseWriter, r *http.Request) {
 		w.Write(b)
 	}
 }
+
+// Rotate a webhook's secret.
+//
+// A new secret is generated and returned along with the rest of the webhook.
+// This is the only time the secret is returned. For the configured
+// `webhookSecretGracePeriod`, payloads are signed with both the new secret and
+// the old one, so that receivers can switch to the new secret without
+// rejecting any payloads. The secret cannot be rotated again until then, and
+// the response has an HTTP 409. Slack hooks are not signed, so their secrets
+// cannot be rotated.
+//
+// URL: `/webhooks/<hook-id>/rotate-secret`
+func (api *API) rotateHookSecret(w http.ResponseWriter, r *http.Request) {
+	api.hookStoreLock.Lock()
+	defer api.hookStoreLock.Unlock()
+
+	hookId := mux.Vars(r)["hook-id"]
+
+	var hook *hooks.Webhook
+	var exists bool
+	if hook, exists = api.hookStore[hookId]; !exists {
+		http.Error(w, "No such webhook", http.StatusNotFound)
+		return
+	} else if !hook.IsSigned() {
+		http.Error(w, "Hook is not signed, so it has no secret to rotate.", http.StatusBadRequest)
+		return
+	}
+
+	rotatedHook, err := hook.RotateSecret(api.config.WebhookSecretGracePeriodDuration())
+	if err == hooks.RotationInProgressErr {
+		http.Error(w,
+			fmt.Sprintf("The secret is already being rotated. It can be rotated again after %s.",
+				hook.PreviousSecretExpires.Format(time.RFC3339)),
+			http.StatusConflict)
+		return
+	} else if err != nil {
+		log.Println("Could not generate webhook secret: ", err.Error())
+		http.Error(w, "An unexpected error occurred.", http.StatusInternalServerError)
+		return
+	}
+
+	// The new secret is returned in plaintext so that it can be given to
+	// the receiver, but is only stored encrypted.
+	storedHook := rotatedHook
+	if err := storedHook.EncryptSecrets(api.config.SecretsKey); err != nil {
+		log.Println("Could not encrypt webhook secret: ", err.Error())
+		http.Error(w, "An unexpected error occurred.", http.StatusInternalServerError)
+		return
+	}
+
+	api.hookStore[hook.Id] = &storedHook
+	if err := api.hookStore.Save(api.config.WebhookStorePath); err != nil {
+		// If we cannot save the store, revert our state so that we stay
+		// consistent with it.
+		api.hookStore[hook.Id] = hook
+		log.Println("Could not update hook store: ", err.Error())
+		http.Error(w, "An unexpected error occurred.", http.StatusInternalServerError)
+		return
+	}
+
+	resource := newWebhookResource(&rotatedHook)
+	resource.Secret = rotatedHook.Secret
+
+	b, err := json.MarshalIndent(resource, "", "  ")
+	if err != nil {
+		http.Error(w, "An unexpected error occurred.", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
@@ -1,18 +1,27 @@
 package api_test
 
 import (
+	"archive/zip"
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"gopkg.in/src-d/go-git.v4"
 	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
 
 	"github.com/reviewboard/rb-gateway/api"
 	"github.com/reviewboard/rb-gateway/api/tokens"
@@ -138,6 +147,57 @@ func TestGetFileAPI(t *testing.T) {
 
 }
 
+func TestGetFileAPIRange(t *testing.T) {
+	assert := assert.New(t)
+
+	testSetup := setupRoutesTest(t)
+	defer testSetup.cleanup(t)
+
+	fileId := helpers.GetRepositoryFileId(t, testSetup.rawRepo, "README").String()
+	url := fmt.Sprintf("/repos/%s/file/%s", testSetup.repo.Name, fileId)
+
+	handler, err := api.New(testSetup.config)
+	assert.Nil(err)
+
+	token, err := (*handler.GetTokenStore()).New()
+	assert.Nil(err)
+
+	testCases := []struct {
+		rangeHeader  string
+		statusCode   int
+		body         string
+		contentRange string
+	}{
+		{"", http.StatusOK, "README\n", ""},
+		{"bytes=0-2", http.StatusPartialContent, "REA", "bytes 0-2/7"},
+		{"bytes=3-", http.StatusPartialContent, "DME\n", "bytes 3-6/7"},
+		{"bytes=-2", http.StatusPartialContent, "E\n", "bytes 5-6/7"},
+		{"bytes=0-1,3-4", http.StatusOK, "README\n", ""},
+		{"bytes=10-", http.StatusRequestedRangeNotSatisfiable, "", "bytes */7"},
+	}
+
+	for _, testCase := range testCases {
+		request, err := http.NewRequest("GET", url, nil)
+		assert.Nil(err)
+
+		request.Header.Set(api.PrivateTokenHeader, *token)
+		if testCase.rangeHeader != "" {
+			request.Header.Set("Range", testCase.rangeHeader)
+		}
+
+		rsp := httptest.NewRecorder()
+		handler.ServeHTTP(rsp, request)
+
+		assert.Equal(testCase.statusCode, rsp.Code, "Range: %s", testCase.rangeHeader)
+		assert.Equal(testCase.contentRange, rsp.Header().Get("Content-Range"))
+
+		if testCase.body != "" {
+			assert.Equal(testCase.body, rsp.Body.String())
+			assert.Equal(fmt.Sprintf("%d", len(testCase.body)), rsp.Header().Get("Content-Length"))
+		}
+	}
+}
+
 func TestFileExistsAPI(t *testing.T) {
 	assert := assert.New(t)
 
@@ -215,6 +275,116 @@ func TestFileExistsByCommitAPI(t *testing.T) {
 	)
 }
 
+func TestGetFileByRefAPI(t *testing.T) {
+	assert := assert.New(t)
+
+	testSetup := setupRoutesTest(t)
+	defer testSetup.cleanup(t)
+
+	branchName := testSetup.branch.Name().Short()
+
+	// Testing valid ref and file path
+	url := fmt.Sprintf("/repos/%s/refs/%s/path/%s", "repo", branchName, "AUTHORS")
+	rsp := testRoute(t, testSetup.config, url, "GET", nil)
+	assert.Equal(http.StatusOK, rsp.Code)
+	assert.Equal(helpers.GetRepoFiles()["AUTHORS"], rsp.Body.Bytes())
+
+	// Testing a ref containing slashes
+	featureRef := plumbing.NewHashReference("refs/heads/feature/x", testSetup.branch.Hash())
+	assert.Nil(testSetup.rawRepo.Storer.SetReference(featureRef))
+
+	url = fmt.Sprintf("/repos/%s/refs/%s/path/%s", "repo", "feature/x", "AUTHORS")
+	rsp = testRoute(t, testSetup.config, url, "GET", nil)
+	assert.Equal(http.StatusOK, rsp.Code)
+	assert.Equal(helpers.GetRepoFiles()["AUTHORS"], rsp.Body.Bytes())
+
+	// Testing file missing at ref
+	url = fmt.Sprintf("/repos/%s/refs/%s/path/%s", "repo", "master", "AUTHORS")
+	assert.Equal(
+		http.StatusNotFound,
+		testRoute(t, testSetup.config, url, "GET", nil).Code,
+	)
+
+	// Testing invalid ref
+	url = fmt.Sprintf("/repos/%s/refs/%s/path/%s", "repo", "bad-ref", "README")
+	assert.Equal(
+		http.StatusNotFound,
+		testRoute(t, testSetup.config, url, "GET", nil).Code,
+	)
+}
+
+func TestFileExistsByRefAPI(t *testing.T) {
+	assert := assert.New(t)
+
+	testSetup := setupRoutesTest(t)
+	defer testSetup.cleanup(t)
+
+	// Testing valid ref and file path
+	url := fmt.Sprintf("/repos/%s/refs/%s/path/%s", "repo", "master", "README")
+	assert.Equal(
+		http.StatusOK,
+		testRoute(t, testSetup.config, url, "HEAD", nil).Code,
+	)
+
+	// Testing invalid ref
+	url = fmt.Sprintf("/repos/%s/refs/%s/path/%s", "repo", "bad-ref", "README")
+	assert.Equal(
+		http.StatusNotFound,
+		testRoute(t, testSetup.config, url, "HEAD", nil).Code,
+	)
+}
+
+func TestSymlinksAPI(t *testing.T) {
+	assert := assert.New(t)
+
+	testSetup := setupRoutesTest(t)
+	defer testSetup.cleanup(t)
+
+	commitId := helpers.CreateGitSymlinks(t, testSetup.repo, testSetup.rawRepo, map[string]string{
+		"LICENSE": "COPYING",
+		"escape":  "../README",
+		"loop":    "loop",
+	}).String()
+
+	for _, ref := range []string{"commits/" + commitId, "refs/test-branch"} {
+		// Symlinks are returned as their targets, with their modes.
+		url := fmt.Sprintf("/repos/repo/%s/path/LICENSE", ref)
+		rsp := testRoute(t, testSetup.config, url, "GET", nil)
+		assert.Equal(http.StatusOK, rsp.Code, url)
+		assert.Equal("COPYING", rsp.Body.String(), url)
+		assert.Equal("120000", rsp.Header().Get("X-RBG-File-Mode"), url)
+		assert.Equal("symlink", rsp.Header().Get("X-RBG-File-Type"), url)
+		assert.Equal("", rsp.Header().Get("X-RBG-File-Path"), url)
+		symlinkETag := rsp.Header().Get("ETag")
+
+		url = fmt.Sprintf("/repos/repo/%s/path/README", ref)
+		rsp = testRoute(t, testSetup.config, url, "GET", nil)
+		assert.Equal(http.StatusOK, rsp.Code, url)
+		assert.Equal("100644", rsp.Header().Get("X-RBG-File-Mode"), url)
+		assert.Equal("file", rsp.Header().Get("X-RBG-File-Type"), url)
+
+		// Symlinks can be followed.
+		url = fmt.Sprintf("/repos/repo/%s/path/LICENSE?follow_symlinks=1", ref)
+		rsp = testRoute(t, testSetup.config, url, "GET", nil)
+		assert.Equal(http.StatusOK, rsp.Code, url)
+		assert.Equal(helpers.GetRepoFiles()["COPYING"], rsp.Body.Bytes(), url)
+		assert.Equal("100644", rsp.Header().Get("X-RBG-File-Mode"), url)
+		assert.Equal("file", rsp.Header().Get("X-RBG-File-Type"), url)
+		assert.Equal("COPYING", rsp.Header().Get("X-RBG-File-Path"), url)
+		assert.NotEqual(symlinkETag, rsp.Header().Get("ETag"), url)
+
+		// Symlinks out of the repository and symlink loops are not followed.
+		for _, path := range []string{"escape", "loop"} {
+			url = fmt.Sprintf("/repos/repo/%s/path/%s?follow_symlinks=1", ref, path)
+			assert.Equal(
+				http.StatusNotFound,
+				testRoute(t, testSetup.config, url, "GET", nil).Code,
+				url,
+			)
+		}
+	}
+}
+
 func TestGetBranchesAPI(t *testing.T) {
 	testSetup := setupRoutesTest(t)
 	defer testSetup.cleanup(t)
@@ -226,6 +396,92 @@ func TestGetBranchesAPI(t *testing.T) {
 	)
 }
 
+func TestGetBranchesAPISorted(t *testing.T) {
+	assert := assert.New(t)
+
+	testSetup := setupRoutesTest(t)
+	defer testSetup.cleanup(t)
+
+	var branches []repositories.Branch
+
+	rsp := testRoute(t, testSetup.config, "/repos/repo/branches?sort=name&order=desc", "GET", nil)
+	assert.Equal(http.StatusOK, rsp.Code)
+	assert.Nil(json.Unmarshal(rsp.Body.Bytes(), &branches))
+	assert.Equal(2, len(branches))
+	assert.Equal("test-branch", branches[0].Name)
+	assert.Equal("master", branches[1].Name)
+
+	rsp = testRoute(t, testSetup.config, "/repos/repo/branches?sort=last-commit-date", "GET", nil)
+	assert.Equal(http.StatusOK, rsp.Code)
+	assert.Nil(json.Unmarshal(rsp.Body.Bytes(), &branches))
+	assert.Equal(2, len(branches))
+	assert.Equal("test-branch", branches[0].Name)
+
+	rsp = testRoute(t, testSetup.config, "/repos/repo/branches?sort=size", "GET", nil)
+	assert.Equal(http.StatusBadRequest, rsp.Code)
+
+	rsp = testRoute(t, testSetup.config, "/repos/repo/branches?sort=name&order=up", "GET", nil)
+	assert.Equal(http.StatusBadRequest, rsp.Code)
+}
+
+func TestGetRepositoryAPI(t *testing.T) {
+	assert := assert.New(t)
+
+	testSetup := setupRoutesTest(t)
+	defer testSetup.cleanup(t)
+
+	rsp := testRoute(t, testSetup.config, "/repos/repo", "GET", nil)
+	assert.Equal(http.StatusOK, rsp.Code)
+
+	var parsedRsp struct {
+		Name     string                `json:"name"`
+		Scm      string                `json:"scm"`
+		Features repositories.Features `json:"features"`
+	}
+
+	assert.Nil(json.Unmarshal(rsp.Body.Bytes(), &parsedRsp))
+	assert.Equal("repo", parsedRsp.Name)
+	assert.Equal("git", parsedRsp.Scm)
+	assert.Equal(repositories.Features{Archive: true, Notes: true}, parsedRsp.Features)
+
+	rsp = testRoute(t, testSetup.config, "/repos/does-not-exist", "GET", nil)
+	assert.Equal(http.StatusNotFound, rsp.Code)
+}
+
+func TestGetRefsAPI(t *testing.T) {
+	assert := assert.New(t)
+
+	testSetup := setupRoutesTest(t)
+	defer testSetup.cleanup(t)
+
+	url := fmt.Sprintf("/repos/%s/refs", "repo")
+	rsp := testRoute(t, testSetup.config, url, "GET", nil)
+	assert.Equal(http.StatusOK, rsp.Code)
+
+	var parsedRsp struct {
+		Cursor string             `json:"cursor"`
+		Refs   []repositories.Ref `json:"refs"`
+	}
+
+	assert.Nil(json.Unmarshal(rsp.Body.Bytes(), &parsedRsp))
+	assert.NotEqual("", parsedRsp.Cursor)
+	assert.Equal(2, len(parsedRsp.Refs))
+
+	// Testing an unchanged cursor
+	url = fmt.Sprintf("/repos/%s/refs?since_cursor=%s", "repo", parsedRsp.Cursor)
+	rsp = testRoute(t, testSetup.config, url, "GET", nil)
+	assert.Equal(http.StatusNotModified, rsp.Code)
+	assert.Equal(0, rsp.Body.Len())
+
+	// Testing a cursor after a ref has moved
+	err := testSetup.rawRepo.Storer.SetReference(plumbing.NewHashReference(
+		"refs/heads/master", testSetup.branch.Hash()))
+	assert.Nil(err)
+
+	rsp = testRoute(t, testSetup.config, url, "GET", nil)
+	assert.Equal(http.StatusOK, rsp.Code)
+}
+
 func TestGetCommitsAPI(t *testing.T) {
 	testSetup := setupRoutesTest(t)
 	defer testSetup.cleanup(t)
@@ -239,6 +495,197 @@ func TestGetCommitsAPI(t *testing.T) {
 	)
 }
 
+func TestGetCommitsAPISorted(t *testing.T) {
+	assert := assert.New(t)
+
+	testSetup := setupRoutesTest(t)
+	defer testSetup.cleanup(t)
+
+	var commits []repositories.CommitInfo
+
+	for _, sort := range []string{"date", "topological"} {
+		url := fmt.Sprintf("/repos/repo/branches/test-branch/commits?sort=%s", sort)
+		rsp := testRoute(t, testSetup.config, url, "GET", nil)
+		assert.Equal(http.StatusOK, rsp.Code)
+		assert.Nil(json.Unmarshal(rsp.Body.Bytes(), &commits))
+		assert.Equal(2, len(commits))
+		assert.Equal(testSetup.branch.Hash().String(), commits[0].Id)
+	}
+
+	rsp := testRoute(t, testSetup.config, "/repos/repo/branches/test-branch/commits?sort=date&order=asc", "GET", nil)
+	assert.Equal(http.StatusBadRequest, rsp.Code)
+
+	rsp = testRoute(t, testSetup.config, "/repos/repo/branches/test-branch/commits?sort=author", "GET", nil)
+	assert.Equal(http.StatusBadRequest, rsp.Code)
+}
+
+func TestGetCommitsAPIFiltered(t *testing.T) {
+	assert := assert.New(t)
+
+	testSetup := setupRoutesTest(t)
+	defer testSetup.cleanup(t)
+
+	var commits []repositories.CommitInfo
+
+	rsp := testRoute(t, testSetup.config, "/repos/repo/branches/test-branch/commits?author=AUTHOR@example", "GET", nil)
+	assert.Equal(http.StatusOK, rsp.Code)
+	assert.Nil(json.Unmarshal(rsp.Body.Bytes(), &commits))
+	assert.Equal(2, len(commits))
+
+	rsp = testRoute(t, testSetup.config, "/repos/repo/branches/test-branch/commits?author=nobody", "GET", nil)
+	assert.Equal(http.StatusOK, rsp.Code)
+	assert.Equal("[]", rsp.Body.String())
+
+	yesterday := time.Now().UTC().AddDate(0, 0, -1)
+	url := fmt.Sprintf("/repos/repo/branches/test-branch/commits?since=%s&until=%s",
+		yesterday.Format("2006-01-02"),
+		time.Now().UTC().Add(time.Hour).Format(time.RFC3339))
+	rsp = testRoute(t, testSetup.config, url, "GET", nil)
+	assert.Equal(http.StatusOK, rsp.Code)
+	assert.Nil(json.Unmarshal(rsp.Body.Bytes(), &commits))
+	assert.Equal(2, len(commits))
+
+	url = fmt.Sprintf("/repos/repo/branches/test-branch/commits?until=%s", yesterday.Format("2006-01-02"))
+	rsp = testRoute(t, testSetup.config, url, "GET", nil)
+	assert.Equal(http.StatusOK, rsp.Code)
+	assert.Equal("[]", rsp.Body.String())
+
+	// A date for until includes the whole day.
+	url = fmt.Sprintf("/repos/repo/branches/test-branch/commits?until=%s", time.Now().UTC().Format("2006-01-02"))
+	rsp = testRoute(t, testSetup.config, url, "GET", nil)
+	assert.Equal(http.StatusOK, rsp.Code)
+	assert.Nil(json.Unmarshal(rsp.Body.Bytes(), &commits))
+	assert.Equal(2, len(commits))
+
+	rsp = testRoute(t, testSetup.config, "/repos/repo/branches/test-branch/commits?since=last-week", "GET", nil)
+	assert.Equal(http.StatusBadRequest, rsp.Code)
+	assert.Equal("Invalid value for since: \"last-week\".\n", rsp.Body.String())
+}
+
+func TestGetMergeBaseAPI(t *testing.T) {
+	assert := assert.New(t)
+
+	testSetup := setupRoutesTest(t)
+	defer testSetup.cleanup(t)
+
+	master, err := testSetup.rawRepo.Reference("refs/heads/master", false)
+	assert.Nil(err)
+
+	rsp := testRoute(t, testSetup.config, "/repos/repo/merge-base?a=master&b=test-branch", "GET", nil)
+	assert.Equal(http.StatusOK, rsp.Code)
+	assert.Equal(fmt.Sprintf(`{"merge_base":"%s"}`, master.Hash().String()), rsp.Body.String())
+
+	rsp = testRoute(t, testSetup.config, "/repos/repo/merge-base?a=master", "GET", nil)
+	assert.Equal(http.StatusBadRequest, rsp.Code)
+
+	rsp = testRoute(t, testSetup.config, "/repos/repo/merge-base?a=master&b=does-not-exist", "GET", nil)
+	assert.Equal(http.StatusBadRequest, rsp.Code)
+}
+
+func TestGetFileLogAPI(t *testing.T) {
+	assert := assert.New(t)
+
+	testSetup := setupRoutesTest(t)
+	defer testSetup.cleanup(t)
+
+	branchName := testSetup.branch.Name().Short()
+
+	url := fmt.Sprintf("/repos/%s/branches/%s/path/%s/log", "repo", branchName, "AUTHORS")
+	rsp := testRoute(t, testSetup.config, url, "GET", nil)
+	assert.Equal(http.StatusOK, rsp.Code)
+
+	var commits []repositories.FileLogEntry
+	assert.Nil(json.Unmarshal(rsp.Body.Bytes(), &commits))
+	if assert.Equal(1, len(commits)) {
+		assert.Equal(testSetup.branch.Hash().String(), commits[0].Id)
+		assert.Equal("AUTHORS", commits[0].Path)
+		assert.Equal(repositories.PatchAdded, commits[0].Status)
+		assert.Equal("", commits[0].OldPath)
+	}
+
+	url = fmt.Sprintf("/repos/%s/branches/%s/path/%s/log", "repo", "does-not-exist", "AUTHORS")
+	assert.Equal(
+		http.StatusBadRequest,
+		testRoute(t, testSetup.config, url, "GET", nil).Code,
+	)
+}
+
+func TestGetCommitRangeAPI(t *testing.T) {
+	assert := assert.New(t)
+
+	testSetup := setupRoutesTest(t)
+	defer testSetup.cleanup(t)
+
+	branchName := testSetup.branch.Name().Short()
+
+	url := fmt.Sprintf("/repos/%s/commits?since=%s&until=%s", "repo", "master", branchName)
+	rsp := testRoute(t, testSetup.config, url, "GET", nil)
+	assert.Equal(http.StatusOK, rsp.Code)
+
+	var commits []repositories.CommitInfo
+	assert.Nil(json.Unmarshal(rsp.Body.Bytes(), &commits))
+	assert.Equal(1, len(commits))
+	assert.Equal(testSetup.branch.Hash().String(), commits[0].Id)
+
+	// Testing missing parameters
+	url = fmt.Sprintf("/repos/%s/commits?since=%s", "repo", "master")
+	assert.Equal(
+		http.StatusBadRequest,
+		testRoute(t, testSetup.config, url, "GET", nil).Code,
+	)
+}
+
+func TestSearchCommitsAPI(t *testing.T) {
+	assert := assert.New(t)
+
+	testSetup := setupRoutesTest(t)
+	defer testSetup.cleanup(t)
+
+	branchName := testSetup.branch.Name().Short()
+
+	url := fmt.Sprintf("/repos/%s/search/commits?q=%s&branch=%s", "repo", "branch", branchName)
+	rsp := testRoute(t, testSetup.config, url, "GET", nil)
+	assert.Equal(http.StatusOK, rsp.Code)
+
+	var commits []repositories.CommitInfo
+	assert.Nil(json.Unmarshal(rsp.Body.Bytes(), &commits))
+	assert.Equal(1, len(commits))
+	assert.Equal(testSetup.branch.Hash().String(), commits[0].Id)
+
+	url = fmt.Sprintf("/repos/%s/search/commits?q=%s&authors=true", "repo", "author")
+	rsp = testRoute(t, testSetup.config, url, "GET", nil)
+	assert.Equal(http.StatusOK, rsp.Code)
+	assert.Nil(json.Unmarshal(rsp.Body.Bytes(), &commits))
+	assert.Equal(2, len(commits))
+
+	url = fmt.Sprintf("/repos/%s/search/commits?q=%s&paths=1", "repo", "AUTHORS")
+	rsp = testRoute(t, testSetup.config, url, "GET", nil)
+	assert.Equal(http.StatusOK, rsp.Code)
+	assert.Nil(json.Unmarshal(rsp.Body.Bytes(), &commits))
+	if assert.Equal(1, len(commits)) {
+		assert.Equal(testSetup.branch.Hash().String(), commits[0].Id)
+	}
+
+	// Testing invalid parameters
+	url = fmt.Sprintf("/repos/%s/search/commits", "repo")
+	assert.Equal(
+		http.StatusBadRequest,
+		testRoute(t, testSetup.config, url, "GET", nil).Code,
+	)
+
+	url = fmt.Sprintf("/repos/%s/search/commits?q=%s&authors=%s", "repo", "author", "maybe")
+	assert.Equal(
+		http.StatusBadRequest,
+		testRoute(t, testSetup.config, url, "GET", nil).Code,
+	)
+
+	url = fmt.Sprintf("/repos/%s/search/commits?q=%s&paths=%s", "repo", "author", "maybe")
+	assert.Equal(
+		http.StatusBadRequest,
+		testRoute(t, testSetup.config, url, "GET", nil).Code,
+	)
+}
+
 func TestGetCommitAPI(t *testing.T) {
 	assert := assert.New(t)
 
@@ -254,62 +701,1910 @@ func TestGetCommitAPI(t *testing.T) {
 		testRoute(t, testSetup.config, url, "GET", nil).Code,
 	)
 
-	// Testing invalid commit id
-	url = fmt.Sprintf("/repos/%s/commits/%s", "repo", routesTestInvalidId)
-	assert.Equal(
-		http.StatusNotFound,
-		testRoute(t, testSetup.config, url, "GET", nil).Code,
-	)
+	// Testing invalid commit id
+	url = fmt.Sprintf("/repos/%s/commits/%s", "repo", routesTestInvalidId)
+	assert.Equal(
+		http.StatusNotFound,
+		testRoute(t, testSetup.config, url, "GET", nil).Code,
+	)
+
+}
+
+func TestApplyCheckAPI(t *testing.T) {
+	assert := assert.New(t)
+
+	testSetup := setupRoutesTest(t)
+	defer testSetup.cleanup(t)
+
+	head := helpers.GetRepoHead(t, testSetup.rawRepo).String()
+	url := fmt.Sprintf("/repos/repo/commits/%s/apply-check", head)
+
+	diff := []byte(`diff --git a/README b/README
+--- a/README
++++ b/README
+@@ -1 +1 @@
+-README
++Read me
+`)
+
+	var parsedRsp struct {
+		Commit  string `json:"commit"`
+		Applies bool   `json:"applies"`
+		Files   []struct {
+			Path      string `json:"path"`
+			Status    string `json:"status"`
+			Applies   bool   `json:"applies"`
+			Conflicts []struct {
+				Line     int      `json:"line"`
+				Expected []string `json:"expected"`
+			} `json:"conflicts"`
+		} `json:"files"`
+	}
+
+	rsp := testRoute(t, testSetup.config, url, "POST", diff)
+	assert.Equal(http.StatusOK, rsp.Code)
+	assert.Nil(json.Unmarshal(rsp.Body.Bytes(), &parsedRsp))
+	assert.Equal(head, parsedRsp.Commit)
+	assert.True(parsedRsp.Applies)
+	if assert.Equal(1, len(parsedRsp.Files)) {
+		assert.Equal("README", parsedRsp.Files[0].Path)
+		assert.Equal(repositories.PatchModified, parsedRsp.Files[0].Status)
+		assert.True(parsedRsp.Files[0].Applies)
+	}
+
+	// Symbolic refs are resolved.
+	rsp = testRoute(t, testSetup.config, "/repos/repo/commits/test-branch/apply-check", "POST", diff)
+	assert.Equal(http.StatusOK, rsp.Code)
+
+	rsp = testRoute(t, testSetup.config, url, "POST", []byte(`diff --git a/README b/README
+--- a/README
++++ b/README
+@@ -1 +1 @@
+-Read me
++README
+`))
+	assert.Equal(http.StatusOK, rsp.Code)
+	assert.Nil(json.Unmarshal(rsp.Body.Bytes(), &parsedRsp))
+	assert.False(parsedRsp.Applies)
+	if assert.Equal(1, len(parsedRsp.Files)) && assert.Equal(1, len(parsedRsp.Files[0].Conflicts)) {
+		conflict := parsedRsp.Files[0].Conflicts[0]
+		assert.Equal(1, conflict.Line)
+		assert.Equal([]string{"Read me"}, conflict.Expected)
+	}
+
+	rsp = testRoute(t, testSetup.config, url, "POST", []byte("not a diff"))
+	assert.Equal(http.StatusBadRequest, rsp.Code)
+
+	rsp = testRoute(t, testSetup.config, fmt.Sprintf("/repos/repo/commits/%s/apply-check", routesTestInvalidId), "POST", diff)
+	assert.Equal(http.StatusNotFound, rsp.Code)
+
+	// Checking a patch only reads the repository, so read-only tokens can be
+	// used.
+	handler, err := api.New(testSetup.config)
+	assert.Nil(err)
+
+	token, err := (*handler.GetTokenStore()).NewWithOptions(tokens.Options{ReadOnly: true})
+	assert.Nil(err)
+
+	rsp = serveRequest(t, handler, "POST", url, *token, diff)
+	assert.Equal(http.StatusOK, rsp.Code)
+
+	rsp = serveRequest(t, handler, "POST", "/repos/repo/test-event", *token, nil)
+	assert.Equal(http.StatusForbidden, rsp.Code)
+}
+
+func TestGetArchiveAPI(t *testing.T) {
+	assert := assert.New(t)
+
+	testSetup := setupRoutesTest(t)
+	defer testSetup.cleanup(t)
+
+	commitId := testSetup.branch.Hash().String()
+	name := fmt.Sprintf("repo-%s", commitId[:12])
+
+	url := fmt.Sprintf("/repos/%s/commits/%s/archive?format=zip", "repo", commitId)
+	rsp := testRoute(t, testSetup.config, url, "GET", nil)
+	assert.Equal(http.StatusOK, rsp.Code)
+	assert.Equal("application/zip", rsp.Header().Get("Content-Type"))
+	assert.Equal(fmt.Sprintf("attachment; filename=\"%s.zip\"", name), rsp.Header().Get("Content-Disposition"))
+
+	reader, err := zip.NewReader(bytes.NewReader(rsp.Body.Bytes()), int64(rsp.Body.Len()))
+	assert.Nil(err)
+
+	files := helpers.GetRepoFiles()
+	assert.Equal(len(files), len(reader.File))
+
+	for _, file := range reader.File {
+		content, ok := files[strings.TrimPrefix(file.Name, name+"/")]
+		assert.Truef(ok, "Unexpected file %s", file.Name)
+
+		f, err := file.Open()
+		assert.Nil(err)
+		data, err := ioutil.ReadAll(f)
+		assert.Nil(err)
+		assert.Equal(content, data)
+	}
+
+	// The default format is a gzipped tarball.
+	url = fmt.Sprintf("/repos/%s/commits/%s/archive", "repo", "master")
+	rsp = testRoute(t, testSetup.config, url, "GET", nil)
+	assert.Equal(http.StatusOK, rsp.Code)
+	assert.Equal("application/gzip", rsp.Header().Get("Content-Type"))
+
+	url = fmt.Sprintf("/repos/%s/commits/%s/archive?format=rar", "repo", commitId)
+	assert.Equal(
+		http.StatusBadRequest,
+		testRoute(t, testSetup.config, url, "GET", nil).Code,
+	)
+
+	url = fmt.Sprintf("/repos/%s/commits/%s/archive", "repo", routesTestInvalidId)
+	assert.Equal(
+		http.StatusNotFound,
+		testRoute(t, testSetup.config, url, "GET", nil).Code,
+	)
+}
+
+func TestGetNotesAPI(t *testing.T) {
+	assert := assert.New(t)
+
+	testSetup := setupRoutesTest(t)
+	defer testSetup.cleanup(t)
+
+	head := helpers.GetRepoHead(t, testSetup.rawRepo)
+	helpers.CreateGitNote(t, testSetup.rawRepo, head, "Review approved\n")
+
+	url := fmt.Sprintf("/repos/%s/commits/%s/notes", "repo", head.String())
+	rsp := testRoute(t, testSetup.config, url, "GET", nil)
+	assert.Equal(http.StatusOK, rsp.Code)
+
+	var notes []repositories.Note
+	assert.Nil(json.Unmarshal(rsp.Body.Bytes(), &notes))
+	assert.Equal(1, len(notes))
+	assert.Equal("Review approved\n", notes[0].Message)
+
+	// Testing invalid commit id
+	url = fmt.Sprintf("/repos/%s/commits/%s/notes", "repo", routesTestInvalidId)
+	assert.Equal(
+		http.StatusNotFound,
+		testRoute(t, testSetup.config, url, "GET", nil).Code,
+	)
+}
+
+func TestGetLanguagesAPI(t *testing.T) {
+	assert := assert.New(t)
+
+	testSetup := setupRoutesTest(t)
+	defer testSetup.cleanup(t)
+
+	worktree, err := testSetup.rawRepo.Worktree()
+	assert.Nil(err)
+
+	files := map[string]string{
+		"main.go":   "package main\n\nfunc main() {}\n",
+		"util.go":   "package main\n",
+		"script.py": "print()\n",
+	}
+
+	for name, content := range files {
+		assert.Nil(ioutil.WriteFile(filepath.Join(testSetup.repo.Path, name), []byte(content), 0644))
+		_, err = worktree.Add(name)
+		assert.Nil(err)
+	}
+
+	commitId, err := worktree.Commit("Add code", &git.CommitOptions{
+		Author: &object.Signature{
+			Name:  "Author",
+			Email: "author@example.com",
+			When:  time.Now(),
+		},
+	})
+	assert.Nil(err)
+
+	for _, ref := range []string{commitId.String(), "test-branch"} {
+		url := fmt.Sprintf("/repos/repo/commits/%s/languages", ref)
+		rsp := testRoute(t, testSetup.config, url, "GET", nil)
+		assert.Equal(http.StatusOK, rsp.Code, url)
+
+		var languages []repositories.LanguageStats
+		assert.Nil(json.Unmarshal(rsp.Body.Bytes(), &languages), url)
+		assert.Equal([]repositories.LanguageStats{
+			{Language: "Go", Bytes: int64(len(files["main.go"]) + len(files["util.go"])), Files: 2},
+			{Language: "Python", Bytes: int64(len(files["script.py"])), Files: 1},
+		}, languages, url)
+	}
+
+	// Commits without any files in a known language have no languages.
+	url := fmt.Sprintf("/repos/repo/commits/%s/languages", testSetup.branch.Hash().String())
+	rsp := testRoute(t, testSetup.config, url, "GET", nil)
+	assert.Equal(http.StatusOK, rsp.Code)
+	assert.Equal("[]", strings.TrimSpace(rsp.Body.String()))
+
+	// Testing invalid commit id
+	url = fmt.Sprintf("/repos/repo/commits/%s/languages", routesTestInvalidId)
+	assert.Equal(
+		http.StatusNotFound,
+		testRoute(t, testSetup.config, url, "GET", nil).Code,
+	)
+}
+
+func TestOwnersAPI(t *testing.T) {
+	assert := assert.New(t)
+
+	testSetup := setupRoutesTest(t)
+	defer testSetup.cleanup(t)
+
+	testSetup.config.OwnersFiles = config.DefaultOwnersFiles
+
+	// Without an owners file, nothing is owned.
+	url := "/repos/repo/refs/test-branch/owners?path=README"
+	rsp := testRoute(t, testSetup.config, url, "GET", nil)
+	assert.Equal(http.StatusOK, rsp.Code)
+	assert.JSONEq(`{
+		"owners_file": "",
+		"owners": [],
+		"paths": [{"path": "README", "owners": []}]
+	}`, rsp.Body.String())
+
+	worktree, err := testSetup.rawRepo.Worktree()
+	assert.Nil(err)
+
+	files := map[string]string{
+		".github/CODEOWNERS": "*        @core\n/docs/   @docs alice\n*.go     @go\n",
+		"docs/index.rst":     "Docs\n",
+		"main.go":            "package main\n",
+	}
+
+	for name, content := range files {
+		path := filepath.Join(testSetup.repo.Path, name)
+		assert.Nil(os.MkdirAll(filepath.Dir(path), 0755))
+		assert.Nil(ioutil.WriteFile(path, []byte(content), 0644))
+		_, err = worktree.Add(name)
+		assert.Nil(err)
+	}
+
+	commitId, err := worktree.Commit("Add owners", &git.CommitOptions{
+		Author: &object.Signature{
+			Name:  "Author",
+			Email: "author@example.com",
+			When:  time.Now(),
+		},
+	})
+	assert.Nil(err)
+
+	for _, ref := range []string{commitId.String(), "test-branch"} {
+		url := fmt.Sprintf("/repos/repo/commits/%s/owners", ref)
+		rsp := testRoute(t, testSetup.config, url, "GET", nil)
+		assert.Equal(http.StatusOK, rsp.Code, url)
+		assert.JSONEq(`{
+			"owners_file": ".github/CODEOWNERS",
+			"owners": ["@core", "@docs", "@go", "alice"],
+			"paths": [
+				{"path": ".github/CODEOWNERS", "owners": ["@core"]},
+				{"path": "docs/index.rst", "owners": ["@docs", "alice"]},
+				{"path": "main.go", "owners": ["@go"]}
+			]
+		}`, rsp.Body.String(), url)
+	}
+
+	// The paths do not need to exist.
+	url = "/repos/repo/refs/test-branch/owners?path=docs/new.rst&path=/cmd/new.go"
+	rsp = testRoute(t, testSetup.config, url, "GET", nil)
+	assert.Equal(http.StatusOK, rsp.Code)
+	assert.JSONEq(`{
+		"owners_file": ".github/CODEOWNERS",
+		"owners": ["@docs", "@go", "alice"],
+		"paths": [
+			{"path": "docs/new.rst", "owners": ["@docs", "alice"]},
+			{"path": "cmd/new.go", "owners": ["@go"]}
+		]
+	}`, rsp.Body.String())
+
+	// Owners files that are not configured are not used.
+	testSetup.config.OwnersFiles = []string{"CODEOWNERS"}
+	rsp = testRoute(t, testSetup.config, url, "GET", nil)
+	assert.Equal(http.StatusOK, rsp.Code)
+	assert.Contains(rsp.Body.String(), `"owners_file":""`)
+
+	url = "/repos/repo/refs/test-branch/owners"
+	assert.Equal(
+		http.StatusBadRequest,
+		testRoute(t, testSetup.config, url, "GET", nil).Code,
+	)
+
+	url = "/repos/repo/refs/bad-ref/owners?path=README"
+	assert.Equal(
+		http.StatusNotFound,
+		testRoute(t, testSetup.config, url, "GET", nil).Code,
+	)
+
+	url = fmt.Sprintf("/repos/repo/commits/%s/owners", routesTestInvalidId)
+	assert.Equal(
+		http.StatusNotFound,
+		testRoute(t, testSetup.config, url, "GET", nil).Code,
+	)
+}
+
+func TestGetSessionAPI(t *testing.T) {
+	assert := assert.New(t)
+
+	testSetup := setupRoutesTest(t)
+	defer testSetup.cleanup(t)
+
+	request, err := http.NewRequest("GET", "/session", nil)
+	assert.Nil(err)
+
+	request.SetBasicAuth("username", "password")
+
+	response := httptest.NewRecorder()
+	handler, err := api.New(testSetup.config)
+	assert.Nil(err)
+
+	handler.ServeHTTP(response, request)
+
+	var session api.Session
+
+	assert.Nil(json.Unmarshal(response.Body.Bytes(), &session))
+
+	assert.Equal(len(session.PrivateToken), tokens.TokenSize,
+		"Private token is not provided in the response")
+}
+
+func TestCreateSessionAPI(t *testing.T) {
+	assert := assert.New(t)
+
+	testSetup := setupRoutesTest(t)
+	defer testSetup.cleanup(t)
+
+	handler, err := api.New(testSetup.config)
+	assert.Nil(err)
+
+	body := []byte(`{"ttl": 600, "repositories": ["repo"], "read_only": true}`)
+	rsp := serveRequest(t, handler, "POST", "/session", "", body)
+	assert.Equal(http.StatusOK, rsp.Code)
+
+	var session api.Session
+	assert.Nil(json.Unmarshal(rsp.Body.Bytes(), &session))
+	assert.Equal(tokens.TokenSize, len(session.PrivateToken))
+	assert.Equal([]string{"repo"}, session.Repositories)
+	assert.True(session.ReadOnly)
+	assert.NotNil(session.Created)
+	assert.NotNil(session.Expires)
+	assert.Equal(600*time.Second, session.Expires.Sub(*session.Created))
+
+	// Fetching the session describes the presented token instead of creating
+	// a new one.
+	rsp = serveRequest(t, handler, "GET", "/session", session.PrivateToken, nil)
+	assert.Equal(http.StatusOK, rsp.Code)
+
+	var fetched api.Session
+	assert.Nil(json.Unmarshal(rsp.Body.Bytes(), &fetched))
+	assert.Equal(session.PrivateToken, fetched.PrivateToken)
+	assert.Equal(session.Repositories, fetched.Repositories)
+	assert.True(fetched.ReadOnly)
+
+	// The token is limited to reading the repository.
+	rsp = serveRequest(t, handler, "GET", "/repos/repo/branches", session.PrivateToken, nil)
+	assert.Equal(http.StatusOK, rsp.Code)
+
+	rsp = serveRequest(t, handler, "GET", "/webhooks", session.PrivateToken, nil)
+	assert.Equal(http.StatusForbidden, rsp.Code)
+
+	rsp = serveRequest(t, handler, "POST", "/session", session.PrivateToken, nil)
+	assert.Equal(http.StatusUnauthorized, rsp.Code)
+}
+
+func TestCreateSessionAPIAuthProvider(t *testing.T) {
+	assert := assert.New(t)
+
+	testSetup := setupRoutesTest(t)
+	defer testSetup.cleanup(t)
+
+	dir, err := ioutil.TempDir("", "rb-gateway-credentials-")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	script := filepath.Join(dir, "check-password")
+	assert.Nil(ioutil.WriteFile(script, []byte(`#!/bin/sh
+read username
+read password
+
+case "$username" in
+    username) [ "$password" = secret ] ;;
+    *) exit 2 ;;
+esac
+`), 0755))
+
+	testSetup.config.AuthProvider = config.AuthProviderConfig{
+		Type:    "command",
+		Command: script,
+		Timeout: 10,
+	}
+
+	handler, err := api.New(testSetup.config)
+	assert.Nil(err)
+
+	request := func(username, password string) *httptest.ResponseRecorder {
+		request, err := http.NewRequest("POST", "/session", nil)
+		assert.Nil(err)
+		request.SetBasicAuth(username, password)
+
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, request)
+		return response
+	}
+
+	assert.Equal(http.StatusOK, request("username", "secret").Code)
+
+	// The htpasswd file is no longer consulted.
+	rsp := request("username", "password")
+	assert.Equal(http.StatusUnauthorized, rsp.Code)
+	assert.Equal(`Basic realm="RB Gateway"`, rsp.Header().Get("WWW-Authenticate"))
+
+	// Errors checking credentials are not reported as failed logins.
+	assert.Equal(http.StatusInternalServerError, request("other", "secret").Code)
+}
+
+func TestCreateSessionAPIReadOnly(t *testing.T) {
+	assert := assert.New(t)
+
+	testSetup := setupRoutesTest(t)
+	defer testSetup.cleanup(t)
+
+	handler, err := api.New(testSetup.config)
+	assert.Nil(err)
+
+	rsp := serveRequest(t, handler, "POST", "/session", "", []byte(`{"read_only": true}`))
+	assert.Equal(http.StatusOK, rsp.Code)
+
+	var session api.Session
+	assert.Nil(json.Unmarshal(rsp.Body.Bytes(), &session))
+	assert.Nil(session.Expires)
+
+	rsp = serveRequest(t, handler, "GET", "/webhooks", session.PrivateToken, nil)
+	assert.Equal(http.StatusOK, rsp.Code)
+
+	rsp = serveRequest(t, handler, "DELETE", "/webhooks/test-hook-1", session.PrivateToken, nil)
+	assert.Equal(http.StatusForbidden, rsp.Code)
+}
+
+func TestReadOnlyUsersAPI(t *testing.T) {
+	assert := assert.New(t)
+
+	testSetup := setupRoutesTest(t)
+	defer testSetup.cleanup(t)
+
+	handler, err := api.New(testSetup.config)
+	assert.Nil(err)
+
+	existing, err := (*handler.GetTokenStore()).NewWithOptions(tokens.Options{User: "username"})
+	assert.Nil(err)
+
+	testSetup.config.ReadOnlyUsers = []string{"username"}
+
+	rsp := serveRequest(t, handler, "POST", "/session", "", nil)
+	assert.Equal(http.StatusOK, rsp.Code)
+
+	var session api.Session
+	assert.Nil(json.Unmarshal(rsp.Body.Bytes(), &session))
+	assert.True(session.ReadOnly)
+	assert.Equal("username", session.User)
+	assert.Equal(tokens.RoleReader, session.Role)
+
+	for _, token := range []string{session.PrivateToken, *existing} {
+		rsp = serveRequest(t, handler, "GET", "/repos/repo/branches", token, nil)
+		assert.Equal(http.StatusOK, rsp.Code)
+
+		rsp = serveRequest(t, handler, "GET", "/webhooks", token, nil)
+		assert.Equal(http.StatusForbidden, rsp.Code)
+
+		rsp = serveRequest(t, handler, "GET", "/webhooks/test-hook-1", token, nil)
+		assert.Equal(http.StatusForbidden, rsp.Code)
+
+		rsp = serveRequest(t, handler, "DELETE", "/webhooks/test-hook-1", token, nil)
+		assert.Equal(http.StatusForbidden, rsp.Code)
+	}
+}
+
+func TestCreateSessionAPIInvalid(t *testing.T) {
+	assert := assert.New(t)
+
+	testSetup := setupRoutesTest(t)
+	defer testSetup.cleanup(t)
+
+	handler, err := api.New(testSetup.config)
+	assert.Nil(err)
+
+	testCases := []string{
+		`{"ttl": -1}`,
+		`{"ttl": 9223372037}`,
+		`{"repositories": ["does-not-exist"]}`,
+		`not json`,
+	}
+
+	for _, body := range testCases {
+		rsp := serveRequest(t, handler, "POST", "/session", "", []byte(body))
+		assert.Equal(http.StatusBadRequest, rsp.Code, body)
+	}
+}
+
+func TestDelegateSessionAPI(t *testing.T) {
+	assert := assert.New(t)
+
+	testSetup := setupRoutesTest(t)
+	defer testSetup.cleanup(t)
+
+	testSetup.config.MaxDelegatedTokenTTL = 3600
+
+	handler, err := api.New(testSetup.config)
+	assert.Nil(err)
+
+	parent, err := (*handler.GetTokenStore()).New()
+	assert.Nil(err)
+
+	rsp := serveRequest(t, handler, "POST", "/session/delegate", *parent, []byte(`{"repository": "repo"}`))
+	assert.Equal(http.StatusOK, rsp.Code)
+
+	var session api.Session
+	assert.Nil(json.Unmarshal(rsp.Body.Bytes(), &session))
+	assert.NotEqual(*parent, session.PrivateToken)
+	assert.Equal([]string{"repo"}, session.Repositories)
+	assert.True(session.ReadOnly)
+	if assert.NotNil(session.Expires) {
+		assert.Equal(15*time.Minute, session.Expires.Sub(*session.Created))
+	}
+
+	// The delegated token can read the repository, but nothing else.
+	rsp = serveRequest(t, handler, "GET", "/repos/repo/branches", session.PrivateToken, nil)
+	assert.Equal(http.StatusOK, rsp.Code)
+
+	rsp = serveRequest(t, handler, "GET", "/webhooks", session.PrivateToken, nil)
+	assert.Equal(http.StatusForbidden, rsp.Code)
+
+	// Delegated tokens are read-only, so they cannot delegate further.
+	rsp = serveRequest(t, handler, "POST", "/session/delegate", session.PrivateToken, []byte(`{"repository": "repo"}`))
+	assert.Equal(http.StatusForbidden, rsp.Code)
+}
+
+func TestDelegateSessionAPIExpiry(t *testing.T) {
+	assert := assert.New(t)
+
+	testSetup := setupRoutesTest(t)
+	defer testSetup.cleanup(t)
+
+	testSetup.config.MaxDelegatedTokenTTL = 3600
+
+	handler, err := api.New(testSetup.config)
+	assert.Nil(err)
+
+	parent, err := (*handler.GetTokenStore()).NewWithOptions(tokens.Options{TTL: time.Minute})
+	assert.Nil(err)
+	parentInfo := (*handler.GetTokenStore()).Info(*parent)
+
+	rsp := serveRequest(t, handler, "POST", "/session/delegate", *parent, []byte(`{"repository": "repo", "ttl": 600}`))
+	assert.Equal(http.StatusOK, rsp.Code)
+
+	var session api.Session
+	assert.Nil(json.Unmarshal(rsp.Body.Bytes(), &session))
+
+	// The delegated token cannot outlive its parent.
+	if assert.NotNil(session.Expires) {
+		assert.False(session.Expires.After(parentInfo.Expires))
+	}
+}
+
+func TestDelegateSessionAPIInvalid(t *testing.T) {
+	assert := assert.New(t)
+
+	testSetup := setupRoutesTest(t)
+	defer testSetup.cleanup(t)
+
+	testSetup.config.MaxDelegatedTokenTTL = 3600
+
+	handler, err := api.New(testSetup.config)
+	assert.Nil(err)
+
+	token, err := (*handler.GetTokenStore()).New()
+	assert.Nil(err)
+
+	testCases := []string{
+		`{}`,
+		`{"repository": "does-not-exist"}`,
+		`{"repository": "repo", "ttl": 3601}`,
+		`{"repository": "repo", "ttl": -1}`,
+		`{"repository": "repo", "ttl": 18446744074}`,
+		`not json`,
+	}
+
+	for _, body := range testCases {
+		rsp := serveRequest(t, handler, "POST", "/session/delegate", *token, []byte(body))
+		assert.Equal(http.StatusBadRequest, rsp.Code, body)
+	}
+
+	rsp := serveRequest(t, handler, "POST", "/session/delegate", "", []byte(`{"repository": "repo"}`))
+	assert.Equal(http.StatusUnauthorized, rsp.Code)
+}
+
+func TestCreateSessionAPIDisabled(t *testing.T) {
+	assert := assert.New(t)
+
+	testSetup := setupRoutesTest(t)
+	defer testSetup.cleanup(t)
+
+	testSetup.config.DisableTokenCreation = true
+
+	handler, err := api.New(testSetup.config)
+	assert.Nil(err)
+
+	for _, method := range []string{"GET", "POST"} {
+		rsp := serveRequest(t, handler, method, "/session", "", nil)
+		assert.Equal(http.StatusForbidden, rsp.Code, method)
+	}
+
+	// Existing tokens can still be inspected.
+	token, err := (*handler.GetTokenStore()).New()
+	assert.Nil(err)
+
+	rsp := serveRequest(t, handler, "GET", "/session", *token, nil)
+	assert.Equal(http.StatusOK, rsp.Code)
+
+	rsp = serveRequest(t, handler, "POST", "/session/delegate", *token, []byte(`{"repository": "repo"}`))
+	assert.Equal(http.StatusForbidden, rsp.Code)
+}
+
+func TestGroupedRepositoryAPI(t *testing.T) {
+	assert := assert.New(t)
+
+	testSetup := setupRoutesTest(t)
+	defer testSetup.cleanup(t)
+
+	testSetup.config.Repositories["team/project"] = &repositories.GitRepository{
+		RepositoryInfo: repositories.RepositoryInfo{
+			Name: "team/project",
+			Path: testSetup.repo.Path,
+		},
+	}
+
+	rsp := testRoute(t, testSetup.config, "/repos/team/project", "GET", nil)
+	assert.Equal(http.StatusOK, rsp.Code)
+
+	var parsedRsp struct {
+		Name string `json:"name"`
+	}
+	assert.Nil(json.Unmarshal(rsp.Body.Bytes(), &parsedRsp))
+	assert.Equal("team/project", parsedRsp.Name)
+
+	for _, url := range []string{
+		"/repos/team/project/branches",
+		"/repos/team/project/branches/master/commits",
+		"/repos/team/project/refs/master/path/README",
+		"/repos/team/project/refs",
+		"/repos/team/project/search/commits?q=commit",
+		"/repos/team%2Fproject/branches",
+	} {
+		assert.Equal(http.StatusOK, testRoute(t, testSetup.config, url, "GET", nil).Code, url)
+	}
+
+	assert.Equal(http.StatusNotFound,
+		testRoute(t, testSetup.config, "/repos/team/branches", "GET", nil).Code)
+
+	rsp = testRoute(t, testSetup.config, "/repos/team/project/commits/master/archive?format=zip", "GET", nil)
+	assert.Equal(http.StatusOK, rsp.Code)
+	assert.Contains(rsp.Header().Get("Content-Disposition"), `filename="team-project-`)
+}
+
+func TestRepositoryNameCaseAPI(t *testing.T) {
+	assert := assert.New(t)
+
+	testSetup := setupRoutesTest(t)
+	defer testSetup.cleanup(t)
+
+	rsp := testRoute(t, testSetup.config, "/repos/Repo/branches", "GET", nil)
+	assert.Equal(http.StatusNotFound, rsp.Code)
+	assert.Equal("Repository not found. Repository names are case-sensitive; did you mean \"repo\"?\n",
+		rsp.Body.String())
+
+	testSetup.config.CaseInsensitiveRepositoryNames = true
+
+	rsp = testRoute(t, testSetup.config, "/repos/REPO", "GET", nil)
+	assert.Equal(http.StatusOK, rsp.Code)
+
+	var parsedRsp struct {
+		Name string `json:"name"`
+	}
+	assert.Nil(json.Unmarshal(rsp.Body.Bytes(), &parsedRsp))
+	assert.Equal("repo", parsedRsp.Name)
+
+	rsp = testRoute(t, testSetup.config, "/repos/does-not-exist", "GET", nil)
+	assert.Equal(http.StatusNotFound, rsp.Code)
+	assert.Equal("Repository not found.\n", rsp.Body.String())
+}
+
+func TestTestEventAPI(t *testing.T) {
+	assert := assert.New(t)
+
+	testSetup := setupRoutesTest(t)
+	defer testSetup.cleanup(t)
+
+	server, requestsChan := helpers.CreateRequestRecorder(t)
+	defer server.Close()
+
+	testSetup.hooks["test-hook-1"].Url = server.URL + "/1/"
+	helpers.WriteTestWebhookStore(t, testSetup.hooks, testSetup.config)
+
+	rsp := testRoute(t, testSetup.config, "/repos/repo/test-event", "POST", nil)
+	assert.Equal(http.StatusOK, rsp.Code)
+
+	var parsedRsp struct {
+		Event   string             `json:"event"`
+		Payload events.PushPayload `json:"payload"`
+		Error   string             `json:"error"`
+	}
+	assert.Nil(json.Unmarshal(rsp.Body.Bytes(), &parsedRsp))
+	assert.Equal(events.PushEvent, parsedRsp.Event)
+	assert.Equal("", parsedRsp.Error)
+
+	// The test branch was committed to most recently.
+	payload := parsedRsp.Payload
+	assert.Equal("repo", payload.Repository)
+	assert.Equal(2, len(payload.Commits))
+	assert.Equal(testSetup.branch.Hash().String(), payload.Commits[len(payload.Commits)-1].Id)
+	assert.Equal("test-branch", payload.Commits[0].Target.Branch)
+	assert.Equal("author@example.com", payload.Commits[0].AuthorEmail)
+
+	request := helpers.AssertNumRequests(t, 1, requestsChan)[0]
+	assert.Equal("/1/", request.Request.URL.Path)
+	assert.Equal(events.PushEvent, request.Request.Header.Get("X-RBG-Event"))
+
+	rawJson, err := events.MarshalPayload(payload)
+	assert.Nil(err)
+	assert.Equal(string(rawJson), string(request.Body))
+
+	rsp = testRoute(t, testSetup.config, "/repos/repo/test-event", "POST", []byte(`{"branch": "master", "commits": 1}`))
+	assert.Equal(http.StatusOK, rsp.Code)
+	assert.Nil(json.Unmarshal(rsp.Body.Bytes(), &parsedRsp))
+	assert.Equal(1, len(parsedRsp.Payload.Commits))
+	assert.Equal("master", parsedRsp.Payload.Commits[0].Target.Branch)
+	helpers.AssertNumRequests(t, 1, requestsChan)
+
+	// With an external URL, the payload links back to the API.
+	testSetup.config.ExternalUrl = "https://gateway.example.com"
+
+	rsp = testRoute(t, testSetup.config, "/repos/repo/test-event", "POST", []byte(`{"branch": "master", "commits": 1}`))
+	assert.Equal(http.StatusOK, rsp.Code)
+	assert.Nil(json.Unmarshal(rsp.Body.Bytes(), &parsedRsp))
+	assert.Equal("https://gateway.example.com/repos/repo", parsedRsp.Payload.RepositoryUrl)
+	assert.Equal(
+		fmt.Sprintf("https://gateway.example.com/repos/repo/commits/%s", parsedRsp.Payload.Commits[0].Id),
+		parsedRsp.Payload.Commits[0].CommitUrl)
+
+	request = helpers.AssertNumRequests(t, 1, requestsChan)[0]
+	assert.Contains(string(request.Body), `"repository_url": "https://gateway.example.com/repos/repo"`)
+
+	testCases := []string{
+		`{"branch": "does-not-exist"}`,
+		`{"commits": -1}`,
+		`not json`,
+	}
+
+	for _, body := range testCases {
+		rsp = testRoute(t, testSetup.config, "/repos/repo/test-event", "POST", []byte(body))
+		assert.Equal(http.StatusBadRequest, rsp.Code, body)
+	}
+}
+
+func TestPushPayloadAPI(t *testing.T) {
+	assert := assert.New(t)
+
+	testSetup := setupRoutesTest(t)
+	defer testSetup.cleanup(t)
+
+	url := "/repos/repo/push-payload?old=master&new=test-branch"
+
+	rsp := testRoute(t, testSetup.config, url, "GET", nil)
+	assert.Equal(http.StatusOK, rsp.Code)
+
+	payload, err := events.UnmarshalPayload(events.PushEvent, rsp.Body.Bytes())
+	assert.Nil(err)
+
+	pushPayload := payload.(events.PushPayload)
+	assert.Equal("repo", pushPayload.Repository)
+	if assert.Equal(1, len(pushPayload.Commits)) {
+		assert.Equal(testSetup.branch.Hash().String(), pushPayload.Commits[0].Id)
+		assert.Equal("test-branch", pushPayload.Commits[0].Target.Branch)
+	}
+
+	testCases := []string{
+		"/repos/repo/push-payload",
+		"/repos/repo/push-payload?old=master",
+		"/repos/repo/push-payload?old=master&new=does-not-exist",
+	}
+
+	for _, url := range testCases {
+		rsp = testRoute(t, testSetup.config, url, "GET", nil)
+		assert.Equal(http.StatusBadRequest, rsp.Code, url)
+	}
+
+	// Until a dispatcher is set, payloads cannot be delivered.
+	handler, err := api.New(testSetup.config)
+	assert.Nil(err)
+
+	token, err := (*handler.GetTokenStore()).New()
+	assert.Nil(err)
+
+	rsp = serveRequest(t, handler, "POST", url, *token, nil)
+	assert.Equal(http.StatusServiceUnavailable, rsp.Code)
+
+	var dispatched []events.Payload
+	var dispatchErr error
+
+	dispatch := func(cfg *config.Config, repository repositories.Repository, event string, payload events.Payload) error {
+		assert.Equal("repo", repository.GetName())
+		assert.Equal(events.PushEvent, event)
+
+		dispatched = append(dispatched, payload)
+		return dispatchErr
+	}
+	handler.SetEventDispatcher(dispatch, dispatch)
+
+	var parsedRsp struct {
+		Event   string             `json:"event"`
+		Payload events.PushPayload `json:"payload"`
+		Error   string             `json:"error"`
+	}
+
+	rsp = serveRequest(t, handler, "POST", url, *token, nil)
+	assert.Equal(http.StatusOK, rsp.Code)
+	assert.Nil(json.Unmarshal(rsp.Body.Bytes(), &parsedRsp))
+	assert.Equal(events.PushEvent, parsedRsp.Event)
+	assert.Equal(1, len(parsedRsp.Payload.Commits))
+	assert.Equal("", parsedRsp.Error)
+
+	if assert.Equal(1, len(dispatched)) {
+		assert.Equal(pushPayload, dispatched[0])
+	}
+
+	dispatchErr = errors.New("connection refused")
+
+	rsp = serveRequest(t, handler, "POST", url, *token, nil)
+	assert.Equal(http.StatusBadGateway, rsp.Code)
+	assert.Nil(json.Unmarshal(rsp.Body.Bytes(), &parsedRsp))
+	assert.Equal("connection refused", parsedRsp.Error)
+
+	// Read-only tokens and readers can neither get payloads nor deliver
+	// them.
+	for _, options := range []tokens.Options{{ReadOnly: true}, {Role: tokens.RoleReader}} {
+		token, err = (*handler.GetTokenStore()).NewWithOptions(options)
+		assert.Nil(err)
+
+		for _, method := range []string{"GET", "POST"} {
+			rsp = serveRequest(t, handler, method, url, *token, nil)
+			assert.Equal(http.StatusForbidden, rsp.Code, method)
+		}
+	}
+
+	// Nor can anonymous users of public repositories.
+	testSetup.config.PublicRepositories = map[string]bool{"repo": true}
+	handler, err = api.New(testSetup.config)
+	assert.Nil(err)
+
+	rsp = serveRequest(t, handler, "GET", url, "", nil)
+	assert.Equal(http.StatusForbidden, rsp.Code)
+}
+
+func TestDeadLettersAPI(t *testing.T) {
+	assert := assert.New(t)
+
+	testSetup := setupRoutesTest(t)
+	defer testSetup.cleanup(t)
+
+	server, requestsChan := helpers.CreateRequestRecorder(t)
+	defer server.Close()
+
+	testSetup.hooks["test-hook-1"].Url = server.URL + "/1/"
+	helpers.WriteTestWebhookStore(t, testSetup.hooks, testSetup.config)
+
+	deadLetterDir, err := ioutil.TempDir("", "rb-gateway-dead-letters-")
+	assert.Nil(err)
+	defer os.RemoveAll(deadLetterDir)
+
+	testSetup.config.WebhookDeadLetterPath = deadLetterDir
+	testSetup.config.WebhookStatusPath = filepath.Join(deadLetterDir, "status")
+	deadLetters := hooks.DeadLetterStore{Dir: deadLetterDir}
+
+	var page struct {
+		DeadLetters []hooks.DeadLetter `json:"dead_letters"`
+		TotalCount  int                `json:"total_count"`
+	}
+
+	rsp := testRoute(t, testSetup.config, "/webhooks/dead-letters", "GET", nil)
+	assert.Equal(http.StatusOK, rsp.Code)
+	assert.Nil(json.Unmarshal(rsp.Body.Bytes(), &page))
+	assert.Equal(0, page.TotalCount)
+	assert.Equal(0, len(page.DeadLetters))
+
+	letter := hooks.DeadLetter{
+		HookId:     "test-hook-1",
+		Event:      events.PushEvent,
+		Repository: "repo",
+		Time:       time.Now().UTC(),
+		Attempts:   1,
+		Reason:     hooks.DeliveryReasonConnection,
+		Error:      "connection refused",
+		Payload:    `{"event": "push", "repository": "repo", "commits": []}`,
+	}
+	assert.Nil(deadLetters.Add(&letter))
+
+	rsp = testRoute(t, testSetup.config, "/webhooks/dead-letters", "GET", nil)
+	assert.Equal(http.StatusOK, rsp.Code)
+
+	assert.Nil(json.Unmarshal(rsp.Body.Bytes(), &page))
+	assert.Equal(1, page.TotalCount)
+	if assert.Equal(1, len(page.DeadLetters)) {
+		assert.Equal(letter.Id, page.DeadLetters[0].Id)
+		assert.Equal(letter.Payload, page.DeadLetters[0].Payload)
+	}
+
+	// Redriving delivers the original payload and removes the dead letter.
+	rsp = testRoute(t, testSetup.config, fmt.Sprintf("/webhooks/dead-letters/%s/redrive", letter.Id), "POST", nil)
+	assert.Equal(http.StatusOK, rsp.Code)
+	assert.Equal(`{"delivered":true}`, rsp.Body.String())
+
+	request := helpers.AssertNumRequests(t, 1, requestsChan)[0]
+	assert.Equal("/1/", request.Request.URL.Path)
+	assert.Equal(letter.Payload, string(request.Body))
+
+	_, err = deadLetters.Load(letter.Id)
+	assert.True(os.IsNotExist(err))
+
+	rsp = testRoute(t, testSetup.config, fmt.Sprintf("/webhooks/dead-letters/%s/redrive", letter.Id), "POST", nil)
+	assert.Equal(http.StatusNotFound, rsp.Code)
+
+	// Dead letters for webhooks that no longer exist can only be discarded.
+	letter = hooks.DeadLetter{
+		HookId:     "deleted-hook",
+		Event:      events.PushEvent,
+		Repository: "repo",
+		Time:       time.Now().UTC(),
+		Attempts:   1,
+	}
+	assert.Nil(deadLetters.Add(&letter))
+
+	rsp = testRoute(t, testSetup.config, fmt.Sprintf("/webhooks/dead-letters/%s/redrive", letter.Id), "POST", nil)
+	assert.Equal(http.StatusBadRequest, rsp.Code)
+
+	rsp = testRoute(t, testSetup.config, fmt.Sprintf("/webhooks/dead-letters/%s", letter.Id), "DELETE", nil)
+	assert.Equal(http.StatusNoContent, rsp.Code)
+
+	rsp = testRoute(t, testSetup.config, fmt.Sprintf("/webhooks/dead-letters/%s", letter.Id), "DELETE", nil)
+	assert.Equal(http.StatusNotFound, rsp.Code)
+}
+
+func TestGetPathAPI(t *testing.T) {
+	assert := assert.New(t)
+
+	testSetup := setupRoutesTest(t)
+	defer testSetup.cleanup(t)
+
+	rsp := testRoute(t, testSetup.config, "/repos/repo/path", "GET", nil)
+	assert.Equal(http.StatusOK, rsp.Code)
+	assert.Equal(0, rsp.Body.Len())
+
+	testSetup.config.LegacyCompat = true
+
+	rsp = testRoute(t, testSetup.config, "/repos/repo/path", "GET", nil)
+	assert.Equal(http.StatusOK, rsp.Code)
+	assert.Equal(strings.TrimRight(testSetup.repo.Path, "/")+"/info/refs", rsp.Body.String())
+}
+
+func TestGetPathAPILegacyCompat(t *testing.T) {
+	assert := assert.New(t)
+
+	testSetup := setupRoutesTest(t)
+	defer testSetup.cleanup(t)
+
+	testSetup.config.LegacyCompat = true
+
+	// Older Review Board versions use the body as is, so a trailing slash in
+	// the configured path must not be repeated.
+	expected := testSetup.repo.Path + "/info/refs"
+	testSetup.repo.Path += "/"
+
+	rsp := testRoute(t, testSetup.config, "/repos/repo/path", "GET", nil)
+	assert.Equal(http.StatusOK, rsp.Code)
+	assert.Equal("text/plain; charset=utf-8", rsp.Header().Get("Content-Type"))
+	assert.Equal(expected, rsp.Body.String())
+}
+
+func TestPublicRepositoryAPI(t *testing.T) {
+	assert := assert.New(t)
+
+	testSetup := setupRoutesTest(t)
+	defer testSetup.cleanup(t)
+
+	handler, err := api.New(testSetup.config)
+	assert.Nil(err)
+
+	anonymousRequest := func(method, url string) int {
+		request, err := http.NewRequest(method, url, nil)
+		assert.Nil(err)
+
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, request)
+
+		return response.Code
+	}
+
+	assert.Equal(http.StatusUnauthorized, anonymousRequest("GET", "/repos/repo/branches"))
+
+	testSetup.config.PublicRepositories = map[string]bool{"repo": true}
+	handler, err = api.New(testSetup.config)
+	assert.Nil(err)
+
+	assert.Equal(http.StatusOK, anonymousRequest("GET", "/repos/repo/branches"))
+	assert.Equal(http.StatusOK, anonymousRequest("GET", "/repos/repo/branches/master/commits"))
+	assert.Equal(http.StatusOK, anonymousRequest("HEAD", "/repos/repo/refs/master/path/README"))
+
+	// Other repositories and webhooks still require a token.
+	assert.Equal(http.StatusUnauthorized, anonymousRequest("GET", "/repos/other-repo/branches"))
+	assert.Equal(http.StatusUnauthorized, anonymousRequest("GET", "/webhooks"))
+
+	// Invalid tokens are still rejected.
+	request, err := http.NewRequest("GET", "/repos/repo/branches", nil)
+	assert.Nil(err)
+	request.Header.Set(api.PrivateTokenHeader, strings.Repeat("A", tokens.TokenSize))
+
+	response := httptest.NewRecorder()
+	handler.ServeHTTP(response, request)
+	assert.Equal(http.StatusUnauthorized, response.Code)
+}
+
+func TestListAPIPagination(t *testing.T) {
+	assert := assert.New(t)
+
+	testSetup := setupRoutesTest(t)
+	defer testSetup.cleanup(t)
+
+	// The test branch already has two commits.
+	worktree, err := testSetup.rawRepo.Worktree()
+	assert.Nil(err)
+
+	for i := 0; i < 25; i++ {
+		_, err := worktree.Commit(fmt.Sprintf("Commit %d", i), &git.CommitOptions{
+			Author: &object.Signature{
+				Name:  "Author",
+				Email: "author@example.com",
+				When:  time.Now().Add(time.Duration(i+1) * time.Minute),
+			},
+		})
+		assert.Nil(err)
+	}
+
+	handler, err := api.New(testSetup.config)
+	assert.Nil(err)
+
+	token, err := (*handler.GetTokenStore()).New()
+	assert.Nil(err)
+
+	rsp := serveRequest(t, handler, "GET", "/repos/repo/branches/test-branch/commits", *token, nil)
+	assert.Equal(http.StatusOK, rsp.Code)
+
+	// Bare arrays are still returned by default.
+	var commits []repositories.CommitInfo
+	assert.Nil(json.Unmarshal(rsp.Body.Bytes(), &commits))
+	assert.Equal(repositories.CommitsPageSize, len(commits))
+	assert.Equal("", rsp.Header().Get("X-Total-Count"))
+
+	next := fmt.Sprintf("/repos/repo/branches/test-branch/commits?start=%s", commits[len(commits)-1].ParentId)
+	assert.Equal(fmt.Sprintf(`<%s>; rel="next"`, next), rsp.Header().Get("Link"))
+
+	rsp = serveRequest(t, handler, "GET", next+"&envelope=true", *token, nil)
+	assert.Equal(http.StatusOK, rsp.Code)
+	assert.Equal("", rsp.Header().Get("Link"))
+
+	var page struct {
+		Items      []repositories.CommitInfo `json:"items"`
+		TotalCount *int                      `json:"total_count"`
+		HasMore    bool                      `json:"has_more"`
+		Next       *string                   `json:"next"`
+	}
+	assert.Nil(json.Unmarshal(rsp.Body.Bytes(), &page))
+	assert.Equal(27-repositories.CommitsPageSize, len(page.Items))
+	assert.Nil(page.TotalCount)
+	assert.False(page.HasMore)
+	assert.Nil(page.Next)
+
+	rsp = serveRequest(t, handler, "GET", "/repos/repo/branches?envelope=1", *token, nil)
+	assert.Equal(http.StatusOK, rsp.Code)
+	assert.Equal("2", rsp.Header().Get("X-Total-Count"))
+
+	var branchPage struct {
+		Items      []repositories.Branch `json:"items"`
+		TotalCount *int                  `json:"total_count"`
+		HasMore    bool                  `json:"has_more"`
+	}
+	assert.Nil(json.Unmarshal(rsp.Body.Bytes(), &branchPage))
+	assert.Equal(2, len(branchPage.Items))
+	if assert.NotNil(branchPage.TotalCount) {
+		assert.Equal(2, *branchPage.TotalCount)
+	}
+	assert.False(branchPage.HasMore)
+
+	// With an external URL, links to the next page are absolute.
+	testSetup.config.ExternalUrl = "https://gateway.example.com/rb-gateway"
+
+	rsp = testRoute(t, testSetup.config, "/repos/repo/branches/test-branch/commits", "GET", nil)
+	assert.Equal(http.StatusOK, rsp.Code)
+	assert.Equal(fmt.Sprintf(`<https://gateway.example.com/rb-gateway%s>; rel="next"`, next), rsp.Header().Get("Link"))
+}
+
+func TestGetHooksAPI(t *testing.T) {
+	assert := assert.New(t)
+
+	testSetup := setupRoutesTest(t)
+	defer testSetup.cleanup(t)
+
+	rsp := testRoute(t, testSetup.config, "/webhooks", "GET", nil)
+	assert.Equal(http.StatusOK, rsp.Code)
+
+	var parsedRsp struct {
+		Webhooks   []hooks.Webhook `json:"webhooks"`
+		TotalCount int             `json:"total_count"`
+		HasMore    bool            `json:"has_more"`
+	}
+
+	assert.Nil(json.Unmarshal(rsp.Body.Bytes(), &parsedRsp))
+	assert.Equal(2, parsedRsp.TotalCount)
+	assert.False(parsedRsp.HasMore)
+
+	parsedWebhooks := make(hooks.WebhookStore)
+	for hookId := range parsedRsp.Webhooks {
+		hook := &parsedRsp.Webhooks[hookId]
+		parsedWebhooks[hook.Id] = hook
+	}
+
+	expected := make(hooks.WebhookStore)
+	for hookId, hook := range testSetup.hooks {
+		hook := withoutSecrets(*hook)
+		expected[hookId] = &hook
+	}
+
+	assert.Equal(expected, parsedWebhooks)
+}
+
+// Return a copy of a webhook without its secrets, as the API returns it.
+func withoutSecrets(hook hooks.Webhook) hooks.Webhook {
+	hook.Secret = ""
+	hook.PreviousSecret = ""
+
+	if hook.Headers != nil {
+		headers := make(map[string]string, len(hook.Headers))
+		for name := range hook.Headers {
+			headers[name] = "[REDACTED]"
+		}
+
+		hook.Headers = headers
+	}
+
+	if hook.BasicAuth != nil {
+		hook.BasicAuth = &hooks.WebhookBasicAuth{Username: hook.BasicAuth.Username, Password: "[REDACTED]"}
+	}
+
+	return hook
+}
+
+func TestGetHooksAPIRedactsCredentials(t *testing.T) {
+	assert := assert.New(t)
+
+	testSetup := setupRoutesTest(t)
+	defer testSetup.cleanup(t)
+
+	body, err := json.Marshal(map[string]interface{}{
+		"id":        "credentials-hook",
+		"url":       "http://example.com/credentials/",
+		"secret":    strings.Repeat("s", 20),
+		"enabled":   true,
+		"events":    []string{events.PushEvent},
+		"repos":     []string{"repo"},
+		"headers":   map[string]string{"X-Proxy-Token": "proxy-token-value"},
+		"basicAuth": map[string]string{"username": "user", "password": "basic-auth-password"},
+	})
+	assert.Nil(err)
+
+	rsp := testRoute(t, testSetup.config, "/webhooks", "POST", body)
+	assert.Equal(http.StatusCreated, rsp.Code)
+
+	for _, url := range []string{"/webhooks", "/webhooks/credentials-hook"} {
+		rsp = testRoute(t, testSetup.config, url, "GET", nil)
+		assert.Equal(http.StatusOK, rsp.Code)
+
+		content := rsp.Body.String()
+		assert.NotContains(content, "proxy-token-value", url)
+		assert.NotContains(content, "basic-auth-password", url)
+		assert.Contains(content, `"X-Proxy-Token":"[REDACTED]"`, url)
+		assert.Contains(content, `"username":"user"`, url)
+	}
+}
+
+func TestGetHooksAPISorted(t *testing.T) {
+	assert := assert.New(t)
+
+	testSetup := setupRoutesTest(t)
+	defer testSetup.cleanup(t)
+
+	var parsedRsp struct {
+		Webhooks []hooks.Webhook `json:"webhooks"`
+	}
+
+	ids := func() []string {
+		result := make([]string, 0, len(parsedRsp.Webhooks))
+		for _, hook := range parsedRsp.Webhooks {
+			result = append(result, hook.Id)
+		}
+		return result
+	}
+
+	rsp := testRoute(t, testSetup.config, "/webhooks?sort=id&order=desc", "GET", nil)
+	assert.Equal(http.StatusOK, rsp.Code)
+	assert.Nil(json.Unmarshal(rsp.Body.Bytes(), &parsedRsp))
+	assert.Equal([]string{"test-hook-2", "test-hook-1"}, ids())
+
+	rsp = testRoute(t, testSetup.config, "/webhooks?sort=enabled", "GET", nil)
+	assert.Equal(http.StatusOK, rsp.Code)
+	assert.Nil(json.Unmarshal(rsp.Body.Bytes(), &parsedRsp))
+	assert.Equal([]string{"test-hook-2", "test-hook-1"}, ids())
+
+	rsp = testRoute(t, testSetup.config, "/webhooks?sort=url", "GET", nil)
+	assert.Equal(http.StatusBadRequest, rsp.Code)
+}
+
+func TestRequestBodyLimitAPI(t *testing.T) {
+	assert := assert.New(t)
+
+	testSetup := setupRoutesTest(t)
+	defer testSetup.cleanup(t)
+
+	testSetup.config.MaxRequestBodySize = 64
+
+	body, err := json.Marshal(map[string]interface{}{
+		"id":      "large-hook",
+		"url":     "http://example.com/large/",
+		"secret":  strings.Repeat("a", 100),
+		"enabled": true,
+		"events":  []string{events.PushEvent},
+		"repos":   []string{"repo"},
+	})
+	assert.Nil(err)
+
+	rsp := testRoute(t, testSetup.config, "/webhooks", "POST", body)
+	assert.Equal(http.StatusRequestEntityTooLarge, rsp.Code)
+	assert.Equal("Request body is too large; the limit is 64 bytes.\n", rsp.Body.String())
+
+	rsp = testRoute(t, testSetup.config, "/webhooks/test-hook-1", "PATCH", body)
+	assert.Equal(http.StatusRequestEntityTooLarge, rsp.Code)
+
+	rsp = testRoute(t, testSetup.config, "/webhooks/test-hook-1", "PATCH", []byte(`{"enabled": false}`))
+	assert.Equal(http.StatusOK, rsp.Code)
+}
+
+func TestMaxFileSizeAPI(t *testing.T) {
+	assert := assert.New(t)
+
+	testSetup := setupRoutesTest(t)
+	defer testSetup.cleanup(t)
+
+	fileId := helpers.GetRepositoryFileId(t, testSetup.rawRepo, "README").String()
+	urls := []string{
+		fmt.Sprintf("/repos/repo/file/%s", fileId),
+		fmt.Sprintf("/repos/repo/commits/%s/path/README", testSetup.branch.Hash().String()),
+		"/repos/repo/refs/test-branch/path/README",
+	}
+
+	for _, url := range urls {
+		assert.Equal(http.StatusOK, testRoute(t, testSetup.config, url, "GET", nil).Code, url)
+	}
+
+	testSetup.config.MaxFileSize = 1
+
+	for _, url := range urls {
+		rsp := testRoute(t, testSetup.config, url, "GET", nil)
+		assert.Equal(http.StatusNotAcceptable, rsp.Code, url)
+		assert.Contains(rsp.Body.String(), "the limit is 1 bytes.", url)
+	}
+}
+
+func TestLargeFilesAPI(t *testing.T) {
+	assert := assert.New(t)
+
+	testSetup := setupRoutesTest(t)
+	defer testSetup.cleanup(t)
+
+	content := bytes.Repeat([]byte("A large file.\n"), 100)
+	commitId, oid := helpers.CreateGitLfsFile(t, testSetup.repo, testSetup.rawRepo, "large.bin", content)
+
+	fileId := helpers.GetRepositoryFileId(t, testSetup.rawRepo, "large.bin").String()
+	urls := []string{
+		fmt.Sprintf("/repos/repo/file/%s", fileId),
+		fmt.Sprintf("/repos/repo/commits/%s/path/large.bin", commitId.String()),
+		"/repos/repo/refs/test-branch/path/large.bin",
+	}
+
+	for _, url := range urls {
+		rsp := testRoute(t, testSetup.config, url, "GET", nil)
+		assert.Equal(http.StatusOK, rsp.Code, url)
+		assert.Contains(rsp.Body.String(), "oid sha256:"+oid, url)
+		assert.Equal("", rsp.Header().Get("X-RBG-Large-File"), url)
+	}
+
+	testSetup.repo.LargeFiles = true
+
+	for _, url := range urls {
+		rsp := testRoute(t, testSetup.config, url, "GET", nil)
+		assert.Equal(http.StatusOK, rsp.Code, url)
+		assert.Equal(content, rsp.Body.Bytes(), url)
+		assert.Equal(oid, rsp.Header().Get("X-RBG-Large-File"), url)
+	}
+
+	// Other files are returned as-is.
+	rsp := testRoute(t, testSetup.config, "/repos/repo/refs/test-branch/path/README", "GET", nil)
+	assert.Equal(http.StatusOK, rsp.Code)
+	assert.Equal(helpers.GetRepoFiles()["README"], rsp.Body.Bytes())
+	assert.Equal("", rsp.Header().Get("X-RBG-Large-File"))
+
+	// The size of the large file is checked, rather than the pointer.
+	testSetup.config.MaxFileSize = int64(len(content)) - 1
+
+	for _, url := range urls {
+		assert.Equal(http.StatusNotAcceptable, testRoute(t, testSetup.config, url, "GET", nil).Code, url)
+	}
+
+	testSetup.repo.LargeFiles = false
+
+	for _, url := range urls {
+		assert.Equal(http.StatusOK, testRoute(t, testSetup.config, url, "GET", nil).Code, url)
+	}
+}
+
+func TestLargeFilesETagsAPI(t *testing.T) {
+	assert := assert.New(t)
+
+	testSetup := setupRoutesTest(t)
+	defer testSetup.cleanup(t)
+
+	content := []byte("A large file.\n")
+	commitId, oid := helpers.CreateGitLfsFile(t, testSetup.repo, testSetup.rawRepo, "large.bin", content)
+
+	handler, err := api.New(testSetup.config)
+	assert.Nil(err)
+
+	token, err := (*handler.GetTokenStore()).New()
+	assert.Nil(err)
+
+	get := func(url, ifNoneMatch string) *httptest.ResponseRecorder {
+		request, err := http.NewRequest("GET", url, nil)
+		assert.Nil(err)
+
+		request.Header.Set(api.PrivateTokenHeader, *token)
+		if ifNoneMatch != "" {
+			request.Header.Set("If-None-Match", ifNoneMatch)
+		}
+
+		rsp := httptest.NewRecorder()
+		handler.ServeHTTP(rsp, request)
+		return rsp
+	}
+
+	fileId := helpers.GetRepositoryFileId(t, testSetup.rawRepo, "large.bin").String()
+	urls := []string{
+		fmt.Sprintf("/repos/repo/file/%s", fileId),
+		fmt.Sprintf("/repos/repo/commits/%s/path/large.bin", commitId.String()),
+		"/repos/repo/refs/test-branch/path/large.bin",
+	}
+
+	objectPath := filepath.Join(testSetup.repo.Path, ".git", "lfs", "objects", oid[0:2], oid[2:4], oid)
+
+	for _, url := range urls {
+		testSetup.repo.LargeFiles = false
+
+		pointer := get(url, "")
+		assert.Equal(http.StatusOK, pointer.Code, url)
+		pointerETag := pointer.Header().Get("ETag")
+
+		// Once large files are enabled, the pointer is not reused.
+		testSetup.repo.LargeFiles = true
+
+		resolved := get(url, pointerETag)
+		assert.Equal(http.StatusOK, resolved.Code, url)
+		assert.Equal(content, resolved.Body.Bytes(), url)
+
+		resolvedETag := resolved.Header().Get("ETag")
+		assert.NotEqual(pointerETag, resolvedETag, url)
+		assert.Contains(resolvedETag, oid, url)
+		assert.Equal(http.StatusNotModified, get(url, resolvedETag).Code, url)
+
+		// If the large file is removed from the store, the pointer is
+		// returned with another ETag, and must be revalidated.
+		assert.Nil(os.Rename(objectPath, objectPath+".moved"))
+
+		missing := get(url, resolvedETag)
+		assert.Equal(http.StatusOK, missing.Code, url)
+		assert.Contains(missing.Body.String(), "oid sha256:"+oid, url)
+		assert.Equal("private, no-cache", missing.Header().Get("Cache-Control"), url)
+
+		missingETag := missing.Header().Get("ETag")
+		assert.NotEqual(resolvedETag, missingETag, url)
+		assert.Equal(http.StatusNotModified, get(url, missingETag).Code, url)
+
+		// Once it is back, the large file is returned again.
+		assert.Nil(os.Rename(objectPath+".moved", objectPath))
+
+		rsp := get(url, missingETag)
+		assert.Equal(http.StatusOK, rsp.Code, url)
+		assert.Equal(content, rsp.Body.Bytes(), url)
+		assert.Equal(resolvedETag, rsp.Header().Get("ETag"), url)
+	}
+}
+
+func TestConditionalRequestsAPI(t *testing.T) {
+	assert := assert.New(t)
+
+	testSetup := setupRoutesTest(t)
+	defer testSetup.cleanup(t)
+
+	handler, err := api.New(testSetup.config)
+	assert.Nil(err)
+
+	token, err := (*handler.GetTokenStore()).New()
+	assert.Nil(err)
+
+	get := func(url, ifNoneMatch string) *httptest.ResponseRecorder {
+		request, err := http.NewRequest("GET", url, nil)
+		assert.Nil(err)
+
+		request.Header.Set(api.PrivateTokenHeader, *token)
+		if ifNoneMatch != "" {
+			request.Header.Set("If-None-Match", ifNoneMatch)
+		}
+
+		rsp := httptest.NewRecorder()
+		handler.ServeHTTP(rsp, request)
+		return rsp
+	}
+
+	commitId := testSetup.branch.Hash().String()
+	fileId := helpers.GetRepositoryFileId(t, testSetup.rawRepo, "README").String()
+
+	testCases := []struct {
+		url          string
+		cacheControl string
+	}{
+		{fmt.Sprintf("/repos/repo/file/%s", fileId), "private, max-age=31536000, immutable"},
+		{fmt.Sprintf("/repos/repo/commits/%s/path/README", commitId), "private, max-age=31536000, immutable"},
+		{fmt.Sprintf("/repos/repo/commits/%s", commitId), "private, no-cache"},
+		{fmt.Sprintf("/repos/repo/commits/%s/languages", commitId), "private, no-cache"},
+		{"/repos/repo/refs/test-branch/path/README", "private, no-cache"},
+	}
+
+	for _, testCase := range testCases {
+		rsp := get(testCase.url, "")
+		assert.Equal(http.StatusOK, rsp.Code, testCase.url)
+		assert.Equal(testCase.cacheControl, rsp.Header().Get("Cache-Control"), testCase.url)
+
+		etag := rsp.Header().Get("ETag")
+		assert.NotEqual("", etag, testCase.url)
+
+		rsp = get(testCase.url, etag)
+		assert.Equal(http.StatusNotModified, rsp.Code, testCase.url)
+		assert.Equal(etag, rsp.Header().Get("ETag"), testCase.url)
+		assert.Equal(0, rsp.Body.Len(), testCase.url)
+
+		rsp = get(testCase.url, fmt.Sprintf(`"other", W/%s`, etag))
+		assert.Equal(http.StatusNotModified, rsp.Code, testCase.url)
+
+		rsp = get(testCase.url, `"other"`)
+		assert.Equal(http.StatusOK, rsp.Code, testCase.url)
+	}
+
+	// Files at a ref and at the commit it points to have the same ETag.
+	assert.Equal(
+		get(fmt.Sprintf("/repos/repo/commits/%s/path/README", commitId), "").Header().Get("ETag"),
+		get("/repos/repo/refs/test-branch/path/README", "").Header().Get("ETag"))
+
+	// Errors are not cached.
+	rsp := get(fmt.Sprintf("/repos/repo/commits/%s/path/does-not-exist", commitId), "")
+	assert.Equal(http.StatusNotFound, rsp.Code)
+	assert.Equal("", rsp.Header().Get("ETag"))
+	assert.Equal("", rsp.Header().Get("Cache-Control"))
+
+	// Content at abbreviated IDs may change, so it has no ETag.
+	rsp = get(fmt.Sprintf("/repos/repo/commits/%s", commitId[:12]), "")
+	assert.Equal("", rsp.Header().Get("ETag"))
+}
+
+func TestBlobRedirectAPI(t *testing.T) {
+	assert := assert.New(t)
+
+	testSetup := setupRoutesTest(t)
+	defer testSetup.cleanup(t)
+
+	cacheDir, err := ioutil.TempDir("", "rb-gateway-blobs-")
+	assert.Nil(err)
+	defer os.RemoveAll(cacheDir)
+
+	testSetup.config.BlobRedirect = config.BlobRedirectConfig{
+		MinSize:  1,
+		CacheDir: cacheDir,
+		TTL:      60,
+		MaxAge:   60,
+	}
+
+	handler, err := api.New(testSetup.config)
+	assert.Nil(err)
+
+	token, err := (*handler.GetTokenStore()).New()
+	assert.Nil(err)
+
+	fileId := helpers.GetRepositoryFileId(t, testSetup.rawRepo, "README").String()
+	urls := []string{
+		fmt.Sprintf("/repos/repo/file/%s", fileId),
+		fmt.Sprintf("/repos/repo/commits/%s/path/README", testSetup.branch.Hash().String()),
+		"/repos/repo/refs/test-branch/path/README",
+	}
+
+	blobPaths := make([]string, len(urls))
+
+	for i, url := range urls {
+		rsp := serveRequest(t, handler, "GET", url, *token, nil)
+		assert.Equal(http.StatusFound, rsp.Code, url)
+
+		location := rsp.Header().Get("Location")
+		assert.True(strings.HasPrefix(location, "/blobs/"), location)
+		blobPaths[i] = strings.SplitN(location, "?", 2)[0]
+
+		// Blob URLs do not require a token.
+		request, err := http.NewRequest("GET", location, nil)
+		assert.Nil(err)
+
+		rsp = httptest.NewRecorder()
+		handler.ServeHTTP(rsp, request)
+		assert.Equal(http.StatusOK, rsp.Code, location)
+		assert.Equal("README\n", rsp.Body.String())
+
+		request, err = http.NewRequest("GET", location+"0", nil)
+		assert.Nil(err)
+
+		rsp = httptest.NewRecorder()
+		handler.ServeHTTP(rsp, request)
+		assert.Equal(http.StatusForbidden, rsp.Code, location)
+	}
+
+	// Blobs are named for the object they hold, so a file at a commit is
+	// stored once however it is requested.
+	assert.NotEqual(blobPaths[0], blobPaths[1])
+	assert.Equal(blobPaths[1], blobPaths[2])
+
+	entries, err := ioutil.ReadDir(cacheDir)
+	assert.Nil(err)
+	assert.Equal(2, len(entries))
+
+	// Blobs that are already stored are not read or stored again.
+	for _, blobPath := range blobPaths {
+		err = ioutil.WriteFile(filepath.Join(cacheDir, strings.TrimPrefix(blobPath, "/blobs/")), []byte("cached\n"), 0600)
+		assert.Nil(err)
+	}
+
+	for i, url := range urls {
+		rsp := serveRequest(t, handler, "GET", url, *token, nil)
+		assert.Equal(http.StatusFound, rsp.Code, url)
+
+		location := rsp.Header().Get("Location")
+		assert.Equal(blobPaths[i], strings.SplitN(location, "?", 2)[0])
+
+		request, err := http.NewRequest("GET", location, nil)
+		assert.Nil(err)
+
+		rsp = httptest.NewRecorder()
+		handler.ServeHTTP(rsp, request)
+		assert.Equal("cached\n", rsp.Body.String(), url)
+	}
+
+	entries, err = ioutil.ReadDir(cacheDir)
+	assert.Nil(err)
+	assert.Equal(2, len(entries))
+
+	// Files smaller than the minimum size are sent directly.
+	testSetup.config.BlobRedirect.MinSize = 1024
+
+	for _, url := range urls {
+		rsp := testRoute(t, testSetup.config, url, "GET", nil)
+		assert.Equal(http.StatusOK, rsp.Code, url)
+		assert.Equal("README\n", rsp.Body.String())
+	}
+
+	// Without a base URL, redirects are relative to the external URL.
+	testSetup.config.BlobRedirect.MinSize = 1
+	testSetup.config.ExternalUrl = "https://gateway.example.com/rb-gateway"
+
+	rsp := testRoute(t, testSetup.config, urls[0], "GET", nil)
+	assert.Equal(http.StatusFound, rsp.Code)
+	assert.True(strings.HasPrefix(rsp.Header().Get("Location"), "https://gateway.example.com/rb-gateway/blobs/"),
+		rsp.Header().Get("Location"))
+}
+
+// An S3-compatible object storage server for tests.
+type fakeObjectStorage struct {
+	lock    sync.Mutex
+	objects map[string][]byte
+	headers map[string]http.Header
+	uploads int
+}
+
+func (s *fakeObjectStorage) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=key-id/") &&
+		r.URL.Query().Get("X-Amz-Signature") == "" {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	switch r.Method {
+	case "HEAD", "GET":
+		content, ok := s.objects[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		for name, values := range s.headers[r.URL.Path] {
+			w.Header()[name] = values
+		}
+		w.Write(content)
+
+	case "PUT":
+		content, _ := ioutil.ReadAll(r.Body)
+		hash := sha256.Sum256(content)
+		if r.Header.Get("X-Amz-Content-Sha256") != hex.EncodeToString(hash[:]) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		s.objects[r.URL.Path] = content
+		s.headers[r.URL.Path] = http.Header{
+			"Content-Type":        r.Header["Content-Type"],
+			"Content-Disposition": r.Header["Content-Disposition"],
+		}
+		s.uploads++
+	}
+}
+
+// Wait for the given number of objects to have been uploaded.
+func (s *fakeObjectStorage) waitForUploads(t *testing.T, count int) {
+	t.Helper()
+
+	for i := 0; i < 500; i++ {
+		s.lock.Lock()
+		uploads := s.uploads
+		s.lock.Unlock()
+
+		if uploads >= count {
+			return
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("Timed out waiting for %d uploads.", count)
+}
+
+func TestObjectStorageAPI(t *testing.T) {
+	assert := assert.New(t)
+
+	testSetup := setupRoutesTest(t)
+	defer testSetup.cleanup(t)
+
+	storage := &fakeObjectStorage{
+		objects: make(map[string][]byte),
+		headers: make(map[string]http.Header),
+	}
+	server := httptest.NewServer(storage)
+	defer server.Close()
+
+	cacheDir, err := ioutil.TempDir("", "rb-gateway-blobs-")
+	assert.Nil(err)
+	defer os.RemoveAll(cacheDir)
+
+	testSetup.config.BlobRedirect = config.BlobRedirectConfig{
+		MinSize:  1,
+		CacheDir: cacheDir,
+		TTL:      60,
+		MaxAge:   60,
+	}
+	testSetup.config.ObjectStorage = config.ObjectStorageConfig{
+		Endpoint:        server.URL,
+		Region:          "us-east-1",
+		Bucket:          "bucket",
+		Prefix:          "rb-gateway/",
+		AccessKeyId:     "key-id",
+		SecretAccessKey: "secret",
+		PathStyle:       true,
+		Archives:        true,
+		UrlTTL:          60,
+	}
+
+	handler, err := api.New(testSetup.config)
+	assert.Nil(err)
+
+	token, err := (*handler.GetTokenStore()).New()
+	assert.Nil(err)
+
+	commitId := testSetup.branch.Hash().String()
+	archivePath := fmt.Sprintf("/bucket/rb-gateway/archives/repo/%s.zip", commitId)
+
+	url := fmt.Sprintf("/repos/repo/commits/%s/archive?format=zip", commitId)
+
+	// Archives are sent directly while they are uploaded in the background.
+	rsp := serveRequest(t, handler, "GET", url, *token, nil)
+	assert.Equal(http.StatusOK, rsp.Code)
+	assert.Equal("application/zip", rsp.Header().Get("Content-Type"))
+
+	storage.waitForUploads(t, 1)
+
+	// Once uploaded, archives are redirected to and not uploaded again.
+	for i := 0; i < 2; i++ {
+		rsp := serveRequest(t, handler, "GET", url, *token, nil)
+		assert.Equal(http.StatusFound, rsp.Code)
+
+		location := rsp.Header().Get("Location")
+		assert.True(strings.HasPrefix(location, server.URL+archivePath+"?"), location)
+		assert.Contains(location, "X-Amz-Expires=60")
+
+		download, err := http.Get(location)
+		if assert.Nil(err) {
+			content, err := ioutil.ReadAll(download.Body)
+			download.Body.Close()
+			assert.Nil(err)
+
+			assert.Equal(http.StatusOK, download.StatusCode)
+			assert.Equal("application/zip", download.Header.Get("Content-Type"))
+			assert.Contains(download.Header.Get("Content-Disposition"), ".zip")
+
+			_, err = zip.NewReader(bytes.NewReader(content), int64(len(content)))
+			assert.Nil(err)
+		}
+	}
+
+	assert.Equal(1, storage.uploads)
+
+	// Blobs are served from the cache directory while they are uploaded in
+	// the background.
+	fileId := helpers.GetRepositoryFileId(t, testSetup.rawRepo, "README").String()
+	rsp = serveRequest(t, handler, "GET", fmt.Sprintf("/repos/repo/file/%s", fileId), *token, nil)
+	assert.Equal(http.StatusFound, rsp.Code)
+	assert.True(strings.HasPrefix(rsp.Header().Get("Location"), "/blobs/"), rsp.Header().Get("Location"))
+
+	storage.waitForUploads(t, 2)
+
+	hash := sha256.Sum256([]byte("file\x00git\x00" + fileId))
+	blobPath := fmt.Sprintf("/bucket/rb-gateway/blobs/%s", hex.EncodeToString(hash[:]))
+	assert.Equal("README\n", string(storage.objects[blobPath]))
+
+	// Once uploaded, blobs are redirected to and not uploaded again.
+	rsp = serveRequest(t, handler, "GET", fmt.Sprintf("/repos/repo/file/%s", fileId), *token, nil)
+	assert.Equal(http.StatusFound, rsp.Code)
+	assert.True(strings.HasPrefix(rsp.Header().Get("Location"), server.URL+blobPath+"?"))
+	assert.Equal(2, storage.uploads)
+}
+
+// A response writer that blocks writing the body until it is released.
+type blockingResponseWriter struct {
+	*httptest.ResponseRecorder
+	writing chan struct{}
+	release chan struct{}
+}
 
+// Write the given content once the writer is released.
+func (b *blockingResponseWriter) Write(content []byte) (int, error) {
+	close(b.writing)
+	<-b.release
+	return b.ResponseRecorder.Write(content)
 }
 
-func TestGetSessionAPI(t *testing.T) {
+func TestMemoryBudgetAPI(t *testing.T) {
 	assert := assert.New(t)
 
 	testSetup := setupRoutesTest(t)
 	defer testSetup.cleanup(t)
 
-	request, err := http.NewRequest("GET", "/session", nil)
-	assert.Nil(err)
-
-	request.SetBasicAuth("username", "password")
+	testSetup.config.MemoryBudget = 1
 
-	response := httptest.NewRecorder()
 	handler, err := api.New(testSetup.config)
 	assert.Nil(err)
 
-	handler.ServeHTTP(response, request)
+	token, err := (*handler.GetTokenStore()).New()
+	assert.Nil(err)
 
-	var session api.Session
+	url := "/repos/repo/refs/test-branch/path/README"
 
-	assert.Nil(json.Unmarshal(response.Body.Bytes(), &session))
+	// The first file is sent even though it is larger than the budget.
+	blocked := &blockingResponseWriter{
+		ResponseRecorder: httptest.NewRecorder(),
+		writing:          make(chan struct{}),
+		release:          make(chan struct{}),
+	}
 
-	assert.Equal(len(session.PrivateToken), tokens.TokenSize,
-		"Private token is not provided in the response")
-}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
 
-func TestGetHooksAPI(t *testing.T) {
-	assert := assert.New(t)
+		request, err := http.NewRequest("GET", url, nil)
+		assert.Nil(err)
+		request.Header.Set(api.PrivateTokenHeader, *token)
 
-	testSetup := setupRoutesTest(t)
-	defer testSetup.cleanup(t)
+		handler.ServeHTTP(blocked, request)
+	}()
 
-	rsp := testRoute(t, testSetup.config, "/webhooks", "GET", nil)
+	<-blocked.writing
+
+	// While it is being sent, the budget is exhausted.
+	rsp := serveRequest(t, handler, "GET", url, *token, nil)
+	assert.Equal(http.StatusServiceUnavailable, rsp.Code)
+	assert.Equal("1", rsp.Header().Get("Retry-After"))
+
+	rsp = serveRequest(t, handler, "GET", fmt.Sprintf("/repos/repo/commits/%s", testSetup.branch.Hash().String()), *token, nil)
+	assert.Equal(http.StatusServiceUnavailable, rsp.Code)
+
+	rsp = serveRequest(t, handler, "GET", fmt.Sprintf("/repos/repo/commits/%s/archive", testSetup.branch.Hash().String()), *token, nil)
+	assert.Equal(http.StatusServiceUnavailable, rsp.Code)
+
+	// Other routes are not affected.
+	rsp = serveRequest(t, handler, "GET", "/repos/repo/branches", *token, nil)
 	assert.Equal(http.StatusOK, rsp.Code)
 
-	var parsedRsp struct {
-		Webhooks []hooks.Webhook `json:"webhooks"`
-	}
+	close(blocked.release)
+	<-done
+	assert.Equal(http.StatusOK, blocked.Code)
 
-	assert.Nil(json.Unmarshal(rsp.Body.Bytes(), &parsedRsp))
+	// Once it has been sent, the memory is released.
+	rsp = serveRequest(t, handler, "GET", url, *token, nil)
+	assert.Equal(http.StatusOK, rsp.Code)
 
-	parsedWebhooks := make(hooks.WebhookStore)
-	for hookId := range parsedRsp.Webhooks {
-		hook := &parsedRsp.Webhooks[hookId]
-		parsedWebhooks[hook.Id] = hook
+	// A file is refused if reserving it would exceed the budget, even when
+	// the memory in use is under the budget.
+	testSetup.config.MemoryBudget = int64(rsp.Body.Len()) + 1
+
+	handler, err = api.New(testSetup.config)
+	assert.Nil(err)
+
+	token, err = (*handler.GetTokenStore()).New()
+	assert.Nil(err)
+
+	blocked = &blockingResponseWriter{
+		ResponseRecorder: httptest.NewRecorder(),
+		writing:          make(chan struct{}),
+		release:          make(chan struct{}),
 	}
 
-	assert.Equal(testSetup.hooks, parsedWebhooks)
+	done = make(chan struct{})
+	go func() {
+		defer close(done)
+
+		request, err := http.NewRequest("GET", url, nil)
+		assert.Nil(err)
+		request.Header.Set(api.PrivateTokenHeader, *token)
+
+		handler.ServeHTTP(blocked, request)
+	}()
+
+	<-blocked.writing
+
+	rsp = serveRequest(t, handler, "GET", url, *token, nil)
+	assert.Equal(http.StatusServiceUnavailable, rsp.Code)
+	assert.Equal("1", rsp.Header().Get("Retry-After"))
+
+	close(blocked.release)
+	<-done
+	assert.Equal(http.StatusOK, blocked.Code)
 }
 
 func TestGetHookAPI(t *testing.T) {
@@ -325,7 +2620,55 @@ func TestGetHookAPI(t *testing.T) {
 	fmt.Println(string(rsp.Body.Bytes()))
 
 	assert.Nil(json.Unmarshal(rsp.Body.Bytes(), &parsedHook))
-	assert.Equal(*testSetup.hooks["test-hook-1"], parsedHook)
+	assert.Equal(withoutSecrets(*testSetup.hooks["test-hook-1"]), parsedHook)
+}
+
+func TestGetHookAPIDeliveryStatus(t *testing.T) {
+	assert := assert.New(t)
+
+	testSetup := setupRoutesTest(t)
+	defer testSetup.cleanup(t)
+
+	statusDir, err := ioutil.TempDir("", "rb-gateway-status-")
+	assert.Nil(err)
+	defer os.RemoveAll(statusDir)
+
+	testSetup.config.WebhookStatusPath = statusDir
+	statusStore := hooks.DeliveryStatusStore{Dir: statusDir}
+
+	var parsedRsp struct {
+		DeliveryStatus hooks.HookStatus `json:"delivery_status"`
+	}
+
+	// A hook that has never been delivered.
+	rsp := testRoute(t, testSetup.config, "/webhooks/test-hook-1", "GET", nil)
+	assert.Equal(http.StatusOK, rsp.Code)
+	assert.Nil(json.Unmarshal(rsp.Body.Bytes(), &parsedRsp))
+	assert.Nil(parsedRsp.DeliveryStatus.LastDelivery)
+	assert.Nil(parsedRsp.DeliveryStatus.LastError)
+
+	failure := hooks.DeliveryStatus{
+		Time:       time.Now().UTC().Truncate(time.Second),
+		Event:      events.PushEvent,
+		Repository: "repo",
+		Reason:     hooks.DeliveryReasonHTTPStatus,
+		StatusCode: http.StatusBadGateway,
+		Error:      "Expected status 2XX, received 502 Bad Gateway.",
+	}
+	assert.Nil(statusStore.Record("test-hook-1", failure))
+
+	success := failure
+	success.Success = true
+	success.Reason = hooks.DeliveryReasonNone
+	success.StatusCode = 0
+	success.Error = ""
+	assert.Nil(statusStore.Record("test-hook-1", success))
+
+	rsp = testRoute(t, testSetup.config, "/webhooks/test-hook-1", "GET", nil)
+	assert.Equal(http.StatusOK, rsp.Code)
+	assert.Nil(json.Unmarshal(rsp.Body.Bytes(), &parsedRsp))
+	assert.Equal(&success, parsedRsp.DeliveryStatus.LastDelivery)
+	assert.Equal(&failure, parsedRsp.DeliveryStatus.LastError)
 }
 
 func TestDeleteGetHookAPI(t *testing.T) {
@@ -348,7 +2691,30 @@ func TestDeleteGetHookAPI(t *testing.T) {
 
 	assert.Nil(json.Unmarshal(rsp.Body.Bytes(), &parsedRsp))
 	assert.Equal(1, len(parsedRsp.Webhooks))
-	assert.Equal(*testSetup.hooks["test-hook-2"], parsedRsp.Webhooks[0])
+	assert.Equal(withoutSecrets(*testSetup.hooks["test-hook-2"]), parsedRsp.Webhooks[0])
+}
+
+func TestDeleteHookAPIUnknown(t *testing.T) {
+	assert := assert.New(t)
+
+	testSetup := setupRoutesTest(t)
+	defer testSetup.cleanup(t)
+
+	// The store must not be rewritten, so its modification time is kept.
+	modTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	assert.Nil(os.Chtimes(testSetup.config.WebhookStorePath, modTime, modTime))
+
+	rsp := testRoute(t, testSetup.config, "/webhooks/unknown-hook", "DELETE", nil)
+	assert.Equal(http.StatusNotFound, rsp.Code)
+	assert.Equal("No such webhook\n", rsp.Body.String())
+
+	info, err := os.Stat(testSetup.config.WebhookStorePath)
+	assert.Nil(err)
+	assert.True(modTime.Equal(info.ModTime()))
+
+	store, err := hooks.LoadStore(testSetup.config.WebhookStorePath, testSetup.config.RepositorySet())
+	assert.Nil(err)
+	assert.Equal(2, len(store))
 }
 
 func TestCreateHookAPI(t *testing.T) {
@@ -380,7 +2746,183 @@ func TestCreateHookAPI(t *testing.T) {
 	var parsedHook hooks.Webhook
 	assert.Nil(json.Unmarshal(rsp.Body.Bytes(), &parsedHook))
 
-	assert.Equal(hook, parsedHook)
+	assert.Equal(withoutSecrets(hook), parsedHook)
+
+	store, err := hooks.LoadStore(testSetup.config.WebhookStorePath, testSetup.config.RepositorySet())
+	assert.Nil(err)
+	assert.Equal(hook, *store["test-hook-3"])
+}
+
+func TestCreateHookAPIDefaultSecret(t *testing.T) {
+	assert := assert.New(t)
+
+	testSetup := setupRoutesTest(t)
+	defer testSetup.cleanup(t)
+
+	testSetup.config.WebhookSecret = strings.Repeat("d", 20)
+
+	hook := hooks.Webhook{
+		Id:      "test-hook-3",
+		Url:     "http://example.com/3/",
+		Enabled: true,
+		Events:  []string{events.PushEvent},
+		Repos:   []string{testSetup.repo.Name},
+	}
+
+	body, err := json.Marshal(hook)
+	assert.Nil(err)
+
+	assert.Equal(
+		http.StatusCreated,
+		testRoute(t, testSetup.config, "/webhooks", "POST", body).Code,
+	)
+
+	// The hook uses the default secret rather than a copy of it.
+	store, err := hooks.LoadStore(testSetup.config.WebhookStorePath, testSetup.config.RepositorySet())
+	assert.Nil(err)
+	assert.Equal("", store["test-hook-3"].Secret)
+}
+
+func TestRotateHookSecretAPI(t *testing.T) {
+	assert := assert.New(t)
+
+	testSetup := setupRoutesTest(t)
+	defer testSetup.cleanup(t)
+
+	testSetup.config.WebhookSecretGracePeriod = 60 * 60
+	oldSecret := testSetup.hooks["test-hook-1"].Secret
+
+	before := time.Now()
+	rsp := testRoute(t, testSetup.config, "/webhooks/test-hook-1/rotate-secret", "POST", nil)
+	assert.Equal(http.StatusOK, rsp.Code)
+
+	var rotatedHook hooks.Webhook
+	assert.Nil(json.Unmarshal(rsp.Body.Bytes(), &rotatedHook))
+	assert.Equal(64, len(rotatedHook.Secret))
+	assert.NotEqual(oldSecret, rotatedHook.Secret)
+	assert.Equal("", rotatedHook.PreviousSecret)
+	if assert.NotNil(rotatedHook.PreviousSecretExpires) {
+		assert.WithinDuration(before.Add(time.Hour), *rotatedHook.PreviousSecretExpires, 5*time.Second)
+	}
+
+	// The rotated secret is saved.
+	store, err := hooks.LoadStore(testSetup.config.WebhookStorePath, testSetup.config.RepositorySet())
+	assert.Nil(err)
+	assert.Equal(rotatedHook.Secret, store["test-hook-1"].Secret)
+	assert.Equal(oldSecret, store["test-hook-1"].PreviousSecret)
+
+	// Secrets are never read back.
+	for _, url := range []string{"/webhooks/test-hook-1", "/webhooks"} {
+		rsp = testRoute(t, testSetup.config, url, "GET", nil)
+		assert.Equal(http.StatusOK, rsp.Code)
+		assert.NotContains(rsp.Body.String(), `"secret"`)
+		assert.NotContains(rsp.Body.String(), `"previousSecret"`)
+		assert.NotContains(rsp.Body.String(), rotatedHook.Secret)
+	}
+
+	// The secret cannot be rotated again during the grace period, since
+	// receivers may still be using the original secret.
+	rsp = testRoute(t, testSetup.config, "/webhooks/test-hook-1/rotate-secret", "POST", nil)
+	assert.Equal(http.StatusConflict, rsp.Code)
+
+	store, err = hooks.LoadStore(testSetup.config.WebhookStorePath, testSetup.config.RepositorySet())
+	assert.Nil(err)
+	assert.Equal(rotatedHook.Secret, store["test-hook-1"].Secret)
+	assert.Equal(oldSecret, store["test-hook-1"].PreviousSecret)
+
+	// Setting the secret ends the rotation.
+	rsp = testRoute(t, testSetup.config, "/webhooks/test-hook-1", "PATCH",
+		[]byte(fmt.Sprintf(`{"secret": "%s"}`, strings.Repeat("e", 20))))
+	assert.Equal(http.StatusOK, rsp.Code)
+
+	var updatedHook hooks.Webhook
+	assert.Nil(json.Unmarshal(rsp.Body.Bytes(), &updatedHook))
+	assert.Equal("", updatedHook.Secret)
+	assert.Nil(updatedHook.PreviousSecretExpires)
+
+	store, err = hooks.LoadStore(testSetup.config.WebhookStorePath, testSetup.config.RepositorySet())
+	assert.Nil(err)
+	assert.Equal(strings.Repeat("e", 20), store["test-hook-1"].Secret)
+	assert.Equal("", store["test-hook-1"].PreviousSecret)
+
+	// Once the rotation has ended, the secret can be rotated again.
+	rsp = testRoute(t, testSetup.config, "/webhooks/test-hook-1/rotate-secret", "POST", nil)
+	assert.Equal(http.StatusOK, rsp.Code)
+
+	assert.Equal(
+		http.StatusNotFound,
+		testRoute(t, testSetup.config, "/webhooks/bad-hook/rotate-secret", "POST", nil).Code,
+	)
+}
+
+func TestEncryptedHookSecretsAPI(t *testing.T) {
+	assert := assert.New(t)
+
+	testSetup := setupRoutesTest(t)
+	defer testSetup.cleanup(t)
+
+	keyDir, err := ioutil.TempDir("", "rb-gateway-secrets-")
+	assert.Nil(err)
+	defer os.RemoveAll(keyDir)
+
+	keyPath := filepath.Join(keyDir, "secrets.key")
+	assert.Nil(hooks.GenerateSecretsKey(keyPath))
+
+	testSetup.config.SecretsKey, err = hooks.LoadSecretsKey(keyPath)
+	assert.Nil(err)
+
+	secret := strings.Repeat("s", 20)
+	body, err := json.Marshal(map[string]interface{}{
+		"id":        "encrypted-hook",
+		"url":       "http://example.com/encrypted/",
+		"secret":    secret,
+		"enabled":   true,
+		"events":    []string{events.PushEvent},
+		"repos":     []string{"repo"},
+		"headers":   map[string]string{"X-Proxy-Token": "proxy-token"},
+		"basicAuth": map[string]string{"username": "user", "password": "password"},
+	})
+	assert.Nil(err)
+
+	rsp := testRoute(t, testSetup.config, "/webhooks", "POST", body)
+	assert.Equal(http.StatusCreated, rsp.Code)
+
+	// Secrets are only stored encrypted.
+	store, err := hooks.LoadStore(testSetup.config.WebhookStorePath, testSetup.config.RepositorySet())
+	assert.Nil(err)
+	assert.True(hooks.IsEncryptedSecret(store["encrypted-hook"].Secret))
+	assert.True(hooks.IsEncryptedSecret(store["encrypted-hook"].Headers["X-Proxy-Token"]))
+	assert.True(hooks.IsEncryptedSecret(store["encrypted-hook"].BasicAuth.Password))
+	assert.Equal("user", store["encrypted-hook"].BasicAuth.Username)
+
+	decrypted, err := store["encrypted-hook"].DecryptSecrets(testSetup.config.SecretsKey)
+	assert.Nil(err)
+	assert.Equal(secret, decrypted.Secret)
+	assert.Equal("proxy-token", decrypted.Headers["X-Proxy-Token"])
+	assert.Equal("password", decrypted.BasicAuth.Password)
+
+	// Decrypting does not change the stored hook.
+	assert.True(hooks.IsEncryptedSecret(store["encrypted-hook"].Headers["X-Proxy-Token"]))
+	assert.True(hooks.IsEncryptedSecret(store["encrypted-hook"].BasicAuth.Password))
+
+	// Rotating returns the new secret in plaintext, but stores both secrets
+	// encrypted.
+	rsp = testRoute(t, testSetup.config, "/webhooks/encrypted-hook/rotate-secret", "POST", nil)
+	assert.Equal(http.StatusOK, rsp.Code)
+
+	var rotatedHook hooks.Webhook
+	assert.Nil(json.Unmarshal(rsp.Body.Bytes(), &rotatedHook))
+	assert.False(hooks.IsEncryptedSecret(rotatedHook.Secret))
+
+	store, err = hooks.LoadStore(testSetup.config.WebhookStorePath, testSetup.config.RepositorySet())
+	assert.Nil(err)
+	assert.True(hooks.IsEncryptedSecret(store["encrypted-hook"].Secret))
+	assert.True(hooks.IsEncryptedSecret(store["encrypted-hook"].PreviousSecret))
+
+	decrypted, err = store["encrypted-hook"].DecryptSecrets(testSetup.config.SecretsKey)
+	assert.Nil(err)
+	assert.Equal(rotatedHook.Secret, decrypted.Secret)
+	assert.Equal(secret, decrypted.PreviousSecret)
 }
 
 func TestCreateHookAPIValidate(t *testing.T) {
@@ -463,6 +3005,51 @@ func TestCreateHookAPIValidate(t *testing.T) {
 			},
 			errorMsg: "Secret is too short (1 bytes); secrets must be at least 20 bytes.\n",
 		},
+		{
+			hook: hooks.Webhook{
+				Id:      "test-hook-3",
+				Url:     "http://example.com",
+				Enabled: true,
+				Events:  []string{events.PushEvent},
+				Repos:   []string{"repo"},
+			},
+			errorMsg: "Hook has no secret, and repository \"repo\" has no default secret.\n",
+		},
+		{
+			hook: hooks.Webhook{
+				Id:      "test-hook-3",
+				Url:     "http://example.com",
+				Enabled: true,
+				Events:  []string{events.PrePushEvent},
+				Repos:   []string{"repo"},
+				Type:    hooks.TypeSlack,
+			},
+			errorMsg: "Slack hooks do not support the \"pre-push\" event.\n",
+		},
+		{
+			hook: hooks.Webhook{
+				Id:      "test-hook-3",
+				Url:     "http://example.com",
+				Secret:  strings.Repeat("a", 20),
+				Enabled: true,
+				Events:  []string{events.RepositoryStatusEvent},
+				Repos:   []string{"repo"},
+				Format:  hooks.FormatGitHub,
+			},
+			errorMsg: "The GitHub format does not support the \"repository-status\" event.\n",
+		},
+		{
+			hook: hooks.Webhook{
+				Id:      "test-hook-3",
+				Url:     "http://example.com",
+				Secret:  strings.Repeat("a", 20),
+				Enabled: true,
+				Events:  []string{events.PushEvent},
+				Repos:   []string{"repo"},
+				Type:    "irc",
+			},
+			errorMsg: "Invalid type: \"irc\".\n",
+		},
 	}
 
 	for _, testCase := range testCases {
@@ -573,6 +3160,83 @@ func TestUpdateHook(t *testing.T) {
 			statusCode: 400,
 			errorMsg:   "Hook has no repositories.\n",
 		},
+		{
+			body: map[string]interface{}{
+				"branches": []string{"regex:("},
+			},
+			statusCode: 400,
+			errorMsg:   "Invalid branch pattern \"regex:(\": error parsing regexp: missing closing ): `(`\n",
+		},
+		{
+			body: map[string]interface{}{
+				"headers": map[string]string{"X-RBG-Event": "fake"},
+			},
+			statusCode: 400,
+			errorMsg:   "Header \"X-RBG-Event\" cannot be overridden.\n",
+		},
+		{
+			body: map[string]interface{}{
+				"headers":   map[string]string{"X-Proxy-Token": "token"},
+				"basicAuth": map[string]string{"username": "user", "password": "pass"},
+			},
+			statusCode: 200,
+			expected: &hooks.Webhook{
+				Id:        hook.Id,
+				Url:       "https://example.com/some-path/?foo",
+				Secret:    strings.Repeat("b", 20),
+				Enabled:   false,
+				Events:    hook.Events,
+				Repos:     hook.Repos,
+				Headers:   map[string]string{"X-Proxy-Token": "token"},
+				BasicAuth: &hooks.WebhookBasicAuth{Username: "user", Password: "pass"},
+			},
+		},
+		{
+			body: map[string]interface{}{
+				"headers": map[string]string{"Authorization": "Bearer token"},
+			},
+			statusCode: 400,
+			errorMsg:   "An Authorization header cannot be used with basic authentication.\n",
+		},
+		{
+			body: map[string]interface{}{
+				"headers":   map[string]string{"Authorization": "Bearer token"},
+				"basicAuth": map[string]string{"username": ""},
+			},
+			statusCode: 200,
+			expected: &hooks.Webhook{
+				Id:      hook.Id,
+				Url:     "https://example.com/some-path/?foo",
+				Secret:  strings.Repeat("b", 20),
+				Enabled: false,
+				Events:  hook.Events,
+				Repos:   hook.Repos,
+				Headers: map[string]string{"Authorization": "Bearer token"},
+			},
+		},
+		{
+			body: map[string]interface{}{
+				"timeout": -1,
+			},
+			statusCode: 400,
+			errorMsg:   "Invalid timeout: -1.\n",
+		},
+		{
+			body: map[string]interface{}{
+				"timeout": 5,
+			},
+			statusCode: 200,
+			expected: &hooks.Webhook{
+				Id:      hook.Id,
+				Url:     "https://example.com/some-path/?foo",
+				Secret:  strings.Repeat("b", 20),
+				Enabled: false,
+				Events:  hook.Events,
+				Repos:   hook.Repos,
+				Headers: map[string]string{"Authorization": "Bearer token"},
+				Timeout: 5,
+			},
+		},
 	}
 
 	for _, testCase := range testCases {
@@ -591,7 +3255,11 @@ func TestUpdateHook(t *testing.T) {
 
 			var parsedHook hooks.Webhook
 			assert.Nil(json.Unmarshal(body, &parsedHook))
-			assert.Equal(*testCase.expected, parsedHook)
+			assert.Equal(withoutSecrets(*testCase.expected), parsedHook)
+
+			store, err := hooks.LoadStore(testSetup.config.WebhookStorePath, testSetup.config.RepositorySet())
+			assert.Nil(err)
+			assert.Equal(*testCase.expected, *store["test-hook-1"])
 		}
 	}
 }
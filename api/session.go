@@ -1,8 +1,86 @@
 package api
 
-// Represents a Session. Currently only holds the private_token, used for
-// authentication. This can be extended in the future to store more session
-// information such as time created, user email, etc.
+import (
+	"time"
+
+	"github.com/reviewboard/rb-gateway/api/tokens"
+)
+
+// The default lifetime of a delegated token.
+const defaultDelegatedTokenTTL = 15 * time.Minute
+
+// The maximum lifetime of a token created with a session request, in seconds.
+//
+// Larger lifetimes would overflow the token's expiry. Tokens that should not
+// expire are created without a lifetime.
+const maxSessionTTL = 10 * 365 * 24 * 60 * 60
+
+// Represents a Session. The private_token is used for authentication, and the
+// remaining fields describe what the token may be used for.
 type Session struct {
 	PrivateToken string `json:"private_token"`
+
+	// When the token was created, if known.
+	Created *time.Time `json:"created,omitempty"`
+
+	// When the token expires, if ever.
+	Expires *time.Time `json:"expires,omitempty"`
+
+	// The repositories the token is restricted to, if any.
+	Repositories []string `json:"repositories,omitempty"`
+
+	// Whether or not the token is limited to reading.
+	ReadOnly bool `json:"read_only"`
+
+	// The user the token was created for, if known.
+	User string `json:"user,omitempty"`
+
+	// The role of the token, if any.
+	Role string `json:"role,omitempty"`
+}
+
+// Return a new Session for a token.
+func newSession(token string, info *tokens.Info) Session {
+	session := Session{
+		PrivateToken: token,
+		Repositories: info.Repositories,
+		ReadOnly:     info.ReadOnly,
+		User:         info.User,
+		Role:         info.Role,
+	}
+
+	if !info.Created.IsZero() {
+		created := info.Created
+		session.Created = &created
+	}
+
+	if !info.Expires.IsZero() {
+		expires := info.Expires
+		session.Expires = &expires
+	}
+
+	return session
+}
+
+// The optional body of a request to create a session.
+type sessionRequest struct {
+	// How long the token is valid for, in seconds. If zero, the token never
+	// expires.
+	TTL int64 `json:"ttl"`
+
+	// The repositories to restrict the token to, if any.
+	Repositories []string `json:"repositories"`
+
+	// Whether or not to limit the token to reading.
+	ReadOnly bool `json:"read_only"`
+}
+
+// The body of a request to delegate a session.
+type delegateRequest struct {
+	// The repository to restrict the token to.
+	Repository string `json:"repository"`
+
+	// How long the token is valid for, in seconds. If zero, the default is
+	// used.
+	TTL int64 `json:"ttl"`
 }
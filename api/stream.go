@@ -0,0 +1,112 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var (
+	errUnsatisfiableRange = errors.New("Requested range not satisfiable.")
+)
+
+// Stream the contents of a reader to the client.
+//
+// If `size` is known (i.e., non-negative), the `Content-Length` header will
+// be set and a single byte range requested by the `Range` header will be
+// honoured. Requests for multiple ranges are served the full content, which
+// is permitted by RFC 7233.
+func writeStream(w http.ResponseWriter, r *http.Request, reader io.Reader, size int64) {
+	if size < 0 {
+		io.Copy(w, reader)
+		return
+	}
+
+	w.Header().Set("Accept-Ranges", "bytes")
+
+	start, length, err := parseRange(r.Header.Get("Range"), size)
+	if err != nil {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		http.Error(w, err.Error(), http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+
+	if length == size {
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+		w.WriteHeader(http.StatusOK)
+		io.Copy(w, reader)
+		return
+	}
+
+	// The underlying readers are not seekable, so skip ahead by discarding.
+	if _, err = io.CopyN(ioutil.Discard, reader, start); err != nil {
+		http.Error(w, "An unexpected error occurred.", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, start+length-1, size))
+	w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+	w.WriteHeader(http.StatusPartialContent)
+	io.CopyN(w, reader, length)
+}
+
+// Parse a `Range` header into a start offset and length.
+//
+// If the header is empty, malformed, or requests multiple ranges, the entire
+// content is selected.
+func parseRange(header string, size int64) (start, length int64, err error) {
+	start, length = 0, size
+
+	const prefix = "bytes="
+	if !strings.HasPrefix(header, prefix) || strings.Contains(header, ",") {
+		return
+	}
+
+	spec := strings.TrimSpace(strings.TrimPrefix(header, prefix))
+	dash := strings.Index(spec, "-")
+	if dash == -1 {
+		return
+	}
+
+	rawStart, rawEnd := spec[:dash], spec[dash+1:]
+
+	if rawStart == "" {
+		// A suffix range, e.g., `bytes=-500` for the last 500 bytes.
+		suffix, parseErr := strconv.ParseInt(rawEnd, 10, 64)
+		if parseErr != nil {
+			return
+		} else if suffix <= 0 {
+			err = errUnsatisfiableRange
+			return
+		}
+
+		if suffix > size {
+			suffix = size
+		}
+
+		return size - suffix, suffix, nil
+	}
+
+	first, parseErr := strconv.ParseInt(rawStart, 10, 64)
+	if parseErr != nil {
+		return
+	} else if first >= size {
+		err = errUnsatisfiableRange
+		return
+	}
+
+	last := size - 1
+	if rawEnd != "" {
+		if last, parseErr = strconv.ParseInt(rawEnd, 10, 64); parseErr != nil || last < first {
+			return 0, size, nil
+		} else if last >= size {
+			last = size - 1
+		}
+	}
+
+	return first, last - first + 1, nil
+}
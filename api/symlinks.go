@@ -0,0 +1,53 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/reviewboard/rb-gateway/repositories"
+)
+
+const (
+	// The header containing the mode of a file (e.g., `100644`).
+	fileModeHeader = "X-RBG-File-Mode"
+
+	// The header containing the type of a file (e.g., `symlink`).
+	fileTypeHeader = "X-RBG-File-Type"
+
+	// The header containing the path of the file that a symlink resolved to.
+	filePathHeader = "X-RBG-File-Path"
+)
+
+// Return the path and mode of a file at a commit.
+//
+// If symlinks are followed, the path and mode of the file that the path
+// resolves to are returned instead.
+func resolveFileMode(repo repositories.Repository, commitId, path string, followSymlinks bool) (string, repositories.FileMode, error) {
+	if followSymlinks {
+		return repositories.ResolveSymlinks(repo, commitId, path)
+	}
+
+	mode, err := repo.GetFileModeByCommit(commitId, path)
+	return path, mode, err
+}
+
+// Return the ETag for a file at a commit.
+//
+// The contents of a followed symlink differ from the symlink's own, so they
+// have a different ETag.
+func symlinkFileETag(commitId, path string, followSymlinks bool) string {
+	if followSymlinks {
+		return fileETag(commitId, path+"\x00follow_symlinks")
+	}
+
+	return fileETag(commitId, path)
+}
+
+// Set the headers describing the mode of a file.
+func setFileModeHeaders(w http.ResponseWriter, path string, mode repositories.FileMode, followSymlinks bool) {
+	w.Header().Set(fileModeHeader, mode.String())
+	w.Header().Set(fileTypeHeader, mode.Type())
+
+	if followSymlinks {
+		w.Header().Set(filePathHeader, path)
+	}
+}
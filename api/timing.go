@@ -0,0 +1,488 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/reviewboard/rb-gateway/config"
+	"github.com/reviewboard/rb-gateway/repositories"
+)
+
+const (
+	// The header that reports how long the server took to process a request.
+	ServerTimingHeader = "Server-Timing"
+
+	// The route that requests are counted under if they match no route.
+	unmatchedRoute = "(unmatched)"
+)
+
+// The operations performed while handling a request and how long they took.
+//
+// A timing is provided through the request context as `"timing"`.
+type requestTiming struct {
+	lock       sync.Mutex
+	start      time.Time
+	route      string
+	repository string
+	operations []operationTiming
+}
+
+// A repository operation performed while handling a request.
+type operationTiming struct {
+	name     string
+	duration time.Duration
+}
+
+// Record that an operation started at `start` has finished.
+func (t *requestTiming) record(name string, start time.Time) {
+	duration := time.Since(start)
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.operations = append(t.operations, operationTiming{name, duration})
+}
+
+// Return the route and repository of the request.
+//
+// The route is the method and path template of the route that handled the
+// request (e.g., `GET /repos/{repo:.+}/branches`), as used in the metrics. The
+// repository is the name from the request's path, if it has one.
+func (t *requestTiming) target() (string, string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return t.route, t.repository
+}
+
+// Return the timing for the request, or nil if it is not being timed.
+func requestTimingFrom(r *http.Request) *requestTiming {
+	timing, _ := r.Context().Value("timing").(*requestTiming)
+	return timing
+}
+
+// Latency statistics for a route or repository operation.
+type LatencyMetrics struct {
+	// The number of requests or operations.
+	Count int64 `json:"count"`
+
+	// The total time spent, in milliseconds.
+	TotalTime float64 `json:"total_ms"`
+
+	// The longest time spent on a single request or operation, in
+	// milliseconds.
+	MaxTime float64 `json:"max_ms"`
+}
+
+// Add a request or operation to the statistics.
+func (m *LatencyMetrics) add(duration time.Duration) {
+	ms := float64(duration) / float64(time.Millisecond)
+
+	m.Count++
+	m.TotalTime += ms
+	if ms > m.MaxTime {
+		m.MaxTime = ms
+	}
+}
+
+// Latency statistics for a route.
+type RouteMetrics struct {
+	LatencyMetrics
+
+	// The number of requests that exceeded `slowRequestThreshold`.
+	SlowCount int64 `json:"slow_count"`
+}
+
+// A snapshot of the server's request processing times.
+type Metrics struct {
+	// Statistics for each route, keyed by method and path template (e.g.,
+	// `GET /repos/{repo:.+}/branches`).
+	Routes map[string]*RouteMetrics `json:"routes"`
+
+	// Statistics for each repository operation, keyed by the name of the
+	// operation (e.g., `GetBranches`).
+	Operations map[string]*LatencyMetrics `json:"repository_operations"`
+
+	// Statistics for the auth callout, if it is configured.
+	AuthCallout *AuthCalloutMetrics `json:"auth_callout,omitempty"`
+}
+
+// The request processing times since the server started.
+//
+// These are kept across configuration reloads.
+type requestMetrics struct {
+	lock       sync.Mutex
+	routes     map[string]*RouteMetrics
+	operations map[string]*LatencyMetrics
+}
+
+// Return new, empty request metrics.
+func newRequestMetrics() *requestMetrics {
+	return &requestMetrics{
+		routes:     make(map[string]*RouteMetrics),
+		operations: make(map[string]*LatencyMetrics),
+	}
+}
+
+// Add a finished request to the metrics.
+func (m *requestMetrics) add(route string, duration time.Duration, slow bool, operations []operationTiming) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	metrics, ok := m.routes[route]
+	if !ok {
+		metrics = &RouteMetrics{}
+		m.routes[route] = metrics
+	}
+
+	metrics.add(duration)
+	if slow {
+		metrics.SlowCount++
+	}
+
+	for _, operation := range operations {
+		metrics, ok := m.operations[operation.name]
+		if !ok {
+			metrics = &LatencyMetrics{}
+			m.operations[operation.name] = metrics
+		}
+
+		metrics.add(operation.duration)
+	}
+}
+
+// Return a copy of the metrics.
+func (m *requestMetrics) snapshot() Metrics {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	snapshot := Metrics{
+		Routes:     make(map[string]*RouteMetrics, len(m.routes)),
+		Operations: make(map[string]*LatencyMetrics, len(m.operations)),
+	}
+
+	for route, metrics := range m.routes {
+		metrics := *metrics
+		snapshot.Routes[route] = &metrics
+	}
+
+	for name, metrics := range m.operations {
+		metrics := *metrics
+		snapshot.Operations[name] = &metrics
+	}
+
+	return snapshot
+}
+
+// Create a middleware that times each request.
+//
+// The processing time is reported to the client in the `Server-Timing` header
+// and added to the metrics. Requests that take longer than the configured
+// `slowRequestThreshold` are logged along with the repository operations they
+// performed.
+func newTimingMiddleware(cfg *config.Config, metrics *requestMetrics) Middleware {
+	threshold := cfg.SlowRequestThresholdDuration()
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			timing := &requestTiming{
+				start: time.Now(),
+				route: unmatchedRoute,
+			}
+
+			writer := &timingResponseWriter{
+				ResponseWriter: w,
+				start:          timing.start,
+			}
+
+			ctx := context.WithValue(r.Context(), "timing", timing)
+			next.ServeHTTP(writer, r.WithContext(ctx))
+			writer.setHeader()
+
+			if writer.status == 0 {
+				writer.status = http.StatusOK
+			}
+
+			duration := time.Since(timing.start)
+			slow := threshold > 0 && duration > threshold
+
+			timing.lock.Lock()
+			operations := append([]operationTiming{}, timing.operations...)
+			route := timing.route
+			repository := timing.repository
+			timing.lock.Unlock()
+
+			metrics.add(route, duration, slow, operations)
+
+			if slow {
+				logSlowRequest(r, repository, writer.status, duration, threshold, operations)
+			}
+		})
+	}
+}
+
+// A middleware that records which route handled the request.
+//
+// This must be used on the top-level router, so that the route is known.
+func withRouteTiming(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if timing := requestTimingFrom(r); timing != nil {
+			if template, err := mux.CurrentRoute(r).GetPathTemplate(); err == nil {
+				timing.lock.Lock()
+				timing.route = fmt.Sprintf("%s %s", r.Method, template)
+				timing.repository = mux.Vars(r)["repo"]
+				timing.lock.Unlock()
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Log a slow request with a breakdown of the time spent in each repository
+// operation.
+func logSlowRequest(r *http.Request, repository string, status int, duration, threshold time.Duration, operations []operationTiming) {
+	var names []string
+	totals := make(map[string]time.Duration)
+	counts := make(map[string]int)
+	var operationsTotal time.Duration
+
+	for _, operation := range operations {
+		if _, ok := totals[operation.name]; !ok {
+			names = append(names, operation.name)
+		}
+
+		totals[operation.name] += operation.duration
+		counts[operation.name]++
+		operationsTotal += operation.duration
+	}
+
+	sort.Slice(names, func(i, j int) bool {
+		return totals[names[i]] > totals[names[j]]
+	})
+
+	breakdown := make([]string, 0, len(names)+1)
+	for _, name := range names {
+		breakdown = append(breakdown, fmt.Sprintf("%s x%d %s", name, counts[name], formatMilliseconds(totals[name])))
+	}
+
+	if other := duration - operationsTotal; other > 0 {
+		breakdown = append(breakdown, fmt.Sprintf("other %s", formatMilliseconds(other)))
+	}
+
+	target := ""
+	if repository != "" {
+		target = fmt.Sprintf(` for repository "%s"`, repository)
+	}
+
+	log.Printf(`Slow request: "%s %s"%s returned %d after %s (threshold %s): %s`,
+		r.Method,
+		r.URL,
+		target,
+		status,
+		formatMilliseconds(duration),
+		formatMilliseconds(threshold),
+		strings.Join(breakdown, ", "))
+}
+
+// Format a duration as a number of milliseconds.
+func formatMilliseconds(d time.Duration) string {
+	return fmt.Sprintf("%.1fms", float64(d)/float64(time.Millisecond))
+}
+
+// A specialized `http.ResponseWriter` that reports the processing time in the
+// `Server-Timing` header.
+//
+// The processing time is measured when the headers are written, so it does
+// not include the time spent streaming the body.
+type timingResponseWriter struct {
+	http.ResponseWriter
+	start       time.Time
+	wroteHeader bool
+
+	// The status of the response.
+	status int
+}
+
+// Add the `Server-Timing` header, unless the headers have been written.
+func (t *timingResponseWriter) setHeader() {
+	if t.wroteHeader {
+		return
+	}
+
+	t.wroteHeader = true
+
+	ms := float64(time.Since(t.start)) / float64(time.Millisecond)
+	t.Header().Set(ServerTimingHeader, fmt.Sprintf("total;dur=%.1f", ms))
+}
+
+// Write the header for the given status code.
+func (t *timingResponseWriter) WriteHeader(status int) {
+	t.setHeader()
+	if t.status == 0 {
+		t.status = status
+	}
+
+	t.ResponseWriter.WriteHeader(status)
+}
+
+// Write the given content to the client.
+func (t *timingResponseWriter) Write(content []byte) (int, error) {
+	t.setHeader()
+	if t.status == 0 {
+		t.status = http.StatusOK
+	}
+
+	return t.ResponseWriter.Write(content)
+}
+
+// Return the request processing times since the server started, along with
+// statistics for the auth callout, if it is configured.
+//
+// URL: `/debug/metrics`
+func (api *API) getMetrics(w http.ResponseWriter, r *http.Request) {
+	metrics := api.metrics.snapshot()
+	if api.callout != nil {
+		calloutMetrics := api.callout.snapshot()
+		metrics.AuthCallout = &calloutMetrics
+	}
+
+	response, err := json.Marshal(metrics)
+	if err != nil {
+		log.Printf("Could not serialize metrics: %s", err.Error())
+		http.Error(w, "An unexpected error occurred.", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(response)
+}
+
+// A repository that records how long each operation takes.
+//
+// Operations that do not access the repository (e.g., GetName) are not
+// timed.
+type timedRepository struct {
+	repositories.Repository
+	timing *requestTiming
+}
+
+func (repo *timedRepository) GetFile(id string) ([]byte, error) {
+	defer repo.timing.record("GetFile", time.Now())
+	return repo.Repository.GetFile(id)
+}
+
+func (repo *timedRepository) OpenFile(id string) (io.ReadCloser, int64, error) {
+	defer repo.timing.record("OpenFile", time.Now())
+	return repo.Repository.OpenFile(id)
+}
+
+func (repo *timedRepository) GetFileByCommit(commit, filepath string) ([]byte, error) {
+	defer repo.timing.record("GetFileByCommit", time.Now())
+	return repo.Repository.GetFileByCommit(commit, filepath)
+}
+
+func (repo *timedRepository) OpenLargeFile(contents []byte) (*repositories.LargeFile, error) {
+	defer repo.timing.record("OpenLargeFile", time.Now())
+	return repo.Repository.OpenLargeFile(contents)
+}
+
+func (repo *timedRepository) GetFileModeByCommit(commit, filepath string) (repositories.FileMode, error) {
+	defer repo.timing.record("GetFileModeByCommit", time.Now())
+	return repo.Repository.GetFileModeByCommit(commit, filepath)
+}
+
+func (repo *timedRepository) GetFileSizeByCommit(commit, filepath string) (int64, error) {
+	defer repo.timing.record("GetFileSizeByCommit", time.Now())
+	return repo.Repository.GetFileSizeByCommit(commit, filepath)
+}
+
+func (repo *timedRepository) GetFileSizes(commitId string) (map[string]int64, error) {
+	defer repo.timing.record("GetFileSizes", time.Now())
+	return repo.Repository.GetFileSizes(commitId)
+}
+
+func (repo *timedRepository) CheckPatch(commitId string, diff []byte) (*repositories.PatchCheck, error) {
+	defer repo.timing.record("CheckPatch", time.Now())
+	return repo.Repository.CheckPatch(commitId, diff)
+}
+
+func (repo *timedRepository) GetChangedFiles(commitId string) ([]string, error) {
+	defer repo.timing.record("GetChangedFiles", time.Now())
+	return repo.Repository.GetChangedFiles(commitId)
+}
+
+func (repo *timedRepository) ResolveRef(ref string) (string, error) {
+	defer repo.timing.record("ResolveRef", time.Now())
+	return repo.Repository.ResolveRef(ref)
+}
+
+func (repo *timedRepository) FileExists(id string) (bool, error) {
+	defer repo.timing.record("FileExists", time.Now())
+	return repo.Repository.FileExists(id)
+}
+
+func (repo *timedRepository) FileExistsByCommit(commit, filepath string) (bool, error) {
+	defer repo.timing.record("FileExistsByCommit", time.Now())
+	return repo.Repository.FileExistsByCommit(commit, filepath)
+}
+
+func (repo *timedRepository) GetBranches(sort repositories.BranchSort) ([]repositories.Branch, error) {
+	defer repo.timing.record("GetBranches", time.Now())
+	return repo.Repository.GetBranches(sort)
+}
+
+func (repo *timedRepository) GetRefs() ([]repositories.Ref, error) {
+	defer repo.timing.record("GetRefs", time.Now())
+	return repo.Repository.GetRefs()
+}
+
+func (repo *timedRepository) GetCommits(branch string, start string, order repositories.CommitOrder, filter repositories.CommitFilter) ([]repositories.CommitInfo, error) {
+	defer repo.timing.record("GetCommits", time.Now())
+	return repo.Repository.GetCommits(branch, start, order, filter)
+}
+
+func (repo *timedRepository) GetCommit(commitId string) (*repositories.Commit, error) {
+	defer repo.timing.record("GetCommit", time.Now())
+	return repo.Repository.GetCommit(commitId)
+}
+
+func (repo *timedRepository) GetCommitRange(since, until string) ([]repositories.CommitInfo, error) {
+	defer repo.timing.record("GetCommitRange", time.Now())
+	return repo.Repository.GetCommitRange(since, until)
+}
+
+func (repo *timedRepository) GetMergeBase(a, b string) (string, error) {
+	defer repo.timing.record("GetMergeBase", time.Now())
+	return repo.Repository.GetMergeBase(a, b)
+}
+
+func (repo *timedRepository) GetFileLog(branch, path string) ([]repositories.FileLogEntry, error) {
+	defer repo.timing.record("GetFileLog", time.Now())
+	return repo.Repository.GetFileLog(branch, path)
+}
+
+func (repo *timedRepository) SearchCommits(query, branch string, authors, paths bool) ([]repositories.CommitInfo, error) {
+	defer repo.timing.record("SearchCommits", time.Now())
+	return repo.Repository.SearchCommits(query, branch, authors, paths)
+}
+
+func (repo *timedRepository) WriteArchive(w io.Writer, commitId, format, prefix string) error {
+	defer repo.timing.record("WriteArchive", time.Now())
+	return repo.Repository.WriteArchive(w, commitId, format, prefix)
+}
+
+func (repo *timedRepository) GetNotes(commitId string) ([]repositories.Note, error) {
+	defer repo.timing.record("GetNotes", time.Now())
+	return repo.Repository.GetNotes(commitId)
+}
@@ -0,0 +1,121 @@
+package api_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/reviewboard/rb-gateway/api"
+	"github.com/reviewboard/rb-gateway/config"
+)
+
+func init() {
+	err := api.RegisterMiddleware("test-slow", func(_ *config.Config) (api.Middleware, error) {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				time.Sleep(5 * time.Millisecond)
+				next.ServeHTTP(w, r)
+			})
+		}, nil
+	})
+
+	if err != nil {
+		panic(err)
+	}
+}
+
+func TestServerTimingHeader(t *testing.T) {
+	assert := assert.New(t)
+
+	testSetup := setupRoutesTest(t)
+	defer testSetup.cleanup(t)
+
+	rsp := testRoute(t, testSetup.config, "/repos/repo/branches", "GET", nil)
+	assert.Equal(http.StatusOK, rsp.Code)
+	assert.True(strings.HasPrefix(rsp.Header().Get(api.ServerTimingHeader), "total;dur="))
+
+	rsp = testRoute(t, testSetup.config, "/repos/does-not-exist/branches", "GET", nil)
+	assert.Equal(http.StatusNotFound, rsp.Code)
+	assert.True(strings.HasPrefix(rsp.Header().Get(api.ServerTimingHeader), "total;dur="))
+}
+
+func TestMetrics(t *testing.T) {
+	assert := assert.New(t)
+
+	testSetup := setupRoutesTest(t)
+	defer testSetup.cleanup(t)
+
+	handler, err := api.New(testSetup.config)
+	assert.Nil(err)
+
+	rsp := serveRequest(t, handler, "GET", "/session", "", nil)
+	assert.Equal(http.StatusOK, rsp.Code)
+
+	var session api.Session
+	assert.Nil(json.Unmarshal(rsp.Body.Bytes(), &session))
+
+	for i := 0; i < 2; i++ {
+		rsp = serveRequest(t, handler, "GET", "/repos/repo/branches", session.PrivateToken, nil)
+		assert.Equal(http.StatusOK, rsp.Code)
+	}
+
+	rsp = serveRequest(t, handler, "GET", "/does-not-exist", session.PrivateToken, nil)
+	assert.Equal(http.StatusNotFound, rsp.Code)
+
+	rsp = serveRequest(t, handler, "GET", "/debug/metrics", session.PrivateToken, nil)
+	assert.Equal(http.StatusOK, rsp.Code)
+
+	var metrics api.Metrics
+	assert.Nil(json.Unmarshal(rsp.Body.Bytes(), &metrics))
+
+	if route, ok := metrics.Routes["GET /repos/{repo:.+}/branches"]; assert.True(ok) {
+		assert.Equal(int64(2), route.Count)
+		assert.Equal(int64(0), route.SlowCount)
+		assert.True(route.MaxTime > 0)
+		assert.True(route.TotalTime >= route.MaxTime)
+	}
+
+	if route, ok := metrics.Routes["(unmatched)"]; assert.True(ok) {
+		assert.Equal(int64(1), route.Count)
+	}
+
+	if operation, ok := metrics.Operations["GetBranches"]; assert.True(ok) {
+		assert.Equal(int64(2), operation.Count)
+	}
+
+	// Metrics are only available to unrestricted tokens.
+	rsp = serveRequest(t, handler, "GET", "/debug/metrics", "", nil)
+	assert.Equal(http.StatusUnauthorized, rsp.Code)
+}
+
+func TestSlowRequestLogging(t *testing.T) {
+	assert := assert.New(t)
+
+	testSetup := setupRoutesTest(t)
+	defer testSetup.cleanup(t)
+
+	var output bytes.Buffer
+	log.SetOutput(&output)
+	defer log.SetOutput(os.Stderr)
+
+	testSetup.config.Middleware = []string{"test-slow"}
+
+	rsp := testRoute(t, testSetup.config, "/repos/repo/branches", "GET", nil)
+	assert.Equal(http.StatusOK, rsp.Code)
+	assert.NotContains(output.String(), "Slow request")
+
+	testSetup.config.SlowRequestThreshold = 1
+
+	rsp = testRoute(t, testSetup.config, "/repos/repo/branches", "GET", nil)
+	assert.Equal(http.StatusOK, rsp.Code)
+	assert.Contains(output.String(), `Slow request: "GET /repos/repo/branches" for repository "repo" returned 200 after`)
+	assert.Contains(output.String(), "GetBranches x1")
+	assert.Contains(output.String(), "other ")
+}
@@ -6,14 +6,43 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
 	"sync"
+	"time"
+
+	"github.com/reviewboard/rb-gateway/filelock"
 )
 
+// A token and its information, as stored on disk.
+type storedToken struct {
+	Token string `json:"token"`
+	Info
+}
+
+// Decode a stored token.
+//
+// Older versions of rb-gateway stored tokens as bare strings, which are
+// loaded as tokens that never expire and are not restricted.
+func (stored *storedToken) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &stored.Token); err == nil {
+		stored.Info = Info{}
+		return nil
+	}
+
+	type storedTokenFields storedToken
+	return json.Unmarshal(data, (*storedTokenFields)(stored))
+}
+
 // A token store backed by a file on disk.
+//
+// Other processes (e.g., `rb-gateway create-token`) may add tokens to the
+// file while the store is in use. Such tokens are picked up the first time
+// they are looked up and are preserved when the store is saved.
 type FileStore struct {
-	lock   sync.RWMutex
-	path   string
-	tokens MemoryStore
+	lock    sync.RWMutex
+	path    string
+	tokens  MemoryStore
+	modTime time.Time
 }
 
 // Create a new store from the conents of file at the given path.
@@ -22,62 +51,131 @@ func NewFileStore(path string) (*FileStore, error) {
 		panic("Cannot create FileStore in memory")
 	}
 
-	f, err := os.OpenFile(path, os.O_RDONLY, 0600)
-
-	if err != nil && !os.IsNotExist(err) {
+	tokens, modTime, err := readTokenFile(path)
+	if err != nil {
 		log.Printf("Could not open token store at \"%s\": %s", path, err.Error())
 		return nil, err
-	} else {
-		tokens := make(MemoryStore)
+	}
+
+	store := FileStore{
+		path:    path,
+		tokens:  tokens,
+		modTime: modTime,
+	}
 
-		if f != nil {
-			defer f.Close()
+	return &store, nil
+}
 
-			bytes, err := ioutil.ReadAll(f)
-			if err != nil {
-				return nil, err
-			}
+// Read the tokens from the file at the given path.
+//
+// If the file does not exist, an empty store is returned. The modification
+// time of the file is also returned.
+func readTokenFile(path string) (MemoryStore, time.Time, error) {
+	tokens := make(MemoryStore)
+
+	f, err := os.OpenFile(path, os.O_RDONLY, 0600)
+	if os.IsNotExist(err) {
+		return tokens, time.Time{}, nil
+	} else if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	bytes, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
 
-			if len(bytes) != 0 {
-				var unmarshalled []string
+	if len(bytes) != 0 {
+		var unmarshalled []storedToken
 
-				err := json.Unmarshal(bytes, &unmarshalled)
-				if err == nil {
+		err := json.Unmarshal(bytes, &unmarshalled)
+		if err == nil {
 
-					for _, token := range unmarshalled {
-						tokens[token] = true
-					}
-				} else if err, ok := err.(*json.SyntaxError); ok && err.Offset == 0 && err.Error() == "unexpected end of JSON input" {
-					// The file is empty, so we will just return an empty store.
-				} else {
-					return nil, err
-				}
+			for _, stored := range unmarshalled {
+				tokens[stored.Token] = stored.Info
 			}
+		} else if err, ok := err.(*json.SyntaxError); ok && err.Offset == 0 && err.Error() == "unexpected end of JSON input" {
+			// The file is empty, so we will just return an empty store.
+		} else {
+			return nil, time.Time{}, err
 		}
+	}
+
+	return tokens, stat.ModTime(), nil
+}
+
+// Add any tokens that were written to the backing file by another process.
+//
+// The caller must hold the write lock.
+func (store *FileStore) mergeUnsafe() error {
+	tokens, modTime, err := readTokenFile(store.path)
+	if err != nil {
+		return err
+	}
 
-		store := FileStore{
-			path:   path,
-			tokens: tokens,
+	for token, info := range tokens {
+		if _, exists := store.tokens[token]; !exists {
+			store.tokens[token] = info
 		}
+	}
+
+	store.modTime = modTime
+	return nil
+}
 
-		return &store, nil
+// Reload the backing file if it has changed since it was last read.
+func (store *FileStore) refresh() {
+	stat, err := os.Stat(store.path)
+	if err != nil {
+		return
+	}
+
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	if stat.ModTime().Equal(store.modTime) {
+		return
+	}
+
+	if err := store.mergeUnsafe(); err != nil {
+		log.Printf("Could not reload token store at \"%s\": %s", store.path, err.Error())
 	}
 }
 
 // Save the tokens in the store to the backing file.
+//
+// Tokens added to the file by other processes are kept, and expired tokens are
+// discarded. The file is locked while it is saved, so that tokens saved by
+// other processes at the same time are not lost, and it is replaced with a
+// new file, so that it is never left partially written.
 func (store *FileStore) Save() error {
 	store.lock.Lock()
 	defer store.lock.Unlock()
 
-	f, err := os.OpenFile(store.path, os.O_WRONLY|os.O_CREATE, 0600)
+	lock, err := filelock.Acquire(store.saveLockPath())
 	if err != nil {
 		return err
 	}
+	defer lock.Release()
 
-	tokens := make([]string, 0, len(store.tokens))
+	if err := store.mergeUnsafe(); err != nil {
+		return err
+	}
 
-	for token := range store.tokens {
-		tokens = append(tokens, token)
+	tokens := make([]storedToken, 0, len(store.tokens))
+
+	for token, info := range store.tokens {
+		if info.Expired() {
+			delete(store.tokens, token)
+		} else {
+			tokens = append(tokens, storedToken{token, info})
+		}
 	}
 
 	bytes, err := json.Marshal(tokens)
@@ -85,12 +183,43 @@ func (store *FileStore) Save() error {
 		return err
 	}
 
-	if _, err := f.Write(bytes); err != nil {
+	// The temporary file is created with mode 0600.
+	f, err := ioutil.TempFile(filepath.Dir(store.path), filepath.Base(store.path)+".tmp")
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(bytes)
+	if err == nil {
+		err = f.Sync()
+	}
+
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = os.Rename(f.Name(), store.path)
+	}
+
+	if err != nil {
+		os.Remove(f.Name())
 		return err
 	}
 
+	if stat, err := os.Stat(store.path); err == nil {
+		store.modTime = stat.ModTime()
+	}
+
 	return nil
+}
 
+// Return the path of the file that is locked while the store is saved.
+//
+// This is not the store's own `.lock` file, which a server holds for as long
+// as it is running (see `rb-gateway serve --lock`).
+func (store *FileStore) saveLockPath() string {
+	return store.path + ".save.lock"
 }
 
 // Return the token from the request, if any.
@@ -98,28 +227,71 @@ func (store *FileStore) Save() error {
 // If there is no token associated with this request or the token is invalid
 // `nil` will be returned instead.
 func (store *FileStore) Get(r *http.Request) *string {
+	token := r.Header.Get(TokenHeader)
+
+	if !store.Exists(token) {
+		return nil
+	}
+
+	return &token
+}
+
+// Return information about a token.
+//
+// If the token does not exist or has expired, `nil` will be returned.
+func (store *FileStore) Info(token string) *Info {
+	if len(token) != TokenSize {
+		return nil
+	}
+
+	if info := store.cachedInfo(token); info != nil {
+		return info
+	}
+
+	store.refresh()
+	return store.cachedInfo(token)
+}
+
+// Return information about a token without checking the backing file.
+func (store *FileStore) cachedInfo(token string) *Info {
 	store.lock.RLock()
 	defer store.lock.RUnlock()
 
-	return store.tokens.Get(r)
+	return store.tokens.Info(token)
 }
 
-// Create a new, unique token.
+// Create a new, unique token that never expires and is not restricted.
 //
 // This may return an error if we cannot read from the OS random device or if we
 // cannot generate a unique token after a number of attempts.
 func (store *FileStore) New() (*string, error) {
+	return store.NewWithOptions(Options{})
+}
+
+// Create a new, unique token with the given options.
+//
+// This may return an error if we cannot read from the OS random device or if we
+// cannot generate a unique token after a number of attempts.
+func (store *FileStore) NewWithOptions(opts Options) (*string, error) {
 	store.lock.Lock()
 	defer store.lock.Unlock()
 
-	tok, err := store.tokens.New()
+	tok, err := store.tokens.NewWithOptions(opts)
 	return tok, err
 }
 
-// Return whether or not a token exists in the store.
+// Return whether or not a token exists in the store and has not expired.
 func (store *FileStore) Exists(token string) bool {
+	return store.Info(token) != nil
+}
+
+// Return counts of the tokens in the store, including those added to the
+// backing file by other processes.
+func (store *FileStore) Stats() Stats {
+	store.refresh()
+
 	store.lock.RLock()
 	defer store.lock.RUnlock()
 
-	return store.tokens.Exists(token)
+	return store.tokens.Stats()
 }
@@ -15,7 +15,7 @@ const (
 //
 // This store is not re-entrant and should only be used for unit tests. Tokens do not
 // persist between restarts.
-type MemoryStore map[string]bool
+type MemoryStore map[string]Info
 
 // Save the store.
 //
@@ -44,13 +44,37 @@ func (store MemoryStore) Get(r *http.Request) *string {
 	return &token
 }
 
-// Create a new, unique token.
+// Return information about a token.
+//
+// If the token does not exist or has expired, `nil` will be returned.
+//
+// This method is not re-entrant.
+func (store MemoryStore) Info(token string) *Info {
+	info, exists := store[token]
+	if !exists || info.Expired() {
+		return nil
+	}
+
+	return &info
+}
+
+// Create a new, unique token that never expires and is not restricted.
 //
 // This may return an error if we cannot read from the OS random device or if we
 // cannot generate a unique token after a number of attempts.
 //
 // This method is not re-entrant.
 func (store MemoryStore) New() (*string, error) {
+	return store.NewWithOptions(Options{})
+}
+
+// Create a new, unique token with the given options.
+//
+// This may return an error if we cannot read from the OS random device or if we
+// cannot generate a unique token after a number of attempts.
+//
+// This method is not re-entrant.
+func (store MemoryStore) NewWithOptions(opts Options) (*string, error) {
 	var raw [rawTokenSize]byte
 
 	for i := 0; i < maxAttempts; i++ {
@@ -60,7 +84,7 @@ func (store MemoryStore) New() (*string, error) {
 
 		token := fmt.Sprintf("%X", raw)
 		if _, exists := store[token]; !exists {
-			store[token] = true
+			store[token] = newInfo(opts)
 			return &token, nil
 		}
 	}
@@ -68,7 +92,7 @@ func (store MemoryStore) New() (*string, error) {
 	return nil, fmt.Errorf("Could not generate token after %d attempts.\n", maxAttempts)
 }
 
-// Return whether or not a token exists in the store.
+// Return whether or not a token exists in the store and has not expired.
 //
 // This method is not re-entrant.
 func (store MemoryStore) Exists(token string) bool {
@@ -76,6 +100,29 @@ func (store MemoryStore) Exists(token string) bool {
 		return false
 	}
 
-	_, exists := store[token]
-	return exists
+	info, exists := store[token]
+	return exists && !info.Expired()
+}
+
+// Return counts of the tokens in the store.
+//
+// This method is not re-entrant.
+func (store MemoryStore) Stats() Stats {
+	stats := Stats{Total: len(store)}
+
+	for _, info := range store {
+		if info.Expired() {
+			stats.Expired++
+		}
+
+		if info.ReadOnly {
+			stats.ReadOnly++
+		}
+
+		if !info.Unrestricted() {
+			stats.Restricted++
+		}
+	}
+
+	return stats
 }
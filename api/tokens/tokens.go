@@ -2,19 +2,144 @@ package tokens
 
 import (
 	"net/http"
+	"time"
 )
 
 const (
 	TokenHeader = "PRIVATE-TOKEN"
 	TokenSize   = 64
+
+	// The role of tokens that can read repository data, but cannot manage
+	// the server (e.g., its webhooks).
+	//
+	// Tokens without a role have full access.
+	RoleReader = "reader"
+
+	// The role of tokens that repository hooks use to post events to the
+	// server. They cannot be used for anything else.
+	RoleHook = "hook"
 )
 
+// Options for creating a token.
+type Options struct {
+	// How long the token is valid for. If zero, the token never expires.
+	TTL time.Duration
+
+	// The latest time the token may expire at, regardless of TTL. If zero,
+	// only TTL is used.
+	NotAfter time.Time
+
+	// The repositories the token may access. If empty, the token may access
+	// all repositories.
+	Repositories []string
+
+	// Whether or not the token is limited to reading.
+	ReadOnly bool
+
+	// The user the token was created for, if any.
+	User string
+
+	// The role of the token, if any.
+	Role string
+}
+
+// Information about a token.
+type Info struct {
+	// When the token was created.
+	//
+	// This is zero for tokens created before this was recorded.
+	Created time.Time `json:"created"`
+
+	// When the token expires. If zero, the token never expires.
+	Expires time.Time `json:"expires"`
+
+	// The repositories the token may access. If empty, the token may access
+	// all repositories.
+	Repositories []string `json:"repositories,omitempty"`
+
+	// Whether or not the token is limited to reading.
+	ReadOnly bool `json:"read_only,omitempty"`
+
+	// The user the token was created for, if any.
+	User string `json:"user,omitempty"`
+
+	// The role of the token, if any.
+	Role string `json:"role,omitempty"`
+}
+
+// Return a new Info for a token created now with the given options.
+func newInfo(opts Options) Info {
+	info := Info{
+		Created:  time.Now().UTC(),
+		ReadOnly: opts.ReadOnly,
+		User:     opts.User,
+		Role:     opts.Role,
+	}
+
+	if opts.TTL > 0 {
+		info.Expires = info.Created.Add(opts.TTL)
+	}
+
+	if !opts.NotAfter.IsZero() && (info.Expires.IsZero() || info.Expires.After(opts.NotAfter)) {
+		info.Expires = opts.NotAfter
+	}
+
+	if len(opts.Repositories) > 0 {
+		info.Repositories = append([]string{}, opts.Repositories...)
+	}
+
+	return info
+}
+
+// Return whether or not the token has expired.
+func (info Info) Expired() bool {
+	return !info.Expires.IsZero() && !time.Now().Before(info.Expires)
+}
+
+// Return whether or not the token may access all repositories.
+func (info Info) Unrestricted() bool {
+	return len(info.Repositories) == 0
+}
+
+// Return whether or not the token may access the named repository.
+func (info Info) AllowsRepository(name string) bool {
+	if info.Unrestricted() {
+		return true
+	}
+
+	for _, repo := range info.Repositories {
+		if repo == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Counts of the tokens in a store, for diagnostics.
+type Stats struct {
+	// The number of tokens, including expired tokens.
+	Total int `json:"total"`
+
+	// The number of tokens that have expired.
+	Expired int `json:"expired"`
+
+	// The number of tokens that are limited to reading.
+	ReadOnly int `json:"read_only"`
+
+	// The number of tokens that are limited to some repositories.
+	Restricted int `json:"restricted"`
+}
+
 // A generic token store.
 type TokenStore interface {
 	Save() error
 	Get(r *http.Request) *string
 	New() (*string, error)
+	NewWithOptions(opts Options) (*string, error)
+	Info(token string) *Info
 	Exists(string) bool
+	Stats() Stats
 }
 
 // Create a new TokenStore
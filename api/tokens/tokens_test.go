@@ -7,6 +7,7 @@ import (
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 
@@ -105,3 +106,212 @@ func TestFileStoreExistsEmpty(t *testing.T) {
 	assert.Nil(err)
 	assert.NotNil(store)
 }
+
+// Testing that expired tokens cannot be used.
+func TestExpiredTokens(t *testing.T) {
+	assert := assert.New(t)
+
+	store, err := tokens.NewStore(":memory:")
+	assert.Nil(err)
+
+	tok, err := store.NewWithOptions(tokens.Options{TTL: time.Hour})
+	assert.Nil(err)
+	assert.True(store.Exists(*tok))
+
+	info := store.Info(*tok)
+	assert.NotNil(info)
+	assert.False(info.Expired())
+	assert.Equal(time.Hour, info.Expires.Sub(info.Created))
+
+	store.(tokens.MemoryStore)[*tok] = tokens.Info{
+		Expires: time.Now().Add(-time.Second),
+	}
+
+	assert.False(store.Exists(*tok))
+	assert.Nil(store.Info(*tok))
+}
+
+// Testing counting the tokens in a store.
+func TestStats(t *testing.T) {
+	assert := assert.New(t)
+
+	store, err := tokens.NewStore(":memory:")
+	assert.Nil(err)
+
+	assert.Equal(tokens.Stats{}, store.Stats())
+
+	_, err = store.New()
+	assert.Nil(err)
+
+	_, err = store.NewWithOptions(tokens.Options{
+		Repositories: []string{"repo"},
+		ReadOnly:     true,
+	})
+	assert.Nil(err)
+
+	tok, err := store.NewWithOptions(tokens.Options{ReadOnly: true})
+	assert.Nil(err)
+
+	store.(tokens.MemoryStore)[*tok] = tokens.Info{
+		Expires:  time.Now().Add(-time.Second),
+		ReadOnly: true,
+	}
+
+	assert.Equal(tokens.Stats{
+		Total:      3,
+		Expired:    1,
+		ReadOnly:   2,
+		Restricted: 1,
+	}, store.Stats())
+}
+
+// Testing round-tripping token information through a FileStore.
+func TestFileStoreLoadSaveInfo(t *testing.T) {
+	assert := assert.New(t)
+
+	tmpdir, err := ioutil.TempDir("", "rb-gateway-test-")
+	assert.Nil(err)
+	defer os.RemoveAll(tmpdir)
+
+	storePath := filepath.Join(tmpdir, "tokens.dat")
+
+	store, err := tokens.NewStore(storePath)
+	assert.Nil(err)
+
+	tok, err := store.NewWithOptions(tokens.Options{
+		TTL:          time.Hour,
+		Repositories: []string{"repo"},
+		ReadOnly:     true,
+	})
+	assert.Nil(err)
+
+	expected := store.Info(*tok)
+	assert.NotNil(expected)
+
+	assert.Nil(store.Save())
+
+	store, err = tokens.NewStore(storePath)
+	assert.Nil(err)
+
+	info := store.Info(*tok)
+	assert.NotNil(info)
+	assert.True(expected.Created.Equal(info.Created))
+	assert.True(expected.Expires.Equal(info.Expires))
+	assert.Equal([]string{"repo"}, info.Repositories)
+	assert.True(info.ReadOnly)
+	assert.False(info.AllowsRepository("other-repo"))
+}
+
+// Testing loading a FileStore saved by older versions.
+func TestFileStoreLoadLegacy(t *testing.T) {
+	assert := assert.New(t)
+
+	tmpfile, err := ioutil.TempFile("", "rb-gateway-tokens.dat-")
+	assert.Nil(err)
+	defer os.Remove(tmpfile.Name())
+
+	tok := strings.Repeat("A", tokens.TokenSize)
+
+	_, err = tmpfile.WriteString(`["` + tok + `"]`)
+	assert.Nil(err)
+	tmpfile.Close()
+
+	store, err := tokens.NewStore(tmpfile.Name())
+	assert.Nil(err)
+
+	info := store.Info(tok)
+	assert.NotNil(info)
+	assert.True(info.Expires.IsZero())
+	assert.True(info.Unrestricted())
+	assert.False(info.ReadOnly)
+}
+
+// Testing that tokens added by another process are picked up and preserved.
+func TestFileStoreConcurrentWriters(t *testing.T) {
+	assert := assert.New(t)
+
+	tmpdir, err := ioutil.TempDir("", "rb-gateway-test-")
+	assert.Nil(err)
+	defer os.RemoveAll(tmpdir)
+
+	storePath := filepath.Join(tmpdir, "tokens.dat")
+
+	server, err := tokens.NewStore(storePath)
+	assert.Nil(err)
+
+	serverTok, err := server.New()
+	assert.Nil(err)
+
+	other, err := tokens.NewStore(storePath)
+	assert.Nil(err)
+
+	otherTok, err := other.New()
+	assert.Nil(err)
+	assert.Nil(other.Save())
+
+	assert.True(server.Exists(*otherTok))
+	assert.Nil(server.Save())
+
+	store, err := tokens.NewStore(storePath)
+	assert.Nil(err)
+	assert.True(store.Exists(*serverTok))
+	assert.True(store.Exists(*otherTok))
+}
+
+// Test that tokens saved by many writers at once are not lost.
+func TestFileStoreConcurrentSaves(t *testing.T) {
+	assert := assert.New(t)
+
+	tmpdir, err := ioutil.TempDir("", "rb-gateway-test-")
+	assert.Nil(err)
+	defer os.RemoveAll(tmpdir)
+
+	storePath := filepath.Join(tmpdir, "tokens.dat")
+
+	const writers = 8
+	created := make(chan string, writers)
+	errs := make(chan error, writers)
+
+	for i := 0; i < writers; i++ {
+		go func() {
+			store, err := tokens.NewStore(storePath)
+			if err != nil {
+				errs <- err
+				return
+			}
+
+			token, err := store.New()
+			if err == nil {
+				err = store.Save()
+			}
+
+			if err == nil {
+				created <- *token
+			}
+
+			errs <- err
+		}()
+	}
+
+	for i := 0; i < writers; i++ {
+		assert.Nil(<-errs)
+	}
+	close(created)
+
+	store, err := tokens.NewStore(storePath)
+	assert.Nil(err)
+
+	for token := range created {
+		assert.True(store.Exists(token))
+	}
+
+	stat, err := os.Stat(storePath)
+	if assert.Nil(err) {
+		assert.Equal(os.FileMode(0600), stat.Mode().Perm())
+	}
+
+	// Only the store and its lock are left behind.
+	entries, err := ioutil.ReadDir(tmpdir)
+	assert.Nil(err)
+	assert.Equal(2, len(entries))
+}
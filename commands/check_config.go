@@ -0,0 +1,189 @@
+package commands
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/src-d/go-git.v4"
+
+	"github.com/reviewboard/rb-gateway/api/credentials"
+	"github.com/reviewboard/rb-gateway/api/tokens"
+	"github.com/reviewboard/rb-gateway/config"
+	"github.com/reviewboard/rb-gateway/repositories"
+	"github.com/reviewboard/rb-gateway/repositories/hooks"
+)
+
+// The result of a single configuration check.
+type ConfigCheck struct {
+	// What was checked.
+	Name string `json:"name"`
+
+	// Whether or not the check passed.
+	Passed bool `json:"passed"`
+
+	// Why the check failed, if it did.
+	Error string `json:"error,omitempty"`
+}
+
+// The results of checking a configuration file.
+type ConfigReport struct {
+	// The path to the configuration file.
+	Path string `json:"path"`
+
+	// Whether or not every check passed.
+	Passed bool `json:"passed"`
+
+	Checks []ConfigCheck `json:"checks"`
+
+	// Problems that do not fail the checks, such as deprecated keys.
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// Record the result of a check.
+func (report *ConfigReport) add(name string, err error) {
+	check := ConfigCheck{
+		Name:   name,
+		Passed: err == nil,
+	}
+
+	if err != nil {
+		check.Error = err.Error()
+		report.Passed = false
+	}
+
+	report.Checks = append(report.Checks, check)
+}
+
+// Check a configuration file and the files and repositories it refers to.
+func RunConfigChecks(configPath string) ConfigReport {
+	report := ConfigReport{
+		Path:   configPath,
+		Passed: true,
+		Checks: []ConfigCheck{},
+	}
+
+	cfg, err := config.Load(configPath)
+	report.add("configuration", err)
+	if err != nil {
+		return report
+	}
+
+	for _, deprecation := range cfg.Deprecations {
+		report.Warnings = append(report.Warnings, deprecation.String())
+	}
+
+	if cfg.LegacyCredentials {
+		report.Warnings = append(report.Warnings,
+			`The legacy "username" and "password" keys are ignored until the configuration is migrated with `+
+				"`rb-gateway migrate-config`.")
+	}
+
+	for _, repo := range cfg.RepositoryData {
+		report.add(fmt.Sprintf(`repository "%s"`, repo.Name), checkRepository(repo))
+	}
+
+	// The htpasswd provider is checked by checking its file, so that the
+	// name of the check points at the key that needs fixing.
+	if cfg.AuthProvider.Type == "" || cfg.AuthProvider.Type == credentials.DefaultProvider {
+		report.add("htpasswdPath", checkReadable(cfg.HtpasswdPath))
+	} else {
+		_, err := credentials.New(cfg)
+		report.add("authProvider", err)
+	}
+
+	if cfg.TokenStorePath == ":memory:" {
+		report.add("tokenStorePath", fmt.Errorf("Cannot use memory store outside of tests."))
+	} else {
+		_, err := tokens.NewStore(cfg.TokenStorePath)
+		report.add("tokenStorePath", err)
+	}
+
+	_, err = hooks.LoadStore(cfg.WebhookStorePath, cfg.RepositorySet())
+	report.add("webhookStorePath", err)
+
+	if cfg.TLS.Enabled {
+		_, err := tls.LoadX509KeyPair(cfg.TLS.Certificate, cfg.TLS.Key)
+		report.add("tls", err)
+
+		if cfg.TLS.ClientCAPath != "" {
+			_, err = cfg.TLS.LoadClientCAs()
+			report.add("tls.clientCAPath", err)
+		}
+	}
+
+	return report
+}
+
+// Migrate a configuration file with legacy credentials.
+//
+// See config.MigrateLegacyConfig().
+func MigrateConfig(configPath string) {
+	if err := config.MigrateLegacyConfig(configPath); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Check a configuration file, print a report, and exit unsuccessfully if any
+// checks failed.
+func CheckConfig(configPath string, jsonOutput bool) {
+	report := RunConfigChecks(configPath)
+
+	if jsonOutput {
+		output, _ := json.MarshalIndent(report, "", "  ")
+		fmt.Println(string(output))
+	} else {
+		for _, check := range report.Checks {
+			if check.Passed {
+				fmt.Printf("OK    %s\n", check.Name)
+			} else {
+				fmt.Printf("FAIL  %s: %s\n", check.Name, check.Error)
+			}
+		}
+
+		for _, warning := range report.Warnings {
+			fmt.Printf("WARN  %s\n", warning)
+		}
+	}
+
+	if !report.Passed {
+		os.Exit(1)
+	}
+}
+
+// Check that a repository exists at the configured path with the configured
+// SCM.
+func checkRepository(repo config.RawRepository) error {
+	switch repo.Scm {
+	case "git":
+		if repo.Bare {
+			return repositories.CheckBareGitRepository(repo.Path)
+		} else if _, err := git.PlainOpen(repo.Path); err != nil {
+			return fmt.Errorf("Could not open Git repository at %s: %s", repo.Path, err.Error())
+		}
+
+	case "hg":
+		stat, err := os.Stat(filepath.Join(repo.Path, ".hg"))
+		if err != nil || !stat.IsDir() {
+			return fmt.Errorf("No Mercurial repository at %s", repo.Path)
+		}
+
+	default:
+		return fmt.Errorf(`Unknown SCM "%s"`, repo.Scm)
+	}
+
+	return nil
+}
+
+// Check that a file can be read.
+func checkReadable(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	return f.Close()
+}
@@ -0,0 +1,49 @@
+package commands
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/reviewboard/rb-gateway/api/tokens"
+	"github.com/reviewboard/rb-gateway/config"
+)
+
+// Create a token in the configured token store and print it.
+//
+// A running server picks up the token the first time it is used, so the
+// server does not need to be restarted.
+func CreateToken(configPath string, opts tokens.Options) {
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		log.Fatal("Could not parse configuration: ", err.Error())
+	}
+
+	if cfg.TokenStorePath == ":memory:" {
+		log.Fatal("Cannot create tokens in a memory store.")
+	}
+
+	for i, repoName := range opts.Repositories {
+		repo := cfg.FindRepository(repoName)
+		if repo == nil {
+			log.Fatalf(`Unknown repository: "%s".`, repoName)
+		}
+
+		opts.Repositories[i] = repo.GetName()
+	}
+
+	store, err := tokens.NewStore(cfg.TokenStorePath)
+	if err != nil {
+		log.Fatal("Could not load token store: ", err.Error())
+	}
+
+	token, err := store.NewWithOptions(opts)
+	if err != nil {
+		log.Fatal("Could not create token: ", err.Error())
+	}
+
+	if err := store.Save(); err != nil {
+		log.Fatal("Could not save token store: ", err.Error())
+	}
+
+	fmt.Println(*token)
+}
@@ -0,0 +1,57 @@
+package commands
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/reviewboard/rb-gateway/repositories/events"
+)
+
+// Deliver an event's webhooks from a detached process.
+//
+// The payload is handed to a new `trigger-webhooks --payload-file=-` process,
+// which keeps running after the hook exits, so that the push does not wait
+// for webhooks to be delivered. The detached process has no terminal to
+// report to, so the results of its deliveries are only recorded in the
+// delivery status and dead letter stores.
+func deliverInBackground(configPath, repoName, event string, payload events.Payload) error {
+	data, err := events.MarshalPayload(payload)
+	if err != nil {
+		return err
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	if configPath, err = filepath.Abs(configPath); err != nil {
+		return err
+	}
+
+	cmd := exec.Command(executable, "--config", configPath, "trigger-webhooks", "--payload-file=-", repoName, event)
+	cmd.SysProcAttr = detachedProcAttr()
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+
+	if err = cmd.Start(); err != nil {
+		return err
+	}
+
+	_, err = stdin.Write(data)
+	if closeErr := stdin.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return err
+	}
+
+	return cmd.Process.Release()
+}
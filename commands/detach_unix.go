@@ -0,0 +1,16 @@
+//go:build !windows
+// +build !windows
+
+package commands
+
+import (
+	"syscall"
+)
+
+// Return the attributes for a process that outlives its parent.
+//
+// The process gets its own session, so that it is not sent the signals meant
+// for the hook's (e.g., when an SSH connection is closed).
+func detachedProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setsid: true}
+}
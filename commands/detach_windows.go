@@ -0,0 +1,13 @@
+package commands
+
+import (
+	"syscall"
+)
+
+// Return the attributes for a process that outlives its parent.
+//
+// The process gets its own process group, so that it is not sent the console
+// signals meant for the hook's.
+func detachedProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP}
+}
@@ -0,0 +1,237 @@
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/foomo/htpasswd"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+
+	"github.com/reviewboard/rb-gateway/config"
+	"github.com/reviewboard/rb-gateway/repositories/hooks"
+)
+
+const (
+	harnessAuthor      = "Author"
+	harnessAuthorEmail = "author@example.com"
+)
+
+// Options for the test harness.
+type HarnessOptions struct {
+	// The port the server will listen on.
+	Port uint16
+
+	// The credentials that can be used to create sessions.
+	Username string
+	Password string
+
+	// Whether or not to create a Mercurial repository in addition to the Git
+	// repository. This requires hg to be installed.
+	Hg bool
+
+	// Whether or not to keep the temporary files after the server exits.
+	Keep bool
+}
+
+// A repository created by the test harness.
+type HarnessRepository struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+	Scm  string `json:"scm"`
+}
+
+// Information about a running test harness.
+//
+// This is written to stdout as a single line of JSON once the harness has
+// been set up, so that callers can discover the server and its repositories.
+type HarnessInfo struct {
+	// The temporary directory containing the configuration and repositories.
+	Root string `json:"root"`
+
+	// The path to the configuration file.
+	ConfigPath string `json:"config_path"`
+
+	// The base URL of the server.
+	Url string `json:"url"`
+
+	// The credentials that can be used to create sessions.
+	Username string `json:"username"`
+	Password string `json:"password"`
+
+	// The repositories served by the harness.
+	Repositories []HarnessRepository `json:"repositories"`
+}
+
+// Run a server against temporary repositories for integration testing.
+//
+// This creates a temporary directory containing a seeded Git repository (and,
+// optionally, a Mercurial repository), a configuration file, an htpasswd file,
+// and an empty webhook store. The harness information is written to stdout and
+// the server is run until it receives SIGINT or SIGTERM, at which point the
+// temporary directory is removed.
+//
+// The server may not be accepting connections when the harness information is
+// written, so callers should retry their first request.
+func TestHarness(opts HarnessOptions) {
+	info, err := setupHarness(opts)
+	if info != nil && !opts.Keep {
+		defer os.RemoveAll(info.Root)
+	}
+
+	if err != nil {
+		log.Fatalf("Could not set up test harness: %s", err.Error())
+	}
+
+	output, err := json.Marshal(info)
+	if err != nil {
+		log.Fatalf("Could not serialize test harness information: %s", err.Error())
+	}
+
+	fmt.Println(string(output))
+
+	Serve(info.ConfigPath, ServeOptions{})
+}
+
+// Create the temporary files for the test harness.
+//
+// If the temporary directory was created, the returned info will be non-nil,
+// even if an error occurs.
+func setupHarness(opts HarnessOptions) (*HarnessInfo, error) {
+	root, err := ioutil.TempDir("", "rb-gateway-harness-")
+	if err != nil {
+		return nil, err
+	}
+
+	info := &HarnessInfo{
+		Root:       root,
+		ConfigPath: filepath.Join(root, "config.json"),
+		Url:        fmt.Sprintf("http://localhost:%d", opts.Port),
+		Username:   opts.Username,
+		Password:   opts.Password,
+	}
+
+	gitPath := filepath.Join(root, "git-repo")
+	if err = createHarnessGitRepo(gitPath); err != nil {
+		return info, fmt.Errorf("Could not create Git repository: %s", err.Error())
+	}
+
+	info.Repositories = append(info.Repositories, HarnessRepository{
+		Name: "git-repo",
+		Path: gitPath,
+		Scm:  "git",
+	})
+
+	if opts.Hg {
+		hgPath := filepath.Join(root, "hg-repo")
+		if err = createHarnessHgRepo(hgPath); err != nil {
+			return info, fmt.Errorf("Could not create Mercurial repository: %s", err.Error())
+		}
+
+		info.Repositories = append(info.Repositories, HarnessRepository{
+			Name: "hg-repo",
+			Path: hgPath,
+			Scm:  "hg",
+		})
+	}
+
+	cfg := config.Config{
+		HtpasswdPath:     filepath.Join(root, "htpasswd"),
+		Port:             opts.Port,
+		RepositoryData:   make([]config.RawRepository, 0, len(info.Repositories)),
+		TokenStorePath:   filepath.Join(root, "tokens.dat"),
+		WebhookStorePath: filepath.Join(root, "webhooks.json"),
+	}
+
+	for _, repo := range info.Repositories {
+		cfg.RepositoryData = append(cfg.RepositoryData, config.RawRepository{
+			Name: repo.Name,
+			Path: repo.Path,
+			Scm:  repo.Scm,
+		})
+	}
+
+	err = htpasswd.SetPassword(cfg.HtpasswdPath, opts.Username, opts.Password, htpasswd.HashBCrypt)
+	if err != nil {
+		return info, err
+	}
+
+	if err = (hooks.WebhookStore{}).Save(cfg.WebhookStorePath); err != nil {
+		return info, err
+	}
+
+	content, err := json.MarshalIndent(cfg, "", "    ")
+	if err != nil {
+		return info, err
+	}
+
+	if err = ioutil.WriteFile(info.ConfigPath, content, 0600); err != nil {
+		return info, err
+	}
+
+	return info, nil
+}
+
+// Create a Git repository with a single commit.
+func createHarnessGitRepo(path string) error {
+	repo, err := git.PlainInit(path, false)
+	if err != nil {
+		return err
+	}
+
+	if err = ioutil.WriteFile(filepath.Join(path, "README"), []byte("README\n"), 0644); err != nil {
+		return err
+	}
+
+	worktree, err := repo.Worktree()
+	if err != nil {
+		return err
+	}
+
+	if _, err = worktree.Add("README"); err != nil {
+		return err
+	}
+
+	_, err = worktree.Commit("Initial commit", &git.CommitOptions{
+		Author: &object.Signature{
+			Name:  harnessAuthor,
+			Email: harnessAuthorEmail,
+			When:  time.Now(),
+		},
+	})
+
+	return err
+}
+
+// Create a Mercurial repository with a single commit.
+func createHarnessHgRepo(path string) error {
+	if err := runHarnessHg("init", path); err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(path, "README"), []byte("README\n"), 0644); err != nil {
+		return err
+	}
+
+	if err := runHarnessHg("--cwd", path, "add", "README"); err != nil {
+		return err
+	}
+
+	return runHarnessHg("--cwd", path, "commit", "-m", "Initial commit",
+		"-u", fmt.Sprintf("%s <%s>", harnessAuthor, harnessAuthorEmail))
+}
+
+// Run an hg command, including its output in any returned error.
+func runHarnessHg(args ...string) error {
+	if output, err := exec.Command("hg", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %s", err.Error(), output)
+	}
+
+	return nil
+}
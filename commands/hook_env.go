@@ -0,0 +1,100 @@
+package commands
+
+import (
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/reviewboard/rb-gateway/config"
+	"github.com/reviewboard/rb-gateway/repositories"
+)
+
+// The prefixes of the environment variables that SCMs pass to hooks.
+//
+// Mercurial passes the details of the operation (e.g., HG_NODE and
+// HG_HOOKTYPE) this way, and Git passes the location of the repository and any
+// push options.
+var hookEnvPrefixes = []string{"HG", "GIT_"}
+
+// Parts of environment variable names whose values are never logged.
+var sensitiveEnvNames = []string{"AUTH", "PASSWD", "PASSWORD", "SECRET", "TOKEN"}
+
+// Log how a hook invoked `trigger-webhooks` and the environment it was given.
+//
+// This is for diagnosing misconfigured hooks, such as Mercurial hooks of the
+// wrong type, which do not pass the variables that the payload is parsed
+// from.
+func logHookEnvironment(repository repositories.Repository, event string) {
+	log.Printf("Hook invocation: %s", strings.Join(os.Args, " "))
+
+	if wd, err := os.Getwd(); err == nil {
+		log.Printf("  Working directory: %s", wd)
+	}
+
+	log.Printf("  Repository: %s (%s) at %s", repository.GetName(), repository.GetScm(), repository.GetPath())
+	log.Printf("  Event: %s", event)
+	log.Printf("  Parent process: %d", os.Getppid())
+
+	env := hookEnvironment(os.Environ())
+	if len(env) == 0 {
+		log.Printf("Hook environment: no HG* or GIT_* variables are set")
+		return
+	}
+
+	log.Printf("Hook environment:")
+	for _, v := range env {
+		log.Printf("  %s", v)
+	}
+}
+
+// Return the hook variables in an environment, sorted, with secrets redacted.
+//
+// The values of variables with sensitive names are replaced entirely, and
+// passwords are removed from URLs (such as HG_URL).
+func hookEnvironment(environ []string) []string {
+	var env []string
+
+	for _, v := range environ {
+		parts := strings.SplitN(v, "=", 2)
+		if len(parts) != 2 || !hasAnyPrefix(parts[0], hookEnvPrefixes) {
+			continue
+		}
+
+		name, value := parts[0], parts[1]
+
+		if isSensitiveEnvName(name) {
+			value = config.RedactedValue
+		} else {
+			value = config.RedactUrls(value)
+		}
+
+		env = append(env, name+"="+value)
+	}
+
+	sort.Strings(env)
+	return env
+}
+
+// Return whether or not a string starts with any of the prefixes.
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Return whether or not the value of an environment variable may be secret.
+func isSensitiveEnvName(name string) bool {
+	name = strings.ToUpper(name)
+	for _, sensitive := range sensitiveEnvNames {
+		if strings.Contains(name, sensitive) {
+			return true
+		}
+	}
+
+	return false
+}
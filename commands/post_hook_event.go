@@ -0,0 +1,155 @@
+package commands
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/reviewboard/rb-gateway/api/tokens"
+	"github.com/reviewboard/rb-gateway/repositories"
+	"github.com/reviewboard/rb-gateway/repositories/events"
+)
+
+// How long to wait for the server to deliver an event posted by a hook.
+const postHookEventTimeout = 2 * time.Minute
+
+// Options for posting an event from a hook to the server.
+type PostHookEventOptions struct {
+	// The URL of the server.
+	Url string
+
+	// The path to the file containing the repository's hook token.
+	TokenFile string
+
+	// The path to a file of CA certificates to trust, if not the system's.
+	CAFile string
+
+	// The paths to the client certificate and private key to present, if
+	// any.
+	CertFile string
+	KeyFile  string
+
+	// Whether or not to post the hook's standard input.
+	Stdin bool
+}
+
+// Post an event from a repository hook to the server, which delivers it to
+// webhooks.
+//
+// This is run by hooks installed with `hooks.mode` set to `api`. Unlike
+// `trigger-webhooks`, it does not read the configuration or webhook store:
+// the hook's input and environment are posted as-is, along with a token that
+// can only be used to post events for the repository.
+func PostHookEvent(opts PostHookEventOptions, repoName, event string) {
+	if !events.IsValidEvent(event) {
+		log.Fatalf(`Unknown event: "%s"`, event)
+	}
+
+	token, err := repositories.ReadHookToken(opts.TokenFile)
+	if err != nil {
+		log.Fatal("Could not read hook token: ", err.Error())
+	}
+
+	var input []byte
+	if opts.Stdin {
+		if input, err = ioutil.ReadAll(os.Stdin); err != nil {
+			log.Fatal("Could not read hook input: ", err.Error())
+		}
+	}
+
+	env := make(map[string]string)
+	for _, v := range os.Environ() {
+		parts := strings.SplitN(v, "=", 2)
+		if len(parts) == 2 && hasAnyPrefix(parts[0], hookEnvPrefixes) {
+			env[parts[0]] = parts[1]
+		}
+	}
+
+	body, err := json.Marshal(struct {
+		Input string            `json:"input"`
+		Env   map[string]string `json:"env"`
+	}{string(input), env})
+	if err != nil {
+		log.Fatal("Could not encode hook event: ", err.Error())
+	}
+
+	url := fmt.Sprintf("%s/repos/%s/hook-events/%s", opts.Url, repoName, event)
+	request, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		log.Fatal("Could not create request: ", err.Error())
+	}
+
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(tokens.TokenHeader, token)
+
+	tlsConfig, err := hookTLSConfig(opts)
+	if err != nil {
+		log.Fatal("Could not load TLS settings: ", err.Error())
+	}
+
+	client := http.Client{
+		Timeout: postHookEventTimeout,
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: tlsConfig,
+		},
+	}
+	rsp, err := client.Do(request)
+	if err != nil {
+		log.Fatal("Could not post hook event: ", err.Error())
+	}
+	defer rsp.Body.Close()
+
+	if rsp.StatusCode >= 200 && rsp.StatusCode < 300 {
+		return
+	}
+
+	message, _ := ioutil.ReadAll(rsp.Body)
+
+	// For gating events, exiting unsuccessfully rejects the operation. The
+	// server's response explains why, and is written without the log's
+	// timestamp when the push was rejected, since the SCM shows it to the
+	// user who pushed.
+	if rsp.StatusCode == http.StatusForbidden && events.IsGatingEvent(event) {
+		fmt.Fprintln(os.Stderr, strings.TrimSpace(string(message)))
+		os.Exit(1)
+	}
+
+	log.Fatalf("Could not post hook event (HTTP %d): %s", rsp.StatusCode, strings.TrimSpace(string(message)))
+}
+
+// Return the TLS settings for posting an event to the server.
+func hookTLSConfig(opts PostHookEventOptions) (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+
+	if opts.CAFile != "" {
+		content, err := ioutil.ReadFile(opts.CAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(content) {
+			return nil, fmt.Errorf(`No certificates were found in "%s".`, opts.CAFile)
+		}
+	}
+
+	if opts.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
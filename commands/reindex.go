@@ -0,0 +1,36 @@
+package commands
+
+import (
+	"log"
+	"time"
+
+	"github.com/reviewboard/rb-gateway/config"
+	"github.com/reviewboard/rb-gateway/repositories"
+)
+
+// Rebuild the commit index of a repository from scratch.
+func Reindex(configPath, repoName string) {
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		log.Fatal("Could not parse configuration: ", err.Error())
+	}
+
+	repository, exists := cfg.Repositories[repoName]
+	if !exists {
+		log.Fatalf(`Unknown repository: "%s".`, repoName)
+	}
+
+	gitRepo, ok := repository.(*repositories.GitRepository)
+	if !ok || gitRepo.Index == nil {
+		log.Fatalf(`Repository "%s" does not have "index" enabled.`, repoName)
+	}
+
+	start := time.Now()
+
+	count, err := gitRepo.RebuildIndex()
+	if err != nil {
+		log.Fatalf(`Could not rebuild the commit index for repository "%s": %s`, repoName, err.Error())
+	}
+
+	log.Printf(`Indexed %d commits for repository "%s" in %s.`, count, repoName, time.Since(start))
+}
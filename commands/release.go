@@ -0,0 +1,92 @@
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/reviewboard/rb-gateway/version"
+)
+
+// Write and sign the release manifest for the binaries in a directory.
+//
+// This is run by the Makefile's `release` target after it builds the binaries
+// for each platform, so that the manifest has the version embedded in this
+// build. See `version.NewManifest()`. The manifest is signed with the private
+// key in `signingKeyPath`, and the signature is written beside it (see
+// `version.SignatureFileName`).
+func Release(dist, baseUrl, signingKeyPath string) {
+	if version.Version == "" {
+		log.Fatal("This build has no version. Build it with the Makefile's release target.")
+	}
+
+	if signingKeyPath == "" {
+		log.Fatal("No release signing key was given. Set RELEASE_SIGNING_KEY for the Makefile's release target.")
+	}
+
+	keyFile, err := ioutil.ReadFile(signingKeyPath)
+	if err != nil {
+		log.Fatal("Could not read release signing key: ", err.Error())
+	}
+
+	manifest, err := version.NewManifest(dist, version.Version, baseUrl)
+	if err != nil {
+		log.Fatal("Could not create release manifest: ", err.Error())
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "    ")
+	if err != nil {
+		log.Fatal("Could not serialize release manifest: ", err.Error())
+	}
+
+	data = append(data, '\n')
+
+	signature, err := version.SignManifest(data, keyFile)
+	if err != nil {
+		log.Fatal("Could not sign release manifest: ", err.Error())
+	}
+
+	path := filepath.Join(dist, version.ManifestFileName)
+	if err = ioutil.WriteFile(path, data, 0644); err != nil {
+		log.Fatal("Could not write release manifest: ", err.Error())
+	}
+
+	if err = ioutil.WriteFile(filepath.Join(dist, version.SignatureFileName), signature, 0644); err != nil {
+		log.Fatal("Could not write release manifest signature: ", err.Error())
+	}
+
+	log.Printf(`Wrote the manifest for rb-gateway %s (%s) to "%s".`,
+		manifest.Version, strings.Join(manifest.Platforms(), ", "), path)
+}
+
+// Generate a release signing key.
+//
+// The private key is written to `path`, which must not already exist, and the
+// public key is printed so that it can be given to the Makefile as
+// RELEASE_PUBLIC_KEY.
+func GenerateReleaseKey(path string) {
+	keyFile, publicKey, err := version.GenerateSigningKey()
+	if err != nil {
+		log.Fatal("Could not generate release signing key: ", err.Error())
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		log.Fatal("Could not create release signing key: ", err.Error())
+	}
+
+	_, err = file.Write(keyFile)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		log.Fatal("Could not write release signing key: ", err.Error())
+	}
+
+	fmt.Printf("Wrote the release signing key to \"%s\". Its public key is:\n%s\n", path, publicKey)
+}
@@ -0,0 +1,86 @@
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/reviewboard/rb-gateway/api/tokens"
+	"github.com/reviewboard/rb-gateway/repositories/events"
+)
+
+// How long to wait for the server to create and deliver a replayed payload.
+const replayTimeout = 5 * time.Minute
+
+// Have a server create and deliver the push payload for a range of commits.
+//
+// This uses the server's `/repos/<repo>/push-payload` API, so neither the
+// repository nor the configuration needs to be available locally. Only push
+// events for a `--commit-range` can be replayed this way.
+func replayThroughServer(repoName, event string, replay ReplayOptions) {
+	if event != events.PushEvent {
+		log.Fatalf(`Only "%s" events can be replayed with --server.`, events.PushEvent)
+	} else if replay.CommitRange == "" || replay.PayloadFile != "" {
+		log.Fatal("--server can only be used with --commit-range.")
+	} else if replay.TokenFile == "" {
+		log.Fatal("--token-file must be given with --server.")
+	}
+
+	revs := strings.SplitN(replay.CommitRange, "..", 2)
+	if len(revs) != 2 || revs[0] == "" || revs[1] == "" {
+		log.Fatalf(`Invalid commit range "%s"; expected "<start>..<end>".`, replay.CommitRange)
+	}
+
+	content, err := ioutil.ReadFile(replay.TokenFile)
+	if err != nil {
+		log.Fatal("Could not read token: ", err.Error())
+	}
+
+	query := url.Values{}
+	query.Set("old", revs[0])
+	query.Set("new", revs[1])
+
+	request, err := http.NewRequest(http.MethodPost,
+		fmt.Sprintf("%s/repos/%s/push-payload?%s", strings.TrimSuffix(replay.Server, "/"), repoName, query.Encode()),
+		nil)
+	if err != nil {
+		log.Fatal("Could not create request: ", err.Error())
+	}
+
+	request.Header.Set(tokens.TokenHeader, strings.TrimSpace(string(content)))
+
+	client := &http.Client{
+		Timeout: replayTimeout,
+	}
+
+	rsp, err := client.Do(request)
+	if err != nil {
+		log.Fatal("Could not reach server: ", err.Error())
+	}
+	defer rsp.Body.Close()
+
+	body, err := ioutil.ReadAll(rsp.Body)
+	if err != nil {
+		log.Fatal("Could not read response: ", err.Error())
+	}
+
+	var response struct {
+		Payload events.PushPayload `json:"payload"`
+		Error   string             `json:"error"`
+	}
+
+	if rsp.StatusCode != http.StatusOK && rsp.StatusCode != http.StatusBadGateway {
+		log.Fatalf("Could not replay push (HTTP %d): %s", rsp.StatusCode, strings.TrimSpace(string(body)))
+	} else if err = json.Unmarshal(body, &response); err != nil {
+		log.Fatal("Could not parse response: ", err.Error())
+	} else if response.Error != "" {
+		log.Fatal(response.Error)
+	}
+
+	log.Printf("Delivered %d commits to webhooks.", len(response.Payload.Commits))
+}
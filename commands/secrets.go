@@ -0,0 +1,54 @@
+package commands
+
+import (
+	"log"
+
+	"github.com/reviewboard/rb-gateway/config"
+	"github.com/reviewboard/rb-gateway/repositories/hooks"
+)
+
+// Generate a key for encrypting webhook secrets.
+//
+// The key is written to the given path, which must not already exist. To use
+// it, set `secretsKeyPath` in the configuration.
+func GenerateSecretsKey(path string) {
+	if err := hooks.GenerateSecretsKey(path); err != nil {
+		log.Fatal("Could not generate secrets key: ", err.Error())
+	}
+
+	log.Printf(`Wrote secrets key to "%s".`, path)
+}
+
+// Encrypt the plaintext secrets in the configured webhook store.
+//
+// Secrets that are already encrypted are left alone, so this can safely be
+// run more than once. The server should be stopped first, so that it does not
+// overwrite the store with the plaintext secrets it has loaded.
+func EncryptWebhookSecrets(configPath string) {
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		log.Fatal("Could not parse configuration: ", err.Error())
+	}
+
+	if cfg.SecretsKey == nil {
+		log.Fatal("Cannot encrypt webhook secrets: secretsKeyPath is not configured.")
+	}
+
+	store, err := hooks.LoadStore(cfg.WebhookStorePath, cfg.RepositorySet())
+	if err != nil {
+		log.Fatal("Could not load webhook store: ", err.Error())
+	}
+
+	count, err := store.EncryptSecrets(cfg.SecretsKey)
+	if err != nil {
+		log.Fatal("Could not encrypt webhook secrets: ", err.Error())
+	}
+
+	if count > 0 {
+		if err := store.Save(cfg.WebhookStorePath); err != nil {
+			log.Fatal("Could not save webhook store: ", err.Error())
+		}
+	}
+
+	log.Printf("Encrypted the secrets of %d webhooks.", count)
+}
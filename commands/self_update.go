@@ -0,0 +1,270 @@
+package commands
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/reviewboard/rb-gateway/config"
+	"github.com/reviewboard/rb-gateway/version"
+)
+
+// How long to wait for the release manifest and binary to download.
+const selfUpdateTimeout = 5 * time.Minute
+
+// The largest release manifest and signature that will be downloaded.
+const maxManifestSize = 1024 * 1024
+
+// The largest binary that will be downloaded.
+const maxBinarySize = 512 * 1024 * 1024
+
+// Options for updating rb-gateway.
+type SelfUpdateOptions struct {
+	// The URL of the release manifest. If empty, the configured `updateUrl` is
+	// used.
+	Url string
+
+	// Whether to only report whether an update is available.
+	Check bool
+
+	// Whether to install the release even if it is not newer than the running
+	// build (e.g., for development builds, which have no version).
+	Force bool
+}
+
+// Replace the running binary with the latest release.
+//
+// The release manifest (as written by `rb-gateway release`) and its signature
+// are downloaded over https from the configured `updateUrl`, and the signature
+// is verified against the key embedded in this build (see
+// `version.PublicKey`). If it describes a newer version, the binary
+// for this platform is downloaded, its checksum is verified, and it replaces
+// the running binary. This is meant for single-binary deployments that are
+// not managed by a package manager. A running server keeps using the old
+// binary until it is restarted.
+func SelfUpdate(configPath string, opts SelfUpdateOptions) {
+	manifestUrl := opts.Url
+	if manifestUrl == "" {
+		cfg, err := config.Load(configPath)
+		if err != nil {
+			log.Fatal("Could not parse configuration: ", err.Error())
+		}
+
+		manifestUrl = cfg.UpdateUrl
+	}
+
+	if manifestUrl == "" {
+		log.Fatal("No update URL is configured. Set updateUrl in the configuration or use --url.")
+	}
+
+	if parsed, err := url.Parse(manifestUrl); err != nil || parsed.Scheme != "https" {
+		log.Fatalf(`The update URL "%s" must be an https URL.`, manifestUrl)
+	}
+
+	client := &http.Client{
+		Timeout: selfUpdateTimeout,
+		CheckRedirect: func(request *http.Request, via []*http.Request) error {
+			if request.URL.Scheme != "https" {
+				return fmt.Errorf(`Refusing to follow a redirect to "%s", which is not https.`, request.URL)
+			}
+
+			return nil
+		},
+	}
+
+	manifest, err := fetchManifest(client, manifestUrl)
+	if err != nil {
+		log.Fatalf(`Could not get release manifest from "%s": %s`, manifestUrl, err.Error())
+	}
+
+	current := version.Version
+	newer := current != "" && version.Compare(manifest.Version, current) > 0
+
+	if opts.Check {
+		switch {
+		case current == "":
+			fmt.Printf("The latest release is rb-gateway %s. This is a development build.\n", manifest.Version)
+		case newer:
+			fmt.Printf("rb-gateway %s is available. This is rb-gateway %s.\n", manifest.Version, current)
+		default:
+			fmt.Printf("rb-gateway %s is up to date.\n", current)
+		}
+
+		return
+	}
+
+	if !newer && !opts.Force {
+		if current == "" {
+			log.Fatal("This is a development build of rb-gateway, which cannot be compared to releases. Use --force to replace it anyway.")
+		}
+
+		fmt.Printf("rb-gateway %s is up to date.\n", current)
+		return
+	}
+
+	artifact, ok := manifest.Artifacts[version.Platform()]
+	if !ok {
+		log.Fatalf("rb-gateway %s has no binary for %s. Binaries are available for: %s",
+			manifest.Version, version.Platform(), strings.Join(manifest.Platforms(), ", "))
+	}
+
+	exePath, err := os.Executable()
+	if err == nil {
+		exePath, err = filepath.EvalSymlinks(exePath)
+	}
+
+	if err != nil {
+		log.Fatal("Could not find the rb-gateway binary: ", err.Error())
+	}
+
+	artifactUrl, err := resolveArtifactUrl(manifestUrl, artifact.Url)
+	if err != nil {
+		log.Fatalf(`Invalid URL for the rb-gateway %s binary "%s": %s`, manifest.Version, artifact.Url, err.Error())
+	} else if !strings.HasPrefix(artifactUrl, "https://") {
+		log.Fatalf(`The URL of the rb-gateway %s binary "%s" must be an https URL.`, manifest.Version, artifactUrl)
+	}
+
+	if err = replaceBinary(client, exePath, artifactUrl, artifact.Sha256); err != nil {
+		log.Fatalf("Could not update rb-gateway to %s: %s", manifest.Version, err.Error())
+	}
+
+	if current == "" {
+		current = "a development build"
+	}
+
+	log.Printf("Updated rb-gateway from %s to %s. Restart any running servers to use it.", current, manifest.Version)
+}
+
+// Download, verify, and parse a release manifest.
+//
+// The manifest's detached signature is downloaded from beside it (see
+// `version.SignatureFileName`).
+func fetchManifest(client *http.Client, manifestUrl string) (*version.Manifest, error) {
+	data, err := fetchLimited(client, manifestUrl, maxManifestSize)
+	if err != nil {
+		return nil, err
+	}
+
+	signatureUrl, err := resolveArtifactUrl(manifestUrl, version.SignatureFileName)
+	if err != nil {
+		return nil, err
+	}
+
+	signature, err := fetchLimited(client, signatureUrl, maxManifestSize)
+	if err != nil {
+		return nil, fmt.Errorf(`Could not get the manifest signature from "%s": %s`, signatureUrl, err.Error())
+	}
+
+	if err = version.VerifyManifest(data, signature); err != nil {
+		return nil, err
+	}
+
+	return version.ParseManifest(data)
+}
+
+// Download a small file, failing if it is larger than `limit` bytes.
+func fetchLimited(client *http.Client, fileUrl string, limit int64) ([]byte, error) {
+	rsp, err := client.Get(fileUrl)
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+
+	if rsp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP %d", rsp.StatusCode)
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(rsp.Body, limit+1))
+	if err != nil {
+		return nil, err
+	} else if int64(len(data)) > limit {
+		return nil, fmt.Errorf("The response is larger than %d bytes.", limit)
+	}
+
+	return data, nil
+}
+
+// Return the URL of a binary, which may be relative to the manifest.
+func resolveArtifactUrl(manifestUrl, artifactUrl string) (string, error) {
+	base, err := url.Parse(manifestUrl)
+	if err != nil {
+		return "", err
+	}
+
+	ref, err := url.Parse(artifactUrl)
+	if err != nil {
+		return "", err
+	}
+
+	return base.ResolveReference(ref).String(), nil
+}
+
+// Download a binary and atomically replace the binary at `exePath` with it.
+//
+// The binary is written to a temporary file beside `exePath`, so that it can
+// be renamed into place, and is only used if its checksum matches.
+func replaceBinary(client *http.Client, exePath, binaryUrl, checksum string) error {
+	info, err := os.Stat(exePath)
+	if err != nil {
+		return err
+	}
+
+	rsp, err := client.Get(binaryUrl)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+
+	if rsp.StatusCode != http.StatusOK {
+		return fmt.Errorf(`Could not download "%s": HTTP %d`, binaryUrl, rsp.StatusCode)
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(exePath), ".rb-gateway-update-")
+	if err != nil {
+		return err
+	}
+
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath)
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hash), io.LimitReader(rsp.Body, maxBinarySize+1))
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		return err
+	} else if size > maxBinarySize {
+		return fmt.Errorf("The binary is larger than %d bytes.", int64(maxBinarySize))
+	} else if actual := hex.EncodeToString(hash.Sum(nil)); !strings.EqualFold(actual, checksum) {
+		return fmt.Errorf("The checksum of the downloaded binary (%s) does not match the release manifest (%s).", actual, checksum)
+	}
+
+	if err = os.Chmod(tmpPath, info.Mode().Perm()|0111); err != nil {
+		return err
+	}
+
+	// Windows does not allow a running binary to be replaced, but it does
+	// allow it to be renamed out of the way.
+	if runtime.GOOS == "windows" {
+		oldPath := exePath + ".old"
+		os.Remove(oldPath)
+
+		if err = os.Rename(exePath, oldPath); err != nil {
+			return err
+		}
+	}
+
+	return os.Rename(tmpPath, exePath)
+}
@@ -1,38 +1,51 @@
 package commands
 
 import (
+	"context"
 	"log"
 	"os"
 	"os/signal"
 	"syscall"
 
-	"github.com/reviewboard/rb-gateway/api"
 	"github.com/reviewboard/rb-gateway/config"
+	"github.com/reviewboard/rb-gateway/gateway"
 )
 
-func Serve(configPath string) {
-	var cfg *config.Config
-	configWatcher := config.Watch(configPath)
+// Options for the server.
+type ServeOptions struct {
+	// Whether or not to suppress the startup banner.
+	Quiet bool
 
-	select {
-	case cfg = <-configWatcher.NewConfig:
-		installHooks(cfg, configPath, false)
-		break
+	// The path to a file to write the ID of the server process to, if any.
+	PidFile string
 
-	case <-configWatcher.Errors:
-		log.Fatalf("Unable to load configuration file %s. See installation instructions at http://www.reviewboard.org/docs/rbgateway/latest/installation/",
-			configPath)
-	}
+	// Whether or not to refuse to start if another server is using the same
+	// token and webhook stores.
+	Lock bool
+
+	// A user to create the htpasswd file with, if it does not exist.
+	InitialUser string
+
+	// The file to read the password for InitialUser from ("-" for standard
+	// input). If empty, a random password is generated and printed to the
+	// terminal.
+	InitialPasswordFile string
+}
 
-	if cfg.TokenStorePath == ":memory:" {
-		log.Fatal("Cannot use memory store outside of tests.")
+func Serve(configPath string, opts ServeOptions) {
+	// The server is the only long-running user of the configuration, so it
+	// migrates a legacy configuration before loading it.
+	if err := config.MigrateLegacyConfig(configPath); err != nil {
+		log.Fatal(err)
 	}
 
-	api, err := api.New(cfg)
-	if err != nil {
-		log.Fatalf("Could not create API: %s", err.Error())
+	if opts.InitialUser != "" {
+		createInitialUser(configPath, opts.InitialUser, opts.InitialPasswordFile)
 	}
 
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
 	hup := make(chan os.Signal, 1)
 	signal.Notify(hup, syscall.SIGHUP)
 
@@ -42,64 +55,42 @@ func Serve(configPath string) {
 	terminate := make(chan os.Signal, 1)
 	signal.Notify(terminate, syscall.SIGTERM)
 
-	for {
-		var newCfg *config.Config = nil
-		shouldExit := false
-		log.Println("Starting rb-gateway server on port", cfg.Port)
-		log.Println("Quit the server with CONTROL-C.")
-
-		server := api.Serve()
-
-		select {
-		case newCfg = <-configWatcher.NewConfig:
-			log.Println("Detected configuration change, reloading...")
-
-		case err := <-configWatcher.Errors:
-			log.Fatal("Unexpected error: ", err)
-
-		case <-hup:
-			log.Println("Received SIGHUP, reloading configuration...")
-
-			var err error
-			if newCfg, err = configWatcher.ForceReload(); err != nil {
-				log.Fatal("Unexpected error: ", err)
+	reload := make(chan struct{})
+
+	go func() {
+		for {
+			select {
+			case <-hup:
+				log.Println("Received SIGHUP, reloading configuration...")
+				reload <- struct{}{}
+
+			case <-interrupt:
+				signal.Reset(os.Interrupt)
+				log.Println("Received SIGINT, shutting down...")
+				log.Println("CONTROL-C again to force quit.")
+				cancel()
+				return
+
+			case <-terminate:
+				log.Println("Received SIGTERM, shutting down...")
+				cancel()
+				return
 			}
-
-		case <-interrupt:
-			shouldExit = true
-			signal.Reset(os.Interrupt)
-			log.Println("Received SIGINT, shutting down...")
-			log.Println("CONTROL-C again to force quit.")
-
-		case <-terminate:
-			shouldExit = true
-			log.Println("Received SIGTERM, shutting down...")
 		}
+	}()
 
-		err = api.Shutdown(server)
-		if err != nil {
-			log.Fatalf("An error occurred while shutting down the server: %s", err.Error())
-		}
-
-		log.Println("Server shut down.")
+	err := gateway.Run(ctx, gateway.Options{
+		ConfigPath: configPath,
+		Reload:     reload,
+		Quiet:      opts.Quiet,
+		PidFile:    opts.PidFile,
+		LockStores: opts.Lock,
+	})
 
-		if shouldExit {
-			break
-		}
-
-		if newCfg != nil {
-			if newCfg.TokenStorePath == ":memory:" {
-				log.Println("Failed to reload configuration: cannot use memory store outside of tests.")
-				log.Println("Configuration was not reloaded.")
-			} else if err = api.SetConfig(newCfg); err != nil {
-				log.Printf("Failed to reload configuration: %s\n", err.Error())
-			} else {
-				log.Println("Configuration reloaded.")
-
-				// If we have any new repositories, install hooks for them.
-				// We do not need to force install because configPath has not changed.
-				installHooks(cfg, configPath, false)
-			}
-		}
+	if _, ok := err.(*gateway.LoadError); ok {
+		log.Fatalf("Unable to load configuration file %s. See installation instructions at http://www.reviewboard.org/docs/rbgateway/latest/installation/",
+			configPath)
+	} else if err != nil {
+		log.Fatal(err)
 	}
 }
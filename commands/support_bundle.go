@@ -0,0 +1,359 @@
+package commands
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/reviewboard/rb-gateway/api/tokens"
+	"github.com/reviewboard/rb-gateway/config"
+	"github.com/reviewboard/rb-gateway/repositories"
+	"github.com/reviewboard/rb-gateway/repositories/hooks"
+	"github.com/reviewboard/rb-gateway/version"
+)
+
+// The most of each log file that is included in a support bundle.
+//
+// Only the end of the file is included, since it is the most likely to be
+// relevant.
+const maxSupportLogSize = 1 << 20
+
+// Options for generating a support bundle.
+type SupportBundleOptions struct {
+	// The path to write the bundle to. By default, a file named for the
+	// current time is written to the working directory.
+	Output string
+
+	// The log files to include.
+	LogFiles []string
+}
+
+// Version information for a support bundle.
+type supportVersions struct {
+	// The build of rb-gateway.
+	RbGateway version.Info `json:"rb_gateway"`
+
+	// The Go version rb-gateway was built with.
+	Go string `json:"go"`
+
+	// The operating system and architecture rb-gateway was built for.
+	Platform string `json:"platform"`
+
+	// The module versions rb-gateway was built with, by module path.
+	Modules map[string]string `json:"modules,omitempty"`
+
+	// The output of `git --version`, or why it could not be run.
+	Git string `json:"git"`
+
+	// The output of `hg --version`, or why it could not be run.
+	Hg string `json:"hg"`
+}
+
+// The hooks installed in a repository, for a support bundle.
+type supportRepositoryHooks struct {
+	// The hooks rb-gateway installs.
+	Hooks []repositories.InstalledHook `json:"hooks,omitempty"`
+
+	// Why the hooks could not be read, if they could not be.
+	Error string `json:"error,omitempty"`
+}
+
+// The delivery history of a webhook, for a support bundle.
+type supportWebhookStats struct {
+	// Whether or not the webhook is enabled.
+	Enabled bool `json:"enabled"`
+
+	// The events the webhook is triggered by.
+	Events []string `json:"events"`
+
+	// The repositories the webhook is triggered by.
+	Repositories []string `json:"repos"`
+
+	// The delivery history of the webhook.
+	Status *hooks.HookStatus `json:"status,omitempty"`
+}
+
+// Statistics about the stores, for a support bundle.
+//
+// Only counts and delivery statuses are included, never tokens or webhook
+// URLs and secrets.
+type supportStoreStats struct {
+	// Counts of the API tokens.
+	Tokens *tokens.Stats `json:"tokens,omitempty"`
+
+	// The webhooks, by ID.
+	Webhooks map[string]supportWebhookStats `json:"webhooks,omitempty"`
+
+	// The number of undelivered webhook payloads.
+	DeadLetters int `json:"dead_letters"`
+
+	// Why the stores could not be read, by store.
+	Errors map[string]string `json:"errors,omitempty"`
+}
+
+// Generate a support bundle.
+//
+// The bundle is a gzipped tarball with the configuration (with its secrets
+// redacted), version information, the results of `check-config`, the state of
+// each repository's hooks, statistics about the token and webhook stores, and
+// the end of each log file. As much is included as can be read, so that a
+// bundle can still be generated when the configuration is broken.
+//
+// The path of the bundle is returned.
+func GenerateSupportBundle(configPath string, opts SupportBundleOptions) (string, error) {
+	output := opts.Output
+	if output == "" {
+		output = fmt.Sprintf("rb-gateway-support-%s.tar.gz", time.Now().UTC().Format("20060102-150405"))
+	}
+
+	f, err := os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	gz := gzip.NewWriter(f)
+	bundle := tar.NewWriter(gz)
+	now := time.Now()
+
+	add := func(name string, content []byte) error {
+		err := bundle.WriteHeader(&tar.Header{
+			Name:    name,
+			Mode:    0600,
+			Size:    int64(len(content)),
+			ModTime: now,
+		})
+		if err != nil {
+			return err
+		}
+
+		_, err = bundle.Write(content)
+		return err
+	}
+
+	addJson := func(name string, value interface{}) error {
+		content, err := json.MarshalIndent(value, "", "  ")
+		if err != nil {
+			return err
+		}
+
+		return add(name, append(content, '\n'))
+	}
+
+	cfg, loadErr := config.Load(configPath)
+
+	if err = addRedactedConfig(add, configPath); err != nil {
+		return "", err
+	}
+
+	if err = addJson("version.json", collectVersions()); err != nil {
+		return "", err
+	}
+
+	if err = addJson("check-config.json", RunConfigChecks(configPath)); err != nil {
+		return "", err
+	}
+
+	if loadErr == nil {
+		if err = addJson("hooks.json", collectInstalledHooks(cfg)); err != nil {
+			return "", err
+		}
+
+		if err = addJson("stores.json", collectStoreStats(cfg)); err != nil {
+			return "", err
+		}
+	}
+
+	for _, logFile := range opts.LogFiles {
+		content, err := readLogTail(logFile)
+		if err != nil {
+			content = []byte(fmt.Sprintf("Could not read %s: %s\n", logFile, err.Error()))
+		}
+
+		if err = add("logs/"+filepath.Base(logFile), content); err != nil {
+			return "", err
+		}
+	}
+
+	if err = bundle.Close(); err != nil {
+		return "", err
+	} else if err = gz.Close(); err != nil {
+		return "", err
+	}
+
+	return output, f.Close()
+}
+
+// Generate a support bundle and print its path.
+func SupportBundle(configPath string, opts SupportBundleOptions) {
+	output, err := GenerateSupportBundle(configPath, opts)
+	if err != nil {
+		log.Fatal("Could not generate support bundle: ", err.Error())
+	}
+
+	fmt.Println(output)
+}
+
+// Add the configuration to a support bundle with its secrets redacted.
+//
+// If the configuration cannot be read or parsed, why is added instead. It
+// cannot be included as-is, since it may contain secrets.
+func addRedactedConfig(add func(name string, content []byte) error, configPath string) error {
+	content, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return add("config-error.txt", []byte(err.Error()+"\n"))
+	}
+
+	redacted, err := config.Redact(content)
+	if err != nil {
+		return add("config-error.txt", []byte(fmt.Sprintf("Could not parse configuration: %s\n", err.Error())))
+	}
+
+	return add("config.json", append(redacted, '\n'))
+}
+
+// Return the versions of rb-gateway, Go, and the SCM tools.
+func collectVersions() supportVersions {
+	versions := supportVersions{
+		RbGateway: version.Get(),
+		Go:        runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+		Git:       commandVersion("git"),
+		Hg:        commandVersion("hg"),
+	}
+
+	if info, ok := debug.ReadBuildInfo(); ok {
+		versions.Modules = map[string]string{
+			info.Main.Path: info.Main.Version,
+		}
+
+		for _, dep := range info.Deps {
+			versions.Modules[dep.Path] = dep.Version
+		}
+	}
+
+	return versions
+}
+
+// Return the output of `<command> --version`, or why it could not be run.
+func commandVersion(command string) string {
+	output, err := exec.Command(command, "--version").Output()
+	if err != nil {
+		return fmt.Sprintf("Could not run %s: %s", command, err.Error())
+	}
+
+	// Mercurial prints its license after the version.
+	return strings.TrimSpace(strings.SplitN(string(output), "\n", 2)[0])
+}
+
+// Return the hooks installed in each repository, by repository name.
+func collectInstalledHooks(cfg *config.Config) map[string]supportRepositoryHooks {
+	installed := make(map[string]supportRepositoryHooks, len(cfg.Repositories))
+
+	for name, repo := range cfg.Repositories {
+		var state supportRepositoryHooks
+
+		if repoHooks, err := repositories.GetInstalledHooks(repo); err != nil {
+			state.Error = err.Error()
+		} else {
+			state.Hooks = repoHooks
+		}
+
+		installed[name] = state
+	}
+
+	return installed
+}
+
+// Return statistics about the token, webhook, and dead letter stores.
+func collectStoreStats(cfg *config.Config) supportStoreStats {
+	stats := supportStoreStats{
+		Errors: make(map[string]string),
+	}
+
+	if cfg.TokenStorePath != ":memory:" {
+		if store, err := tokens.NewStore(cfg.TokenStorePath); err != nil {
+			stats.Errors["tokens"] = err.Error()
+		} else {
+			tokenStats := store.Stats()
+			stats.Tokens = &tokenStats
+		}
+	}
+
+	if webhooks, err := hooks.LoadStore(cfg.WebhookStorePath, cfg.RepositorySet()); err != nil {
+		stats.Errors["webhooks"] = err.Error()
+	} else {
+		statusStore := hooks.DeliveryStatusStore{Dir: cfg.WebhookStatusPath}
+		stats.Webhooks = make(map[string]supportWebhookStats, len(webhooks))
+
+		for id, hook := range webhooks {
+			hookStats := supportWebhookStats{
+				Enabled:      hook.Enabled,
+				Events:       hook.Events,
+				Repositories: hook.Repos,
+			}
+
+			if status, err := statusStore.Load(id); err == nil {
+				hookStats.Status = status
+			}
+
+			stats.Webhooks[id] = hookStats
+		}
+	}
+
+	deadLetterStore := hooks.DeadLetterStore{Dir: cfg.WebhookDeadLetterPath}
+	if letters, err := deadLetterStore.List(); err != nil {
+		stats.Errors["deadLetters"] = err.Error()
+	} else {
+		stats.DeadLetters = len(letters)
+	}
+
+	return stats
+}
+
+// Read the end of a log file.
+//
+// If the file is larger than maxSupportLogSize, the partial line at the start
+// of what is read is dropped.
+func readLogTail(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	if stat.Size() <= maxSupportLogSize {
+		return ioutil.ReadAll(f)
+	}
+
+	if _, err = f.Seek(-maxSupportLogSize, io.SeekEnd); err != nil {
+		return nil, err
+	}
+
+	content, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+
+	if i := strings.IndexByte(string(content), '\n'); i != -1 {
+		content = content[i+1:]
+	}
+
+	return content, nil
+}
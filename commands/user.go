@@ -0,0 +1,281 @@
+package commands
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/foomo/htpasswd"
+	"golang.org/x/crypto/ssh/terminal"
+
+	"github.com/reviewboard/rb-gateway/config"
+)
+
+const (
+	// The number of random bytes in a generated password.
+	generatedPasswordSize = 18
+)
+
+// Add a user to the configured htpasswd file.
+//
+// The file is created if it does not exist. The password is prompted for if
+// standard input is a terminal and is otherwise read from the first line of
+// standard input.
+func AddUser(configPath, username string) {
+	updateUser(configPath, username, func(passwords htpasswd.HashedPasswords) error {
+		if _, exists := passwords[username]; exists {
+			return fmt.Errorf(`User "%s" already exists.`, username)
+		}
+
+		return setPassword(passwords, username)
+	})
+}
+
+// Remove a user from the configured htpasswd file.
+func RemoveUser(configPath, username string) {
+	updateUser(configPath, username, func(passwords htpasswd.HashedPasswords) error {
+		if _, exists := passwords[username]; !exists {
+			return fmt.Errorf(`User "%s" does not exist.`, username)
+		}
+
+		delete(passwords, username)
+		return nil
+	})
+}
+
+// Change the password of a user in the configured htpasswd file.
+//
+// The password is read the same way as for AddUser.
+func SetUserPassword(configPath, username string) {
+	updateUser(configPath, username, func(passwords htpasswd.HashedPasswords) error {
+		if _, exists := passwords[username]; !exists {
+			return fmt.Errorf(`User "%s" does not exist.`, username)
+		}
+
+		return setPassword(passwords, username)
+	})
+}
+
+// Create the configured htpasswd file with a single user, if it does not
+// exist.
+//
+// The password is read from the first line of `passwordFile`, or of standard
+// input if it is "-", so that it is not visible in the process list. If no
+// file is given, a random password is generated and printed to the terminal,
+// but never logged. This only happens once, since the file exists afterwards.
+func createInitialUser(configPath, username, passwordFile string) {
+	if !isValidUsername(username) {
+		log.Fatalf(`Invalid username: "%s".`, username)
+	}
+
+	// If the configuration cannot be loaded, the server will report it.
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		return
+	}
+
+	if _, err = os.Stat(cfg.HtpasswdPath); err == nil {
+		return
+	} else if !os.IsNotExist(err) {
+		log.Fatal("Could not read htpasswd file: ", err.Error())
+	}
+
+	var password string
+	generated := passwordFile == ""
+	if generated {
+		if !terminal.IsTerminal(int(os.Stderr.Fd())) {
+			log.Fatal("A generated password can only be shown on a terminal. Use --initial-password-file to choose the password instead.")
+		} else if password, err = generatePassword(); err != nil {
+			log.Fatal("Could not generate password: ", err.Error())
+		}
+	} else if password, err = readPasswordFile(passwordFile); err != nil {
+		log.Fatal("Could not read password: ", err.Error())
+	}
+
+	passwords := make(htpasswd.HashedPasswords)
+	if err = passwords.SetPassword(username, password, htpasswd.HashBCrypt); err != nil {
+		log.Fatal("Could not hash password: ", err.Error())
+	}
+
+	if err = writeHtpasswd(cfg.HtpasswdPath, passwords); err != nil {
+		log.Fatal("Could not write htpasswd file: ", err.Error())
+	}
+
+	log.Printf(`Created htpasswd file "%s" with user "%s".`, cfg.HtpasswdPath, username)
+
+	if generated {
+		fmt.Fprintf(os.Stderr, "The password for %s is: %s\nThis password will not be shown again.\n", username, password)
+	}
+}
+
+// Read a password from the first line of a file, or of standard input if the
+// path is "-".
+func readPasswordFile(path string) (string, error) {
+	var reader io.Reader = os.Stdin
+	if path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			return "", err
+		}
+		defer file.Close()
+
+		reader = file
+	}
+
+	line, err := bufio.NewReader(reader).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+
+	password := strings.TrimRight(line, "\r\n")
+	if password == "" {
+		return "", errors.New("The password is empty.")
+	}
+
+	return password, nil
+}
+
+// Return a random password.
+func generatePassword() (string, error) {
+	raw := make([]byte, generatedPasswordSize)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+// Return whether or not a username can be stored in an htpasswd file.
+func isValidUsername(username string) bool {
+	return username != "" && !strings.ContainsAny(username, ": \t\r\n")
+}
+
+// Load the htpasswd file, apply the update, and write it back.
+func updateUser(configPath, username string, update func(htpasswd.HashedPasswords) error) {
+	if !isValidUsername(username) {
+		log.Fatalf(`Invalid username: "%s".`, username)
+	}
+
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		log.Fatal("Could not parse configuration: ", err.Error())
+	}
+
+	passwords := make(htpasswd.HashedPasswords)
+	if _, err = os.Stat(cfg.HtpasswdPath); err == nil {
+		passwords, err = htpasswd.ParseHtpasswdFile(cfg.HtpasswdPath)
+		if err != nil {
+			log.Fatal("Could not parse htpasswd file: ", err.Error())
+		}
+	} else if !os.IsNotExist(err) {
+		log.Fatal("Could not read htpasswd file: ", err.Error())
+	}
+
+	if err = update(passwords); err != nil {
+		log.Fatal(err.Error())
+	}
+
+	if err = writeHtpasswd(cfg.HtpasswdPath, passwords); err != nil {
+		log.Fatal("Could not write htpasswd file: ", err.Error())
+	}
+}
+
+// Read a password and store its bcrypt hash.
+func setPassword(passwords htpasswd.HashedPasswords, username string) error {
+	password, err := readPassword(username)
+	if err != nil {
+		return err
+	}
+
+	return passwords.SetPassword(username, password, htpasswd.HashBCrypt)
+}
+
+// Read a new password for the user.
+//
+// When standard input is a terminal, the password is prompted for twice
+// without being echoed.
+func readPassword(username string) (string, error) {
+	fd := int(os.Stdin.Fd())
+
+	if !terminal.IsTerminal(fd) {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return "", errors.New("Could not read password from standard input.")
+		}
+
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+
+	fmt.Fprintf(os.Stderr, "New password for %s: ", username)
+	password, err := terminal.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+
+	fmt.Fprint(os.Stderr, "Confirm password: ")
+	confirmation, err := terminal.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+
+	if string(password) != string(confirmation) {
+		return "", errors.New("Passwords do not match.")
+	}
+
+	return string(password), nil
+}
+
+// Write the htpasswd file, sorted by username.
+//
+// The file is replaced atomically so that a running server never reads a
+// partially written file. Existing permissions are preserved; new files are
+// only readable by their owner.
+func writeHtpasswd(path string, passwords htpasswd.HashedPasswords) error {
+	mode := os.FileMode(0600)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+
+	usernames := make([]string, 0, len(passwords))
+	for username := range passwords {
+		usernames = append(usernames, username)
+	}
+	sort.Strings(usernames)
+
+	var content strings.Builder
+	for _, username := range usernames {
+		fmt.Fprintf(&content, "%s:%s\n", username, passwords[username])
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(path), ".htpasswd-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err = f.WriteString(content.String()); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err = f.Close(); err != nil {
+		return err
+	}
+
+	if err = os.Chmod(f.Name(), mode); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
@@ -1,47 +1,170 @@
 package commands
 
 import (
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"log"
-	"net/http"
 	"os"
+	"strings"
 
 	"github.com/reviewboard/rb-gateway/config"
+	"github.com/reviewboard/rb-gateway/gateway"
 	"github.com/reviewboard/rb-gateway/repositories"
 	"github.com/reviewboard/rb-gateway/repositories/events"
-	"github.com/reviewboard/rb-gateway/repositories/hooks"
 )
 
+// Options for replaying an event instead of reading it from a hook.
+type ReplayOptions struct {
+	// The path to a payload as sent to webhooks, or "-" for standard input.
+	PayloadFile string
+
+	// A range of commits (`<start>..<end>`) to create a payload for.
+	CommitRange string
+
+	// The URL of a server to create and deliver the payload for CommitRange,
+	// instead of reading the repository and configuration locally.
+	Server string
+
+	// The path to a file containing an API token for Server.
+	TokenFile string
+}
+
 // Trigger all webhooks that match the repository and event.
-func TriggerWebhooks(configPath, repoName, event string) {
+//
+// The payload is normally parsed from the input of the repository's hook. It
+// can instead be replayed from a file or created for a range of commits, so
+// that events that webhooks missed can be sent again.
+//
+// Events read from a hook, other than gating events, are delivered by a
+// detached process (see `deliverInBackground`), so that the push does not
+// wait for webhooks.
+//
+// If a server is given, the payload for the range of commits is created and
+// delivered by that server instead (see `replayThroughServer`).
+//
+// If `verbose` is true, how the hook was invoked and its environment are
+// logged first.
+//
+// Webhooks that could not be delivered for an event read from a hook are
+// logged rather than returned as an error, since the push has already been
+// accepted and the failures are kept as dead letters to be redriven.
+func TriggerWebhooks(configPath, repoName, event string, replay ReplayOptions, verbose bool) error {
+	if replay.Server != "" {
+		replayThroughServer(repoName, event, replay)
+		return nil
+	}
+
 	cfg, err := config.Load(configPath)
 	if err != nil {
-		log.Fatal("Could not parse configuration: ", err.Error())
+		return fmt.Errorf("Could not parse configuration: %s", err.Error())
 	}
 
 	var repository repositories.Repository
 	var exists bool
 
 	if repository, exists = cfg.Repositories[repoName]; !exists {
-		log.Fatalf(`Unknown repository: "%s".`, repoName)
+		return fmt.Errorf(`Unknown repository: "%s".`, repoName)
 	}
 
 	if !events.IsValidEvent(event) {
-		log.Fatalf(`Unknown event: "%s"`, event)
+		return fmt.Errorf(`Unknown event: "%s"`, event)
 	}
 
-	store, err := hooks.LoadStore(cfg.WebhookStorePath, cfg.RepositorySet())
+	if verbose {
+		logHookEnvironment(repository, event)
+	}
 
+	payload, err := readEventPayload(repository, event, replay)
 	if err != nil {
-		log.Fatal("Could not load webhook store: ", err.Error())
+		if !verbose {
+			return fmt.Errorf("Could not parse event payload: %s (run with --verbose to log the hook environment)", err.Error())
+		}
+
+		return fmt.Errorf("Could not parse event payload: %s", err.Error())
+	} else if payload == nil {
+		return nil
 	}
 
-	payload, err := repository.ParseEventPayload(event, os.Stdin)
-	if err != nil {
-		log.Fatal("Could not parse event payload: ", err.Error())
+	isReplay := replay.PayloadFile != "" || replay.CommitRange != ""
+
+	// Gating events are delivered before the hook exits, since their results
+	// decide whether the push is accepted. Other events from hooks are
+	// delivered in the background, so that the push does not wait for them.
+	// Replays are delivered immediately, so that failures are reported.
+	if !events.IsGatingEvent(event) && !isReplay {
+		err = deliverInBackground(configPath, repoName, event, payload)
+		if err == nil {
+			return nil
+		}
+
+		log.Printf("Could not deliver webhooks in the background, delivering them now: %s", err.Error())
 	}
 
-	err = repositories.InvokeAllHooks(http.DefaultClient, store, event, repository, payload)
-	if err != nil {
-		log.Fatal(err.Error())
+	err = gateway.DispatchEvent(cfg, repository, event, payload)
+	if err == nil {
+		return nil
+	}
+
+	switch {
+	case events.IsGatingEvent(event):
+		// For gating events, exiting unsuccessfully rejects the operation.
+		// The reason is written without the log's timestamp, since the SCM
+		// shows it to the user who pushed.
+		fmt.Fprintf(os.Stderr, "Push rejected: %s\n", err.Error())
+		os.Exit(1)
+
+	case !isReplay:
+		log.Printf(`Could not deliver webhooks for "%s" event for repository "%s": %s`,
+			event, repoName, err.Error())
+		return nil
+	}
+
+	return err
+}
+
+// Read the payload for an event.
+//
+// If no replay options are given, the payload is parsed from the input of the
+// repository's hook.
+func readEventPayload(repository repositories.Repository, event string, replay ReplayOptions) (events.Payload, error) {
+	switch {
+	case replay.PayloadFile != "" && replay.CommitRange != "":
+		return nil, errors.New("Only one of --payload-file and --commit-range can be given.")
+
+	case replay.PayloadFile != "":
+		var data []byte
+		var err error
+
+		if replay.PayloadFile == "-" {
+			data, err = ioutil.ReadAll(os.Stdin)
+		} else {
+			data, err = ioutil.ReadFile(replay.PayloadFile)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		payload, err := events.UnmarshalPayload(event, data)
+		if err != nil {
+			return nil, err
+		} else if payload.GetRepository() != repository.GetName() {
+			return nil, fmt.Errorf(`Payload is for repository "%s", not "%s".`,
+				payload.GetRepository(), repository.GetName())
+		}
+
+		return payload, nil
+
+	case replay.CommitRange != "":
+		revs := strings.SplitN(replay.CommitRange, "..", 2)
+		if len(revs) != 2 || revs[0] == "" || revs[1] == "" {
+			return nil, fmt.Errorf(`Invalid commit range "%s"; expected "<start>..<end>".`, replay.CommitRange)
+		}
+
+		return repository.ParseCommitRange(event, revs[0], revs[1], 0)
+
+	default:
+		return repository.ParseEventPayload(event, os.Stdin)
 	}
 }
@@ -0,0 +1,153 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// The SCM of a repository entry that is a collection of Mercurial
+// repositories.
+const hgCollectionScm = "hg-collection"
+
+// Replace each Mercurial collection in the repository list with the
+// repositories it contains.
+//
+// Like hgweb's `[collections]`, every Mercurial repository found under the
+// collection's path is registered. Each one is named for its path relative to
+// the collection, under the collection's name (e.g., `<collection>/<name>`).
+// Repositories that would have invalid names or that conflict with another
+// repository, and directories that cannot be read, are skipped with a warning,
+// so that one bad entry does not keep the configuration from loading.
+//
+// The directories that were searched are recorded in `HgCollectionDirs` so
+// that they can be watched for new and removed repositories.
+func expandHgCollections(config *Config) error {
+	// Names are compared the way validate() compares them.
+	nameKey := func(name string) string {
+		if config.CaseInsensitiveRepositoryNames {
+			return strings.ToLower(name)
+		}
+
+		return name
+	}
+
+	configured := make(map[string]bool)
+	for _, repo := range config.RepositoryData {
+		if repo.Scm != hgCollectionScm {
+			configured[nameKey(repo.Name)] = true
+		}
+	}
+
+	expanded := make([]RawRepository, 0, len(config.RepositoryData))
+	config.HgCollectionDirs = nil
+
+	for _, repo := range config.RepositoryData {
+		if repo.Scm != hgCollectionScm {
+			expanded = append(expanded, repo)
+			continue
+		}
+
+		if err := validateRepositoryName(repo.Name); err != nil {
+			return err
+		}
+
+		found, dirs, err := findHgRepositories(repo.Path)
+		if err != nil {
+			return fmt.Errorf(`Could not read Mercurial collection "%s": %s`, repo.Name, err.Error())
+		}
+
+		config.HgCollectionDirs = append(config.HgCollectionDirs, dirs...)
+
+		for _, relPath := range found {
+			// Some file systems (e.g., on macOS) store names decomposed, so
+			// names are normalized to NFC, as configured names must be.
+			name := norm.NFC.String(path.Join(repo.Name, relPath))
+
+			if err := validateRepositoryName(name); err != nil {
+				log.Printf(`Skipping repository "%s" in Mercurial collection "%s": %s`, relPath, repo.Name, err.Error())
+				continue
+			} else if configured[nameKey(name)] {
+				log.Printf(`Skipping repository "%s" in Mercurial collection "%s": a repository named "%s" already exists.`,
+					relPath, repo.Name, name)
+				continue
+			}
+
+			configured[nameKey(name)] = true
+			expanded = append(expanded, RawRepository{
+				LargeFiles:    repo.LargeFiles,
+				Name:          name,
+				Path:          filepath.Join(repo.Path, filepath.FromSlash(relPath)),
+				Public:        repo.Public,
+				Scm:           "hg",
+				WebhookSecret: repo.WebhookSecret,
+			})
+		}
+	}
+
+	config.RepositoryData = expanded
+	return nil
+}
+
+// Find the Mercurial repositories under a directory.
+//
+// The paths of the repositories, relative to root and separated by slashes,
+// are returned along with every directory that was searched. Repositories are
+// not searched for nested repositories, and hidden directories are skipped.
+// Only an error reading root itself is returned; directories under it that
+// cannot be read are skipped with a warning.
+func findHgRepositories(root string) (repos []string, dirs []string, err error) {
+	var search func(dir, relPath string) error
+	search = func(dir, relPath string) error {
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil {
+			if relPath == "" {
+				return err
+			}
+
+			log.Printf(`Skipping "%s" while searching for Mercurial repositories: %s`, dir, err.Error())
+			return nil
+		}
+
+		dirs = append(dirs, dir)
+
+		for _, entry := range entries {
+			if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+				continue
+			}
+
+			entryPath := filepath.Join(dir, entry.Name())
+			entryRelPath := path.Join(relPath, entry.Name())
+
+			if isHgRepository(entryPath) {
+				repos = append(repos, entryRelPath)
+			} else if err := search(entryPath, entryRelPath); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	if isHgRepository(root) {
+		return nil, nil, fmt.Errorf(`"%s" is a repository, not a directory of repositories`, root)
+	}
+
+	if err = search(root, ""); err != nil {
+		return nil, nil, err
+	}
+
+	return
+}
+
+// Return whether or not the directory is a Mercurial repository.
+func isHgRepository(dir string) bool {
+	info, err := os.Stat(filepath.Join(dir, ".hg"))
+	return err == nil && info.IsDir()
+}
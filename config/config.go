@@ -1,39 +1,627 @@
 package config
 
 import (
+	"crypto/x509"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
 	"path/filepath"
 	"strings"
+	"time"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
 
 	"github.com/reviewboard/rb-gateway/repositories"
+	"github.com/reviewboard/rb-gateway/repositories/hooks"
 )
 
 const DefaultConfigPath = "config.json"
 
+const (
+	// Identify the users of client certificates by their subject's common
+	// name.
+	ClientCertIdentityCN = "cn"
+
+	// Identify the users of client certificates by their first DNS subject
+	// alternative name or, if they have none, their first email address.
+	ClientCertIdentitySAN = "san"
+)
+
+// The roles granted to users that are authenticated without an rb-gateway
+// token (i.e., OpenID Connect group members and client certificate users).
+//
+// RoleReader is the default, so that users only have more access when it is
+// granted explicitly.
+const (
+	// The role of users that can only read repository data.
+	RoleReader = "reader"
+
+	// The role of users that have full access, including writing and
+	// managing the server.
+	RoleManager = "manager"
+)
+
+const (
+	// Do not log requests.
+	RequestLogLevelNone = "none"
+
+	// Log each request in the Common Log Format.
+	RequestLogLevelNormal = "normal"
+
+	// Log each request in the Common Log Format, followed by its route,
+	// repository, headers, and response headers.
+	RequestLogLevelDebug = "debug"
+)
+
+var (
+	// The middleware used when none is configured.
+	DefaultMiddleware = []string{"logging"}
+
+	// The content types that are compressed when none are configured.
+	DefaultCompressionContentTypes = []string{"application/json", "text/plain"}
+
+	// The owners files that are looked for when none are configured.
+	DefaultOwnersFiles = []string{".github/CODEOWNERS", "CODEOWNERS", "docs/CODEOWNERS"}
+
+	// Path segments that cannot follow a `/` in a repository name, because
+	// the API routes for repositories would be ambiguous.
+	reservedRepositoryNameSegments = map[string]bool{
+		"branches":     true,
+		"commits":      true,
+		"file":         true,
+		"hook-events":  true,
+		"merge-base":   true,
+		"path":         true,
+		"push-payload": true,
+		"refs":         true,
+		"search":       true,
+		"test-event":   true,
+	}
+)
+
 const (
 	defaultPort uint16 = 8888
+
+	// The default timeout for delivering a single webhook, in seconds.
+	defaultWebhookTimeout = 30
+
+	// The default time that payloads are also signed with a webhook's
+	// previous secret after it is rotated, in seconds.
+	defaultWebhookSecretGracePeriod = 24 * 60 * 60
+
+	// The default directory for webhook delivery statuses.
+	defaultWebhookStatusPath = "webhook-status"
+
+	// The default directory for webhook payloads that could not be delivered.
+	defaultWebhookDeadLetterPath = "webhook-dead-letters"
+
+	// The default number of webhook payloads that could not be delivered to
+	// keep.
+	defaultWebhookDeadLetterLimit = 1000
+
+	// The default time to keep webhook payloads that could not be delivered,
+	// in seconds.
+	defaultWebhookDeadLetterMaxAge = 7 * 24 * 60 * 60
+
+	// The default file for the last known heads of polled repositories.
+	defaultPollStatePath = "poll-heads.json"
+
+	// The default fraction of failed deliveries that triggers a notification.
+	defaultErrorRateThreshold = 0.5
+
+	// The default maximum lifetime of a delegated token, in seconds.
+	defaultMaxDelegatedTokenTTL = 60 * 60
+
+	// The default maximum size of a request body, in bytes.
+	defaultMaxRequestBodySize = 1024 * 1024
+
+	// The default number of request/response pairs to keep when recording.
+	defaultRecordingSize = 100
+
+	// The default number of bytes of each body to keep when recording.
+	defaultRecordingMaxBodySize = 64 * 1024
+
+	// The default directory for blobs that clients are redirected to.
+	defaultBlobCacheDir = "blob-cache"
+
+	// The default lifetime of a signed blob URL, in seconds.
+	defaultBlobUrlTTL = 5 * 60
+
+	// The default time after which unused blobs are removed, in seconds.
+	defaultBlobMaxAge = 24 * 60 * 60
+
+	// The default directory for commit indexes.
+	defaultCommitIndexPath = "commit-index"
+
+	// The default size at which responses are compressed, in bytes.
+	defaultCompressionMinSize = 1024
+
+	// The default region for object storage.
+	defaultObjectStorageRegion = "us-east-1"
+
+	// The default and maximum lifetimes of a pre-signed object storage URL,
+	// in seconds. The maximum is imposed by S3.
+	defaultObjectStorageUrlTTL = 5 * 60
+	maxObjectStorageUrlTTL     = 7 * 24 * 60 * 60
+
+	// The default time that each request to object storage may take, in
+	// seconds.
+	defaultObjectStorageTimeout = 5 * 60
+
+	// The default time to wait for a decision from the auth callout, in
+	// seconds.
+	defaultAuthCalloutTimeout = 5
+
+	// The default number of decisions from the auth callout to cache.
+	defaultAuthCalloutCacheSize = 10000
+
+	// The default time that an external command or LDAP server may take to
+	// check credentials, in seconds.
+	defaultAuthProviderTimeout = 10
+
+	// The default claims that identify the user and their groups in OpenID
+	// Connect tokens.
+	defaultOidcUsernameClaim = "sub"
+	defaultOidcGroupsClaim   = "groups"
+
+	// The default allowance for clock differences with the OpenID Connect
+	// issuer when checking token lifetimes, in seconds.
+	defaultOidcClockSkew = 60
+
+	// The default time to wait for the OpenID Connect issuer's keys, in
+	// seconds.
+	defaultOidcTimeout = 10
+
+	// The default time to wait for the Review Board server when checking
+	// compatibility, in seconds.
+	defaultReviewBoardTimeout = 10
+
+	// The default PAM service for the `pam` auth provider.
+	defaultAuthProviderPamService = "rb-gateway"
+
+	// The default environment variables holding the credentials for the `env`
+	// auth provider.
+	defaultAuthProviderUsernameVariable = "RBGATEWAY_USERNAME"
+	defaultAuthProviderPasswordVariable = "RBGATEWAY_PASSWORD"
+
+	// The default rate limits for each token and each client address.
+	defaultTokenRequestsPerSecond = 10
+	defaultTokenBurst             = 20
+	defaultIpRequestsPerSecond    = 50
+	defaultIpBurst                = 100
 )
 
-type RawRepository struct {
-	Name string `json:"name"`
+// Settings for asking an external endpoint whether each request is allowed.
+type AuthCalloutConfig struct {
+	// The URL that authorization requests are posted to. The callout is
+	// disabled when this is empty.
+	Url string `json:"url"`
+
+	// An optional key for signing authorization requests.
+	Secret string `json:"secret"`
+
+	// How long to wait for a decision, in seconds.
+	Timeout int `json:"timeout"`
+
+	// Whether to allow requests when no decision can be made (e.g., when
+	// the endpoint cannot be reached). By default, they are refused.
+	FailOpen bool `json:"failOpen"`
+
+	// How long to cache each decision, in seconds. Decisions are not cached
+	// when this is 0.
+	CacheTTL int `json:"cacheTTL"`
+
+	// The number of decisions to cache.
+	CacheSize int `json:"cacheSize"`
+}
+
+// Return whether or not the auth callout is enabled.
+func (cfg AuthCalloutConfig) Enabled() bool {
+	return cfg.Url != ""
+}
+
+// Settings for checking the credentials used to create sessions.
+type AuthProviderConfig struct {
+	// The name of the provider (e.g., `htpasswd`).
+	Type string `json:"type"`
+
+	// The environment variables holding the username and password, for the
+	// `env` provider.
+	UsernameVariable string `json:"usernameVariable"`
+	PasswordVariable string `json:"passwordVariable"`
+
+	// The command that checks credentials, for the `command` provider.
+	Command string `json:"command"`
+
+	// The URL of the LDAP server (`ldap://` or `ldaps://`), for the `ldap`
+	// provider.
+	LdapUrl string `json:"ldapUrl"`
+
+	// The DN to bind as, with `{username}` in place of the username (e.g.,
+	// `uid={username},ou=people,dc=example,dc=com`).
+	LdapBindDN string `json:"ldapBindDN"`
+
+	// Whether or not to upgrade `ldap://` connections with StartTLS.
+	LdapStartTLS bool `json:"ldapStartTLS"`
+
+	// Whether or not to allow `ldap://` connections without StartTLS, which
+	// send passwords in cleartext.
+	LdapAllowInsecure bool `json:"ldapAllowInsecure"`
+
+	// The path to the CA certificates that the LDAP server's certificate
+	// must be signed by. The system's CA certificates are used if this is
+	// empty.
+	LdapCAPath string `json:"ldapCAPath"`
+
+	// The PAM service to authenticate with, for the `pam` provider.
+	PamService string `json:"pamService"`
+
+	// How long the command may run or the LDAP server may take to respond,
+	// in seconds.
+	Timeout int `json:"timeout"`
+}
+
+// Settings for notifying operators when webhook deliveries fail.
+type NotificationsConfig struct {
+	// An optional Slack- or Mattermost-compatible incoming webhook URL.
+	ChatWebhookUrl string `json:"chatWebhookUrl"`
+
+	// The fraction of deliveries for an event that must fail to trigger a
+	// notification.
+	ErrorRateThreshold float64 `json:"errorRateThreshold"`
+}
+
+// Settings for redirecting requests for large files to signed blob URLs.
+type BlobRedirectConfig struct {
+	// The size, in bytes, at which files are redirected. Redirects are
+	// disabled when this is 0.
+	MinSize int64 `json:"minSize"`
+
+	// The directory that blobs are written to, named for the SHA-256 hashes
+	// of their contents.
+	CacheDir string `json:"cacheDir"`
+
+	// The URL that blobs are served from, if not rb-gateway's `/blobs/`
+	// route (e.g., a CDN in front of it).
+	BaseUrl string `json:"baseUrl"`
+
+	// The key for signing blob URLs. If empty, a random key is used, and URLs
+	// are only valid until the server restarts.
+	Secret string `json:"secret"`
+
+	// How long a signed URL is valid for, in seconds.
+	TTL int `json:"ttl"`
+
+	// How long a blob may go unused before it is removed, in seconds.
+	MaxAge int `json:"maxAge"`
+}
+
+// Return whether or not redirects are enabled.
+func (cfg BlobRedirectConfig) Enabled() bool {
+	return cfg.MinSize > 0
+}
+
+// Settings for accepting OpenID Connect (OAuth2) bearer tokens.
+//
+// Clients present an ID or access token issued by the configured issuer in
+// the `Authorization: Bearer` header instead of an rb-gateway token.
+type OidcConfig struct {
+	// The issuer that tokens must come from (e.g.,
+	// `https://login.example.com/realms/dev`). Bearer tokens are not accepted
+	// when this is empty.
+	Issuer string `json:"issuer"`
+
+	// The URL of the issuer's JSON Web Key Set. If empty, it is discovered
+	// from the issuer's `/.well-known/openid-configuration`.
+	JwksUrl string `json:"jwksUrl"`
+
+	// The audience that tokens must be issued for (usually the client ID
+	// registered for rb-gateway).
+	Audience string `json:"audience"`
+
+	// The claim holding the name of the user.
+	UsernameClaim string `json:"usernameClaim"`
+
+	// The claim holding the user's groups.
+	GroupsClaim string `json:"groupsClaim"`
+
+	// The access granted to members of each group. The group `*` matches
+	// every token. Tokens that match no group are refused.
+	Groups map[string]OidcGroupAccess `json:"groups"`
+
+	// How far the issuer's clock may differ when checking when tokens
+	// expire, in seconds.
+	ClockSkew int `json:"clockSkew"`
+
+	// How long to wait for the issuer's keys, in seconds.
+	Timeout int `json:"timeout"`
+}
+
+// Return whether or not bearer tokens are accepted.
+func (cfg OidcConfig) Enabled() bool {
+	return cfg.Issuer != ""
+}
+
+// The access granted to the members of an OpenID Connect group.
+type OidcGroupAccess struct {
+	// The repositories that members may access. If empty, they may access
+	// all repositories.
+	Repositories []string `json:"repositories"`
+
+	// The role of members: RoleReader (the default) or RoleManager.
+	Role string `json:"role"`
+}
+
+// Settings for uploading archives and blobs to S3-compatible object storage.
+type ObjectStorageConfig struct {
+	// The URL of the storage service. If empty, the AWS S3 endpoint for the
+	// region is used.
+	Endpoint string `json:"endpoint"`
+
+	// The region of the bucket, which is part of each request's signature.
+	Region string `json:"region"`
+
+	// The bucket that objects are uploaded to. Object storage is disabled
+	// when this is empty.
+	Bucket string `json:"bucket"`
+
+	// A prefix for the keys of uploaded objects (e.g., `rb-gateway/`).
+	Prefix string `json:"prefix"`
+
+	// The credentials for the storage service.
+	AccessKeyId     string `json:"accessKeyId"`
+	SecretAccessKey string `json:"secretAccessKey"`
+
+	// Whether to address the bucket as part of the path instead of the host
+	// name, as required by some S3-compatible services.
+	PathStyle bool `json:"pathStyle"`
+
+	// Whether to upload archives and redirect clients to them.
+	Archives bool `json:"archives"`
+
+	// How long a pre-signed URL is valid for, in seconds.
+	UrlTTL int `json:"urlTTL"`
+
+	// How long each request to the storage service may take, in seconds.
+	Timeout int `json:"timeout"`
+}
+
+// Return whether or not object storage is enabled.
+func (cfg ObjectStorageConfig) Enabled() bool {
+	return cfg.Bucket != ""
+}
+
+// Settings for the indexes used to search the commits of repositories with
+// `index` enabled.
+type CommitIndexConfig struct {
+	// The directory that indexes are stored in.
 	Path string `json:"path"`
-	Scm  string `json:"scm"`
+}
+
+// Settings for the `gzip` middleware.
+type CompressionConfig struct {
+	// The gzip compression level, from 1 (fastest) to 9 (smallest). If 0,
+	// the default level is used.
+	Level int `json:"level"`
+
+	// The size, in bytes, at which responses are compressed.
+	MinSize int `json:"minSize"`
+
+	// The content types of responses to compress (e.g., `application/json`).
+	ContentTypes []string `json:"contentTypes"`
+}
+
+// Settings for recording requests and responses for debugging.
+type RecordingConfig struct {
+	// The fraction of requests to record, between 0 and 1. Recording is
+	// disabled when this is 0.
+	SampleRate float64 `json:"sampleRate"`
+
+	// The number of request/response pairs to keep. Once this many have been
+	// recorded, the oldest are discarded.
+	Size int `json:"size"`
+
+	// The maximum number of bytes of each request and response body to keep.
+	MaxBodySize int `json:"maxBodySize"`
+}
+
+// Settings for the `logging` middleware.
+type RequestLoggingConfig struct {
+	// How much to log about each request (`none`, `normal`, or `debug`).
+	Level string `json:"level"`
+
+	// The level for requests to specific routes, keyed by method and path
+	// template (e.g., `GET /repos/{repo:.+}/branches`).
+	Routes map[string]string `json:"routes"`
+}
+
+// Return the level for requests to a route.
+func (cfg RequestLoggingConfig) LevelFor(route string) string {
+	if level, ok := cfg.Routes[route]; ok {
+		return level
+	} else if cfg.Level == "" {
+		return RequestLogLevelNormal
+	}
+
+	return cfg.Level
+}
+
+// Settings for serving the API over TLS.
+type TLSConfig struct {
+	// Whether or not to serve the API over HTTPS.
+	Enabled bool `json:"enabled"`
+
+	// The path to the certificate file.
+	Certificate string `json:"certificate"`
+
+	// The path to the private key file.
+	Key string `json:"key"`
+
+	// The path to a file of CA certificates. If set, clients must present a
+	// certificate signed by one of them.
+	ClientCAPath string `json:"clientCAPath"`
+
+	// The part of a client certificate that identifies its user (`cn` or
+	// `san`). If empty, client certificates do not identify users, and
+	// requests still require a token.
+	ClientCertIdentity string `json:"clientCertIdentity"`
+
+	// The roles of client certificate users (RoleReader or RoleManager), by
+	// user. Users that are not listed have RoleReader.
+	ClientCertRoles map[string]string `json:"clientCertRoles"`
+}
+
+// Load the CA certificates that client certificates must be signed by.
+func (cfg TLSConfig) LoadClientCAs() (*x509.CertPool, error) {
+	content, err := ioutil.ReadFile(cfg.ClientCAPath)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(content) {
+		return nil, fmt.Errorf(`No certificates were found in "%s".`, cfg.ClientCAPath)
+	}
+
+	return pool, nil
+}
+
+// A token bucket rate limit.
+type RateLimit struct {
+	// The number of requests allowed per second, on average.
+	RequestsPerSecond float64 `json:"requestsPerSecond"`
+
+	// The number of requests that can be made at once before being limited.
+	Burst int `json:"burst"`
+}
+
+// Settings for the `ratelimit` middleware.
+type RateLimitConfig struct {
+	// The limit for each client address.
+	PerIp RateLimit `json:"perIp"`
+
+	// The limit for each user, or for each API token that was not created
+	// for a user.
+	PerToken RateLimit `json:"perToken"`
+}
+
+// Settings for checking compatibility with the Review Board server.
+type ReviewBoardConfig struct {
+	// The URL of the Review Board server (e.g.,
+	// `https://reviews.example.com/`). If empty, compatibility is not
+	// checked.
+	Url string `json:"url"`
+
+	// An API token for a Review Board user, for servers that do not allow
+	// anonymous access to the API.
+	ApiToken string `json:"apiToken"`
+
+	// How long to wait for the Review Board server, in seconds.
+	Timeout int `json:"timeout"`
+}
+
+type RawRepository struct {
+	Bare          bool   `json:"bare"`
+	HooksDir      string `json:"hooksDir"`
+	Index         bool   `json:"index"`
+	LargeFiles    bool   `json:"largeFiles"`
+	Name          string `json:"name"`
+	Path          string `json:"path"`
+	PollInterval  int    `json:"pollInterval"`
+	Public        bool   `json:"public"`
+	Scm           string `json:"scm"`
+	WebhookSecret string `json:"webhookSecret"`
 }
 
 type Config struct {
-	HtpasswdPath     string          `json:"htpasswdPath"`
-	Port             uint16          `json:"port"`
-	RepositoryData   []RawRepository `json:"repositories"`
-	SSLCertificate   string          `json:"sslCertificate"`
-	SSLKey           string          `json:"sslKey"`
-	TokenStorePath   string          `json:"tokenStorePath"`
-	UseTLS           bool            `json:"useTLS"`
-	WebhookStorePath string          `json:"webhookStorePath"`
+	AuthCallout                    AuthCalloutConfig       `json:"authCallout"`
+	AuthProvider                   AuthProviderConfig      `json:"authProvider"`
+	BlobRedirect                   BlobRedirectConfig      `json:"blobRedirect"`
+	CaseInsensitiveRepositoryNames bool                    `json:"caseInsensitiveRepositoryNames"`
+	CommitIndex                    CommitIndexConfig       `json:"commitIndex"`
+	Compression                    CompressionConfig       `json:"compression"`
+	DisableTokenCreation           bool                    `json:"disableTokenCreation"`
+	ExternalUrl                    string                  `json:"externalUrl"`
+	Git                            repositories.GitConfig  `json:"git"`
+	Hg                             repositories.HgConfig   `json:"hg"`
+	Hooks                          repositories.HookConfig `json:"hooks"`
+	HtpasswdPath                   string                  `json:"htpasswdPath"`
+	LegacyCompat                   bool                    `json:"legacyCompat"`
+	MaxDelegatedTokenTTL           int                     `json:"maxDelegatedTokenTTL"`
+	MaxFileSize                    int64                   `json:"maxFileSize"`
+	MaxRequestBodySize             int64                   `json:"maxRequestBodySize"`
+	MemoryBudget                   int64                   `json:"memoryBudget"`
+	Middleware                     []string                `json:"middleware"`
+	Notifications                  NotificationsConfig     `json:"notifications"`
+	ObjectStorage                  ObjectStorageConfig     `json:"objectStorage"`
+	Oidc                           OidcConfig              `json:"oidc"`
+	OwnersFiles                    []string                `json:"ownersFiles"`
+	PollStatePath                  string                  `json:"pollStatePath"`
+	Port                           uint16                  `json:"port"`
+	ProxyProtocol                  bool                    `json:"proxyProtocol"`
+	RateLimit                      RateLimitConfig         `json:"rateLimit"`
+	ReadOnlyUsers                  []string                `json:"readOnlyUsers"`
+	Recording                      RecordingConfig         `json:"recording"`
+	RepositoryCheckInterval        int                     `json:"repositoryCheckInterval"`
+	RepositoryData                 []RawRepository         `json:"repositories"`
+	RequestLogging                 RequestLoggingConfig    `json:"requestLogging"`
+	ResponseHeaders                map[string]string       `json:"responseHeaders"`
+	ReviewBoard                    ReviewBoardConfig       `json:"reviewBoard"`
+	SecretsKeyPath                 string                  `json:"secretsKeyPath"`
+	SlowRequestThreshold           int                     `json:"slowRequestThreshold"`
+	SuggestReviewers               bool                    `json:"suggestReviewers"`
+	TLS                            TLSConfig               `json:"tls"`
+	TokenStorePath                 string                  `json:"tokenStorePath"`
+	TrustedProxies                 []string                `json:"trustedProxies"`
+	UpdateUrl                      string                  `json:"updateUrl"`
+	WarmCaches                     bool                    `json:"warmCaches"`
+	WebhookDeadLetterLimit         int                     `json:"webhookDeadLetterLimit"`
+	WebhookDeadLetterMaxAge        int                     `json:"webhookDeadLetterMaxAge"`
+	WebhookDeadLetterPath          string                  `json:"webhookDeadLetterPath"`
+	WebhookSecret                  string                  `json:"webhookSecret"`
+	WebhookSecretGracePeriod       int                     `json:"webhookSecretGracePeriod"`
+	WebhookStatusPath              string                  `json:"webhookStatusPath"`
+	WebhookStorePath               string                  `json:"webhookStorePath"`
+	WebhookTimeout                 int                     `json:"webhookTimeout"`
+	WebhookWorkers                 int                     `json:"webhookWorkers"`
 
 	Repositories map[string]repositories.Repository `json:"-"`
+
+	// The names of repositories that can be read without a token.
+	PublicRepositories map[string]bool `json:"-"`
+
+	// The directories that were searched for repositories in Mercurial
+	// collections.
+	//
+	// See `ConfigWatcher`.
+	HgCollectionDirs []string `json:"-"`
+
+	// The key used to encrypt webhook secrets at rest, loaded from
+	// SecretsKeyPath.
+	//
+	// If nil, webhook secrets are stored in plaintext.
+	SecretsKey *hooks.SecretsKey `json:"-"`
+
+	// The networks of the trusted proxies, parsed from TrustedProxies.
+	TrustedProxyNets []*net.IPNet `json:"-"`
+
+	// The version of the schema of the configuration file.
+	ConfigVersion int `json:"-"`
+
+	// The deprecated keys that were found in the configuration file.
+	Deprecations []Deprecation `json:"-"`
+
+	// Whether or not the configuration file has legacy credentials that have
+	// not been migrated (see MigrateLegacyConfig()).
+	LegacyCredentials bool `json:"-"`
 }
 
 func Load(path string) (*Config, error) {
@@ -42,11 +630,30 @@ func Load(path string) (*Config, error) {
 		return nil, err
 	}
 
+	// Legacy credentials are only migrated by the server and the
+	// `migrate-config` command (see MigrateLegacyConfig()). Until then, they
+	// are ignored.
+	legacyCredentials := hasLegacyCredentials(content)
+
+	var version int
+	if content, version, err = flattenConfig(content); err != nil {
+		return nil, err
+	}
+
+	var deprecations []Deprecation
+	if content, deprecations, err = migrateDeprecatedKeys(content); err != nil {
+		return nil, err
+	}
+
 	var config Config
 	if err = json.Unmarshal(content, &config); err != nil {
 		return nil, err
 	}
 
+	config.ConfigVersion = version
+	config.Deprecations = deprecations
+	config.LegacyCredentials = legacyCredentials
+
 	var cfgDir string
 	if cfgDir, err = filepath.Abs(path); err != nil {
 		return nil, err
@@ -58,20 +665,37 @@ func Load(path string) (*Config, error) {
 		return nil, err
 	}
 
+	repositories.SetGitConfig(config.Git)
+	repositories.SetHookConfig(config.Hooks)
+
+	if err = repositories.SetHgConfig(config.Hg); err != nil {
+		return nil, err
+	}
+
 	config.Repositories = make(map[string]repositories.Repository)
+	config.PublicRepositories = make(map[string]bool)
 
 	for _, repo := range config.RepositoryData {
 		info := repositories.RepositoryInfo{
-			Name: repo.Name,
-			Path: repo.Path,
+			Name:       repo.Name,
+			Path:       repo.Path,
+			LargeFiles: repo.LargeFiles,
 		}
 
 		switch repo.Scm {
 		case "git":
-			config.Repositories[repo.Name] = &repositories.GitRepository{
+			gitRepo := &repositories.GitRepository{
 				RepositoryInfo: info,
+				Bare:           repo.Bare,
+				HooksDir:       repo.HooksDir,
+			}
+
+			if repo.Index {
+				gitRepo.Index = repositories.OpenCommitIndex(config.CommitIndexPath(repo.Name))
 			}
 
+			config.Repositories[repo.Name] = gitRepo
+
 		case "hg":
 			config.Repositories[repo.Name] = &repositories.HgRepository{
 				RepositoryInfo: info,
@@ -79,75 +703,906 @@ func Load(path string) (*Config, error) {
 
 		default:
 			log.Printf("Unknown SCM '%s' while loading configuration '%s'; ignoring.", repo.Scm, path)
+			continue
+		}
+
+		if repo.Public {
+			config.PublicRepositories[repo.Name] = true
 		}
 	}
 
 	return &config, nil
 }
 
-// Return the set of repository names.
+// Return the path of the commit index for a repository.
 //
-// See `hooks.LoadStore()`.
-func (cfg *Config) RepositorySet() (repos map[string]struct{}) {
-	repos = make(map[string]struct{})
-	for name := range cfg.Repositories {
-		repos[name] = struct{}{}
-	}
-	return
+// Grouped repository names contain slashes, so names are escaped.
+func (cfg *Config) CommitIndexPath(name string) string {
+	return filepath.Join(cfg.CommitIndex.Path, url.PathEscape(name)+".idx")
 }
 
-func validate(cfgDir string, config *Config) (err error) {
-	missingFields := []string{}
+// Return the maximum lifetime of a delegated token.
+func (cfg *Config) MaxDelegatedTokenDuration() time.Duration {
+	return time.Duration(cfg.MaxDelegatedTokenTTL) * time.Second
+}
 
-	if config.Port == 0 {
-		log.Printf("WARNING: Port missing from config, defaulting to %d.", defaultPort)
-		config.Port = defaultPort
+// Return how long a request may take before it is logged as slow.
+//
+// Slow requests are not logged if this is 0.
+func (cfg *Config) SlowRequestThresholdDuration() time.Duration {
+	return time.Duration(cfg.SlowRequestThreshold) * time.Millisecond
+}
+
+// Return how often the paths of repositories are checked.
+//
+// Paths are not checked if this is 0.
+func (cfg *Config) RepositoryCheckIntervalDuration() time.Duration {
+	return time.Duration(cfg.RepositoryCheckInterval) * time.Second
+}
+
+// Return the timeout for delivering a single webhook.
+func (cfg *Config) WebhookTimeoutDuration() time.Duration {
+	return time.Duration(cfg.WebhookTimeout) * time.Second
+}
+
+// Return the time that payloads are also signed with a webhook's previous
+// secret after it is rotated.
+func (cfg *Config) WebhookSecretGracePeriodDuration() time.Duration {
+	return time.Duration(cfg.WebhookSecretGracePeriod) * time.Second
+}
+
+// Return how often each repository that is polled for new commits is polled.
+//
+// Repositories that are not polled are not included.
+func (cfg *Config) PollIntervals() map[string]time.Duration {
+	intervals := make(map[string]time.Duration)
+
+	for _, repo := range cfg.RepositoryData {
+		if repo.PollInterval > 0 {
+			intervals[repo.Name] = time.Duration(repo.PollInterval) * time.Second
+		}
 	}
 
-	if len(config.RepositoryData) == 0 {
-		missingFields = append(missingFields, "repositories")
+	return intervals
+}
+
+// Return the store for webhook payloads that could not be delivered.
+func (cfg *Config) DeadLetterStore() *hooks.DeadLetterStore {
+	return &hooks.DeadLetterStore{
+		Dir:        cfg.WebhookDeadLetterPath,
+		MaxLetters: cfg.WebhookDeadLetterLimit,
+		MaxAge:     time.Duration(cfg.WebhookDeadLetterMaxAge) * time.Second,
 	}
+}
 
-	if config.UseTLS {
-		if config.SSLCertificate == "" {
-			missingFields = append(missingFields, "ssl_certificate")
-		} else {
-			config.SSLCertificate = resolvePath(cfgDir, config.SSLCertificate)
-		}
+// Return the default secrets for webhooks that do not have their own.
+func (cfg *Config) WebhookSecrets() hooks.SecretDefaults {
+	secrets := hooks.SecretDefaults{
+		Global:       cfg.WebhookSecret,
+		Repositories: make(map[string]string),
+	}
 
-		if config.SSLKey == "" {
-			missingFields = append(missingFields, "ssl_key")
-		} else {
-			config.SSLKey = resolvePath(cfgDir, config.SSLKey)
+	for _, repo := range cfg.RepositoryData {
+		if repo.WebhookSecret != "" {
+			secrets.Repositories[repo.Name] = repo.WebhookSecret
 		}
 	}
 
-	optionalPathFields := []struct {
-		field        *string
-		name         string
-		defaultValue string
-	}{
-		{&config.TokenStorePath, "tokenStorePath", "tokens.dat"},
-		{&config.HtpasswdPath, "htpasswdPath", "htpasswd"},
-		{&config.WebhookStorePath, "webhookStorePath", "webhooks.json"},
+	return secrets
+}
+
+// Return a webhook dispatcher for the configuration.
+//
+// The dispatcher delivers with the configured timeout, secrets, and delivery
+// status store. Dead letters and failure notifications are left to the caller,
+// since not every delivery should record them.
+func (cfg *Config) NewDispatcher(workers int) *repositories.Dispatcher {
+	dispatcher := repositories.NewDispatcher(http.DefaultClient, workers, cfg.WebhookTimeoutDuration())
+	dispatcher.StatusStore = &hooks.DeliveryStatusStore{Dir: cfg.WebhookStatusPath}
+	dispatcher.Secrets = cfg.WebhookSecrets()
+	dispatcher.SecretsKey = cfg.SecretsKey
+	dispatcher.RejectOnDeliveryFailure = cfg.Hg.PrePushFailClosed
+
+	return dispatcher
+}
+
+// Log warnings about deprecated keys and legacy credentials in the
+// configuration file.
+//
+// The configuration is loaded by every hook and command, so only the server
+// logs these, once when it starts. `check-config` reports them instead.
+func (cfg *Config) LogWarnings() {
+	if cfg.LegacyCredentials {
+		log.Println(`Warning: The "username" and "password" configuration keys are no longer supported and are ignored. ` +
+			"Run `rb-gateway migrate-config` or start the server to move them to an htpasswd file.")
 	}
 
-	for _, fieldInfo := range optionalPathFields {
-		if *fieldInfo.field == "" {
-			log.Printf(`Warning: %s missing from config, defaulting to "%v".`, fieldInfo.name, fieldInfo.defaultValue)
-			*fieldInfo.field = fieldInfo.defaultValue
+	for _, deprecation := range cfg.Deprecations {
+		log.Printf("Warning: %s", deprecation)
+	}
+}
+
+// Return whether or not the user is listed in `readOnlyUsers`.
+func (cfg *Config) IsReadOnlyUser(username string) bool {
+	for _, readOnlyUser := range cfg.ReadOnlyUsers {
+		if readOnlyUser == username {
+			return true
 		}
 	}
 
-	if config.TokenStorePath != ":memory:" {
-		config.TokenStorePath = resolvePath(cfgDir, config.TokenStorePath)
+	return false
+}
+
+// Return whether or not a request log level is valid.
+func isRequestLogLevel(level string) bool {
+	return level == RequestLogLevelNone || level == RequestLogLevelNormal || level == RequestLogLevelDebug
+}
+
+// Return whether or not the address belongs to a proxy listed in
+// `trustedProxies`.
+func (cfg *Config) IsTrustedProxy(ip net.IP) bool {
+	for _, network := range cfg.TrustedProxyNets {
+		if network.Contains(ip) {
+			return true
+		}
 	}
 
-	config.HtpasswdPath = resolvePath(cfgDir, config.HtpasswdPath)
-	config.WebhookStorePath = resolvePath(cfgDir, config.WebhookStorePath)
+	return false
+}
 
-	if len(missingFields) != 0 {
-		err = fmt.Errorf("Some required fields were missing from the configuration: %s.", strings.Join(missingFields, ","))
+// Parse the addresses and networks of trusted proxies.
+//
+// Each entry is either an IP address (e.g., `10.0.0.1`) or a network in CIDR
+// notation (e.g., `10.0.0.0/8`).
+func ParseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(proxies))
+
+	for _, proxy := range proxies {
+		if _, network, err := net.ParseCIDR(proxy); err == nil {
+			networks = append(networks, network)
+		} else if ip := net.ParseIP(proxy); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+		} else {
+			return nil, fmt.Errorf(`"%s" is not an IP address or CIDR network.`, proxy)
+		}
+	}
+
+	return networks, nil
+}
+
+// Return the repository with the given name, or nil if there is none.
+//
+// The name is normalized to NFC first, as configured names are (see
+// validateRepositoryName), so that names that look the same match. If
+// `caseInsensitiveRepositoryNames` is enabled, names are matched regardless
+// of case.
+func (cfg *Config) FindRepository(name string) repositories.Repository {
+	name = norm.NFC.String(name)
+
+	if repo, ok := cfg.Repositories[name]; ok {
+		return repo
+	} else if cfg.CaseInsensitiveRepositoryNames {
+		return cfg.findRepositoryFold(name)
+	}
+
+	return nil
+}
+
+// Return the name of a repository whose name matches the given name except
+// for case, or an empty string if there is none.
+//
+// This is used to explain why a repository could not be found when names are
+// case-sensitive.
+func (cfg *Config) SimilarRepositoryName(name string) string {
+	if repo := cfg.findRepositoryFold(norm.NFC.String(name)); repo != nil {
+		return repo.GetName()
+	}
+
+	return ""
+}
+
+// Return the repository whose name matches the given name regardless of case.
+func (cfg *Config) findRepositoryFold(name string) repositories.Repository {
+	for repoName, repo := range cfg.Repositories {
+		if strings.EqualFold(repoName, name) {
+			return repo
+		}
+	}
+
+	return nil
+}
+
+// Return the set of repository names.
+//
+// See `hooks.LoadStore()`.
+func (cfg *Config) RepositorySet() (repos map[string]struct{}) {
+	repos = make(map[string]struct{})
+	for name := range cfg.Repositories {
+		repos[name] = struct{}{}
+	}
+	return
+}
+
+// Validate a repository name.
+//
+// Names may contain Unicode letters and digits, as well as `-`, `_`, `.`, and
+// `+`. They may be grouped with slashes (e.g., `team/project`), but each
+// component must be non-empty and must not be `.` or `..`.
+//
+// Names must be in Unicode Normalization Form C (NFC), so that names that
+// look the same (e.g., with an accented letter that is composed in one and
+// decomposed in the other) cannot both be configured.
+func validateRepositoryName(name string) error {
+	if name == "" {
+		return errors.New("Repository name cannot be empty.")
+	} else if !norm.NFC.IsNormalString(name) {
+		return fmt.Errorf(`Invalid repository name "%s": names must be in Unicode Normalization Form C (NFC); use "%s".`,
+			name, norm.NFC.String(name))
+	}
+
+	for _, c := range name {
+		if !unicode.IsLetter(c) && !unicode.IsDigit(c) && !unicode.IsMark(c) && !strings.ContainsRune("-_.+/", c) {
+			return fmt.Errorf(`Invalid repository name "%s": names can only contain letters, digits, "-", "_", ".", "+", and "/".`, name)
+		}
+	}
+
+	for i, segment := range strings.Split(name, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return fmt.Errorf(`Invalid repository name "%s": "%s" is not a valid component.`, name, segment)
+		} else if i > 0 && reservedRepositoryNameSegments[segment] {
+			return fmt.Errorf(`Invalid repository name "%s": "%s" cannot follow a "/".`, name, segment)
+		}
+	}
+
+	return nil
+}
+
+// Validate the settings for hooks that post events to the server.
+//
+// If `hooks.url` is not set, hooks post events to this server on localhost.
+// When the server uses TLS, its certificate must then be valid for
+// `localhost`, and it is trusted by the hooks unless `hooks.caPath` is set.
+// If the server also requires client certificates, hooks must be given one.
+func validateApiHooks(cfgDir string, config *Config) error {
+	hooksCfg := &config.Hooks
+
+	if (hooksCfg.ClientCertificate == "") != (hooksCfg.ClientKey == "") {
+		return errors.New("hooks.clientCertificate and hooks.clientKey must be set together.")
+	}
+
+	for _, path := range []*string{&hooksCfg.CAPath, &hooksCfg.ClientCertificate, &hooksCfg.ClientKey} {
+		if *path != "" {
+			*path = resolvePath(cfgDir, *path)
+		}
+	}
+
+	if hooksCfg.Url == "" {
+		if !config.TLS.Enabled {
+			hooksCfg.Url = fmt.Sprintf("http://localhost:%d", config.Port)
+		} else {
+			hooksCfg.Url = fmt.Sprintf("https://localhost:%d", config.Port)
+
+			if err := checkCertificateHost(config.TLS.Certificate, "localhost"); err != nil {
+				return fmt.Errorf("hooks.url must be set to a URL that matches tls.certificate: %s", err.Error())
+			} else if config.TLS.ClientCAPath != "" && hooksCfg.ClientCertificate == "" {
+				return errors.New("hooks.clientCertificate and hooks.clientKey must be set when tls.clientCAPath is set.")
+			}
+
+			if hooksCfg.CAPath == "" {
+				hooksCfg.CAPath = config.TLS.Certificate
+			}
+		}
+	} else if parsed, err := url.Parse(hooksCfg.Url); err != nil || !parsed.IsAbs() || parsed.Host == "" {
+		return fmt.Errorf(`hooks.url "%s" is not an absolute URL.`, hooksCfg.Url)
+	}
+
+	if !strings.HasPrefix(hooksCfg.Url, "https://") && (hooksCfg.CAPath != "" || hooksCfg.ClientCertificate != "") {
+		return errors.New("hooks.caPath and hooks.clientCertificate require an https hooks.url.")
+	}
+
+	hooksCfg.Url = strings.TrimSuffix(hooksCfg.Url, "/")
+	return nil
+}
+
+// Check that the first certificate in a file is valid for a host name.
+func checkCertificateHost(path, host string) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	block, _ := pem.Decode(content)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return fmt.Errorf(`No certificate was found in "%s".`, path)
+	}
+
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return err
+	}
+
+	return cert.VerifyHostname(host)
+}
+
+func validate(cfgDir string, config *Config) (err error) {
+	missingFields := []string{}
+
+	if config.Port == 0 {
+		log.Printf("WARNING: Port missing from config, defaulting to %d.", defaultPort)
+		config.Port = defaultPort
+	}
+
+	if len(config.RepositoryData) == 0 {
+		missingFields = append(missingFields, "repositories")
+	}
+
+	if config.TLS.Enabled {
+		if config.TLS.Certificate == "" {
+			missingFields = append(missingFields, "tls.certificate")
+		} else {
+			config.TLS.Certificate = resolvePath(cfgDir, config.TLS.Certificate)
+		}
+
+		if config.TLS.Key == "" {
+			missingFields = append(missingFields, "tls.key")
+		} else {
+			config.TLS.Key = resolvePath(cfgDir, config.TLS.Key)
+		}
+
+		if config.TLS.ClientCAPath != "" {
+			config.TLS.ClientCAPath = resolvePath(cfgDir, config.TLS.ClientCAPath)
+		}
+	} else if config.TLS.ClientCAPath != "" {
+		return errors.New("tls.clientCAPath requires tls.enabled.")
+	}
+
+	switch config.TLS.ClientCertIdentity {
+	case "":
+	case ClientCertIdentityCN, ClientCertIdentitySAN:
+		if config.TLS.ClientCAPath == "" {
+			return errors.New("tls.clientCertIdentity requires tls.clientCAPath.")
+		}
+
+	default:
+		return fmt.Errorf(`tls.clientCertIdentity must be "%s" or "%s", not "%s".`,
+			ClientCertIdentityCN, ClientCertIdentitySAN, config.TLS.ClientCertIdentity)
+	}
+
+	if len(config.TLS.ClientCertRoles) != 0 && config.TLS.ClientCertIdentity == "" {
+		return errors.New("tls.clientCertRoles requires tls.clientCertIdentity.")
+	}
+
+	for user, role := range config.TLS.ClientCertRoles {
+		if role != RoleReader && role != RoleManager {
+			return fmt.Errorf(`tls.clientCertRoles["%s"] must be "%s" or "%s", not "%s".`,
+				user, RoleReader, RoleManager, role)
+		}
+	}
+
+	optionalPathFields := []struct {
+		field        *string
+		name         string
+		defaultValue string
+	}{
+		{&config.TokenStorePath, "tokenStorePath", "tokens.dat"},
+		{&config.HtpasswdPath, "htpasswdPath", "htpasswd"},
+		{&config.WebhookStorePath, "webhookStorePath", "webhooks.json"},
+	}
+
+	for _, fieldInfo := range optionalPathFields {
+		if *fieldInfo.field == "" {
+			log.Printf(`Warning: %s missing from config, defaulting to "%v".`, fieldInfo.name, fieldInfo.defaultValue)
+			*fieldInfo.field = fieldInfo.defaultValue
+		}
+	}
+
+	if config.TokenStorePath != ":memory:" {
+		config.TokenStorePath = resolvePath(cfgDir, config.TokenStorePath)
+	}
+
+	config.HtpasswdPath = resolvePath(cfgDir, config.HtpasswdPath)
+
+	if config.AuthProvider.LdapCAPath != "" {
+		config.AuthProvider.LdapCAPath = resolvePath(cfgDir, config.AuthProvider.LdapCAPath)
+	}
+	config.WebhookStorePath = resolvePath(cfgDir, config.WebhookStorePath)
+
+	if config.PollStatePath == "" {
+		config.PollStatePath = defaultPollStatePath
+	}
+	config.PollStatePath = resolvePath(cfgDir, config.PollStatePath)
+
+	if config.WebhookStatusPath == "" {
+		config.WebhookStatusPath = defaultWebhookStatusPath
+	}
+	config.WebhookStatusPath = resolvePath(cfgDir, config.WebhookStatusPath)
+
+	if config.WebhookDeadLetterPath == "" {
+		config.WebhookDeadLetterPath = defaultWebhookDeadLetterPath
+	}
+	config.WebhookDeadLetterPath = resolvePath(cfgDir, config.WebhookDeadLetterPath)
+
+	if config.WebhookDeadLetterLimit <= 0 {
+		config.WebhookDeadLetterLimit = defaultWebhookDeadLetterLimit
+	}
+
+	if config.WebhookDeadLetterMaxAge <= 0 {
+		config.WebhookDeadLetterMaxAge = defaultWebhookDeadLetterMaxAge
+	}
+
+	if config.WebhookTimeout <= 0 {
+		config.WebhookTimeout = defaultWebhookTimeout
+	}
+
+	if config.WebhookSecretGracePeriod <= 0 {
+		config.WebhookSecretGracePeriod = defaultWebhookSecretGracePeriod
+	}
+
+	if config.MaxDelegatedTokenTTL <= 0 {
+		config.MaxDelegatedTokenTTL = defaultMaxDelegatedTokenTTL
+	}
+
+	if config.MaxRequestBodySize <= 0 {
+		config.MaxRequestBodySize = defaultMaxRequestBodySize
+	}
+
+	if config.MaxFileSize < 0 {
+		config.MaxFileSize = 0
+	}
+
+	if config.MemoryBudget < 0 {
+		config.MemoryBudget = 0
+	}
+
+	if config.SlowRequestThreshold < 0 {
+		return fmt.Errorf("slowRequestThreshold must not be negative, not %d.", config.SlowRequestThreshold)
+	}
+
+	if config.RepositoryCheckInterval < 0 {
+		return fmt.Errorf("repositoryCheckInterval must not be negative, not %d.", config.RepositoryCheckInterval)
+	}
+
+	if config.AuthCallout.Enabled() {
+		callout := &config.AuthCallout
+
+		if parsed, err := url.Parse(callout.Url); err != nil || !parsed.IsAbs() {
+			return fmt.Errorf(`authCallout.url "%s" is not an absolute URL.`, callout.Url)
+		}
+
+		if callout.Timeout <= 0 {
+			callout.Timeout = defaultAuthCalloutTimeout
+		}
+
+		if callout.Secret != "" && len(callout.Secret) < 20 {
+			return fmt.Errorf("authCallout.secret is too short (%d bytes); secrets must be at least 20 bytes.",
+				len(callout.Secret))
+		}
+
+		if callout.CacheTTL < 0 {
+			return fmt.Errorf("authCallout.cacheTTL must not be negative, not %d.", callout.CacheTTL)
+		}
+
+		if callout.CacheSize <= 0 {
+			callout.CacheSize = defaultAuthCalloutCacheSize
+		}
+	}
+
+	if config.AuthProvider.Timeout < 0 {
+		return fmt.Errorf("authProvider.timeout must not be negative, not %d.", config.AuthProvider.Timeout)
+	} else if config.AuthProvider.Timeout == 0 {
+		config.AuthProvider.Timeout = defaultAuthProviderTimeout
+	}
+
+	if config.AuthProvider.UsernameVariable == "" {
+		config.AuthProvider.UsernameVariable = defaultAuthProviderUsernameVariable
+	}
+
+	if config.AuthProvider.PasswordVariable == "" {
+		config.AuthProvider.PasswordVariable = defaultAuthProviderPasswordVariable
+	}
+
+	if config.AuthProvider.PamService == "" {
+		config.AuthProvider.PamService = defaultAuthProviderPamService
+	}
+
+	if config.Notifications.ErrorRateThreshold <= 0 || config.Notifications.ErrorRateThreshold > 1 {
+		config.Notifications.ErrorRateThreshold = defaultErrorRateThreshold
+	}
+
+	if config.WebhookWorkers <= 0 {
+		config.WebhookWorkers = repositories.DefaultWebhookWorkers
+	}
+
+	if config.Recording.SampleRate < 0 || config.Recording.SampleRate > 1 {
+		return fmt.Errorf("recording.sampleRate must be between 0 and 1, not %v.", config.Recording.SampleRate)
+	}
+
+	if config.RequestLogging.Level == "" {
+		config.RequestLogging.Level = RequestLogLevelNormal
+	}
+
+	if !isRequestLogLevel(config.RequestLogging.Level) {
+		return fmt.Errorf(`requestLogging.level must be "%s", "%s", or "%s", not "%s".`,
+			RequestLogLevelNone, RequestLogLevelNormal, RequestLogLevelDebug, config.RequestLogging.Level)
+	}
+
+	for route, level := range config.RequestLogging.Routes {
+		if !isRequestLogLevel(level) {
+			return fmt.Errorf(`requestLogging.routes["%s"] must be "%s", "%s", or "%s", not "%s".`,
+				route, RequestLogLevelNone, RequestLogLevelNormal, RequestLogLevelDebug, level)
+		}
+	}
+
+	if config.Recording.Size <= 0 {
+		config.Recording.Size = defaultRecordingSize
+	}
+
+	if config.Recording.MaxBodySize <= 0 {
+		config.Recording.MaxBodySize = defaultRecordingMaxBodySize
+	}
+
+	rateLimits := []struct {
+		limit                    *RateLimit
+		requestsPerSecond, burst int
+	}{
+		{&config.RateLimit.PerIp, defaultIpRequestsPerSecond, defaultIpBurst},
+		{&config.RateLimit.PerToken, defaultTokenRequestsPerSecond, defaultTokenBurst},
+	}
+
+	for _, rateLimit := range rateLimits {
+		if rateLimit.limit.RequestsPerSecond <= 0 {
+			rateLimit.limit.RequestsPerSecond = float64(rateLimit.requestsPerSecond)
+		}
+
+		if rateLimit.limit.Burst <= 0 {
+			rateLimit.limit.Burst = rateLimit.burst
+		}
+	}
+
+	if config.Compression.Level < 0 || config.Compression.Level > 9 {
+		return fmt.Errorf("compression.level must be between 1 and 9, not %d.", config.Compression.Level)
+	}
+
+	if config.Compression.MinSize <= 0 {
+		config.Compression.MinSize = defaultCompressionMinSize
+	}
+
+	if config.Compression.ContentTypes == nil {
+		config.Compression.ContentTypes = append([]string(nil), DefaultCompressionContentTypes...)
+	}
+
+	if config.OwnersFiles == nil {
+		config.OwnersFiles = append([]string(nil), DefaultOwnersFiles...)
+	}
+
+	for i, path := range config.OwnersFiles {
+		config.OwnersFiles[i] = strings.TrimPrefix(path, "/")
+		if config.OwnersFiles[i] == "" {
+			return errors.New("ownersFiles must not contain empty paths.")
+		}
+	}
+
+	if config.BlobRedirect.MinSize < 0 {
+		config.BlobRedirect.MinSize = 0
+	}
+
+	if config.BlobRedirect.Enabled() {
+		blobs := &config.BlobRedirect
+
+		if blobs.CacheDir == "" {
+			blobs.CacheDir = defaultBlobCacheDir
+		}
+		blobs.CacheDir = resolvePath(cfgDir, blobs.CacheDir)
+
+		if blobs.TTL <= 0 {
+			blobs.TTL = defaultBlobUrlTTL
+		}
+
+		if blobs.MaxAge <= 0 {
+			blobs.MaxAge = defaultBlobMaxAge
+		}
+
+		if blobs.MaxAge < blobs.TTL {
+			return fmt.Errorf("blobRedirect.maxAge (%d) must not be less than blobRedirect.ttl (%d).", blobs.MaxAge, blobs.TTL)
+		}
+
+		if blobs.Secret != "" && len(blobs.Secret) < 20 {
+			return fmt.Errorf("blobRedirect.secret is too short (%d bytes); secrets must be at least 20 bytes.",
+				len(blobs.Secret))
+		}
+
+		if blobs.BaseUrl != "" {
+			if parsed, err := url.Parse(blobs.BaseUrl); err != nil || !parsed.IsAbs() {
+				return fmt.Errorf(`blobRedirect.baseUrl "%s" is not an absolute URL.`, blobs.BaseUrl)
+			}
+
+			blobs.BaseUrl = strings.TrimSuffix(blobs.BaseUrl, "/")
+		}
+	}
+
+	if config.ObjectStorage.Enabled() {
+		objects := &config.ObjectStorage
+
+		if objects.Region == "" {
+			objects.Region = defaultObjectStorageRegion
+		}
+
+		if objects.Endpoint == "" {
+			objects.Endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", objects.Region)
+		} else if parsed, err := url.Parse(objects.Endpoint); err != nil || !parsed.IsAbs() || parsed.Host == "" {
+			return fmt.Errorf(`objectStorage.endpoint "%s" is not an absolute URL.`, objects.Endpoint)
+		}
+
+		objects.Endpoint = strings.TrimSuffix(objects.Endpoint, "/")
+
+		if objects.AccessKeyId == "" || objects.SecretAccessKey == "" {
+			return errors.New("objectStorage.accessKeyId and objectStorage.secretAccessKey are required when objectStorage.bucket is set.")
+		}
+
+		if objects.UrlTTL <= 0 {
+			objects.UrlTTL = defaultObjectStorageUrlTTL
+		} else if objects.UrlTTL > maxObjectStorageUrlTTL {
+			return fmt.Errorf("objectStorage.urlTTL must not be greater than %d, not %d.", maxObjectStorageUrlTTL, objects.UrlTTL)
+		}
+
+		if objects.Timeout <= 0 {
+			objects.Timeout = defaultObjectStorageTimeout
+		}
+	}
+
+	if config.Oidc.Enabled() {
+		oidc := &config.Oidc
+
+		if parsed, err := url.Parse(oidc.Issuer); err != nil || !parsed.IsAbs() || parsed.Host == "" {
+			return fmt.Errorf(`oidc.issuer "%s" is not an absolute URL.`, oidc.Issuer)
+		}
+
+		if oidc.JwksUrl != "" {
+			if parsed, err := url.Parse(oidc.JwksUrl); err != nil || !parsed.IsAbs() || parsed.Host == "" {
+				return fmt.Errorf(`oidc.jwksUrl "%s" is not an absolute URL.`, oidc.JwksUrl)
+			}
+		}
+
+		if oidc.Audience == "" {
+			return errors.New("oidc.audience is required when oidc.issuer is set.")
+		}
+
+		if len(oidc.Groups) == 0 {
+			return errors.New(`oidc.groups must grant access to at least one group (or "*" for every token).`)
+		}
+
+		for group, access := range oidc.Groups {
+			switch access.Role {
+			case "":
+				access.Role = RoleReader
+				oidc.Groups[group] = access
+
+			case RoleReader, RoleManager:
+
+			default:
+				return fmt.Errorf(`oidc.groups["%s"].role must be "%s" or "%s", not "%s".`,
+					group, RoleReader, RoleManager, access.Role)
+			}
+		}
+
+		if oidc.UsernameClaim == "" {
+			oidc.UsernameClaim = defaultOidcUsernameClaim
+		}
+
+		if oidc.GroupsClaim == "" {
+			oidc.GroupsClaim = defaultOidcGroupsClaim
+		}
+
+		if oidc.ClockSkew < 0 {
+			return fmt.Errorf("oidc.clockSkew must not be negative, not %d.", oidc.ClockSkew)
+		} else if oidc.ClockSkew == 0 {
+			oidc.ClockSkew = defaultOidcClockSkew
+		}
+
+		if oidc.Timeout <= 0 {
+			oidc.Timeout = defaultOidcTimeout
+		}
+	}
+
+	switch config.Hooks.Mode {
+	case "", repositories.HookModeCommand:
+		config.Hooks.Mode = repositories.HookModeCommand
+
+	case repositories.HookModeApi:
+		// Hook tokens are created by whichever process installs the hooks,
+		// so the server must be able to read them from the token store.
+		if config.TokenStorePath == ":memory:" {
+			return fmt.Errorf(`hooks.mode "%s" requires tokenStorePath to be a file.`, repositories.HookModeApi)
+		}
+
+		if err := validateApiHooks(cfgDir, config); err != nil {
+			return err
+		}
+
+	default:
+		return fmt.Errorf(`hooks.mode must be "%s" or "%s", not "%s".`,
+			repositories.HookModeCommand, repositories.HookModeApi, config.Hooks.Mode)
+	}
+
+	if config.ReviewBoard.Url != "" {
+		if parsed, err := url.Parse(config.ReviewBoard.Url); err != nil || !parsed.IsAbs() || parsed.Host == "" {
+			return fmt.Errorf(`reviewBoard.url "%s" is not an absolute URL.`, config.ReviewBoard.Url)
+		}
+
+		config.ReviewBoard.Url = strings.TrimSuffix(config.ReviewBoard.Url, "/")
+	}
+
+	if config.ReviewBoard.Timeout <= 0 {
+		config.ReviewBoard.Timeout = defaultReviewBoardTimeout
+	}
+
+	if config.ExternalUrl != "" {
+		if parsed, err := url.Parse(config.ExternalUrl); err != nil || !parsed.IsAbs() {
+			return fmt.Errorf(`externalUrl "%s" is not an absolute URL.`, config.ExternalUrl)
+		}
+
+		config.ExternalUrl = strings.TrimSuffix(config.ExternalUrl, "/")
+	}
+
+	if config.UpdateUrl != "" {
+		if parsed, err := url.Parse(config.UpdateUrl); err != nil || !parsed.IsAbs() {
+			return fmt.Errorf(`updateUrl "%s" is not an absolute URL.`, config.UpdateUrl)
+		} else if parsed.Scheme != "https" {
+			return fmt.Errorf(`updateUrl "%s" must use https.`, config.UpdateUrl)
+		}
+	}
+
+	if config.TrustedProxyNets, err = ParseTrustedProxies(config.TrustedProxies); err != nil {
+		return fmt.Errorf("Invalid trustedProxies: %s", err.Error())
+	}
+
+	if config.ProxyProtocol && len(config.TrustedProxies) == 0 {
+		return errors.New("trustedProxies is required when proxyProtocol is enabled.")
+	}
+
+	if config.WebhookSecret != "" && len(config.WebhookSecret) < 20 {
+		return fmt.Errorf("webhookSecret is too short (%d bytes); secrets must be at least 20 bytes.",
+			len(config.WebhookSecret))
+	}
+
+	for _, repo := range config.RepositoryData {
+		if repo.WebhookSecret != "" && len(repo.WebhookSecret) < 20 {
+			return fmt.Errorf(`webhookSecret for repository "%s" is too short (%d bytes); secrets must be at least 20 bytes.`,
+				repo.Name, len(repo.WebhookSecret))
+		}
+	}
+
+	if config.SecretsKeyPath != "" {
+		config.SecretsKeyPath = resolvePath(cfgDir, config.SecretsKeyPath)
+
+		if config.SecretsKey, err = hooks.LoadSecretsKey(config.SecretsKeyPath); err != nil {
+			return fmt.Errorf("Could not load secretsKeyPath: %s", err.Error())
+		}
+	}
+
+	if config.Middleware == nil {
+		config.Middleware = append([]string(nil), DefaultMiddleware...)
+	}
+
+	for name := range config.ResponseHeaders {
+		if name == "" || strings.ContainsAny(name, " \t\r\n:") {
+			return fmt.Errorf(`Invalid response header name: "%s".`, name)
+		}
+	}
+
+	if err = expandHgCollections(config); err != nil {
+		return err
+	}
+
+	repoNames := make(map[string]string)
+	for _, repo := range config.RepositoryData {
+		key := repo.Name
+		if config.CaseInsensitiveRepositoryNames {
+			key = strings.ToLower(key)
+		}
+
+		if err = validateRepositoryName(repo.Name); err != nil {
+			return err
+		} else if existing, ok := repoNames[key]; ok && existing == repo.Name {
+			return fmt.Errorf(`Duplicate repository name: "%s".`, repo.Name)
+		} else if ok {
+			return fmt.Errorf(`Repository names "%s" and "%s" differ only by case.`, existing, repo.Name)
+		}
+
+		repoNames[key] = repo.Name
+	}
+
+	// Group access refers to repositories by name, so the names are made to
+	// match the configured names exactly.
+	for group, access := range config.Oidc.Groups {
+		for i, name := range access.Repositories {
+			key := name
+			if config.CaseInsensitiveRepositoryNames {
+				key = strings.ToLower(key)
+			}
+
+			repoName, ok := repoNames[key]
+			if !ok {
+				return fmt.Errorf(`oidc.groups["%s"] refers to unknown repository "%s".`, group, name)
+			}
+
+			access.Repositories[i] = repoName
+		}
+	}
+
+	if config.CommitIndex.Path == "" {
+		config.CommitIndex.Path = defaultCommitIndexPath
+	}
+	config.CommitIndex.Path = resolvePath(cfgDir, config.CommitIndex.Path)
+
+	for _, repo := range config.RepositoryData {
+		if repo.Index && repo.Scm != "git" {
+			return fmt.Errorf(`Repository "%s" cannot be indexed; only Git repositories can be indexed.`, repo.Name)
+		}
+	}
+
+	if config.Hooks.Path != "" {
+		config.Hooks.Path = resolvePath(cfgDir, config.Hooks.Path)
+	}
+
+	for i := range config.RepositoryData {
+		repo := &config.RepositoryData[i]
+		if repo.HooksDir == "" {
+			continue
+		} else if repo.Scm != "git" {
+			return fmt.Errorf(`Repository "%s" cannot have a hooksDir; only Git repositories can have one.`, repo.Name)
+		}
+
+		repo.HooksDir = resolvePath(cfgDir, repo.HooksDir)
+	}
+
+	for _, repo := range config.RepositoryData {
+		if repo.PollInterval < 0 {
+			return fmt.Errorf(`Repository "%s" has a negative poll interval.`, repo.Name)
+		}
+	}
+
+	// A bare repository whose path is missing (e.g., because its file system
+	// is not mounted yet) is reported by the path monitor instead, so that
+	// the other repositories can still be served.
+	for _, repo := range config.RepositoryData {
+		if !repo.Bare {
+			continue
+		} else if repo.Scm != "git" {
+			return fmt.Errorf(`Repository "%s" cannot be bare; only Git repositories can be bare.`, repo.Name)
+		} else if _, statErr := os.Stat(repo.Path); os.IsNotExist(statErr) {
+			continue
+		} else if err = repositories.CheckBareGitRepository(repo.Path); err != nil {
+			return fmt.Errorf(`Invalid bare repository "%s": %s.`, repo.Name, err.Error())
+		}
+	}
+
+	if len(missingFields) != 0 {
+		err = fmt.Errorf("Some required fields were missing from the configuration: %s.", strings.Join(missingFields, ","))
+	}
+
+	if err == nil {
+		for _, repo := range config.RepositoryData {
+			if repo.Scm == "git" {
+				err = config.Git.Validate()
+				break
+			}
+		}
+	}
+
+	if err == nil {
+		for _, repo := range config.RepositoryData {
+			if repo.Scm == "hg" {
+				err = config.Hg.Validate()
+				break
+			}
+		}
 	}
 
 	return
@@ -0,0 +1,157 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// A configuration key that has been replaced by another.
+type deprecatedKey struct {
+	// The dotted path of the deprecated key (e.g., `sslKey`).
+	old string
+
+	// The dotted path of the key that replaces it (e.g., `tls.key`).
+	new string
+
+	// The version of rb-gateway that will no longer accept the deprecated
+	// key.
+	removedIn string
+}
+
+// The configuration keys that have been replaced.
+//
+// Deprecated keys are moved to their replacements before the configuration
+// is parsed, so the rest of the configuration only has to handle the new
+// keys. Keys are moved in order, so a key can be replaced more than once.
+var deprecatedKeys = []deprecatedKey{
+	{"sslCertificate", "tls.certificate", "3.0"},
+	{"sslKey", "tls.key", "3.0"},
+	{"useTLS", "tls.enabled", "3.0"},
+}
+
+// A deprecated key that was found in a configuration.
+type Deprecation struct {
+	// The deprecated key.
+	Key string `json:"key"`
+
+	// The key that replaces it.
+	Replacement string `json:"replacement"`
+
+	// The version of rb-gateway that will no longer accept the deprecated
+	// key.
+	RemovedIn string `json:"removed_in"`
+}
+
+// Return the warning for the deprecated key.
+func (d Deprecation) String() string {
+	return fmt.Sprintf(`The "%s" configuration key is deprecated and will be removed in rb-gateway %s. Use "%s" instead.`,
+		d.Key, d.RemovedIn, d.Replacement)
+}
+
+// Move deprecated keys in a configuration to the keys that replace them.
+//
+// The content of the configuration is returned, along with the deprecated
+// keys that were found. If a deprecated key and its replacement are both
+// set, an error is returned, since it is not clear which was intended.
+func migrateDeprecatedKeys(content []byte) ([]byte, []Deprecation, error) {
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber()
+
+	var fields map[string]interface{}
+	if err := decoder.Decode(&fields); err != nil {
+		return nil, nil, err
+	}
+
+	deprecations := []Deprecation{}
+
+	for _, key := range deprecatedKeys {
+		value, ok := lookupKey(fields, key.old)
+		if !ok {
+			continue
+		}
+
+		if _, ok = lookupKey(fields, key.new); ok {
+			return nil, nil, fmt.Errorf(`"%s" and "%s" cannot both be set; remove the deprecated "%s".`,
+				key.old, key.new, key.old)
+		}
+
+		if err := setKey(fields, key.new, value); err != nil {
+			return nil, nil, err
+		}
+
+		deleteKey(fields, key.old)
+
+		deprecations = append(deprecations, Deprecation{
+			Key:         key.old,
+			Replacement: key.new,
+			RemovedIn:   key.removedIn,
+		})
+	}
+
+	if len(deprecations) == 0 {
+		return content, deprecations, nil
+	}
+
+	migrated, err := json.Marshal(fields)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return migrated, deprecations, nil
+}
+
+// Return the value of a dotted key, if it is set.
+func lookupKey(fields map[string]interface{}, key string) (interface{}, bool) {
+	parts := strings.Split(key, ".")
+
+	for _, part := range parts[:len(parts)-1] {
+		section, ok := fields[part].(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+
+		fields = section
+	}
+
+	value, ok := fields[parts[len(parts)-1]]
+	return value, ok
+}
+
+// Set the value of a dotted key, creating any sections it is in.
+func setKey(fields map[string]interface{}, key string, value interface{}) error {
+	parts := strings.Split(key, ".")
+
+	for i, part := range parts[:len(parts)-1] {
+		if _, ok := fields[part]; !ok {
+			fields[part] = make(map[string]interface{})
+		}
+
+		section, ok := fields[part].(map[string]interface{})
+		if !ok {
+			return fmt.Errorf(`"%s" must be an object.`, strings.Join(parts[:i+1], "."))
+		}
+
+		fields = section
+	}
+
+	fields[parts[len(parts)-1]] = value
+	return nil
+}
+
+// Remove a dotted key.
+func deleteKey(fields map[string]interface{}, key string) {
+	parts := strings.Split(key, ".")
+
+	for _, part := range parts[:len(parts)-1] {
+		section, ok := fields[part].(map[string]interface{})
+		if !ok {
+			return
+		}
+
+		fields = section
+	}
+
+	delete(fields, parts[len(parts)-1])
+}
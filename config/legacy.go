@@ -0,0 +1,182 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/foomo/htpasswd"
+)
+
+// The suffix for the copy of a configuration file made before it is
+// migrated.
+const legacyBackupSuffix = ".legacy"
+
+// The credentials from a configuration written for rb-gateway 1.0.
+//
+// These versions stored a single username and password in the configuration
+// file instead of in an htpasswd file.
+type legacyCredentials struct {
+	Username *string `json:"username"`
+	Password *string `json:"password"`
+}
+
+// Return whether or not the content of a configuration file has the legacy
+// credentials.
+func hasLegacyCredentials(content []byte) bool {
+	var credentials legacyCredentials
+	if err := json.Unmarshal(content, &credentials); err != nil {
+		return false
+	}
+
+	return credentials.Username != nil || credentials.Password != nil
+}
+
+// Migrate a configuration file from the legacy format, if necessary.
+//
+// The embedded credentials are added to the htpasswd file (which is created
+// if it does not exist) and removed from the configuration file. If the user
+// is already in the htpasswd file, their password there is kept. The original
+// file is kept alongside it with a `.legacy` suffix.
+//
+// This is only done by the server when it starts and by the `migrate-config`
+// command, since Load() is also used by hooks and other commands that should
+// not rewrite the configuration.
+func MigrateLegacyConfig(path string) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var credentials legacyCredentials
+	if err := json.Unmarshal(content, &credentials); err != nil {
+		return err
+	}
+
+	if credentials.Username == nil && credentials.Password == nil {
+		return nil
+	}
+
+	if err = migrateLegacyCredentials(path, content, credentials); err != nil {
+		return fmt.Errorf(
+			"The configuration uses the legacy \"username\" and \"password\" keys, which are no "+
+				"longer supported, and could not be migrated automatically: %s. Add the user to an "+
+				"htpasswd file (e.g., with `rb-gateway user add`), set \"htpasswdPath\", and remove "+
+				"these keys.",
+			err.Error())
+	}
+
+	return nil
+}
+
+// Move the legacy credentials into the htpasswd file and rewrite the
+// configuration without them.
+func migrateLegacyCredentials(path string, content []byte, credentials legacyCredentials) error {
+	if credentials.Username == nil || *credentials.Username == "" {
+		return fmt.Errorf(`"username" is missing`)
+	} else if credentials.Password == nil || *credentials.Password == "" {
+		return fmt.Errorf(`"password" is missing`)
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(content, &fields); err != nil {
+		return err
+	}
+
+	cfgDir, err := filepath.Abs(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+
+	htpasswdPath := "htpasswd"
+	if raw, ok := fields["htpasswdPath"]; ok {
+		if err = json.Unmarshal(raw, &htpasswdPath); err != nil {
+			return fmt.Errorf(`"htpasswdPath" is invalid: %s`, err.Error())
+		}
+	} else if fields["htpasswdPath"], err = json.Marshal(htpasswdPath); err != nil {
+		return err
+	}
+
+	backupPath := path + legacyBackupSuffix
+	if _, err = os.Stat(backupPath); err == nil {
+		return fmt.Errorf(`"%s" already exists`, backupPath)
+	}
+
+	delete(fields, "username")
+	delete(fields, "password")
+
+	migrated, err := json.MarshalIndent(fields, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	htpasswdPath = resolvePath(cfgDir, htpasswdPath)
+
+	passwords, err := htpasswd.ParseHtpasswdFile(htpasswdPath)
+	if os.IsNotExist(err) {
+		passwords = make(htpasswd.HashedPasswords)
+	} else if err != nil {
+		return fmt.Errorf(`could not read "%s": %s`, htpasswdPath, err.Error())
+	}
+
+	if _, exists := passwords[*credentials.Username]; exists {
+		log.Printf(`The user "%s" from the legacy configuration is already in "%s", so their password there was kept.`,
+			*credentials.Username, htpasswdPath)
+	} else if err = passwords.SetPassword(*credentials.Username, *credentials.Password, htpasswd.HashBCrypt); err != nil {
+		return err
+	} else if err = writeFileAtomic(htpasswdPath, passwords.Bytes(), 0600); err != nil {
+		return fmt.Errorf(`could not update "%s": %s`, htpasswdPath, err.Error())
+	}
+
+	if err = writeFileAtomic(backupPath, content, 0600); err != nil {
+		return err
+	}
+
+	mode := os.FileMode(0600)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+
+	if err = writeFileAtomic(path, append(migrated, '\n'), mode); err != nil {
+		return err
+	}
+
+	log.Printf(`Migrated the legacy configuration "%s": the credentials for "%s" were moved to "%s", and the original was saved to "%s".`,
+		path, *credentials.Username, htpasswdPath, backupPath)
+
+	return nil
+}
+
+// Write a file by writing a temporary file beside it and renaming it, so that
+// the file is never left partially written.
+func writeFileAtomic(path string, content []byte, mode os.FileMode) error {
+	file, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+
+	if _, err = file.Write(content); err == nil {
+		err = file.Sync()
+	}
+
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = os.Chmod(file.Name(), mode)
+	}
+
+	if err == nil {
+		err = os.Rename(file.Name(), path)
+	}
+
+	if err != nil {
+		os.Remove(file.Name())
+	}
+
+	return err
+}
@@ -0,0 +1,108 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/url"
+)
+
+// The value that secrets are replaced with by Redact.
+const RedactedValue = "[REDACTED]"
+
+// The configuration keys whose values are secrets, in any section.
+//
+// The environment variables for Mercurial (`hg.env`) are redacted as a whole,
+// since any of them may hold credentials. The password is only found in
+// legacy configurations that have not been migrated yet.
+var secretKeys = map[string]bool{
+	"accessKeyId":     true,
+	"apiToken":        true,
+	"chatWebhookUrl":  true,
+	"env":             true,
+	"password":        true,
+	"secret":          true,
+	"secretAccessKey": true,
+	"webhookSecret":   true,
+}
+
+// Return a copy of the content of a configuration file with its secrets
+// redacted.
+//
+// Both version 1 and version 2 configurations are supported, since the keys
+// that hold secrets have the same names in each. Empty secrets are left as
+// they are, so that it is clear which were set. Passwords are also removed
+// from URLs in any other values (see RedactUrls).
+func Redact(content []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber()
+
+	var fields interface{}
+	if err := decoder.Decode(&fields); err != nil {
+		return nil, err
+	}
+
+	return json.MarshalIndent(redactValue(fields), "", "    ")
+}
+
+// Redact the secrets in a parsed JSON value.
+func redactValue(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		for key, child := range value {
+			if secretKeys[key] && !isEmptyValue(child) {
+				value[key] = RedactedValue
+			} else {
+				value[key] = redactValue(child)
+			}
+		}
+
+	case []interface{}:
+		for i, child := range value {
+			value[i] = redactValue(child)
+		}
+
+	case string:
+		return RedactUrls(value)
+	}
+
+	return value
+}
+
+// Remove the passwords from any URLs in a value.
+//
+// Mercurial prefixes the location in HG_URL with the source of the changesets
+// (e.g., `remote:https:`), so URLs are looked for after each colon.
+func RedactUrls(value string) string {
+	for i := 0; i < len(value); i++ {
+		if i != 0 && value[i-1] != ':' {
+			continue
+		}
+
+		u, err := url.Parse(value[i:])
+		if err != nil || u.User == nil {
+			continue
+		}
+
+		if _, hasPassword := u.User.Password(); hasPassword {
+			return value[:i] + u.Redacted()
+		}
+	}
+
+	return value
+}
+
+// Return whether or not a parsed JSON value is null or empty.
+func isEmptyValue(value interface{}) bool {
+	switch value := value.(type) {
+	case nil:
+		return true
+
+	case string:
+		return value == ""
+
+	case map[string]interface{}:
+		return len(value) == 0
+	}
+
+	return false
+}
@@ -0,0 +1,185 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// The newest version of the configuration schema.
+//
+// Version 1 configurations have every key at the top level. Version 2
+// configurations group them into sections, and must set `configVersion` to 2.
+const latestConfigVersion = 2
+
+// The sections of a version 2 configuration.
+var configSections = []string{
+	"auth",
+	"logging",
+	"repositories",
+	"server",
+	"stores",
+	"tls",
+	"webhooks",
+}
+
+// The keys of a version 2 configuration, and the version 1 keys they
+// correspond to.
+//
+// Version 2 configurations are converted to version 1 before they are
+// parsed, so every key that is added to Config must also be added here.
+var configSectionKeys = []struct {
+	// The dotted path of the key in a version 2 configuration.
+	path string
+
+	// The key in a version 1 configuration.
+	key string
+}{
+	{"auth.callout", "authCallout"},
+	{"auth.disableTokenCreation", "disableTokenCreation"},
+	{"auth.htpasswd", "htpasswdPath"},
+	{"auth.maxDelegatedTokenTTL", "maxDelegatedTokenTTL"},
+	{"auth.oidc", "oidc"},
+	{"auth.provider", "authProvider"},
+	{"auth.readOnlyUsers", "readOnlyUsers"},
+
+	{"logging.recording", "recording"},
+	{"logging.requests", "requestLogging"},
+	{"logging.slowRequestThreshold", "slowRequestThreshold"},
+
+	{"repositories.caseInsensitiveNames", "caseInsensitiveRepositoryNames"},
+	{"repositories.checkInterval", "repositoryCheckInterval"},
+	{"repositories.git", "git"},
+	{"repositories.hg", "hg"},
+	{"repositories.hooks", "hooks"},
+	{"repositories.list", "repositories"},
+	{"repositories.ownersFiles", "ownersFiles"},
+
+	{"server.blobRedirect", "blobRedirect"},
+	{"server.compression", "compression"},
+	{"server.externalUrl", "externalUrl"},
+	{"server.legacyCompat", "legacyCompat"},
+	{"server.maxFileSize", "maxFileSize"},
+	{"server.maxRequestBodySize", "maxRequestBodySize"},
+	{"server.memoryBudget", "memoryBudget"},
+	{"server.middleware", "middleware"},
+	{"server.port", "port"},
+	{"server.proxyProtocol", "proxyProtocol"},
+	{"server.rateLimit", "rateLimit"},
+	{"server.responseHeaders", "responseHeaders"},
+	{"server.reviewBoard", "reviewBoard"},
+	{"server.trustedProxies", "trustedProxies"},
+	{"server.updateUrl", "updateUrl"},
+	{"server.warmCaches", "warmCaches"},
+
+	{"stores.commitIndex", "commitIndex"},
+	{"stores.objects", "objectStorage"},
+	{"stores.secretsKey", "secretsKeyPath"},
+	{"stores.tokens", "tokenStorePath"},
+	{"stores.webhookDeadLetters", "webhookDeadLetterPath"},
+	{"stores.webhookStatus", "webhookStatusPath"},
+	{"stores.webhooks", "webhookStorePath"},
+
+	{"tls", "tls"},
+
+	{"webhooks.deadLetterLimit", "webhookDeadLetterLimit"},
+	{"webhooks.deadLetterMaxAge", "webhookDeadLetterMaxAge"},
+	{"webhooks.notifications", "notifications"},
+	{"webhooks.secret", "webhookSecret"},
+	{"webhooks.secretGracePeriod", "webhookSecretGracePeriod"},
+	{"webhooks.suggestReviewers", "suggestReviewers"},
+	{"webhooks.timeout", "webhookTimeout"},
+	{"webhooks.workers", "webhookWorkers"},
+}
+
+// Convert a configuration to the version 1 schema, if necessary.
+//
+// The content of the converted configuration is returned, along with the
+// version of the original. Keys that are not part of the version 2 schema are
+// rejected, rather than ignored, since a key in the wrong section would
+// otherwise silently have no effect.
+func flattenConfig(content []byte) ([]byte, int, error) {
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber()
+
+	var fields map[string]interface{}
+	if err := decoder.Decode(&fields); err != nil {
+		return nil, 0, err
+	}
+
+	rawVersion, ok := fields["configVersion"]
+	if !ok {
+		return content, 1, nil
+	}
+
+	version, err := parseConfigVersion(rawVersion)
+	if err != nil {
+		return nil, 0, err
+	} else if version == 1 {
+		return content, version, nil
+	}
+
+	flattened := make(map[string]interface{})
+	delete(fields, "configVersion")
+
+	for key := range fields {
+		if !isConfigSection(key) {
+			return nil, 0, fmt.Errorf(`"%s" is not a configuration section. Configuration version %d groups keys into these sections: %s.`,
+				key, version, strings.Join(configSections, ", "))
+		}
+	}
+
+	for _, entry := range configSectionKeys {
+		if value, ok := lookupKey(fields, entry.path); ok {
+			flattened[entry.key] = value
+			deleteKey(fields, entry.path)
+		}
+	}
+
+	unknown := []string{}
+	for section, value := range fields {
+		keys, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, 0, fmt.Errorf(`"%s" must be an object.`, section)
+		}
+
+		for key := range keys {
+			unknown = append(unknown, fmt.Sprintf(`"%s.%s"`, section, key))
+		}
+	}
+
+	if len(unknown) != 0 {
+		sort.Strings(unknown)
+		return nil, 0, fmt.Errorf("Unknown configuration keys: %s.", strings.Join(unknown, ", "))
+	}
+
+	if content, err = json.Marshal(flattened); err != nil {
+		return nil, 0, err
+	}
+
+	return content, version, nil
+}
+
+// Parse the `configVersion` of a configuration.
+func parseConfigVersion(value interface{}) (int, error) {
+	if number, ok := value.(json.Number); ok {
+		if version, err := number.Int64(); err == nil && version >= 1 && version <= latestConfigVersion {
+			return int(version), nil
+		}
+	}
+
+	return 0, fmt.Errorf(`Unsupported "configVersion" %v; the latest version is %d.`, value, latestConfigVersion)
+}
+
+// Return whether or not a key is a section of a version 2 configuration.
+func isConfigSection(key string) bool {
+	for _, section := range configSections {
+		if key == section {
+			return true
+		}
+	}
+
+	return false
+}
@@ -2,49 +2,111 @@ package config
 
 import (
 	"errors"
+	"log"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
 )
 
+// Watches a configuration file and loads it whenever it changes.
+//
+// The directories of any Mercurial collections in the configuration are also
+// watched, so that the configuration is reloaded as repositories are added to
+// or removed from them.
+//
+// If the configuration cannot be loaded when it is first loaded, the error is
+// sent on Errors and the watcher stops. After that, a configuration that
+// cannot be loaded is logged and skipped, so that the previous configuration
+// stays in use until it is fixed.
 type ConfigWatcher struct {
 	NewConfig <-chan *Config
 	Errors    <-chan error
-	reload    chan<- bool
+	reload    chan<- chan reloadResult
+	stop      chan struct{}
+	done      <-chan struct{}
+}
+
+// The result of a reload requested by ForceReload().
+type reloadResult struct {
+	cfg *Config
+	err error
 }
 
 func Watch(path string) *ConfigWatcher {
 	configChan := make(chan *Config, 1)
 	errorChan := make(chan error, 1)
-	reload := make(chan bool)
+	reload := make(chan chan reloadResult)
+	stop := make(chan struct{})
+	done := make(chan struct{})
 
 	go func() {
+		defer close(done)
 		defer close(configChan)
 		defer close(errorChan)
-		defer close(reload)
 
 		watcher, err := fsnotify.NewWatcher()
 		if err != nil {
 			errorChan <- err
 			return
 		}
+		defer watcher.Close()
 
 		if err = watcher.Add(path); err != nil {
 			errorChan <- err
 			return
 		}
 
+		collectionDirs := make(map[string]bool)
+		loaded := false
+
+		// Where to send the result of a forced reload, if one was requested.
+		var reply chan reloadResult
+
 		for {
 			cfg, err := Load(path)
-			if err != nil {
+
+			if err == nil {
+				loaded = true
+				watchCollectionDirs(watcher, collectionDirs, cfg.HgCollectionDirs)
+			}
+
+			if reply != nil {
+				reply <- reloadResult{cfg, err}
+				reply = nil
+			} else if !loaded {
 				errorChan <- err
 				return
-			}
+			} else if err != nil {
+				log.Printf("Failed to reload configuration: %s", err.Error())
+				log.Println("Configuration was not reloaded.")
+			} else {
+				select {
+				case configChan <- cfg:
+				case <-stop:
+					return
+
+				case reply = <-reload:
+					// The forced reload replaces any configuration that
+					// has not been received yet.
+					select {
+					case <-configChan:
+					default:
+					}
 
-			configChan <- cfg
+					continue
+				}
+			}
 
 			select {
+			case <-stop:
+				return
+
 			case evt := <-watcher.Events:
+				if evt.Name != path {
+					// A repository was added to or removed from a collection.
+					continue
+				}
+
 				if evt.Op == fsnotify.Remove || evt.Op == fsnotify.Rename {
 					// The file was removed, which may be because it is being copied
 					// over. We need to wait and see if it comes back.
@@ -61,7 +123,7 @@ func Watch(path string) *ConfigWatcher {
 				errorChan <- err
 				return
 
-			case <-reload:
+			case reply = <-reload:
 				continue
 			}
 
@@ -72,17 +134,59 @@ func Watch(path string) *ConfigWatcher {
 		NewConfig: configChan,
 		Errors:    errorChan,
 		reload:    reload,
+		stop:      stop,
+		done:      done,
 	}
 }
 
+// Update the watched collection directories to match the configuration.
+//
+// Directories that can no longer be watched (e.g., because they were removed)
+// are ignored, since their parents are also watched.
+func watchCollectionDirs(watcher *fsnotify.Watcher, watched map[string]bool, dirs []string) {
+	current := make(map[string]bool, len(dirs))
+	for _, dir := range dirs {
+		current[dir] = true
+
+		if !watched[dir] {
+			if err := watcher.Add(dir); err != nil {
+				log.Printf(`Could not watch Mercurial collection directory "%s": %s`, dir, err.Error())
+				continue
+			}
+
+			watched[dir] = true
+		}
+	}
+
+	for dir := range watched {
+		if !current[dir] {
+			watcher.Remove(dir)
+			delete(watched, dir)
+		}
+	}
+}
+
+// Stop watching the configuration file.
+//
+// The NewConfig and Errors channels are closed once the watcher has stopped.
+// This must be called at most once.
+func (cw *ConfigWatcher) Stop() {
+	close(cw.stop)
+}
+
+// Load the configuration again, even if it has not changed.
+//
+// The configuration is returned rather than sent on NewConfig. If it cannot be
+// loaded, the error is returned and the watcher keeps watching.
 func (cw *ConfigWatcher) ForceReload() (*Config, error) {
-	cw.reload <- true
+	reply := make(chan reloadResult, 1)
 
 	select {
-	case cfg := <-cw.NewConfig:
-		return cfg, nil
-
-	case err := <-cw.Errors:
-		return nil, err
+	case cw.reload <- reply:
+	case <-cw.done:
+		return nil, errors.New("Configuration watcher stopped.")
 	}
+
+	result := <-reply
+	return result.cfg, result.err
 }
@@ -0,0 +1,97 @@
+// Package filelock provides advisory locks on files that are shared between
+// processes, such as the server and the hooks it installs.
+package filelock
+
+import (
+	"errors"
+	"os"
+)
+
+// The error returned by TryAcquire when another process holds the lock.
+var ErrLocked = errors.New("The file is locked by another process.")
+
+// An exclusive lock on a file.
+//
+// The lock is held until it is released or the process exits, so a lock held
+// by a process that crashed is never stale.
+type Lock struct {
+	file *os.File
+}
+
+// Acquire an exclusive lock on a file, waiting until it is available.
+//
+// The file is created if it does not exist. Its contents are not changed.
+func Acquire(path string) (*Lock, error) {
+	return acquire(path, true)
+}
+
+// Acquire an exclusive lock on a file without waiting.
+//
+// If another process holds the lock, ErrLocked is returned.
+func TryAcquire(path string) (*Lock, error) {
+	return acquire(path, false)
+}
+
+func acquire(path string, wait bool) (*Lock, error) {
+	for {
+		file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, err
+		}
+
+		if err = lockFile(file, wait); err != nil {
+			file.Close()
+			return nil, err
+		}
+
+		// The file may have been removed (see Remove()) while this was
+		// waiting for it, in which case the lock is on a file that no
+		// other process will open, and the new file must be locked
+		// instead.
+		if current, err := os.Stat(path); err == nil {
+			if opened, err := file.Stat(); err == nil && os.SameFile(current, opened) {
+				return &Lock{file}, nil
+			}
+		} else if !os.IsNotExist(err) {
+			unlockFile(file)
+			file.Close()
+			return nil, err
+		}
+
+		unlockFile(file)
+		file.Close()
+	}
+}
+
+// Return the locked file, which may be used to read or write its contents.
+func (lock *Lock) File() *os.File {
+	return lock.file
+}
+
+// Remove the file and release the lock.
+//
+// The file is removed while the lock is still held, so no other process can
+// lock it in the meantime. On Windows, where open files cannot be removed,
+// it is removed once the lock has been released instead.
+func (lock *Lock) Remove() error {
+	path := lock.file.Name()
+	err := os.Remove(path)
+
+	if releaseErr := lock.Release(); releaseErr != nil {
+		return releaseErr
+	} else if err != nil && !os.IsNotExist(err) {
+		err = os.Remove(path)
+	}
+
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
+
+// Release the lock.
+func (lock *Lock) Release() error {
+	unlockFile(lock.file)
+	return lock.file.Close()
+}
@@ -0,0 +1,83 @@
+package filelock_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/reviewboard/rb-gateway/filelock"
+)
+
+func TestAcquire(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "rb-gateway-filelock-")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "file.lock")
+
+	lock, err := filelock.Acquire(path)
+	assert.Nil(err)
+
+	_, err = filelock.TryAcquire(path)
+	assert.Equal(filelock.ErrLocked, err)
+
+	acquired := make(chan *filelock.Lock)
+	go func() {
+		other, err := filelock.Acquire(path)
+		assert.Nil(err)
+		acquired <- other
+	}()
+
+	assert.Nil(lock.Release())
+
+	other := <-acquired
+	assert.NotNil(other)
+	assert.Nil(other.Release())
+
+	lock, err = filelock.TryAcquire(path)
+	assert.Nil(err)
+	assert.Nil(lock.Release())
+}
+
+func TestRemove(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "rb-gateway-filelock-")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "file.lock")
+
+	lock, err := filelock.Acquire(path)
+	assert.Nil(err)
+
+	// A process waiting for the lock when the file is removed locks the new
+	// file instead.
+	acquired := make(chan *filelock.Lock)
+	go func() {
+		other, err := filelock.Acquire(path)
+		assert.Nil(err)
+		acquired <- other
+	}()
+
+	assert.Nil(lock.Remove())
+
+	other := <-acquired
+	assert.NotNil(other)
+
+	_, err = os.Stat(path)
+	assert.Nil(err)
+
+	_, err = filelock.TryAcquire(path)
+	assert.Equal(filelock.ErrLocked, err)
+
+	assert.Nil(other.Remove())
+
+	_, err = os.Stat(path)
+	assert.True(os.IsNotExist(err))
+}
@@ -0,0 +1,68 @@
+package gateway
+
+import (
+	"encoding/json"
+	"net"
+
+	"github.com/reviewboard/rb-gateway/config"
+)
+
+const (
+	// The prefix of the startup banner in the log.
+	//
+	// Provisioning tools can look for this to find the banner and parse the
+	// JSON that follows it.
+	BannerPrefix = "rb-gateway started: "
+)
+
+// A summary of the server that is logged each time it starts listening.
+type Banner struct {
+	// The address the server is listening on.
+	Listen string `json:"listen"`
+
+	// The scheme the server is serving (either "http" or "https").
+	Scheme string `json:"scheme"`
+
+	// Whether or not the server is using TLS.
+	TLS bool `json:"tls"`
+
+	// The number of configured repositories.
+	Repositories int `json:"repositories"`
+
+	// The number of configured repositories for each SCM.
+	RepositoriesByScm map[string]int `json:"repositories_by_scm"`
+
+	// The number of configured webhooks.
+	Webhooks int `json:"webhooks"`
+}
+
+// Return the banner for a server listening on addr with the configuration.
+func NewBanner(cfg *config.Config, addr net.Addr, webhooks int) Banner {
+	banner := Banner{
+		Listen:            addr.String(),
+		Scheme:            "http",
+		TLS:               cfg.TLS.Enabled,
+		Repositories:      len(cfg.Repositories),
+		RepositoriesByScm: make(map[string]int),
+		Webhooks:          webhooks,
+	}
+
+	if cfg.TLS.Enabled {
+		banner.Scheme = "https"
+	}
+
+	for _, repo := range cfg.Repositories {
+		banner.RepositoriesByScm[repo.GetScm()]++
+	}
+
+	return banner
+}
+
+// Return the banner as a single line of the log.
+func (b Banner) String() string {
+	// A Banner only contains strings, ints, and bools, so it can always be
+	// serialized.
+	body, _ := json.Marshal(b)
+
+	return BannerPrefix + string(body)
+}
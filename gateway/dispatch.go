@@ -0,0 +1,90 @@
+package gateway
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/reviewboard/rb-gateway/config"
+	"github.com/reviewboard/rb-gateway/repositories"
+	"github.com/reviewboard/rb-gateway/repositories/events"
+	"github.com/reviewboard/rb-gateway/repositories/hooks"
+)
+
+// Deliver an event to all webhooks that match the repository and event.
+//
+// Webhooks are loaded from the configured store. Pushed commits are first
+// added to the repository's commit index and, if configured, push payloads
+// are given suggested reviewers. If `externalUrl` is configured, push and
+// repository status payloads are given links back to the API.
+func DispatchEvent(cfg *config.Config, repository repositories.Repository, event string, payload events.Payload) error {
+	store, err := hooks.LoadStore(cfg.WebhookStorePath, cfg.RepositorySet())
+	if err != nil {
+		return fmt.Errorf("Could not load webhook store: %s", err.Error())
+	}
+
+	if pushPayload, ok := payload.(events.PushPayload); ok {
+		indexPushedCommits(repository, pushPayload)
+
+		if cfg.SuggestReviewers {
+			suggestReviewers(cfg, repository, pushPayload)
+		}
+
+		// Pre-push payloads are not linked, since their commits cannot be
+		// fetched until the push is accepted.
+		if cfg.ExternalUrl != "" {
+			payload = pushPayload.WithLinks(cfg.ExternalUrl)
+		}
+	} else if statusPayload, ok := payload.(events.RepositoryStatusPayload); ok && cfg.ExternalUrl != "" {
+		payload = statusPayload.WithLinks(cfg.ExternalUrl)
+	}
+
+	dispatcher := cfg.NewDispatcher(cfg.WebhookWorkers)
+	dispatcher.Notifier = newNotifier(cfg)
+	dispatcher.ErrorRateThreshold = cfg.Notifications.ErrorRateThreshold
+	dispatcher.DeadLetters = cfg.DeadLetterStore()
+
+	return dispatcher.InvokeAllHooks(store, event, repository, payload)
+}
+
+// Add pushed commits to the repository's commit index, if it has one.
+//
+// Failures are logged, but do not fail the hook, since commits that have not
+// been indexed are still found by searches.
+func indexPushedCommits(repository repositories.Repository, payload events.PushPayload) {
+	gitRepo, ok := repository.(*repositories.GitRepository)
+	if !ok || gitRepo.Index == nil {
+		return
+	}
+
+	if _, err := gitRepo.IndexPushedCommits(payload); err != nil {
+		log.Printf(`Could not update the commit index for repository "%s": %s`, gitRepo.Name, err.Error())
+	}
+}
+
+// Add the owners of the files changed by each pushed commit to the payload.
+//
+// Failures are logged, but do not fail the hook, so that the payload is still
+// delivered without suggested reviewers.
+func suggestReviewers(cfg *config.Config, repository repositories.Repository, payload events.PushPayload) {
+	if err := repositories.SuggestReviewers(repository, cfg.OwnersFiles, payload); err != nil {
+		log.Printf(`Could not suggest reviewers for repository "%s": %s`, repository.GetName(), err.Error())
+	}
+}
+
+// Return the notifier for webhook delivery failures.
+//
+// Failures are always logged. If a chat webhook is configured, they are also
+// posted there.
+func newNotifier(cfg *config.Config) repositories.Notifier {
+	notifiers := repositories.MultiNotifier{repositories.LogNotifier{}}
+
+	if cfg.Notifications.ChatWebhookUrl != "" {
+		notifiers = append(notifiers, repositories.ChatNotifier{
+			Client: http.DefaultClient,
+			Url:    cfg.Notifications.ChatWebhookUrl,
+		})
+	}
+
+	return notifiers
+}
@@ -0,0 +1,536 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/reviewboard/rb-gateway/api"
+	"github.com/reviewboard/rb-gateway/api/tokens"
+	"github.com/reviewboard/rb-gateway/config"
+	"github.com/reviewboard/rb-gateway/repositories"
+)
+
+const (
+	// The number of repositories whose caches are warmed at once.
+	cacheWarmingWorkers = 4
+)
+
+var (
+	// An error returned when the configuration uses an in-memory token store.
+	MemoryStoreErr = errors.New("Cannot use memory store outside of tests.")
+)
+
+// Options for running the server.
+type Options struct {
+	// The path to the configuration file.
+	//
+	// The file is watched for changes and the server is restarted with the
+	// new configuration whenever it changes.
+	ConfigPath string
+
+	// A channel that forces the configuration to be reloaded whenever it
+	// receives a value (e.g., on SIGHUP). It may be nil.
+	Reload <-chan struct{}
+
+	// A function that is called with the address of the server each time it
+	// starts listening. It may be nil.
+	Started func(addr net.Addr)
+
+	// Whether or not to suppress the banner that is logged when the server
+	// starts. See Banner.
+	Quiet bool
+
+	// The path to a file to write the ID of the server process to. It is
+	// removed when the server exits. It may be empty.
+	PidFile string
+
+	// Whether or not to refuse to use token and webhook stores that are in
+	// use by another server. See LockStores().
+	LockStores bool
+}
+
+// An error loading the initial configuration.
+type LoadError struct {
+	// The path to the configuration file.
+	Path string
+
+	// The original error.
+	Err error
+}
+
+// Return the error message.
+func (e *LoadError) Error() string {
+	return fmt.Sprintf("Unable to load configuration file %s: %s", e.Path, e.Err.Error())
+}
+
+// Run the server until the context is cancelled.
+//
+// This loads the configuration, installs hooks into its repositories, and
+// serves the API, restarting the server whenever the configuration changes.
+// If the configuration cannot be loaded, a *LoadError is returned. Once the
+// context is cancelled, the server is shut down and nil is returned.
+func Run(ctx context.Context, opts Options) error {
+	if opts.PidFile != "" {
+		pidFile, err := WritePidFile(opts.PidFile)
+		if err != nil {
+			return fmt.Errorf("Could not write PID file: %s", err.Error())
+		}
+
+		defer pidFile.Remove()
+	}
+
+	configWatcher := config.Watch(opts.ConfigPath)
+	defer configWatcher.Stop()
+
+	var cfg *config.Config
+
+	select {
+	case cfg = <-configWatcher.NewConfig:
+		if cfg == nil {
+			return &LoadError{opts.ConfigPath, unexpectedWatcherErr(configWatcher)}
+		}
+
+	case err := <-configWatcher.Errors:
+		return &LoadError{opts.ConfigPath, err}
+
+	case <-ctx.Done():
+		return nil
+	}
+
+	if cfg.TokenStorePath == ":memory:" {
+		return MemoryStoreErr
+	}
+
+	cfg.LogWarnings()
+
+	// Fault injection is only meant for testing, so a server that has it
+	// enabled by mistake should be obvious, and one that has it misspelled
+	// should not start.
+	if faults, err := repositories.FaultInjectionFromEnv(); err != nil {
+		return err
+	} else if faults != nil {
+		log.Printf("WARNING: Injecting webhook delivery faults (%s): %s", repositories.FaultInjectionVar, faults)
+	}
+
+	var storeLock *StoreLock
+	if opts.LockStores {
+		var err error
+		if storeLock, err = LockStores(cfg); err != nil {
+			return err
+		}
+
+		defer func() {
+			storeLock.Release()
+		}()
+	}
+
+	InstallHooks(cfg, opts.ConfigPath, false)
+
+	if cfg.ReviewBoard.Url != "" {
+		go CheckReviewBoard(cfg)
+	}
+
+	// Caches are warmed in the background, so that requests are served in
+	// the meantime.
+	if cfg.WarmCaches {
+		go WarmCaches(cfg.Repositories)
+	}
+
+	// Catch up on any pushes that were not added to the commit indexes by
+	// the post-receive hook (e.g., while hooks were not installed).
+	go UpdateIndexes(cfg)
+
+	eventQueue := NewEventQueue(DispatchEvent)
+	defer eventQueue.Close()
+
+	poller := NewPoller(eventQueue.Enqueue)
+	poller.Start(cfg)
+	defer poller.Stop()
+
+	api, err := api.New(cfg)
+	if err != nil {
+		return fmt.Errorf("Could not create API: %s", err.Error())
+	}
+
+	api.SetEventDispatcher(DispatchEvent, eventQueue.Enqueue)
+
+	monitor := NewPathMonitor(api, eventQueue.Enqueue)
+	monitor.Start(cfg)
+	defer monitor.Stop()
+
+	listener, err := listen(cfg, nil)
+	if err != nil {
+		return err
+	}
+
+	if !opts.Quiet {
+		log.Println(NewBanner(cfg, listener.Addr(), api.NumWebhooks()))
+	}
+
+	server, serveErrors := serve(api, listener, opts)
+
+	for {
+		var newCfg *config.Config = nil
+		shouldExit := false
+
+		select {
+		case reloadedCfg, ok := <-configWatcher.NewConfig:
+			if !ok {
+				err = fmt.Errorf("Unexpected error: %s", unexpectedWatcherErr(configWatcher).Error())
+				shouldExit = true
+			} else {
+				log.Println("Detected configuration change, reloading...")
+				newCfg = reloadedCfg
+			}
+
+		case watchErr, ok := <-configWatcher.Errors:
+			if !ok {
+				watchErr = unexpectedWatcherErr(configWatcher)
+			}
+
+			err = fmt.Errorf("Unexpected error: %s", watchErr.Error())
+			shouldExit = true
+
+		case <-opts.Reload:
+			var reloadErr error
+			if newCfg, reloadErr = configWatcher.ForceReload(); reloadErr != nil {
+				log.Printf("Failed to reload configuration: %s", reloadErr.Error())
+				log.Println("Configuration was not reloaded.")
+			}
+
+		case err = <-serveErrors:
+			shouldExit = true
+
+		case <-ctx.Done():
+			shouldExit = true
+		}
+
+		if shouldExit {
+			if shutdownErr := stop(api, server, listener); shutdownErr != nil {
+				return shutdownErr
+			}
+
+			return err
+		}
+
+		if newCfg == nil {
+			continue
+		} else if newCfg.TokenStorePath == ":memory:" {
+			log.Printf("Failed to reload configuration: %s", MemoryStoreErr.Error())
+			log.Println("Configuration was not reloaded.")
+			continue
+		}
+
+		// The stores may have moved, in which case the new ones need to be
+		// locked before they are used.
+		var newStoreLock *StoreLock
+		if storeLock != nil && !storeLock.Covers(newCfg) {
+			if newStoreLock, err = LockStores(newCfg); err != nil {
+				log.Printf("Failed to reload configuration: %s", err.Error())
+				log.Println("Configuration was not reloaded.")
+				continue
+			}
+		}
+
+		// The listener only needs to be rebound if the socket settings
+		// changed. Otherwise, the configuration is swapped in place and the
+		// server keeps accepting connections. The new listener is bound
+		// before anything else changes, so that the server keeps running
+		// with the old configuration if it cannot be bound.
+		var newListener net.Listener
+		if socketSettingsChanged(cfg, newCfg) {
+			if newListener, err = listen(newCfg, listener); err != nil {
+				log.Printf("Failed to reload configuration: %s", err.Error())
+				log.Println("Configuration was not reloaded.")
+
+				if newStoreLock != nil {
+					newStoreLock.releaseExcept(storeLock)
+				}
+
+				continue
+			}
+		}
+
+		if err = api.SetConfig(newCfg); err != nil {
+			log.Printf("Failed to reload configuration: %s\n", err.Error())
+
+			if newListener != nil {
+				newListener.Close()
+			}
+
+			if newStoreLock != nil {
+				newStoreLock.releaseExcept(storeLock)
+			}
+
+			continue
+		}
+
+		if newListener != nil {
+			log.Println("Socket settings changed, restarting server...")
+
+			if err = stop(api, server, listener); err != nil {
+				newListener.Close()
+				return err
+			}
+
+			listener = newListener
+			server, serveErrors = serve(api, listener, opts)
+			log.Printf("Server restarted on %s.", listener.Addr())
+		}
+
+		if newStoreLock != nil {
+			storeLock.releaseExcept(newStoreLock)
+			storeLock = newStoreLock
+		}
+
+		changed := changedRepositories(cfg, newCfg)
+		cfg = newCfg
+		repositories.RetainRepositoryCache(cfg.Repositories)
+		log.Println("Configuration reloaded.")
+
+		// If we have any new repositories, install hooks for them.
+		// We do not need to force install because configPath has not changed.
+		InstallHooks(cfg, opts.ConfigPath, false)
+
+		if cfg.WarmCaches && len(changed) != 0 {
+			go WarmCaches(changed)
+		}
+
+		go UpdateIndexes(cfg)
+		poller.Start(cfg)
+		monitor.Start(cfg)
+	}
+}
+
+// Bind a listener for the configuration.
+//
+// If `current` is listening on the configured port already, its socket is
+// duplicated instead, so that the port stays bound while the server restarts
+// (e.g., to enable TLS).
+func listen(cfg *config.Config, current net.Listener) (net.Listener, error) {
+	if current != nil {
+		if tcpListener, ok := current.(*net.TCPListener); ok && tcpListener.Addr().(*net.TCPAddr).Port == int(cfg.Port) {
+			file, err := tcpListener.File()
+			if err != nil {
+				return nil, fmt.Errorf("Could not reuse the listener on port %d: %s", cfg.Port, err.Error())
+			}
+			defer file.Close()
+
+			return net.FileListener(file)
+		}
+	}
+
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", cfg.Port))
+	if err != nil {
+		return nil, fmt.Errorf("Could not listen on port %d: %s", cfg.Port, err.Error())
+	}
+
+	return listener, nil
+}
+
+// Start serving the API on a listener.
+func serve(api *api.API, listener net.Listener, opts Options) (*http.Server, <-chan error) {
+	server, serveErrors := api.ServeListener(listener)
+
+	if opts.Started != nil {
+		opts.Started(listener.Addr())
+	}
+
+	return server, serveErrors
+}
+
+// Shut down the server, draining in-progress requests.
+func stop(api *api.API, server *http.Server, listener net.Listener) error {
+	if err := api.Shutdown(server); err != nil {
+		return fmt.Errorf("An error occurred while shutting down the server: %s", err.Error())
+	}
+
+	log.Printf("Server on %s shut down.", listener.Addr())
+	return nil
+}
+
+// Return whether or not the listener must be rebound to apply a new
+// configuration.
+//
+// The roles of client certificate users are checked for each request, so
+// they do not require it.
+func socketSettingsChanged(old, new *config.Config) bool {
+	oldTLS, newTLS := old.TLS, new.TLS
+	oldTLS.ClientCertRoles = nil
+	newTLS.ClientCertRoles = nil
+
+	return old.Port != new.Port ||
+		!reflect.DeepEqual(oldTLS, newTLS) ||
+		old.ProxyProtocol != new.ProxyProtocol
+}
+
+// Install hooks for all the repositories specified by cfg.
+//
+// Repositories that are polled for new commits are skipped, since they cannot
+// have hooks installed and webhooks would otherwise be triggered twice. If
+// hooks post events to the server (i.e., `hooks.mode` is `api`), each
+// repository is given a hook token first. See EnsureHookToken().
+//
+// Errors are logged as they occur. If any occurred, they are returned.
+func InstallHooks(cfg *config.Config, configPath string, force bool) []error {
+	errors := []error{}
+	polled := cfg.PollIntervals()
+
+	var store tokens.TokenStore
+	if cfg.Hooks.Mode == repositories.HookModeApi {
+		var err error
+		if store, err = tokens.NewStore(cfg.TokenStorePath); err != nil {
+			log.Printf("Could not open token store to create hook tokens: %s", err.Error())
+			return []error{err}
+		}
+	}
+
+	for _, repository := range cfg.Repositories {
+		if _, ok := polled[repository.GetName()]; ok {
+			continue
+		} else if store != nil {
+			if err := EnsureHookToken(store, repository, force); err != nil {
+				errors = append(errors, err)
+				log.Printf(
+					`An error occurred while creating a hook token for repository "%s": %s`,
+					repository.GetName(), err.Error())
+				continue
+			}
+		}
+
+		if err := repository.InstallHooks(configPath, force); err != nil {
+			errors = append(errors, err)
+			log.Printf(
+				`An error occurred while installing hooks for repository "%s": %s`,
+				repository.GetName(), err.Error())
+		}
+	}
+
+	if len(errors) == 0 {
+		errors = nil
+	}
+
+	return errors
+}
+
+// Return the repositories in the new configuration that are not in the old
+// one, or whose configuration changed.
+func changedRepositories(old, new *config.Config) map[string]repositories.Repository {
+	changed := make(map[string]repositories.Repository)
+
+	for name, repository := range new.Repositories {
+		if !reflect.DeepEqual(old.Repositories[name], repository) {
+			changed[name] = repository
+		}
+	}
+
+	return changed
+}
+
+// Warm the caches for the given repositories, keyed by name.
+//
+// Each repository is opened and its branch heads are resolved, so that the
+// first requests for it do not have to wait for Git packfile indices to be
+// loaded. Mercurial repositories are not kept open between requests, so this
+// only warms the operating system's caches of the repository and Mercurial
+// itself.
+//
+// Errors are logged as they occur. If any occurred, they are returned.
+func WarmCaches(repos map[string]repositories.Repository) []error {
+	start := time.Now()
+
+	queue := make(chan repositories.Repository)
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	errors := []error{}
+
+	for i := 0; i < cacheWarmingWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for repository := range queue {
+				if _, err := repository.GetBranches(repositories.BranchSortDefault); err != nil {
+					log.Printf(
+						`An error occurred while warming the cache for repository "%s": %s`,
+						repository.GetName(), err.Error())
+
+					lock.Lock()
+					errors = append(errors, err)
+					lock.Unlock()
+				}
+			}
+		}()
+	}
+
+	for _, repository := range repos {
+		queue <- repository
+	}
+
+	close(queue)
+	wg.Wait()
+
+	log.Printf("Warmed caches for %d repositories in %s.", len(repos), time.Since(start))
+
+	if len(errors) == 0 {
+		errors = nil
+	}
+
+	return errors
+}
+
+// Update the commit indexes for all the repositories specified by cfg that
+// have `index` enabled.
+//
+// Errors are logged as they occur. If any occurred, they are returned.
+func UpdateIndexes(cfg *config.Config) []error {
+	errors := []error{}
+
+	for _, repository := range indexedRepositories(cfg) {
+		start := time.Now()
+
+		if added, err := repository.UpdateIndex(); err != nil {
+			errors = append(errors, err)
+			log.Printf(
+				`An error occurred while updating the commit index for repository "%s": %s`,
+				repository.GetName(), err.Error())
+		} else if added > 0 {
+			log.Printf(`Indexed %d commits for repository "%s" in %s.`, added, repository.GetName(), time.Since(start))
+		}
+	}
+
+	if len(errors) == 0 {
+		errors = nil
+	}
+
+	return errors
+}
+
+// Return the repositories specified by cfg that have `index` enabled.
+func indexedRepositories(cfg *config.Config) []*repositories.GitRepository {
+	var indexed []*repositories.GitRepository
+
+	for _, repository := range cfg.Repositories {
+		if gitRepo, ok := repository.(*repositories.GitRepository); ok && gitRepo.Index != nil {
+			indexed = append(indexed, gitRepo)
+		}
+	}
+
+	return indexed
+}
+
+// Return the error that caused the configuration watcher to stop.
+func unexpectedWatcherErr(configWatcher *config.ConfigWatcher) error {
+	if err, ok := <-configWatcher.Errors; ok && err != nil {
+		return err
+	}
+
+	return errors.New("Configuration watcher stopped.")
+}
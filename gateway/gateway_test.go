@@ -0,0 +1,656 @@
+package gateway_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/reviewboard/rb-gateway/api"
+	"github.com/reviewboard/rb-gateway/api/tokens"
+	"github.com/reviewboard/rb-gateway/config"
+	"github.com/reviewboard/rb-gateway/filelock"
+	"github.com/reviewboard/rb-gateway/gateway"
+	"github.com/reviewboard/rb-gateway/helpers"
+	"github.com/reviewboard/rb-gateway/repositories"
+	"github.com/reviewboard/rb-gateway/repositories/events"
+	"github.com/reviewboard/rb-gateway/repositories/hooks"
+)
+
+// Return a port that is not in use.
+func freePort(t *testing.T) uint16 {
+	t.Helper()
+	assert := assert.New(t)
+
+	listener, err := net.Listen("tcp", "localhost:0")
+	assert.Nil(err)
+	defer listener.Close()
+
+	return uint16(listener.Addr().(*net.TCPAddr).Port)
+}
+
+// Write a configuration for a server listening on a free port.
+func setupGatewayConfig(t *testing.T) (string, config.Config) {
+	t.Helper()
+	assert := assert.New(t)
+
+	repo, rawRepo := helpers.CreateGitRepo(t, "repo")
+	helpers.SeedGitRepo(t, repo, rawRepo)
+
+	cfgDir, err := ioutil.TempDir("", "rb-gateway-config-")
+	assert.Nil(err)
+
+	cfg := helpers.CreateTestConfig(t, repo)
+	cfg.Port = freePort(t)
+	cfg.TokenStorePath = filepath.Join(cfgDir, "tokens.dat")
+	cfg.WebhookStorePath = filepath.Join(cfgDir, "webhooks.json")
+	helpers.CreateTestHtpasswd(t, "username", "password", &cfg)
+
+	assert.Nil(hooks.WebhookStore{}.Save(cfg.WebhookStorePath))
+
+	cfgPath := filepath.Join(cfgDir, "config.json")
+	helpers.WriteConfig(t, cfgPath, &cfg)
+
+	return cfgPath, cfg
+}
+
+func TestRun(t *testing.T) {
+	assert := assert.New(t)
+
+	cfgPath, cfg := setupGatewayConfig(t)
+	defer os.RemoveAll(filepath.Dir(cfgPath))
+	defer os.Remove(cfg.HtpasswdPath)
+	defer helpers.CleanupRepository(t, cfg.Repositories["repo"].GetPath())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	reload := make(chan struct{})
+	started := make(chan net.Addr, 1)
+	result := make(chan error, 1)
+
+	go func() {
+		result <- gateway.Run(ctx, gateway.Options{
+			ConfigPath: cfgPath,
+			Reload:     reload,
+			Started: func(addr net.Addr) {
+				started <- addr
+			},
+		})
+	}()
+
+	waitForStart := func(port uint16) {
+		select {
+		case addr := <-started:
+			assert.Equal(int(port), addr.(*net.TCPAddr).Port)
+
+		case err := <-result:
+			assert.FailNow("Server exited unexpectedly", "%v", err)
+
+		case <-time.After(5 * time.Second):
+			assert.FailNow("Timed out waiting for server to start")
+		}
+	}
+
+	getSession := func(port uint16) (*http.Response, error) {
+		request, err := http.NewRequest("GET", fmt.Sprintf("http://localhost:%d/session", port), nil)
+		assert.Nil(err)
+		request.SetBasicAuth("username", "password")
+
+		rsp, err := http.DefaultClient.Do(request)
+		if err == nil {
+			rsp.Body.Close()
+		}
+
+		return rsp, err
+	}
+
+	waitForStart(cfg.Port)
+
+	rsp, err := getSession(cfg.Port)
+	assert.Nil(err)
+	assert.Equal(http.StatusOK, rsp.StatusCode)
+
+	// Reloading without changing the socket settings should not restart the
+	// server.
+	reload <- struct{}{}
+
+	rsp, err = getSession(cfg.Port)
+	assert.Nil(err)
+	assert.Equal(http.StatusOK, rsp.StatusCode)
+
+	select {
+	case <-started:
+		assert.Fail("Server restarted unexpectedly")
+
+	default:
+	}
+
+	// If the new port cannot be bound, the server keeps running with the old
+	// configuration.
+	busy, err := net.Listen("tcp", ":0")
+	assert.Nil(err)
+	defer busy.Close()
+
+	oldPort := cfg.Port
+	cfg.Port = uint16(busy.Addr().(*net.TCPAddr).Port)
+	cfg.RepositoryData = nil
+
+	tmpPath := cfgPath + ".tmp"
+	helpers.WriteConfig(t, tmpPath, &cfg)
+	assert.Nil(os.Rename(tmpPath, cfgPath))
+	reload <- struct{}{}
+
+	rsp, err = getSession(oldPort)
+	assert.Nil(err)
+	assert.Equal(http.StatusOK, rsp.StatusCode)
+
+	select {
+	case <-started:
+		assert.Fail("Server restarted unexpectedly")
+
+	default:
+	}
+
+	// Changing the port should rebind the listener. The watcher only sees the
+	// new file once it has finished handling the last rename.
+	cfg.Port = freePort(t)
+	cfg.RepositoryData = nil
+	time.Sleep(200 * time.Millisecond)
+
+	helpers.WriteConfig(t, tmpPath, &cfg)
+	assert.Nil(os.Rename(tmpPath, cfgPath))
+
+	waitForStart(cfg.Port)
+
+	rsp, err = getSession(cfg.Port)
+	assert.Nil(err)
+	assert.Equal(http.StatusOK, rsp.StatusCode)
+
+	_, err = getSession(oldPort)
+	assert.NotNil(err)
+
+	cancel()
+
+	select {
+	case err := <-result:
+		assert.Nil(err)
+
+	case <-time.After(10 * time.Second):
+		assert.Fail("Timed out waiting for server to shut down")
+	}
+}
+
+func TestRunInvalidConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	err := gateway.Run(context.Background(), gateway.Options{
+		ConfigPath: "does-not-exist.json",
+	})
+
+	_, ok := err.(*gateway.LoadError)
+	assert.True(ok)
+}
+
+func TestRunPidFileAndLock(t *testing.T) {
+	assert := assert.New(t)
+
+	cfgPath, cfg := setupGatewayConfig(t)
+	defer os.RemoveAll(filepath.Dir(cfgPath))
+	defer os.Remove(cfg.HtpasswdPath)
+	defer helpers.CleanupRepository(t, cfg.Repositories["repo"].GetPath())
+
+	pidPath := filepath.Join(filepath.Dir(cfgPath), "rb-gateway.pid")
+	tokenLockPath := cfg.TokenStorePath + ".lock"
+	webhookLockPath := cfg.WebhookStorePath + ".lock"
+
+	// Another running process holds the lock on the webhook store.
+	held, err := filelock.TryAcquire(webhookLockPath)
+	assert.Nil(err)
+	_, err = held.File().WriteString(fmt.Sprintf("%d\n", os.Getppid()))
+	assert.Nil(err)
+
+	err = gateway.Run(context.Background(), gateway.Options{
+		ConfigPath: cfgPath,
+		LockStores: true,
+		Quiet:      true,
+	})
+
+	if lockedErr, ok := err.(*gateway.LockedError); assert.True(ok) {
+		assert.Equal(webhookLockPath, lockedErr.Path)
+		assert.Equal(os.Getppid(), lockedErr.Pid)
+	}
+
+	_, err = os.Stat(tokenLockPath)
+	assert.True(os.IsNotExist(err))
+
+	// Once that process has exited, its lock is released, even if it left
+	// the file behind.
+	assert.Nil(held.Release())
+	assert.Nil(ioutil.WriteFile(webhookLockPath, []byte("2147483646\n"), 0644))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	started := make(chan net.Addr, 1)
+	result := make(chan error, 1)
+
+	go func() {
+		result <- gateway.Run(ctx, gateway.Options{
+			ConfigPath: cfgPath,
+			Started: func(addr net.Addr) {
+				started <- addr
+			},
+			Quiet:      true,
+			PidFile:    pidPath,
+			LockStores: true,
+		})
+	}()
+
+	select {
+	case <-started:
+	case err := <-result:
+		assert.FailNow("Server exited unexpectedly", "%v", err)
+
+	case <-time.After(5 * time.Second):
+		assert.FailNow("Timed out waiting for server to start")
+	}
+
+	expected := fmt.Sprintf("%d\n", os.Getpid())
+
+	for _, path := range []string{pidPath, tokenLockPath, webhookLockPath} {
+		content, err := ioutil.ReadFile(path)
+		assert.Nil(err)
+		assert.Equal(expected, string(content))
+	}
+
+	// A second server cannot take over the PID file.
+	_, err = gateway.WritePidFile(pidPath)
+	if lockedErr, ok := err.(*gateway.LockedError); assert.True(ok) {
+		assert.Equal(pidPath, lockedErr.Path)
+		assert.Equal(os.Getpid(), lockedErr.Pid)
+	}
+
+	cancel()
+
+	select {
+	case err := <-result:
+		assert.Nil(err)
+
+	case <-time.After(10 * time.Second):
+		assert.Fail("Timed out waiting for server to shut down")
+	}
+
+	_, err = os.Stat(pidPath)
+	assert.True(os.IsNotExist(err))
+	_, err = os.Stat(tokenLockPath)
+	assert.True(os.IsNotExist(err))
+	_, err = os.Stat(webhookLockPath)
+	assert.True(os.IsNotExist(err))
+}
+
+func TestPoller(t *testing.T) {
+	assert := assert.New(t)
+
+	repo, rawRepo := helpers.CreateGitRepo(t, "git-repo")
+	defer helpers.CleanupRepository(t, repo.Path)
+	helpers.SeedGitRepo(t, repo, rawRepo)
+
+	server, requests := helpers.CreateRequestRecorder(t)
+	defer server.Close()
+
+	storeDir, err := ioutil.TempDir("", "rb-gateway-poller-")
+	assert.Nil(err)
+	defer os.RemoveAll(storeDir)
+
+	cfg := helpers.CreateTestConfig(t, repo)
+	cfg.WebhookStorePath = filepath.Join(storeDir, "webhooks.json")
+	cfg.WebhookStatusPath = filepath.Join(storeDir, "status")
+	cfg.WebhookDeadLetterPath = filepath.Join(storeDir, "dead-letters")
+
+	store := hooks.WebhookStore{
+		"webhook-1": &hooks.Webhook{
+			Id:      "webhook-1",
+			Url:     server.URL + "/webhook-1",
+			Secret:  "top-secret-123456789",
+			Enabled: true,
+			Events:  []string{events.PushEvent},
+			Repos:   []string{"git-repo"},
+		},
+	}
+	assert.Nil(store.Save(cfg.WebhookStorePath))
+
+	cfg.PollStatePath = filepath.Join(storeDir, "poll-heads.json")
+
+	queue := gateway.NewEventQueue(gateway.DispatchEvent)
+	defer queue.Close()
+
+	poller := gateway.NewPoller(queue.Enqueue)
+
+	// The first poll only records the branch heads.
+	assert.Nil(poller.Poll(&cfg, repo))
+	helpers.AssertNumRequests(t, 0, requests)
+
+	_, err = os.Stat(cfg.PollStatePath)
+	assert.Nil(err)
+
+	branch := helpers.CreateGitBranch(t, repo, rawRepo)
+
+	// Events that cannot be queued are retried on the next poll.
+	failing := gateway.NewPoller(func(*config.Config, repositories.Repository, string, events.Payload) error {
+		return gateway.EventQueueFullErr
+	})
+	assert.Equal(gateway.EventQueueFullErr, failing.Poll(&cfg, repo))
+
+	// The heads are saved, so commits pushed while polling was stopped (e.g.,
+	// while the server was down) are found.
+	poller = gateway.NewPoller(queue.Enqueue)
+
+	assert.Nil(poller.Poll(&cfg, repo))
+	recorded := helpers.AssertNumRequests(t, 1, requests)
+
+	var payload events.PushPayload
+	assert.Nil(json.Unmarshal(recorded[0].Body, &payload))
+	assert.Equal("git-repo", payload.Repository)
+	if assert.Equal(1, len(payload.Commits)) {
+		assert.Equal(branch.Hash().String(), payload.Commits[0].Id)
+		assert.Equal("test-branch", payload.Commits[0].Target.Branch)
+	}
+
+	// Nothing changed since the last poll.
+	assert.Nil(poller.Poll(&cfg, repo))
+
+	select {
+	case <-requests:
+		assert.Fail("Unexpected webhook request")
+
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestEventQueue(t *testing.T) {
+	assert := assert.New(t)
+
+	repo, _ := helpers.CreateGitRepo(t, "git-repo")
+	defer helpers.CleanupRepository(t, repo.Path)
+
+	cfg := helpers.CreateTestConfig(t, repo)
+
+	release := make(chan struct{})
+	delivered := make(chan string, 3)
+
+	queue := gateway.NewEventQueue(func(cfg *config.Config, repository repositories.Repository, event string, payload events.Payload) error {
+		<-release
+		delivered <- payload.(events.PushPayload).Repository
+		return errors.New("connection refused")
+	})
+
+	// Events are queued without waiting for them to be delivered.
+	for _, name := range []string{"first", "second"} {
+		assert.Nil(queue.Enqueue(&cfg, repo, events.PushEvent, events.PushPayload{Repository: name}))
+	}
+
+	queue.Close()
+	assert.Equal(gateway.EventQueueClosedErr,
+		queue.Enqueue(&cfg, repo, events.PushEvent, events.PushPayload{Repository: "third"}))
+
+	// Queued events are still delivered, in order, after the queue is
+	// closed.
+	close(release)
+	queue.Wait()
+	close(delivered)
+
+	var names []string
+	for name := range delivered {
+		names = append(names, name)
+	}
+
+	assert.Equal([]string{"first", "second"}, names)
+}
+
+func TestPathMonitor(t *testing.T) {
+	assert := assert.New(t)
+
+	repo, rawRepo := helpers.CreateGitRepo(t, "git-repo")
+	defer helpers.CleanupRepository(t, repo.Path)
+	helpers.SeedGitRepo(t, repo, rawRepo)
+
+	server, requests := helpers.CreateRequestRecorder(t)
+	defer server.Close()
+
+	storeDir, err := ioutil.TempDir("", "rb-gateway-monitor-")
+	assert.Nil(err)
+	defer os.RemoveAll(storeDir)
+
+	cfg := helpers.CreateTestConfig(t, repo)
+	cfg.ExternalUrl = "https://gateway.example.com"
+	cfg.RepositoryCheckInterval = 30
+	cfg.WebhookStorePath = filepath.Join(storeDir, "webhooks.json")
+	cfg.WebhookStatusPath = filepath.Join(storeDir, "status")
+	cfg.WebhookDeadLetterPath = filepath.Join(storeDir, "dead-letters")
+	helpers.CreateTestHtpasswd(t, "username", "password", &cfg)
+	defer os.Remove(cfg.HtpasswdPath)
+
+	store := hooks.WebhookStore{
+		"webhook-1": &hooks.Webhook{
+			Id:      "webhook-1",
+			Url:     server.URL + "/webhook-1",
+			Secret:  "top-secret-123456789",
+			Enabled: true,
+			Events:  []string{events.RepositoryStatusEvent},
+			Repos:   []string{"git-repo"},
+		},
+	}
+	assert.Nil(store.Save(cfg.WebhookStorePath))
+
+	handler, err := api.New(&cfg)
+	if !assert.Nil(err) {
+		return
+	}
+
+	token, err := (*handler.GetTokenStore()).New()
+	assert.Nil(err)
+
+	getBranches := func() *httptest.ResponseRecorder {
+		request := httptest.NewRequest("GET", "/repos/git-repo/branches", nil)
+		request.Header.Set(api.PrivateTokenHeader, *token)
+
+		rsp := httptest.NewRecorder()
+		handler.ServeHTTP(rsp, request)
+		return rsp
+	}
+
+	// Events are delivered immediately, rather than queued, so that the
+	// requests can be checked.
+	monitor := gateway.NewPathMonitor(handler, gateway.DispatchEvent)
+
+	// Nothing is dispatched while the repository is available.
+	assert.Nil(monitor.Check(&cfg, repo))
+	helpers.AssertNumRequests(t, 0, requests)
+	assert.Equal(http.StatusOK, getBranches().Code)
+
+	// An unmounted file system leaves an empty directory behind.
+	movedPath := repo.Path + ".moved"
+	assert.Nil(os.Rename(repo.Path, movedPath))
+	assert.Nil(os.Mkdir(repo.Path, 0755))
+
+	assert.Nil(monitor.Check(&cfg, repo))
+	recorded := helpers.AssertNumRequests(t, 1, requests)
+
+	var payload events.RepositoryStatusPayload
+	assert.Nil(json.Unmarshal(recorded[0].Body, &payload))
+	assert.Equal("git-repo", payload.Repository)
+	assert.Equal("https://gateway.example.com/repos/git-repo", payload.RepositoryUrl)
+	assert.False(payload.Status.Available)
+	assert.Contains(payload.Status.Reason, "does not contain a git repository")
+
+	rsp := getBranches()
+	assert.Equal(http.StatusServiceUnavailable, rsp.Code)
+	assert.Equal("30", rsp.Header().Get("Retry-After"))
+	assert.Equal("Repository is unavailable.\n", rsp.Body.String())
+
+	// Nothing is dispatched until the status changes again.
+	assert.Nil(monitor.Check(&cfg, repo))
+	helpers.AssertNumRequests(t, 0, requests)
+
+	assert.Nil(os.Remove(repo.Path))
+	assert.Nil(os.Rename(movedPath, repo.Path))
+
+	assert.Nil(monitor.Check(&cfg, repo))
+	recorded = helpers.AssertNumRequests(t, 1, requests)
+
+	payload = events.RepositoryStatusPayload{}
+	assert.Nil(json.Unmarshal(recorded[0].Body, &payload))
+	assert.True(payload.Status.Available)
+	assert.Equal("", payload.Status.Reason)
+
+	assert.Equal(http.StatusOK, getBranches().Code)
+}
+
+func TestBanner(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg := helpers.CreateTestConfig(t,
+		&repositories.GitRepository{RepositoryInfo: repositories.RepositoryInfo{Name: "git-1"}},
+		&repositories.GitRepository{RepositoryInfo: repositories.RepositoryInfo{Name: "git-2"}},
+		&repositories.HgRepository{RepositoryInfo: repositories.RepositoryInfo{Name: "hg"}})
+	cfg.TLS.Enabled = true
+
+	addr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8888}
+	banner := gateway.NewBanner(&cfg, addr, 3)
+
+	assert.Equal(gateway.Banner{
+		Listen:            "127.0.0.1:8888",
+		Scheme:            "https",
+		TLS:               true,
+		Repositories:      3,
+		RepositoriesByScm: map[string]int{"git": 2, "hg": 1},
+		Webhooks:          3,
+	}, banner)
+
+	line := banner.String()
+	assert.True(strings.HasPrefix(line, gateway.BannerPrefix))
+
+	var parsed gateway.Banner
+	assert.Nil(json.Unmarshal([]byte(strings.TrimPrefix(line, gateway.BannerPrefix)), &parsed))
+	assert.Equal(banner, parsed)
+}
+
+func TestInstallHooksApiMode(t *testing.T) {
+	assert := assert.New(t)
+
+	repo, _ := helpers.CreateGitRepo(t, "repo")
+	defer helpers.CleanupRepository(t, repo.Path)
+
+	tempDir, err := ioutil.TempDir("", "rb-gateway-hook-tokens-")
+	assert.Nil(err)
+	defer os.RemoveAll(tempDir)
+
+	cfg := helpers.CreateTestConfig(t, repo)
+	cfg.TokenStorePath = filepath.Join(tempDir, "tokens.dat")
+	cfg.Hooks = repositories.HookConfig{
+		Mode: repositories.HookModeApi,
+		Url:  "http://localhost:8888",
+	}
+
+	repositories.SetHookConfig(cfg.Hooks)
+	defer repositories.SetHookConfig(repositories.HookConfig{})
+
+	assert.Nil(gateway.InstallHooks(&cfg, "/tmp/config.json", false))
+
+	tokenPath, err := repositories.HookTokenPath(repo)
+	assert.Nil(err)
+
+	token, err := repositories.ReadHookToken(tokenPath)
+	assert.Nil(err)
+
+	info, err := os.Stat(tokenPath)
+	assert.Nil(err)
+	assert.Equal(os.FileMode(0640), info.Mode().Perm())
+
+	store, err := tokens.NewStore(cfg.TokenStorePath)
+	assert.Nil(err)
+
+	tokenInfo := store.Info(token)
+	if assert.NotNil(tokenInfo) {
+		assert.Equal(tokens.RoleHook, tokenInfo.Role)
+		assert.Equal([]string{"repo"}, tokenInfo.Repositories)
+	}
+
+	// The token is kept unless hooks are re-installed with force.
+	assert.Nil(gateway.InstallHooks(&cfg, "/tmp/config.json", false))
+
+	kept, err := repositories.ReadHookToken(tokenPath)
+	assert.Nil(err)
+	assert.Equal(token, kept)
+
+	assert.Nil(gateway.InstallHooks(&cfg, "/tmp/config.json", true))
+
+	replaced, err := repositories.ReadHookToken(tokenPath)
+	assert.Nil(err)
+	assert.NotEqual(token, replaced)
+}
+
+func TestWarmCaches(t *testing.T) {
+	assert := assert.New(t)
+
+	repo, rawRepo := helpers.CreateGitRepo(t, "repo")
+	defer helpers.CleanupRepository(t, repo.Path)
+	helpers.SeedGitRepo(t, repo, rawRepo)
+
+	missing := &repositories.GitRepository{
+		RepositoryInfo: repositories.RepositoryInfo{
+			Name: "missing",
+			Path: filepath.Join(repo.Path, "does-not-exist"),
+		},
+	}
+
+	cfg := helpers.CreateTestConfig(t, repo)
+	assert.Nil(gateway.WarmCaches(cfg.Repositories))
+
+	cfg = helpers.CreateTestConfig(t, repo, missing)
+	assert.Equal(1, len(gateway.WarmCaches(cfg.Repositories)))
+}
+
+func TestUpdateIndexes(t *testing.T) {
+	assert := assert.New(t)
+
+	repo, rawRepo := helpers.CreateGitRepo(t, "repo")
+	defer helpers.CleanupRepository(t, repo.Path)
+	helpers.SeedGitRepo(t, repo, rawRepo)
+
+	indexDir, err := ioutil.TempDir("", "rb-gateway-index-")
+	assert.Nil(err)
+	defer os.RemoveAll(indexDir)
+
+	repo.Index = repositories.OpenCommitIndex(filepath.Join(indexDir, "repo.idx"))
+
+	missing := &repositories.GitRepository{
+		RepositoryInfo: repositories.RepositoryInfo{
+			Name: "missing",
+			Path: filepath.Join(repo.Path, "does-not-exist"),
+		},
+		Index: repositories.OpenCommitIndex(filepath.Join(indexDir, "missing.idx")),
+	}
+
+	unindexed, rawUnindexed := helpers.CreateGitRepo(t, "unindexed")
+	defer helpers.CleanupRepository(t, unindexed.Path)
+	helpers.SeedGitRepo(t, unindexed, rawUnindexed)
+
+	cfg := helpers.CreateTestConfig(t, repo, unindexed)
+	assert.Nil(gateway.UpdateIndexes(&cfg))
+
+	count, err := repo.Index.Len()
+	assert.Nil(err)
+	assert.Equal(1, count)
+
+	cfg = helpers.CreateTestConfig(t, repo, missing)
+	assert.Equal(1, len(gateway.UpdateIndexes(&cfg)))
+}
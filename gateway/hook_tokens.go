@@ -0,0 +1,51 @@
+package gateway
+
+import (
+	"os"
+
+	"github.com/reviewboard/rb-gateway/api/tokens"
+	"github.com/reviewboard/rb-gateway/repositories"
+)
+
+// Make sure that a repository has a hook token for posting events.
+//
+// The token is written to the repository's hook token file (see
+// `repositories.HookTokenPath()`), and can only be used to post hook events
+// for that repository. An existing token is kept unless `force` is true or
+// it is no longer in the token store.
+func EnsureHookToken(store tokens.TokenStore, repository repositories.Repository, force bool) error {
+	path, err := repositories.HookTokenPath(repository)
+	if err != nil {
+		return err
+	}
+
+	if !force {
+		token, err := repositories.ReadHookToken(path)
+		if err == nil && isHookToken(store.Info(token), repository.GetName()) {
+			return nil
+		} else if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	token, err := store.NewWithOptions(tokens.Options{
+		Repositories: []string{repository.GetName()},
+		Role:         tokens.RoleHook,
+	})
+	if err != nil {
+		return err
+	} else if err = store.Save(); err != nil {
+		return err
+	}
+
+	return repositories.WriteHookToken(path, *token)
+}
+
+// Return whether or not a token is a valid hook token for a repository.
+func isHookToken(info *tokens.Info, repoName string) bool {
+	return info != nil &&
+		!info.Expired() &&
+		info.Role == tokens.RoleHook &&
+		len(info.Repositories) == 1 &&
+		info.Repositories[0] == repoName
+}
@@ -0,0 +1,209 @@
+package gateway
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/reviewboard/rb-gateway/config"
+	"github.com/reviewboard/rb-gateway/filelock"
+)
+
+// The most that is read from a PID file.
+const maxPidFileSize = 64
+
+// An error indicating that another process holds a lock.
+type LockedError struct {
+	// The path of the lock file.
+	Path string
+
+	// The ID of the process holding the lock, or 0 if it is not known.
+	Pid int
+}
+
+// Return the error message.
+func (e *LockedError) Error() string {
+	if e.Pid == 0 {
+		return fmt.Sprintf("%s is locked by another rb-gateway process", e.Path)
+	}
+
+	return fmt.Sprintf("%s is locked by another rb-gateway process (PID %d)", e.Path, e.Pid)
+}
+
+// A set of lock files preventing other servers from using the same token and
+// webhook stores.
+//
+// Two servers writing the same stores would silently overwrite each other's
+// changes.
+type StoreLock struct {
+	// The paths of the lock files that are held.
+	paths []string
+
+	// The locks on the lock files, by path.
+	locks map[string]*filelock.Lock
+}
+
+// Return the paths of the lock files for the stores used by the configuration.
+func storeLockPaths(cfg *config.Config) []string {
+	paths := []string{}
+
+	if cfg.TokenStorePath != "" && cfg.TokenStorePath != ":memory:" {
+		paths = append(paths, cfg.TokenStorePath+".lock")
+	}
+
+	if cfg.WebhookStorePath != "" {
+		paths = append(paths, cfg.WebhookStorePath+".lock")
+	}
+
+	return paths
+}
+
+// Lock the token and webhook stores used by the configuration.
+//
+// If another running process holds any of the locks, a *LockedError is
+// returned and no locks are held. The locks are released by the operating
+// system if the process exits without releasing them, so they are never
+// stale.
+func LockStores(cfg *config.Config) (*StoreLock, error) {
+	lock := &StoreLock{
+		locks: make(map[string]*filelock.Lock),
+	}
+
+	for _, path := range storeLockPaths(cfg) {
+		fileLock, err := lockPidFile(path)
+		if err != nil {
+			lock.Release()
+			return nil, err
+		}
+
+		lock.paths = append(lock.paths, path)
+		lock.locks[path] = fileLock
+	}
+
+	return lock, nil
+}
+
+// Return whether or not the lock covers the stores used by the configuration.
+func (l *StoreLock) Covers(cfg *config.Config) bool {
+	paths := storeLockPaths(cfg)
+	if len(paths) != len(l.paths) {
+		return false
+	}
+
+	for i, path := range paths {
+		if path != l.paths[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Release the lock.
+func (l *StoreLock) Release() {
+	l.releaseExcept(nil)
+}
+
+// Release the lock, except for any lock files that are also held by other.
+//
+// This is used when the lock is replaced by a lock for a new configuration
+// that shares some of the same stores.
+func (l *StoreLock) releaseExcept(other *StoreLock) {
+	for _, path := range l.paths {
+		if other == nil || !other.holds(path) {
+			l.locks[path].Remove()
+		}
+	}
+
+	l.paths = nil
+	l.locks = nil
+}
+
+// Return whether or not the lock holds a lock file.
+func (l *StoreLock) holds(path string) bool {
+	for _, held := range l.paths {
+		if held == path {
+			return true
+		}
+	}
+
+	return false
+}
+
+// A locked PID file.
+type PidFile struct {
+	lock *filelock.Lock
+}
+
+// Lock a PID file and write the ID of this process to it.
+//
+// If another running process holds the lock, a *LockedError is returned and
+// the file is not changed.
+func WritePidFile(path string) (*PidFile, error) {
+	lock, err := lockPidFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &PidFile{lock}, nil
+}
+
+// Remove the PID file and release its lock.
+//
+// The file is only removed if it still contains the ID of this process, so
+// that a file written by another process (e.g., one that replaced it after
+// this process's lock was broken) is left alone.
+func (f *PidFile) Remove() error {
+	if pid, err := readPid(f.lock.File()); err != nil || pid != os.Getpid() {
+		return f.lock.Release()
+	}
+
+	return f.lock.Remove()
+}
+
+// Lock a file and write the ID of this process to it.
+//
+// The lock is acquired before the file is written, so the file only ever
+// names the process that holds it. If another process holds the lock, a
+// *LockedError naming that process is returned.
+func lockPidFile(path string) (*filelock.Lock, error) {
+	lock, err := filelock.TryAcquire(path)
+	if err == filelock.ErrLocked {
+		lockedErr := &LockedError{Path: path}
+		if file, err := os.Open(path); err == nil {
+			lockedErr.Pid, _ = readPid(file)
+			file.Close()
+		}
+
+		return nil, lockedErr
+	} else if err != nil {
+		return nil, err
+	}
+
+	file := lock.File()
+	if err = file.Truncate(0); err == nil {
+		if _, err = file.WriteAt([]byte(fmt.Sprintf("%d\n", os.Getpid())), 0); err == nil {
+			err = file.Sync()
+		}
+	}
+
+	if err != nil {
+		lock.Remove()
+		return nil, err
+	}
+
+	return lock, nil
+}
+
+// Read the process ID from a PID file.
+func readPid(file *os.File) (int, error) {
+	content, err := ioutil.ReadAll(io.NewSectionReader(file, 0, maxPidFileSize))
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.Atoi(strings.TrimSpace(string(content)))
+}
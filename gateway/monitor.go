@@ -0,0 +1,151 @@
+package gateway
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/reviewboard/rb-gateway/api"
+	"github.com/reviewboard/rb-gateway/config"
+	"github.com/reviewboard/rb-gateway/repositories"
+	"github.com/reviewboard/rb-gateway/repositories/events"
+)
+
+// Monitors the paths of repositories, so that repositories whose paths
+// disappear are taken out of service until they return.
+//
+// Each repository's path is checked at the configured
+// `repositoryCheckInterval`. When a repository's path is missing (e.g.,
+// because the NFS share it is on was unmounted), the repository is marked
+// unavailable in the API, so that requests for it receive an HTTP 503, and a
+// `repository-status` event is queued for webhooks. When the path returns,
+// the repository is marked available again and another event is queued.
+type PathMonitor struct {
+	// The API to mark repositories (un)available in.
+	api *api.API
+
+	// The function that queues events (e.g., EventQueue.Enqueue()).
+	enqueue api.EventDispatcher
+
+	// A lock for reading from/writing to unavailable.
+	lock sync.Mutex
+
+	// The names of the repositories that are unavailable.
+	unavailable map[string]bool
+
+	// Stop the monitoring goroutine, if it is running.
+	cancel context.CancelFunc
+
+	// The monitoring goroutine.
+	wg sync.WaitGroup
+}
+
+// Return a new path monitor for the API that queues events with `enqueue`.
+//
+// Events should be queued rather than delivered, so that checks (and Stop())
+// do not wait for slow webhooks.
+func NewPathMonitor(api *api.API, enqueue api.EventDispatcher) *PathMonitor {
+	return &PathMonitor{
+		api:         api,
+		enqueue:     enqueue,
+		unavailable: make(map[string]bool),
+	}
+}
+
+// Start monitoring the repositories in the configuration.
+//
+// Any previous monitoring is stopped first. Repositories that were
+// unavailable but are no longer configured are marked available.
+func (m *PathMonitor) Start(cfg *config.Config) {
+	m.Stop()
+
+	m.lock.Lock()
+	for name := range m.unavailable {
+		if _, ok := cfg.Repositories[name]; !ok {
+			delete(m.unavailable, name)
+			m.api.SetRepositoryAvailable(name)
+		}
+	}
+	m.lock.Unlock()
+
+	interval := cfg.RepositoryCheckIntervalDuration()
+	if interval == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	m.cancel = cancel
+
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			for _, repository := range cfg.Repositories {
+				if err := m.Check(cfg, repository); err != nil {
+					log.Printf(`Could not queue status of repository "%s": %s`, repository.GetName(), err.Error())
+				}
+			}
+
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Stop monitoring and wait for any checks in progress to finish.
+func (m *PathMonitor) Stop() {
+	if m.cancel != nil {
+		m.cancel()
+		m.cancel = nil
+	}
+
+	m.wg.Wait()
+}
+
+// Check the path of a repository once.
+//
+// If the repository's availability changed since the last check, it is
+// updated in the API and a `repository-status` event is queued. An error is
+// only returned if the event could not be queued.
+func (m *PathMonitor) Check(cfg *config.Config, repository repositories.Repository) error {
+	name := repository.GetName()
+	pathErr := repositories.CheckPath(repository)
+
+	m.lock.Lock()
+	changed := m.unavailable[name] != (pathErr != nil)
+	if pathErr != nil {
+		m.unavailable[name] = true
+	} else {
+		delete(m.unavailable, name)
+	}
+	m.lock.Unlock()
+
+	if !changed {
+		return nil
+	}
+
+	status := events.RepositoryStatus{Available: pathErr == nil}
+
+	if pathErr != nil {
+		status.Reason = pathErr.Error()
+
+		log.Printf(`Repository "%s" is unavailable: %s`, name, status.Reason)
+		m.api.SetRepositoryUnavailable(name)
+	} else {
+		log.Printf(`Repository "%s" is available again.`, name)
+		m.api.SetRepositoryAvailable(name)
+	}
+
+	return m.enqueue(cfg, repository, events.RepositoryStatusEvent, events.RepositoryStatusPayload{
+		Repository: name,
+		Status:     status,
+	})
+}
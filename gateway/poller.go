@@ -0,0 +1,265 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/reviewboard/rb-gateway/api"
+	"github.com/reviewboard/rb-gateway/config"
+	"github.com/reviewboard/rb-gateway/repositories"
+	"github.com/reviewboard/rb-gateway/repositories/events"
+)
+
+// The prefix of the names of bookmarks in the heads of polled repositories.
+//
+// Bookmarks (which only Mercurial repositories have) are polled along with
+// branches, and the prefix keeps them from colliding with branches that have
+// the same names.
+const bookmarkHeadPrefix = "bookmark:"
+
+// Polls repositories that cannot have hooks installed for new commits.
+//
+// Each repository with a `pollInterval` has its branch and bookmark heads read
+// at that interval. When they change, a push event is created for the new
+// commits and queued to be dispatched to webhooks, just as the repository's
+// hooks would have. The heads are saved to `pollStatePath`, so that commits
+// pushed while polling is stopped (e.g., while the server is down or the
+// configuration is being reloaded) are not missed.
+type Poller struct {
+	// A lock for reading from/writing to the fields below.
+	lock sync.Mutex
+
+	// The last known heads of each repository, by repository name.
+	heads map[string]map[string]string
+
+	// The file that the heads were loaded from and are saved to.
+	statePath string
+
+	// The function that queues push events to be dispatched (e.g.,
+	// EventQueue.Enqueue()).
+	enqueue api.EventDispatcher
+
+	// Stop the polling goroutines, if they are running.
+	cancel context.CancelFunc
+
+	// The polling goroutines.
+	wg sync.WaitGroup
+}
+
+// Return a new poller that queues events with the given function.
+//
+// The function should not wait for the events to be delivered, so that
+// stopping the poller does not wait for webhooks.
+func NewPoller(enqueue api.EventDispatcher) *Poller {
+	return &Poller{
+		heads:   make(map[string]map[string]string),
+		enqueue: enqueue,
+	}
+}
+
+// Start polling the repositories in the configuration.
+//
+// Any previous polling is stopped first.
+func (p *Poller) Start(cfg *config.Config) {
+	p.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	p.cancel = cancel
+
+	for name, interval := range cfg.PollIntervals() {
+		repository, ok := cfg.Repositories[name]
+		if !ok {
+			continue
+		}
+
+		p.wg.Add(1)
+		go func(repository repositories.Repository, interval time.Duration) {
+			defer p.wg.Done()
+
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+
+			for {
+				if err := p.Poll(cfg, repository); err != nil {
+					log.Printf(`Could not poll repository "%s": %s`, repository.GetName(), err.Error())
+				}
+
+				select {
+				case <-ticker.C:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}(repository, interval)
+	}
+}
+
+// Stop polling and wait for any polls in progress to finish.
+//
+// Polls only queue their events, so this does not wait for them to be
+// delivered.
+func (p *Poller) Stop() {
+	if p.cancel != nil {
+		p.cancel()
+		p.cancel = nil
+	}
+
+	p.wg.Wait()
+}
+
+// Poll a repository once.
+//
+// The first poll of a repository (ever, if its heads are saved) only records
+// its heads. Later polls queue a push event for any commits added since the
+// previous poll. If the commits cannot be read or the event cannot be
+// queued, the heads are not updated, so that they are retried on the next
+// poll.
+func (p *Poller) Poll(cfg *config.Config, repository repositories.Repository) error {
+	newHeads, err := pollHeads(repository)
+	if err != nil {
+		return err
+	}
+
+	p.lock.Lock()
+	p.loadHeadsUnsafe(cfg.PollStatePath)
+	oldHeads, polled := p.heads[repository.GetName()]
+	p.lock.Unlock()
+
+	if polled && equalHeads(oldHeads, newHeads) {
+		return nil
+	}
+
+	var payload events.Payload
+	if polled {
+		if payload, err = repository.ParseBranchChanges(oldHeads, newHeads); err != nil {
+			return err
+		}
+	}
+
+	if pushPayload, ok := payload.(events.PushPayload); ok && len(pushPayload.Commits) != 0 {
+		if err = p.enqueue(cfg, repository, events.PushEvent, payload); err != nil {
+			return err
+		}
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.heads[repository.GetName()] = newHeads
+	return p.saveHeadsUnsafe()
+}
+
+// Load the heads saved at the path, unless they were loaded already.
+//
+// Heads that are already known are kept. Errors are logged, and polling then
+// starts over for the repositories whose heads could not be loaded.
+//
+// The caller must hold the lock.
+func (p *Poller) loadHeadsUnsafe(path string) {
+	if path == "" || path == p.statePath {
+		return
+	}
+
+	p.statePath = path
+
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return
+	} else if err != nil {
+		log.Printf("Could not read polled repository heads: %s", err.Error())
+		return
+	}
+
+	saved := make(map[string]map[string]string)
+	if err = json.Unmarshal(content, &saved); err != nil {
+		log.Printf(`Could not parse polled repository heads in "%s": %s`, path, err.Error())
+		return
+	}
+
+	for name, heads := range saved {
+		if _, ok := p.heads[name]; !ok {
+			p.heads[name] = heads
+		}
+	}
+}
+
+// Save the heads, replacing the file atomically.
+//
+// The caller must hold the lock.
+func (p *Poller) saveHeadsUnsafe() error {
+	if p.statePath == "" {
+		return nil
+	}
+
+	content, err := json.Marshal(p.heads)
+	if err != nil {
+		return err
+	}
+
+	file, err := ioutil.TempFile(filepath.Dir(p.statePath), filepath.Base(p.statePath)+".tmp")
+	if err != nil {
+		return err
+	}
+
+	if _, err = file.Write(content); err == nil {
+		err = file.Sync()
+	}
+
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = os.Rename(file.Name(), p.statePath)
+	}
+
+	if err != nil {
+		os.Remove(file.Name())
+	}
+
+	return err
+}
+
+// Return the heads of a repository's branches and bookmarks, by name.
+//
+// Bookmarks are named with bookmarkHeadPrefix.
+func pollHeads(repository repositories.Repository) (map[string]string, error) {
+	refs, err := repository.GetRefs()
+	if err != nil {
+		return nil, err
+	}
+
+	heads := make(map[string]string, len(refs))
+	for _, ref := range refs {
+		switch ref.Type {
+		case repositories.RefTypeBranch:
+			heads[ref.Name] = ref.Id
+
+		case repositories.RefTypeBookmark:
+			heads[bookmarkHeadPrefix+ref.Name] = ref.Id
+		}
+	}
+
+	return heads, nil
+}
+
+// Return whether or not two sets of heads are the same.
+func equalHeads(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for name, id := range a {
+		if otherId, ok := b[name]; !ok || otherId != id {
+			return false
+		}
+	}
+
+	return true
+}
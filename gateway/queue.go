@@ -0,0 +1,120 @@
+package gateway
+
+import (
+	"errors"
+	"log"
+	"sync"
+
+	"github.com/reviewboard/rb-gateway/api"
+	"github.com/reviewboard/rb-gateway/config"
+	"github.com/reviewboard/rb-gateway/repositories"
+	"github.com/reviewboard/rb-gateway/repositories/events"
+)
+
+// The number of events that can be waiting to be delivered at once.
+const eventQueueSize = 1000
+
+var (
+	// An error returned when the event queue is full.
+	EventQueueFullErr = errors.New("Too many events are waiting to be delivered.")
+
+	// An error returned when the event queue has been closed.
+	EventQueueClosedErr = errors.New("The server is shutting down.")
+)
+
+// An event waiting to be delivered.
+type queuedEvent struct {
+	cfg        *config.Config
+	repository repositories.Repository
+	event      string
+	payload    events.Payload
+}
+
+// A queue of events to be delivered to webhooks in the background.
+//
+// Events are delivered one at a time, in the order they were queued, so that
+// (e.g.) pushes to a repository are delivered in the order they happened.
+// Each event is still delivered to its webhooks concurrently (see
+// `webhookWorkers`). Failures are logged.
+type EventQueue struct {
+	// A lock for closing and sending to events.
+	lock sync.RWMutex
+
+	// Whether or not the queue has been closed.
+	closed bool
+
+	// The events waiting to be delivered.
+	events chan queuedEvent
+
+	// The function that delivers each event.
+	dispatch api.EventDispatcher
+
+	// Closed once every queued event has been delivered after Close().
+	done chan struct{}
+}
+
+// Return a new event queue that delivers events with a dispatcher (e.g.,
+// DispatchEvent()).
+func NewEventQueue(dispatch api.EventDispatcher) *EventQueue {
+	q := &EventQueue{
+		events:   make(chan queuedEvent, eventQueueSize),
+		dispatch: dispatch,
+		done:     make(chan struct{}),
+	}
+
+	go q.run()
+
+	return q
+}
+
+// Queue an event to be delivered.
+//
+// This does not wait for the event to be delivered. If the queue is full or
+// closed, an error is returned and the event is not delivered.
+func (q *EventQueue) Enqueue(cfg *config.Config, repository repositories.Repository, event string, payload events.Payload) error {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+
+	if q.closed {
+		return EventQueueClosedErr
+	}
+
+	select {
+	case q.events <- queuedEvent{cfg, repository, event, payload}:
+		return nil
+
+	default:
+		return EventQueueFullErr
+	}
+}
+
+// Stop accepting events.
+//
+// Events that have already been queued are still delivered in the
+// background. This does not wait for them; see Wait().
+func (q *EventQueue) Close() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if !q.closed {
+		q.closed = true
+		close(q.events)
+	}
+}
+
+// Wait for every queued event to be delivered after Close().
+func (q *EventQueue) Wait() {
+	<-q.done
+}
+
+// Deliver queued events until the queue is closed.
+func (q *EventQueue) run() {
+	defer close(q.done)
+
+	for e := range q.events {
+		if err := q.dispatch(e.cfg, e.repository, e.event, e.payload); err != nil {
+			log.Printf(`Could not deliver "%s" event for repository "%s": %s`,
+				e.event, e.repository.GetName(), err.Error())
+		}
+	}
+}
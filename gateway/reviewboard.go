@@ -0,0 +1,228 @@
+package gateway
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/reviewboard/rb-gateway/config"
+	"github.com/reviewboard/rb-gateway/repositories/events"
+	"github.com/reviewboard/rb-gateway/repositories/hooks"
+	"github.com/reviewboard/rb-gateway/version"
+)
+
+// The name that Review Board reports for itself in its API.
+const reviewBoardProductName = "Review Board"
+
+// The versions of Review Board that rb-gateway's features require.
+//
+// Each requirement is only checked if the configuration uses the feature. The
+// versions are those whose release notes introduced support for the feature:
+//
+//	3.0  The RB Gateway hosting service.
+//	     https://www.reviewboard.org/docs/releasenotes/reviewboard/3.0/
+//	4.0  Mercurial repositories in the RB Gateway hosting service, and the
+//	     second version of rb-gateway's push payloads, which give the
+//	     bookmarks and tags that each commit is the target of.
+//	     https://www.reviewboard.org/docs/releasenotes/reviewboard/4.0/
+var reviewBoardRequirements = []struct {
+	// The oldest version of Review Board that supports the feature.
+	Version string
+
+	// A description of the feature, for log messages.
+	Feature string
+
+	// Return whether or not the configuration uses the feature.
+	Used func(cfg *config.Config) bool
+}{
+	{
+		Version: "3.0",
+		Feature: "RB Gateway repositories",
+		Used:    func(cfg *config.Config) bool { return true },
+	},
+	{
+		Version: "4.0",
+		Feature: "Mercurial repositories hosted by RB Gateway",
+		Used:    func(cfg *config.Config) bool { return usesScm(cfg, "hg") },
+	},
+	{
+		Version: "4.0",
+		Feature: "Webhooks that send version 2 push payloads to Review Board",
+		Used:    sendsPushPayloadsToReviewBoard,
+	},
+}
+
+// The product information from the root of the Review Board API.
+type ReviewBoardInfo struct {
+	// The name of the product, which is "Review Board" for Review Board
+	// servers.
+	Name string `json:"name"`
+
+	// The human-readable version (e.g., `5.0 beta 1`).
+	Version string `json:"version"`
+
+	// The version of the installed package (e.g., `5.0b1`).
+	PackageVersion string `json:"package_version"`
+
+	// Whether or not the version is a release, rather than a development
+	// build.
+	IsRelease bool `json:"is_release"`
+}
+
+// Fetch the product information from a Review Board server's API.
+//
+// If the server rejects the request (e.g., because it does not allow
+// anonymous access and no API token is configured), or the response is not
+// from Review Board, an error describing how to fix it is returned.
+func GetReviewBoardInfo(cfg config.ReviewBoardConfig) (*ReviewBoardInfo, error) {
+	apiUrl := cfg.Url + "/api/"
+
+	request, err := http.NewRequest(http.MethodGet, apiUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	request.Header.Set("Accept", "application/json")
+	if cfg.ApiToken != "" {
+		request.Header.Set("Authorization", "token "+cfg.ApiToken)
+	}
+
+	client := http.Client{Timeout: time.Duration(cfg.Timeout) * time.Second}
+
+	rsp, err := client.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("Could not connect to Review Board at %s: %s. Check reviewBoard.url.", cfg.Url, err.Error())
+	}
+	defer rsp.Body.Close()
+
+	switch {
+	case rsp.StatusCode == http.StatusUnauthorized || rsp.StatusCode == http.StatusForbidden:
+		if cfg.ApiToken == "" {
+			return nil, fmt.Errorf("Review Board at %s requires authentication (HTTP %d). Set reviewBoard.apiToken.", cfg.Url, rsp.StatusCode)
+		}
+
+		return nil, fmt.Errorf("Review Board at %s rejected reviewBoard.apiToken (HTTP %d). Check that the token is valid.", cfg.Url, rsp.StatusCode)
+
+	case rsp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("%s returned HTTP %d. Check reviewBoard.url.", apiUrl, rsp.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(rsp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read response from %s: %s", apiUrl, err.Error())
+	}
+
+	var root struct {
+		Product *ReviewBoardInfo `json:"product"`
+	}
+
+	if err = json.Unmarshal(body, &root); err != nil || root.Product == nil || root.Product.Name != reviewBoardProductName {
+		return nil, fmt.Errorf("%s is not the Review Board API. Check reviewBoard.url.", apiUrl)
+	}
+
+	return root.Product, nil
+}
+
+// Return the problems with using a Review Board server with the configuration.
+//
+// Each problem is a message saying which feature needs a newer version of
+// Review Board. Development builds of Review Board are assumed to support
+// everything.
+func CheckReviewBoardCompatibility(cfg *config.Config, info *ReviewBoardInfo) []string {
+	problems := []string{}
+
+	if !info.IsRelease {
+		return problems
+	}
+
+	rbVersion := info.PackageVersion
+	if rbVersion == "" {
+		rbVersion = info.Version
+	}
+
+	for _, requirement := range reviewBoardRequirements {
+		if requirement.Used(cfg) && version.Compare(rbVersion, requirement.Version) < 0 {
+			problems = append(problems, fmt.Sprintf(
+				"%s require Review Board %s or newer, but %s is running Review Board %s. Upgrade Review Board.",
+				requirement.Feature, requirement.Version, cfg.ReviewBoard.Url, info.Version))
+		}
+	}
+
+	return problems
+}
+
+// Check that the configured Review Board server can be reached and supports
+// the configuration, logging any problems.
+//
+// This is run when the server starts, if `reviewBoard.url` is set. Problems
+// are only logged, since Review Board may be upgraded or become reachable
+// later. It returns whether or not there were no problems.
+func CheckReviewBoard(cfg *config.Config) bool {
+	if cfg.ReviewBoard.ApiToken != "" && strings.HasPrefix(strings.ToLower(cfg.ReviewBoard.Url), "http://") {
+		log.Printf("WARNING: reviewBoard.apiToken is sent to %s over plain HTTP, where it can be intercepted. Use an https:// URL.",
+			cfg.ReviewBoard.Url)
+	}
+
+	info, err := GetReviewBoardInfo(cfg.ReviewBoard)
+	if err != nil {
+		log.Printf("WARNING: %s", err.Error())
+		return false
+	}
+
+	problems := CheckReviewBoardCompatibility(cfg, info)
+	for _, problem := range problems {
+		log.Printf("WARNING: %s", problem)
+	}
+
+	if len(problems) != 0 {
+		return false
+	}
+
+	log.Printf("Connected to Review Board %s at %s.", info.Version, cfg.ReviewBoard.Url)
+	return true
+}
+
+// Return whether or not any configured repository uses an SCM.
+func usesScm(cfg *config.Config, scm string) bool {
+	for _, repo := range cfg.Repositories {
+		if repo.GetScm() == scm {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Return whether or not any enabled webhook sends push payloads in
+// rb-gateway's format to the configured Review Board server.
+//
+// If the webhook store cannot be loaded, this is assumed not to be the case;
+// the error is reported when webhooks are dispatched.
+func sendsPushPayloadsToReviewBoard(cfg *config.Config) bool {
+	store, err := hooks.LoadStore(cfg.WebhookStorePath, cfg.RepositorySet())
+	if err != nil {
+		return false
+	}
+
+	prefix := strings.ToLower(strings.TrimSuffix(cfg.ReviewBoard.Url, "/") + "/")
+
+	for _, hook := range store {
+		if !hook.Enabled || (hook.Format != "" && hook.Format != hooks.FormatRBGateway) {
+			continue
+		} else if !strings.HasPrefix(strings.ToLower(hook.Url), prefix) {
+			continue
+		}
+
+		for _, event := range hook.Events {
+			if event == events.PushEvent {
+				return true
+			}
+		}
+	}
+
+	return false
+}
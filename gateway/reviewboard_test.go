@@ -0,0 +1,130 @@
+package gateway_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/reviewboard/rb-gateway/config"
+	"github.com/reviewboard/rb-gateway/gateway"
+	"github.com/reviewboard/rb-gateway/helpers"
+	"github.com/reviewboard/rb-gateway/repositories"
+)
+
+func TestCheckReviewBoard(t *testing.T) {
+	assert := assert.New(t)
+
+	gitRepo, _ := helpers.CreateGitRepo(t, "git-repo")
+	defer helpers.CleanupRepository(t, gitRepo.Path)
+
+	// Only the SCM of the Mercurial repository is checked.
+	hgRepo := &repositories.HgRepository{
+		RepositoryInfo: repositories.RepositoryInfo{
+			Name: "hg-repo",
+			Path: "/does/not/exist/hg-repo",
+		},
+	}
+
+	product := `{"name": "Review Board", "version": "3.0.24", "package_version": "3.0.24", "is_release": true}`
+	var authorization string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+
+		switch {
+		case r.URL.Path != "/api/":
+			http.NotFound(w, r)
+		case product == "":
+			http.Error(w, `{"stat": "fail"}`, http.StatusUnauthorized)
+		default:
+			fmt.Fprintf(w, `{"stat": "ok", "product": %s}`, product)
+		}
+	}))
+	defer server.Close()
+
+	cfg := helpers.CreateTestConfig(t, gitRepo)
+	cfg.ReviewBoard = config.ReviewBoardConfig{
+		Url:      server.URL,
+		ApiToken: "api-token",
+		Timeout:  10,
+	}
+
+	info, err := gateway.GetReviewBoardInfo(cfg.ReviewBoard)
+	assert.Nil(err)
+	if assert.NotNil(info) {
+		assert.Equal("3.0.24", info.PackageVersion)
+		assert.Empty(gateway.CheckReviewBoardCompatibility(&cfg, info))
+	}
+	assert.Equal("token api-token", authorization)
+	assert.True(gateway.CheckReviewBoard(&cfg))
+
+	// Mercurial repositories need a newer version.
+	hgCfg := helpers.CreateTestConfig(t, gitRepo, hgRepo)
+	hgCfg.ReviewBoard = cfg.ReviewBoard
+
+	problems := gateway.CheckReviewBoardCompatibility(&hgCfg, info)
+	if assert.Equal(1, len(problems)) {
+		assert.Contains(problems[0], "Mercurial")
+		assert.Contains(problems[0], "Review Board 4.0 or newer")
+	}
+	assert.False(gateway.CheckReviewBoard(&hgCfg))
+
+	// So do webhooks that send push payloads to Review Board.
+	webhookCfg := helpers.CreateTestConfig(t, gitRepo)
+	webhookCfg.ReviewBoard = cfg.ReviewBoard
+	helpers.WriteTestWebhookStore(t, helpers.CreateTestWebhookStore(server.URL+"/repos/1/rbgateway/hooks"), &webhookCfg)
+	defer os.Remove(webhookCfg.WebhookStorePath)
+
+	problems = gateway.CheckReviewBoardCompatibility(&webhookCfg, info)
+	if assert.Equal(1, len(problems)) {
+		assert.Contains(problems[0], "version 2 push payloads")
+		assert.Contains(problems[0], "Review Board 4.0 or newer")
+	}
+
+	// Pre-releases come before the release they lead up to.
+	assert.NotEmpty(gateway.CheckReviewBoardCompatibility(&hgCfg, &gateway.ReviewBoardInfo{
+		Name:           "Review Board",
+		Version:        "4.0 beta 2",
+		PackageVersion: "4.0b2",
+		IsRelease:      true,
+	}))
+
+	// Development builds are not checked.
+	assert.Empty(gateway.CheckReviewBoardCompatibility(&hgCfg, &gateway.ReviewBoardInfo{
+		Name:           "Review Board",
+		Version:        "2.0",
+		PackageVersion: "2.0",
+	}))
+
+	product = ""
+
+	_, err = gateway.GetReviewBoardInfo(cfg.ReviewBoard)
+	if assert.NotNil(err) {
+		assert.Contains(err.Error(), "rejected reviewBoard.apiToken")
+	}
+
+	cfg.ReviewBoard.ApiToken = ""
+
+	_, err = gateway.GetReviewBoardInfo(cfg.ReviewBoard)
+	if assert.NotNil(err) {
+		assert.Contains(err.Error(), "Set reviewBoard.apiToken")
+	}
+
+	product = `{"name": "Something Else", "version": "1.0"}`
+
+	_, err = gateway.GetReviewBoardInfo(cfg.ReviewBoard)
+	if assert.NotNil(err) {
+		assert.Contains(err.Error(), "is not the Review Board API")
+	}
+
+	cfg.ReviewBoard.Url = server.URL + "/reviews"
+
+	_, err = gateway.GetReviewBoardInfo(cfg.ReviewBoard)
+	if assert.NotNil(err) {
+		assert.Contains(err.Error(), "HTTP 404")
+	}
+}
@@ -1,7 +1,11 @@
 package helpers
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"io/ioutil"
+	"os"
 	"path/filepath"
 	"testing"
 	"time"
@@ -9,6 +13,7 @@ import (
 	"github.com/stretchr/testify/assert"
 	"gopkg.in/src-d/go-git.v4"
 	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
 	"gopkg.in/src-d/go-git.v4/plumbing/object"
 
 	"github.com/reviewboard/rb-gateway/repositories"
@@ -50,6 +55,39 @@ func CreateGitRepo(t *testing.T, name string) (*repositories.GitRepository, *git
 	return repo, rawRepo
 }
 
+// Create a bare Git repository for testing, seeded with the files from
+// `SeedGitRepo`.
+//
+// The caller is responsible for cleaning up the filesystem afterwards.
+func CreateBareGitRepo(t *testing.T, name string) (*repositories.GitRepository, *git.Repository) {
+	t.Helper()
+	assert := assert.New(t)
+
+	seedRepo, rawSeedRepo := CreateGitRepo(t, name)
+	defer CleanupRepository(t, seedRepo.Path)
+	SeedGitRepo(t, seedRepo, rawSeedRepo)
+
+	path, err := ioutil.TempDir("", "rb-gateway-test-bare-")
+	assert.Nil(err, "Could not create temporary directory.")
+	path, err = filepath.EvalSymlinks(path)
+	assert.Nil(err, "Could not get absolute path.")
+
+	rawRepo, err := git.PlainClone(path, true, &git.CloneOptions{
+		URL: seedRepo.Path,
+	})
+	assert.Nil(err, "Could not clone repository.")
+
+	repo := &repositories.GitRepository{
+		RepositoryInfo: repositories.RepositoryInfo{
+			Name: name,
+			Path: path,
+		},
+		Bare: true,
+	}
+
+	return repo, rawRepo
+}
+
 // Add files to a repository and commit them, returning the commit ID.
 //
 // Callers can compare committed file contents with the result of `helpers.GetRepoFiles`.
@@ -107,6 +145,69 @@ func CreateGitBranch(t *testing.T, repo *repositories.GitRepository, rawRepo *gi
 	return branch
 }
 
+// Commit a Git LFS pointer to a file and store the file in the repository's
+// local LFS store, returning the commit ID and the LFS object ID.
+func CreateGitLfsFile(t *testing.T, repo *repositories.GitRepository, rawRepo *git.Repository, path string, content []byte) (plumbing.Hash, string) {
+	t.Helper()
+	assert := assert.New(t)
+
+	hash := sha256.Sum256(content)
+	oid := hex.EncodeToString(hash[:])
+
+	objectDir := filepath.Join(repo.Path, git.GitDirName, "lfs", "objects", oid[0:2], oid[2:4])
+	assert.Nil(os.MkdirAll(objectDir, 0755))
+	assert.Nil(ioutil.WriteFile(filepath.Join(objectDir, oid), content, 0644))
+
+	worktree, err := rawRepo.Worktree()
+	assert.Nil(err)
+
+	pointer := fmt.Sprintf("version https://git-lfs.github.com/spec/v1\noid sha256:%s\nsize %d\n", oid, len(content))
+	createAndAddFilesGit(t, repo.Path, worktree, map[string][]byte{
+		path: []byte(pointer),
+	})
+
+	commitId, err := worktree.Commit("Add large file", &git.CommitOptions{
+		Author: &object.Signature{
+			Name:  "Author",
+			Email: "author@example.com",
+			When:  time.Now(),
+		},
+	})
+	assert.Nil(err)
+
+	return commitId, oid
+}
+
+// Commit symlinks, keyed by path, to the given targets and return the commit
+// ID.
+func CreateGitSymlinks(t *testing.T, repo *repositories.GitRepository, rawRepo *git.Repository, links map[string]string) plumbing.Hash {
+	t.Helper()
+	assert := assert.New(t)
+
+	worktree, err := rawRepo.Worktree()
+	assert.Nil(err)
+
+	for path, target := range links {
+		fullPath := filepath.Join(repo.Path, path)
+		assert.Nil(os.MkdirAll(filepath.Dir(fullPath), 0755))
+		assert.Nil(os.Symlink(target, fullPath))
+
+		_, err = worktree.Add(path)
+		assert.Nil(err)
+	}
+
+	commitId, err := worktree.Commit("Add symlinks", &git.CommitOptions{
+		Author: &object.Signature{
+			Name:  "Author",
+			Email: "author@example.com",
+			When:  time.Now(),
+		},
+	})
+	assert.Nil(err)
+
+	return commitId
+}
+
 // Return the object ID of the given file.
 func GetRepositoryFileId(t *testing.T, rawRepo *git.Repository, path string) plumbing.Hash {
 	t.Helper()
@@ -137,6 +238,61 @@ func GetRepoHead(t *testing.T, rawRepo *git.Repository) plumbing.Hash {
 	return head.Hash()
 }
 
+// Attach a note to a commit under `refs/notes/commits`, returning the notes commit ID.
+func CreateGitNote(t *testing.T, rawRepo *git.Repository, commitId plumbing.Hash, message string) plumbing.Hash {
+	t.Helper()
+	assert := assert.New(t)
+
+	blob := rawRepo.Storer.NewEncodedObject()
+	blob.SetType(plumbing.BlobObject)
+	writer, err := blob.Writer()
+	assert.Nil(err)
+	_, err = writer.Write([]byte(message))
+	assert.Nil(err)
+	assert.Nil(writer.Close())
+
+	blobId, err := rawRepo.Storer.SetEncodedObject(blob)
+	assert.Nil(err)
+
+	tree := object.Tree{
+		Entries: []object.TreeEntry{
+			{
+				Name: commitId.String(),
+				Mode: filemode.Regular,
+				Hash: blobId,
+			},
+		},
+	}
+
+	encoded := rawRepo.Storer.NewEncodedObject()
+	assert.Nil(tree.Encode(encoded))
+	treeId, err := rawRepo.Storer.SetEncodedObject(encoded)
+	assert.Nil(err)
+
+	signature := object.Signature{
+		Name:  "Author",
+		Email: "author@example.com",
+		When:  time.Now(),
+	}
+
+	commit := object.Commit{
+		Author:    signature,
+		Committer: signature,
+		Message:   "Notes added by 'git notes add'",
+		TreeHash:  treeId,
+	}
+
+	encoded = rawRepo.Storer.NewEncodedObject()
+	assert.Nil(commit.Encode(encoded))
+	notesId, err := rawRepo.Storer.SetEncodedObject(encoded)
+	assert.Nil(err)
+
+	err = rawRepo.Storer.SetReference(plumbing.NewHashReference("refs/notes/commits", notesId))
+	assert.Nil(err)
+
+	return notesId
+}
+
 // Create some files and add them to to an index.
 func createAndAddFilesGit(t *testing.T, path string, worktree *git.Worktree, files map[string][]byte) {
 	t.Helper()
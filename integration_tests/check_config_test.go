@@ -0,0 +1,90 @@
+package integration_tests
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/reviewboard/rb-gateway/commands"
+	"github.com/reviewboard/rb-gateway/config"
+	"github.com/reviewboard/rb-gateway/helpers"
+	"github.com/reviewboard/rb-gateway/repositories/hooks"
+)
+
+// Run `rb-gateway check-config` and return its report and exit status.
+func runCheckConfig(t *testing.T, cfgPath string) (commands.ConfigReport, bool) {
+	t.Helper()
+	assert := assert.New(t)
+
+	cmd := exec.Command(os.Args[0], "--config", cfgPath, "check-config", "--json")
+	output, err := cmd.Output()
+
+	var report commands.ConfigReport
+	assert.Nil(json.Unmarshal(output, &report))
+
+	return report, err == nil
+}
+
+// Integration tests for `rb-gateway check-config`.
+func TestIntegrationForCheckConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	repo, _ := helpers.CreateGitRepo(t, "repo")
+	defer helpers.CleanupRepository(t, repo.Path)
+
+	cfgDir, cfg := setupConfig(t, repo)
+	defer os.RemoveAll(cfgDir)
+
+	assert.Nil(hooks.WebhookStore{}.Save(cfg.WebhookStorePath))
+
+	cfgPath := filepath.Join(cfgDir, "config.json")
+
+	report, ok := runCheckConfig(t, cfgPath)
+	assert.True(ok)
+	assert.True(report.Passed)
+	assert.Equal(0, len(report.Warnings))
+
+	for _, check := range report.Checks {
+		assert.True(check.Passed, check.Name)
+	}
+
+	// Point the repository at a directory that is not a repository and use a
+	// missing htpasswd file.
+	cfg.RepositoryData = []config.RawRepository{
+		{Name: "repo", Path: cfgDir, Scm: "git"},
+	}
+	cfg.HtpasswdPath = filepath.Join(cfgDir, "does-not-exist")
+
+	data, err := json.Marshal(&cfg)
+	assert.Nil(err)
+	assert.Nil(ioutil.WriteFile(cfgPath, data, 0600))
+
+	report, ok = runCheckConfig(t, cfgPath)
+	assert.False(ok)
+	assert.False(report.Passed)
+
+	failed := map[string]bool{}
+	for _, check := range report.Checks {
+		if !check.Passed {
+			failed[check.Name] = true
+		}
+	}
+
+	assert.Equal(map[string]bool{
+		`repository "repo"`: true,
+		"htpasswdPath":      true,
+	}, failed)
+
+	// An unparsable configuration is reported as well.
+	assert.Nil(ioutil.WriteFile(cfgPath, []byte("{"), 0600))
+
+	report, ok = runCheckConfig(t, cfgPath)
+	assert.False(ok)
+	assert.Equal(1, len(report.Checks))
+	assert.Equal("configuration", report.Checks[0].Name)
+}
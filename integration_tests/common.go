@@ -1,6 +1,7 @@
 package integration_tests
 
 import (
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"path/filepath"
@@ -83,13 +84,34 @@ func runTests(t *testing.T, cases []testCase, upstream repositories.Repository,
 		assert.Equalf("/test-hook", request.URL.Path, "URL for request %d does not match", i)
 		assert.Equalf(events.PushEvent, request.Header.Get("X-RBG-Event"), "X-RBG-Event header for request %d does not match", i)
 		assert.Equalf(hook.SignPayload(body), request.Header.Get("X-RBG-Signature"), "Signature for request %d does not match", i)
+		// The authors and committers of the commits depend on when they were
+		// made, so they are only checked for presence.
+		var received events.PushPayload
+		assert.Nilf(json.Unmarshal(body, &received), "Body for request %d is not a push payload", i)
+
+		var commit events.PushPayloadCommit
+		if assert.Equalf(1, len(received.Commits), "Commits for request %d do not match", i) {
+			commit = received.Commits[0]
+
+			assert.NotEqualf("", commit.AuthorEmail, "Author email for request %d is missing", i)
+			assert.NotEqualf("", commit.Date, "Date for request %d is missing", i)
+			assert.NotEqualf("", commit.CommitterEmail, "Committer email for request %d is missing", i)
+			assert.NotEqualf("", commit.CommitterDate, "Committer date for request %d is missing", i)
+		}
+
 		payload := events.PushPayload{
 			Repository: upstream.GetName(),
 			Commits: []events.PushPayloadCommit{
 				{
-					Id:      testCase.commitId,
-					Message: testCase.message,
-					Target:  testCase.target,
+					Id:             testCase.commitId,
+					Message:        testCase.message,
+					Author:         commit.Author,
+					AuthorEmail:    commit.AuthorEmail,
+					Date:           commit.Date,
+					Committer:      commit.Committer,
+					CommitterEmail: commit.CommitterEmail,
+					CommitterDate:  commit.CommitterDate,
+					Target:         testCase.target,
 				},
 			},
 		}
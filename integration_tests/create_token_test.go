@@ -0,0 +1,56 @@
+package integration_tests
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/reviewboard/rb-gateway/api/tokens"
+	"github.com/reviewboard/rb-gateway/helpers"
+)
+
+// Integration tests for `rb-gateway create-token`.
+func TestIntegrationForCreateToken(t *testing.T) {
+	assert := assert.New(t)
+
+	repo, _ := helpers.CreateGitRepo(t, "repo")
+	defer helpers.CleanupRepository(t, repo.Path)
+
+	cfgDir, cfg := setupConfig(t, repo)
+	defer os.RemoveAll(cfgDir)
+
+	cmd := exec.Command(os.Args[0],
+		"--config", filepath.Join(cfgDir, "config.json"),
+		"create-token",
+		"--expires", "1h",
+		"--repository", repo.Name,
+		"--read-only")
+
+	output, err := cmd.Output()
+	assert.Nil(err)
+
+	token := strings.TrimSpace(string(output))
+	assert.Equal(tokens.TokenSize, len(token))
+
+	store, err := tokens.NewStore(cfg.TokenStorePath)
+	assert.Nil(err)
+
+	info := store.Info(token)
+	if assert.NotNil(info) {
+		assert.WithinDuration(time.Now().Add(time.Hour), info.Expires, time.Minute)
+		assert.Equal([]string{repo.Name}, info.Repositories)
+		assert.True(info.ReadOnly)
+	}
+
+	cmd = exec.Command(os.Args[0],
+		"--config", filepath.Join(cfgDir, "config.json"),
+		"create-token",
+		"--repository", "does-not-exist")
+
+	assert.NotNil(cmd.Run())
+}
@@ -72,6 +72,10 @@ func TestIntegrtionForGitHooks(t *testing.T) {
 	assert.Nil(gitRepo.Push(pushOptions))
 	fmt.Printf("Response from first push:\n %s\n", progressBuffer.String())
 
+	// Webhooks are delivered in the background, so wait for the first push's
+	// before pushing again to keep them in order.
+	requests := helpers.AssertNumRequests(t, 1, requestsChan)
+
 	progressBuffer.Reset()
 
 	newHead, err := worktree.Commit("New commit", &git.CommitOptions{
@@ -85,7 +89,7 @@ func TestIntegrtionForGitHooks(t *testing.T) {
 	assert.Nil(gitRepo.Push(pushOptions))
 	fmt.Printf("Response from second push:\n %s\n", progressBuffer.String())
 
-	requests := helpers.AssertNumRequests(t, 2, requestsChan)
+	requests = append(requests, helpers.AssertNumRequests(t, 1, requestsChan)...)
 
 	cases := []testCase{
 		{
@@ -109,6 +113,95 @@ func TestIntegrtionForGitHooks(t *testing.T) {
 	runTests(t, cases, upstream, hook)
 }
 
+// Integration tests for Git hooks installed into a shared hooks directory.
+//
+// Both repositories run hooks from the same `core.hooksPath`, so each
+// repository's script must only deliver webhooks for pushes to it.
+func TestIntegrationForGitHooksSharedDir(t *testing.T) {
+	assert := assert.New(t)
+
+	server, requestsChan := helpers.CreateRequestRecorder(t)
+
+	hookDir, err := ioutil.TempDir("", "rb-gateway-hooks-")
+	assert.Nil(err)
+	defer os.RemoveAll(hookDir)
+
+	upstream := setupBareGitRepo(t)
+	defer helpers.CleanupRepository(t, upstream.Path)
+
+	other := setupBareGitRepo(t)
+	other.Name = "other"
+	defer helpers.CleanupRepository(t, other.Path)
+
+	cfgDir, cfg := setupConfig(t, upstream)
+	defer os.RemoveAll(cfgDir)
+
+	hook := setupStore(t, server.URL, &cfg)
+
+	for _, repo := range []*repositories.GitRepository{upstream, other} {
+		rawRepo, err := git.PlainOpen(repo.Path)
+		assert.Nil(err)
+
+		repoCfg, err := rawRepo.Config()
+		assert.Nil(err)
+		repoCfg.Raw.Section("core").SetOption("hooksPath", hookDir)
+		assert.Nil(rawRepo.Storer.SetConfig(repoCfg))
+
+		assert.Nil(repo.InstallHooks(filepath.Join(cfgDir, "config.json"), false))
+	}
+
+	repo, gitRepo := helpers.CreateGitRepo(t, "clone")
+	defer helpers.CleanupRepository(t, repo.Path)
+
+	for name, path := range map[string]string{"origin": upstream.Path, "other": other.Path} {
+		_, err = gitRepo.CreateRemote(&git_config.RemoteConfig{
+			Name: name,
+			URLs: []string{path},
+		})
+		assert.Nil(err)
+	}
+
+	worktree, err := gitRepo.Worktree()
+	assert.Nil(err)
+
+	head, err := worktree.Commit("Initial commit", &git.CommitOptions{
+		Author: &object.Signature{
+			Name:  "Author",
+			Email: "author@example.com",
+			When:  time.Now(),
+		},
+	})
+	assert.Nil(err)
+
+	for _, remote := range []string{"origin", "other"} {
+		assert.Nil(gitRepo.Push(&git.PushOptions{
+			RemoteName: remote,
+			RefSpecs:   []git_config.RefSpec{"refs/heads/master:refs/heads/master"},
+		}))
+	}
+
+	requests := helpers.AssertNumRequests(t, 1, requestsChan)
+
+	select {
+	case <-requestsChan:
+		t.Error("Received a webhook for a push to another repository")
+	case <-time.After(time.Second):
+	}
+
+	cases := []testCase{
+		{
+			recorded: &requests[0],
+			message:  "Initial commit",
+			commitId: head.String(),
+			target: events.PushPayloadCommitTarget{
+				Branch: "master",
+			},
+		},
+	}
+
+	runTests(t, cases, upstream, hook)
+}
+
 // Create a bare repository that we can push to.
 func setupBareGitRepo(t *testing.T) *repositories.GitRepository {
 	t.Helper()
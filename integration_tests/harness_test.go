@@ -0,0 +1,90 @@
+package integration_tests
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/reviewboard/rb-gateway/api"
+	"github.com/reviewboard/rb-gateway/commands"
+	"github.com/reviewboard/rb-gateway/repositories"
+)
+
+// Integration tests for the test harness.
+//
+// This runs `rb-gateway test-harness`, creates a session with the credentials
+// it reports, and queries the repository it created.
+func TestIntegrationForTestHarness(t *testing.T) {
+	assert := assert.New(t)
+
+	listener, err := net.Listen("tcp", "localhost:0")
+	assert.Nil(err)
+	port := listener.Addr().(*net.TCPAddr).Port
+	assert.Nil(listener.Close())
+
+	cmd := exec.Command(os.Args[0], "test-harness", "--port", fmt.Sprintf("%d", port))
+	stdout, err := cmd.StdoutPipe()
+	assert.Nil(err)
+	assert.Nil(cmd.Start())
+
+	var info commands.HarnessInfo
+	line, err := bufio.NewReader(stdout).ReadBytes('\n')
+	assert.Nil(err)
+	assert.Nil(json.Unmarshal(line, &info))
+	assert.Equal(1, len(info.Repositories))
+
+	defer func() {
+		assert.Nil(cmd.Process.Signal(os.Interrupt))
+		assert.Nil(cmd.Wait())
+
+		_, err := os.Stat(info.Root)
+		assert.True(os.IsNotExist(err))
+	}()
+
+	request, err := http.NewRequest("GET", info.Url+"/session", nil)
+	assert.Nil(err)
+	request.SetBasicAuth(info.Username, info.Password)
+
+	// The server may not be listening yet.
+	var rsp *http.Response
+	for i := 0; i < 50; i++ {
+		if rsp, err = http.DefaultClient.Do(request); err == nil {
+			break
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	if !assert.Nil(err) {
+		return
+	}
+
+	assert.Equal(http.StatusOK, rsp.StatusCode)
+
+	var session api.Session
+	assert.Nil(json.NewDecoder(rsp.Body).Decode(&session))
+	rsp.Body.Close()
+
+	request, err = http.NewRequest("GET", fmt.Sprintf("%s/repos/%s/branches", info.Url, info.Repositories[0].Name), nil)
+	assert.Nil(err)
+	request.Header.Set(api.PrivateTokenHeader, session.PrivateToken)
+
+	rsp, err = http.DefaultClient.Do(request)
+	assert.Nil(err)
+	defer rsp.Body.Close()
+
+	assert.Equal(http.StatusOK, rsp.StatusCode)
+
+	var branches []repositories.Branch
+	assert.Nil(json.NewDecoder(rsp.Body).Decode(&branches))
+	assert.Equal(1, len(branches))
+	assert.Equal("master", branches[0].Name)
+}
@@ -0,0 +1,163 @@
+package integration_tests
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/reviewboard/rb-gateway/api/tokens"
+)
+
+// Integration tests for `rb-gateway post-hook-event`.
+func TestIntegrationForPostHookEvent(t *testing.T) {
+	assert := assert.New(t)
+
+	tempDir, err := ioutil.TempDir("", "rb-gateway-post-hook-event-")
+	assert.Nil(err)
+	defer os.RemoveAll(tempDir)
+
+	tokenPath := filepath.Join(tempDir, "rbgateway-hook-token")
+	assert.Nil(ioutil.WriteFile(tokenPath, []byte("hook-token\n"), 0600))
+
+	var path, token string
+	var body struct {
+		Input string            `json:"input"`
+		Env   map[string]string `json:"env"`
+	}
+
+	status := http.StatusNoContent
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		token = r.Header.Get(tokens.TokenHeader)
+
+		content, err := ioutil.ReadAll(r.Body)
+		assert.Nil(err)
+		assert.Nil(json.Unmarshal(content, &body))
+
+		if status != http.StatusNoContent {
+			http.Error(w, "Push rejected: not allowed", status)
+			return
+		}
+
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	cmd := exec.Command(os.Args[0], "post-hook-event", "--url", server.URL, "--token-file", tokenPath,
+		"--stdin", "repo", "push")
+	cmd.Env = append(os.Environ(), "GIT_PUSH_OPTION_COUNT=0")
+	cmd.Stdin = strings.NewReader("old new refs/heads/master\n")
+	output, err := cmd.CombinedOutput()
+	assert.Nil(err, string(output))
+
+	assert.Equal("/repos/repo/hook-events/push", path)
+	assert.Equal("hook-token", token)
+	assert.Equal("old new refs/heads/master\n", body.Input)
+	assert.Equal("0", body.Env["GIT_PUSH_OPTION_COUNT"])
+
+	// Gating events are rejected when the server rejects them.
+	status = http.StatusForbidden
+
+	cmd = exec.Command(os.Args[0], "post-hook-event", "--url", server.URL, "--token-file", tokenPath,
+		"repo", "pre-push")
+	output, err = cmd.CombinedOutput()
+	assert.NotNil(err)
+
+	assert.Equal("/repos/repo/hook-events/pre-push", path)
+	assert.Equal("", body.Input)
+	assert.Contains(string(output), "Push rejected: not allowed")
+}
+
+// Integration tests for `rb-gateway post-hook-event` with a server that
+// requires client certificates.
+func TestIntegrationForPostHookEventTLS(t *testing.T) {
+	assert := assert.New(t)
+
+	tempDir, err := ioutil.TempDir("", "rb-gateway-post-hook-event-")
+	assert.Nil(err)
+	defer os.RemoveAll(tempDir)
+
+	tokenPath := filepath.Join(tempDir, "rbgateway-hook-token")
+	assert.Nil(ioutil.WriteFile(tokenPath, []byte("hook-token\n"), 0600))
+
+	// A self-signed client certificate for the hooks.
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Nil(err)
+	clientCert, err := x509.ParseCertificate(der)
+	assert.Nil(err)
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.Nil(err)
+
+	certPath := filepath.Join(tempDir, "hook.pem")
+	keyPath := filepath.Join(tempDir, "hook.key")
+	assert.Nil(ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	assert.Nil(ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert)
+
+	var requests int
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	server.TLS = &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  clientCAs,
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	caPath := filepath.Join(tempDir, "ca.pem")
+	assert.Nil(ioutil.WriteFile(caPath,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0600))
+
+	// Without the CA, the server's certificate is not trusted.
+	cmd := exec.Command(os.Args[0], "post-hook-event", "--url", server.URL, "--token-file", tokenPath,
+		"--cert", certPath, "--key", keyPath, "repo", "push")
+	output, err := cmd.CombinedOutput()
+	assert.NotNil(err)
+	assert.Contains(string(output), "certificate")
+
+	// Without a client certificate, the server refuses the connection.
+	cmd = exec.Command(os.Args[0], "post-hook-event", "--url", server.URL, "--token-file", tokenPath,
+		"--ca-file", caPath, "repo", "push")
+	output, err = cmd.CombinedOutput()
+	assert.NotNil(err)
+
+	assert.Equal(0, requests)
+
+	cmd = exec.Command(os.Args[0], "post-hook-event", "--url", server.URL, "--token-file", tokenPath,
+		"--ca-file", caPath, "--cert", certPath, "--key", keyPath, "repo", "push")
+	output, err = cmd.CombinedOutput()
+	assert.Nil(err, string(output))
+
+	assert.Equal(1, requests)
+}
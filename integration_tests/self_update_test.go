@@ -0,0 +1,161 @@
+package integration_tests
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/reviewboard/rb-gateway/version"
+)
+
+// Integration tests for `rb-gateway self-update`.
+func TestIntegrationForSelfUpdate(t *testing.T) {
+	assert := assert.New(t)
+
+	tempDir, err := ioutil.TempDir("", "rb-gateway-self-update-")
+	assert.Nil(err)
+	defer os.RemoveAll(tempDir)
+
+	// The binary under test is replaced, so a copy is updated. It is built
+	// with a release signing key embedded, like release builds.
+	keyFile, publicKey, err := version.GenerateSigningKey()
+	assert.Nil(err)
+
+	otherKeyFile, _, err := version.GenerateSigningKey()
+	assert.Nil(err)
+
+	exePath := filepath.Join(tempDir, "rb-gateway")
+	build := exec.Command("go", "build", "-o", exePath,
+		"-ldflags", "-X github.com/reviewboard/rb-gateway/version.PublicKey="+publicKey)
+	build.Dir = ".."
+
+	output, err := build.CombinedOutput()
+	if !assert.Nil(err, string(output)) {
+		return
+	}
+
+	original, err := ioutil.ReadFile(exePath)
+	assert.Nil(err)
+
+	binary := []byte("#!/bin/sh\necho updated\n")
+	checksum := sha256.Sum256(binary)
+
+	manifest := version.Manifest{
+		Version: "99.0",
+		Artifacts: map[string]version.Artifact{
+			version.Platform(): {
+				Url:    "binaries/rb-gateway",
+				Sha256: hex.EncodeToString(checksum[:]),
+			},
+		},
+	}
+
+	signingKey := keyFile
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/releases/release.json", func(w http.ResponseWriter, r *http.Request) {
+		data, err := json.Marshal(manifest)
+		assert.Nil(err)
+		w.Write(data)
+	})
+	mux.HandleFunc("/releases/release.json.sig", func(w http.ResponseWriter, r *http.Request) {
+		data, err := json.Marshal(manifest)
+		assert.Nil(err)
+
+		signature, err := version.SignManifest(data, signingKey)
+		assert.Nil(err)
+		w.Write(signature)
+	})
+	mux.HandleFunc("/releases/binaries/rb-gateway", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(binary)
+	})
+
+	server := httptest.NewTLSServer(mux)
+	defer server.Close()
+
+	// The updater trusts the test server's certificate through the system
+	// certificate pool.
+	certPath := filepath.Join(tempDir, "cert.pem")
+	assert.Nil(ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: server.Certificate().Raw,
+	}), 0644))
+
+	selfUpdate := func(args ...string) ([]byte, error) {
+		cmd := exec.Command(exePath, append([]string{"self-update"}, args...)...)
+		cmd.Env = append(os.Environ(), "SSL_CERT_FILE="+certPath)
+		return cmd.CombinedOutput()
+	}
+
+	manifestUrl := server.URL + "/releases/release.json"
+
+	// Manifests are only downloaded over https.
+	output, err = selfUpdate("--url", "http"+strings.TrimPrefix(manifestUrl, "https"), "--check")
+	assert.NotNil(err)
+	assert.Contains(string(output), "must be an https URL")
+
+	// A manifest signed with another key is rejected.
+	signingKey = otherKeyFile
+
+	output, err = selfUpdate("--url", manifestUrl, "--check")
+	assert.NotNil(err)
+	assert.Contains(string(output), "signature does not match")
+
+	signingKey = keyFile
+
+	// The binary under test is a development build, which is never replaced
+	// unless forced.
+	output, err = selfUpdate("--url", manifestUrl, "--check")
+	assert.Nil(err, string(output))
+	assert.Contains(string(output), "The latest release is rb-gateway 99.0. This is a development build.")
+
+	output, err = selfUpdate("--url", manifestUrl)
+	assert.NotNil(err)
+	assert.Contains(string(output), "--force")
+
+	// A binary that does not match its checksum is not installed.
+	manifest.Artifacts[version.Platform()] = version.Artifact{
+		Url:    "binaries/rb-gateway",
+		Sha256: hex.EncodeToString(make([]byte, sha256.Size)),
+	}
+
+	output, err = selfUpdate("--url", manifestUrl, "--force")
+	assert.NotNil(err)
+	assert.Contains(string(output), "does not match the release manifest")
+
+	content, err := ioutil.ReadFile(exePath)
+	assert.Nil(err)
+	assert.Equal(original, content)
+
+	manifest.Artifacts[version.Platform()] = version.Artifact{
+		Url:    "binaries/rb-gateway",
+		Sha256: hex.EncodeToString(checksum[:]),
+	}
+
+	output, err = selfUpdate("--url", manifestUrl, "--force")
+	assert.Nil(err, string(output))
+	assert.Contains(string(output), "Updated rb-gateway from a development build to 99.0.")
+
+	content, err = ioutil.ReadFile(exePath)
+	assert.Nil(err)
+	assert.Equal(binary, content)
+
+	info, err := os.Stat(exePath)
+	assert.Nil(err)
+	assert.Equal(os.FileMode(0755), info.Mode().Perm())
+
+	output, err = exec.Command(exePath).CombinedOutput()
+	assert.Nil(err, string(output))
+	assert.Equal("updated\n", string(output))
+}
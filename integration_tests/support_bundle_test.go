@@ -0,0 +1,126 @@
+package integration_tests
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/reviewboard/rb-gateway/config"
+	"github.com/reviewboard/rb-gateway/helpers"
+	"github.com/reviewboard/rb-gateway/repositories/hooks"
+)
+
+// Read the entries of a support bundle, by name.
+func readSupportBundle(t *testing.T, path string) map[string]string {
+	t.Helper()
+	assert := assert.New(t)
+
+	f, err := os.Open(path)
+	assert.Nil(err)
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	assert.Nil(err)
+
+	entries := make(map[string]string)
+	reader := tar.NewReader(gz)
+
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+
+		assert.Nil(err)
+
+		content, err := ioutil.ReadAll(reader)
+		assert.Nil(err)
+
+		entries[header.Name] = string(content)
+	}
+
+	return entries
+}
+
+// Integration tests for `rb-gateway support-bundle`.
+func TestIntegrationForSupportBundle(t *testing.T) {
+	assert := assert.New(t)
+
+	repo, _ := helpers.CreateGitRepo(t, "repo")
+	defer helpers.CleanupRepository(t, repo.Path)
+
+	cfgDir, cfg := setupConfig(t, repo)
+	defer os.RemoveAll(cfgDir)
+
+	cfg.WebhookSecret = "very-secret-webhook-value"
+	cfgPath := filepath.Join(cfgDir, "config.json")
+
+	data, err := json.Marshal(&cfg)
+	assert.Nil(err)
+	assert.Nil(ioutil.WriteFile(cfgPath, data, 0600))
+
+	assert.Nil(hooks.WebhookStore{
+		"test-hook": &hooks.Webhook{
+			Id:      "test-hook",
+			Enabled: true,
+			Url:     "http://example.com/",
+			Secret:  "hook-secret-value",
+			Events:  []string{"push"},
+			Repos:   []string{"repo"},
+		},
+	}.Save(cfg.WebhookStorePath))
+
+	logPath := filepath.Join(cfgDir, "rb-gateway.log")
+	assert.Nil(ioutil.WriteFile(logPath, []byte("Starting server\n"), 0600))
+
+	bundlePath := filepath.Join(cfgDir, "bundle.tar.gz")
+
+	cmd := exec.Command(os.Args[0], "--config", cfgPath, "support-bundle",
+		"--output", bundlePath, "--log-file", logPath)
+	output, err := cmd.Output()
+	assert.Nil(err)
+	assert.Equal(bundlePath, strings.TrimSpace(string(output)))
+
+	entries := readSupportBundle(t, bundlePath)
+
+	for _, name := range []string{"config.json", "version.json", "check-config.json", "hooks.json", "stores.json", "logs/rb-gateway.log"} {
+		assert.Contains(entries, name)
+	}
+
+	assert.NotContains(entries["config.json"], "very-secret-webhook-value")
+	assert.Contains(entries["config.json"], config.RedactedValue)
+	assert.NotContains(entries["stores.json"], "hook-secret-value")
+	assert.NotContains(entries["stores.json"], "http://example.com/")
+	assert.Equal("Starting server\n", entries["logs/rb-gateway.log"])
+
+	var stores struct {
+		Webhooks map[string]struct {
+			Enabled bool `json:"enabled"`
+		} `json:"webhooks"`
+	}
+	assert.Nil(json.Unmarshal([]byte(entries["stores.json"]), &stores))
+	assert.True(stores.Webhooks["test-hook"].Enabled)
+
+	// A bundle is still generated for an unparsable configuration, without
+	// the configuration itself.
+	assert.Nil(ioutil.WriteFile(cfgPath, []byte(`{"webhookSecret": "very-secret-webhook-value"`), 0600))
+
+	cmd = exec.Command(os.Args[0], "--config", cfgPath, "support-bundle", "--output", bundlePath)
+	assert.Nil(cmd.Run())
+
+	entries = readSupportBundle(t, bundlePath)
+	assert.Contains(entries, "config-error.txt")
+	assert.Contains(entries, "check-config.json")
+	assert.NotContains(entries, "config.json")
+	assert.NotContains(entries, "stores.json")
+	assert.NotContains(entries["config-error.txt"], "very-secret-webhook-value")
+}
@@ -0,0 +1,128 @@
+package integration_tests
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/foomo/htpasswd"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/reviewboard/rb-gateway/helpers"
+)
+
+// Integration tests for `rb-gateway user`.
+func TestIntegrationForUser(t *testing.T) {
+	assert := assert.New(t)
+
+	repo, _ := helpers.CreateGitRepo(t, "repo")
+	defer helpers.CleanupRepository(t, repo.Path)
+
+	cfgDir, cfg := setupConfig(t, repo)
+	defer os.RemoveAll(cfgDir)
+
+	run := func(stdin string, args ...string) error {
+		args = append([]string{"--config", filepath.Join(cfgDir, "config.json"), "user"}, args...)
+		cmd := exec.Command(os.Args[0], args...)
+		cmd.Stdin = strings.NewReader(stdin)
+		return cmd.Run()
+	}
+
+	checkPassword := func(username, password string) bool {
+		passwords, err := htpasswd.ParseHtpasswdFile(cfg.HtpasswdPath)
+		assert.Nil(err)
+
+		hash, ok := passwords[username]
+		return ok && bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	}
+
+	assert.Nil(run("secret\n", "add", "alice"))
+	assert.True(checkPassword("alice", "secret"))
+	assert.True(checkPassword("username", "password"))
+
+	// Adding an existing user fails.
+	assert.NotNil(run("other\n", "add", "alice"))
+	assert.True(checkPassword("alice", "secret"))
+
+	assert.Nil(run("changed\n", "passwd", "alice"))
+	assert.True(checkPassword("alice", "changed"))
+
+	assert.NotNil(run("changed\n", "passwd", "bob"))
+	assert.NotNil(run("\n", "add", "bob"))
+	assert.NotNil(run("secret\n", "add", "bob:smith"))
+
+	assert.Nil(run("", "remove", "alice"))
+	assert.False(checkPassword("alice", "changed"))
+	assert.True(checkPassword("username", "password"))
+
+	assert.NotNil(run("", "remove", "alice"))
+}
+
+// Integration tests for `rb-gateway serve --initial-user`.
+func TestIntegrationForInitialUser(t *testing.T) {
+	assert := assert.New(t)
+
+	repo, _ := helpers.CreateGitRepo(t, "repo")
+	defer helpers.CleanupRepository(t, repo.Path)
+
+	cfgDir, cfg := setupConfig(t, repo)
+	defer os.RemoveAll(cfgDir)
+
+	listener, err := net.Listen("tcp", "localhost:0")
+	assert.Nil(err)
+	cfg.Port = uint16(listener.Addr().(*net.TCPAddr).Port)
+	assert.Nil(listener.Close())
+
+	cfg.RepositoryData = nil
+	helpers.WriteConfig(t, filepath.Join(cfgDir, "config.json"), &cfg)
+	assert.Nil(os.Remove(cfg.HtpasswdPath))
+
+	configPath := filepath.Join(cfgDir, "config.json")
+
+	// A generated password is only shown on a terminal, so the server does
+	// not start without one.
+	output, err := exec.Command(os.Args[0], "--config", configPath, "serve",
+		"--initial-user", "admin").CombinedOutput()
+	assert.NotNil(err)
+	assert.Contains(string(output), "--initial-password-file")
+
+	_, err = os.Stat(cfg.HtpasswdPath)
+	assert.True(os.IsNotExist(err))
+
+	cmd := exec.Command(os.Args[0], "--config", configPath, "serve",
+		"--initial-user", "admin", "--initial-password-file=-")
+	cmd.Stdin = strings.NewReader("initial-password\n")
+	stderr, err := cmd.StderrPipe()
+	assert.Nil(err)
+	assert.Nil(cmd.Start())
+
+	// Read the log until the server has started.
+	var log strings.Builder
+	scanner := bufio.NewScanner(stderr)
+	for scanner.Scan() {
+		line := scanner.Text()
+		log.WriteString(line + "\n")
+
+		if strings.Contains(line, "rb-gateway started: ") {
+			break
+		}
+	}
+
+	assert.Nil(cmd.Process.Signal(os.Interrupt))
+	for scanner.Scan() {
+	}
+	assert.Nil(cmd.Wait())
+
+	assert.Contains(log.String(), `with user "admin"`)
+	assert.NotContains(log.String(), "initial-password")
+
+	passwords, err := htpasswd.ParseHtpasswdFile(cfg.HtpasswdPath)
+	assert.Nil(err)
+	assert.Equal(1, len(passwords))
+	assert.Nil(bcrypt.CompareHashAndPassword([]byte(passwords["admin"]), []byte("initial-password")))
+}
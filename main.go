@@ -1,12 +1,15 @@
 package main
 
 import (
+	"log"
 	"os"
 
 	"github.com/alecthomas/kingpin"
 
+	"github.com/reviewboard/rb-gateway/api/tokens"
 	"github.com/reviewboard/rb-gateway/commands"
 	"github.com/reviewboard/rb-gateway/config"
+	"github.com/reviewboard/rb-gateway/version"
 )
 
 var (
@@ -15,7 +18,12 @@ var (
 			Default(config.DefaultConfigPath).
 			String()
 
-	serve = app.Command("serve", "Start the API server.").Default()
+	serve                    = app.Command("serve", "Start the API server.").Default()
+	serveQuiet               = serve.Flag("quiet", "Do not log the startup banner.").Bool()
+	servePidFile             = serve.Flag("pid-file", "Write the ID of the server process to a file.").String()
+	serveLock                = serve.Flag("lock", "Refuse to start if another server is using the same token and webhook stores.").Bool()
+	serveInitialUser         = serve.Flag("initial-user", "Create the htpasswd file with this user if it does not exist.").String()
+	serveInitialPasswordFile = serve.Flag("initial-password-file", `Read the password for --initial-user from a file ("-" for standard input). By default, a random password is generated and printed to the terminal.`).String()
 
 	webhook  = app.Command("trigger-webhooks", "Trigger matching webhooks.")
 	repoName = webhook.Arg("repository", "The name of the repository to trigger the webhook for.").
@@ -24,19 +32,172 @@ var (
 	event = webhook.Arg("event", "The name of the event.").
 		Required().
 		String()
+	webhookPayloadFile = webhook.Flag("payload-file", `Replay a payload as sent to webhooks from a file ("-" for standard input).`).String()
+	webhookCommitRange = webhook.Flag("commit-range", "Send a payload for a range of commits (<start>..<end>).").String()
+	webhookServer      = webhook.Flag("server", "Have the server at this URL create and deliver the payload for --commit-range, instead of reading the repository.").String()
+	webhookTokenFile   = webhook.Flag("token-file", "The path to a file containing an API token for --server.").String()
+	webhookVerbose     = webhook.Flag("verbose", "Log how the hook was invoked and its environment, with secrets redacted.").Bool()
+
+	postHookEvent          = app.Command("post-hook-event", "Post an event from a repository hook to the server.").Hidden()
+	postHookEventUrl       = postHookEvent.Flag("url", "The URL of the server.").Required().String()
+	postHookEventTokenFile = postHookEvent.Flag("token-file", "The path to the repository's hook token.").Required().String()
+	postHookEventStdin     = postHookEvent.Flag("stdin", "Post the hook's standard input.").Bool()
+	postHookEventCAFile    = postHookEvent.Flag("ca-file", "The path to a file of CA certificates to trust.").String()
+	postHookEventCertFile  = postHookEvent.Flag("cert", "The path to a client certificate to present.").String()
+	postHookEventKeyFile   = postHookEvent.Flag("key", "The path to the client certificate's private key.").String()
+	postHookEventRepoName  = postHookEvent.Arg("repository", "The name of the repository.").Required().String()
+	postHookEventEvent     = postHookEvent.Arg("event", "The name of the event.").Required().String()
 
 	reinstallHooks = app.Command("reinstall-hooks", "Re-install hook scripts if  the configuration path has changed.")
+
+	reindex         = app.Command("reindex", "Rebuild the commit index of a repository.")
+	reindexRepoName = reindex.Arg("repository", "The name of the repository to rebuild the commit index for.").
+			Required().
+			String()
+
+	generateSecretsKey     = app.Command("generate-secrets-key", "Generate a key for encrypting webhook secrets.")
+	generateSecretsKeyPath = generateSecretsKey.Arg("path", "The path to write the key to.").
+				Required().
+				String()
+
+	encryptWebhookSecrets = app.Command("encrypt-webhook-secrets", "Encrypt the plaintext secrets in the webhook store.")
+
+	checkConfig     = app.Command("check-config", "Check the configuration and the files and repositories it refers to.")
+	checkConfigJson = checkConfig.Flag("json", "Print the report as JSON.").Bool()
+
+	migrateConfig = app.Command("migrate-config", "Move the credentials in a configuration from rb-gateway 1.0 to an htpasswd file.")
+
+	createToken             = app.Command("create-token", "Create an API token and print it.")
+	createTokenExpires      = createToken.Flag("expires", "How long until the token expires (e.g., 720h). By default, tokens do not expire.").Duration()
+	createTokenRepositories = createToken.Flag("repository", "Restrict the token to a repository. May be repeated.").Strings()
+	createTokenReadOnly     = createToken.Flag("read-only", "Restrict the token to reading.").Bool()
+
+	supportBundle         = app.Command("support-bundle", "Write a tarball of diagnostic information for support requests.")
+	supportBundleOutput   = supportBundle.Flag("output", "The path to write the tarball to.").String()
+	supportBundleLogFiles = supportBundle.Flag("log-file", "Include the end of a log file. May be repeated.").Strings()
+
+	user               = app.Command("user", "Manage users in the htpasswd file.")
+	userAdd            = user.Command("add", "Add a user.")
+	userAddUsername    = userAdd.Arg("username", "The name of the user.").Required().String()
+	userRemove         = user.Command("remove", "Remove a user.")
+	userRemoveUsername = userRemove.Arg("username", "The name of the user.").Required().String()
+	userPasswd         = user.Command("passwd", "Change the password of a user.")
+	userPasswdUsername = userPasswd.Arg("username", "The name of the user.").Required().String()
+
+	selfUpdate      = app.Command("self-update", "Replace this binary with the latest release.")
+	selfUpdateUrl   = selfUpdate.Flag("url", "The URL of the release manifest. Defaults to updateUrl from the configuration.").String()
+	selfUpdateCheck = selfUpdate.Flag("check", "Only report whether a newer release is available.").Bool()
+	selfUpdateForce = selfUpdate.Flag("force", "Install the release even if it is not newer than this build.").Bool()
+
+	release            = app.Command("release", "Write the release manifest for the binaries built by the release target of the Makefile.").Hidden()
+	releaseDist        = release.Flag("dist", "The directory containing the release binaries.").Default("dist").String()
+	releaseBaseUrl     = release.Flag("base-url", "The URL the binaries will be published at. By default, they are relative to the manifest.").String()
+	releaseSigningKey  = release.Flag("signing-key", "The file containing the private key to sign the release manifest with.").String()
+	releaseGenerateKey = release.Flag("generate-key", "Generate a release signing key, write it to this file, and print its public key.").String()
+
+	harness         = app.Command("test-harness", "Run a server against temporary repositories for integration testing.").Hidden()
+	harnessPort     = harness.Flag("port", "The port to listen on.").Default("8888").Uint16()
+	harnessUsername = harness.Flag("username", "The username for creating sessions.").Default("username").String()
+	harnessPassword = harness.Flag("password", "The password for creating sessions.").Default("password").String()
+	harnessHg       = harness.Flag("hg", "Also create a Mercurial repository.").Bool()
+	harnessKeep     = harness.Flag("keep", "Keep the temporary files after exiting.").Bool()
 )
 
 func main() {
+	app.Version(version.String())
+
 	switch kingpin.MustParse(app.Parse(os.Args[1:])) {
 	case serve.FullCommand():
-		commands.Serve(*configPath)
+		commands.Serve(*configPath, commands.ServeOptions{
+			Quiet:               *serveQuiet,
+			PidFile:             *servePidFile,
+			Lock:                *serveLock,
+			InitialUser:         *serveInitialUser,
+			InitialPasswordFile: *serveInitialPasswordFile,
+		})
 
 	case webhook.FullCommand():
-		commands.TriggerWebhooks(*configPath, *repoName, *event)
+		err := commands.TriggerWebhooks(*configPath, *repoName, *event, commands.ReplayOptions{
+			PayloadFile: *webhookPayloadFile,
+			CommitRange: *webhookCommitRange,
+			Server:      *webhookServer,
+			TokenFile:   *webhookTokenFile,
+		}, *webhookVerbose)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+
+	case postHookEvent.FullCommand():
+		commands.PostHookEvent(commands.PostHookEventOptions{
+			Url:       *postHookEventUrl,
+			TokenFile: *postHookEventTokenFile,
+			Stdin:     *postHookEventStdin,
+			CAFile:    *postHookEventCAFile,
+			CertFile:  *postHookEventCertFile,
+			KeyFile:   *postHookEventKeyFile,
+		}, *postHookEventRepoName, *postHookEventEvent)
 
 	case reinstallHooks.FullCommand():
 		commands.ReinstallHooks(*configPath)
+
+	case reindex.FullCommand():
+		commands.Reindex(*configPath, *reindexRepoName)
+
+	case generateSecretsKey.FullCommand():
+		commands.GenerateSecretsKey(*generateSecretsKeyPath)
+
+	case encryptWebhookSecrets.FullCommand():
+		commands.EncryptWebhookSecrets(*configPath)
+
+	case checkConfig.FullCommand():
+		commands.CheckConfig(*configPath, *checkConfigJson)
+
+	case migrateConfig.FullCommand():
+		commands.MigrateConfig(*configPath)
+
+	case createToken.FullCommand():
+		commands.CreateToken(*configPath, tokens.Options{
+			TTL:          *createTokenExpires,
+			Repositories: *createTokenRepositories,
+			ReadOnly:     *createTokenReadOnly,
+		})
+
+	case supportBundle.FullCommand():
+		commands.SupportBundle(*configPath, commands.SupportBundleOptions{
+			Output:   *supportBundleOutput,
+			LogFiles: *supportBundleLogFiles,
+		})
+
+	case userAdd.FullCommand():
+		commands.AddUser(*configPath, *userAddUsername)
+
+	case userRemove.FullCommand():
+		commands.RemoveUser(*configPath, *userRemoveUsername)
+
+	case userPasswd.FullCommand():
+		commands.SetUserPassword(*configPath, *userPasswdUsername)
+
+	case selfUpdate.FullCommand():
+		commands.SelfUpdate(*configPath, commands.SelfUpdateOptions{
+			Url:   *selfUpdateUrl,
+			Check: *selfUpdateCheck,
+			Force: *selfUpdateForce,
+		})
+
+	case release.FullCommand():
+		if *releaseGenerateKey != "" {
+			commands.GenerateReleaseKey(*releaseGenerateKey)
+		} else {
+			commands.Release(*releaseDist, *releaseBaseUrl, *releaseSigningKey)
+		}
+
+	case harness.FullCommand():
+		commands.TestHarness(commands.HarnessOptions{
+			Port:     *harnessPort,
+			Username: *harnessUsername,
+			Password: *harnessPassword,
+			Hg:       *harnessHg,
+			Keep:     *harnessKeep,
+		})
 	}
 }
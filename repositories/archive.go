@@ -0,0 +1,179 @@
+package repositories
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"time"
+
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+// The formats supported by Repository.WriteArchive.
+const (
+	ArchiveFormatTarGz = "tar.gz"
+	ArchiveFormatZip   = "zip"
+)
+
+// Return whether or not the archive format is supported.
+func IsValidArchiveFormat(format string) bool {
+	return format == ArchiveFormatTarGz || format == ArchiveFormatZip
+}
+
+// Return the MIME type of an archive format.
+func ArchiveContentType(format string) string {
+	switch format {
+	case ArchiveFormatTarGz:
+		return "application/gzip"
+
+	case ArchiveFormatZip:
+		return "application/zip"
+	}
+
+	return "application/octet-stream"
+}
+
+// An archive that files from a Git tree can be written to.
+type archiveWriter interface {
+	// Add a file to the archive.
+	//
+	// For symlinks, the contents are the target of the link.
+	WriteFile(name string, mode os.FileMode, size int64, modified time.Time, contents io.Reader) error
+
+	// Finish writing the archive.
+	Close() error
+}
+
+// Return a writer for an archive in the given format.
+func newArchiveWriter(w io.Writer, format string) (archiveWriter, error) {
+	switch format {
+	case ArchiveFormatTarGz:
+		gz := gzip.NewWriter(w)
+		return &tarArchiveWriter{gz: gz, tar: tar.NewWriter(gz)}, nil
+
+	case ArchiveFormatZip:
+		return &zipArchiveWriter{zip.NewWriter(w)}, nil
+	}
+
+	return nil, fmt.Errorf(`Unsupported archive format "%s".`, format)
+}
+
+// An archiveWriter for gzipped tarballs.
+type tarArchiveWriter struct {
+	gz  *gzip.Writer
+	tar *tar.Writer
+}
+
+func (a *tarArchiveWriter) WriteFile(name string, mode os.FileMode, size int64, modified time.Time, contents io.Reader) error {
+	header := &tar.Header{
+		Name:    name,
+		Mode:    int64(mode.Perm()),
+		ModTime: modified,
+	}
+
+	if mode&os.ModeSymlink != 0 {
+		target, err := readAll(contents, size)
+		if err != nil {
+			return err
+		}
+
+		header.Typeflag = tar.TypeSymlink
+		header.Linkname = string(target)
+		header.Mode = 0777
+
+		return a.tar.WriteHeader(header)
+	}
+
+	header.Typeflag = tar.TypeReg
+	header.Size = size
+
+	if err := a.tar.WriteHeader(header); err != nil {
+		return err
+	}
+
+	_, err := io.Copy(a.tar, contents)
+	return err
+}
+
+func (a *tarArchiveWriter) Close() error {
+	if err := a.tar.Close(); err != nil {
+		return err
+	}
+
+	return a.gz.Close()
+}
+
+// An archiveWriter for zip files.
+type zipArchiveWriter struct {
+	zip *zip.Writer
+}
+
+func (a *zipArchiveWriter) WriteFile(name string, mode os.FileMode, size int64, modified time.Time, contents io.Reader) error {
+	header := &zip.FileHeader{
+		Name:     name,
+		Method:   zip.Deflate,
+		Modified: modified,
+	}
+	header.SetMode(mode)
+
+	w, err := a.zip.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(w, contents)
+	return err
+}
+
+func (a *zipArchiveWriter) Close() error {
+	return a.zip.Close()
+}
+
+// Read all of a reader with a known size.
+func readAll(r io.Reader, size int64) ([]byte, error) {
+	buf := make([]byte, size)
+	_, err := io.ReadFull(r, buf)
+	return buf, err
+}
+
+// Write the files in a Git commit to an archive.
+//
+// Every file is placed under `prefix` and given the commit's committer time as
+// its modification time. Submodules are skipped by go-git's file iterator.
+func writeGitArchive(w io.Writer, commit *object.Commit, format, prefix string) error {
+	archive, err := newArchiveWriter(w, format)
+	if err != nil {
+		return err
+	}
+
+	tree, err := commit.Tree()
+	if err != nil {
+		return err
+	}
+
+	modified := commit.Committer.When
+
+	err = tree.Files().ForEach(func(file *object.File) error {
+		mode, err := file.Mode.ToOSFileMode()
+		if err != nil {
+			return err
+		}
+
+		contents, err := file.Reader()
+		if err != nil {
+			return err
+		}
+		defer contents.Close()
+
+		return archive.WriteFile(path.Join(prefix, file.Name), mode, file.Size, modified, contents)
+	})
+	if err != nil {
+		return err
+	}
+
+	return archive.Close()
+}
@@ -0,0 +1,43 @@
+package repositories
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Return an error if a repository's path is missing or does not contain the
+// repository.
+//
+// The path is checked for the files that mark it as a repository, rather than
+// only for its existence, since a file system that has been unmounted (e.g.,
+// an NFS share) usually leaves an empty directory behind at its mount point.
+func CheckPath(repo Repository) error {
+	path := repo.GetPath()
+
+	if _, err := os.Stat(path); err != nil {
+		return err
+	}
+
+	var markers []string
+	switch repo.GetScm() {
+	case "git":
+		// Either a worktree's `.git` directory (or file) or a bare
+		// repository's `HEAD`.
+		markers = []string{".git", "HEAD"}
+
+	case "hg":
+		markers = []string{".hg"}
+
+	default:
+		return nil
+	}
+
+	for _, marker := range markers {
+		if _, err := os.Stat(filepath.Join(path, marker)); err == nil {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%s does not contain a %s repository", path, repo.GetScm())
+}
@@ -0,0 +1,163 @@
+package repositories
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+const (
+	// How long an opened Git repository may be re-used before it is re-opened.
+	gitRepoCacheTTL = 5 * time.Minute
+)
+
+var (
+	gitRepoCache = newGitRepositoryCache(gitRepoCacheTTL)
+)
+
+// A cache of opened Git repositories, keyed by path.
+//
+// Opening a repository reads its packfile indices, which is expensive to do on
+// every request. go-git does not notice packfiles that are added after the
+// indices are read (e.g., by a push or `git gc`), so a cached handle is
+// re-opened whenever the repository's pack directory changes or the handle
+// is older than the TTL.
+type gitRepositoryCache struct {
+	lock    sync.Mutex
+	ttl     time.Duration
+	entries map[string]*gitRepositoryCacheEntry
+}
+
+// An entry in the gitRepositoryCache.
+type gitRepositoryCacheEntry struct {
+	repo     *git.Repository
+	openedAt time.Time
+	packDir  string
+	packTime time.Time
+}
+
+// Create a new repository cache.
+func newGitRepositoryCache(ttl time.Duration) *gitRepositoryCache {
+	return &gitRepositoryCache{
+		ttl:     ttl,
+		entries: make(map[string]*gitRepositoryCacheEntry),
+	}
+}
+
+// Return an opened repository for the given path.
+//
+// A cached handle will be returned if it is still valid.
+func (c *gitRepositoryCache) Open(path string) (*git.Repository, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if entry, ok := c.entries[path]; ok && entry.isValid(c.ttl) {
+		return entry.repo, nil
+	}
+
+	repo, err := git.PlainOpen(path)
+	if err != nil {
+		delete(c.entries, path)
+		return nil, err
+	}
+
+	// Force go-git to load the packfile indices now, while we hold the lock.
+	// They are loaded lazily and without synchronization, so loading them
+	// from concurrent requests would race.
+	if _, err = repo.Storer.EncodedObject(plumbing.AnyObject, plumbing.ZeroHash); err != nil && err != plumbing.ErrObjectNotFound {
+		return nil, err
+	}
+
+	entry := &gitRepositoryCacheEntry{
+		repo:     repo,
+		openedAt: time.Now(),
+		packDir:  gitPackDir(path),
+	}
+	entry.packTime = modTime(entry.packDir)
+
+	c.entries[path] = entry
+	return repo, nil
+}
+
+// Remove all entries from the cache.
+func (c *gitRepositoryCache) Flush() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.entries = make(map[string]*gitRepositoryCacheEntry)
+}
+
+// Remove the entries for paths that are not in `paths`.
+func (c *gitRepositoryCache) Retain(paths map[string]bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for path := range c.entries {
+		if !paths[path] {
+			delete(c.entries, path)
+		}
+	}
+}
+
+// Return whether or not the cached handle may still be used.
+func (entry *gitRepositoryCacheEntry) isValid(ttl time.Duration) bool {
+	if time.Since(entry.openedAt) > ttl {
+		return false
+	}
+
+	return entry.packDir == "" || modTime(entry.packDir).Equal(entry.packTime)
+}
+
+// Return the pack directory for the repository at the given path.
+//
+// If the pack directory cannot be found (e.g., for a linked worktree), an
+// empty string is returned and cached handles will only expire by TTL.
+func gitPackDir(path string) string {
+	for _, dir := range []string{
+		filepath.Join(path, git.GitDirName, "objects", "pack"),
+		filepath.Join(path, "objects", "pack"),
+	} {
+		if stat, err := os.Stat(dir); err == nil && stat.IsDir() {
+			return dir
+		}
+	}
+
+	return ""
+}
+
+// Return the modification time of the given path, or the zero time if it
+// cannot be determined.
+func modTime(path string) time.Time {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+
+	return stat.ModTime()
+}
+
+// Remove all cached repository handles.
+//
+// This should be called when the configuration is reloaded so that handles for
+// repositories that have been removed are released.
+func FlushRepositoryCache() {
+	gitRepoCache.Flush()
+}
+
+// Remove the cached handles for repositories other than the given ones.
+//
+// This should be called when the configuration is reloaded so that handles for
+// repositories that have been removed are released, while the handles for the
+// others stay warm.
+func RetainRepositoryCache(repos map[string]Repository) {
+	paths := make(map[string]bool, len(repos))
+	for _, repo := range repos {
+		paths[repo.GetPath()] = true
+	}
+
+	gitRepoCache.Retain(paths)
+}
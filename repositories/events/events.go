@@ -4,10 +4,22 @@ import (
 	"bytes"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"net/url"
+	"strings"
 )
 
 const (
 	PushEvent string = "push"
+
+	// An event dispatched before a push is accepted.
+	//
+	// Webhooks for this event can reject the push. See IsGatingEvent().
+	PrePushEvent string = "pre-push"
+
+	// An event dispatched when a repository becomes unavailable (e.g., its
+	// path has disappeared) or available again.
+	RepositoryStatusEvent string = "repository-status"
 )
 
 var (
@@ -16,7 +28,9 @@ var (
 	exists = struct{}{}
 
 	validEvents = map[string]struct{}{
-		PushEvent: exists,
+		PushEvent:             exists,
+		PrePushEvent:          exists,
+		RepositoryStatusEvent: exists,
 	}
 )
 
@@ -25,6 +39,12 @@ func IsValidEvent(event string) bool {
 	return ok
 }
 
+// Return whether or not webhooks for the event can reject the operation that
+// triggered it.
+func IsGatingEvent(event string) bool {
+	return event == PrePushEvent
+}
+
 // The payload type.
 type Payload interface {
 	// The event the payload is for.
@@ -45,6 +65,14 @@ type Payload interface {
 	GetContent() (string, interface{})
 }
 
+// A payload that links to its repository in the gateway's API.
+type linkedPayload interface {
+	// The URL of the repository, or an empty string if there is none.
+	//
+	// This will be included in the marshalled payload, if present.
+	GetRepositoryUrl() string
+}
+
 // Marshal a payload into a JSON blob.
 func MarshalPayload(p Payload) ([]byte, error) {
 	buffer := bytes.NewBufferString("{\n")
@@ -66,6 +94,16 @@ func MarshalPayload(p Payload) ([]byte, error) {
 	buffer.WriteString("\t\"repository\": ")
 	buffer.Write(b)
 
+	if linked, ok := p.(linkedPayload); ok && linked.GetRepositoryUrl() != "" {
+		b, err = json.Marshal(linked.GetRepositoryUrl())
+		if err != nil {
+			return nil, err
+		}
+
+		buffer.WriteString(",\n\t\"repository_url\": ")
+		buffer.Write(b)
+	}
+
 	fieldName, content := p.GetContent()
 	if fieldName != "" {
 		buffer.WriteString(",\n")
@@ -91,3 +129,57 @@ func MarshalPayload(p Payload) ([]byte, error) {
 
 	return buffer.Bytes(), nil
 }
+
+// Unmarshal a JSON blob created by MarshalPayload.
+//
+// This allows a payload to be sent again (e.g., after an outage). If the blob
+// names an event, it must be `event`.
+func UnmarshalPayload(event string, data []byte) (Payload, error) {
+	var header struct {
+		Event string `json:"event"`
+	}
+
+	if err := json.Unmarshal(data, &header); err != nil {
+		return nil, err
+	} else if header.Event != "" && header.Event != event {
+		return nil, fmt.Errorf(`Payload is for event "%s", not "%s".`, header.Event, event)
+	}
+
+	switch event {
+	case PushEvent, PrePushEvent:
+		var payload PushPayload
+		if err := json.Unmarshal(data, &payload); err != nil {
+			return nil, err
+		}
+
+		if event == PrePushEvent {
+			return PrePushPayload{PushPayload: payload}, nil
+		}
+
+		return payload, nil
+
+	case RepositoryStatusEvent:
+		var payload RepositoryStatusPayload
+		if err := json.Unmarshal(data, &payload); err != nil {
+			return nil, err
+		}
+
+		return payload, nil
+
+	default:
+		return nil, InvalidEventErr
+	}
+}
+
+// Return the URL of a repository in the gateway's API.
+//
+// Each segment of the repository name is escaped, but its slashes are kept, as
+// the API's routes expect.
+func repositoryUrl(baseUrl, repoName string) string {
+	segments := strings.Split(repoName, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+
+	return fmt.Sprintf("%s/repos/%s", strings.TrimSuffix(baseUrl, "/"), strings.Join(segments, "/"))
+}
@@ -86,3 +86,301 @@ func TestMarshalPushPayload(t *testing.T) {
 
 	assert.Equal(expected, string(bytes))
 }
+
+func TestMarshalGitHubPayloads(t *testing.T) {
+	assert := assert.New(t)
+
+	payload := events.PushPayload{
+		Repository: "foo",
+		Commits: []events.PushPayloadCommit{
+			{
+				Id:             "abababab",
+				Message:        "Commit message 1",
+				Committer:      "Jane Doe",
+				CommitterEmail: "jane@example.com",
+				Target: events.PushPayloadCommitTarget{
+					Branch: "master",
+				},
+			},
+			{
+				Id:             "cdcdcdcd",
+				Message:        "Commit message 2",
+				Committer:      "John Doe",
+				CommitterEmail: "john@example.com",
+				Added:          []string{"NEWS"},
+				Modified:       []string{"README", "src/main.go"},
+				Target: events.PushPayloadCommitTarget{
+					Branch: "dev",
+					Tags:   []string{"v1"},
+				},
+			},
+		},
+		Refs: []events.PushPayloadRef{
+			{
+				Ref:    "refs/heads/master",
+				Before: "efefefef",
+				After:  "abababab",
+			},
+			{
+				Ref:    "refs/heads/dev",
+				Before: "0000000000000000000000000000000000000000",
+				After:  "cdcdcdcd",
+			},
+		},
+	}
+
+	blobs, err := events.MarshalGitHubPayloads(payload)
+	assert.Nil(err)
+
+	// Each ref is sent separately, with the commits pushed to it.
+	expected := []string{`{
+	"ref": "refs/heads/master",
+	"before": "efefefef",
+	"after": "abababab",
+	"repository": {
+		"name": "foo",
+		"full_name": "foo",
+		"url": ""
+	},
+	"pusher": {
+		"name": "Jane Doe",
+		"email": "jane@example.com"
+	},
+	"commits": [
+		{
+			"id": "abababab",
+			"message": "Commit message 1",
+			"added": [],
+			"modified": [],
+			"removed": []
+		}
+	],
+	"head_commit": {
+		"id": "abababab",
+		"message": "Commit message 1",
+		"added": [],
+		"modified": [],
+		"removed": []
+	}
+}`, `{
+	"ref": "refs/heads/dev",
+	"before": "0000000000000000000000000000000000000000",
+	"after": "cdcdcdcd",
+	"repository": {
+		"name": "foo",
+		"full_name": "foo",
+		"url": ""
+	},
+	"pusher": {
+		"name": "John Doe",
+		"email": "john@example.com"
+	},
+	"commits": [
+		{
+			"id": "cdcdcdcd",
+			"message": "Commit message 2",
+			"added": [
+				"NEWS"
+			],
+			"modified": [
+				"README",
+				"src/main.go"
+			],
+			"removed": []
+		}
+	],
+	"head_commit": {
+		"id": "cdcdcdcd",
+		"message": "Commit message 2",
+		"added": [
+			"NEWS"
+		],
+		"modified": [
+			"README",
+			"src/main.go"
+		],
+		"removed": []
+	}
+}`}
+
+	if assert.Equal(2, len(blobs)) {
+		assert.Equal(expected[0], string(blobs[0]))
+		assert.Equal(expected[1], string(blobs[1]))
+	}
+
+	prePushBlobs, err := events.MarshalGitHubPayloads(events.PrePushPayload{PushPayload: payload})
+	assert.Nil(err)
+	assert.Equal(blobs, prePushBlobs)
+
+	// Without refs, they are taken from the targets of the commits.
+	payload.Refs = nil
+
+	blobs, err = events.MarshalGitHubPayloads(payload)
+	assert.Nil(err)
+
+	if assert.Equal(2, len(blobs)) {
+		assert.Contains(string(blobs[0]), `"ref": "refs/heads/master",
+	"before": "0000000000000000000000000000000000000000",
+	"after": "abababab",`)
+		assert.Contains(string(blobs[1]), `"ref": "refs/heads/dev",
+	"before": "0000000000000000000000000000000000000000",
+	"after": "cdcdcdcd",`)
+	}
+
+	assert.Equal("push", events.GitHubEventName(events.PushEvent))
+	assert.Equal("push", events.GitHubEventName(events.PrePushEvent))
+}
+
+func TestMarshalSlackPayload(t *testing.T) {
+	assert := assert.New(t)
+
+	payload := events.PushPayload{
+		Repository: "foo",
+		Commits: []events.PushPayloadCommit{
+			{
+				Id:      "abababababab",
+				Message: "Fix <script> & things\n\nDetails.",
+				Target: events.PushPayloadCommitTarget{
+					Branch: "master",
+				},
+			},
+			{
+				Id:      "cdcd",
+				Message: "Commit message 2",
+			},
+		},
+	}
+
+	bytes, err := events.MarshalSlackPayload(payload)
+	assert.Nil(err)
+
+	expected := `{
+	"text": "2 new commits pushed to foo",
+	"attachments": [
+		{
+			"fallback": "2 new commits pushed to foo",
+			"color": "#36a64f",
+			"text": "` + "`abababa` Fix \\u0026lt;script\\u0026gt; \\u0026amp; things (master)\\n`cdcd` Commit message 2" + `",
+			"mrkdwn_in": [
+				"text"
+			]
+		}
+	]
+}`
+
+	assert.Equal(expected, string(bytes))
+
+	_, err = events.MarshalSlackPayload(events.PrePushPayload{PushPayload: payload})
+	assert.NotNil(err)
+}
+
+func TestPushPayloadWithLinks(t *testing.T) {
+	assert := assert.New(t)
+
+	payload := events.PushPayload{
+		Repository: "team/foo",
+		Commits: []events.PushPayloadCommit{
+			{
+				Id:      "abababab",
+				Message: "Commit message 1",
+			},
+			{
+				Id:      "cdcdcdcd",
+				Message: "Commit message 2",
+			},
+		},
+	}
+
+	linked := payload.WithLinks("https://gateway.example.com/")
+	assert.Equal("https://gateway.example.com/repos/team/foo", linked.RepositoryUrl)
+	assert.Equal("https://gateway.example.com/repos/team/foo/commits/abababab", linked.Commits[0].CommitUrl)
+	assert.Equal("https://gateway.example.com/repos/team/foo/commits/cdcdcdcd", linked.Commits[1].CommitUrl)
+
+	// The original payload is not modified.
+	assert.Equal("", payload.RepositoryUrl)
+	assert.Equal("", payload.Commits[0].CommitUrl)
+
+	bytes, err := events.MarshalPayload(linked)
+	assert.Nil(err)
+	assert.Contains(string(bytes), `"repository_url": "https://gateway.example.com/repos/team/foo"`)
+	assert.Contains(string(bytes), `"commit_url": "https://gateway.example.com/repos/team/foo/commits/abababab"`)
+
+	blobs, err := events.MarshalGitHubPayloads(linked)
+	assert.Nil(err)
+	assert.Equal(1, len(blobs))
+	assert.Contains(string(blobs[0]), `"url": "https://gateway.example.com/repos/team/foo"`)
+	assert.Contains(string(blobs[0]), `"url": "https://gateway.example.com/repos/team/foo/commits/cdcdcdcd"`)
+
+	bytes, err = events.MarshalSlackPayload(linked)
+	assert.Nil(err)
+	assert.Contains(string(bytes), "\\u003chttps://gateway.example.com/repos/team/foo/commits/abababab|`abababa`\\u003e Commit message 1")
+
+	// Repository names are escaped, except for their slashes.
+	payload.Repository = "team/foo bar#1|x"
+	linked = payload.WithLinks("https://gateway.example.com")
+	assert.Equal("https://gateway.example.com/repos/team/foo%20bar%231%7Cx", linked.RepositoryUrl)
+	assert.Equal("https://gateway.example.com/repos/team/foo%20bar%231%7Cx/commits/abababab", linked.Commits[0].CommitUrl)
+
+	status := events.RepositoryStatusPayload{Repository: "team/foo bar"}.WithLinks("https://gateway.example.com")
+	assert.Equal("https://gateway.example.com/repos/team/foo%20bar", status.RepositoryUrl)
+}
+
+func TestUnmarshalPayload(t *testing.T) {
+	assert := assert.New(t)
+
+	payload := events.PushPayload{
+		Repository:    "foo",
+		RepositoryUrl: "https://gateway.example.com/repos/foo",
+		Commits: []events.PushPayloadCommit{
+			{
+				Id:      "abababab",
+				Message: "Commit message 1",
+				Added:   []string{"README"},
+				Target: events.PushPayloadCommitTarget{
+					Branch: "master",
+				},
+			},
+		},
+	}
+
+	bytes, err := events.MarshalPayload(payload)
+	assert.Nil(err)
+
+	unmarshalled, err := events.UnmarshalPayload(events.PushEvent, bytes)
+	assert.Nil(err)
+	assert.Equal(payload, unmarshalled)
+
+	bytes, err = events.MarshalPayload(events.PrePushPayload{PushPayload: payload})
+	assert.Nil(err)
+
+	unmarshalled, err = events.UnmarshalPayload(events.PrePushEvent, bytes)
+	assert.Nil(err)
+	assert.Equal(events.PrePushPayload{PushPayload: payload}, unmarshalled)
+
+	// The event must match.
+	_, err = events.UnmarshalPayload(events.PushEvent, bytes)
+	assert.NotNil(err)
+
+	statusPayload := events.RepositoryStatusPayload{
+		Repository: "foo",
+		Status: events.RepositoryStatus{
+			Available: false,
+			Reason:    "stat /srv/foo: no such file or directory",
+		},
+	}.WithLinks("https://gateway.example.com/")
+
+	bytes, err = events.MarshalPayload(statusPayload)
+	assert.Nil(err)
+	assert.Contains(string(bytes), `"event": "repository-status"`)
+	assert.Contains(string(bytes), `"repository_url": "https://gateway.example.com/repos/foo"`)
+
+	unmarshalled, err = events.UnmarshalPayload(events.RepositoryStatusEvent, bytes)
+	assert.Nil(err)
+	assert.Equal(statusPayload, unmarshalled)
+
+	_, err = events.UnmarshalPayload("invalid", []byte(`{}`))
+	assert.Equal(events.InvalidEventErr, err)
+
+	_, err = events.UnmarshalPayload(events.PushEvent, []byte(`not json`))
+	assert.NotNil(err)
+}
@@ -0,0 +1,198 @@
+package events
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+// The ID GitHub gives as the previous commit of a ref that was created.
+const gitHubNullId = "0000000000000000000000000000000000000000"
+
+// A push payload in the format of a GitHub push event.
+//
+// Only the fields that rb-gateway can fill in are included. See
+// https://docs.github.com/en/webhooks/webhook-events-and-payloads#push.
+type gitHubPushPayload struct {
+	// The full ref that was pushed to (e.g., `refs/heads/master`).
+	Ref string `json:"ref"`
+
+	// The ID of the most recent commit on the ref before the push.
+	Before string `json:"before"`
+
+	// The ID of the most recent commit on the ref after the push.
+	After string `json:"after"`
+
+	// The repository where the event occurred.
+	Repository gitHubRepository `json:"repository"`
+
+	// The user who pushed the commits.
+	Pusher gitHubPerson `json:"pusher"`
+
+	// The commits that were pushed.
+	Commits []gitHubCommit `json:"commits"`
+
+	// The most recent commit that was pushed, if any.
+	HeadCommit *gitHubCommit `json:"head_commit"`
+}
+
+// A repository in a GitHub payload.
+type gitHubRepository struct {
+	Name     string `json:"name"`
+	FullName string `json:"full_name"`
+	Url      string `json:"url"`
+}
+
+// A user in a GitHub payload.
+type gitHubPerson struct {
+	Name  string `json:"name"`
+	Email string `json:"email,omitempty"`
+}
+
+// A commit in a GitHub payload.
+type gitHubCommit struct {
+	Id       string   `json:"id"`
+	Message  string   `json:"message"`
+	Url      string   `json:"url,omitempty"`
+	Added    []string `json:"added"`
+	Modified []string `json:"modified"`
+	Removed  []string `json:"removed"`
+}
+
+// Return the name of the GitHub event that an event is sent as, for the
+// `X-GitHub-Event` header.
+//
+// GitHub has no pre-push event, so pre-push payloads are sent as push events.
+// Receivers can tell them apart by the `X-RBG-Event` header.
+func GitHubEventName(event string) string {
+	if event == PrePushEvent {
+		return PushEvent
+	}
+
+	return event
+}
+
+// Marshal a payload into JSON blobs shaped like GitHub push events.
+//
+// GitHub sends a push event per ref, so one blob is returned for each ref in
+// the payload, with the commits that were pushed to it. If the payload does
+// not record the refs that were updated, they are taken from the targets of
+// its commits, and the commit before the push is given as the null ID.
+//
+// rb-gateway does not know who pushed, so the pusher is the committer of the
+// most recent commit. Only push and pre-push payloads can be converted.
+func MarshalGitHubPayloads(p Payload) ([][]byte, error) {
+	var pushPayload PushPayload
+
+	switch payload := p.(type) {
+	case PushPayload:
+		pushPayload = payload
+
+	case PrePushPayload:
+		pushPayload = payload.PushPayload
+
+	default:
+		return nil, errors.New("Only push payloads can be sent in the GitHub format.")
+	}
+
+	refs := pushPayload.Refs
+	if len(refs) == 0 {
+		refs = commitRefs(pushPayload.Commits)
+	}
+
+	blobs := make([][]byte, 0, len(refs))
+
+	for _, ref := range refs {
+		gitHubPayload := gitHubPushPayload{
+			Ref:    ref.Ref,
+			Before: ref.Before,
+			After:  ref.After,
+			Repository: gitHubRepository{
+				Name:     pushPayload.Repository,
+				FullName: pushPayload.Repository,
+				Url:      pushPayload.RepositoryUrl,
+			},
+			Commits: []gitHubCommit{},
+		}
+
+		for _, commit := range pushPayload.Commits {
+			if commitRef(commit) != ref.Ref {
+				continue
+			}
+
+			gitHubPayload.Commits = append(gitHubPayload.Commits, gitHubCommit{
+				Id:       commit.Id,
+				Message:  commit.Message,
+				Url:      commit.CommitUrl,
+				Added:    nonNilStrings(commit.Added),
+				Modified: nonNilStrings(commit.Modified),
+				Removed:  nonNilStrings(commit.Removed),
+			})
+
+			gitHubPayload.Pusher = gitHubPerson{
+				Name:  commit.Committer,
+				Email: commit.CommitterEmail,
+			}
+		}
+
+		if len(gitHubPayload.Commits) != 0 {
+			gitHubPayload.HeadCommit = &gitHubPayload.Commits[len(gitHubPayload.Commits)-1]
+		}
+
+		blob, err := json.MarshalIndent(gitHubPayload, "", "\t")
+		if err != nil {
+			return nil, err
+		}
+
+		blobs = append(blobs, blob)
+	}
+
+	return blobs, nil
+}
+
+// Return the refs that commits were pushed to, in the order they were first
+// pushed to, from the targets of the commits.
+func commitRefs(commits []PushPayloadCommit) []PushPayloadRef {
+	refs := []PushPayloadRef{}
+	indexes := make(map[string]int)
+
+	for _, commit := range commits {
+		name := commitRef(commit)
+
+		i, ok := indexes[name]
+		if !ok {
+			i = len(refs)
+			indexes[name] = i
+			refs = append(refs, PushPayloadRef{Ref: name, Before: gitHubNullId})
+		}
+
+		refs[i].After = commit.Id
+	}
+
+	return refs
+}
+
+// Return the full ref that a commit was pushed to.
+//
+// Commits pushed to a branch belong to its ref. Other commits belong to the
+// ref of their first tag, if they have one.
+func commitRef(commit PushPayloadCommit) string {
+	if commit.Target.Branch != "" {
+		return "refs/heads/" + commit.Target.Branch
+	} else if len(commit.Target.Tags) != 0 {
+		return "refs/tags/" + commit.Target.Tags[0]
+	}
+
+	return ""
+}
+
+// Return the list, or an empty list if it is nil.
+//
+// GitHub payloads always include the file lists of commits, even if they are
+// empty.
+func nonNilStrings(values []string) []string {
+	if values == nil {
+		return []string{}
+	}
+
+	return values
+}
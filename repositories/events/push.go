@@ -1,12 +1,45 @@
 package events
 
+import (
+	"fmt"
+	"net/url"
+)
+
 // A payload for a push event.
 type PushPayload struct {
 	// The repository where the event occurred.
 	Repository string `json:"repository"`
 
+	// The URL of the repository in the gateway's API, if `externalUrl` is
+	// configured.
+	RepositoryUrl string `json:"repository_url,omitempty"`
+
 	// The commits that were pushed.
 	Commits []PushPayloadCommit `json:"commits"`
+
+	// The refs that were updated, if known.
+	Refs []PushPayloadRef `json:"refs,omitempty"`
+}
+
+// A ref that was updated by a push.
+type PushPayloadRef struct {
+	// The full name of the ref (e.g., `refs/heads/master`).
+	Ref string `json:"ref"`
+
+	// The commit ID the ref pointed to before the push, or the null ID if the
+	// ref was created.
+	Before string `json:"before"`
+
+	// The commit ID the ref points to after the push.
+	After string `json:"after"`
+}
+
+// A payload for a pre-push event.
+//
+// This has the same contents as a PushPayload, but the commits have not yet
+// been accepted into the repository.
+type PrePushPayload struct {
+	PushPayload
 }
 
 // A commit that is part of the push.
@@ -14,9 +47,44 @@ type PushPayloadCommit struct {
 	// The commit ID.
 	Id string `json:"id"`
 
+	// The URL of the commit in the gateway's API, if `externalUrl` is
+	// configured.
+	CommitUrl string `json:"commit_url,omitempty"`
+
 	// The commit message.
 	Message string `json:"message"`
 
+	// The name of the commit's author.
+	Author string `json:"author,omitempty"`
+
+	// The email address of the commit's author.
+	AuthorEmail string `json:"author_email,omitempty"`
+
+	// The date the commit was authored.
+	Date string `json:"date,omitempty"`
+
+	// The name of the commit's committer.
+	Committer string `json:"committer,omitempty"`
+
+	// The email address of the commit's committer.
+	CommitterEmail string `json:"committer_email,omitempty"`
+
+	// The date the commit was committed.
+	CommitterDate string `json:"committer_date,omitempty"`
+
+	// The paths of the files the commit added, if any.
+	Added []string `json:"added,omitempty"`
+
+	// The paths of the files the commit modified, if any.
+	Modified []string `json:"modified,omitempty"`
+
+	// The paths of the files the commit removed, if any.
+	Removed []string `json:"removed,omitempty"`
+
+	// The owners of the files the commit changed, if `suggestReviewers` is
+	// enabled and the repository has an owners file.
+	SuggestedReviewers []string `json:"suggested_reviewers,omitempty"`
+
 	// The targets the commit was pushed to.
 	Target PushPayloadCommitTarget `json:"target"`
 }
@@ -40,12 +108,40 @@ func (_ PushPayload) GetEvent() string {
 	return PushEvent
 }
 
+// Return a copy of the payload with links to the gateway's API.
+//
+// The links are relative to `baseUrl`, which is the URL the gateway is
+// reachable at, so that receivers can fetch more details about the repository
+// and each commit.
+func (p PushPayload) WithLinks(baseUrl string) PushPayload {
+	p.RepositoryUrl = repositoryUrl(baseUrl, p.Repository)
+
+	commits := make([]PushPayloadCommit, len(p.Commits))
+	for i, commit := range p.Commits {
+		commit.CommitUrl = fmt.Sprintf("%s/commits/%s", p.RepositoryUrl, url.PathEscape(commit.Id))
+		commits[i] = commit
+	}
+	p.Commits = commits
+
+	return p
+}
+
 // Return the repository where the event occurred.
 func (p PushPayload) GetRepository() string {
 	return p.Repository
 }
 
+// Return the URL of the repository in the gateway's API, if known.
+func (p PushPayload) GetRepositoryUrl() string {
+	return p.RepositoryUrl
+}
+
 // Return the contents of the payload.
 func (p PushPayload) GetContent() (string, interface{}) {
 	return "commits", p.Commits
 }
+
+// Return the event the payload corresponds to.
+func (_ PrePushPayload) GetEvent() string {
+	return PrePushEvent
+}
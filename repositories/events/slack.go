@@ -0,0 +1,87 @@
+package events
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	// The color of the bar beside Slack attachments for pushes.
+	slackPushColor = "#36a64f"
+
+	// The number of characters of commit IDs to show in Slack messages.
+	slackShortIdLength = 7
+)
+
+// A message for a Slack- or Mattermost-compatible incoming webhook.
+type slackMessage struct {
+	Text        string            `json:"text"`
+	Attachments []slackAttachment `json:"attachments"`
+}
+
+// An attachment to a Slack message.
+type slackAttachment struct {
+	Fallback string   `json:"fallback"`
+	Color    string   `json:"color"`
+	Text     string   `json:"text"`
+	MrkdwnIn []string `json:"mrkdwn_in"`
+}
+
+// Marshal a push payload into a Slack-compatible message.
+//
+// The message summarizes the push, with an attachment listing the first line
+// of each commit's message. Only push payloads can be converted.
+func MarshalSlackPayload(p Payload) ([]byte, error) {
+	pushPayload, ok := p.(PushPayload)
+	if !ok {
+		return nil, errors.New("Only push payloads can be sent to Slack.")
+	}
+
+	noun := "commits"
+	if len(pushPayload.Commits) == 1 {
+		noun = "commit"
+	}
+
+	summary := fmt.Sprintf("%d new %s pushed to %s", len(pushPayload.Commits), noun, pushPayload.Repository)
+
+	lines := make([]string, 0, len(pushPayload.Commits))
+	for _, commit := range pushPayload.Commits {
+		id := commit.Id
+		if len(id) > slackShortIdLength {
+			id = id[:slackShortIdLength]
+		}
+
+		line := fmt.Sprintf("`%s`", id)
+		if commit.CommitUrl != "" {
+			line = fmt.Sprintf("<%s|%s>", commit.CommitUrl, line)
+		}
+
+		line += " " + slackEscape(strings.SplitN(commit.Message, "\n", 2)[0])
+		if commit.Target.Branch != "" {
+			line += fmt.Sprintf(" (%s)", slackEscape(commit.Target.Branch))
+		}
+
+		lines = append(lines, line)
+	}
+
+	message := slackMessage{
+		Text: slackEscape(summary),
+		Attachments: []slackAttachment{
+			{
+				Fallback: summary,
+				Color:    slackPushColor,
+				Text:     strings.Join(lines, "\n"),
+				MrkdwnIn: []string{"text"},
+			},
+		},
+	}
+
+	return json.MarshalIndent(message, "", "\t")
+}
+
+// Escape the characters that Slack treats as control sequences.
+func slackEscape(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(s)
+}
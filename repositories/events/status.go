@@ -0,0 +1,49 @@
+package events
+
+// A payload for a repository status event.
+type RepositoryStatusPayload struct {
+	// The repository whose status changed.
+	Repository string `json:"repository"`
+
+	// The URL of the repository in the gateway's API, if `externalUrl` is
+	// configured.
+	RepositoryUrl string `json:"repository_url,omitempty"`
+
+	// The new status of the repository.
+	Status RepositoryStatus `json:"status"`
+}
+
+// The status of a repository.
+type RepositoryStatus struct {
+	// Whether or not the repository can be used.
+	Available bool `json:"available"`
+
+	// Why the repository cannot be used, if it is unavailable.
+	Reason string `json:"reason,omitempty"`
+}
+
+// Return the event the payload corresponds to.
+func (_ RepositoryStatusPayload) GetEvent() string {
+	return RepositoryStatusEvent
+}
+
+// Return a copy of the payload with a link to the gateway's API.
+func (p RepositoryStatusPayload) WithLinks(baseUrl string) RepositoryStatusPayload {
+	p.RepositoryUrl = repositoryUrl(baseUrl, p.Repository)
+	return p
+}
+
+// Return the repository whose status changed.
+func (p RepositoryStatusPayload) GetRepository() string {
+	return p.Repository
+}
+
+// Return the URL of the repository in the gateway's API, if known.
+func (p RepositoryStatusPayload) GetRepositoryUrl() string {
+	return p.RepositoryUrl
+}
+
+// Return the contents of the payload.
+func (p RepositoryStatusPayload) GetContent() (string, interface{}) {
+	return "status", p.Status
+}
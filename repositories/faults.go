@@ -0,0 +1,181 @@
+package repositories
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The environment variable that enables delivery fault injection.
+//
+// This is for testing only. See ParseFaultInjection() for its format.
+const FaultInjectionVar = "RBGATEWAY_INJECT_DELIVERY_FAULTS"
+
+// Artificial failures and latency for webhook deliveries.
+//
+// This lets operators check that their alerting, dead letter redriving, and
+// timeouts behave as expected (e.g., in a staging environment) without
+// breaking a real webhook endpoint. Injected failures are recorded, dead
+// lettered, and notified like any other failure. Faults are not injected into
+// deliveries of gating events (e.g., `pre-push`), since a failure would reject
+// the operation being gated.
+type FaultInjection struct {
+	// The fraction of deliveries that fail, from 0 to 1.
+	FailureRate float64
+
+	// The HTTP status code that failed deliveries report.
+	StatusCode int
+
+	// How long each delivery is delayed before it is sent.
+	//
+	// The delay counts towards the delivery's timeout, so a latency longer
+	// than the timeout causes the delivery to time out.
+	Latency time.Duration
+
+	// The IDs of the webhooks that faults are injected for. If empty, faults
+	// are injected for every webhook.
+	Hooks []string
+}
+
+// Parse a fault injection specification.
+//
+// The specification is a comma-separated list of `key=value` pairs:
+//
+//	rate     The fraction of deliveries that fail (default 1).
+//	status   The HTTP status code of failed deliveries (default 503).
+//	latency  How long to delay each delivery (e.g., `2s`; default 0).
+//	hook     The ID of a webhook to inject faults for. May be repeated.
+//
+// For example, `rate=0.25,latency=500ms,hook=staging-ci`.
+func ParseFaultInjection(spec string) (*FaultInjection, error) {
+	faults := &FaultInjection{
+		FailureRate: 1,
+		StatusCode:  http.StatusServiceUnavailable,
+	}
+
+	for _, field := range strings.Split(spec, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf(`Expected "key=value", not "%s".`, field)
+		}
+
+		key, value := parts[0], parts[1]
+		var err error
+
+		switch key {
+		case "rate":
+			faults.FailureRate, err = strconv.ParseFloat(value, 64)
+			if err == nil && (faults.FailureRate < 0 || faults.FailureRate > 1) {
+				err = fmt.Errorf("must be between 0 and 1")
+			}
+
+		case "status":
+			faults.StatusCode, err = strconv.Atoi(value)
+			if err == nil && (faults.StatusCode < 100 || faults.StatusCode > 599 ||
+				(faults.StatusCode >= 200 && faults.StatusCode <= 299)) {
+				err = fmt.Errorf("must be a non-2XX HTTP status code")
+			}
+
+		case "latency":
+			faults.Latency, err = time.ParseDuration(value)
+			if err == nil && faults.Latency < 0 {
+				err = fmt.Errorf("cannot be negative")
+			}
+
+		case "hook":
+			faults.Hooks = append(faults.Hooks, value)
+
+		default:
+			return nil, fmt.Errorf(`Unknown key "%s"; expected rate, status, latency, or hook.`, key)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf(`Invalid %s "%s": %s`, key, value, err.Error())
+		}
+	}
+
+	return faults, nil
+}
+
+// Return the fault injection enabled by the environment, if any.
+//
+// If FaultInjectionVar is not set, nil is returned.
+func FaultInjectionFromEnv() (*FaultInjection, error) {
+	spec, ok := os.LookupEnv(FaultInjectionVar)
+	if !ok {
+		return nil, nil
+	}
+
+	faults, err := ParseFaultInjection(spec)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse %s: %s", FaultInjectionVar, err.Error())
+	}
+
+	return faults, nil
+}
+
+// Return a description of the faults, for logging.
+func (f *FaultInjection) String() string {
+	description := fmt.Sprintf("%g%% of deliveries fail with status %d, latency %s",
+		f.FailureRate*100, f.StatusCode, f.Latency)
+
+	if len(f.Hooks) != 0 {
+		description += fmt.Sprintf(", hooks %s", strings.Join(f.Hooks, ", "))
+	}
+
+	return description
+}
+
+// Delay and possibly fail the delivery of a webhook.
+//
+// If the context is done before the latency has passed, its error is
+// returned. If the delivery is chosen to fail, an HTTPStatusErr is returned.
+func (f *FaultInjection) inject(ctx context.Context, hookId string) error {
+	if len(f.Hooks) != 0 && !containsString(f.Hooks, hookId) {
+		return nil
+	}
+
+	if f.Latency > 0 {
+		timer := time.NewTimer(f.Latency)
+		defer timer.Stop()
+
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	if f.FailureRate == 0 || rand.Float64() >= f.FailureRate {
+		return nil
+	}
+
+	log.Printf(`Injecting a delivery failure for hook "%s" (%s is set)`, hookId, FaultInjectionVar)
+
+	return &HTTPStatusErr{
+		StatusCode: f.StatusCode,
+		Status:     fmt.Sprintf("%d %s (injected)", f.StatusCode, http.StatusText(f.StatusCode)),
+	}
+}
+
+// Return whether or not a slice contains a string.
+func containsString(haystack []string, needle string) bool {
+	for _, s := range haystack {
+		if s == needle {
+			return true
+		}
+	}
+
+	return false
+}
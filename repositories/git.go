@@ -2,17 +2,23 @@ package repositories
 
 import (
 	"bytes"
+	"container/heap"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"time"
 
 	"gopkg.in/src-d/go-git.v4"
 	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
 	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+	"gopkg.in/src-d/go-git.v4/utils/merkletrie"
 
 	"github.com/reviewboard/rb-gateway/repositories/events"
 )
@@ -23,6 +29,15 @@ const (
 	patchIndexLength       = 40 // The patch index length.
 
 	refsHeadsPrefix = "refs/heads/"
+	refsNotesPrefix = "refs/notes/"
+	refsTagsPrefix  = "refs/tags/"
+
+	// The percentage of lines that a removed file must share with an added
+	// file for it to be considered renamed, as with Git's default.
+	gitRenameSimilarity = 50
+
+	// The largest file, in bytes, that is compared when finding renames.
+	maxRenameSize = 1024 * 1024
 )
 
 var (
@@ -33,6 +48,17 @@ var (
 // Repository.
 type GitRepository struct {
 	RepositoryInfo
+
+	// Whether the repository is bare, i.e., its path is the Git directory
+	// and it has no worktree.
+	Bare bool
+
+	// The directory to install hooks into instead of the Git directory's
+	// `hooks`, if any. See hookDir().
+	HooksDir string
+
+	// The index used to search the repository's commits, if any.
+	Index *CommitIndex
 }
 
 // GetName is a Repository implementation that returns the name of the
@@ -51,33 +77,93 @@ func (repo *GitRepository) GetScm() string {
 	return "git"
 }
 
+// GetFeatures is a Repository implementation that returns the optional
+// features supported by Git repositories.
+func (repo *GitRepository) GetFeatures() Features {
+	return Features{
+		Archive:    true,
+		LargeFiles: repo.LargeFiles,
+		Notes:      true,
+	}
+}
+
+// Open the underlying Git repository.
+//
+// Opened repositories are cached between calls.
+func (repo *GitRepository) open() (*git.Repository, error) {
+	return gitRepoCache.Open(repo.Path)
+}
+
 // GetFile is a Repository implementation that returns the contents of a file
 // in the GitRepository based on the file revision sha.
 //
 // On success, it returns the file contents in a byte array. On failure, the
 // error will be returned.
 func (repo *GitRepository) GetFile(id string) ([]byte, error) {
-	gitRepo, err := git.PlainOpen(repo.Path)
+	reader, _, err := repo.OpenFile(id)
 	if err != nil {
 		return nil, err
 	}
 
-	blob, err := gitRepo.BlobObject(plumbing.NewHash(id))
+	defer reader.Close()
+
+	buf := new(bytes.Buffer)
+	buf.ReadFrom(reader)
+
+	return buf.Bytes(), nil
+}
+
+// OpenFile is a Repository implementation that returns a reader for the
+// contents of a file in the GitRepository based on the file revision sha.
+//
+// The size is read from the blob's header, and the blob is not loaded until
+// the reader is first read from. On failure, the error will be returned.
+func (repo *GitRepository) OpenFile(id string) (io.ReadCloser, int64, error) {
+	gitRepo, err := repo.open()
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
-	reader, err := blob.Reader()
+	hash := plumbing.NewHash(id)
+
+	objectType, size, err := gitObjectHeader(gitRepo, hash)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
+	} else if objectType != plumbing.BlobObject {
+		return nil, 0, plumbing.ErrInvalidType
 	}
 
-	defer reader.Close()
+	return &gitBlobReader{gitRepo: gitRepo, hash: hash}, size, nil
+}
 
-	buf := new(bytes.Buffer)
-	buf.ReadFrom(reader)
+// A reader for a blob that loads the blob when it is first read from.
+type gitBlobReader struct {
+	gitRepo *git.Repository
+	hash    plumbing.Hash
+	reader  io.ReadCloser
+}
 
-	return buf.Bytes(), nil
+func (r *gitBlobReader) Read(p []byte) (int, error) {
+	if r.reader == nil {
+		blob, err := r.gitRepo.BlobObject(r.hash)
+		if err != nil {
+			return 0, err
+		}
+
+		if r.reader, err = blob.Reader(); err != nil {
+			return 0, err
+		}
+	}
+
+	return r.reader.Read(p)
+}
+
+func (r *gitBlobReader) Close() error {
+	if r.reader == nil {
+		return nil
+	}
+
+	return r.reader.Close()
 }
 
 // GetFileByCommit is a Repository implementation that returns the contents of
@@ -86,7 +172,7 @@ func (repo *GitRepository) GetFile(id string) ([]byte, error) {
 // On success, it returns the file contents in a byte array. On failure, the
 // error will be returned.
 func (repo *GitRepository) GetFileByCommit(commitId, filepath string) ([]byte, error) {
-	gitRepo, err := git.PlainOpen(repo.Path)
+	gitRepo, err := repo.open()
 	if err != nil {
 		return nil, err
 	}
@@ -124,13 +210,140 @@ func (repo *GitRepository) GetFileByCommit(commitId, filepath string) ([]byte, e
 	return buf.Bytes(), nil
 }
 
+// GetFileModeByCommit is a Repository implementation that returns the mode of
+// a file in the GitRepository based on a commit sha and the file path.
+//
+// On failure, the error will be returned.
+func (repo *GitRepository) GetFileModeByCommit(commitId, filepath string) (FileMode, error) {
+	gitRepo, err := repo.open()
+	if err != nil {
+		return 0, err
+	}
+
+	commit, err := gitRepo.CommitObject(plumbing.NewHash(commitId))
+	if err != nil {
+		return 0, err
+	}
+
+	tree, err := gitRepo.TreeObject(commit.TreeHash)
+	if err != nil {
+		return 0, err
+	}
+
+	entry, err := tree.FindEntry(filepath)
+	if err != nil {
+		return 0, err
+	}
+
+	// Group-writable files from old versions of Git are regular files.
+	if entry.Mode == filemode.Deprecated {
+		return RegularFileMode, nil
+	}
+
+	return FileMode(entry.Mode), nil
+}
+
+// GetFileSizeByCommit is a Repository implementation that returns the size of
+// a file in the GitRepository based on a commit sha and the file path, without
+// reading its contents.
+//
+// On failure, the error will be returned.
+func (repo *GitRepository) GetFileSizeByCommit(commitId, filepath string) (int64, error) {
+	gitRepo, err := repo.open()
+	if err != nil {
+		return 0, err
+	}
+
+	commit, err := gitRepo.CommitObject(plumbing.NewHash(commitId))
+	if err != nil {
+		return 0, err
+	}
+
+	tree, err := gitRepo.TreeObject(commit.TreeHash)
+	if err != nil {
+		return 0, err
+	}
+
+	entry, err := tree.FindEntry(filepath)
+	if err != nil {
+		return 0, err
+	}
+
+	return gitObjectSize(gitRepo, entry.Hash)
+}
+
+// ResolveRef is a Repository implementation that resolves a ref name (e.g., a
+// branch or tag name) or commit sha to a commit sha in the GitRepository.
+//
+// Annotated tags will be peeled to the commit they reference. On failure, the
+// error will be returned.
+func (repo *GitRepository) ResolveRef(ref string) (string, error) {
+	gitRepo, err := repo.open()
+	if err != nil {
+		return "", err
+	}
+
+	hash, err := resolveRef(gitRepo, ref)
+	if err != nil {
+		return "", err
+	}
+
+	return hash.String(), nil
+}
+
+// Resolve a ref name or commit sha to the commit it points to.
+//
+// Ref names are tried in the same order as `git rev-parse`, so that `master`
+// will match `refs/heads/master` and `v1.0` will match `refs/tags/v1.0`.
+func resolveRef(gitRepo *git.Repository, ref string) (*plumbing.Hash, error) {
+	for _, rule := range append([]string{"%s"}, plumbing.RefRevParseRules...) {
+		name := plumbing.ReferenceName(fmt.Sprintf(rule, ref))
+		resolved, err := storer.ResolveReference(gitRepo.Storer, name)
+
+		if err == nil {
+			return peelToCommit(gitRepo, resolved.Hash())
+		} else if err != plumbing.ErrReferenceNotFound {
+			return nil, err
+		}
+	}
+
+	if hash := plumbing.NewHash(ref); hash.String() == ref {
+		return peelToCommit(gitRepo, hash)
+	}
+
+	return nil, plumbing.ErrReferenceNotFound
+}
+
+// Return the hash of the commit that the given object refers to.
+//
+// If the object is an annotated tag, the tag will be followed to its commit.
+func peelToCommit(gitRepo *git.Repository, hash plumbing.Hash) (*plumbing.Hash, error) {
+	if tag, err := gitRepo.TagObject(hash); err == nil {
+		commit, err := tag.Commit()
+		if err != nil {
+			return nil, err
+		}
+
+		return &commit.Hash, nil
+	} else if err != plumbing.ErrObjectNotFound {
+		return nil, err
+	}
+
+	commit, err := gitRepo.CommitObject(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	return &commit.Hash, nil
+}
+
 // FileExists is a Repository implementation that returns whether a file exists
 // in the GitRepository based on the file revision sha.
 //
 // It returns true if the file exists, false otherwise. On failure, the error
 // will also be returned.
 func (repo *GitRepository) FileExists(id string) (bool, error) {
-	gitRepo, err := git.PlainOpen(repo.Path)
+	gitRepo, err := repo.open()
 	if err != nil {
 		return false, err
 	}
@@ -153,7 +366,7 @@ func (repo *GitRepository) FileExists(id string) (bool, error) {
 // It returns true if the file exists, false otherwise. On failure, the error
 // will also be returned.
 func (repo *GitRepository) FileExistsByCommit(commitId, filepath string) (bool, error) {
-	gitRepo, err := git.PlainOpen(repo.Path)
+	gitRepo, err := repo.open()
 	if err != nil {
 		return false, err
 	}
@@ -184,11 +397,12 @@ func (repo *GitRepository) FileExistsByCommit(commitId, filepath string) (bool,
 // GetBranches is a Repository implementation that returns all the branches in
 // the repository.
 //
-// On failure, the error will also be returned.
-func (repo *GitRepository) GetBranches() ([]Branch, error) {
+// Sorting by date only requires reading the commit each branch points to. On
+// failure, the error will also be returned.
+func (repo *GitRepository) GetBranches(order BranchSort) ([]Branch, error) {
 	var branches []Branch = make([]Branch, 0, branchesAllocationSize)
 
-	gitRepo, err := git.PlainOpen(repo.Path)
+	gitRepo, err := repo.open()
 	if err != nil {
 		return nil, err
 	}
@@ -212,19 +426,95 @@ func (repo *GitRepository) GetBranches() ([]Branch, error) {
 		return nil, err
 	}
 
+	var dates map[string]time.Time
+	if order == BranchSortDate {
+		dates = make(map[string]time.Time, len(branches))
+
+		for _, branch := range branches {
+			commit, err := gitRepo.CommitObject(plumbing.NewHash(branch.Id))
+			if err != nil {
+				return nil, err
+			}
+
+			dates[branch.Id] = commit.Committer.When
+		}
+	}
+
+	sortBranches(branches, order, dates)
+
 	return branches, nil
 }
 
+// GetRefs is a Repository implementation that returns all the branches, tags,
+// and notes refs in the repository.
+//
+// Other refs (e.g., remote-tracking branches and `HEAD`) are not included. On
+// failure, the error will also be returned.
+func (repo *GitRepository) GetRefs() ([]Ref, error) {
+	gitRepo, err := repo.open()
+	if err != nil {
+		return nil, err
+	}
+
+	iter, err := gitRepo.References()
+	if err != nil {
+		return nil, err
+	}
+
+	refs := []Ref{}
+	err = iter.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() != plumbing.HashReference {
+			return nil
+		}
+
+		name := ref.Name().String()
+		var refType string
+
+		switch {
+		case strings.HasPrefix(name, refsHeadsPrefix):
+			refType = RefTypeBranch
+			name = strings.TrimPrefix(name, refsHeadsPrefix)
+
+		case strings.HasPrefix(name, refsTagsPrefix):
+			refType = RefTypeTag
+			name = strings.TrimPrefix(name, refsTagsPrefix)
+
+		case strings.HasPrefix(name, refsNotesPrefix):
+			refType = RefTypeNote
+			name = strings.TrimPrefix(name, refsNotesPrefix)
+
+		default:
+			return nil
+		}
+
+		refs = append(refs, Ref{
+			Name: name,
+			Type: refType,
+			Id:   ref.Hash().String(),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return refs, nil
+}
+
 // GetCommits is a Repository implementation that returns all the commits in
 // the repository for the specified branch. It also takes an optional start
 // commit sha, which will return all commits starting from the start commit
 // sha instead.
 //
-// On failure, the error will also be returned.
-func (repo *GitRepository) GetCommits(branch string, start string) ([]CommitInfo, error) {
+// Topological ordering requires walking all of the history reachable from the
+// start commit, whereas ordering by date stops after a page of commits, or
+// once commits were committed before `filter.Since`. With a filter, at most
+// MaxFilteredCommits commits are searched. On failure, the error will also be
+// returned.
+func (repo *GitRepository) GetCommits(branch string, start string, order CommitOrder, filter CommitFilter) ([]CommitInfo, error) {
 	var commits []CommitInfo = make([]CommitInfo, 0, commitsPageSize)
 
-	gitRepo, err := git.PlainOpen(repo.Path)
+	gitRepo, err := repo.open()
 	if err != nil {
 		return nil, err
 	}
@@ -241,6 +531,28 @@ func (repo *GitRepository) GetCommits(branch string, start string) ([]CommitInfo
 		startCommit = ref.Hash()
 	}
 
+	matches := func(c *object.Commit) bool {
+		return filter.Matches(c.Author.Name, c.Author.Email, c.Author.When)
+	}
+
+	if order == CommitOrderTopological {
+		maxSearched := 0
+		if !filter.IsEmpty() {
+			maxSearched = MaxFilteredCommits
+		}
+
+		topoCommits, err := gitTopoOrder(gitRepo, startCommit, commitsPageSize, maxSearched, matches)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, commit := range topoCommits {
+			commits = append(commits, newGitCommitInfo(commit))
+		}
+
+		return commits, nil
+	}
+
 	iter, err := gitRepo.Log(&git.LogOptions{
 		From:  startCommit,
 		Order: git.LogOrderCommitterTime,
@@ -250,28 +562,151 @@ func (repo *GitRepository) GetCommits(branch string, start string) ([]CommitInfo
 	}
 
 	commit, err := iter.Next()
-	for err == nil {
+	for searched := 0; err == nil; searched++ {
 		if len(commits) == commitsPageSize {
 			// We only want to return at max one page of commits.
 			break
+		} else if !filter.Since.IsZero() && commit.Committer.When.Before(filter.Since) {
+			// Commits are authored before they are committed, so no older
+			// commit can match.
+			break
+		} else if !filter.IsEmpty() && searched == MaxFilteredCommits {
+			break
 		}
 
-		var parent string
-		if commit.NumParents() > 0 {
-			parent = commit.ParentHashes[0].String()
+		if matches(commit) {
+			commits = append(commits, newGitCommitInfo(commit))
 		}
 
-		commitInfo := CommitInfo{
-			Author:   commit.Author.Name,
-			Id:       commit.Hash.String(),
-			Date:     commit.Author.When.Format("2006-01-02T15:04:05-0700"),
-			Message:  commit.Message,
-			ParentId: parent,
+		commit, err = iter.Next()
+	}
+
+	return commits, nil
+}
+
+// Return up to `limit` commits reachable from `start` in topological order.
+//
+// Like `git log --topo-order`, no commit is returned before any of its
+// children, and the first parent of each commit is followed before its other
+// parents, so that lines of history are kept together. Only commits for which
+// `matches` returns true are returned. If `maxSearched` is positive, no more
+// than that many commits are passed to `matches`.
+//
+// Rather than counting the children of every commit up front, history is
+// explored in order of generation (see gitCommitGeneration()), only until it
+// reaches the generation of the next commit to return, since a commit's
+// children all have later generations.
+func gitTopoOrder(gitRepo *git.Repository, start plumbing.Hash, limit, maxSearched int, matches func(*object.Commit) bool) ([]*object.Commit, error) {
+	startCommit, err := gitRepo.CommitObject(start)
+	if err != nil {
+		return nil, err
+	}
+
+	startGeneration, err := gitCommitGeneration(gitRepo, startCommit)
+	if err != nil {
+		return nil, err
+	}
+
+	// The number of explored children of each commit that have not been
+	// returned yet.
+	pendingChildren := make(map[plumbing.Hash]int)
+	explored := make(map[plumbing.Hash]bool)
+	visited := make(map[plumbing.Hash]bool)
+
+	// The commits that have yet to be explored, latest generation first.
+	frontier := &gitGenerationHeap{{startCommit, startGeneration}}
+	queued := map[plumbing.Hash]bool{start: true}
+
+	explore := func(c *object.Commit) error {
+		if explored[c.Hash] {
+			return nil
 		}
 
-		commits = append(commits, commitInfo)
+		explored[c.Hash] = true
 
-		commit, err = iter.Next()
+		for _, parentHash := range c.ParentHashes {
+			pendingChildren[parentHash]++
+
+			if queued[parentHash] {
+				continue
+			}
+
+			parent, err := gitRepo.CommitObject(parentHash)
+			if err != nil {
+				return err
+			}
+
+			generation, err := gitCommitGeneration(gitRepo, parent)
+			if err != nil {
+				return err
+			}
+
+			heap.Push(frontier, gitGenerationEntry{parent, generation})
+			queued[parentHash] = true
+		}
+
+		return nil
+	}
+
+	commits := make([]*object.Commit, 0, limit)
+	stack := []*object.Commit{startCommit}
+
+	for searched := 0; len(stack) != 0 && len(commits) < limit; {
+		if maxSearched > 0 && searched == maxSearched {
+			break
+		}
+
+		commit := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		if visited[commit.Hash] {
+			continue
+		}
+
+		generation, err := gitCommitGeneration(gitRepo, commit)
+		if err != nil {
+			return nil, err
+		}
+
+		for frontier.Len() != 0 && (*frontier)[0].generation > generation {
+			if err = explore(heap.Pop(frontier).(gitGenerationEntry).commit); err != nil {
+				return nil, err
+			}
+		}
+
+		if pendingChildren[commit.Hash] != 0 {
+			// The commit is pushed again when its last child is visited.
+			continue
+		}
+
+		if err = explore(commit); err != nil {
+			return nil, err
+		}
+
+		visited[commit.Hash] = true
+		searched++
+
+		if matches(commit) {
+			commits = append(commits, commit)
+		}
+
+		// Parents are pushed in reverse so that the first parent is visited
+		// next.
+		for i := len(commit.ParentHashes) - 1; i >= 0; i-- {
+			parentHash := commit.ParentHashes[i]
+
+			pendingChildren[parentHash]--
+			if pendingChildren[parentHash] != 0 {
+				continue
+			}
+
+			parent, err := gitRepo.CommitObject(parentHash)
+			if err != nil {
+				return nil, err
+			}
+
+			stack = append(stack, parent)
+		}
 	}
 
 	return commits, nil
@@ -282,7 +717,7 @@ func (repo *GitRepository) GetCommits(branch string, start string) ([]CommitInfo
 //
 // On failure, the error will also be returned.
 func (repo *GitRepository) GetCommit(commitId string) (*Commit, error) {
-	gitRepo, err := git.PlainOpen(repo.Path)
+	gitRepo, err := repo.open()
 	if err != nil {
 		return nil, err
 	}
@@ -305,44 +740,993 @@ func (repo *GitRepository) GetCommit(commitId string) (*Commit, error) {
 		return nil, err
 	}
 
-	patch, err := parent.Patch(commit)
-	if err != nil {
-		return nil, err
+	var diff string
+
+	if gitCfg := currentGitConfig(); gitCfg.UseBinary {
+		// Color and external diff tools set in the user's or system's Git
+		// configuration would change the output.
+		output, err := gitCfg.run(repo.Path, "diff", "--no-color", "--no-ext-diff", "--full-index",
+			parent.Hash.String(), commit.Hash.String())
+		if err != nil {
+			return nil, err
+		}
+
+		diff = string(output)
+	} else {
+		patch, err := parent.Patch(commit)
+		if err != nil {
+			return nil, err
+		}
+
+		diff = patch.String()
 	}
 
 	change := Commit{
-		CommitInfo: CommitInfo{
-			Author:   commit.Author.Name,
-			Id:       commit.Hash.String(),
-			Date:     commit.Author.When.Format("2006-01-02T15:04:05-0700"),
-			Message:  commit.Message,
-			ParentId: commit.ParentHashes[0].String(),
-		},
-		Diff: patch.String(),
+		CommitInfo: newGitCommitInfo(commit),
+		Diff:       diff,
 	}
 
 	return &change, nil
 }
 
-func (repo *GitRepository) ParseEventPayload(event string, input io.Reader) (events.Payload, error) {
-	if !events.IsValidEvent(event) {
-		return nil, events.InvalidEventErr
+// GetCommitRange is a Repository implementation that returns the commits
+// reachable from `until` that are not reachable from `since`.
+//
+// Both `since` and `until` may be commit shas or ref names. The commits are
+// returned in reverse-chronological (DAG) order. On failure, the error will
+// also be returned.
+func (repo *GitRepository) GetCommitRange(since, until string) ([]CommitInfo, error) {
+	gitRepo, err := repo.open()
+	if err != nil {
+		return nil, err
 	}
 
-	gitRepo, err := git.PlainOpen(repo.Path)
+	sinceHash, err := resolveRef(gitRepo, since)
 	if err != nil {
 		return nil, err
 	}
 
-	switch event {
-	case events.PushEvent: // post-receive
-		return repo.parsePushEvent(gitRepo, event, input)
-
-	default:
+	untilHash, err := resolveRef(gitRepo, until)
+	if err != nil {
+		return nil, err
+	}
+
+	sinceCommit, err := object.GetCommit(gitRepo.Storer, *sinceHash)
+	if err != nil {
+		return nil, err
+	}
+
+	untilCommit, err := object.GetCommit(gitRepo.Storer, *untilHash)
+	if err != nil {
+		return nil, err
+	}
+
+	// All ancestors of `since` (including `since` itself) are excluded.
+	excluded := make(map[plumbing.Hash]bool)
+	err = object.NewCommitPreorderIter(sinceCommit, nil, nil).
+		ForEach(func(c *object.Commit) error {
+			excluded[c.Hash] = true
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	commits := []CommitInfo{}
+	err = object.NewCommitPreorderIter(untilCommit, excluded, nil).
+		ForEach(func(c *object.Commit) error {
+			commits = append(commits, newGitCommitInfo(c))
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	return commits, nil
+}
+
+// GetMergeBase is a Repository implementation that returns the best common
+// ancestor of two commits in the GitRepository.
+//
+// Both `a` and `b` may be commit shas or ref names. If they have no common
+// ancestor, an empty string is returned. On failure, the error will also be
+// returned.
+func (repo *GitRepository) GetMergeBase(a, b string) (string, error) {
+	gitRepo, err := repo.open()
+	if err != nil {
+		return "", err
+	}
+
+	aHash, err := resolveRef(gitRepo, a)
+	if err != nil {
+		return "", err
+	}
+
+	bHash, err := resolveRef(gitRepo, b)
+	if err != nil {
+		return "", err
+	}
+
+	base, err := repo.mergeBase(gitRepo, *aHash, *bHash)
+	if err != nil || base == nil {
+		return "", err
+	}
+
+	return base.String(), nil
+}
+
+// WriteArchive is a Repository implementation that writes an archive of the
+// tree at a commit.
+//
+// On failure, the error will also be returned.
+func (repo *GitRepository) WriteArchive(w io.Writer, commitId, format, prefix string) error {
+	gitRepo, err := repo.open()
+	if err != nil {
+		return err
+	}
+
+	hash, err := resolveRef(gitRepo, commitId)
+	if err != nil {
+		return err
+	}
+
+	commit, err := gitRepo.CommitObject(*hash)
+	if err != nil {
+		return err
+	}
+
+	return writeGitArchive(w, commit, format, prefix)
+}
+
+// GetFileSizes is a Repository implementation that returns the size of every
+// file in the tree at a commit, keyed by path.
+//
+// Submodules are not included. On failure, the error will be returned.
+func (repo *GitRepository) GetFileSizes(commitId string) (map[string]int64, error) {
+	gitRepo, err := repo.open()
+	if err != nil {
+		return nil, err
+	}
+
+	hash, err := resolveRef(gitRepo, commitId)
+	if err != nil {
+		return nil, err
+	}
+
+	commit, err := gitRepo.CommitObject(*hash)
+	if err != nil {
+		return nil, err
+	}
+
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, err
+	}
+
+	// The sizes are read from the objects' headers, so that the blobs in the
+	// tree do not have to be loaded.
+	walker := object.NewTreeWalker(tree, true, nil)
+	defer walker.Close()
+
+	sizes := make(map[string]int64)
+	for {
+		name, entry, err := walker.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		if entry.Mode == filemode.Dir || entry.Mode == filemode.Submodule {
+			continue
+		}
+
+		if sizes[name], err = gitObjectSize(gitRepo, entry.Hash); err != nil {
+			return nil, err
+		}
+	}
+
+	return sizes, nil
+}
+
+// CheckPatch is a Repository implementation that returns whether or not a
+// patch applies cleanly at a commit.
+//
+// The commit's tree is read into a temporary index, and the patch is checked
+// against it with `git apply --check --cached`, so no files are written.
+func (repo *GitRepository) CheckPatch(commitId string, diff []byte) (*PatchCheck, error) {
+	tempDir, err := ioutil.TempDir("", "rb-gateway-index-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tempDir)
+
+	env := []string{"GIT_INDEX_FILE=" + filepath.Join(tempDir, "index")}
+
+	if _, _, err = currentGitConfig().runWithInput(repo.Path, env, nil, "read-tree", commitId); err != nil {
+		return nil, err
+	}
+
+	return checkPatchWithGit(repo.Path, env, diff, true)
+}
+
+// GetChangedFiles is a Repository implementation that returns the paths of
+// the files changed by a commit, relative to its first parent.
+//
+// The paths are sorted. On failure, the error will be returned.
+func (repo *GitRepository) GetChangedFiles(commitId string) ([]string, error) {
+	gitRepo, err := repo.open()
+	if err != nil {
+		return nil, err
+	}
+
+	hash, err := resolveRef(gitRepo, commitId)
+	if err != nil {
+		return nil, err
+	}
+
+	commit, err := gitRepo.CommitObject(*hash)
+	if err != nil {
+		return nil, err
+	}
+
+	added, modified, removed, err := gitCommitFileChanges(commit)
+	if err != nil {
+		return nil, err
+	}
+
+	paths := make([]string, 0, len(added)+len(modified)+len(removed))
+	paths = append(paths, added...)
+	paths = append(paths, modified...)
+	paths = append(paths, removed...)
+	sort.Strings(paths)
+
+	return paths, nil
+}
+
+// GetFileLog is a Repository implementation that returns the commits on a
+// branch that changed a path.
+//
+// A commit is considered to have changed the path if the path differs between
+// the commit and each of its parents, which matches the default history
+// simplification of `git log -- <path>`. As with `git log --follow`, when a
+// commit added a file by renaming or copying another, the history of the
+// other file is followed from then on. The commits are returned in
+// reverse-chronological order. On failure, the error will also be returned.
+//
+// Renames are only detected against a commit's first parent. Commits are
+// visited in commit time order rather than by ancestry, so once a rename has
+// been followed, commits from other branches of a merge that are older than
+// the rename are also matched against the file's previous name, much as
+// `git log --follow` does.
+func (repo *GitRepository) GetFileLog(branch, path string) ([]FileLogEntry, error) {
+	gitRepo, err := repo.open()
+	if err != nil {
+		return nil, err
+	}
+
+	head, err := resolveRef(gitRepo, branch)
+	if err != nil {
+		return nil, err
+	}
+
+	iter, err := gitRepo.Log(&git.LogOptions{
+		From:  *head,
+		Order: git.LogOrderCommitterTime,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	path = strings.Trim(path, "/")
+	entries := make([]FileLogEntry, 0, commitsPageSize)
+
+	err = iter.ForEach(func(commit *object.Commit) error {
+		changed, err := commitChangedPath(commit, path)
+		if err != nil {
+			return err
+		}
+
+		if changed {
+			entry, err := newGitFileLogEntry(commit, path)
+			if err != nil {
+				return err
+			}
+
+			entries = append(entries, entry)
+
+			// Older commits changed the file under its previous name.
+			if entry.OldPath != "" {
+				path = entry.OldPath
+			}
+
+			if len(entries) == commitsPageSize {
+				// We only want to return at max one page of commits.
+				return storer.ErrStop
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// Return the file log entry for a commit that changed a path.
+//
+// If the commit added the path as a file, the commit's first parent is
+// searched for the file it was renamed or copied from.
+func newGitFileLogEntry(commit *object.Commit, path string) (FileLogEntry, error) {
+	entry := FileLogEntry{
+		CommitInfo: newGitCommitInfo(commit),
+		Path:       path,
+		Status:     PatchModified,
+	}
+
+	tree, err := commit.Tree()
+	if err != nil {
+		return entry, err
+	}
+
+	treeEntry, err := findTreeEntry(tree, path)
+	if err != nil {
+		return entry, err
+	} else if treeEntry == nil {
+		entry.Status = PatchDeleted
+		return entry, nil
+	}
+
+	var parentTree *object.Tree
+	if commit.NumParents() > 0 {
+		parent, err := commit.Parent(0)
+		if err != nil {
+			return entry, err
+		}
+
+		if parentTree, err = parent.Tree(); err != nil {
+			return entry, err
+		}
+
+		if parentEntry, err := findTreeEntry(parentTree, path); err != nil {
+			return entry, err
+		} else if parentEntry != nil {
+			return entry, nil
+		}
+	}
+
+	entry.Status = PatchAdded
+
+	if parentTree == nil || !treeEntry.Mode.IsFile() {
+		return entry, nil
+	}
+
+	source, renamed, err := gitCopySource(parentTree, tree, path, treeEntry.Hash)
+	if err != nil || source == "" {
+		return entry, err
+	}
+
+	entry.OldPath = source
+	if renamed {
+		entry.Status = PatchRenamed
+	} else {
+		entry.Status = PatchCopied
+	}
+
+	return entry, nil
+}
+
+// Return the file in `parentTree` that the file at `path` in `tree` was renamed
+// or copied from, if any.
+//
+// A file that was removed is considered renamed if it has the same content, or
+// if enough of its lines are the same (see gitRenameSimilarity). Otherwise, a
+// file with the same content that still exists is considered copied. An empty
+// source is returned if there is neither.
+func gitCopySource(parentTree, tree *object.Tree, path string, hash plumbing.Hash) (source string, renamed bool, err error) {
+	changes, err := object.DiffTree(parentTree, tree)
+	if err != nil {
+		return "", false, err
+	}
+
+	var removed []object.ChangeEntry
+	for _, change := range changes {
+		action, err := change.Action()
+		if err != nil {
+			return "", false, err
+		}
+
+		if action == merkletrie.Delete && change.From.TreeEntry.Mode.IsFile() {
+			if change.From.TreeEntry.Hash == hash {
+				return change.From.Name, true, nil
+			}
+
+			removed = append(removed, change.From)
+		}
+	}
+
+	if source, err = gitSimilarSource(parentTree, tree, path, hash, removed); err != nil || source != "" {
+		return source, source != "", err
+	}
+
+	// Only the entries of the parent's trees are compared, so that its blobs
+	// do not have to be loaded.
+	walker := object.NewTreeWalker(parentTree, true, nil)
+	defer walker.Close()
+
+	for {
+		name, entry, err := walker.Next()
+		if err == io.EOF {
+			return "", false, nil
+		} else if err != nil {
+			return "", false, err
+		}
+
+		if entry.Hash == hash && entry.Mode.IsFile() {
+			return name, false, nil
+		}
+	}
+}
+
+// Return the removed file in `parentTree` that is most similar to the file at
+// `path` in `tree`, if any is similar enough to be considered renamed.
+func gitSimilarSource(parentTree, tree *object.Tree, path string, hash plumbing.Hash, removed []object.ChangeEntry) (string, error) {
+	if len(removed) == 0 {
+		return "", nil
+	}
+
+	newFile, err := tree.TreeEntryFile(&object.TreeEntry{Name: path, Hash: hash})
+	if err != nil {
+		return "", err
+	}
+
+	newLines, err := gitFileLines(newFile)
+	if err != nil || newLines == nil {
+		return "", err
+	}
+
+	source := ""
+	bestSimilarity := gitRenameSimilarity
+	for _, candidate := range removed {
+		oldFile, err := parentTree.TreeEntryFile(&candidate.TreeEntry)
+		if err != nil {
+			return "", err
+		}
+
+		oldLines, err := gitFileLines(oldFile)
+		if err != nil {
+			return "", err
+		} else if oldLines == nil {
+			continue
+		}
+
+		if similarity := lineSimilarity(oldLines, newLines); similarity >= bestSimilarity {
+			source = candidate.Name
+			bestSimilarity = similarity
+		}
+	}
+
+	return source, nil
+}
+
+// Return the lines of a file, for finding renames.
+//
+// Files larger than maxRenameSize are not compared, and nil is returned for
+// them.
+func gitFileLines(file *object.File) ([]string, error) {
+	if file.Size > maxRenameSize {
+		return nil, nil
+	}
+
+	contents, err := file.Contents()
+	if err != nil {
+		return nil, err
+	}
+
+	return strings.SplitAfter(contents, "\n"), nil
+}
+
+// Return the percentage of lines that two versions of a file have in common.
+//
+// Lines are compared regardless of their order, and the percentage is of the
+// longer version.
+func lineSimilarity(a, b []string) int {
+	counts := make(map[string]int, len(a))
+	for _, line := range a {
+		counts[line]++
+	}
+
+	common := 0
+	for _, line := range b {
+		if counts[line] > 0 {
+			counts[line]--
+			common++
+		}
+	}
+
+	total := len(a)
+	if len(b) > total {
+		total = len(b)
+	}
+
+	return common * 100 / total
+}
+
+// Return whether or not a commit changed the given path relative to all of its
+// parents.
+func commitChangedPath(commit *object.Commit, path string) (bool, error) {
+	hash, err := pathHash(commit, path)
+	if err != nil {
+		return false, err
+	}
+
+	if commit.NumParents() == 0 {
+		return hash != plumbing.ZeroHash, nil
+	}
+
+	changed := true
+	err = commit.Parents().ForEach(func(parent *object.Commit) error {
+		parentHash, err := pathHash(parent, path)
+		if err != nil {
+			return err
+		}
+
+		if parentHash == hash {
+			changed = false
+			return storer.ErrStop
+		}
+
+		return nil
+	})
+
+	return changed, err
+}
+
+// Return the object ID of the given path in a commit.
+//
+// If the path does not exist, the zero hash is returned.
+func pathHash(commit *object.Commit, path string) (plumbing.Hash, error) {
+	tree, err := commit.Tree()
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	entry, err := findTreeEntry(tree, path)
+	if err != nil || entry == nil {
+		return plumbing.ZeroHash, err
+	}
+
+	return entry.Hash, nil
+}
+
+// Return the entry for the given path in a tree.
+//
+// If the path does not exist, nil is returned.
+func findTreeEntry(tree *object.Tree, path string) (*object.TreeEntry, error) {
+	entry, err := tree.FindEntry(path)
+	if isMissingFileErr(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return entry, nil
+}
+
+// Return whether or not an error from looking up a file means that the file
+// does not exist.
+func isMissingFileErr(err error) bool {
+	// go-git does not export the error for a missing entry, so we have to
+	// compare the message.
+	return err == object.ErrDirectoryNotFound || err == plumbing.ErrObjectNotFound ||
+		(err != nil && err.Error() == "entry not found") || isNotExist(err)
+}
+
+// SearchCommits is a Repository implementation that returns the commits whose
+// messages (and optionally authors or changed paths) contain the query.
+//
+// If `branch` is empty, every branch is searched. If the repository has a
+// commit index, indexed commits are searched in memory, and only the commits
+// that have not been indexed yet are read from the repository. Otherwise, the
+// history is read newest first and the search stops once a page of commits
+// has been found. The commits are returned in reverse-chronological order. On
+// failure, the error will also be returned.
+func (repo *GitRepository) SearchCommits(query, branch string, authors, paths bool) ([]CommitInfo, error) {
+	gitRepo, err := repo.open()
+	if err != nil {
+		return nil, err
+	}
+
+	var heads []plumbing.Hash
+	if branch != "" {
+		hash, err := resolveRef(gitRepo, branch)
+		if err != nil {
+			return nil, err
+		}
+
+		heads = append(heads, *hash)
+	} else if heads, err = gitBranchHeads(gitRepo); err != nil {
+		return nil, err
+	}
+
+	index := repo.Index
+	if index != nil {
+		if err = index.refresh(); err != nil {
+			return nil, err
+		}
+
+		index.lock.RLock()
+		defer index.lock.RUnlock()
+	}
+
+	query = strings.ToLower(query)
+	matches := func(c *object.Commit) (bool, error) {
+		if strings.Contains(strings.ToLower(c.Message), query) ||
+			(authors && strings.Contains(strings.ToLower(c.Author.Name), query)) {
+			return true, nil
+		} else if !paths {
+			return false, nil
+		}
+
+		added, modified, removed, err := gitCommitFileChanges(c)
+		if err != nil {
+			return false, err
+		}
+
+		for _, changed := range [][]string{added, modified, removed} {
+			for _, path := range changed {
+				if strings.Contains(strings.ToLower(path), query) {
+					return true, nil
+				}
+			}
+		}
+
+		return false, nil
+	}
+
+	var found []commitSearchResult
+	visit := func(c *object.Commit) error {
+		matched, err := matches(c)
+		if matched {
+			found = append(found, commitSearchResult{newGitCommitInfo(c), c.Committer.When.Unix()})
+		}
+
+		return err
+	}
+
+	var indexed []plumbing.Hash
+	if index != nil {
+		indexed, err = walkUnindexedCommits(gitRepo, index, heads, visit)
+	} else {
+		err = walkCommitsNewestFirst(gitRepo, heads, func(c *object.Commit) error {
+			if err := visit(c); err != nil {
+				return err
+			} else if len(found) >= commitsPageSize {
+				return storer.ErrStop
+			}
+
+			return nil
+		})
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if index != nil {
+		found = append(found, index.search(indexed, query, authors, paths)...)
+	}
+
+	sort.SliceStable(found, func(i, j int) bool {
+		return found[i].time > found[j].time
+	})
+
+	if len(found) > commitsPageSize {
+		found = found[:commitsPageSize]
+	}
+
+	commits := make([]CommitInfo, 0, len(found))
+	for _, result := range found {
+		commits = append(commits, result.info)
+	}
+
+	return commits, nil
+}
+
+// Call a function for each commit reachable from the given heads, most
+// recently committed first.
+//
+// The walk stops without an error if the function returns storer.ErrStop.
+// Commits are only read from the repository as the walk reaches them, so
+// stopping early avoids reading the rest of the history.
+func walkCommitsNewestFirst(gitRepo *git.Repository, heads []plumbing.Hash, fn func(commit *object.Commit) error) error {
+	seen := make(map[plumbing.Hash]bool)
+	pending := &gitCommitTimeHeap{}
+
+	push := func(hash plumbing.Hash) error {
+		if seen[hash] {
+			return nil
+		}
+		seen[hash] = true
+
+		commit, err := object.GetCommit(gitRepo.Storer, hash)
+		if err != nil {
+			return err
+		}
+
+		heap.Push(pending, commit)
+		return nil
+	}
+
+	for _, head := range heads {
+		if err := push(head); err != nil {
+			return err
+		}
+	}
+
+	for pending.Len() > 0 {
+		commit := heap.Pop(pending).(*object.Commit)
+
+		if err := fn(commit); err == storer.ErrStop {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		for _, parent := range commit.ParentHashes {
+			if err := push(parent); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// GetNotes is a Repository implementation that returns the notes attached to
+// the given commit from all `refs/notes/*` refs.
+//
+// On failure, the error will also be returned.
+func (repo *GitRepository) GetNotes(commitId string) ([]Note, error) {
+	gitRepo, err := repo.open()
+	if err != nil {
+		return nil, err
+	}
+
+	hash, err := resolveRef(gitRepo, commitId)
+	if err != nil {
+		return nil, err
+	}
+
+	iter, err := gitRepo.Notes()
+	if err != nil {
+		return nil, err
+	}
+
+	notes := []Note{}
+	err = iter.ForEach(func(ref *plumbing.Reference) error {
+		notesCommit, err := gitRepo.CommitObject(ref.Hash())
+		if err != nil {
+			return err
+		}
+
+		tree, err := notesCommit.Tree()
+		if err != nil {
+			return err
+		}
+
+		blob, err := findNoteBlob(gitRepo, tree, hash.String())
+		if err != nil {
+			return err
+		} else if blob == nil {
+			return nil
+		}
+
+		reader, err := blob.Reader()
+		if err != nil {
+			return err
+		}
+		defer reader.Close()
+
+		content, err := ioutil.ReadAll(reader)
+		if err != nil {
+			return err
+		}
+
+		notes = append(notes, Note{
+			Ref:     strings.TrimPrefix(ref.Name().String(), refsNotesPrefix),
+			Message: string(content),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return notes, nil
+}
+
+// Find the blob for the note for the given commit in a notes tree.
+//
+// Git may store notes in fanout subdirectories (e.g., `ab/cdef...`), so each
+// level of the tree is checked for either the remainder of the commit sha or
+// its next two characters. If no note exists, `nil` is returned.
+func findNoteBlob(gitRepo *git.Repository, tree *object.Tree, sha string) (*object.Blob, error) {
+	for len(sha) > 2 {
+		var next *object.TreeEntry
+
+		for i := range tree.Entries {
+			entry := &tree.Entries[i]
+
+			if entry.Name == sha {
+				return gitRepo.BlobObject(entry.Hash)
+			} else if entry.Name == sha[:2] && entry.Mode == filemode.Dir {
+				next = entry
+			}
+		}
+
+		if next == nil {
+			return nil, nil
+		}
+
+		subtree, err := gitRepo.TreeObject(next.Hash)
+		if err != nil {
+			return nil, err
+		}
+
+		tree = subtree
+		sha = sha[2:]
+	}
+
+	return nil, nil
+}
+
+// Return the metadata for a commit.
+func newGitCommitInfo(commit *object.Commit) CommitInfo {
+	var parent string
+	if commit.NumParents() > 0 {
+		parent = commit.ParentHashes[0].String()
+	}
+
+	return CommitInfo{
+		Author:         commit.Author.Name,
+		AuthorEmail:    commit.Author.Email,
+		Committer:      commit.Committer.Name,
+		CommitterEmail: commit.Committer.Email,
+		CommitterDate:  commit.Committer.When.Format(commitDateFormat),
+		Id:             commit.Hash.String(),
+		Date:           commit.Author.When.Format(commitDateFormat),
+		Message:        commit.Message,
+		ParentId:       parent,
+	}
+}
+
+// ParseHookEvent is a Repository implementation that parses the payload for
+// an event from the input of a hook.
+//
+// Git passes everything that is needed on the hook's input, so `getenv` is
+// not used.
+func (repo *GitRepository) ParseHookEvent(event string, input io.Reader, getenv func(string) string) (events.Payload, error) {
+	return repo.ParseEventPayload(event, input)
+}
+
+func (repo *GitRepository) ParseEventPayload(event string, input io.Reader) (events.Payload, error) {
+	if !events.IsValidEvent(event) {
+		return nil, events.InvalidEventErr
+	}
+
+	gitRepo, err := repo.open()
+	if err != nil {
+		return nil, err
+	}
+
+	switch event {
+	case events.PushEvent: // post-receive
+		return repo.parsePushEvent(gitRepo, event, input)
+
+	default:
 		return nil, fmt.Errorf(`Event "%s" unsupported by Git.`, event)
 	}
 }
 
+// ParseCommitRange is a Repository implementation that creates a payload for
+// the commits in a range of the GitRepository.
+//
+// The range contains the commits reachable from `end` but not from `start`,
+// as with `git log start..end`. If `end` is a branch name, the commits target
+// that branch. Otherwise, they target the first branch whose head is `end`, if
+// any.
+func (repo *GitRepository) ParseCommitRange(event, start, end string, limit int) (events.Payload, error) {
+	if event != events.PushEvent {
+		return nil, fmt.Errorf(`Event "%s" cannot be created from a commit range.`, event)
+	}
+
+	gitRepo, err := repo.open()
+	if err != nil {
+		return nil, err
+	}
+
+	startHash, err := resolveRef(gitRepo, start)
+	if err != nil {
+		return nil, fmt.Errorf(`Unknown revision "%s": %s`, start, err.Error())
+	}
+
+	endHash, err := resolveRef(gitRepo, end)
+	if err != nil {
+		return nil, fmt.Errorf(`Unknown revision "%s": %s`, end, err.Error())
+	}
+
+	refName := plumbing.ReferenceName(refsHeadsPrefix + end)
+	if _, err := gitRepo.Reference(refName, false); err != nil {
+		refName = refsHeadsPrefix
+
+		iter, err := gitRepo.Branches()
+		if err != nil {
+			return nil, err
+		}
+
+		err = iter.ForEach(func(r *plumbing.Reference) error {
+			if r.Hash() == *endHash {
+				refName = r.Name()
+				return storer.ErrStop
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	commits, err := repo.pushedCommits(gitRepo, refName.String(), *startHash, *endHash,
+		make(map[plumbing.Hash]bool), limit)
+	if err != nil {
+		return nil, err
+	}
+
+	return events.PushPayload{
+		Repository: repo.Name,
+		Commits:    commits,
+	}, nil
+}
+
+// ParseBranchChanges is a Repository implementation that creates a payload for
+// the commits added to branches of the GitRepository between two snapshots of
+// their heads.
+//
+// The changes are parsed as if they had been given to the post-receive hook.
+// Deleted branches are ignored.
+func (repo *GitRepository) ParseBranchChanges(oldHeads, newHeads map[string]string) (events.Payload, error) {
+	names := make([]string, 0, len(newHeads))
+	for name, id := range newHeads {
+		if oldHeads[name] != id {
+			names = append(names, name)
+		}
+	}
+
+	if len(names) == 0 {
+		return events.PushPayload{
+			Repository: repo.Name,
+			Commits:    []events.PushPayloadCommit{},
+		}, nil
+	}
+
+	sort.Strings(names)
+
+	var input strings.Builder
+	for _, name := range names {
+		oldId, ok := oldHeads[name]
+		if !ok {
+			oldId = nullRevision.String()
+		}
+
+		fmt.Fprintf(&input, "%s %s %s%s\n", oldId, newHeads[name], refsHeadsPrefix, name)
+	}
+
+	return repo.ParseEventPayload(events.PushEvent, strings.NewReader(input.String()))
+}
+
 // Parse a post-receive hook and turn it into a PushPayload
 func (repo *GitRepository) parsePushEvent(
 	gitRepo *git.Repository,
@@ -388,71 +1772,173 @@ func (repo *GitRepository) parsePushEvent(
 			// This is some ref type we don't care about.
 			continue
 		}
-		branchName := strings.TrimPrefix(refName, refsHeadsPrefix)
 
-		ignore := []plumbing.Hash{}
+		commits, err := repo.pushedCommits(gitRepo, refName, oldRevision, newRevision, seen, 0)
+		if err != nil {
+			return nil, err
+		}
 
-		if oldRevision == nullRevision {
-			// A new branch was created. We only want refs belonging to this
-			// branch, so we are going to ignore all refs belonging to other
-			// branches.
-			iter, err := gitRepo.Branches()
-			if err != nil {
-				return nil, err
-			}
+		payload.Commits = append(payload.Commits, commits...)
+		payload.Refs = append(payload.Refs, events.PushPayloadRef{
+			Ref:    refName,
+			Before: oldRevision.String(),
+			After:  newRevision.String(),
+		})
+	}
 
-			err = iter.ForEach(func(r *plumbing.Reference) error {
-				if r.Name().String() != refName {
-					ignore = append(ignore, r.Hash())
-				}
-				return nil
-			})
-			if err != nil {
-				return nil, err
-			}
-		} else {
-			base, err := mergeBase(gitRepo, newRevision, oldRevision)
+	return payload, nil
+}
 
-			if err != nil {
-				return nil, err
-			} else if base != nil {
-				ignore = append(ignore, *base)
+// Return the commits pushed to a branch, oldest first.
+//
+// The commits are those reachable from `newRevision` but not from
+// `oldRevision`. If `oldRevision` is the null revision, the branch is new, and
+// the commits are those not reachable from any other branch. Commits in `seen`
+// are skipped, and the returned commits are added to it. If `limit` is
+// positive and there are more commits than that, a *TooManyCommitsErr is
+// returned.
+func (repo *GitRepository) pushedCommits(
+	gitRepo *git.Repository,
+	refName string,
+	oldRevision plumbing.Hash,
+	newRevision plumbing.Hash,
+	seen map[plumbing.Hash]bool,
+	limit int,
+) ([]events.PushPayloadCommit, error) {
+	branchName := strings.TrimPrefix(refName, refsHeadsPrefix)
+	pushed := []events.PushPayloadCommit{}
+	ignore := []plumbing.Hash{}
+
+	if oldRevision == nullRevision {
+		// A new branch was created. We only want refs belonging to this
+		// branch, so we are going to ignore all refs belonging to other
+		// branches.
+		iter, err := gitRepo.Branches()
+		if err != nil {
+			return nil, err
+		}
+
+		err = iter.ForEach(func(r *plumbing.Reference) error {
+			if r.Name().String() != refName {
+				ignore = append(ignore, r.Hash())
 			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
 		}
+	} else {
+		base, err := repo.mergeBase(gitRepo, newRevision, oldRevision)
 
-		startCommit, err := object.GetCommit(gitRepo.Storer, newRevision)
 		if err != nil {
 			return nil, err
+		} else if base != nil {
+			ignore = append(ignore, *base)
 		}
+	}
+
+	startCommit, err := object.GetCommit(gitRepo.Storer, newRevision)
+	if err != nil {
+		return nil, err
+	}
+
+	commits := []*object.Commit{}
+	err = object.NewCommitPreorderIter(startCommit, seen, ignore).
+		ForEach(func(c *object.Commit) error {
+			if limit > 0 && len(commits) == limit {
+				return &TooManyCommitsErr{limit}
+			}
+
+			seen[c.Hash] = true
+			commits = append(commits, c)
+			return nil
+		})
+
+	if err != nil {
+		return nil, err
+	}
 
-		commits := []*object.Commit{}
-		err = object.NewCommitPreorderIter(startCommit, seen, ignore).
-			ForEach(func(c *object.Commit) error {
-				seen[c.Hash] = true
-				commits = append(commits, c)
-				return nil
-			})
+	// The commits will be yielded in DAG order, i.e.,
+	// reverse-chronological order. We want to go through them in
+	// chronological order, so we traverse this slice in reverse.
+	for i := len(commits) - 1; i >= 0; i-- {
+		commit := commits[i]
 
+		added, modified, removed, err := gitCommitFileChanges(commit)
 		if err != nil {
 			return nil, err
 		}
 
-		// The commits will be yielded in DAG order, i.e.,
-		// reverse-chronological order. We want to go through them in
-		// chronological order, so we traverse this slice in reverse.
-		for i := len(commits) - 1; i >= 0; i-- {
-			commit := commits[i]
-			payload.Commits = append(payload.Commits, events.PushPayloadCommit{
-				Id:      commit.Hash.String(),
-				Message: commit.Message,
-				Target: events.PushPayloadCommitTarget{
-					Branch: branchName,
-				},
-			})
+		pushed = append(pushed, events.PushPayloadCommit{
+			Id:             commit.Hash.String(),
+			Message:        commit.Message,
+			Author:         commit.Author.Name,
+			AuthorEmail:    commit.Author.Email,
+			Date:           commit.Author.When.Format(commitDateFormat),
+			Committer:      commit.Committer.Name,
+			CommitterEmail: commit.Committer.Email,
+			CommitterDate:  commit.Committer.When.Format(commitDateFormat),
+			Added:          added,
+			Modified:       modified,
+			Removed:        removed,
+			Target: events.PushPayloadCommitTarget{
+				Branch: branchName,
+			},
+		})
+	}
+
+	return pushed, nil
+}
+
+// Return the paths of the files a commit added, modified, and removed.
+//
+// Changes are relative to the commit's first parent. Each list is sorted.
+func gitCommitFileChanges(commit *object.Commit) (added, modified, removed []string, err error) {
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	var parentTree *object.Tree
+	if commit.NumParents() > 0 {
+		parent, err := commit.Parent(0)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		if parentTree, err = parent.Tree(); err != nil {
+			return nil, nil, nil, err
 		}
 	}
 
-	return payload, nil
+	changes, err := object.DiffTree(parentTree, tree)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	for _, change := range changes {
+		action, err := change.Action()
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		switch action {
+		case merkletrie.Insert:
+			added = append(added, change.To.Name)
+
+		case merkletrie.Modify:
+			modified = append(modified, change.To.Name)
+
+		case merkletrie.Delete:
+			removed = append(removed, change.From.Name)
+		}
+	}
+
+	sort.Strings(added)
+	sort.Strings(modified)
+	sort.Strings(removed)
+
+	return added, modified, removed, nil
 }
 
 func setDefault(m map[plumbing.Hash]struct{}, h plumbing.Hash) map[plumbing.Hash]struct{} {
@@ -463,6 +1949,30 @@ func setDefault(m map[plumbing.Hash]struct{}, h plumbing.Hash) map[plumbing.Hash
 	return m
 }
 
+// Return a merge base between the two commits.
+//
+// If the Git executable is enabled, it will be used to compute the merge
+// base. Otherwise, see mergeBase().
+func (repo *GitRepository) mergeBase(gitRepo *git.Repository, a, b plumbing.Hash) (*plumbing.Hash, error) {
+	gitCfg := currentGitConfig()
+	if !gitCfg.UseBinary {
+		return mergeBase(gitRepo, a, b)
+	}
+
+	output, err := gitCfg.run(repo.Path, "merge-base", a.String(), b.String())
+	if err != nil {
+		// git merge-base exits with status 1 when there is no merge base.
+		if gitErr, ok := err.(*GitError); ok && gitErr.ExitCode == 1 && gitErr.Output == "" {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	base := plumbing.NewHash(strings.TrimSpace(string(output)))
+	return &base, nil
+}
+
 // Return a merge base between the two commits.
 //
 // This algorithm is biased to return the closest ancestor of `a` that is
@@ -546,12 +2056,30 @@ outer:
 	return &best, nil
 }
 
+// Return an error if there is no bare Git repository at the given path.
+func CheckBareGitRepository(path string) error {
+	rawRepo, err := git.PlainOpen(path)
+	if err != nil {
+		return fmt.Errorf("Could not open Git repository at %s: %s", path, err.Error())
+	}
+
+	if _, err = rawRepo.Worktree(); err != git.ErrIsBareRepository {
+		return fmt.Errorf("The Git repository at %s is not bare", path)
+	}
+
+	return nil
+}
+
 // Return the equivalent of `git rev-parse --git-common-dir`
 func (repo *GitRepository) commonDir() (dir string, err error) {
+	if repo.Bare {
+		return repo.Path, nil
+	}
+
 	dotGitPath := filepath.Join(repo.Path, git.GitDirName)
 
 	var rawRepo *git.Repository
-	if rawRepo, err = git.PlainOpen(repo.Path); err != nil {
+	if rawRepo, err = repo.open(); err != nil {
 		return
 	}
 
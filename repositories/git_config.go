@@ -0,0 +1,174 @@
+package repositories
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// The default Git executable.
+	defaultGitBin = "git"
+
+	// The default timeout for Git commands, in seconds.
+	defaultGitTimeout = 60
+)
+
+var (
+	gitConfigLock sync.RWMutex
+	gitConfig     = GitConfig{Path: defaultGitBin, Timeout: defaultGitTimeout}
+)
+
+// Settings for running the system Git executable.
+//
+// go-git is used for all operations by default. Some operations (e.g.,
+// generating diffs or computing merge bases in very large repositories) are
+// much faster with the Git executable, which can be enabled with UseBinary.
+type GitConfig struct {
+	// The path to the git executable.
+	//
+	// If this is not an absolute path, it will be looked up in $PATH.
+	Path string `json:"path"`
+
+	// Whether or not to use the git executable where it is faster than go-git.
+	UseBinary bool `json:"useBinary"`
+
+	// The maximum number of seconds a git command may run.
+	Timeout int `json:"timeout"`
+}
+
+// An error from a Git command.
+type GitError struct {
+	// The command that failed.
+	Command string
+
+	// The exit code of the command, or -1 if it did not exit (e.g., it timed
+	// out).
+	ExitCode int
+
+	// The error output of the command.
+	Output string
+
+	// The original error.
+	err error
+}
+
+// Return the error message.
+func (e *GitError) Error() string {
+	if e.Output != "" {
+		return fmt.Sprintf("%s: %s: %s", e.Command, e.err.Error(), e.Output)
+	}
+
+	return fmt.Sprintf("%s: %s", e.Command, e.err.Error())
+}
+
+// Set the configuration used to run Git.
+func SetGitConfig(cfg GitConfig) {
+	if cfg.Path == "" {
+		cfg.Path = defaultGitBin
+	}
+
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultGitTimeout
+	}
+
+	gitConfigLock.Lock()
+	defer gitConfigLock.Unlock()
+
+	gitConfig = cfg
+}
+
+// Return the current configuration used to run Git.
+func currentGitConfig() GitConfig {
+	gitConfigLock.RLock()
+	defer gitConfigLock.RUnlock()
+
+	return gitConfig
+}
+
+// Validate that Git can be run with the configuration.
+//
+// This only checks the executable if UseBinary is set.
+func (cfg GitConfig) Validate() error {
+	if !cfg.UseBinary {
+		return nil
+	}
+
+	path := cfg.Path
+	if path == "" {
+		path = defaultGitBin
+	}
+
+	if _, err := exec.LookPath(path); err != nil {
+		return fmt.Errorf(`Could not find Git executable "%s": %s`, path, err.Error())
+	}
+
+	cfg.Path = path
+	if _, err := cfg.run("", "--version"); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Run a git command in the given directory and return its output.
+//
+// The command is killed if it runs longer than the configured timeout.
+func (cfg GitConfig) run(dir string, args ...string) ([]byte, error) {
+	stdout, _, err := cfg.runWithInput(dir, nil, nil, args...)
+	return stdout, err
+}
+
+// Run a git command in the given directory with additional environment
+// variables and the given input, and return its output and error output.
+//
+// The command is killed if it runs longer than the configured timeout.
+func (cfg GitConfig) runWithInput(dir string, env []string, input []byte, args ...string) ([]byte, []byte, error) {
+	timeout := time.Duration(cfg.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = defaultGitTimeout * time.Second
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+
+	cmd := exec.CommandContext(ctx, cfg.Path, args...)
+	cmd.Dir = dir
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if env != nil {
+		cmd.Env = append(os.Environ(), env...)
+	}
+
+	if input != nil {
+		cmd.Stdin = bytes.NewReader(input)
+	}
+
+	if err := cmd.Run(); err != nil {
+		gitErr := &GitError{
+			Command:  strings.Join(append([]string{"git"}, args...), " "),
+			ExitCode: -1,
+			Output:   strings.TrimSpace(stderr.String()),
+			err:      err,
+		}
+
+		if ctx.Err() == context.DeadlineExceeded {
+			gitErr.err = errors.New("timed out")
+		} else if exitErr, ok := err.(*exec.ExitError); ok {
+			gitErr.ExitCode = exitErr.ExitCode()
+		}
+
+		return nil, stderr.Bytes(), gitErr
+	}
+
+	return stdout.Bytes(), stderr.Bytes(), nil
+}
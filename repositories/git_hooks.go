@@ -3,11 +3,14 @@ package repositories
 import (
 	"fmt"
 	"log"
+	"net/url"
 	"os"
 	"path/filepath"
 	"text/template"
 
 	"github.com/kballard/go-shellquote"
+	"gopkg.in/src-d/go-git.v4"
+	git_config "gopkg.in/src-d/go-git.v4/config"
 
 	"github.com/reviewboard/rb-gateway/repositories/events"
 )
@@ -38,7 +41,8 @@ exit $EXIT
 `)
 
 	gitHookScriptTemplate = (`#!/bin/bash
-exec {{ .ExePath }} --config {{ .ConfigPath }} trigger-webhooks {{ .Repository }} {{ .Event }}
+{{ if .GitDir }}[ "$(cd "$(git rev-parse --git-common-dir)" && pwd -P)" = {{ .GitDir }} ] || exit 0
+{{ end }}exec {{ .Command }}
 `)
 )
 
@@ -49,23 +53,26 @@ var (
 )
 
 type gitHookData struct {
-	ConfigPath string
+	Command    string
 	Event      string
-	ExePath    string
+	GitDir     string
 	HookDir    string
 	HookName   string
-	Repository string
+	ScriptName string
 }
 
 // Install all hooks for the given repository.
+//
+// Hooks are installed into the directory returned by hookDir(). If that
+// directory may be shared with other repositories, the scripts are named
+// after the repository and only run for pushes to it.
 func (repo *GitRepository) InstallHooks(cfgPath string, force bool) (err error) {
-	var commonDir string
-	if commonDir, err = repo.commonDir(); err != nil {
+	var hookDir string
+	var shared bool
+	if hookDir, shared, err = repo.hookDir(); err != nil {
 		return
 	}
 
-	hookDir := filepath.Join(commonDir, "hooks")
-
 	if _, err = ensureDir(hookDir); err != nil {
 		return
 	}
@@ -75,16 +82,30 @@ func (repo *GitRepository) InstallHooks(cfgPath string, force bool) (err error)
 		return
 	}
 
+	var tokenPath string
+	if tokenPath, err = HookTokenPath(repo); err != nil {
+		return
+	}
+
+	hookCfg := currentHookConfig()
 	hookData := gitHookData{
-		ConfigPath: shellquote.Join(cfgPath),
-		ExePath:    shellquote.Join(exePath),
-		HookDir:    shellquote.Join(hookDir),
-		Repository: shellquote.Join(repo.Name),
+		HookDir: shellquote.Join(hookDir),
+	}
+
+	if shared {
+		var gitDir string
+		if gitDir, err = repo.resolvedCommonDir(); err != nil {
+			return
+		}
+
+		hookData.GitDir = shellquote.Join(gitDir)
 	}
 
 	for event, hookName := range gitEvents {
+		hookData.Command = shellquote.Join(hookCommand(hookCfg, exePath, cfgPath, tokenPath, repo.Name, event, true)...)
 		hookData.Event = shellquote.Join(event)
 		hookData.HookName = shellquote.Join(hookName)
+		hookData.ScriptName = gitHookScriptName(repo.Name, event, shared)
 
 		err = repo.installHook(hookDir, &hookData, force)
 		if err != nil {
@@ -107,7 +128,7 @@ func (repo *GitRepository) InstallHooks(cfgPath string, force bool) (err error)
 func (repo *GitRepository) installHook(hookDir string, hookData *gitHookData, force bool) (err error) {
 	dispatchPath := filepath.Join(hookDir, hookData.HookName)
 	scriptDir := filepath.Join(hookDir, fmt.Sprintf("%s.d", hookData.HookName))
-	scriptPath := filepath.Join(scriptDir, fmt.Sprintf("99-rbgateway-%s-event.sh", hookData.Event))
+	scriptPath := filepath.Join(scriptDir, hookData.ScriptName)
 
 	var created bool
 
@@ -180,3 +201,78 @@ func (repo *GitRepository) installHook(hookDir string, hookData *gitHookData, fo
 
 	return
 }
+
+// Return the directory that the repository's hooks are installed into.
+//
+// This is the repository's `hooksDir`, if set, or else `hooks.path`, or else
+// the `core.hooksPath` in the repository's Git configuration, which Git runs
+// hooks from instead of the Git directory's `hooks`. Git also reads
+// `core.hooksPath` from the global and system configuration, which rb-gateway
+// does not, so `hooks.path` must be set to match it.
+//
+// `shared` is true if the directory is not the repository's own `hooks`
+// directory, in which case it may also hold hooks for other repositories
+// (e.g., with Gitolite).
+func (repo *GitRepository) hookDir() (hookDir string, shared bool, err error) {
+	var commonDir string
+	if commonDir, err = repo.commonDir(); err != nil {
+		return
+	}
+
+	defaultDir := filepath.Join(commonDir, "hooks")
+
+	if repo.HooksDir != "" {
+		hookDir = repo.HooksDir
+	} else if hookCfg := currentHookConfig(); hookCfg.Path != "" {
+		hookDir = hookCfg.Path
+	} else {
+		var rawRepo *git.Repository
+		if rawRepo, err = repo.open(); err != nil {
+			return
+		}
+
+		var gitCfg *git_config.Config
+		if gitCfg, err = rawRepo.Config(); err != nil {
+			return
+		}
+
+		// Relative paths are relative to where Git runs hooks, which is the
+		// root of the worktree (or the Git directory, if the repository is
+		// bare).
+		if hookDir = gitCfg.Raw.Section("core").Option("hooksPath"); hookDir == "" {
+			return defaultDir, false, nil
+		} else if !filepath.IsAbs(hookDir) {
+			hookDir = filepath.Join(repo.Path, hookDir)
+		}
+	}
+
+	hookDir = filepath.Clean(hookDir)
+	return hookDir, hookDir != filepath.Clean(defaultDir), nil
+}
+
+// Return the absolute path of the repository's Git directory with symlinks
+// resolved, as hooks see it from `git rev-parse --git-common-dir`.
+func (repo *GitRepository) resolvedCommonDir() (string, error) {
+	commonDir, err := repo.commonDir()
+	if err != nil {
+		return "", err
+	}
+
+	if commonDir, err = filepath.Abs(commonDir); err != nil {
+		return "", err
+	}
+
+	return filepath.EvalSymlinks(commonDir)
+}
+
+// Return the name of the script that delivers an event.
+//
+// Scripts in shared hook directories are named after their repository, so that
+// each repository's hooks can be installed side by side.
+func gitHookScriptName(repoName, event string, shared bool) string {
+	if shared {
+		return fmt.Sprintf("99-rbgateway-%s-%s-event.sh", url.PathEscape(repoName), event)
+	}
+
+	return fmt.Sprintf("99-rbgateway-%s-event.sh", event)
+}
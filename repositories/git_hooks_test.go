@@ -4,12 +4,15 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 
 	"github.com/reviewboard/rb-gateway/helpers"
+	"github.com/reviewboard/rb-gateway/repositories"
+	"github.com/reviewboard/rb-gateway/repositories/events"
 )
 
 func TestInstallGitHooks(t *testing.T) {
@@ -74,6 +77,35 @@ exit $EXIT
 		"expected:\n=========\n%s\n\t\t======\n\nactual:\n=======\n%s\n\t\t======", expected, content)
 }
 
+func TestGetInstalledGitHooks(t *testing.T) {
+	assert := assert.New(t)
+
+	repo, _ := helpers.CreateGitRepo(t, "git-repo")
+	defer helpers.CleanupRepository(t, repo.Path)
+
+	installed, err := repositories.GetInstalledHooks(repo)
+	assert.Nil(err)
+	assert.Equal([]repositories.InstalledHook{
+		{Hook: "post-receive", Event: events.PushEvent},
+	}, installed)
+
+	assert.Nil(repo.InstallHooks("/tmp/config.json", false))
+
+	exePath, err := filepath.Abs(os.Args[0])
+	assert.Nil(err)
+
+	installed, err = repositories.GetInstalledHooks(repo)
+	assert.Nil(err)
+	assert.Equal([]repositories.InstalledHook{
+		{
+			Hook:      "post-receive",
+			Event:     events.PushEvent,
+			Installed: true,
+			Command:   fmt.Sprintf("%s --config /tmp/config.json trigger-webhooks git-repo push", exePath),
+		},
+	}, installed)
+}
+
 func TestInstallGitHooksQuoted(t *testing.T) {
 	assert := assert.New(t)
 
@@ -106,6 +138,62 @@ func TestInstallGitHooksQuoted(t *testing.T) {
 		string(content))
 }
 
+func TestInstallGitHooksApiMode(t *testing.T) {
+	assert := assert.New(t)
+
+	repo, _ := helpers.CreateGitRepo(t, "git-repo")
+	defer helpers.CleanupRepository(t, repo.Path)
+
+	repositories.SetHookConfig(repositories.HookConfig{
+		Mode: repositories.HookModeApi,
+		Url:  "http://localhost:8888",
+	})
+	defer repositories.SetHookConfig(repositories.HookConfig{})
+
+	err := repo.InstallHooks("/tmp/config.json", false)
+	if err != nil {
+		assert.Nilf(err, "%s", err.Error())
+	}
+
+	tokenPath, err := repositories.HookTokenPath(repo)
+	assert.Nil(err)
+	assert.Equal(filepath.Join(repo.Path, ".git", "rbgateway-hook-token"), tokenPath)
+
+	exePath, err := filepath.Abs(os.Args[0])
+	assert.Nil(err)
+
+	content, err := ioutil.ReadFile(filepath.Join(repo.Path, ".git", "hooks", "post-receive.d", "99-rbgateway-push-event.sh"))
+	assert.Nil(err)
+
+	assert.Equal(fmt.Sprintf(
+		"#!/bin/bash\n"+
+			"exec %s post-hook-event --url http://localhost:8888 --token-file %s --stdin git-repo push\n",
+		exePath, tokenPath),
+		string(content))
+
+	// The hooks are given the TLS settings for posting events.
+	repositories.SetHookConfig(repositories.HookConfig{
+		CAPath:            "/etc/rb-gateway/ca.pem",
+		ClientCertificate: "/etc/rb-gateway/hook.pem",
+		ClientKey:         "/etc/rb-gateway/hook.key",
+		Mode:              repositories.HookModeApi,
+		Url:               "https://localhost:8888",
+	})
+
+	assert.Nil(repo.InstallHooks("/tmp/config.json", true))
+
+	content, err = ioutil.ReadFile(filepath.Join(repo.Path, ".git", "hooks", "post-receive.d", "99-rbgateway-push-event.sh"))
+	assert.Nil(err)
+
+	assert.Equal(fmt.Sprintf(
+		"#!/bin/bash\n"+
+			"exec %s post-hook-event --url https://localhost:8888 --token-file %s "+
+			"--ca-file /etc/rb-gateway/ca.pem --cert /etc/rb-gateway/hook.pem --key /etc/rb-gateway/hook.key "+
+			"--stdin git-repo push\n",
+		exePath, tokenPath),
+		string(content))
+}
+
 func TestInstallGitHooksPreexisting(t *testing.T) {
 	assert := assert.New(t)
 
@@ -213,3 +301,112 @@ exit $EXIT
 
 	assert.Equal(expectedScript, string(script))
 }
+
+func TestInstallGitHooksBare(t *testing.T) {
+	assert := assert.New(t)
+
+	repo, _ := helpers.CreateBareGitRepo(t, "repo")
+	defer helpers.CleanupRepository(t, repo.Path)
+
+	err := repo.InstallHooks("/tmp/config.json", false)
+	if err != nil {
+		assert.Nilf(err, "%s", err.Error())
+	}
+
+	assert.FileExists(filepath.Join(repo.Path, "hooks", "post-receive"))
+	assert.FileExists(filepath.Join(repo.Path, "hooks", "post-receive.d", "99-rbgateway-push-event.sh"))
+
+	_, err = os.Stat(filepath.Join(repo.Path, ".git"))
+	assert.True(os.IsNotExist(err))
+}
+
+func TestInstallGitHooksSharedDir(t *testing.T) {
+	assert := assert.New(t)
+
+	hookDir, err := ioutil.TempDir("", "rb-gateway-hooks-")
+	assert.Nil(err)
+	defer os.RemoveAll(hookDir)
+
+	repo, _ := helpers.CreateGitRepo(t, "repo")
+	defer helpers.CleanupRepository(t, repo.Path)
+
+	other, _ := helpers.CreateGitRepo(t, "group/other")
+	defer helpers.CleanupRepository(t, other.Path)
+
+	repo.HooksDir = hookDir
+	other.HooksDir = hookDir
+
+	assert.Nil(repo.InstallHooks("/tmp/config.json", false))
+	assert.Nil(other.InstallHooks("/tmp/config.json", false))
+
+	// Nothing is installed into the repositories' own hooks directories.
+	_, err = os.Stat(filepath.Join(repo.Path, ".git", "hooks", "post-receive"))
+	assert.True(os.IsNotExist(err))
+
+	assert.FileExists(filepath.Join(hookDir, "post-receive"))
+
+	exePath, err := filepath.Abs(os.Args[0])
+	assert.Nil(err)
+
+	gitDir, err := filepath.EvalSymlinks(filepath.Join(repo.Path, ".git"))
+	assert.Nil(err)
+
+	scriptPath := filepath.Join(hookDir, "post-receive.d", "99-rbgateway-repo-push-event.sh")
+	content, err := ioutil.ReadFile(scriptPath)
+	assert.Nil(err)
+
+	assert.Equal(fmt.Sprintf(
+		"#!/bin/bash\n"+
+			"[ \"$(cd \"$(git rev-parse --git-common-dir)\" && pwd -P)\" = %s ] || exit 0\n"+
+			"exec %s --config /tmp/config.json trigger-webhooks repo push\n",
+		gitDir, exePath),
+		string(content))
+
+	assert.FileExists(filepath.Join(hookDir, "post-receive.d", "99-rbgateway-group%2Fother-push-event.sh"))
+
+	installed, err := repositories.GetInstalledHooks(other)
+	assert.Nil(err)
+	assert.Equal([]repositories.InstalledHook{
+		{
+			Hook:      "post-receive",
+			Event:     events.PushEvent,
+			Installed: true,
+			Command:   fmt.Sprintf("%s --config /tmp/config.json trigger-webhooks group/other push", exePath),
+		},
+	}, installed)
+
+	// The script does nothing when run for another repository.
+	cmd := exec.Command("bash", scriptPath)
+	cmd.Dir = other.Path
+	output, err := cmd.CombinedOutput()
+	assert.Nil(err)
+	assert.Empty(string(output))
+}
+
+func TestInstallGitHooksCoreHooksPath(t *testing.T) {
+	assert := assert.New(t)
+
+	repo, rawRepo := helpers.CreateGitRepo(t, "repo")
+	defer helpers.CleanupRepository(t, repo.Path)
+
+	cfg, err := rawRepo.Config()
+	assert.Nil(err)
+	cfg.Raw.Section("core").SetOption("hooksPath", ".githooks")
+	assert.Nil(rawRepo.Storer.SetConfig(cfg))
+
+	assert.Nil(repo.InstallHooks("/tmp/config.json", false))
+
+	assert.FileExists(filepath.Join(repo.Path, ".githooks", "post-receive"))
+	assert.FileExists(filepath.Join(repo.Path, ".githooks", "post-receive.d", "99-rbgateway-repo-push-event.sh"))
+
+	// hooks.path takes precedence over core.hooksPath.
+	hookDir, err := ioutil.TempDir("", "rb-gateway-hooks-")
+	assert.Nil(err)
+	defer os.RemoveAll(hookDir)
+
+	repositories.SetHookConfig(repositories.HookConfig{Path: hookDir})
+	defer repositories.SetHookConfig(repositories.HookConfig{})
+
+	assert.Nil(repo.InstallHooks("/tmp/config.json", false))
+	assert.FileExists(filepath.Join(hookDir, "post-receive.d", "99-rbgateway-repo-push-event.sh"))
+}
@@ -0,0 +1,373 @@
+package repositories
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/format/idxfile"
+	"gopkg.in/src-d/go-git.v4/plumbing/format/objfile"
+	"gopkg.in/src-d/go-git.v4/plumbing/format/packfile"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/storage/filesystem"
+)
+
+// The maximum number of pack indexes kept in memory for looking up object
+// sizes.
+const maxCachedPackIndexes = 64
+
+var (
+	packIndexesLock sync.Mutex
+
+	// Pack indexes, by the checksum of their packs.
+	//
+	// A pack's checksum identifies its contents, so indexes can be shared
+	// between repositories and never go stale.
+	packIndexes = make(map[plumbing.Hash]*idxfile.Idxfile)
+)
+
+// The maximum length of a chain of deltas followed to find an object's type.
+const maxDeltaChainLength = 10000
+
+// Returned by the writer in gitObjectHeader() once it has the delta header.
+var errDeltaHeaderRead = errors.New("delta header read")
+
+// Return the size of an object in a repository without loading its contents.
+func gitObjectSize(gitRepo *git.Repository, hash plumbing.Hash) (int64, error) {
+	_, size, err := gitObjectHeader(gitRepo, hash)
+	return size, err
+}
+
+// Return the type and size of an object in a repository without loading its
+// contents.
+//
+// go-git decodes an entire object to report its size, so the size is read
+// from the object's header instead: either the header of the loose object,
+// or its entry in a pack (and, for deltas, the header of the delta and the
+// type of its base). Objects in other kinds of storage, or in alternate
+// object directories, are loaded.
+func gitObjectHeader(gitRepo *git.Repository, hash plumbing.Hash) (plumbing.ObjectType, int64, error) {
+	storage, ok := gitRepo.Storer.(*filesystem.Storage)
+	if !ok {
+		return gitLoadedObjectHeader(gitRepo, hash)
+	}
+
+	fs := storage.Filesystem()
+	objectPath := fs.Join("objects", hash.String()[:2], hash.String()[2:])
+
+	if file, err := fs.Open(objectPath); err == nil {
+		defer file.Close()
+
+		reader, err := objfile.NewReader(file)
+		if err != nil {
+			return plumbing.InvalidObject, 0, err
+		}
+		defer reader.Close()
+
+		return reader.Header()
+	}
+
+	packs, err := storage.ObjectPacks()
+	if err != nil {
+		return plumbing.InvalidObject, 0, err
+	}
+
+	for _, pack := range packs {
+		idx, err := gitPackIndex(storage, pack)
+		if err != nil {
+			return plumbing.InvalidObject, 0, err
+		}
+
+		entries := idx.Entries
+		i := sort.Search(len(entries), func(i int) bool {
+			return bytes.Compare(entries[i].Hash[:], hash[:]) >= 0
+		})
+
+		if i < len(entries) && entries[i].Hash == hash {
+			return gitPackedObjectHeader(gitRepo, storage, pack, int64(entries[i].Offset))
+		}
+	}
+
+	return gitLoadedObjectHeader(gitRepo, hash)
+}
+
+// Return the type and size of an object by loading it.
+func gitLoadedObjectHeader(gitRepo *git.Repository, hash plumbing.Hash) (plumbing.ObjectType, int64, error) {
+	obj, err := gitRepo.Storer.EncodedObject(plumbing.AnyObject, hash)
+	if err != nil {
+		return plumbing.InvalidObject, 0, err
+	}
+
+	return obj.Type(), obj.Size(), nil
+}
+
+// Return the type and size of the object at an offset in a pack.
+func gitPackedObjectHeader(gitRepo *git.Repository, storage *filesystem.Storage, pack plumbing.Hash, offset int64) (plumbing.ObjectType, int64, error) {
+	fs := storage.Filesystem()
+
+	file, err := fs.Open(fs.Join("objects", "pack", fmt.Sprintf("pack-%s.pack", pack)))
+	if err != nil {
+		return plumbing.InvalidObject, 0, err
+	}
+	defer file.Close()
+
+	scanner := packfile.NewScanner(file)
+	if _, err = scanner.SeekFromStart(offset); err != nil {
+		return plumbing.InvalidObject, 0, err
+	}
+
+	header, err := scanner.NextObjectHeader()
+	if err != nil {
+		return plumbing.InvalidObject, 0, err
+	} else if header.Type != plumbing.OFSDeltaObject && header.Type != plumbing.REFDeltaObject {
+		return header.Type, header.Length, nil
+	}
+
+	// A delta starts with the sizes of its base and of the object it
+	// produces, so only that much of it needs to be inflated.
+	var delta deltaHeaderWriter
+	if _, _, err = scanner.NextObject(&delta); err != nil && err != errDeltaHeaderRead {
+		return plumbing.InvalidObject, 0, err
+	}
+
+	sizes := delta.sizes()
+	if len(sizes) < 2 {
+		return plumbing.InvalidObject, 0, fmt.Errorf("Invalid delta for object at offset %d of pack %s.", offset, pack)
+	}
+
+	// A delta has the type of the object at the end of its chain of bases.
+	for i := 0; i < maxDeltaChainLength; i++ {
+		if header.Type == plumbing.REFDeltaObject {
+			objectType, _, err := gitObjectHeader(gitRepo, header.Reference)
+			return objectType, sizes[1], err
+		} else if header.Type != plumbing.OFSDeltaObject {
+			return header.Type, sizes[1], nil
+		}
+
+		// The scanner would try to skip past the body of the last
+		// header it read, so each base is read with a new one.
+		scanner = packfile.NewScanner(file)
+		if _, err = scanner.SeekFromStart(header.OffsetReference); err != nil {
+			return plumbing.InvalidObject, 0, err
+		} else if header, err = scanner.NextObjectHeader(); err != nil {
+			return plumbing.InvalidObject, 0, err
+		}
+	}
+
+	return plumbing.InvalidObject, 0, fmt.Errorf("Delta chain for object at offset %d of pack %s is too long.", offset, pack)
+}
+
+// Return the index of a pack, loading it if it is not cached.
+func gitPackIndex(storage *filesystem.Storage, pack plumbing.Hash) (*idxfile.Idxfile, error) {
+	packIndexesLock.Lock()
+	idx, ok := packIndexes[pack]
+	packIndexesLock.Unlock()
+
+	if ok {
+		return idx, nil
+	}
+
+	fs := storage.Filesystem()
+
+	file, err := fs.Open(fs.Join("objects", "pack", fmt.Sprintf("pack-%s.idx", pack)))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	idx = idxfile.NewIdxfile()
+	if err = idxfile.NewDecoder(file).Decode(idx); err != nil {
+		return nil, err
+	}
+
+	packIndexesLock.Lock()
+	defer packIndexesLock.Unlock()
+
+	if len(packIndexes) >= maxCachedPackIndexes {
+		packIndexes = make(map[plumbing.Hash]*idxfile.Idxfile)
+	}
+
+	packIndexes[pack] = idx
+	return idx, nil
+}
+
+// A writer that collects the header of a delta and then stops the write.
+type deltaHeaderWriter struct {
+	data []byte
+}
+
+func (w *deltaHeaderWriter) Write(p []byte) (int, error) {
+	w.data = append(w.data, p...)
+
+	if len(w.sizes()) == 2 {
+		return len(p), errDeltaHeaderRead
+	}
+
+	return len(p), nil
+}
+
+// Return the sizes that have been read from the delta header.
+//
+// Each size is a little-endian variable-width integer, with 7 bits per byte
+// and the high bit set on all but the last byte.
+func (w *deltaHeaderWriter) sizes() []int64 {
+	var sizes []int64
+	var size int64
+	var shift uint
+
+	for _, b := range w.data {
+		size |= int64(b&0x7f) << shift
+		shift += 7
+
+		if b&0x80 == 0 {
+			sizes = append(sizes, size)
+			if len(sizes) == 2 {
+				break
+			}
+
+			size = 0
+			shift = 0
+		}
+	}
+
+	return sizes
+}
+
+// The maximum number of commit generations kept in memory.
+const maxCachedCommitGenerations = 1 << 21
+
+var (
+	commitGenerationsLock sync.Mutex
+
+	// Commit generations, by commit ID.
+	//
+	// Like pack indexes, a commit's ID identifies its ancestry, so
+	// generations can be shared between repositories and never go stale.
+	commitGenerations = make(map[plumbing.Hash]int)
+)
+
+// Return the generation of a commit.
+//
+// A commit with no parents has a generation of 1, and any other commit has a
+// generation one more than the latest of its parents, so every commit has a
+// later generation than its ancestors. Computing it walks the commit's history
+// once; the generations of the commit and its ancestors are then cached.
+func gitCommitGeneration(gitRepo *git.Repository, commit *object.Commit) (int, error) {
+	if generation, ok := cachedGitCommitGeneration(commit.Hash); ok {
+		return generation, nil
+	}
+
+	generations := make(map[plumbing.Hash]int)
+	lookup := func(hash plumbing.Hash) (int, bool) {
+		if generation, ok := generations[hash]; ok {
+			return generation, true
+		}
+
+		return cachedGitCommitGeneration(hash)
+	}
+
+	stack := []*object.Commit{commit}
+	for len(stack) != 0 {
+		top := stack[len(stack)-1]
+		if _, ok := lookup(top.Hash); ok {
+			stack = stack[:len(stack)-1]
+			continue
+		}
+
+		generation := 1
+		missing := false
+
+		for _, parentHash := range top.ParentHashes {
+			if parentGeneration, ok := lookup(parentHash); ok {
+				if parentGeneration >= generation {
+					generation = parentGeneration + 1
+				}
+				continue
+			}
+
+			parent, err := gitRepo.CommitObject(parentHash)
+			if err != nil {
+				return 0, err
+			}
+
+			stack = append(stack, parent)
+			missing = true
+		}
+
+		if !missing {
+			generations[top.Hash] = generation
+			stack = stack[:len(stack)-1]
+		}
+	}
+
+	commitGenerationsLock.Lock()
+	defer commitGenerationsLock.Unlock()
+
+	if len(commitGenerations)+len(generations) > maxCachedCommitGenerations {
+		commitGenerations = make(map[plumbing.Hash]int)
+	}
+
+	for hash, generation := range generations {
+		commitGenerations[hash] = generation
+	}
+
+	return generations[commit.Hash], nil
+}
+
+// Return the cached generation of a commit, if it is known.
+func cachedGitCommitGeneration(hash plumbing.Hash) (int, bool) {
+	commitGenerationsLock.Lock()
+	defer commitGenerationsLock.Unlock()
+
+	generation, ok := commitGenerations[hash]
+	return generation, ok
+}
+
+// A commit and its generation.
+type gitGenerationEntry struct {
+	commit     *object.Commit
+	generation int
+}
+
+// A heap of commits, latest generation first. This implements heap.Interface.
+type gitGenerationHeap []gitGenerationEntry
+
+func (h gitGenerationHeap) Len() int           { return len(h) }
+func (h gitGenerationHeap) Less(i, j int) bool { return h[i].generation > h[j].generation }
+func (h gitGenerationHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *gitGenerationHeap) Push(x interface{}) {
+	*h = append(*h, x.(gitGenerationEntry))
+}
+
+func (h *gitGenerationHeap) Pop() interface{} {
+	old := *h
+	entry := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return entry
+}
+
+// A heap of commits, most recently committed first. This implements
+// heap.Interface.
+type gitCommitTimeHeap []*object.Commit
+
+func (h gitCommitTimeHeap) Len() int { return len(h) }
+func (h gitCommitTimeHeap) Less(i, j int) bool {
+	return h[i].Committer.When.After(h[j].Committer.When)
+}
+func (h gitCommitTimeHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *gitCommitTimeHeap) Push(x interface{}) {
+	*h = append(*h, x.(*object.Commit))
+}
+
+func (h *gitCommitTimeHeap) Pop() interface{} {
+	old := *h
+	commit := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return commit
+}
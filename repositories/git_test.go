@@ -1,7 +1,16 @@
 package repositories_test
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -12,6 +21,7 @@ import (
 	"gopkg.in/src-d/go-git.v4/plumbing/object"
 
 	"github.com/reviewboard/rb-gateway/helpers"
+	"github.com/reviewboard/rb-gateway/repositories"
 	"github.com/reviewboard/rb-gateway/repositories/events"
 )
 
@@ -31,6 +41,27 @@ func TestGetFile(t *testing.T) {
 	assert.Equal(string(expectedContent), string(fileContent))
 }
 
+func TestOpenFile(t *testing.T) {
+	assert := assert.New(t)
+
+	repo, rawRepo := helpers.CreateGitRepo(t, "repo")
+	defer helpers.CleanupRepository(t, repo.Path)
+
+	helpers.SeedGitRepo(t, repo, rawRepo)
+	fileId := helpers.GetRepositoryFileId(t, rawRepo, "README").String()
+
+	reader, size, err := repo.OpenFile(fileId)
+	assert.Nil(err)
+	defer reader.Close()
+
+	fileContent, err := ioutil.ReadAll(reader)
+	assert.Nil(err)
+
+	expectedContent := helpers.GetRepoFiles()["README"]
+	assert.Equal(int64(len(expectedContent)), size)
+	assert.Equal(string(expectedContent), string(fileContent))
+}
+
 func TestGetFileByCommit(t *testing.T) {
 	assert := assert.New(t)
 
@@ -39,102 +70,891 @@ func TestGetFileByCommit(t *testing.T) {
 
 	commitId := helpers.SeedGitRepo(t, repo, rawRepo).String()
 
-	fileContent, err := repo.GetFileByCommit(commitId, "README")
+	fileContent, err := repo.GetFileByCommit(commitId, "README")
+	assert.Nil(err)
+
+	expectedContent := helpers.GetRepoFiles()["README"]
+	assert.Equal(string(expectedContent), string(fileContent))
+}
+
+func TestGetFileSizeByCommit(t *testing.T) {
+	assert := assert.New(t)
+
+	repo, rawRepo := helpers.CreateGitRepo(t, "repo")
+	defer helpers.CleanupRepository(t, repo.Path)
+
+	worktree, err := rawRepo.Worktree()
+	assert.Nil(err)
+
+	var lines []string
+	for i := 0; i < 1000; i++ {
+		lines = append(lines, fmt.Sprintf("Line %d", i))
+	}
+
+	contents := map[string]string{}
+	commit := func(content string) string {
+		assert.Nil(ioutil.WriteFile(filepath.Join(repo.Path, "file.txt"), []byte(content), 0644))
+
+		_, err := worktree.Add("file.txt")
+		assert.Nil(err)
+
+		commitId, err := worktree.Commit("Commit", &git.CommitOptions{
+			Author: &object.Signature{
+				Name:  "Author",
+				Email: "author@example.com",
+				When:  time.Now(),
+			},
+		})
+		assert.Nil(err)
+
+		contents[commitId.String()] = content
+		return commitId.String()
+	}
+
+	commit(strings.Join(lines, "\n"))
+	commit(strings.Join(lines[:900], "\n") + "\nChanged\n")
+
+	checkSizes := func() {
+		for commitId, content := range contents {
+			size, err := repo.GetFileSizeByCommit(commitId, "file.txt")
+			assert.Nil(err)
+			assert.Equal(int64(len(content)), size)
+
+			commitObject, err := rawRepo.CommitObject(plumbing.NewHash(commitId))
+			assert.Nil(err)
+			file, err := commitObject.File("file.txt")
+			assert.Nil(err)
+
+			reader, size, err := repo.OpenFile(file.Hash.String())
+			assert.Nil(err)
+			assert.Equal(int64(len(content)), size)
+
+			data, err := ioutil.ReadAll(reader)
+			assert.Nil(err)
+			assert.Equal(content, string(data))
+			assert.Nil(reader.Close())
+
+			_, _, err = repo.OpenFile(commitObject.TreeHash.String())
+			assert.NotNil(err)
+		}
+	}
+
+	// Loose objects.
+	checkSizes()
+
+	// Packed objects, one of which is stored as a delta of the other.
+	output, err := exec.Command("git", "-C", repo.Path, "repack", "-a", "-d", "-f").CombinedOutput()
+	assert.Nil(err, string(output))
+	output, err = exec.Command("git", "-C", repo.Path, "prune-packed").CombinedOutput()
+	assert.Nil(err, string(output))
+
+	checkSizes()
+
+	_, err = repo.GetFileSizeByCommit(helpers.GetRepoHead(t, rawRepo).String(), "does-not-exist")
+	assert.NotNil(err)
+}
+
+func TestBareRepository(t *testing.T) {
+	assert := assert.New(t)
+
+	repo, rawRepo := helpers.CreateBareGitRepo(t, "repo")
+	defer helpers.CleanupRepository(t, repo.Path)
+
+	commitId := helpers.GetRepoHead(t, rawRepo).String()
+	expectedContent := helpers.GetRepoFiles()["README"]
+
+	fileContent, err := repo.GetFileByCommit(commitId, "README")
+	assert.Nil(err)
+	assert.Equal(string(expectedContent), string(fileContent))
+
+	fileId := helpers.GetRepositoryFileId(t, rawRepo, "README").String()
+	fileContent, err = repo.GetFile(fileId)
+	assert.Nil(err)
+	assert.Equal(string(expectedContent), string(fileContent))
+
+	branches, err := repo.GetBranches(repositories.BranchSortDefault)
+	assert.Nil(err)
+	if assert.Equal(1, len(branches)) {
+		assert.Equal("master", branches[0].Name)
+		assert.Equal(commitId, branches[0].Id)
+	}
+
+	commits, err := repo.GetCommits("master", "", repositories.CommitOrderDefault, repositories.CommitFilter{})
+	assert.Nil(err)
+	if assert.Equal(1, len(commits)) {
+		assert.Equal(commitId, commits[0].Id)
+	}
+}
+
+func TestFileExists(t *testing.T) {
+	assert := assert.New(t)
+
+	repo, rawRepo := helpers.CreateGitRepo(t, "repo")
+	defer helpers.CleanupRepository(t, repo.Path)
+
+	helpers.SeedGitRepo(t, repo, rawRepo)
+	fileId := helpers.GetRepositoryFileId(t, rawRepo, "README").String()
+
+	exists, err := repo.FileExists(fileId)
+	assert.Nil(err)
+	assert.True(exists)
+}
+
+func TestFileExistsByCommit(t *testing.T) {
+	assert := assert.New(t)
+
+	repo, rawRepo := helpers.CreateGitRepo(t, "repo")
+	defer helpers.CleanupRepository(t, repo.Path)
+
+	commitId := helpers.SeedGitRepo(t, repo, rawRepo).String()
+
+	exists, err := repo.FileExistsByCommit(commitId, "README")
+	assert.Nil(err)
+	assert.True(exists)
+}
+
+func TestResolveRef(t *testing.T) {
+	assert := assert.New(t)
+
+	repo, rawRepo := helpers.CreateGitRepo(t, "repo")
+	defer helpers.CleanupRepository(t, repo.Path)
+
+	commitId := helpers.SeedGitRepo(t, repo, rawRepo)
+	branch := helpers.CreateGitBranch(t, repo, rawRepo)
+
+	err := rawRepo.Storer.SetReference(plumbing.NewHashReference("refs/tags/v1.0", commitId))
+	assert.Nil(err)
+
+	testCases := []struct {
+		ref      string
+		expected string
+	}{
+		{"master", commitId.String()},
+		{"refs/heads/master", commitId.String()},
+		{branch.Name().Short(), branch.Hash().String()},
+		{"v1.0", commitId.String()},
+		{branch.Hash().String(), branch.Hash().String()},
+	}
+
+	for _, testCase := range testCases {
+		resolved, err := repo.ResolveRef(testCase.ref)
+		assert.Nil(err)
+		assert.Equal(testCase.expected, resolved, "Ref %s resolved incorrectly", testCase.ref)
+	}
+
+	_, err = repo.ResolveRef("does-not-exist")
+	assert.NotNil(err)
+}
+
+func TestGetBranches(t *testing.T) {
+	assert := assert.New(t)
+
+	repo, rawRepo := helpers.CreateGitRepo(t, "repo")
+	defer helpers.CleanupRepository(t, repo.Path)
+
+	helpers.SeedGitRepo(t, repo, rawRepo)
+	branch := helpers.CreateGitBranch(t, repo, rawRepo)
+	branchName := branch.Name().Short()
+
+	branches, err := repo.GetBranches(repositories.BranchSortDefault)
+	assert.Nil(err)
+
+	assert.Equal(2, len(branches))
+
+	for i := range branches {
+		assert.Contains([]string{"master", branchName}, branches[i].Name)
+
+		if branches[i].Name == branchName {
+			assert.Equal(branch.Hash().String(), branches[i].Id)
+		}
+	}
+}
+
+func TestGetBranchesAfterChange(t *testing.T) {
+	assert := assert.New(t)
+
+	repo, rawRepo := helpers.CreateGitRepo(t, "repo")
+	defer helpers.CleanupRepository(t, repo.Path)
+
+	helpers.SeedGitRepo(t, repo, rawRepo)
+
+	branches, err := repo.GetBranches(repositories.BranchSortDefault)
+	assert.Nil(err)
+	assert.Equal(1, len(branches))
+
+	// The cached repository handle must see branches and commits created
+	// after it was opened.
+	branch := helpers.CreateGitBranch(t, repo, rawRepo)
+
+	branches, err = repo.GetBranches(repositories.BranchSortDefault)
+	assert.Nil(err)
+	assert.Equal(2, len(branches))
+
+	commit, err := repo.GetCommit(branch.Hash().String())
+	assert.Nil(err)
+	assert.Equal("Add branch", commit.Message)
+
+	repositories.FlushRepositoryCache()
+
+	branches, err = repo.GetBranches(repositories.BranchSortDefault)
+	assert.Nil(err)
+	assert.Equal(2, len(branches))
+}
+
+func TestGetRefs(t *testing.T) {
+	assert := assert.New(t)
+
+	repo, rawRepo := helpers.CreateGitRepo(t, "repo")
+	defer helpers.CleanupRepository(t, repo.Path)
+
+	commitId := helpers.SeedGitRepo(t, repo, rawRepo)
+	branch := helpers.CreateGitBranch(t, repo, rawRepo)
+
+	err := rawRepo.Storer.SetReference(plumbing.NewHashReference("refs/tags/v1.0", commitId))
+	assert.Nil(err)
+
+	refs, err := repo.GetRefs()
+	assert.Nil(err)
+
+	assert.ElementsMatch(
+		[]repositories.Ref{
+			{Name: "master", Type: repositories.RefTypeBranch, Id: commitId.String()},
+			{Name: branch.Name().Short(), Type: repositories.RefTypeBranch, Id: branch.Hash().String()},
+			{Name: "v1.0", Type: repositories.RefTypeTag, Id: commitId.String()},
+		},
+		refs)
+}
+
+func TestGetCommits(t *testing.T) {
+	assert := assert.New(t)
+
+	repo, rawRepo := helpers.CreateGitRepo(t, "repo")
+	defer helpers.CleanupRepository(t, repo.Path)
+
+	commitId := helpers.SeedGitRepo(t, repo, rawRepo)
+	commit, err := rawRepo.CommitObject(commitId)
+	assert.Nil(err)
+
+	branch := helpers.CreateGitBranch(t, repo, rawRepo)
+	branchCommit, err := rawRepo.CommitObject(branch.Hash())
+	assert.Nil(err)
+
+	branchName := branch.Name().Short()
+	assert.Nil(err)
+
+	// Testing GetCommits without a starting commit.
+	commits, err := repo.GetCommits(branchName, "", repositories.CommitOrderDefault, repositories.CommitFilter{})
+	assert.Nil(err)
+
+	assert.Equal(len(commits), 2)
+
+	assert.Equal(branchCommit.Message, commits[0].Message)
+	assert.Equal(branch.Hash().String(), commits[0].Id)
+	assert.Equal(commitId.String(), commits[0].ParentId)
+	assert.Equal(commit.Message, commits[1].Message)
+	assert.Equal(commitId.String(), commits[1].Id)
+	assert.Equal("", commits[1].ParentId)
+
+	// Testing GetCommits with a starting commit.
+	commits, err = repo.GetCommits(branchName, commitId.String(), repositories.CommitOrderDefault, repositories.CommitFilter{})
+	assert.Nil(err)
+
+	assert.Equal(len(commits), 1)
+
+	assert.Equal(commit.Message, commits[0].Message)
+	assert.Equal(commitId.String(), commits[0].Id)
+}
+
+func TestGetBranchesSorted(t *testing.T) {
+	assert := assert.New(t)
+
+	repo, rawRepo := helpers.CreateGitRepo(t, "repo")
+	defer helpers.CleanupRepository(t, repo.Path)
+
+	commitId := helpers.SeedGitRepo(t, repo, rawRepo)
+	helpers.CreateGitBranch(t, repo, rawRepo)
+
+	worktree, err := rawRepo.Worktree()
+	assert.Nil(err)
+
+	_, err = worktree.Commit("Newest commit", &git.CommitOptions{
+		Author: &object.Signature{
+			Name:  "Author",
+			Email: "author@example.com",
+			When:  time.Now().Add(time.Hour),
+		},
+	})
+	assert.Nil(err)
+
+	err = rawRepo.Storer.SetReference(plumbing.NewHashReference("refs/heads/aaa", commitId))
+	assert.Nil(err)
+
+	names := func(branches []repositories.Branch) []string {
+		result := make([]string, 0, len(branches))
+		for _, branch := range branches {
+			result = append(result, branch.Name)
+		}
+		return result
+	}
+
+	branches, err := repo.GetBranches(repositories.BranchSortName)
+	assert.Nil(err)
+	assert.Equal([]string{"aaa", "master", "test-branch"}, names(branches))
+
+	// Branches pointing at the same commit are ordered by name.
+	branches, err = repo.GetBranches(repositories.BranchSortDate)
+	assert.Nil(err)
+	assert.Equal([]string{"aaa", "master", "test-branch"}, names(branches))
+}
+
+func TestGetCommitsOrder(t *testing.T) {
+	assert := assert.New(t)
+
+	repo, rawRepo := helpers.CreateGitRepo(t, "repo")
+	defer helpers.CleanupRepository(t, repo.Path)
+
+	helpers.SeedGitRepo(t, repo, rawRepo)
+	helpers.CreateGitBranch(t, repo, rawRepo)
+
+	worktree, err := rawRepo.Worktree()
+	assert.Nil(err)
+
+	commit := func(message string, offset time.Duration, parents ...plumbing.Hash) plumbing.Hash {
+		commitId, err := worktree.Commit(message, &git.CommitOptions{
+			Author: &object.Signature{
+				Name:  "Author",
+				Email: "author@example.com",
+				When:  time.Now().Add(offset),
+			},
+			Parents: parents,
+		})
+		assert.Nil(err)
+		return commitId
+	}
+
+	// The base has a later date than its children, so ordering by date lists
+	// it before one of them.
+	base := commit("Base", 3*time.Hour)
+	first := commit("First parent", 2*time.Hour, base)
+	second := commit("Second parent", time.Hour, base)
+	commit("Merge", 4*time.Hour, first, second)
+
+	messages := func(commits []repositories.CommitInfo) []string {
+		result := make([]string, 0, len(commits))
+		for _, commit := range commits {
+			result = append(result, commit.Message)
+		}
+		return result
+	}
+
+	commits, err := repo.GetCommits("test-branch", "", repositories.CommitOrderDate, repositories.CommitFilter{})
+	assert.Nil(err)
+	assert.Equal(
+		[]string{"Merge", "First parent", "Base", "Second parent", "Add branch", "Initial commit"},
+		messages(commits))
+
+	commits, err = repo.GetCommits("test-branch", "", repositories.CommitOrderDefault, repositories.CommitFilter{})
+	assert.Nil(err)
+	assert.Equal(
+		[]string{"Merge", "First parent", "Base", "Second parent", "Add branch", "Initial commit"},
+		messages(commits))
+
+	commits, err = repo.GetCommits("test-branch", "", repositories.CommitOrderTopological, repositories.CommitFilter{})
+	assert.Nil(err)
+	assert.Equal(
+		[]string{"Merge", "First parent", "Second parent", "Base", "Add branch", "Initial commit"},
+		messages(commits))
+}
+
+func TestGetCommitsFilter(t *testing.T) {
+	assert := assert.New(t)
+
+	repo, rawRepo := helpers.CreateGitRepo(t, "repo")
+	defer helpers.CleanupRepository(t, repo.Path)
+
+	helpers.SeedGitRepo(t, repo, rawRepo)
+	helpers.CreateGitBranch(t, repo, rawRepo)
+
+	worktree, err := rawRepo.Worktree()
+	assert.Nil(err)
+
+	now := time.Now()
+	commit := func(message, name, email string, when time.Time) {
+		_, err := worktree.Commit(message, &git.CommitOptions{
+			Author: &object.Signature{
+				Name:  name,
+				Email: email,
+				When:  when,
+			},
+		})
+		assert.Nil(err)
+	}
+
+	commit("Old", "Jane Doe", "jane@example.com", now.Add(time.Hour))
+	commit("Middle", "John Smith", "jsmith@example.com", now.Add(2*time.Hour))
+	commit("New", "Jane Doe", "jane@example.com", now.Add(3*time.Hour))
+
+	messages := func(commits []repositories.CommitInfo) []string {
+		result := make([]string, 0, len(commits))
+		for _, commit := range commits {
+			result = append(result, commit.Message)
+		}
+		return result
+	}
+
+	for _, order := range []repositories.CommitOrder{repositories.CommitOrderDate, repositories.CommitOrderTopological} {
+		commits, err := repo.GetCommits("test-branch", "", order, repositories.CommitFilter{
+			Author: "JANE",
+		})
+		assert.Nil(err)
+		assert.Equal([]string{"New", "Old"}, messages(commits))
+
+		commits, err = repo.GetCommits("test-branch", "", order, repositories.CommitFilter{
+			Author: "jsmith@",
+		})
+		assert.Nil(err)
+		assert.Equal([]string{"Middle"}, messages(commits))
+
+		commits, err = repo.GetCommits("test-branch", "", order, repositories.CommitFilter{
+			Since: now.Add(90 * time.Minute),
+		})
+		assert.Nil(err)
+		assert.Equal([]string{"New", "Middle"}, messages(commits))
+
+		commits, err = repo.GetCommits("test-branch", "", order, repositories.CommitFilter{
+			Since: now.Add(30 * time.Minute),
+			Until: now.Add(2 * time.Hour),
+		})
+		assert.Nil(err)
+		assert.Equal([]string{"Middle", "Old"}, messages(commits))
+
+		commits, err = repo.GetCommits("test-branch", "", order, repositories.CommitFilter{
+			Author: "Jane",
+			Since:  now.Add(90 * time.Minute),
+		})
+		assert.Nil(err)
+		assert.Equal([]string{"New"}, messages(commits))
+
+		commits, err = repo.GetCommits("test-branch", "", order, repositories.CommitFilter{
+			Author: "nobody",
+		})
+		assert.Nil(err)
+		assert.Equal([]string{}, messages(commits))
+	}
+}
+
+func TestGetMergeBase(t *testing.T) {
+	assert := assert.New(t)
+
+	repo, rawRepo := helpers.CreateGitRepo(t, "repo")
+	defer helpers.CleanupRepository(t, repo.Path)
+
+	base := helpers.SeedGitRepo(t, repo, rawRepo)
+	branch := helpers.CreateGitBranch(t, repo, rawRepo)
+
+	worktree, err := rawRepo.Worktree()
+	assert.Nil(err)
+
+	assert.Nil(worktree.Checkout(&git.CheckoutOptions{
+		Branch: "refs/heads/master",
+	}))
+
+	_, err = worktree.Commit("Master commit", &git.CommitOptions{
+		Author: &object.Signature{
+			Name:  "Author",
+			Email: "author@example.com",
+			When:  time.Now(),
+		},
+	})
+	assert.Nil(err)
+
+	mergeBase, err := repo.GetMergeBase("master", "test-branch")
+	assert.Nil(err)
+	assert.Equal(base.String(), mergeBase)
+
+	mergeBase, err = repo.GetMergeBase(branch.Hash().String(), base.String())
+	assert.Nil(err)
+	assert.Equal(base.String(), mergeBase)
+
+	mergeBase, err = repo.GetMergeBase("test-branch", "test-branch")
+	assert.Nil(err)
+	assert.Equal(branch.Hash().String(), mergeBase)
+
+	_, err = repo.GetMergeBase("master", "does-not-exist")
+	assert.NotNil(err)
+}
+
+func TestGetCommitRange(t *testing.T) {
+	assert := assert.New(t)
+
+	repo, rawRepo := helpers.CreateGitRepo(t, "repo")
+	defer helpers.CleanupRepository(t, repo.Path)
+
+	since := helpers.SeedGitRepo(t, repo, rawRepo)
+
+	worktree, err := rawRepo.Worktree()
+	assert.Nil(err)
+
+	commitIds := make([]plumbing.Hash, 0, 3)
+	for i := 1; i <= 3; i++ {
+		commitId, err := worktree.Commit(fmt.Sprintf("Commit %d", i), &git.CommitOptions{
+			Author: &object.Signature{
+				Name:  "Author",
+				Email: "author@example.com",
+				When:  time.Now(),
+			},
+		})
+		assert.Nil(err)
+
+		commitIds = append(commitIds, commitId)
+	}
+
+	commits, err := repo.GetCommitRange(since.String(), "master")
+	assert.Nil(err)
+	assert.Equal(3, len(commits))
+
+	for i, commit := range commits {
+		expected := commitIds[len(commitIds)-1-i]
+		assert.Equal(expected.String(), commit.Id)
+	}
+
+	assert.Equal(since.String(), commits[2].ParentId)
+
+	commits, err = repo.GetCommitRange(commitIds[2].String(), commitIds[2].String())
+	assert.Nil(err)
+	assert.Equal(0, len(commits))
+
+	_, err = repo.GetCommitRange("does-not-exist", "master")
+	assert.NotNil(err)
+}
+
+func TestWriteArchive(t *testing.T) {
+	assert := assert.New(t)
+
+	repo, rawRepo := helpers.CreateGitRepo(t, "repo")
+	defer helpers.CleanupRepository(t, repo.Path)
+
+	helpers.SeedGitRepo(t, repo, rawRepo)
+	branch := helpers.CreateGitBranch(t, repo, rawRepo)
+
+	var buf bytes.Buffer
+	assert.Nil(repo.WriteArchive(&buf, branch.Name().Short(), repositories.ArchiveFormatTarGz, "prefix"))
+
+	gz, err := gzip.NewReader(&buf)
+	assert.Nil(err)
+
+	files := helpers.GetRepoFiles()
+	reader := tar.NewReader(gz)
+	count := 0
+
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.Nil(err)
+
+		content, ok := files[strings.TrimPrefix(header.Name, "prefix/")]
+		assert.Truef(ok, "Unexpected file %s", header.Name)
+
+		data, err := ioutil.ReadAll(reader)
+		assert.Nil(err)
+		assert.Equal(content, data)
+		assert.Equal(int64(0644), header.Mode)
+
+		count++
+	}
+
+	assert.Equal(len(files), count)
+
+	buf.Reset()
+	assert.Nil(repo.WriteArchive(&buf, branch.Name().Short(), repositories.ArchiveFormatZip, "prefix"))
+
+	zipReader, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	assert.Nil(err)
+	assert.Equal(len(files), len(zipReader.File))
+
+	assert.NotNil(repo.WriteArchive(&buf, "master", "rar", "prefix"))
+	assert.NotNil(repo.WriteArchive(&buf, "does-not-exist", repositories.ArchiveFormatZip, "prefix"))
+}
+
+func TestGetFileSizes(t *testing.T) {
+	assert := assert.New(t)
+
+	repo, rawRepo := helpers.CreateGitRepo(t, "repo")
+	defer helpers.CleanupRepository(t, repo.Path)
+
+	helpers.SeedGitRepo(t, repo, rawRepo)
+	helpers.CreateGitBranch(t, repo, rawRepo)
+
+	sizes, err := repo.GetFileSizes("test-branch")
+	assert.Nil(err)
+
+	expected := make(map[string]int64)
+	for name, content := range helpers.GetRepoFiles() {
+		expected[name] = int64(len(content))
+	}
+	assert.Equal(expected, sizes)
+
+	sizes, err = repo.GetFileSizes("master")
+	assert.Nil(err)
+	assert.Equal(2, len(sizes))
+
+	_, err = repo.GetFileSizes("bad-ref")
+	assert.NotNil(err)
+}
+
+func TestGetChangedFiles(t *testing.T) {
+	assert := assert.New(t)
+
+	repo, rawRepo := helpers.CreateGitRepo(t, "repo")
+	defer helpers.CleanupRepository(t, repo.Path)
+
+	seedId := helpers.SeedGitRepo(t, repo, rawRepo)
+	helpers.CreateGitBranch(t, repo, rawRepo)
+
+	paths, err := repo.GetChangedFiles(seedId.String())
+	assert.Nil(err)
+	assert.Equal([]string{"COPYING", "README"}, paths)
+
+	paths, err = repo.GetChangedFiles("test-branch")
+	assert.Nil(err)
+	assert.Equal([]string{"AUTHORS"}, paths)
+
+	_, err = repo.GetChangedFiles("bad-ref")
+	assert.NotNil(err)
+}
+
+func TestGetFileLog(t *testing.T) {
+	assert := assert.New(t)
+
+	repo, rawRepo := helpers.CreateGitRepo(t, "repo")
+	defer helpers.CleanupRepository(t, repo.Path)
+
+	seedId := helpers.SeedGitRepo(t, repo, rawRepo)
+	branch := helpers.CreateGitBranch(t, repo, rawRepo)
+
+	worktree, err := rawRepo.Worktree()
+	assert.Nil(err)
+
+	commit := func(message string, files map[string]string) plumbing.Hash {
+		for path, content := range files {
+			assert.Nil(os.MkdirAll(filepath.Join(repo.Path, filepath.Dir(path)), 0755))
+			assert.Nil(ioutil.WriteFile(filepath.Join(repo.Path, path), []byte(content), 0644))
+
+			_, err := worktree.Add(path)
+			assert.Nil(err)
+		}
+
+		commitId, err := worktree.Commit(message, &git.CommitOptions{
+			Author: &object.Signature{
+				Name:  "Author",
+				Email: "author@example.com",
+				When:  time.Now(),
+			},
+		})
+		assert.Nil(err)
+
+		return commitId
+	}
+
+	readmeId := commit("Update README", map[string]string{"README": "Updated README\n"})
+	docsId := commit("Add docs", map[string]string{"docs/guide.txt": "Guide\n"})
+
+	commits, err := repo.GetFileLog("test-branch", "README")
+	assert.Nil(err)
+	assert.Equal(2, len(commits))
+	assert.Equal(readmeId.String(), commits[0].Id)
+	assert.Equal(seedId.String(), commits[1].Id)
+
+	commits, err = repo.GetFileLog("test-branch", "AUTHORS")
+	assert.Nil(err)
+	assert.Equal(1, len(commits))
+	assert.Equal(branch.Hash().String(), commits[0].Id)
+
+	commits, err = repo.GetFileLog("master", "AUTHORS")
+	assert.Nil(err)
+	assert.Equal(0, len(commits))
+
+	for _, path := range []string{"docs", "docs/guide.txt", "/docs/"} {
+		commits, err = repo.GetFileLog("test-branch", path)
+		assert.Nil(err)
+		assert.Equal(1, len(commits))
+		assert.Equal(docsId.String(), commits[0].Id)
+	}
+
+	commits, err = repo.GetFileLog("test-branch", "README/does-not-exist")
 	assert.Nil(err)
+	assert.Equal(0, len(commits))
 
-	expectedContent := helpers.GetRepoFiles()["README"]
-	assert.Equal(string(expectedContent), string(fileContent))
+	_, err = repo.GetFileLog("does-not-exist", "README")
+	assert.NotNil(err)
 }
 
-func TestFileExists(t *testing.T) {
+func TestGetFileLogRenames(t *testing.T) {
 	assert := assert.New(t)
 
 	repo, rawRepo := helpers.CreateGitRepo(t, "repo")
 	defer helpers.CleanupRepository(t, repo.Path)
 
-	helpers.SeedGitRepo(t, repo, rawRepo)
-	fileId := helpers.GetRepositoryFileId(t, rawRepo, "README").String()
-
-	exists, err := repo.FileExists(fileId)
+	worktree, err := rawRepo.Worktree()
 	assert.Nil(err)
-	assert.True(exists)
-}
 
-func TestFileExistsByCommit(t *testing.T) {
-	assert := assert.New(t)
+	lines := "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n"
+	when := time.Now()
 
-	repo, rawRepo := helpers.CreateGitRepo(t, "repo")
-	defer helpers.CleanupRepository(t, repo.Path)
+	// Commits are a second apart so that they are logged in order.
+	commit := func(message string, files map[string]string, removed ...string) string {
+		for path, content := range files {
+			assert.Nil(ioutil.WriteFile(filepath.Join(repo.Path, path), []byte(content), 0644))
 
-	commitId := helpers.SeedGitRepo(t, repo, rawRepo).String()
+			_, err := worktree.Add(path)
+			assert.Nil(err)
+		}
 
-	exists, err := repo.FileExistsByCommit(commitId, "README")
-	assert.Nil(err)
-	assert.True(exists)
-}
+		for _, path := range removed {
+			_, err := worktree.Remove(path)
+			assert.Nil(err)
+		}
 
-func TestGetBranches(t *testing.T) {
-	assert := assert.New(t)
+		when = when.Add(time.Second)
+		commitId, err := worktree.Commit(message, &git.CommitOptions{
+			Author: &object.Signature{
+				Name:  "Author",
+				Email: "author@example.com",
+				When:  when,
+			},
+		})
+		assert.Nil(err)
 
-	repo, rawRepo := helpers.CreateGitRepo(t, "repo")
-	defer helpers.CleanupRepository(t, repo.Path)
+		return commitId.String()
+	}
 
-	helpers.SeedGitRepo(t, repo, rawRepo)
-	branch := helpers.CreateGitBranch(t, repo, rawRepo)
-	branchName := branch.Name().Short()
+	addId := commit("Add a.txt", map[string]string{"a.txt": lines})
+	modifyId := commit("Modify a.txt", map[string]string{"a.txt": lines + "11\n"})
+	renameId := commit("Rename a.txt", map[string]string{"b.txt": lines + "11\n"}, "a.txt")
+	copyId := commit("Copy b.txt", map[string]string{"c.txt": lines + "11\n"})
+	editRenameId := commit("Rename and edit c.txt", map[string]string{"d.txt": lines + "eleven\n"}, "c.txt")
+	unrelatedId := commit("Replace b.txt", map[string]string{"e.txt": "unrelated\n"}, "b.txt")
 
-	branches, err := repo.GetBranches()
+	entries, err := repo.GetFileLog("master", "d.txt")
 	assert.Nil(err)
 
-	assert.Equal(2, len(branches))
-
-	for i := range branches {
-		assert.Contains([]string{"master", branchName}, branches[i].Name)
+	type logEntry struct {
+		Id      string
+		Path    string
+		OldPath string
+		Status  string
+	}
 
-		if branches[i].Name == branchName {
-			assert.Equal(branch.Hash().String(), branches[i].Id)
+	summarize := func(entries []repositories.FileLogEntry) []logEntry {
+		summary := []logEntry{}
+		for _, entry := range entries {
+			summary = append(summary, logEntry{entry.Id, entry.Path, entry.OldPath, entry.Status})
 		}
+
+		return summary
 	}
+
+	assert.Equal([]logEntry{
+		{editRenameId, "d.txt", "c.txt", repositories.PatchRenamed},
+		{copyId, "c.txt", "b.txt", repositories.PatchCopied},
+		{renameId, "b.txt", "a.txt", repositories.PatchRenamed},
+		{modifyId, "a.txt", "", repositories.PatchModified},
+		{addId, "a.txt", "", repositories.PatchAdded},
+	}, summarize(entries))
+
+	// Files that are not similar are not renames.
+	entries, err = repo.GetFileLog("master", "e.txt")
+	assert.Nil(err)
+	assert.Equal([]logEntry{
+		{unrelatedId, "e.txt", "", repositories.PatchAdded},
+	}, summarize(entries))
+
+	entries, err = repo.GetFileLog("master", "b.txt")
+	assert.Nil(err)
+	assert.Equal([]logEntry{
+		{unrelatedId, "b.txt", "", repositories.PatchDeleted},
+		{renameId, "b.txt", "a.txt", repositories.PatchRenamed},
+		{modifyId, "a.txt", "", repositories.PatchModified},
+		{addId, "a.txt", "", repositories.PatchAdded},
+	}, summarize(entries))
 }
 
-func TestGetCommits(t *testing.T) {
+func TestSearchCommits(t *testing.T) {
 	assert := assert.New(t)
 
 	repo, rawRepo := helpers.CreateGitRepo(t, "repo")
 	defer helpers.CleanupRepository(t, repo.Path)
 
-	commitId := helpers.SeedGitRepo(t, repo, rawRepo)
-	commit, err := rawRepo.CommitObject(commitId)
+	seedId := helpers.SeedGitRepo(t, repo, rawRepo)
+	branch := helpers.CreateGitBranch(t, repo, rawRepo)
+
+	worktree, err := rawRepo.Worktree()
 	assert.Nil(err)
 
-	branch := helpers.CreateGitBranch(t, repo, rawRepo)
-	branchCommit, err := rawRepo.CommitObject(branch.Hash())
+	fixId, err := worktree.Commit("Fix the frobnicator", &git.CommitOptions{
+		Author: &object.Signature{
+			Name:  "Someone Else",
+			Email: "someone@example.com",
+			When:  time.Now().Add(time.Second),
+		},
+	})
 	assert.Nil(err)
 
-	branchName := branch.Name().Short()
+	// Searching all branches.
+	commits, err := repo.SearchCommits("COMMIT", "", false, false)
 	assert.Nil(err)
+	assert.Equal(1, len(commits))
+	assert.Equal(seedId.String(), commits[0].Id)
 
-	// Testing GetCommits without a starting commit.
-	commits, err := repo.GetCommits(branchName, "")
+	commits, err = repo.SearchCommits("frob", "", false, false)
 	assert.Nil(err)
+	assert.Equal(1, len(commits))
+	assert.Equal(fixId.String(), commits[0].Id)
 
-	assert.Equal(len(commits), 2)
+	// Searching a single branch.
+	commits, err = repo.SearchCommits("frob", "master", false, false)
+	assert.Nil(err)
+	assert.Equal(0, len(commits))
 
-	assert.Equal(branchCommit.Message, commits[0].Message)
+	commits, err = repo.SearchCommits("branch", branch.Name().Short(), false, false)
+	assert.Nil(err)
+	assert.Equal(1, len(commits))
 	assert.Equal(branch.Hash().String(), commits[0].Id)
-	assert.Equal(commitId.String(), commits[0].ParentId)
-	assert.Equal(commit.Message, commits[1].Message)
-	assert.Equal(commitId.String(), commits[1].Id)
-	assert.Equal("", commits[1].ParentId)
 
-	// Testing GetCommits with a starting commit.
-	commits, err = repo.GetCommits(branchName, commitId.String())
+	// Searching authors.
+	commits, err = repo.SearchCommits("someone", "", false, false)
 	assert.Nil(err)
+	assert.Equal(0, len(commits))
 
-	assert.Equal(len(commits), 1)
+	commits, err = repo.SearchCommits("someone", "", true, false)
+	assert.Nil(err)
+	assert.Equal(1, len(commits))
+	assert.Equal(fixId.String(), commits[0].Id)
 
-	assert.Equal(commit.Message, commits[0].Message)
-	assert.Equal(commitId.String(), commits[0].Id)
+	_, err = repo.SearchCommits("commit", "does-not-exist", false, false)
+	assert.NotNil(err)
+
+	// Only the newest page of matching commits is returned.
+	var latestId plumbing.Hash
+	for i := 0; i < 25; i++ {
+		latestId, err = worktree.Commit(fmt.Sprintf("Frobnicate %d", i), &git.CommitOptions{
+			Author: &object.Signature{
+				Name:  "Someone Else",
+				Email: "someone@example.com",
+				When:  time.Now().Add(time.Duration(i+2) * time.Second),
+			},
+		})
+		assert.Nil(err)
+	}
+
+	commits, err = repo.SearchCommits("frobnicate", "", false, false)
+	assert.Nil(err)
+	if assert.Equal(20, len(commits)) {
+		assert.Equal(latestId.String(), commits[0].Id)
+		assert.Equal("Frobnicate 5", commits[19].Message)
+	}
 }
 
 func TestGetCommit(t *testing.T) {
@@ -160,6 +980,11 @@ func TestGetCommit(t *testing.T) {
 	}
 
 	assert.Equal(expected.Message, result.CommitInfo.Message)
+	assert.Equal("Author", result.CommitInfo.Author)
+	assert.Equal("author@example.com", result.CommitInfo.AuthorEmail)
+	assert.Equal(expected.Committer.Name, result.CommitInfo.Committer)
+	assert.Equal(expected.Committer.Email, result.CommitInfo.CommitterEmail)
+	assert.Equal(expected.Committer.When.Format("2006-01-02T15:04:05-0700"), result.CommitInfo.CommitterDate)
 
 	diff := fmt.Sprintf(`diff --git a/AUTHORS b/AUTHORS
 new file mode 100644
@@ -172,6 +997,84 @@ index 0000000000000000000000000000000000000000..%s
 	assert.Equal(diff, result.Diff)
 }
 
+func TestGetCommitGitBinary(t *testing.T) {
+	assert := assert.New(t)
+
+	repositories.SetGitConfig(repositories.GitConfig{UseBinary: true})
+	defer repositories.SetGitConfig(repositories.GitConfig{})
+
+	repo, rawRepo := helpers.CreateGitRepo(t, "repo")
+	defer helpers.CleanupRepository(t, repo.Path)
+
+	helpers.SeedGitRepo(t, repo, rawRepo)
+
+	branch := helpers.CreateGitBranch(t, repo, rawRepo)
+
+	result, err := repo.GetCommit(branch.Hash().String())
+	assert.Nil(err)
+
+	fileId := helpers.GetRepositoryFileId(t, rawRepo, "AUTHORS").String()
+	content := string(helpers.GetRepoFiles()["AUTHORS"])
+
+	assert.True(strings.HasPrefix(result.Diff, fmt.Sprintf(`diff --git a/AUTHORS b/AUTHORS
+new file mode 100644
+index 0000000000000000000000000000000000000000..%s
+--- /dev/null
++++ b/AUTHORS
+@@ -0,0 +1 @@
++%s`, fileId, content)))
+}
+
+func TestGetNotes(t *testing.T) {
+	assert := assert.New(t)
+
+	repo, rawRepo := helpers.CreateGitRepo(t, "repo")
+	defer helpers.CleanupRepository(t, repo.Path)
+
+	commitId := helpers.SeedGitRepo(t, repo, rawRepo)
+	branch := helpers.CreateGitBranch(t, repo, rawRepo)
+
+	helpers.CreateGitNote(t, rawRepo, commitId, "CI passed\n")
+
+	notes, err := repo.GetNotes(commitId.String())
+	assert.Nil(err)
+	assert.Equal(
+		[]repositories.Note{
+			{Ref: "commits", Message: "CI passed\n"},
+		},
+		notes)
+
+	notes, err = repo.GetNotes(branch.Hash().String())
+	assert.Nil(err)
+	assert.Equal(0, len(notes))
+}
+
+// Return a copy of a push payload with only the IDs, messages, and targets of
+// its commits.
+//
+// The authors and committers of commits include the current time, and their
+// file changes are tested separately.
+func withoutCommitDetails(payload events.Payload) events.Payload {
+	pushPayload, ok := payload.(events.PushPayload)
+	if !ok {
+		return payload
+	}
+
+	commits := make([]events.PushPayloadCommit, 0, len(pushPayload.Commits))
+	for _, commit := range pushPayload.Commits {
+		commits = append(commits, events.PushPayloadCommit{
+			Id:      commit.Id,
+			Message: commit.Message,
+			Target:  commit.Target,
+		})
+	}
+
+	return events.PushPayload{
+		Repository: pushPayload.Repository,
+		Commits:    commits,
+	}
+}
+
 func TestGitParsePushEvent(t *testing.T) {
 	assert := assert.New(t)
 
@@ -202,6 +1105,25 @@ func TestGitParsePushEvent(t *testing.T) {
 
 	payload, err := repo.ParseEventPayload(events.PushEvent, input)
 	assert.Nil(err)
+
+	if pushPayload, ok := payload.(events.PushPayload); assert.True(ok) && assert.Equal(3, len(pushPayload.Commits)) {
+		commit := pushPayload.Commits[0]
+		assert.Equal("Author", commit.Author)
+		assert.Equal("author@example.com", commit.AuthorEmail)
+		assert.Equal("Author", commit.Committer)
+		assert.Equal("author@example.com", commit.CommitterEmail)
+		assert.NotEqual("", commit.Date)
+		assert.Equal(commit.Date, commit.CommitterDate)
+
+		assert.Equal([]events.PushPayloadRef{
+			{
+				Ref:    "refs/heads/master",
+				Before: oldHead.String(),
+				After:  commitIds[2].String(),
+			},
+		}, pushPayload.Refs)
+	}
+
 	expected := events.PushPayload{
 		Repository: repo.Name,
 		Commits: []events.PushPayloadCommit{
@@ -228,7 +1150,53 @@ func TestGitParsePushEvent(t *testing.T) {
 			},
 		},
 	}
-	assert.Equal(expected, payload)
+	assert.Equal(expected, withoutCommitDetails(payload))
+}
+
+func TestGitParsePushEventFileChanges(t *testing.T) {
+	assert := assert.New(t)
+
+	repo, rawRepo := helpers.CreateGitRepo(t, "git-repo")
+	defer helpers.CleanupRepository(t, repo.Path)
+
+	oldHead := helpers.SeedGitRepo(t, repo, rawRepo)
+
+	worktree, err := rawRepo.Worktree()
+	assert.Nil(err)
+
+	err = ioutil.WriteFile(filepath.Join(repo.Path, "NEWS"), []byte("NEWS\n"), 0644)
+	assert.Nil(err)
+	_, err = worktree.Add("NEWS")
+	assert.Nil(err)
+
+	err = ioutil.WriteFile(filepath.Join(repo.Path, "README"), []byte("Updated README\n"), 0644)
+	assert.Nil(err)
+	_, err = worktree.Add("README")
+	assert.Nil(err)
+
+	_, err = worktree.Remove("COPYING")
+	assert.Nil(err)
+
+	commitId, err := worktree.Commit("Change files", &git.CommitOptions{
+		Author: &object.Signature{
+			Name:  "Author",
+			Email: "author@example.com",
+			When:  time.Now(),
+		},
+	})
+	assert.Nil(err)
+
+	input := strings.NewReader(fmt.Sprintf("%s %s refs/heads/master\n", oldHead.String(), commitId.String()))
+
+	payload, err := repo.ParseEventPayload(events.PushEvent, input)
+	assert.Nil(err)
+
+	if pushPayload, ok := payload.(events.PushPayload); assert.True(ok) && assert.Equal(1, len(pushPayload.Commits)) {
+		commit := pushPayload.Commits[0]
+		assert.Equal([]string{"NEWS"}, commit.Added)
+		assert.Equal([]string{"README"}, commit.Modified)
+		assert.Equal([]string{"COPYING"}, commit.Removed)
+	}
 }
 
 func TestGitParsePushEventNewBranch(t *testing.T) {
@@ -283,7 +1251,7 @@ func TestGitParsePushEventNewBranch(t *testing.T) {
 		},
 	}
 
-	assert.Equal(expected, payload)
+	assert.Equal(expected, withoutCommitDetails(payload))
 
 }
 
@@ -368,7 +1336,7 @@ func TestGitParsePushEventRebase(t *testing.T) {
 		},
 	}
 
-	assert.Equal(expected, payload)
+	assert.Equal(expected, withoutCommitDetails(payload))
 }
 
 func TestGitParsePushEventMultiple(t *testing.T) {
@@ -462,5 +1430,152 @@ func TestGitParsePushEventMultiple(t *testing.T) {
 		},
 	}
 
-	assert.Equal(expected, payload)
+	assert.Equal(expected, withoutCommitDetails(payload))
+}
+
+func TestGitParseCommitRange(t *testing.T) {
+	assert := assert.New(t)
+
+	repo, rawRepo := helpers.CreateGitRepo(t, "git-repo")
+	defer helpers.CleanupRepository(t, repo.Path)
+
+	oldHead := helpers.SeedGitRepo(t, repo, rawRepo)
+	commitIds := make([]plumbing.Hash, 0, 3)
+
+	worktree, err := rawRepo.Worktree()
+	assert.Nil(err)
+	for i := 1; i <= 3; i++ {
+		commitId, err := worktree.Commit(fmt.Sprintf("Commit %d", i), &git.CommitOptions{
+			Author: &object.Signature{
+				Name:  "Author",
+				Email: "author@example.com",
+				When:  time.Now(),
+			},
+		})
+		assert.Nil(err)
+
+		commitIds = append(commitIds, commitId)
+	}
+
+	payload, err := repo.ParseCommitRange(events.PushEvent, oldHead.String(), "master", 0)
+	assert.Nil(err)
+
+	expected := events.PushPayload{
+		Repository: repo.Name,
+		Commits: []events.PushPayloadCommit{
+			{
+				Id:      commitIds[0].String(),
+				Message: "Commit 1",
+				Target: events.PushPayloadCommitTarget{
+					Branch: "master",
+				},
+			},
+			{
+				Id:      commitIds[1].String(),
+				Message: "Commit 2",
+				Target: events.PushPayloadCommitTarget{
+					Branch: "master",
+				},
+			},
+			{
+				Id:      commitIds[2].String(),
+				Message: "Commit 3",
+				Target: events.PushPayloadCommitTarget{
+					Branch: "master",
+				},
+			},
+		},
+	}
+	assert.Equal(expected, withoutCommitDetails(payload))
+
+	// A commit at the head of a branch targets the branch.
+	payload, err = repo.ParseCommitRange(events.PushEvent, commitIds[0].String(), commitIds[2].String(), 0)
+	assert.Nil(err)
+	assert.Equal(expected.Commits[1:], withoutCommitDetails(payload).(events.PushPayload).Commits)
+
+	// Other commits do not target any branch.
+	payload, err = repo.ParseCommitRange(events.PushEvent, oldHead.String(), commitIds[0].String(), 0)
+	assert.Nil(err)
+	if pushPayload, ok := payload.(events.PushPayload); assert.True(ok) && assert.Equal(1, len(pushPayload.Commits)) {
+		assert.Equal(commitIds[0].String(), pushPayload.Commits[0].Id)
+		assert.Equal("", pushPayload.Commits[0].Target.Branch)
+	}
+
+	// Ranges with more commits than the limit are refused.
+	payload, err = repo.ParseCommitRange(events.PushEvent, oldHead.String(), "master", 3)
+	assert.Nil(err)
+	assert.Equal(3, len(payload.(events.PushPayload).Commits))
+
+	_, err = repo.ParseCommitRange(events.PushEvent, oldHead.String(), "master", 2)
+	if tooMany, ok := err.(*repositories.TooManyCommitsErr); assert.True(ok) {
+		assert.Equal(2, tooMany.Limit)
+	}
+
+	_, err = repo.ParseCommitRange(events.PushEvent, "does-not-exist", "master", 0)
+	assert.NotNil(err)
+
+	_, err = repo.ParseCommitRange(events.PrePushEvent, oldHead.String(), "master", 0)
+	assert.NotNil(err)
+}
+
+func TestGitParseBranchChanges(t *testing.T) {
+	assert := assert.New(t)
+
+	repo, rawRepo := helpers.CreateGitRepo(t, "git-repo")
+	defer helpers.CleanupRepository(t, repo.Path)
+
+	oldHead := helpers.SeedGitRepo(t, repo, rawRepo)
+	oldHeads := map[string]string{"master": oldHead.String()}
+
+	worktree, err := rawRepo.Worktree()
+	assert.Nil(err)
+	commitId, err := worktree.Commit("Commit on master", &git.CommitOptions{
+		Author: &object.Signature{
+			Name:  "Author",
+			Email: "author@example.com",
+			When:  time.Now(),
+		},
+	})
+	assert.Nil(err)
+
+	branch := helpers.CreateGitBranch(t, repo, rawRepo)
+
+	newHeads := map[string]string{
+		"master":      commitId.String(),
+		"test-branch": branch.Hash().String(),
+	}
+
+	payload, err := repo.ParseBranchChanges(oldHeads, newHeads)
+	assert.Nil(err)
+	assert.Equal(
+		events.PushPayload{
+			Repository: repo.Name,
+			Commits: []events.PushPayloadCommit{
+				{
+					Id:      commitId.String(),
+					Message: "Commit on master",
+					Target: events.PushPayloadCommitTarget{
+						Branch: "master",
+					},
+				},
+				{
+					Id:      branch.Hash().String(),
+					Message: "Add branch",
+					Target: events.PushPayloadCommitTarget{
+						Branch: "test-branch",
+					},
+				},
+			},
+		},
+		withoutCommitDetails(payload))
+
+	// Nothing changed.
+	payload, err = repo.ParseBranchChanges(newHeads, newHeads)
+	assert.Nil(err)
+	assert.Equal(events.PushPayload{Repository: repo.Name, Commits: []events.PushPayloadCommit{}}, payload)
+
+	// Deleted branches are ignored.
+	payload, err = repo.ParseBranchChanges(newHeads, oldHeads)
+	assert.Nil(err)
+	assert.Equal(0, len(payload.(events.PushPayload).Commits))
 }
@@ -1,12 +1,18 @@
 package repositories
 
 import (
-	"errors"
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	hg "bitbucket.org/gohg/gohg"
 	"github.com/go-ini/ini"
@@ -15,13 +21,44 @@ import (
 	"github.com/reviewboard/rb-gateway/repositories/events"
 )
 
-const (
-	hgBin = "hg"
-)
-
 var (
-	hgEvents = map[string]string{
-		events.PushEvent: "changegroup",
+	// Mercurial hooks for each event.
+	//
+	// The `txnclose-bookmark` hook is used in addition to `changegroup` for
+	// push events so that bookmark moves that do not introduce new changesets
+	// still trigger webhooks. It runs once per bookmark after the transaction
+	// that moved it, and is ignored when that transaction also added
+	// changesets, since the `changegroup` payload already includes their
+	// bookmarks.
+	hgEvents = map[string][]string{
+		events.PushEvent: {"changegroup", "txnclose-bookmark"},
+	}
+
+	// Mercurial hooks that earlier versions of rb-gateway installed, which are
+	// removed when hooks are installed.
+	//
+	// The `pushkey` hook delivered a second payload for bookmarks moved by
+	// pushes that also added changesets.
+	hgObsoleteHooks = []string{"pushkey"}
+
+	// Mercurial hooks for gating events.
+	//
+	// These are only installed if HgConfig.PrePushHooks is set, since they
+	// delay every push until webhooks have responded.
+	hgGatingEvents = map[string][]string{
+		events.PrePushEvent: {"pretxnchangegroup"},
+	}
+
+	// The `hg log` template fields for commit metadata.
+	//
+	// See newHgCommitInfo().
+	hgCommitInfoFields = []string{
+		"{node}",
+		"{date|rfc3339date}",
+		"{desc}",
+		"{p1node}",
+		"{author|person}",
+		"{author|email}",
 	}
 )
 
@@ -47,12 +84,25 @@ func (repo *HgRepository) GetScm() string {
 	return "hg"
 }
 
+// Return the optional features supported by Mercurial repositories.
+func (repo *HgRepository) GetFeatures() Features {
+	return Features{
+		Archive:    true,
+		Bookmarks:  true,
+		LargeFiles: repo.LargeFiles,
+	}
+}
+
 // Create a new client for the repository.
 //
 // The caller is responsible for calling Client.Disconnect() when finished.
 func (repo *HgRepository) Client() (*hg.HgClient, error) {
+	cfg := currentHgConfig()
 	client := hg.NewHgClient()
-	err := client.Connect(hgBin, repo.Path, nil, false)
+
+	err := cfg.withEnv(func() error {
+		return client.Connect(cfg.Path, repo.Path, nil, false)
+	})
 
 	if err != nil {
 		return nil, err
@@ -71,8 +121,21 @@ func (repo *HgRepository) GetFile(filepath string) ([]byte, error) {
 		return nil, err
 	}
 	defer client.Disconnect()
-	hgcmd := []string{"cat", filepath}
-	return client.ExecCmd(hgcmd)
+
+	return repo.cat(client, nil, filepath)
+}
+
+// Return a reader for the contents of the requested file.
+//
+// The Mercurial command server returns command output in full, so the file is
+// read into memory before being returned.
+func (repo *HgRepository) OpenFile(filepath string) (io.ReadCloser, int64, error) {
+	contents, err := repo.GetFile(filepath)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return ioutil.NopCloser(bytes.NewReader(contents)), int64(len(contents)), nil
 }
 
 // Return the contents of the requested file at the given changeset.
@@ -86,8 +149,121 @@ func (repo *HgRepository) GetFileByCommit(changeset, filepath string) ([]byte, e
 	}
 	defer client.Disconnect()
 
-	hgcmd := []string{"cat", "-r", changeset, filepath}
-	return client.ExecCmd(hgcmd)
+	return repo.cat(client, []string{"-r", changeset}, filepath)
+}
+
+// Return the mode of the requested file at the given changeset.
+//
+// Mercurial only records whether files are executable or symlinks, so every
+// other file is a regular file. On failure, the error will be returned.
+func (repo *HgRepository) GetFileModeByCommit(changeset, filepath string) (FileMode, error) {
+	flags, err := repo.fileField(changeset, filepath, "{flags|json}")
+	if err != nil {
+		return 0, err
+	}
+
+	switch flags.String(0) {
+	case "l":
+		return SymlinkFileMode, nil
+
+	case "x":
+		return ExecutableFileMode, nil
+
+	default:
+		return RegularFileMode, nil
+	}
+}
+
+// Return the size of the requested file at the given changeset, without
+// reading its contents.
+//
+// If large files are enabled for the repository and the file is a largefile,
+// this is the size of its standin. On failure, the error will be returned.
+func (repo *HgRepository) GetFileSizeByCommit(changeset, filepath string) (int64, error) {
+	record, err := repo.fileField(changeset, filepath, "{size|json}")
+	if err != nil {
+		return 0, err
+	}
+
+	var size int64
+	if err = json.Unmarshal(record[0], &size); err != nil {
+		return 0, err
+	}
+
+	return size, nil
+}
+
+// Return a field of a file at a changeset from `hg files`.
+//
+// The field is a template (e.g., `{flags|json}`), which is the first entry of
+// the returned record. If large files are enabled for the repository and the
+// file does not exist, its largefiles standin is used instead.
+func (repo *HgRepository) fileField(changeset, filepath, field string) (HgLogRecord, error) {
+	client, err := repo.Client()
+	if err != nil {
+		return nil, err
+	}
+	defer client.Disconnect()
+
+	paths := []string{filepath}
+	if repo.LargeFiles {
+		paths = append(paths, hgStandinDir+filepath)
+	}
+
+	for _, path := range paths {
+		// Some fields (e.g., the size) are only available to templates in
+		// verbose mode.
+		output, err := hgExec(client, []string{
+			"files",
+			"--verbose",
+			"--rev", changeset,
+			"--template", "[" + field + ",{path|json}]\\n",
+			"path:" + path,
+		})
+
+		if isNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		decoder := json.NewDecoder(bytes.NewReader(output))
+		for decoder.More() {
+			var record HgLogRecord
+			if err = decoder.Decode(&record); err != nil {
+				return nil, err
+			} else if len(record) != 2 {
+				return nil, fmt.Errorf("Expected 2 fields from hg files, got %d.", len(record))
+			}
+
+			// Directories match every file inside them.
+			if record.String(1) == path {
+				return record, nil
+			}
+		}
+	}
+
+	return nil, fmt.Errorf(`File "%s" not found at changeset "%s".`, filepath, changeset)
+}
+
+// Resolve a revision (e.g., a branch, bookmark, or tag name) to a changeset.
+//
+// On success, it returns the full node ID of the changeset. On failure, the
+// error will be returned.
+func (repo *HgRepository) ResolveRef(ref string) (string, error) {
+	records, err := repo.Log(nil,
+		[]string{"{node}"},
+		[]string{presentRevset(ref)},
+		"--limit", "1",
+	)
+
+	if err != nil {
+		return "", err
+	} else if len(records) == 0 {
+		return "", fmt.Errorf(`Unknown revision "%s".`, ref)
+	}
+
+	return records[0].String(0), nil
 }
 
 // Return whther or not a file exists.
@@ -101,7 +277,7 @@ func (repo *HgRepository) FileExists(filepath string) (bool, error) {
 	}
 	defer client.Disconnect()
 
-	if _, err = client.ExecCmd([]string{"cat", filepath}); err != nil {
+	if _, err = repo.cat(client, nil, filepath); err != nil {
 		if isNotExist(err) {
 			return false, nil
 		} else {
@@ -123,12 +299,7 @@ func (repo *HgRepository) FileExistsByCommit(changeset, filepath string) (bool,
 	}
 	defer client.Disconnect()
 
-	_, err = client.ExecCmd([]string{
-		"cat",
-		"-r", changeset,
-		"--template", "",
-		filepath,
-	})
+	_, err = repo.cat(client, []string{"-r", changeset, "--template", ""}, filepath)
 	if err != nil {
 		if isNotExist(err) {
 			return false, nil
@@ -142,52 +313,108 @@ func (repo *HgRepository) FileExistsByCommit(changeset, filepath string) (bool,
 
 // Return the branches of the repository.
 //
-// This returns both Mercurial branches and bookmarks.
+// This returns both Mercurial branches and bookmarks. Sorting by date requires
+// a single additional `hg log` call.
 //
 // On failure, the error will also be returned.
-func (repo *HgRepository) GetBranches() ([]Branch, error) {
+func (repo *HgRepository) GetBranches(order BranchSort) ([]Branch, error) {
 	client, err := repo.Client()
 	if err != nil {
 		return nil, err
 	}
 	defer client.Disconnect()
 
-	output, err := client.ExecCmd([]string{
-		"branches",
-		"--template", "{branch}\\x1f{node}\\x1e",
-	})
+	branchRecords, err := hgRefs(client, "branches")
 	if err != nil {
 		return nil, err
 	}
 
-	branchRecords := strings.Split(strings.TrimRight(string(output), "\x1e"), "\x1e")
-
-	output, err = client.ExecCmd([]string{
-		"bookmarks",
-		"--template", "{bookmark}\\x1f{node}\\x1e",
-	})
+	bookmarkRecords, err := hgRefs(client, "bookmarks")
 	if err != nil {
 		return nil, err
 	}
 
-	bookmarkRecords := strings.Split(strings.TrimRight(string(output), "\x1e"), "\x1e")
 	branches := make([]Branch, 0, len(bookmarkRecords)+len(branchRecords))
 
-	for _, records := range [][]string{branchRecords, bookmarkRecords} {
+	for _, records := range [][]hgRefRecord{branchRecords, bookmarkRecords} {
+		for _, record := range records {
+			branches = append(branches, Branch{
+				Name: record.Name(),
+				Id:   record.Node,
+			})
+		}
+	}
+
+	var dates map[string]time.Time
+	if order == BranchSortDate && len(branches) != 0 {
+		revisions := make([]string, 0, len(branches))
+		for _, branch := range branches {
+			revisions = append(revisions, branch.Id)
+		}
+
+		records, err := repo.Log(client, []string{"{node}", "{date|rfc3339date}"}, revisions)
+		if err != nil {
+			return nil, err
+		}
+
+		dates = make(map[string]time.Time, len(records))
+		for _, record := range records {
+			date, err := time.Parse(time.RFC3339, record.String(1))
+			if err != nil {
+				return nil, err
+			}
+
+			dates[record.String(0)] = date
+		}
+	}
+
+	sortBranches(branches, order, dates)
+
+	return branches, nil
+}
+
+// Return the refs of the repository.
+//
+// This returns Mercurial branches, bookmarks, and tags. The special `tip` tag
+// is not included.
+//
+// On failure, the error will also be returned.
+func (repo *HgRepository) GetRefs() ([]Ref, error) {
+	client, err := repo.Client()
+	if err != nil {
+		return nil, err
+	}
+	defer client.Disconnect()
+
+	refs := []Ref{}
+
+	for _, refInfo := range []struct {
+		command string
+		refType string
+	}{
+		{"branches", RefTypeBranch},
+		{"bookmarks", RefTypeBookmark},
+		{"tags", RefTypeTag},
+	} {
+		records, err := hgRefs(client, refInfo.command)
+		if err != nil {
+			return nil, err
+		}
+
 		for _, record := range records {
-			if (len(record) == 0) {
+			if refInfo.refType == RefTypeTag && record.Tag == "tip" {
 				continue
 			}
 
-			fields := strings.Split(record, "\x1f")
-			branches = append(branches, Branch{
-				Name: fields[0],
-				Id:   fields[1],
+			refs = append(refs, Ref{
+				Name: record.Name(),
+				Type: refInfo.refType,
+				Id:   record.Node,
 			})
 		}
 	}
 
-	return branches, nil
+	return refs, nil
 }
 
 // Return commits from a given starting point.
@@ -195,23 +422,54 @@ func (repo *HgRepository) GetBranches() ([]Branch, error) {
 // If `start` is non-empty, that will be used as the starting point. Otherwise
 // `branch` will be used.
 //
+// Revision numbers are already in topological order, which is the default.
+//
 // On failure, the error will also be returned.
-func (repo *HgRepository) GetCommits(branch string, start string) ([]CommitInfo, error) {
+func (repo *HgRepository) GetCommits(branch string, start string, order CommitOrder, filter CommitFilter) ([]CommitInfo, error) {
 	if start == "" {
 		start = branch
 	}
 
+	revisions := []string{start}
+	args := []string{"--follow"}
+
+	if order == CommitOrderDate || !filter.IsEmpty() {
+		revset := fmt.Sprintf("ancestors(%s)", hgRevsetString(start))
+
+		if !filter.IsEmpty() {
+			revset = fmt.Sprintf("sort(limit(reverse(%s), %d), rev)", revset, MaxFilteredCommits)
+		}
+
+		// The user() revset matches substrings case-insensitively, unless the
+		// string has a prefix such as `re:`, so the author is always given as a
+		// literal. date() accepts a Unix timestamp and time zone offset.
+		if filter.Author != "" {
+			revset += fmt.Sprintf(" and user(%s)", hgRevsetString("literal:"+filter.Author))
+		}
+
+		if !filter.Since.IsZero() {
+			revset += fmt.Sprintf(` and date(">%d 0")`, filter.Since.Unix())
+		}
+
+		if !filter.Until.IsZero() {
+			revset += fmt.Sprintf(` and date("<%d 0")`, filter.Until.Unix())
+		}
+
+		if order == CommitOrderDate {
+			revisions = []string{fmt.Sprintf("sort(%s, -date)", revset)}
+		} else {
+			revisions = []string{fmt.Sprintf("reverse(%s)", revset)}
+		}
+
+		args = nil
+	}
+
+	args = append(args, "--limit", fmt.Sprintf("%d", commitsPageSize))
+
 	records, err := repo.Log(nil,
-		[]string{
-			"{author}",
-			"{node}",
-			"{date|rfc3339date}",
-			"{desc}",
-			"{p1node}",
-		},
-		[]string{start},
-		"--follow",
-		"--limit", fmt.Sprintf("%d", commitsPageSize),
+		hgCommitInfoFields,
+		revisions,
+		args...,
 	)
 
 	if err != nil {
@@ -220,18 +478,47 @@ func (repo *HgRepository) GetCommits(branch string, start string) ([]CommitInfo,
 
 	commits := make([]CommitInfo, 0, len(records))
 	for _, record := range records {
-		commits = append(commits, CommitInfo{
-			Author:   record[0],
-			Id:       record[1],
-			Date:     record[2],
-			Message:  record[3],
-			ParentId: record[4],
-		})
+		commits = append(commits, newHgCommitInfo(record))
 	}
 
 	return commits, nil
 }
 
+// Return the metadata for a commit from an `hg log` record of
+// hgCommitInfoFields.
+//
+// The author's name and email address are split from the user string (e.g.,
+// `Name <email>`), as they are for Git. Mercurial does not record committers
+// separately, so the author is also reported as the committer.
+func newHgCommitInfo(record HgLogRecord) CommitInfo {
+	date := hgCommitDate(record.String(1))
+
+	return CommitInfo{
+		Author:         record.String(4),
+		AuthorEmail:    record.String(5),
+		Committer:      record.String(4),
+		CommitterEmail: record.String(5),
+		CommitterDate:  date,
+		Id:             record.String(0),
+		Date:           date,
+		Message:        record.String(2),
+		ParentId:       record.String(3),
+	}
+}
+
+// Convert a date from the `rfc3339date` template filter to commitDateFormat.
+//
+// The date's time zone offset is kept. Dates that cannot be parsed are
+// returned unchanged.
+func hgCommitDate(value string) string {
+	date, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return value
+	}
+
+	return date.Format(commitDateFormat)
+}
+
 // Return a commit and its diff.
 //
 // On failure, the error will also be returned.
@@ -243,43 +530,363 @@ func (repo *HgRepository) GetCommit(commitId string) (*Commit, error) {
 	defer client.Disconnect()
 
 	records, err := repo.Log(client,
-		[]string{
-			"{author}",
-			"{node}",
-			"{date|rfc3339date}",
-			"{desc}",
-			"{p1node}",
-		},
-		[]string{commitId},
+		hgCommitInfoFields,
+		[]string{presentRevset(commitId)},
 		"--follow",
 		"--limit", fmt.Sprintf("%d", commitsPageSize),
 	)
 
 	if err != nil {
 		return nil, err
+	} else if len(records) == 0 {
+		return nil, nil
 	}
 
-	diff, err := client.ExecCmd([]string{
+	diff, err := hgExec(client, []string{
 		"diff",
 		"--git",
 		"--rev", fmt.Sprintf("%s^:%s", commitId, commitId),
 	})
+	if err != nil {
+		return nil, err
+	}
 
 	record := records[0]
 	commit := Commit{
-		CommitInfo: CommitInfo{
-			Author:   record[0],
-			Id:       record[1],
-			Date:     record[2],
-			Message:  record[3],
-			ParentId: record[4],
-		},
-		Diff: string(diff),
+		CommitInfo: newHgCommitInfo(record),
+		Diff:       string(diff),
 	}
 
 	return &commit, nil
 }
 
+// Return the changesets that are ancestors of `until` but not of `since`.
+//
+// The changesets are returned newest first. On failure, the error will also
+// be returned.
+func (repo *HgRepository) GetCommitRange(since, until string) ([]CommitInfo, error) {
+	records, err := repo.Log(nil,
+		hgCommitInfoFields,
+		[]string{
+			fmt.Sprintf("reverse(only(%s, %s))", hgRevsetString(until), hgRevsetString(since)),
+		},
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	commits := make([]CommitInfo, 0, len(records))
+	for _, record := range records {
+		commits = append(commits, newHgCommitInfo(record))
+	}
+
+	return commits, nil
+}
+
+// Return the best common ancestor of two changesets.
+//
+// This is the changeset `hg debugancestor` reports. If they have no common
+// ancestor, an empty string is returned. On failure, the error will also be
+// returned.
+func (repo *HgRepository) GetMergeBase(a, b string) (string, error) {
+	for _, rev := range []string{a, b} {
+		if _, err := repo.ResolveRef(rev); err != nil {
+			return "", err
+		}
+	}
+
+	records, err := repo.Log(nil,
+		[]string{"{node}"},
+		[]string{fmt.Sprintf("ancestor(%s, %s)", hgRevsetString(a), hgRevsetString(b))},
+	)
+
+	if err != nil {
+		return "", err
+	} else if len(records) == 0 {
+		return "", nil
+	}
+
+	return records[0].String(0), nil
+}
+
+// Write an archive of the files at a changeset.
+//
+// On failure, the error will also be returned.
+func (repo *HgRepository) WriteArchive(w io.Writer, commitId, format, prefix string) error {
+	var archiveType string
+
+	switch format {
+	case ArchiveFormatTarGz:
+		archiveType = "tgz"
+
+	case ArchiveFormatZip:
+		archiveType = "zip"
+
+	default:
+		return fmt.Errorf(`Unsupported archive format "%s".`, format)
+	}
+
+	// An output path of "-" writes the archive to stdout, which is streamed
+	// to the writer rather than being buffered by the command server.
+	return hgExecStream(repo.Path, w, []string{
+		"archive",
+		"--rev", commitId,
+		"--type", archiveType,
+		"--prefix", prefix,
+		"-",
+	})
+}
+
+// Return the size of every file at a changeset, keyed by path.
+//
+// On failure, the error will be returned.
+func (repo *HgRepository) GetFileSizes(changeset string) (map[string]int64, error) {
+	client, err := repo.Client()
+	if err != nil {
+		return nil, err
+	}
+	defer client.Disconnect()
+
+	// The size is only available to templates in verbose mode.
+	output, err := hgExec(client, []string{
+		"files",
+		"--verbose",
+		"--rev", changeset,
+		"--template", "[{size|json},{path|json}]\\n",
+	})
+
+	sizes := make(map[string]int64)
+	if isNotExist(err) {
+		// There are no files at the changeset.
+		return sizes, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(output))
+	for decoder.More() {
+		var record HgLogRecord
+		if err = decoder.Decode(&record); err != nil {
+			return nil, err
+		} else if len(record) != 2 {
+			return nil, fmt.Errorf("Expected 2 fields from hg files, got %d.", len(record))
+		}
+
+		var size int64
+		if err = json.Unmarshal(record[0], &size); err != nil {
+			return nil, err
+		}
+
+		sizes[record.String(1)] = size
+	}
+
+	return sizes, nil
+}
+
+// CheckPatch is a Repository implementation that returns whether or not a
+// patch applies cleanly at a commit.
+//
+// `hg import` can only apply a patch by committing it, so the files the patch
+// changes are written to a temporary directory and checked with
+// `git apply --check` instead.
+func (repo *HgRepository) CheckPatch(commitId string, diff []byte) (*PatchCheck, error) {
+	return checkPatchInDirectory(repo, commitId, diff)
+}
+
+// Return the paths of the files changed by a changeset, relative to its first
+// parent.
+//
+// The paths are sorted. On failure, the error will be returned.
+func (repo *HgRepository) GetChangedFiles(changeset string) ([]string, error) {
+	records, err := repo.Log(
+		nil,
+		[]string{
+			"{file_adds}",
+			"{file_mods}",
+			"{file_dels}",
+		},
+		[]string{changeset},
+		"--limit", "1",
+	)
+	if err != nil {
+		return nil, err
+	} else if len(records) == 0 {
+		return nil, fmt.Errorf(`Unknown changeset "%s".`, changeset)
+	}
+
+	paths := make([]string, 0)
+	for i := 0; i < 3; i++ {
+		paths = append(paths, records[0].Strings(i)...)
+	}
+	sort.Strings(paths)
+
+	return paths, nil
+}
+
+// Return the changesets on a branch that changed a path.
+//
+// If the path is a file on the branch, its history is followed across copies
+// and renames, as with `hg log --follow`. The changesets are returned newest
+// first. On failure, the error will also be returned.
+func (repo *HgRepository) GetFileLog(branch, path string) ([]FileLogEntry, error) {
+	path = strings.Trim(path, "/")
+
+	isFile, err := repo.FileExistsByCommit(branch, path)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := make([]string, 0, len(hgCommitInfoFields)+3)
+	fields = append(fields, hgCommitInfoFields...)
+	fields = append(fields, "{file_adds}", "{file_dels}", "{file_copies}")
+
+	var records []HgLogRecord
+	if isFile {
+		// follow() fails for files that do not exist in the starting
+		// changeset, so it can only be used for files.
+		records, err = repo.Log(nil,
+			fields,
+			[]string{fmt.Sprintf("reverse(follow(%s, %s))", hgRevsetString("path:"+path), hgRevsetString(branch))},
+			"--limit", fmt.Sprintf("%d", commitsPageSize),
+		)
+	} else {
+		records, err = repo.Log(nil,
+			fields,
+			[]string{fmt.Sprintf("reverse(ancestors(%s))", hgRevsetString(branch))},
+			"--limit", fmt.Sprintf("%d", commitsPageSize),
+			"--",
+			"path:"+path,
+		)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	n := len(hgCommitInfoFields)
+	entries := make([]FileLogEntry, 0, len(records))
+
+	for _, record := range records {
+		entry := FileLogEntry{
+			CommitInfo: newHgCommitInfo(record),
+			Path:       path,
+			Status:     PatchModified,
+		}
+
+		added := record.Strings(n)
+		removed := record.Strings(n + 1)
+
+		if source, ok := record.StringMap(n + 2)[path]; ok {
+			entry.OldPath = source
+			entry.Status = PatchCopied
+
+			if containsString(removed, source) {
+				entry.Status = PatchRenamed
+			}
+
+			// Older changesets changed the file under its previous name.
+			path = source
+		} else if containsString(added, path) {
+			entry.Status = PatchAdded
+		} else if containsString(removed, path) {
+			entry.Status = PatchDeleted
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// Return the changesets whose descriptions (and optionally authors or changed
+// files) contain the query.
+//
+// If `branch` is empty, every changeset is searched. The changesets are
+// returned newest first. On failure, the error will also be returned.
+func (repo *HgRepository) SearchCommits(query, branch string, authors, paths bool) ([]CommitInfo, error) {
+	// The desc() and user() revsets match substrings case-insensitively.
+	predicate := fmt.Sprintf("desc(%s)", hgRevsetString(query))
+	if authors {
+		predicate = fmt.Sprintf("%s or user(%s)", predicate, hgRevsetString(query))
+	}
+
+	// File patterns are matched from the start of the path, so the regular
+	// expression must allow any prefix.
+	if paths {
+		pattern := "re:(?i).*" + regexp.QuoteMeta(query)
+		predicate = fmt.Sprintf("%s or file(%s)", predicate, hgRevsetString(pattern))
+	}
+
+	predicate = fmt.Sprintf("(%s)", predicate)
+
+	// Mercurial filters the changesets lazily, so with --limit it stops once
+	// a page has been found instead of walking the full history.
+	revset := fmt.Sprintf("reverse(%s)", predicate)
+	if branch != "" {
+		revset = fmt.Sprintf("reverse(ancestors(%s) and %s)", hgRevsetString(branch), predicate)
+	}
+
+	records, err := repo.Log(nil,
+		hgCommitInfoFields,
+		[]string{revset},
+		"--limit", fmt.Sprintf("%d", commitsPageSize),
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	commits := make([]CommitInfo, 0, len(records))
+	for _, record := range records {
+		commits = append(commits, newHgCommitInfo(record))
+	}
+
+	return commits, nil
+}
+
+// Return the notes attached to a changeset.
+//
+// Mercurial does not support notes, so this always returns UnsupportedErr.
+func (repo *HgRepository) GetNotes(commitId string) ([]Note, error) {
+	return nil, UnsupportedErr
+}
+
+// Return a value quoted as a string in a revset.
+//
+// Revset strings are unescaped like Python byte strings, so quotes and
+// backslashes are escaped, as are control characters. Other bytes, including
+// those of UTF-8 sequences, are kept as they are.
+func hgRevsetString(value string) string {
+	var quoted strings.Builder
+	quoted.WriteByte('\'')
+
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; {
+		case c == '\\' || c == '\'':
+			quoted.WriteByte('\\')
+			quoted.WriteByte(c)
+
+		case c < 0x20 || c == 0x7f:
+			fmt.Fprintf(&quoted, "\\x%02x", c)
+
+		default:
+			quoted.WriteByte(c)
+		}
+	}
+
+	quoted.WriteByte('\'')
+	return quoted.String()
+}
+
+// Return a revset matching the given revision, or nothing if it is unknown.
+//
+// This allows callers to detect unknown revisions from an empty result instead
+// of from the (possibly localized) error output of an aborted command.
+func presentRevset(rev string) string {
+	return fmt.Sprintf("present(%s)", hgRevsetString(rev))
+}
+
 // A convencience method for calling `hg log` and extracting the results.
 //
 // `client` may be nil, in which case a client will be allocated for the call
@@ -288,12 +895,14 @@ func (repo *HgRepository) GetCommit(commitId string) (*Commit, error) {
 //
 // `fields` is a list of template parameters. They will be used to generate the
 // `--template` argument to `hg log`. [Details on templating in Mercurial][1].
+// Each field is passed through the `json` filter, so values containing
+// arbitrary bytes are parsed correctly.
 //
 // The returned list is a list of the values corresponding the to the template
 // parameters in `fields` for each revision in `revisions`.
 //
 // [1]: https://www.mercurial-scm.org/repo/hg/help/templates
-func (repo *HgRepository) Log(client *hg.HgClient, fields, revisions []string, args ...string) ([][]string, error) {
+func (repo *HgRepository) Log(client *hg.HgClient, fields, revisions []string, args ...string) ([]HgLogRecord, error) {
 	nFields := len(fields)
 	if nFields == 0 {
 		return nil, nil
@@ -308,7 +917,12 @@ func (repo *HgRepository) Log(client *hg.HgClient, fields, revisions []string, a
 		defer client.Disconnect()
 	}
 
-	format := fmt.Sprintf("%s\\x1e", strings.Join(fields, "\\x1f"))
+	jsonFields := make([]string, 0, nFields)
+	for _, field := range fields {
+		jsonFields = append(jsonFields, strings.TrimSuffix(field, "}")+"|json}")
+	}
+
+	format := fmt.Sprintf("[%s]\\n", strings.Join(jsonFields, ","))
 
 	command := make([]string, 0, 3+2*len(revisions)+len(args))
 	command = append(command, "log", "--template", format)
@@ -317,46 +931,168 @@ func (repo *HgRepository) Log(client *hg.HgClient, fields, revisions []string, a
 	}
 	command = append(command, args...)
 
-	output, err := client.ExecCmd(command)
+	output, err := hgExec(client, command)
 	if err != nil {
 		return nil, err
 	}
 
-	records := make([][]string, 0, len(revisions))
-	rawRecords := strings.Split(strings.TrimRight(string(output), "\x1e"), "\x1e")
-	for _, rawRecord := range rawRecords {
-		records = append(records, strings.Split(rawRecord, "\x1f"))
+	records := make([]HgLogRecord, 0, len(revisions))
+	decoder := json.NewDecoder(bytes.NewReader(output))
+	for decoder.More() {
+		var record HgLogRecord
+		if err = decoder.Decode(&record); err != nil {
+			return nil, err
+		}
+
+		if len(record) != nFields {
+			return nil, fmt.Errorf("Expected %d fields from hg log, got %d.", nFields, len(record))
+		}
+
+		records = append(records, record)
 	}
 
 	return records, nil
 }
 
 func (repo *HgRepository) ParseEventPayload(event string, input io.Reader) (events.Payload, error) {
+	return repo.ParseHookEvent(event, input, os.Getenv)
+}
+
+// ParseHookEvent is a Repository implementation that parses the payload for
+// an event from the `HG_*` environment variables of a hook, as looked up with
+// `getenv`.
+//
+// Mercurial does not give hooks any input, so `input` is ignored.
+func (repo *HgRepository) ParseHookEvent(event string, input io.Reader, getenv func(string) string) (events.Payload, error) {
 	if !events.IsValidEvent(event) {
 		return nil, events.InvalidEventErr
 	}
 
 	switch event {
-	case events.PushEvent: // changegroup hook
-		first_node := os.Getenv("HG_NODE")
-		last_node := os.Getenv("HG_NODE_LAST")
+	case events.PushEvent: // changegroup and txnclose-bookmark hooks
+		if getenv("HG_HOOKTYPE") == "txnclose-bookmark" {
+			// Mercurial passes the transaction's arguments to the hook, so
+			// HG_NODE_LAST is set if the transaction added changesets. The
+			// changegroup hook delivers those, along with their bookmarks.
+			if getenv("HG_NODE_LAST") != "" {
+				return nil, nil
+			}
 
-		if first_node == "" {
-			return nil, errors.New("No HG_NODE environment variable.")
+			return repo.parseBookmarkEvent(getenv("HG_BOOKMARK"), getenv("HG_NODE"))
 		}
 
-		if last_node == "" {
-			last_node = first_node
+		return repo.parsePushEventFromEnv(getenv)
+
+	case events.PrePushEvent: // pretxnchangegroup hook
+		// Mercurial sets HG_PENDING for the hook, which the command server
+		// inherits, so the changesets being pushed are visible.
+		payload, err := repo.parsePushEventFromEnv(getenv)
+		if err != nil {
+			return nil, err
 		}
 
-		return repo.parsePushEvent(first_node, last_node)
+		return events.PrePushPayload{PushPayload: payload.(events.PushPayload)}, nil
 
 	default:
 		return nil, fmt.Errorf(`Event "%s" is unuspported by Hg.`, event)
 	}
 }
 
-func (repo *HgRepository) parsePushEvent(first_node, last_node string) (events.Payload, error) {
+// Parse a push event from the environment of a changegroup-style hook.
+func (repo *HgRepository) parsePushEventFromEnv(getenv func(string) string) (events.Payload, error) {
+	first_node := getenv("HG_NODE")
+	last_node := getenv("HG_NODE_LAST")
+
+	if first_node == "" {
+		return nil, fmt.Errorf(
+			`No HG_NODE environment variable (HG_HOOKTYPE is "%s"). Push events must be triggered by changegroup or pretxnchangegroup hooks, which set it; pushkey hooks do not.`,
+			getenv("HG_HOOKTYPE"))
+	}
+
+	if last_node == "" {
+		last_node = first_node
+	}
+
+	return repo.parsePushEvent(fmt.Sprintf("%s:%s", first_node, last_node))
+}
+
+// ParseCommitRange is a Repository implementation that creates a payload for
+// the commits in a range of the HgRepository.
+//
+// The range contains the changesets that are ancestors of `end` but not of
+// `start`, as with `hg log -r "only(end, start)"`.
+func (repo *HgRepository) ParseCommitRange(event, start, end string, limit int) (events.Payload, error) {
+	if event != events.PushEvent {
+		return nil, fmt.Errorf(`Event "%s" cannot be created from a commit range.`, event)
+	}
+
+	// The revisions are resolved first, so that the revset refers to the
+	// changesets that were checked rather than re-interpreting the names.
+	nodes := make([]string, 0, 2)
+	for _, rev := range []string{start, end} {
+		node, err := repo.ResolveRef(rev)
+		if err != nil {
+			return nil, err
+		}
+
+		nodes = append(nodes, node)
+	}
+
+	revset := fmt.Sprintf("sort(only(%s, %s), rev)", nodes[1], nodes[0])
+
+	// Only the IDs are loaded to count the changesets, since loading the
+	// files they changed is what is expensive.
+	if limit > 0 {
+		records, err := repo.Log(nil, []string{"{node}"}, []string{fmt.Sprintf("limit(%s, %d)", revset, limit+1)})
+		if err != nil {
+			return nil, err
+		} else if len(records) > limit {
+			return nil, &TooManyCommitsErr{limit}
+		}
+	}
+
+	return repo.parsePushEvent(revset)
+}
+
+// ParseBranchChanges is a Repository implementation that creates a payload for
+// the changesets added to branches and bookmarks of the HgRepository between
+// two snapshots of their heads.
+//
+// The payload contains the changesets that are ancestors of the changed heads
+// but not of any of the old heads.
+func (repo *HgRepository) ParseBranchChanges(oldHeads, newHeads map[string]string) (events.Payload, error) {
+	changed := []string{}
+	for name, id := range newHeads {
+		if oldHeads[name] != id {
+			changed = append(changed, strconv.Quote(id))
+		}
+	}
+
+	if len(changed) == 0 {
+		return events.PushPayload{
+			Repository: repo.Name,
+			Commits:    []events.PushPayloadCommit{},
+		}, nil
+	}
+
+	old := make([]string, 0, len(oldHeads))
+	for _, id := range oldHeads {
+		old = append(old, strconv.Quote(id))
+	}
+
+	sort.Strings(changed)
+	sort.Strings(old)
+
+	revset := fmt.Sprintf("sort(::(%s), rev)", strings.Join(changed, "+"))
+	if len(old) != 0 {
+		revset = fmt.Sprintf("sort(only(%s, %s), rev)", strings.Join(changed, "+"), strings.Join(old, "+"))
+	}
+
+	return repo.parsePushEvent(revset)
+}
+
+// Create a PushPayload for the changesets in a revset.
+func (repo *HgRepository) parsePushEvent(revset string) (events.Payload, error) {
 	records, err := repo.Log(
 		nil,
 		[]string{
@@ -365,10 +1101,14 @@ func (repo *HgRepository) parsePushEvent(first_node, last_node string) (events.P
 			"{branch}",
 			"{bookmarks}",
 			"{tags}",
+			"{author|person}",
+			"{author|email}",
+			"{date|rfc3339date}",
+			"{file_adds}",
+			"{file_mods}",
+			"{file_dels}",
 		},
-		[]string{
-			fmt.Sprintf("%s:%s", first_node, last_node),
-		},
+		[]string{revset},
 	)
 
 	if err != nil {
@@ -381,23 +1121,22 @@ func (repo *HgRepository) parsePushEvent(first_node, last_node string) (events.P
 	}
 
 	for _, record := range records {
-		var bookmarks []string = nil
-		if record[3] != "" {
-			bookmarks = strings.Split(record[3], " ")
-		}
-
-		var tags []string = nil
-		if record[4] != "" {
-			tags = strings.Split(record[4], " ")
-		}
-
 		payload.Commits = append(payload.Commits, events.PushPayloadCommit{
-			Id:      record[0],
-			Message: record[1],
+			Id:             record.String(0),
+			Message:        record.String(1),
+			Author:         record.String(5),
+			AuthorEmail:    record.String(6),
+			Date:           hgCommitDate(record.String(7)),
+			Committer:      record.String(5),
+			CommitterEmail: record.String(6),
+			CommitterDate:  hgCommitDate(record.String(7)),
+			Added:          record.Strings(8),
+			Modified:       record.Strings(9),
+			Removed:        record.Strings(10),
 			Target: events.PushPayloadCommitTarget{
-				Branch:    record[2],
-				Bookmarks: bookmarks,
-				Tags:      tags,
+				Branch:    record.String(2),
+				Bookmarks: record.Strings(3),
+				Tags:      record.Strings(4),
 			},
 		})
 	}
@@ -405,6 +1144,65 @@ func (repo *HgRepository) parsePushEvent(first_node, last_node string) (events.P
 	return payload, nil
 }
 
+// Parse a bookmark move from a txnclose-bookmark hook into a PushPayload.
+//
+// The payload will contain a single commit: the one the bookmark now points
+// to. Bookmark deletions do not produce a payload.
+func (repo *HgRepository) parseBookmarkEvent(bookmark, node string) (events.Payload, error) {
+	if node == "" {
+		return nil, nil
+	}
+
+	records, err := repo.Log(
+		nil,
+		[]string{
+			"{node}",
+			"{desc}",
+			"{branch}",
+			"{tags}",
+			"{author|person}",
+			"{author|email}",
+			"{date|rfc3339date}",
+			"{file_adds}",
+			"{file_mods}",
+			"{file_dels}",
+		},
+		[]string{presentRevset(node)},
+	)
+
+	if err != nil {
+		return nil, err
+	} else if len(records) != 1 {
+		return nil, fmt.Errorf(`Unknown revision "%s".`, node)
+	}
+
+	record := records[0]
+
+	return events.PushPayload{
+		Repository: repo.Name,
+		Commits: []events.PushPayloadCommit{
+			{
+				Id:             record.String(0),
+				Message:        record.String(1),
+				Author:         record.String(4),
+				AuthorEmail:    record.String(5),
+				Date:           hgCommitDate(record.String(6)),
+				Committer:      record.String(4),
+				CommitterEmail: record.String(5),
+				CommitterDate:  hgCommitDate(record.String(6)),
+				Added:          record.Strings(7),
+				Modified:       record.Strings(8),
+				Removed:        record.Strings(9),
+				Target: events.PushPayloadCommitTarget{
+					Branch:    record.String(2),
+					Bookmarks: []string{bookmark},
+					Tags:      record.Strings(3),
+				},
+			},
+		},
+	}, nil
+}
+
 func (repo *HgRepository) InstallHooks(cfgPath string, force bool) error {
 	client, err := repo.Client()
 	if err != nil {
@@ -429,24 +1227,52 @@ func (repo *HgRepository) InstallHooks(cfgPath string, force bool) error {
 		return err
 	}
 
+	tokenPath, err := HookTokenPath(repo)
+	if err != nil {
+		return err
+	}
+
 	hookSection := hgrc.Section("hooks")
+	for _, hook := range hgObsoleteHooks {
+		hookSection.DeleteKey(fmt.Sprintf("%s.rbgateway", hook))
+	}
 
-	for event, hook := range hgEvents {
-		key := fmt.Sprintf("%s.rbgateway", hook)
-		if !hookSection.HasKey(key) || force {
-			hookSection.Key(key).SetValue(shellquote.Join(
-				exePath,
-				"--config",
-				cfgPath,
-				"trigger-webhooks",
-				repo.Name,
-				event,
-			))
+	installGatingHooks := currentHgConfig().PrePushHooks
+	hookCfg := currentHookConfig()
+
+	for _, eventHooks := range []struct {
+		hooks   map[string][]string
+		install bool
+	}{
+		{hgEvents, true},
+		{hgGatingEvents, installGatingHooks},
+	} {
+		for event, hookNames := range eventHooks.hooks {
+			for _, hook := range hookNames {
+				key := fmt.Sprintf("%s.rbgateway", hook)
+
+				if !eventHooks.install {
+					// Remove hooks that were installed when they were
+					// previously enabled.
+					if force {
+						hookSection.DeleteKey(key)
+					}
+				} else if !hookSection.HasKey(key) || force {
+					eventCfg := hookCfg
+
+					// Gating hooks must run trigger-webhooks, since the
+					// changesets being pushed are only visible to processes
+					// that inherit the hook's HG_PENDING.
+					if events.IsGatingEvent(event) {
+						eventCfg.Mode = HookModeCommand
+					}
+
+					hookSection.Key(key).SetValue(shellquote.Join(
+						hookCommand(eventCfg, exePath, cfgPath, tokenPath, repo.Name, event, false)...))
+				}
+			}
 		}
 	}
 
 	return hgrc.SaveTo(hgrcPath)
 }
-func isNotExist(err error) bool {
-	return strings.Index(err.Error(), ": no such file in rev ") != -1
-}
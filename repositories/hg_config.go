@@ -0,0 +1,177 @@
+package repositories
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	// The default Mercurial executable.
+	defaultHgBin = "hg"
+)
+
+var (
+	hgConfigLock sync.RWMutex
+	hgConfig     = HgConfig{Path: defaultHgBin}
+)
+
+// Settings for running Mercurial.
+type HgConfig struct {
+	// The path to the hg executable.
+	//
+	// If this is not an absolute path, it will be looked up in $PATH.
+	Path string `json:"path"`
+
+	// Extra environment variables for Mercurial (e.g., `HGRCPATH`).
+	//
+	// These are only set for the Mercurial processes that rb-gateway starts.
+	// See withEnv().
+	Env map[string]string `json:"env"`
+
+	// Extensions that will be enabled for every Mercurial command.
+	//
+	// Each entry is either the name of an extension (e.g., `"largefiles"`) or
+	// a name and a path, as they would appear in an hgrc file (e.g.,
+	// `"myext=/path/to/myext.py"`).
+	Extensions []string `json:"extensions"`
+
+	// Whether or not to install `pretxnchangegroup` hooks, which dispatch
+	// pre-push events that allow webhooks to reject pushes.
+	PrePushHooks bool `json:"prePushHooks"`
+
+	// Whether or not pushes are rejected when a pre-push webhook cannot be
+	// delivered. By default, only webhooks that reject the push do.
+	PrePushFailClosed bool `json:"prePushFailClosed"`
+}
+
+// A lock held while the environment of the process is changed to start a
+// Mercurial command server. See withEnv().
+var hgEnvLock sync.Mutex
+
+// Set the configuration used to run Mercurial.
+func SetHgConfig(cfg HgConfig) error {
+	if cfg.Path == "" {
+		cfg.Path = defaultHgBin
+	}
+
+	hgConfigLock.Lock()
+	defer hgConfigLock.Unlock()
+
+	hgConfig = cfg
+	return nil
+}
+
+// Return the current configuration used to run Mercurial.
+func currentHgConfig() HgConfig {
+	hgConfigLock.RLock()
+	defer hgConfigLock.RUnlock()
+
+	return hgConfig
+}
+
+// Validate that Mercurial can be run with the configuration.
+//
+// This checks that the hg executable exists and that every configured
+// extension can be loaded.
+func (cfg HgConfig) Validate() error {
+	path := cfg.Path
+	if path == "" {
+		path = defaultHgBin
+	}
+
+	path, err := exec.LookPath(path)
+	if err != nil {
+		return fmt.Errorf(`Could not find Mercurial executable "%s": %s`, cfg.Path, err.Error())
+	}
+
+	env := cfg.environ()
+
+	for _, extension := range cfg.Extensions {
+		name := hgExtensionName(extension)
+
+		// `hg help --extension` exits unsuccessfully if the extension is not
+		// loaded, e.g., because it could not be imported.
+		args := append(cfg.globalArgs(), "help", "--extension", name)
+		cmd := exec.Command(path, args...)
+		cmd.Env = env
+
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf(`Mercurial extension "%s" could not be loaded: %s`, name, err.Error())
+		}
+	}
+
+	return nil
+}
+
+// Return the environment for a Mercurial process: that of rb-gateway, with
+// the configured variables added.
+func (cfg HgConfig) environ() []string {
+	env := os.Environ()
+	keys := make([]string, 0, len(cfg.Env))
+	for key := range cfg.Env {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		env = append(env, fmt.Sprintf("%s=%s", key, cfg.Env[key]))
+	}
+
+	return env
+}
+
+// Call a function with the configured variables set in the environment of
+// the process.
+//
+// The Mercurial command server client starts the server with the environment
+// of the process and cannot be given another, so the variables are set only
+// while `f` runs, and the previous values are then restored. Only one
+// function runs at a time. Processes that rb-gateway starts itself are given
+// environ() instead.
+func (cfg HgConfig) withEnv(f func() error) error {
+	if len(cfg.Env) == 0 {
+		return f()
+	}
+
+	hgEnvLock.Lock()
+	defer hgEnvLock.Unlock()
+
+	for key, value := range cfg.Env {
+		previous, set := os.LookupEnv(key)
+		if err := os.Setenv(key, value); err != nil {
+			return err
+		}
+
+		if set {
+			defer os.Setenv(key, previous)
+		} else {
+			defer os.Unsetenv(key)
+		}
+	}
+
+	return f()
+}
+
+// Return the global options to pass to every Mercurial command.
+func (cfg HgConfig) globalArgs() []string {
+	args := make([]string, 0, 2*len(cfg.Extensions))
+
+	for _, extension := range cfg.Extensions {
+		if !strings.Contains(extension, "=") {
+			extension += "="
+		}
+
+		args = append(args, "--config", "extensions."+extension)
+	}
+
+	return args
+}
+
+// Return the name of an extension from its configuration entry.
+func hgExtensionName(extension string) string {
+	return strings.SplitN(extension, "=", 2)[0]
+}
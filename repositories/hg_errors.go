@@ -0,0 +1,141 @@
+package repositories
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+
+	hg "bitbucket.org/gohg/gohg"
+)
+
+const (
+	// The exit code Mercurial uses when a command had nothing to operate on,
+	// e.g., `hg cat` for a file that does not exist at a revision.
+	hgExitNoMatch = 1
+
+	// The exit code Mercurial uses when a command aborts.
+	hgExitAbort = 255
+)
+
+var (
+	hgReturnCodeRegexp = regexp.MustCompile(`returncode=(-?\d+)`)
+)
+
+// An error from a Mercurial command.
+//
+// The command server client only reports failures as formatted strings, so
+// the exit code and error output are recovered from that message. Callers
+// should classify errors by exit code rather than by matching the error
+// output, which may be localized.
+type HgError struct {
+	// The command that failed.
+	Command string
+
+	// The exit code of the command.
+	ExitCode int
+
+	// The error output of the command.
+	Output string
+
+	// The original error.
+	err error
+}
+
+// Return the error message.
+func (e *HgError) Error() string {
+	return e.err.Error()
+}
+
+// Return whether or not the command failed because it had nothing to operate
+// on (e.g., a file did not exist).
+func (e *HgError) IsNoMatch() bool {
+	return e.ExitCode == hgExitNoMatch
+}
+
+// Return whether or not the command aborted.
+func (e *HgError) IsAbort() bool {
+	return e.ExitCode == hgExitAbort
+}
+
+// Convert an error from the command server client into an HgError.
+//
+// Errors that did not come from a command exiting unsuccessfully (e.g., errors
+// communicating with the command server) are returned unchanged.
+func newHgError(command []string, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	match := hgReturnCodeRegexp.FindStringSubmatch(err.Error())
+	if match == nil {
+		return err
+	}
+
+	exitCode, convErr := strconv.Atoi(match[1])
+	if convErr != nil {
+		return err
+	}
+
+	var output string
+	if index := strings.Index(err.Error(), "hgerr:\n"); index != -1 {
+		output = strings.TrimSpace(err.Error()[index+len("hgerr:\n"):])
+	}
+
+	return &HgError{
+		Command:  strings.Join(command, " "),
+		ExitCode: exitCode,
+		Output:   output,
+		err:      err,
+	}
+}
+
+// Execute a Mercurial command, converting any failure into an HgError.
+//
+// The configured extensions are enabled for the command.
+func hgExec(client *hg.HgClient, command []string) ([]byte, error) {
+	output, err := client.ExecCmd(append(currentHgConfig().globalArgs(), command...))
+	return output, newHgError(command, err)
+}
+
+// Execute a Mercurial command in a repository, streaming its output to `w`.
+//
+// The command server client returns command output in full, so commands with
+// large output (e.g., `hg archive`) run the hg executable directly instead.
+// Failures are converted into an HgError.
+func hgExecStream(repoPath string, w io.Writer, command []string) error {
+	cfg := currentHgConfig()
+
+	args := append([]string{"--repository", repoPath}, cfg.globalArgs()...)
+	cmd := exec.Command(cfg.Path, append(args, command...)...)
+	cmd.Dir = repoPath
+	cmd.Env = append(cfg.environ(), "HGPLAIN=1")
+	cmd.Stdout = w
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		return err
+	}
+
+	output := strings.TrimSpace(stderr.String())
+
+	return &HgError{
+		Command:  strings.Join(command, " "),
+		ExitCode: exitErr.ExitCode(),
+		Output:   output,
+		err:      fmt.Errorf("hg %s: %s: %s", command[0], err.Error(), output),
+	}
+}
+
+// Return whether or not the error indicates that a file does not exist.
+func isNotExist(err error) bool {
+	hgErr, ok := err.(*HgError)
+	return ok && hgErr.IsNoMatch()
+}
@@ -0,0 +1,101 @@
+package repositories
+
+import (
+	"encoding/json"
+	"strings"
+
+	hg "bitbucket.org/gohg/gohg"
+)
+
+// A single revision returned by HgRepository.Log.
+//
+// Each element is the JSON-encoded value of the corresponding template
+// field.
+type HgLogRecord []json.RawMessage
+
+// Return the value of the field at the given index as a string.
+//
+// If the field is not a string (e.g., a list), the raw JSON is returned.
+func (record HgLogRecord) String(index int) string {
+	var value string
+	if err := json.Unmarshal(record[index], &value); err != nil {
+		return string(record[index])
+	}
+
+	return value
+}
+
+// Return the value of the field at the given index as a list of strings.
+//
+// List keywords such as `{bookmarks}` and `{tags}` are encoded as JSON lists
+// by Mercurial. Older versions of Mercurial encode them as a space-separated
+// string, which is also supported. An empty list is returned as nil.
+func (record HgLogRecord) Strings(index int) []string {
+	var values []string
+	if err := json.Unmarshal(record[index], &values); err != nil {
+		if value := record.String(index); value != "" {
+			values = strings.Split(value, " ")
+		}
+	}
+
+	if len(values) == 0 {
+		return nil
+	}
+
+	return values
+}
+
+// Return the value of the field at the given index as a map of strings.
+//
+// Dictionary keywords such as `{file_copies}`, which maps each copied file to
+// its source, are encoded as JSON objects by Mercurial. An empty map, or one
+// that cannot be parsed, is returned as nil.
+func (record HgLogRecord) StringMap(index int) map[string]string {
+	var values map[string]string
+	if err := json.Unmarshal(record[index], &values); err != nil || len(values) == 0 {
+		return nil
+	}
+
+	return values
+}
+
+// A branch, bookmark, or tag from `hg branches`, `hg bookmarks`, or `hg tags`.
+//
+// Only one of Branch, Bookmark, or Tag will be set, depending on the command.
+type hgRefRecord struct {
+	Branch   string `json:"branch"`
+	Bookmark string `json:"bookmark"`
+	Tag      string `json:"tag"`
+	Node     string `json:"node"`
+}
+
+// Return the name of the ref.
+func (record hgRefRecord) Name() string {
+	switch {
+	case record.Branch != "":
+		return record.Branch
+	case record.Bookmark != "":
+		return record.Bookmark
+	default:
+		return record.Tag
+	}
+}
+
+// Return the refs listed by a Mercurial command (e.g., `branches`).
+func hgRefs(client *hg.HgClient, command string) ([]hgRefRecord, error) {
+	output, err := hgExec(client, []string{command, "-T", "json"})
+	if err != nil {
+		return nil, err
+	}
+
+	records := []hgRefRecord{}
+	if len(output) == 0 {
+		return records, nil
+	}
+
+	if err = json.Unmarshal(output, &records); err != nil {
+		return nil, err
+	}
+
+	return records, nil
+}
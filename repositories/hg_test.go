@@ -1,15 +1,22 @@
 package repositories_test
 
 import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/go-ini/ini"
 	"github.com/stretchr/testify/assert"
 
 	"github.com/reviewboard/rb-gateway/helpers"
+	"github.com/reviewboard/rb-gateway/repositories"
 	"github.com/reviewboard/rb-gateway/repositories/events"
 )
 
@@ -59,6 +66,43 @@ func TestHgGetFileByCommit(t *testing.T) {
 	assert.Equal(fileContent, result[:], "Expected file contents to match.")
 }
 
+func TestHgGetFileSizeByCommit(t *testing.T) {
+	assert := assert.New(t)
+
+	repo, client := helpers.CreateHgRepo(t, "hg-repo")
+	defer helpers.CleanupHgRepo(t, client)
+
+	commitID := helpers.SeedHgRepo(t, repo, client)
+
+	size, err := repo.GetFileSizeByCommit(commitID, "README")
+	assert.Nil(err)
+	assert.Equal(int64(len(helpers.GetRepoFiles()["README"])), size)
+
+	_, err = repo.GetFileSizeByCommit(commitID, "does-not-exist")
+	assert.NotNil(err)
+}
+
+func TestHgResolveRef(t *testing.T) {
+	assert := assert.New(t)
+
+	repo, client := helpers.CreateHgRepo(t, "hg-repo")
+	defer helpers.CleanupHgRepo(t, client)
+
+	commitID := helpers.SeedHgRepo(t, repo, client)
+	bookmarkCommitID := helpers.SeedHgBookmark(t, repo, client)
+
+	resolved, err := repo.ResolveRef("test-bookmark")
+	assert.Nil(err)
+	assert.Equal(bookmarkCommitID, resolved)
+
+	resolved, err = repo.ResolveRef(commitID)
+	assert.Nil(err)
+	assert.Equal(commitID, resolved)
+
+	_, err = repo.ResolveRef("does-not-exist")
+	assert.NotNil(err)
+}
+
 func TestHgFileExists(t *testing.T) {
 	assert := assert.New(t)
 
@@ -103,7 +147,7 @@ func TestHgGetBranches(t *testing.T) {
 	helpers.SeedHgRepo(t, repo, client)
 	helpers.SeedHgBookmark(t, repo, client)
 
-	branches, err := repo.GetBranches()
+	branches, err := repo.GetBranches(repositories.BranchSortDefault)
 	assert.Nil(err)
 
 	assert.Equal(2, len(branches))
@@ -125,7 +169,7 @@ func TestHgGetBranchesNoBookmarks(t *testing.T) {
 
 	helpers.SeedHgRepo(t, repo, client)
 
-	branches, err := repo.GetBranches()
+	branches, err := repo.GetBranches(repositories.BranchSortDefault)
 	assert.Nil(err)
 
 	assert.Equal(1, len(branches))
@@ -147,14 +191,13 @@ func TestHgGetCommits(t *testing.T) {
 	commitID := helpers.SeedHgRepo(t, repo, client)
 	bookmarkCommitID := helpers.SeedHgBookmark(t, repo, client)
 
-	commits, err := repo.GetCommits("test-bookmark", "")
+	commits, err := repo.GetCommits("test-bookmark", "", repositories.CommitOrderDefault, repositories.CommitFilter{})
 	assert.Nil(err)
 
 	assert.Equal(2, len(commits))
 	assert.Equal(bookmarkCommitID, commits[0].Id)
 	assert.Equal(commitID, commits[1].Id)
 
-	// 0x1e is the ASCII record separator. 0x1f is the field separator.
 	revisions := make([]string, 0, len(commits))
 	for _, commit := range commits {
 		revisions = append(revisions, commit.Id)
@@ -162,9 +205,9 @@ func TestHgGetCommits(t *testing.T) {
 
 	records, err := repo.Log(client,
 		[]string{
-			"{author}",
+			"{author|person}",
 			"{node}",
-			"{date|rfc3339date}",
+			"{date|hgdate}",
 			"{desc}",
 			"{parents}",
 		},
@@ -175,10 +218,366 @@ func TestHgGetCommits(t *testing.T) {
 	for i, record := range records {
 		commit := commits[i]
 
-		assert.Equal(commit.Author, record[0])
-		assert.Equal(commit.Id, record[1])
-		assert.Equal(commit.Date, record[2])
+		// Dates are formatted as they are for Git.
+		var timestamp, offset int64
+		_, err = fmt.Sscanf(record.String(2), "%d %d", &timestamp, &offset)
+		assert.Nil(err)
+
+		date := time.Unix(timestamp, 0).In(time.FixedZone("", int(-offset)))
+
+		assert.Equal(commit.Author, record.String(0))
+		assert.Equal(commit.Id, record.String(1))
+		assert.Equal(date.Format("2006-01-02T15:04:05-0700"), commit.Date)
+		assert.Equal("Author", commit.Author)
+		assert.Equal("author@example.com", commit.AuthorEmail)
+		assert.Equal("Author", commit.Committer)
+		assert.Equal(commit.Date, commit.CommitterDate)
+	}
+}
+
+func TestHgGetCommitsFilter(t *testing.T) {
+	assert := assert.New(t)
+
+	repo, client := helpers.CreateHgRepo(t, "hg-repo")
+	defer helpers.CleanupHgRepo(t, client)
+
+	commitID := helpers.SeedHgRepo(t, repo, client)
+
+	helpers.CreateAndAddFilesHg(t, repo.Path, client, map[string][]byte{"other": []byte("other\n")})
+	otherCommitID := helpers.CommitHg(t, client, "Other commit", "Jane Doe <jane@example.com>")
+
+	for _, order := range []repositories.CommitOrder{repositories.CommitOrderDefault, repositories.CommitOrderDate} {
+		commits, err := repo.GetCommits(otherCommitID, "", order, repositories.CommitFilter{
+			Author: "JANE",
+		})
+		assert.Nil(err)
+		assert.Equal(1, len(commits))
+		assert.Equal(otherCommitID, commits[0].Id)
+
+		commits, err = repo.GetCommits(otherCommitID, "", order, repositories.CommitFilter{
+			Since: time.Now().Add(-time.Hour),
+			Until: time.Now().Add(time.Hour),
+		})
+		assert.Nil(err)
+		assert.Equal(2, len(commits))
+		assert.Equal(commitID, commits[1].Id)
+
+		commits, err = repo.GetCommits(otherCommitID, "", order, repositories.CommitFilter{
+			Until: time.Now().Add(-time.Hour),
+		})
+		assert.Nil(err)
+		assert.Equal(0, len(commits))
+	}
+}
+
+func TestHgGetCommitUnknown(t *testing.T) {
+	assert := assert.New(t)
+
+	repo, client := helpers.CreateHgRepo(t, "hg-repo")
+	defer helpers.CleanupHgRepo(t, client)
+
+	helpers.SeedHgRepo(t, repo, client)
+
+	commit, err := repo.GetCommit("does-not-exist")
+	assert.Nil(err)
+	assert.Nil(commit)
+}
+
+func TestHgFileExistsByCommitError(t *testing.T) {
+	assert := assert.New(t)
+
+	repo, client := helpers.CreateHgRepo(t, "hg-repo")
+	defer helpers.CleanupHgRepo(t, client)
+
+	helpers.SeedHgRepo(t, repo, client)
+
+	_, err := repo.FileExistsByCommit("does-not-exist", "README")
+	assert.NotNil(err)
+
+	hgErr, ok := err.(*repositories.HgError)
+	assert.True(ok)
+	assert.True(hgErr.IsAbort())
+	assert.False(hgErr.IsNoMatch())
+}
+
+func TestHgGetCommitRange(t *testing.T) {
+	assert := assert.New(t)
+
+	repo, client := helpers.CreateHgRepo(t, "hg-repo")
+	defer helpers.CleanupHgRepo(t, client)
+
+	commitID := helpers.SeedHgRepo(t, repo, client)
+	bookmarkCommitID := helpers.SeedHgBookmark(t, repo, client)
+
+	commits, err := repo.GetCommitRange(commitID, "test-bookmark")
+	assert.Nil(err)
+
+	assert.Equal(1, len(commits))
+	assert.Equal(bookmarkCommitID, commits[0].Id)
+	assert.Equal(commitID, commits[0].ParentId)
+
+	commits, err = repo.GetCommitRange(bookmarkCommitID, bookmarkCommitID)
+	assert.Nil(err)
+	assert.Equal(0, len(commits))
+}
+
+func TestHgGetMergeBase(t *testing.T) {
+	assert := assert.New(t)
+
+	repo, client := helpers.CreateHgRepo(t, "hg-repo")
+	defer helpers.CleanupHgRepo(t, client)
+
+	commitID := helpers.SeedHgRepo(t, repo, client)
+	bookmarkCommitID := helpers.SeedHgBookmark(t, repo, client)
+
+	mergeBase, err := repo.GetMergeBase(commitID, "test-bookmark")
+	assert.Nil(err)
+	assert.Equal(commitID, mergeBase)
+
+	mergeBase, err = repo.GetMergeBase(bookmarkCommitID, bookmarkCommitID)
+	assert.Nil(err)
+	assert.Equal(bookmarkCommitID, mergeBase)
+
+	_, err = repo.GetMergeBase(commitID, "does-not-exist")
+	assert.NotNil(err)
+}
+
+func TestHgWriteArchive(t *testing.T) {
+	assert := assert.New(t)
+
+	repo, client := helpers.CreateHgRepo(t, "hg-repo")
+	defer helpers.CleanupHgRepo(t, client)
+
+	helpers.SeedHgRepo(t, repo, client)
+	bookmarkCommitID := helpers.SeedHgBookmark(t, repo, client)
+
+	var buf bytes.Buffer
+	assert.Nil(repo.WriteArchive(&buf, bookmarkCommitID, repositories.ArchiveFormatZip, "prefix"))
+
+	reader, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	assert.Nil(err)
+
+	files := helpers.GetRepoFiles()
+	for _, file := range reader.File {
+		if file.Name == "prefix/.hg_archival.txt" {
+			continue
+		}
+
+		content, ok := files[strings.TrimPrefix(file.Name, "prefix/")]
+		assert.Truef(ok, "Unexpected file %s", file.Name)
+
+		f, err := file.Open()
+		assert.Nil(err)
+		data, err := ioutil.ReadAll(f)
+		assert.Nil(err)
+		assert.Equal(content, data)
 	}
+
+	assert.NotNil(repo.WriteArchive(&buf, bookmarkCommitID, "rar", "prefix"))
+}
+
+func TestHgGetFileSizes(t *testing.T) {
+	assert := assert.New(t)
+
+	repo, client := helpers.CreateHgRepo(t, "hg-repo")
+	defer helpers.CleanupHgRepo(t, client)
+
+	helpers.SeedHgRepo(t, repo, client)
+	bookmarkCommitID := helpers.SeedHgBookmark(t, repo, client)
+
+	sizes, err := repo.GetFileSizes(bookmarkCommitID)
+	assert.Nil(err)
+
+	expected := make(map[string]int64)
+	for name, content := range helpers.GetRepoFiles() {
+		expected[name] = int64(len(content))
+	}
+	assert.Equal(expected, sizes)
+
+	_, err = repo.GetFileSizes("bad-ref")
+	assert.NotNil(err)
+}
+
+func TestHgGetFileModeByCommit(t *testing.T) {
+	assert := assert.New(t)
+
+	repo, client := helpers.CreateHgRepo(t, "hg-repo")
+	defer helpers.CleanupHgRepo(t, client)
+
+	helpers.SeedHgRepo(t, repo, client)
+
+	assert.Nil(os.Mkdir(filepath.Join(repo.Path, "docs"), 0755))
+	assert.Nil(os.Symlink("../README", filepath.Join(repo.Path, "docs", "readme")))
+	assert.Nil(ioutil.WriteFile(filepath.Join(repo.Path, "run.sh"), []byte("#!/bin/sh\n"), 0755))
+
+	_, err := client.ExecCmd([]string{"add", "docs/readme", "run.sh"})
+	assert.Nil(err)
+
+	commitID := helpers.CommitHg(t, client, "Add a symlink", helpers.DefaultAuthor)
+
+	mode, err := repo.GetFileModeByCommit(commitID, "README")
+	assert.Nil(err)
+	assert.Equal(repositories.RegularFileMode, mode)
+
+	mode, err = repo.GetFileModeByCommit(commitID, "run.sh")
+	assert.Nil(err)
+	assert.Equal(repositories.ExecutableFileMode, mode)
+
+	mode, err = repo.GetFileModeByCommit(commitID, "docs/readme")
+	assert.Nil(err)
+	assert.Equal(repositories.SymlinkFileMode, mode)
+
+	path, mode, err := repositories.ResolveSymlinks(repo, commitID, "docs/readme")
+	assert.Nil(err)
+	assert.Equal("README", path)
+	assert.Equal(repositories.RegularFileMode, mode)
+
+	_, err = repo.GetFileModeByCommit(commitID, "docs")
+	assert.NotNil(err)
+
+	_, err = repo.GetFileModeByCommit(commitID, "MISSING")
+	assert.NotNil(err)
+}
+
+func TestHgGetChangedFiles(t *testing.T) {
+	assert := assert.New(t)
+
+	repo, client := helpers.CreateHgRepo(t, "hg-repo")
+	defer helpers.CleanupHgRepo(t, client)
+
+	commitID := helpers.SeedHgRepo(t, repo, client)
+	bookmarkCommitID := helpers.SeedHgBookmark(t, repo, client)
+
+	paths, err := repo.GetChangedFiles(commitID)
+	assert.Nil(err)
+	assert.Equal([]string{"COPYING", "README"}, paths)
+
+	paths, err = repo.GetChangedFiles(bookmarkCommitID)
+	assert.Nil(err)
+	assert.Equal([]string{"AUTHORS"}, paths)
+
+	_, err = repo.GetChangedFiles("bad-ref")
+	assert.NotNil(err)
+}
+
+func TestHgGetFileLog(t *testing.T) {
+	assert := assert.New(t)
+
+	repo, client := helpers.CreateHgRepo(t, "hg-repo")
+	defer helpers.CleanupHgRepo(t, client)
+
+	commitID := helpers.SeedHgRepo(t, repo, client)
+	bookmarkCommitID := helpers.SeedHgBookmark(t, repo, client)
+
+	commits, err := repo.GetFileLog("test-bookmark", "README")
+	assert.Nil(err)
+	assert.Equal(1, len(commits))
+	assert.Equal(commitID, commits[0].Id)
+
+	commits, err = repo.GetFileLog("test-bookmark", "AUTHORS")
+	assert.Nil(err)
+	assert.Equal(1, len(commits))
+	assert.Equal(bookmarkCommitID, commits[0].Id)
+
+	commits, err = repo.GetFileLog(commitID, "AUTHORS")
+	assert.Nil(err)
+	assert.Equal(0, len(commits))
+}
+
+func TestHgGetFileLogRenames(t *testing.T) {
+	assert := assert.New(t)
+
+	repo, client := helpers.CreateHgRepo(t, "hg-repo")
+	defer helpers.CleanupHgRepo(t, client)
+
+	addId := helpers.SeedHgRepo(t, repo, client)
+
+	_, err := client.ExecCmd([]string{"rename", "README", "README.txt"})
+	assert.Nil(err)
+	renameId := helpers.CommitHg(t, client, "Rename README", helpers.DefaultAuthor)
+
+	_, err = client.ExecCmd([]string{"copy", "README.txt", "README.md"})
+	assert.Nil(err)
+	copyId := helpers.CommitHg(t, client, "Copy README.txt", helpers.DefaultAuthor)
+
+	entries, err := repo.GetFileLog(copyId, "README.md")
+	assert.Nil(err)
+	if assert.Equal(3, len(entries)) {
+		assert.Equal(copyId, entries[0].Id)
+		assert.Equal("README.md", entries[0].Path)
+		assert.Equal("README.txt", entries[0].OldPath)
+		assert.Equal(repositories.PatchCopied, entries[0].Status)
+
+		assert.Equal(renameId, entries[1].Id)
+		assert.Equal("README.txt", entries[1].Path)
+		assert.Equal("README", entries[1].OldPath)
+		assert.Equal(repositories.PatchRenamed, entries[1].Status)
+
+		assert.Equal(addId, entries[2].Id)
+		assert.Equal("README", entries[2].Path)
+		assert.Equal(repositories.PatchAdded, entries[2].Status)
+	}
+
+	// Files that no longer exist are not followed.
+	entries, err = repo.GetFileLog(copyId, "README")
+	assert.Nil(err)
+	if assert.Equal(2, len(entries)) {
+		assert.Equal(renameId, entries[0].Id)
+		assert.Equal(repositories.PatchDeleted, entries[0].Status)
+		assert.Equal(addId, entries[1].Id)
+	}
+}
+
+func TestHgGetFileLogNonASCII(t *testing.T) {
+	assert := assert.New(t)
+
+	repo, client := helpers.CreateHgRepo(t, "hg-repo")
+	defer helpers.CleanupHgRepo(t, client)
+
+	helpers.SeedHgRepo(t, repo, client)
+
+	helpers.CreateAndAddFilesHg(t, repo.Path, client, map[string][]byte{
+		"résumé.txt": []byte("Résumé\n"),
+	})
+	commitID := helpers.CommitHg(t, client, "Add résumé", helpers.DefaultAuthor)
+
+	entries, err := repo.GetFileLog(commitID, "résumé.txt")
+	assert.Nil(err)
+	if assert.Equal(1, len(entries)) {
+		assert.Equal(commitID, entries[0].Id)
+		assert.Equal("résumé.txt", entries[0].Path)
+		assert.Equal(repositories.PatchAdded, entries[0].Status)
+	}
+}
+
+func TestHgSearchCommits(t *testing.T) {
+	assert := assert.New(t)
+
+	repo, client := helpers.CreateHgRepo(t, "hg-repo")
+	defer helpers.CleanupHgRepo(t, client)
+
+	commitID := helpers.SeedHgRepo(t, repo, client)
+	bookmarkCommitID := helpers.SeedHgBookmark(t, repo, client)
+
+	commits, err := repo.SearchCommits("BRANCH", "", false, false)
+	assert.Nil(err)
+	assert.Equal(1, len(commits))
+	assert.Equal(bookmarkCommitID, commits[0].Id)
+
+	commits, err = repo.SearchCommits("commit message", "test-bookmark", false, false)
+	assert.Nil(err)
+	assert.Equal(2, len(commits))
+	assert.Equal(bookmarkCommitID, commits[0].Id)
+	assert.Equal(commitID, commits[1].Id)
+
+	commits, err = repo.SearchCommits("does-not-match", "", false, false)
+	assert.Nil(err)
+	assert.Equal(0, len(commits))
+
+	commits, err = repo.SearchCommits("authors", "", false, true)
+	assert.Nil(err)
+	assert.Equal(1, len(commits))
+	assert.Equal(bookmarkCommitID, commits[0].Id)
 }
 
 func TestHgGetCommit(t *testing.T) {
@@ -248,6 +647,17 @@ func TestParsePushEvent(t *testing.T) {
 
 	assert.Nil(err)
 
+	if pushPayload, ok := payload.(events.PushPayload); assert.True(ok) && assert.Equal(4, len(pushPayload.Commits)) {
+		commit := pushPayload.Commits[0]
+		assert.Equal("Author", commit.Author)
+		assert.Equal("author@example.com", commit.AuthorEmail)
+		assert.Equal([]string{"bar"}, commit.Added)
+		assert.Nil(commit.Modified)
+		assert.Nil(commit.Removed)
+
+		assert.Equal([]string{".hgtags"}, pushPayload.Commits[2].Added)
+	}
+
 	expected := events.PushPayload{
 		Repository: repo.Name,
 		Commits: []events.PushPayloadCommit{
@@ -285,7 +695,148 @@ func TestParsePushEvent(t *testing.T) {
 		},
 	}
 
-	assert.Equal(expected, payload)
+	assert.Equal(expected, withoutCommitDetails(payload))
+}
+
+func TestHgParseCommitRange(t *testing.T) {
+	assert := assert.New(t)
+
+	repo, client := helpers.CreateHgRepo(t, "hg-repo")
+	defer helpers.CleanupHgRepo(t, client)
+
+	base := helpers.SeedHgRepo(t, repo, client)
+
+	nodes := make([]string, 0, 2)
+	for i, filename := range []string{"foo", "bar"} {
+		helpers.CreateAndAddFilesHg(t, repo.Path, client, map[string][]byte{filename: []byte(filename)})
+		nodes = append(nodes, helpers.CommitHg(t, client, fmt.Sprintf("Commit %d", i), helpers.DefaultAuthor))
+	}
+
+	payload, err := repo.ParseCommitRange(events.PushEvent, base, "tip", 0)
+	assert.Nil(err)
+	assert.Equal(
+		events.PushPayload{
+			Repository: repo.Name,
+			Commits: []events.PushPayloadCommit{
+				{
+					Id:      nodes[0],
+					Message: "Commit 0",
+					Target: events.PushPayloadCommitTarget{
+						Branch: "default",
+					},
+				},
+				{
+					Id:      nodes[1],
+					Message: "Commit 1",
+					Target: events.PushPayloadCommitTarget{
+						Branch: "default",
+						Tags:   []string{"tip"},
+					},
+				},
+			},
+		},
+		withoutCommitDetails(payload))
+
+	// Ranges with more changesets than the limit are refused.
+	_, err = repo.ParseCommitRange(events.PushEvent, base, "tip", 2)
+	assert.Nil(err)
+
+	_, err = repo.ParseCommitRange(events.PushEvent, base, "tip", 1)
+	_, ok := err.(*repositories.TooManyCommitsErr)
+	assert.True(ok)
+
+	_, err = repo.ParseCommitRange(events.PushEvent, "does-not-exist", "tip", 0)
+	assert.NotNil(err)
+
+	_, err = repo.ParseCommitRange(events.PrePushEvent, base, "tip", 0)
+	assert.NotNil(err)
+}
+
+func TestHgParseBranchChanges(t *testing.T) {
+	assert := assert.New(t)
+
+	repo, client := helpers.CreateHgRepo(t, "hg-repo")
+	defer helpers.CleanupHgRepo(t, client)
+
+	base := helpers.SeedHgRepo(t, repo, client)
+	oldHeads := map[string]string{"default": base}
+
+	helpers.CreateAndAddFilesHg(t, repo.Path, client, map[string][]byte{"foo": []byte("foo")})
+	node := helpers.CommitHg(t, client, "Commit 0", helpers.DefaultAuthor)
+	newHeads := map[string]string{"default": node}
+
+	payload, err := repo.ParseBranchChanges(oldHeads, newHeads)
+	assert.Nil(err)
+	assert.Equal(
+		events.PushPayload{
+			Repository: repo.Name,
+			Commits: []events.PushPayloadCommit{
+				{
+					Id:      node,
+					Message: "Commit 0",
+					Target: events.PushPayloadCommitTarget{
+						Branch: "default",
+						Tags:   []string{"tip"},
+					},
+				},
+			},
+		},
+		withoutCommitDetails(payload))
+
+	payload, err = repo.ParseBranchChanges(newHeads, newHeads)
+	assert.Nil(err)
+	assert.Equal(events.PushPayload{Repository: repo.Name, Commits: []events.PushPayloadCommit{}}, payload)
+}
+
+func TestHgParseBookmarkEvent(t *testing.T) {
+	assert := assert.New(t)
+
+	repo, client := helpers.CreateHgRepo(t, "hg-repo")
+	defer helpers.CleanupHgRepo(t, client)
+
+	commitID := helpers.SeedHgRepo(t, repo, client)
+
+	env := map[string]string{
+		"HG_HOOKTYPE": "txnclose-bookmark",
+		"HG_BOOKMARK": "bookmark-1",
+		"HG_OLDNODE":  "",
+		"HG_NODE":     commitID,
+	}
+
+	var payload events.Payload
+	var err error
+
+	helpers.WithEnv(t, env, func() {
+		payload, err = repo.ParseEventPayload(events.PushEvent, nil)
+	})
+
+	assert.Nil(err)
+	assert.Equal(
+		events.PushPayload{
+			Repository: repo.Name,
+			Commits: []events.PushPayloadCommit{
+				{
+					Id:      commitID,
+					Message: "Commit message",
+					Target: events.PushPayloadCommitTarget{
+						Branch:    "default",
+						Bookmarks: []string{"bookmark-1"},
+						Tags:      []string{"tip"},
+					},
+				},
+			},
+		},
+		withoutCommitDetails(payload))
+
+	// Bookmarks moved by transactions that added changesets are delivered
+	// by the changegroup hook instead.
+	env["HG_NODE_LAST"] = commitID
+	helpers.WithEnv(t, env, func() {
+		payload, err = repo.ParseEventPayload(events.PushEvent, nil)
+	})
+
+	assert.Nil(err)
+	assert.Nil(payload)
 }
 
 func TestInstallHgHooks(t *testing.T) {
@@ -306,6 +857,72 @@ func TestInstallHgHooks(t *testing.T) {
 		fmt.Sprintf("%s --config /tmp/config.json trigger-webhooks hg-repo push", exePath),
 		hgrc.Section("hooks").Key("changegroup.rbgateway").String(),
 	)
+	assert.Equal(
+		fmt.Sprintf("%s --config /tmp/config.json trigger-webhooks hg-repo push", exePath),
+		hgrc.Section("hooks").Key("txnclose-bookmark.rbgateway").String(),
+	)
+
+	// Hooks that earlier versions installed are removed.
+	hgrc.Section("hooks").Key("pushkey.rbgateway").SetValue("old")
+	assert.Nil(hgrc.SaveTo(filepath.Join(repo.Path, ".hg", "hgrc")))
+	assert.Nil(repo.InstallHooks("/tmp/config.json", false))
+
+	hgrc, err = ini.Load(filepath.Join(repo.Path, ".hg", "hgrc"))
+	assert.Nil(err)
+	assert.False(hgrc.Section("hooks").HasKey("pushkey.rbgateway"))
+}
+
+func TestGetInstalledHgHooks(t *testing.T) {
+	assert := assert.New(t)
+
+	repo, client := helpers.CreateHgRepo(t, "hg-repo")
+	defer helpers.CleanupHgRepo(t, client)
+
+	assert.Nil(repo.InstallHooks("/tmp/config.json", false))
+
+	exePath, err := filepath.Abs(os.Args[0])
+	assert.Nil(err)
+
+	command := fmt.Sprintf("%s --config /tmp/config.json trigger-webhooks hg-repo push", exePath)
+
+	installed, err := repositories.GetInstalledHooks(repo)
+	assert.Nil(err)
+	assert.Equal([]repositories.InstalledHook{
+		{Hook: "changegroup", Event: events.PushEvent, Installed: true, Command: command},
+		{Hook: "pretxnchangegroup", Event: events.PrePushEvent},
+		{Hook: "txnclose-bookmark", Event: events.PushEvent, Installed: true, Command: command},
+	}, installed)
+}
+
+func TestInstallHgPrePushHooks(t *testing.T) {
+	assert := assert.New(t)
+
+	repo, client := helpers.CreateHgRepo(t, "hg-repo")
+	defer helpers.CleanupHgRepo(t, client)
+
+	exePath, err := filepath.Abs(os.Args[0])
+	assert.Nil(err)
+
+	assert.Nil(repositories.SetHgConfig(repositories.HgConfig{PrePushHooks: true}))
+	defer repositories.SetHgConfig(repositories.HgConfig{})
+
+	assert.Nil(repo.InstallHooks("/tmp/config.json", false))
+
+	hgrc, err := ini.Load(filepath.Join(repo.Path, ".hg", "hgrc"))
+	assert.Nil(err)
+
+	assert.Equal(
+		fmt.Sprintf("%s --config /tmp/config.json trigger-webhooks hg-repo pre-push", exePath),
+		hgrc.Section("hooks").Key("pretxnchangegroup.rbgateway").String(),
+	)
+
+	// Disabling the hooks and reinstalling removes them.
+	assert.Nil(repositories.SetHgConfig(repositories.HgConfig{}))
+	assert.Nil(repo.InstallHooks("/tmp/config.json", true))
+
+	hgrc, err = ini.Load(filepath.Join(repo.Path, ".hg", "hgrc"))
+	assert.Nil(err)
+	assert.False(hgrc.Section("hooks").HasKey("pretxnchangegroup.rbgateway"))
 }
 
 func TestInstallHgHooksQuoted(t *testing.T) {
@@ -349,3 +966,66 @@ func TestInstallHgHooksForce(t *testing.T) {
 		hgrc.Section("hooks").Key("changegroup.rbgateway").String(),
 	)
 }
+
+func TestLogRecord(t *testing.T) {
+	assert := assert.New(t)
+
+	var record repositories.HgLogRecord
+	err := json.Unmarshal([]byte(`["line 1\u001fline 2\u001e", ["a b", "c"], [], "old style"]`), &record)
+	assert.Nil(err)
+
+	assert.Equal("line 1\x1fline 2\x1e", record.String(0))
+	assert.Equal([]string{"a b", "c"}, record.Strings(1))
+	assert.Nil(record.Strings(2))
+	assert.Equal([]string{"old", "style"}, record.Strings(3))
+}
+
+func TestValidateHgConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "rb-gateway-hg-")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	// A stand-in for hg that only knows about the "goodext" extension.
+	hgPath := filepath.Join(dir, "hg")
+	err = ioutil.WriteFile(hgPath, []byte(`#!/bin/sh
+for arg in "$@"; do last="$arg"; done
+test "$last" = goodext
+`), 0755)
+	assert.Nil(err)
+
+	cfg := repositories.HgConfig{
+		Path:       hgPath,
+		Extensions: []string{"goodext"},
+	}
+	assert.Nil(cfg.Validate())
+
+	cfg.Extensions = []string{"goodext", "badext=/path/to/badext.py"}
+	err = cfg.Validate()
+	assert.NotNil(err)
+	assert.Contains(err.Error(), `"badext"`)
+
+	// The environment is given to Mercurial, but not set in the process.
+	envHgPath := filepath.Join(dir, "env-hg")
+	err = ioutil.WriteFile(envHgPath, []byte(`#!/bin/sh
+test "$RBGATEWAY_TEST_HG_ENV" = set
+`), 0755)
+	assert.Nil(err)
+
+	cfg = repositories.HgConfig{
+		Path:       envHgPath,
+		Env:        map[string]string{"RBGATEWAY_TEST_HG_ENV": "set"},
+		Extensions: []string{"goodext"},
+	}
+	assert.Nil(cfg.Validate())
+
+	assert.Nil(repositories.SetHgConfig(cfg))
+	defer repositories.SetHgConfig(repositories.HgConfig{})
+
+	_, set := os.LookupEnv("RBGATEWAY_TEST_HG_ENV")
+	assert.False(set)
+
+	cfg.Path = filepath.Join(dir, "does-not-exist")
+	assert.NotNil(cfg.Validate())
+}
@@ -0,0 +1,149 @@
+package repositories
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	// Hooks run `rb-gateway trigger-webhooks`, which reads the configuration
+	// and webhook store and delivers webhooks itself.
+	HookModeCommand = "command"
+
+	// Hooks post events to the server with a hook token, and the server
+	// parses and delivers them.
+	HookModeApi = "api"
+
+	// The name of the file that a repository's hook token is kept in.
+	hookTokenFileName = "rbgateway-hook-token"
+)
+
+var (
+	hookConfigLock sync.RWMutex
+	hookConfig     = HookConfig{Mode: HookModeCommand}
+)
+
+// Settings for how installed hooks deliver events.
+type HookConfig struct {
+	// The path to a file of CA certificates that hooks trust when posting
+	// events to an `https` URL in HookModeApi. If empty, the system's CA
+	// certificates are trusted.
+	CAPath string `json:"caPath"`
+
+	// The paths to the certificate and private key that hooks present when
+	// posting events in HookModeApi, for servers that require client
+	// certificates.
+	ClientCertificate string `json:"clientCertificate"`
+	ClientKey         string `json:"clientKey"`
+
+	// How hooks deliver events. This is one of the `HookMode` constants.
+	Mode string `json:"mode"`
+
+	// The directory that Git hooks are installed into for every repository,
+	// as with Git's `core.hooksPath`. A repository's own hooks directory
+	// takes precedence.
+	Path string `json:"path"`
+
+	// The URL of the server that hooks post events to in HookModeApi.
+	Url string `json:"url"`
+}
+
+// Set the configuration used to install hooks.
+func SetHookConfig(cfg HookConfig) {
+	if cfg.Mode == "" {
+		cfg.Mode = HookModeCommand
+	}
+
+	hookConfigLock.Lock()
+	defer hookConfigLock.Unlock()
+
+	hookConfig = cfg
+}
+
+// Return the configuration used to install hooks.
+func currentHookConfig() HookConfig {
+	hookConfigLock.RLock()
+	defer hookConfigLock.RUnlock()
+
+	return hookConfig
+}
+
+// Return the command line that a hook runs to deliver an event.
+//
+// In HookModeApi, the hook posts the event to the server with the token in
+// `tokenPath`. If `stdin` is true, the hook's input is posted along with its
+// environment. Otherwise, the hook runs `trigger-webhooks` with the
+// configuration at `cfgPath`.
+func hookCommand(cfg HookConfig, exePath, cfgPath, tokenPath, repoName, event string, stdin bool) []string {
+	if cfg.Mode != HookModeApi {
+		return []string{exePath, "--config", cfgPath, "trigger-webhooks", repoName, event}
+	}
+
+	command := []string{exePath, "post-hook-event", "--url", cfg.Url, "--token-file", tokenPath}
+	if cfg.CAPath != "" {
+		command = append(command, "--ca-file", cfg.CAPath)
+	}
+
+	if cfg.ClientCertificate != "" {
+		command = append(command, "--cert", cfg.ClientCertificate, "--key", cfg.ClientKey)
+	}
+
+	if stdin {
+		command = append(command, "--stdin")
+	}
+
+	return append(command, repoName, event)
+}
+
+// Return the path of the file that a repository's hooks read their hook token
+// from in HookModeApi.
+//
+// The file is kept in the repository's metadata directory (e.g., `.git` or
+// `.hg`), alongside the hooks that read it.
+func HookTokenPath(repo Repository) (string, error) {
+	switch repo := repo.(type) {
+	case *GitRepository:
+		commonDir, err := repo.commonDir()
+		if err != nil {
+			return "", err
+		}
+
+		return filepath.Join(commonDir, hookTokenFileName), nil
+
+	case *HgRepository:
+		return filepath.Join(repo.Path, ".hg", hookTokenFileName), nil
+
+	default:
+		return "", fmt.Errorf(`Unknown SCM "%s"`, repo.GetScm())
+	}
+}
+
+// Read a hook token from a file.
+func ReadHookToken(path string) (string, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(content)), nil
+}
+
+// Write a hook token to a file that its owner and group can read.
+//
+// Pushes may be served as any user in the repository's group (e.g., in a
+// repository shared with `core.sharedRepository`), and each of them runs the
+// hooks. The file is given the group of the repository's metadata directory
+// by the operating system when that directory is set-group-ID, as shared
+// repositories are.
+func WriteHookToken(path, token string) error {
+	if err := ioutil.WriteFile(path, []byte(token+"\n"), 0640); err != nil {
+		return err
+	}
+
+	// An existing file keeps its mode when it is written.
+	return os.Chmod(path, 0640)
+}
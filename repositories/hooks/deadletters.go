@@ -0,0 +1,331 @@
+package hooks
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// The format of dead letter IDs, which are also used as file names.
+	deadLetterIdPattern = regexp.MustCompile(`^[0-9]+-[0-9a-f]+$`)
+)
+
+// A webhook delivery that failed and can be redriven.
+type DeadLetter struct {
+	// The ID of the dead letter.
+	Id string `json:"id"`
+
+	// The ID of the webhook the payload was for.
+	HookId string `json:"hook_id"`
+
+	// The event that was delivered.
+	Event string `json:"event"`
+
+	// The repository the event occurred in.
+	Repository string `json:"repository"`
+
+	// When the most recent delivery was attempted.
+	Time time.Time `json:"time"`
+
+	// The number of deliveries that have been attempted.
+	Attempts int `json:"attempts"`
+
+	// Why the most recent delivery failed. This is one of the
+	// `DeliveryReason` constants.
+	Reason string `json:"reason"`
+
+	// The HTTP status code of the response, if one was received.
+	StatusCode int `json:"status_code,omitempty"`
+
+	// The error message of the most recent delivery.
+	Error string `json:"error"`
+
+	// The payload, exactly as it was sent to the webhook.
+	Payload string `json:"payload"`
+}
+
+// A store for webhook deliveries that failed.
+//
+// Like DeliveryStatusStore, this is written by the `trigger-webhooks` command
+// and read by the API server, so dead letters are persisted to disk, each in
+// its own file in Dir.
+//
+// A dead letter that is being redriven is claimed by renaming its file, so
+// that only one redrive delivers it. Claimed dead letters are not listed.
+type DeadLetterStore struct {
+	// The directory the dead letters are stored in.
+	Dir string
+
+	// The most dead letters to keep. The oldest are removed first.
+	//
+	// If zero, there is no limit.
+	MaxLetters int
+
+	// How long dead letters are kept after they were first added.
+	//
+	// If zero, they are kept until they are redriven or removed.
+	MaxAge time.Duration
+}
+
+// Add a dead letter to the store.
+//
+// If the dead letter has no ID, a new one is assigned, and dead letters beyond
+// MaxLetters or older than MaxAge are removed. Otherwise, the existing dead
+// letter with that ID is replaced.
+func (store DeadLetterStore) Add(letter *DeadLetter) error {
+	isNew := letter.Id == ""
+
+	if isNew {
+		suffix := make([]byte, 4)
+		if _, err := rand.Read(suffix); err != nil {
+			return err
+		}
+
+		letter.Id = fmt.Sprintf("%d-%s", letter.Time.UnixNano(), hex.EncodeToString(suffix))
+	} else if !deadLetterIdPattern.MatchString(letter.Id) {
+		return fmt.Errorf(`Invalid dead letter ID "%s".`, letter.Id)
+	}
+
+	content, err := json.Marshal(letter)
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(store.Dir, 0700); err != nil {
+		return err
+	}
+
+	// Write to a temporary file and rename it so that readers never see a
+	// partially written dead letter.
+	file, err := ioutil.TempFile(store.Dir, ".dead-letter-")
+	if err != nil {
+		return err
+	}
+
+	if _, err = file.Write(content); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return err
+	}
+
+	if err = file.Close(); err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+
+	if err = os.Rename(file.Name(), store.path(letter.Id)); err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+
+	if isNew {
+		store.prune(time.Now())
+	}
+
+	return nil
+}
+
+// Return a dead letter.
+//
+// If there is no such dead letter, an error satisfying `os.IsNotExist` is
+// returned.
+func (store DeadLetterStore) Load(id string) (*DeadLetter, error) {
+	if !deadLetterIdPattern.MatchString(id) {
+		return nil, &os.PathError{Op: "open", Path: id, Err: os.ErrNotExist}
+	}
+
+	return store.load(store.path(id))
+}
+
+// Return the dead letter in a file.
+func (store DeadLetterStore) load(path string) (*DeadLetter, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var letter DeadLetter
+	if err = json.Unmarshal(content, &letter); err != nil {
+		return nil, err
+	}
+
+	return &letter, nil
+}
+
+// Return every dead letter, in the order they were added.
+//
+// IDs start with the time the dead letter was added, so they are sorted by
+// that.
+func (store DeadLetterStore) List() ([]DeadLetter, error) {
+	ids, err := store.ids()
+	if err != nil {
+		return nil, err
+	}
+
+	letters := make([]DeadLetter, 0, len(ids))
+	for _, id := range ids {
+		letter, err := store.Load(id)
+		if err != nil {
+			if os.IsNotExist(err) {
+				// The dead letter was removed while listing.
+				continue
+			}
+
+			return nil, err
+		}
+
+		letters = append(letters, *letter)
+	}
+
+	return letters, nil
+}
+
+// Remove a dead letter.
+//
+// If there is no such dead letter, an error satisfying `os.IsNotExist` is
+// returned.
+func (store DeadLetterStore) Remove(id string) error {
+	if !deadLetterIdPattern.MatchString(id) {
+		return &os.PathError{Op: "remove", Path: id, Err: os.ErrNotExist}
+	}
+
+	return os.Remove(store.path(id))
+}
+
+// Claim a dead letter so that it can be redriven.
+//
+// Until it is released with Release() or removed with RemoveClaimed(), the
+// dead letter cannot be listed, loaded or claimed again. If there is no such
+// dead letter, or it has already been claimed, an error satisfying
+// `os.IsNotExist` is returned.
+func (store DeadLetterStore) Claim(id string) (*DeadLetter, error) {
+	if !deadLetterIdPattern.MatchString(id) {
+		return nil, &os.PathError{Op: "rename", Path: id, Err: os.ErrNotExist}
+	}
+
+	if err := os.Rename(store.path(id), store.claimPath(id)); err != nil {
+		return nil, err
+	}
+
+	letter, err := store.load(store.claimPath(id))
+	if err != nil {
+		os.Rename(store.claimPath(id), store.path(id))
+		return nil, err
+	}
+
+	return letter, nil
+}
+
+// Return a claimed dead letter to the store, replacing it with the letter.
+//
+// If the letter cannot be written, the claimed dead letter is returned as it
+// was.
+func (store DeadLetterStore) Release(letter *DeadLetter) error {
+	if err := store.Add(letter); err != nil {
+		os.Rename(store.claimPath(letter.Id), store.path(letter.Id))
+		return err
+	}
+
+	return os.Remove(store.claimPath(letter.Id))
+}
+
+// Remove a claimed dead letter.
+func (store DeadLetterStore) RemoveClaimed(id string) error {
+	if !deadLetterIdPattern.MatchString(id) {
+		return &os.PathError{Op: "remove", Path: id, Err: os.ErrNotExist}
+	}
+
+	return os.Remove(store.claimPath(id))
+}
+
+// Remove the dead letters beyond MaxLetters or older than MaxAge.
+//
+// Failures are logged, since the dead letter that was added has still been
+// kept.
+func (store DeadLetterStore) prune(now time.Time) {
+	if store.MaxLetters <= 0 && store.MaxAge <= 0 {
+		return
+	}
+
+	ids, err := store.ids()
+	if err != nil {
+		log.Printf("Could not list dead letters to remove: %s", err.Error())
+		return
+	}
+
+	excess := 0
+	if store.MaxLetters > 0 && len(ids) > store.MaxLetters {
+		excess = len(ids) - store.MaxLetters
+	}
+
+	for i, id := range ids {
+		if i >= excess && (store.MaxAge <= 0 || now.Sub(deadLetterTime(id)) <= store.MaxAge) {
+			// The rest are newer.
+			break
+		}
+
+		if err := store.Remove(id); err != nil && !os.IsNotExist(err) {
+			log.Printf(`Could not remove dead letter "%s": %s`, id, err.Error())
+		}
+	}
+}
+
+// Return the IDs of the dead letters, oldest first.
+func (store DeadLetterStore) ids() ([]string, error) {
+	entries, err := ioutil.ReadDir(store.Dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []string{}, nil
+		}
+
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		name := entry.Name()
+		id := strings.TrimSuffix(name, ".json")
+
+		if entry.IsDir() || id == name || !deadLetterIdPattern.MatchString(id) {
+			continue
+		}
+
+		ids = append(ids, id)
+	}
+
+	// File names sort by time, except when the number of digits differs.
+	sort.SliceStable(ids, func(i, j int) bool {
+		return deadLetterTime(ids[i]).Before(deadLetterTime(ids[j]))
+	})
+
+	return ids, nil
+}
+
+// Return when a dead letter was first added, from its ID.
+func deadLetterTime(id string) time.Time {
+	nanos, _ := strconv.ParseInt(strings.SplitN(id, "-", 2)[0], 10, 64)
+	return time.Unix(0, nanos)
+}
+
+// Return the path of the file for a dead letter.
+func (store DeadLetterStore) path(id string) string {
+	return filepath.Join(store.Dir, id+".json")
+}
+
+// Return the path of the file for a dead letter that has been claimed.
+//
+// This is hidden from List(), which only lists `.json` files.
+func (store DeadLetterStore) claimPath(id string) string {
+	return filepath.Join(store.Dir, "."+id+".redriving")
+}
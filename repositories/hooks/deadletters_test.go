@@ -0,0 +1,170 @@
+package hooks_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/reviewboard/rb-gateway/repositories/hooks"
+)
+
+func TestDeadLetterStore(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "rb-gateway-dead-letters-")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	// The directory does not need to exist until a dead letter is added.
+	store := hooks.DeadLetterStore{Dir: filepath.Join(dir, "letters")}
+
+	letters, err := store.List()
+	assert.Nil(err)
+	assert.Equal(0, len(letters))
+
+	now := time.Now().UTC()
+	first := hooks.DeadLetter{
+		HookId:   "hook-1",
+		Event:    "push",
+		Time:     now,
+		Attempts: 1,
+		Payload:  `{"event": "push"}`,
+	}
+	second := hooks.DeadLetter{
+		HookId:   "hook-2",
+		Event:    "push",
+		Time:     now.Add(time.Second),
+		Attempts: 1,
+	}
+
+	assert.Nil(store.Add(&first))
+	assert.Nil(store.Add(&second))
+	assert.NotEqual("", first.Id)
+	assert.NotEqual(first.Id, second.Id)
+
+	letters, err = store.List()
+	assert.Nil(err)
+	if assert.Equal(2, len(letters)) {
+		assert.Equal(first.Id, letters[0].Id)
+		assert.Equal(`{"event": "push"}`, letters[0].Payload)
+		assert.Equal(second.Id, letters[1].Id)
+	}
+
+	// Adding a dead letter with an ID replaces it.
+	first.Attempts = 2
+	assert.Nil(store.Add(&first))
+
+	letter, err := store.Load(first.Id)
+	assert.Nil(err)
+	assert.Equal(2, letter.Attempts)
+
+	assert.Nil(store.Remove(first.Id))
+
+	_, err = store.Load(first.Id)
+	assert.True(os.IsNotExist(err))
+	assert.True(os.IsNotExist(store.Remove(first.Id)))
+
+	// IDs cannot refer to other files.
+	_, err = store.Load("../letters")
+	assert.True(os.IsNotExist(err))
+
+	letters, err = store.List()
+	assert.Nil(err)
+	assert.Equal(1, len(letters))
+}
+
+func TestDeadLetterStoreLimits(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "rb-gateway-dead-letters-")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	store := hooks.DeadLetterStore{
+		Dir:        dir,
+		MaxLetters: 2,
+		MaxAge:     time.Hour,
+	}
+
+	now := time.Now().UTC()
+	letters := []hooks.DeadLetter{
+		{HookId: "expired", Time: now.Add(-2 * time.Hour)},
+		{HookId: "oldest", Time: now.Add(-3 * time.Minute)},
+		{HookId: "older", Time: now.Add(-2 * time.Minute)},
+		{HookId: "newest", Time: now.Add(-time.Minute)},
+	}
+
+	for i := range letters {
+		assert.Nil(store.Add(&letters[i]))
+	}
+
+	// Expired dead letters and those beyond the limit are removed, oldest
+	// first.
+	kept, err := store.List()
+	assert.Nil(err)
+	if assert.Equal(2, len(kept)) {
+		assert.Equal("older", kept[0].HookId)
+		assert.Equal("newest", kept[1].HookId)
+	}
+
+	// Replacing a dead letter does not remove any.
+	kept[0].Attempts = 2
+	assert.Nil(store.Add(&kept[0]))
+
+	kept, err = store.List()
+	assert.Nil(err)
+	assert.Equal(2, len(kept))
+}
+
+func TestDeadLetterStoreClaim(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "rb-gateway-dead-letters-")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	store := hooks.DeadLetterStore{Dir: dir}
+
+	letter := hooks.DeadLetter{
+		HookId:   "hook-1",
+		Time:     time.Now().UTC(),
+		Attempts: 1,
+	}
+	assert.Nil(store.Add(&letter))
+
+	claimed, err := store.Claim(letter.Id)
+	assert.Nil(err)
+	assert.Equal(letter.Id, claimed.Id)
+
+	// A claimed dead letter cannot be claimed again, and is not listed.
+	_, err = store.Claim(letter.Id)
+	assert.True(os.IsNotExist(err))
+
+	letters, err := store.List()
+	assert.Nil(err)
+	assert.Equal(0, len(letters))
+
+	// Releasing it replaces it.
+	claimed.Attempts = 2
+	assert.Nil(store.Release(claimed))
+
+	loaded, err := store.Load(letter.Id)
+	assert.Nil(err)
+	assert.Equal(2, loaded.Attempts)
+
+	// Removing it once claimed removes it for good.
+	claimed, err = store.Claim(letter.Id)
+	assert.Nil(err)
+	assert.Nil(store.RemoveClaimed(claimed.Id))
+
+	_, err = store.Claim(letter.Id)
+	assert.True(os.IsNotExist(err))
+
+	entries, err := ioutil.ReadDir(dir)
+	assert.Nil(err)
+	assert.Equal(0, len(entries))
+}
@@ -0,0 +1,248 @@
+package hooks
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+const (
+	// The prefix of secrets that have been encrypted with a SecretsKey.
+	//
+	// The rest of an encrypted secret is the base64-encoded nonce followed by
+	// the AES-GCM ciphertext. The ID of the hook is authenticated along with
+	// the secret, so that it cannot be decrypted as another hook's secret.
+	encryptedSecretPrefix = "enc:v1:"
+
+	// The size of a secrets key, in bytes (for AES-256).
+	secretsKeySize = 32
+)
+
+var (
+	// An error returned when an encrypted secret is used without a key.
+	MissingSecretsKeyErr = errors.New("Secret is encrypted, but no secretsKeyPath is configured.")
+)
+
+// A key for encrypting webhook secrets at rest.
+type SecretsKey struct {
+	aead cipher.AEAD
+}
+
+// Load a secrets key from a file.
+//
+// The file must contain a base64-encoded 256-bit key, as written by
+// GenerateSecretsKey.
+func LoadSecretsKey(path string) (*SecretsKey, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(content)))
+	if err != nil {
+		return nil, fmt.Errorf(`Could not decode secrets key "%s": %s`, path, err.Error())
+	} else if len(raw) != secretsKeySize {
+		return nil, fmt.Errorf(`Secrets key "%s" must be %d bytes, not %d.`, path, secretsKeySize, len(raw))
+	}
+
+	return newSecretsKey(raw)
+}
+
+// Generate a new secrets key and write it to a file.
+//
+// The file is only readable by its owner. An existing file is never
+// overwritten.
+func GenerateSecretsKey(path string) error {
+	raw := make([]byte, secretsKeySize)
+	if _, err := rand.Read(raw); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write([]byte(base64.StdEncoding.EncodeToString(raw) + "\n"))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// Create a secrets key from raw key bytes.
+func newSecretsKey(raw []byte) (*SecretsKey, error) {
+	block, err := aes.NewCipher(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SecretsKey{aead}, nil
+}
+
+// Return whether or not a secret has been encrypted.
+func IsEncryptedSecret(secret string) bool {
+	return strings.HasPrefix(secret, encryptedSecretPrefix)
+}
+
+// Encrypt a secret of the hook with the given ID.
+//
+// Empty and already encrypted secrets are returned unchanged.
+func (key *SecretsKey) Encrypt(secret, hookId string) (string, error) {
+	if secret == "" || IsEncryptedSecret(secret) {
+		return secret, nil
+	}
+
+	nonce := make([]byte, key.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	sealed := key.aead.Seal(nonce, nonce, []byte(secret), []byte(hookId))
+	return encryptedSecretPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt a secret of the hook with the given ID.
+//
+// Secrets that are not encrypted (e.g., from before a key was configured) are
+// returned unchanged. If the key is nil, encrypted secrets produce
+// MissingSecretsKeyErr. Secrets encrypted for another hook cannot be
+// decrypted.
+func (key *SecretsKey) Decrypt(secret, hookId string) (string, error) {
+	if !IsEncryptedSecret(secret) {
+		return secret, nil
+	} else if key == nil {
+		return "", MissingSecretsKeyErr
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(secret, encryptedSecretPrefix))
+	if err != nil {
+		return "", fmt.Errorf("Could not decode encrypted secret: %s", err.Error())
+	}
+
+	nonceSize := key.aead.NonceSize()
+	if len(sealed) < nonceSize {
+		return "", errors.New("Encrypted secret is truncated.")
+	}
+
+	plaintext, err := key.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], []byte(hookId))
+	if err != nil {
+		return "", errors.New("Could not decrypt secret; it may have been encrypted with a different key or for another hook.")
+	}
+
+	return string(plaintext), nil
+}
+
+// Encrypt the hook's secrets in place.
+//
+// Besides the signing secrets, the values of the hook's headers and its basic
+// authentication password are encrypted, since they are credentials too. If
+// the key is nil, the secrets are left unencrypted.
+func (hook *Webhook) EncryptSecrets(key *SecretsKey) error {
+	if key == nil {
+		return nil
+	}
+
+	return hook.mapSecrets(func(secret string) (string, error) {
+		return key.Encrypt(secret, hook.Id)
+	})
+}
+
+// Return a copy of the hook with its secrets decrypted.
+func (hook Webhook) DecryptSecrets(key *SecretsKey) (Webhook, error) {
+	err := hook.mapSecrets(func(secret string) (string, error) {
+		return key.Decrypt(secret, hook.Id)
+	})
+
+	return hook, err
+}
+
+// Replace each of the hook's secrets with the result of a function.
+//
+// The headers and basic authentication credentials are copied before they are
+// changed, since they may be shared with other copies of the hook.
+func (hook *Webhook) mapSecrets(f func(secret string) (string, error)) (err error) {
+	if hook.Secret, err = f(hook.Secret); err != nil {
+		return err
+	}
+
+	if hook.PreviousSecret, err = f(hook.PreviousSecret); err != nil {
+		return err
+	}
+
+	if hook.Headers != nil {
+		headers := make(map[string]string, len(hook.Headers))
+		for name, value := range hook.Headers {
+			if headers[name], err = f(value); err != nil {
+				return err
+			}
+		}
+
+		hook.Headers = headers
+	}
+
+	if hook.BasicAuth != nil {
+		basicAuth := *hook.BasicAuth
+		if basicAuth.Password, err = f(basicAuth.Password); err != nil {
+			return err
+		}
+
+		hook.BasicAuth = &basicAuth
+	}
+
+	return nil
+}
+
+// Return whether or not any of the hook's secrets are not encrypted.
+func (hook Webhook) hasPlaintextSecrets() bool {
+	secrets := []string{hook.Secret, hook.PreviousSecret}
+	for _, value := range hook.Headers {
+		secrets = append(secrets, value)
+	}
+
+	if hook.BasicAuth != nil {
+		secrets = append(secrets, hook.BasicAuth.Password)
+	}
+
+	for _, secret := range secrets {
+		if secret != "" && !IsEncryptedSecret(secret) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Encrypt the secrets of every hook in the store that are not yet encrypted.
+//
+// The number of hooks whose secrets were encrypted is returned. The store is
+// not saved.
+func (s WebhookStore) EncryptSecrets(key *SecretsKey) (int, error) {
+	count := 0
+
+	for _, hook := range s {
+		if !hook.hasPlaintextSecrets() {
+			continue
+		}
+
+		if err := hook.EncryptSecrets(key); err != nil {
+			return count, err
+		}
+
+		count++
+	}
+
+	return count, nil
+}
@@ -0,0 +1,168 @@
+package hooks_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/reviewboard/rb-gateway/repositories/hooks"
+)
+
+func createSecretsKey(t *testing.T, dir, name string) *hooks.SecretsKey {
+	t.Helper()
+
+	path := filepath.Join(dir, name)
+	if err := hooks.GenerateSecretsKey(path); err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := hooks.LoadSecretsKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key
+}
+
+func TestSecretsKey(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "rb-gateway-secrets-")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	key := createSecretsKey(t, dir, "secrets.key")
+
+	encrypted, err := key.Encrypt("top-secret-top-secret", "webhook-1")
+	assert.Nil(err)
+	assert.True(hooks.IsEncryptedSecret(encrypted))
+	assert.NotContains(encrypted, "top-secret")
+
+	// Encrypting the same secret twice uses a new nonce.
+	encryptedAgain, err := key.Encrypt("top-secret-top-secret", "webhook-1")
+	assert.Nil(err)
+	assert.NotEqual(encrypted, encryptedAgain)
+
+	// Encrypted and empty secrets are not re-encrypted.
+	unchanged, err := key.Encrypt(encrypted, "webhook-1")
+	assert.Nil(err)
+	assert.Equal(encrypted, unchanged)
+
+	empty, err := key.Encrypt("", "webhook-1")
+	assert.Nil(err)
+	assert.Equal("", empty)
+
+	decrypted, err := key.Decrypt(encrypted, "webhook-1")
+	assert.Nil(err)
+	assert.Equal("top-secret-top-secret", decrypted)
+
+	// Plaintext secrets are passed through.
+	decrypted, err = key.Decrypt("plaintext-secret", "webhook-1")
+	assert.Nil(err)
+	assert.Equal("plaintext-secret", decrypted)
+
+	// Secrets cannot be decrypted without the key they were encrypted with.
+	_, err = createSecretsKey(t, dir, "other.key").Decrypt(encrypted, "webhook-1")
+	assert.NotNil(err)
+
+	// Secrets cannot be decrypted as the secret of another hook.
+	_, err = key.Decrypt(encrypted, "webhook-2")
+	assert.NotNil(err)
+
+	var noKey *hooks.SecretsKey
+	_, err = noKey.Decrypt(encrypted, "webhook-1")
+	assert.Equal(hooks.MissingSecretsKeyErr, err)
+}
+
+func TestLoadSecretsKeyInvalid(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "rb-gateway-secrets-")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "secrets.key")
+
+	_, err = hooks.LoadSecretsKey(path)
+	assert.NotNil(err)
+
+	assert.Nil(ioutil.WriteFile(path, []byte("c2hvcnQ=\n"), 0600))
+	_, err = hooks.LoadSecretsKey(path)
+	assert.NotNil(err)
+
+	// Existing keys are never overwritten.
+	assert.NotNil(hooks.GenerateSecretsKey(path))
+}
+
+func TestWebhookStoreEncryptSecrets(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "rb-gateway-secrets-")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	key := createSecretsKey(t, dir, "secrets.key")
+
+	encryptedSecret, err := key.Encrypt("already-encrypted-secret", "webhook-2")
+	assert.Nil(err)
+
+	store := hooks.WebhookStore{
+		"webhook-1": &hooks.Webhook{
+			Id:             "webhook-1",
+			Secret:         "plaintext-secret-plaintext",
+			PreviousSecret: "previous-secret-previous",
+		},
+		"webhook-2": &hooks.Webhook{
+			Id:     "webhook-2",
+			Secret: encryptedSecret,
+		},
+		"webhook-3": &hooks.Webhook{
+			Id: "webhook-3",
+		},
+		"webhook-4": &hooks.Webhook{
+			Id:        "webhook-4",
+			Headers:   map[string]string{"X-Proxy-Token": "proxy-token"},
+			BasicAuth: &hooks.WebhookBasicAuth{Username: "user", Password: "password"},
+		},
+	}
+
+	count, err := store.EncryptSecrets(key)
+	assert.Nil(err)
+	assert.Equal(2, count)
+
+	assert.True(hooks.IsEncryptedSecret(store["webhook-4"].Headers["X-Proxy-Token"]))
+	assert.True(hooks.IsEncryptedSecret(store["webhook-4"].BasicAuth.Password))
+	assert.Equal("user", store["webhook-4"].BasicAuth.Username)
+
+	decryptedCredentials, err := store["webhook-4"].DecryptSecrets(key)
+	assert.Nil(err)
+	assert.Equal("proxy-token", decryptedCredentials.Headers["X-Proxy-Token"])
+	assert.Equal("password", decryptedCredentials.BasicAuth.Password)
+
+	assert.True(hooks.IsEncryptedSecret(store["webhook-1"].Secret))
+	assert.True(hooks.IsEncryptedSecret(store["webhook-1"].PreviousSecret))
+	assert.Equal(encryptedSecret, store["webhook-2"].Secret)
+	assert.Equal("", store["webhook-3"].Secret)
+
+	decrypted, err := store["webhook-1"].DecryptSecrets(key)
+	assert.Nil(err)
+	assert.Equal("plaintext-secret-plaintext", decrypted.Secret)
+	assert.Equal("previous-secret-previous", decrypted.PreviousSecret)
+
+	// Decrypting returns a copy.
+	assert.True(hooks.IsEncryptedSecret(store["webhook-1"].Secret))
+
+	// A secret moved to another hook cannot be decrypted.
+	moved := *store["webhook-3"]
+	moved.Secret = store["webhook-1"].Secret
+	_, err = moved.DecryptSecrets(key)
+	assert.NotNil(err)
+
+	// Running the migration again is a no-op.
+	count, err = store.EncryptSecrets(key)
+	assert.Nil(err)
+	assert.Equal(0, count)
+}
@@ -0,0 +1,200 @@
+package hooks
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/reviewboard/rb-gateway/filelock"
+)
+
+// Held while a delivery status is being updated, so that concurrent
+// deliveries in this process do not overwrite each other's results.
+var deliveryStatusLock sync.Mutex
+
+const (
+	// The delivery succeeded.
+	DeliveryReasonNone = ""
+
+	// The webhook's host name could not be resolved.
+	DeliveryReasonDNS = "dns"
+
+	// The webhook did not respond in time.
+	DeliveryReasonTimeout = "timeout"
+
+	// A connection to the webhook could not be established.
+	DeliveryReasonConnection = "connection"
+
+	// The webhook responded with a non-2XX status code.
+	DeliveryReasonHTTPStatus = "http_status"
+
+	// The webhook rejected a gating event.
+	DeliveryReasonRejected = "rejected"
+
+	// The delivery failed for another reason.
+	DeliveryReasonOther = "other"
+)
+
+// The result of delivering a payload to a webhook.
+type DeliveryStatus struct {
+	// When the delivery was attempted.
+	Time time.Time `json:"time"`
+
+	// The event that was delivered.
+	Event string `json:"event"`
+
+	// The repository the event occurred in.
+	Repository string `json:"repository"`
+
+	// Whether or not the delivery succeeded.
+	Success bool `json:"success"`
+
+	// Why the delivery failed, if it did. This is one of the
+	// `DeliveryReason` constants.
+	Reason string `json:"reason,omitempty"`
+
+	// The HTTP status code of the response, if one was received.
+	StatusCode int `json:"status_code,omitempty"`
+
+	// The error message, if the delivery failed.
+	Error string `json:"error,omitempty"`
+}
+
+// The delivery history of a webhook.
+type HookStatus struct {
+	// The most recent delivery attempt.
+	LastDelivery *DeliveryStatus `json:"last_delivery"`
+
+	// The most recent failed delivery attempt.
+	LastError *DeliveryStatus `json:"last_error"`
+}
+
+// A store for the delivery status of webhooks.
+//
+// Webhooks are delivered by the `trigger-webhooks` command, which runs
+// separately from the API server, so delivery statuses are persisted to disk.
+// Each hook's status is stored in its own file in Dir so that concurrent
+// deliveries for different hooks do not conflict.
+type DeliveryStatusStore struct {
+	// The directory the statuses are stored in.
+	Dir string
+}
+
+// Return the status of a webhook.
+//
+// If the hook has never been delivered, an empty status is returned.
+func (store DeliveryStatusStore) Load(hookId string) (*HookStatus, error) {
+	var status HookStatus
+
+	content, err := ioutil.ReadFile(store.path(hookId))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &status, nil
+		}
+
+		return nil, err
+	}
+
+	if err = json.Unmarshal(content, &status); err != nil {
+		return nil, err
+	}
+
+	return &status, nil
+}
+
+// Record the result of a delivery attempt.
+//
+// The status is read, updated, and written back while both a mutex and the
+// status's lock file are held, so that deliveries made concurrently by this
+// process or by `trigger-webhooks` do not lose each other's results.
+func (store DeliveryStatusStore) Record(hookId string, delivery DeliveryStatus) error {
+	deliveryStatusLock.Lock()
+	defer deliveryStatusLock.Unlock()
+
+	if err := os.MkdirAll(store.Dir, 0700); err != nil {
+		return err
+	}
+
+	lock, err := filelock.Acquire(store.lockPath(hookId))
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	status, err := store.Load(hookId)
+	if err != nil {
+		// An unreadable status file should not prevent recording new
+		// deliveries.
+		status = &HookStatus{}
+	}
+
+	status.LastDelivery = &delivery
+	if !delivery.Success {
+		status.LastError = &delivery
+	}
+
+	content, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file and rename it so that readers never see a
+	// partially written status.
+	file, err := ioutil.TempFile(store.Dir, ".status-")
+	if err != nil {
+		return err
+	}
+
+	if _, err = file.Write(content); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return err
+	}
+
+	if err = file.Close(); err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+
+	return os.Rename(file.Name(), store.path(hookId))
+}
+
+// Remove the status of a webhook.
+func (store DeliveryStatusStore) Remove(hookId string) error {
+	deliveryStatusLock.Lock()
+	defer deliveryStatusLock.Unlock()
+
+	lock, err := filelock.Acquire(store.lockPath(hookId))
+	if os.IsNotExist(err) {
+		// The status directory does not exist, so there is no status.
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer lock.Remove()
+
+	err = os.Remove(store.path(hookId))
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
+
+// Return the path of the status file for a webhook.
+//
+// Hook IDs are arbitrary strings, so they are hex-encoded to produce safe
+// file names.
+func (store DeliveryStatusStore) path(hookId string) string {
+	return filepath.Join(store.Dir, hex.EncodeToString([]byte(hookId))+".json")
+}
+
+// Return the path of the lock file that is held while a webhook's status is
+// updated.
+func (store DeliveryStatusStore) lockPath(hookId string) string {
+	return store.path(hookId) + ".lock"
+}
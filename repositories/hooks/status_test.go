@@ -0,0 +1,61 @@
+package hooks_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/reviewboard/rb-gateway/repositories/hooks"
+)
+
+func TestDeliveryStatusStoreConcurrentRecord(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "rb-gateway-status-")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	store := hooks.DeliveryStatusStore{Dir: filepath.Join(dir, "status")}
+
+	// A failed delivery recorded alongside successful ones must not be
+	// lost when the successful ones overwrite the last delivery.
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			delivery := hooks.DeliveryStatus{
+				Time:       time.Now().UTC(),
+				Event:      "push",
+				Repository: fmt.Sprintf("repo-%d", i),
+				Success:    i != 10,
+			}
+			assert.Nil(store.Record("hook", delivery))
+		}(i)
+	}
+	wg.Wait()
+
+	status, err := store.Load("hook")
+	assert.Nil(err)
+	assert.NotNil(status.LastDelivery)
+	if assert.NotNil(status.LastError) {
+		assert.Equal("repo-10", status.LastError.Repository)
+	}
+
+	assert.Nil(store.Remove("hook"))
+
+	status, err = store.Load("hook")
+	assert.Nil(err)
+	assert.Nil(status.LastDelivery)
+	assert.Nil(status.LastError)
+
+	// Removing a status that was never recorded is not an error.
+	assert.Nil(hooks.DeliveryStatusStore{Dir: filepath.Join(dir, "missing")}.Remove("hook"))
+}
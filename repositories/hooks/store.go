@@ -152,7 +152,8 @@ func validateHook(hook *Webhook, repos map[string]struct{}) bool {
 		return false
 	}
 
-	if len(hook.Secret) < 20 {
+	// Hooks without a secret use the default secret for each repository.
+	if hook.Secret != "" && len(hook.Secret) < 20 {
 		log.Printf(
 			`WARNING: Secret for webhook "%s" is too short (%d bytes); should be at least 20 bytes.`,
 			hook.Id, len(hook.Secret))
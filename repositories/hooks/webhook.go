@@ -2,25 +2,107 @@ package hooks
 
 import (
 	"crypto/hmac"
+	"crypto/rand"
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"hash"
+	"net/http"
 	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"time"
 
 	"github.com/reviewboard/rb-gateway/repositories/events"
 )
 
+const (
+	// Sign payloads with both HMAC-SHA1 and HMAC-SHA256.
+	SignatureAlgorithmAll = ""
+
+	// Sign payloads with HMAC-SHA1 only.
+	SignatureAlgorithmSHA1 = "sha1"
+
+	// Sign payloads with HMAC-SHA256 only.
+	SignatureAlgorithmSHA256 = "sha256"
+
+	// The header containing the HMAC-SHA1 signature of the payload.
+	SignatureHeader = "X-RBG-Signature"
+
+	// The header containing the HMAC-SHA256 signature of the payload.
+	SignatureHeaderSHA256 = "X-RBG-Signature-256"
+
+	// The suffix of the headers containing the signatures made with a hook's
+	// previous secret while it is being rotated (e.g.,
+	// `X-RBG-Signature-256-Previous`).
+	PreviousSignatureHeaderSuffix = "-Previous"
+
+	// Send payloads in rb-gateway's own format.
+	FormatRBGateway = "rbgateway"
+
+	// Send payloads in the format of GitHub's push events.
+	FormatGitHub = "github"
+
+	// The header containing the HMAC-SHA1 signature of a GitHub-formatted
+	// payload.
+	GitHubSignatureHeader = "X-Hub-Signature"
+
+	// The header containing the HMAC-SHA256 signature of a GitHub-formatted
+	// payload.
+	GitHubSignatureHeaderSHA256 = "X-Hub-Signature-256"
+
+	// The header containing the event of a GitHub-formatted payload.
+	GitHubEventHeader = "X-GitHub-Event"
+
+	// A webhook that receives JSON payloads.
+	TypeWebhook = "webhook"
+
+	// A Slack- or Mattermost-compatible incoming webhook that receives chat
+	// messages.
+	TypeSlack = "slack"
+
+	// The prefix for branch patterns that are regular expressions.
+	branchRegexPrefix = "regex:"
+)
+
 type Webhook struct {
 	// A unique ID for the webhook.
 	Id string `json:"id"`
 
 	// The URL that the webhook will request.
+	//
+	// The URL may contain the placeholders `{repository}` and `{event}`, which
+	// are replaced by the repository name and event type when the hook is
+	// dispatched. See ExpandUrl().
 	Url string `json:"url"`
 
-	// A secret used for generating an HMAC-SHA1 signature for the payload.
+	// A secret used for generating HMAC signatures for the payload.
+	//
+	// If empty, the default secret for the repository is used. See
+	// SecretDefaults.
 	Secret string `json:"secret"`
 
+	// The secret that was replaced when the secret was last rotated.
+	//
+	// Until PreviousSecretExpires, payloads are also signed with this
+	// secret, so that receivers can switch to the new secret without
+	// rejecting payloads. If empty, the previous secret was the repository's
+	// default secret.
+	PreviousSecret string `json:"previousSecret,omitempty"`
+
+	// When payloads stop being signed with the previous secret.
+	//
+	// This is nil unless the secret has been rotated.
+	PreviousSecretExpires *time.Time `json:"previousSecretExpires,omitempty"`
+
+	// The algorithm used to sign payloads.
+	//
+	// If empty, payloads are signed with both HMAC-SHA1 and HMAC-SHA256.
+	SignatureAlgorithm string `json:"signatureAlgorithm,omitempty"`
+
 	// Whether or not the webhook is enabled.
 	Enabled bool `json:"enabled"`
 
@@ -29,18 +111,405 @@ type Webhook struct {
 
 	// A sorted list of repository names that this webhook applies to.
 	Repos []string `json:"repos"`
+
+	// An optional list of Mercurial bookmarks that this webhook applies to.
+	//
+	// If non-empty, only commits that are pointed to by one of these bookmarks
+	// will be delivered.
+	Bookmarks []string `json:"bookmarks,omitempty"`
+
+	// An optional list of branch patterns that this webhook applies to.
+	//
+	// Patterns are globs (e.g., `release/*`), unless prefixed with `regex:`,
+	// in which case they are regular expressions. If non-empty, only commits
+	// on a matching branch will be delivered.
+	Branches []string `json:"branches,omitempty"`
+
+	// Optional static headers to send with each request (e.g., an
+	// `Authorization` header with a bearer token).
+	Headers map[string]string `json:"headers,omitempty"`
+
+	// Optional credentials for HTTP basic authentication.
+	BasicAuth *WebhookBasicAuth `json:"basicAuth,omitempty"`
+
+	// The maximum number of seconds to wait for the webhook to be delivered.
+	//
+	// If zero, the global `webhookTimeout` is used.
+	Timeout int `json:"timeout,omitempty"`
+
+	// The format of the payloads sent to the webhook.
+	//
+	// If empty, payloads are sent in rb-gateway's own format.
+	Format string `json:"format,omitempty"`
+
+	// The type of the webhook.
+	//
+	// If empty, the hook is a regular webhook. Slack hooks receive chat
+	// messages instead of payloads, and are not signed.
+	Type string `json:"type,omitempty"`
+}
+
+// Default secrets for webhooks that do not have their own.
+type SecretDefaults struct {
+	// The default secret for every repository.
+	Global string
+
+	// Default secrets for individual repositories, by name.
+	//
+	// These take precedence over the global default.
+	Repositories map[string]string
+}
+
+// Return the default secret for the repository.
+//
+// If there is no default, an empty string is returned.
+func (d SecretDefaults) Secret(repository string) string {
+	if secret := d.Repositories[repository]; secret != "" {
+		return secret
+	}
+
+	return d.Global
+}
+
+// Credentials for HTTP basic authentication to a webhook's URL.
+type WebhookBasicAuth struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// Return the maximum time to wait for the webhook to be delivered.
+//
+// If the hook does not specify a timeout, the given default is returned.
+func (hook Webhook) TimeoutDuration(defaultTimeout time.Duration) time.Duration {
+	if hook.Timeout > 0 {
+		return time.Duration(hook.Timeout) * time.Second
+	}
+
+	return defaultTimeout
+}
+
+// Return the secret used to sign the hook's payloads for the repository.
+//
+// This is the hook's own secret, if it has one, or the repository's default.
+func (hook Webhook) EffectiveSecret(defaults SecretDefaults, repository string) string {
+	if hook.Secret != "" {
+		return hook.Secret
+	}
+
+	return defaults.Secret(repository)
+}
+
+// Return the previous secret that the hook's payloads are also signed with
+// for the repository.
+//
+// If the hook's secret is not being rotated at the given time, an empty
+// string is returned.
+func (hook Webhook) EffectivePreviousSecret(defaults SecretDefaults, repository string, now time.Time) string {
+	if !hook.IsRotatingSecret(now) {
+		return ""
+	} else if hook.PreviousSecret != "" {
+		return hook.PreviousSecret
+	}
+
+	return defaults.Secret(repository)
+}
+
+// An error returned when a secret is rotated while a previous rotation's grace
+// period is still running.
+var RotationInProgressErr = errors.New("The secret is already being rotated.")
+
+// Return whether or not payloads are still signed with the previous secret
+// at the given time.
+func (hook Webhook) IsRotatingSecret(now time.Time) bool {
+	return hook.PreviousSecretExpires != nil && now.Before(*hook.PreviousSecretExpires)
+}
+
+// Return a copy of the hook with a new, randomly generated secret.
+//
+// Until the grace period has passed, payloads are signed with both the new
+// secret and the hook's current secret. Only one previous secret is kept, so
+// the secret cannot be rotated again until then, since receivers may still be
+// using the previous secret; RotationInProgressErr is returned instead.
+func (hook Webhook) RotateSecret(gracePeriod time.Duration) (Webhook, error) {
+	if hook.IsRotatingSecret(time.Now()) {
+		return hook, RotationInProgressErr
+	}
+
+	secret, err := GenerateSecret()
+	if err != nil {
+		return hook, err
+	}
+
+	expires := time.Now().Add(gracePeriod).UTC().Truncate(time.Second)
+
+	hook.PreviousSecret = hook.Secret
+	hook.PreviousSecretExpires = &expires
+	hook.Secret = secret
+
+	return hook, nil
+}
+
+// Return a new, randomly generated secret.
+func GenerateSecret() (string, error) {
+	var raw [32]byte
+	if _, err := rand.Read(raw[:]); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(raw[:]), nil
 }
 
 // Return an HMAC-SHA1 signature of the payload using the hook's secret.
 func (hook Webhook) SignPayload(payload []byte) string {
-	hmac := hmac.New(sha1.New, []byte(hook.Secret))
+	return hook.sign(sha1.New, payload)
+}
+
+// Return an HMAC-SHA256 signature of the payload using the hook's secret.
+func (hook Webhook) SignPayloadSHA256(payload []byte) string {
+	return hook.sign(sha256.New, payload)
+}
+
+// Return the signature headers for the payload.
+//
+// The headers included depend on the hook's signature algorithm. Hooks that
+// use the GitHub format receive GitHub's `X-Hub-Signature` headers instead.
+// If the hook has a previous secret, the payload is also signed with it, in
+// headers with the PreviousSignatureHeaderSuffix.
+func (hook Webhook) SignatureHeaders(payload []byte) map[string]string {
+	headers := hook.signatureHeaders(payload)
+
+	if hook.PreviousSecret != "" && hook.PreviousSecret != hook.Secret {
+		previous := hook
+		previous.Secret = hook.PreviousSecret
+
+		for header, signature := range previous.signatureHeaders(payload) {
+			headers[header+PreviousSignatureHeaderSuffix] = signature
+		}
+	}
+
+	return headers
+}
+
+// Return the signature headers for the payload using the hook's secret.
+func (hook Webhook) signatureHeaders(payload []byte) map[string]string {
+	headers := make(map[string]string)
+
+	if hook.SignatureAlgorithm != SignatureAlgorithmSHA256 {
+		if hook.Format == FormatGitHub {
+			headers[GitHubSignatureHeader] = "sha1=" + hook.SignPayload(payload)
+		} else {
+			headers[SignatureHeader] = hook.SignPayload(payload)
+		}
+	}
+
+	if hook.SignatureAlgorithm != SignatureAlgorithmSHA1 {
+		if hook.Format == FormatGitHub {
+			headers[GitHubSignatureHeaderSHA256] = "sha256=" + hook.SignPayloadSHA256(payload)
+		} else {
+			headers[SignatureHeaderSHA256] = hook.SignPayloadSHA256(payload)
+		}
+	}
+
+	return headers
+}
+
+// Return whether or not the hook's payloads are signed.
+func (hook Webhook) IsSigned() bool {
+	return hook.Type != TypeSlack
+}
+
+// Return whether or not the hook receives something other than rb-gateway's
+// own payload format.
+func (hook Webhook) HasCustomPayload() bool {
+	return hook.Type == TypeSlack || hook.Format == FormatGitHub
+}
+
+// Marshal a payload in the hook's format.
+//
+// Each of the returned payloads is delivered separately. Only the GitHub
+// format can have more than one, since GitHub sends a push event per ref.
+func (hook Webhook) MarshalPayloads(payload events.Payload) ([][]byte, error) {
+	if hook.Format == FormatGitHub && hook.Type != TypeSlack {
+		return events.MarshalGitHubPayloads(payload)
+	}
+
+	var marshaled []byte
+	var err error
+
+	if hook.Type == TypeSlack {
+		marshaled, err = events.MarshalSlackPayload(payload)
+	} else {
+		marshaled, err = events.MarshalPayload(payload)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return [][]byte{marshaled}, nil
+}
+
+// Return a hex-encoded HMAC of the payload using the hook's secret.
+func (hook Webhook) sign(h func() hash.Hash, payload []byte) string {
+	hmac := hmac.New(h, []byte(hook.Secret))
 	hmac.Write(payload)
 
 	return hex.EncodeToString(hmac.Sum(nil))
 }
 
+// Return the hook's URL with its placeholders expanded.
+//
+// Values are escaped so that they are safe to use in any part of the URL.
+func (hook Webhook) ExpandUrl(event, repoName string) string {
+	return strings.NewReplacer(
+		"{repository}", url.PathEscape(repoName),
+		"{event}", url.PathEscape(event),
+	).Replace(hook.Url)
+}
+
+// Return the hook's URL as it may be shown in logs and notifications.
+//
+// The URL of a Slack hook is its only credential, so it is redacted.
+func (hook Webhook) DisplayUrl(event, repoName string) string {
+	if hook.Type == TypeSlack {
+		return "(redacted)"
+	}
+
+	return hook.ExpandUrl(event, repoName)
+}
+
+// Apply the hook's custom headers and credentials to a request.
+func (hook Webhook) ApplyRequestAuth(req *http.Request) {
+	for name, value := range hook.Headers {
+		req.Header.Set(name, value)
+	}
+
+	if hook.BasicAuth != nil {
+		req.SetBasicAuth(hook.BasicAuth.Username, hook.BasicAuth.Password)
+	}
+}
+
+// Return whether or not the hook filters the payloads it receives.
+func (hook Webhook) HasFilters() bool {
+	return len(hook.Bookmarks) != 0 || len(hook.Branches) != 0
+}
+
+// Filter the payload to the commits this hook is interested in.
+//
+// If the hook has no filters, the payload is returned unchanged. If none of the
+// commits in the payload match the filters, or the hook is a Slack hook and the
+// payload has no commits, `nil` will be returned and the hook should not be
+// dispatched.
+func (hook Webhook) FilterPayload(payload events.Payload) events.Payload {
+	if prePushPayload, ok := payload.(events.PrePushPayload); ok {
+		filtered := hook.FilterPayload(prePushPayload.PushPayload)
+		if filtered == nil {
+			return nil
+		}
+
+		return events.PrePushPayload{PushPayload: filtered.(events.PushPayload)}
+	}
+
+	pushPayload, ok := payload.(events.PushPayload)
+	if !ok {
+		return payload
+	} else if hook.Type == TypeSlack && len(pushPayload.Commits) == 0 {
+		// There is nothing to announce for pushes that only delete refs.
+		return nil
+	} else if !hook.HasFilters() {
+		return payload
+	}
+
+	filtered := events.PushPayload{
+		Repository:    pushPayload.Repository,
+		RepositoryUrl: pushPayload.RepositoryUrl,
+		Commits:       []events.PushPayloadCommit{},
+	}
+
+	for _, commit := range pushPayload.Commits {
+		if hook.matchesBookmarks(commit) && hook.matchesBranches(commit) {
+			filtered.Commits = append(filtered.Commits, commit)
+		}
+	}
+
+	for _, ref := range pushPayload.Refs {
+		for _, commit := range filtered.Commits {
+			if commit.Target.Branch != "" && ref.Ref == "refs/heads/"+commit.Target.Branch {
+				filtered.Refs = append(filtered.Refs, ref)
+				break
+			}
+		}
+	}
+
+	if len(filtered.Commits) == 0 {
+		return nil
+	}
+
+	return filtered
+}
+
+// Return whether or not the commit matches the hook's bookmark filter.
+func (hook Webhook) matchesBookmarks(commit events.PushPayloadCommit) bool {
+	if len(hook.Bookmarks) == 0 {
+		return true
+	}
+
+	for _, bookmark := range commit.Target.Bookmarks {
+		if containsUnsorted(hook.Bookmarks, bookmark) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Return whether or not the commit matches the hook's branch filter.
+func (hook Webhook) matchesBranches(commit events.PushPayloadCommit) bool {
+	if len(hook.Branches) == 0 {
+		return true
+	}
+
+	for _, pattern := range hook.Branches {
+		if matched, _ := matchBranch(pattern, commit.Target.Branch); matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Return whether or not the branch matches the pattern.
+//
+// An error is returned if the pattern is invalid.
+func matchBranch(pattern, branch string) (bool, error) {
+	if strings.HasPrefix(pattern, branchRegexPrefix) {
+		re, err := regexp.Compile(strings.TrimPrefix(pattern, branchRegexPrefix))
+		if err != nil {
+			return false, err
+		}
+
+		return re.MatchString(branch), nil
+	}
+
+	return path.Match(pattern, branch)
+}
+
+// Check if the unsorted `haystack` contains `needle`.
+func containsUnsorted(haystack []string, needle string) bool {
+	for _, s := range haystack {
+		if s == needle {
+			return true
+		}
+	}
+
+	return false
+}
+
 // Validate a hook.
-func (hook Webhook) Validate(repos map[string]struct{}) error {
+//
+// A hook without a secret is only valid if every repository it applies to has
+// a default secret.
+func (hook Webhook) Validate(repos map[string]struct{}, secrets SecretDefaults) error {
 	if len(hook.Events) == 0 {
 		return errors.New("Hook has no events.")
 	} else {
@@ -61,7 +530,7 @@ func (hook Webhook) Validate(repos map[string]struct{}) error {
 		}
 	}
 
-	url, err := url.Parse(hook.Url)
+	url, err := url.Parse(hook.ExpandUrl(events.PushEvent, "repository"))
 	if err != nil {
 		return fmt.Errorf("Invalid URL: %s", err.Error())
 	}
@@ -71,7 +540,86 @@ func (hook Webhook) Validate(repos map[string]struct{}) error {
 			url.Scheme)
 	}
 
-	if len(hook.Secret) < 20 {
+	for _, pattern := range hook.Branches {
+		if _, err := matchBranch(pattern, ""); err != nil {
+			return fmt.Errorf(`Invalid branch pattern "%s": %s`, pattern, err.Error())
+		}
+	}
+
+	for name := range hook.Headers {
+		canonicalName := http.CanonicalHeaderKey(name)
+
+		if name == "" || strings.ContainsAny(name, " \t\r\n:") {
+			return fmt.Errorf(`Invalid header name: "%s".`, name)
+		} else if strings.HasPrefix(canonicalName, "X-Rbg-") || canonicalName == "Content-Type" ||
+			(hook.Format == FormatGitHub && (strings.HasPrefix(canonicalName, "X-Hub-") ||
+				strings.HasPrefix(canonicalName, "X-Github-"))) {
+			return fmt.Errorf(`Header "%s" cannot be overridden.`, name)
+		} else if canonicalName == "Authorization" && hook.BasicAuth != nil {
+			return errors.New("An Authorization header cannot be used with basic authentication.")
+		}
+	}
+
+	for name, value := range hook.Headers {
+		if strings.ContainsAny(value, "\r\n") {
+			return fmt.Errorf(`Invalid value for header "%s".`, name)
+		}
+	}
+
+	if hook.BasicAuth != nil && hook.BasicAuth.Username == "" {
+		return errors.New("Basic authentication requires a username.")
+	}
+
+	if hook.Timeout < 0 {
+		return fmt.Errorf("Invalid timeout: %d.", hook.Timeout)
+	}
+
+	switch hook.SignatureAlgorithm {
+	case SignatureAlgorithmAll, SignatureAlgorithmSHA1, SignatureAlgorithmSHA256:
+	default:
+		return fmt.Errorf(`Invalid signature algorithm: "%s".`, hook.SignatureAlgorithm)
+	}
+
+	switch hook.Format {
+	case "", FormatRBGateway:
+	case FormatGitHub:
+		for _, event := range hook.Events {
+			if event != events.PushEvent && event != events.PrePushEvent {
+				return fmt.Errorf(`The GitHub format does not support the "%s" event.`, event)
+			}
+		}
+
+	default:
+		return fmt.Errorf(`Invalid format: "%s".`, hook.Format)
+	}
+
+	switch hook.Type {
+	case "", TypeWebhook:
+	case TypeSlack:
+		for _, event := range hook.Events {
+			if event != events.PushEvent {
+				return fmt.Errorf(`Slack hooks do not support the "%s" event.`, event)
+			}
+		}
+
+		if hook.Format != "" {
+			return errors.New("Slack hooks do not support payload formats.")
+		}
+
+		// Slack hooks are not signed, so they do not need a secret.
+		return nil
+
+	default:
+		return fmt.Errorf(`Invalid type: "%s".`, hook.Type)
+	}
+
+	if hook.Secret == "" {
+		for _, repo := range hook.Repos {
+			if secrets.Secret(repo) == "" {
+				return fmt.Errorf(`Hook has no secret, and repository "%s" has no default secret.`, repo)
+			}
+		}
+	} else if len(hook.Secret) < 20 {
 		return fmt.Errorf(`Secret is too short (%d bytes); secrets must be at least 20 bytes.`,
 			len(hook.Secret))
 	}
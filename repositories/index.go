@@ -0,0 +1,872 @@
+package repositories
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+
+	"github.com/reviewboard/rb-gateway/filelock"
+	"github.com/reviewboard/rb-gateway/repositories/events"
+)
+
+// The version of the commit index file format.
+//
+// This must be incremented whenever `indexedCommit` changes. Index files
+// with another version are discarded and rebuilt.
+const commitIndexVersion = 1
+
+// The number of commits that may be in an index's journal before it is
+// compacted into the index file.
+const maxJournalEntries = 1000
+
+var (
+	commitIndexesLock sync.Mutex
+	commitIndexes     = make(map[string]*CommitIndex)
+)
+
+// An on-disk index of the commits on a Git repository's branches.
+//
+// The index holds each commit's message, author, and the paths it changed,
+// so that commits can be searched without reading them from the repository.
+// It is loaded into memory when it is first used, and commits that have not
+// been indexed yet are still found by walking the repository from its
+// branches and from the indexed commits whose parents are not indexed.
+//
+// The index is stored in two files: the index file, which is rewritten when
+// the index is compacted, and a journal next to it, which the post-receive
+// hook appends pushed commits to. Both are re-read whenever they change. The
+// journal is only appended to or rotated while its lock file is held (see
+// journalLockPath()).
+type CommitIndex struct {
+	path string
+
+	// Held while the index is being updated, so that only one update runs
+	// at a time.
+	updateLock sync.Mutex
+
+	// Non-zero while the index is being compacted in the background.
+	compacting int32
+
+	lock    sync.RWMutex
+	loaded  bool
+	commits []indexedCommit
+	ids     map[plumbing.Hash]int
+
+	// The modification time of the index file when it was loaded.
+	modTime time.Time
+
+	// The journal that has been read and how much of it was read.
+	journal        os.FileInfo
+	journalOffset  int64
+	journalEntries int
+}
+
+// A commit in the index.
+type indexedCommit struct {
+	Info    CommitInfo
+	Parents []plumbing.Hash
+
+	// The commit time, in seconds since the epoch.
+	Time int64
+
+	// The paths that were added, modified, or removed relative to the first
+	// parent.
+	Paths []string
+
+	// The lowercase message, author, and paths, for matching queries.
+	message string
+	author  string
+	paths   string
+
+	// The positions of the indexed parents.
+	parents []int
+}
+
+// The contents of an index file.
+type commitIndexFile struct {
+	Version int
+	Commits []indexedCommit
+}
+
+// Return the commit index stored at the given path.
+//
+// Indexes are shared between repositories with the same path and are kept
+// across configuration reloads, so that they are only loaded once.
+func OpenCommitIndex(path string) *CommitIndex {
+	commitIndexesLock.Lock()
+	defer commitIndexesLock.Unlock()
+
+	index, ok := commitIndexes[path]
+	if !ok {
+		index = &CommitIndex{path: path}
+		commitIndexes[path] = index
+	}
+
+	return index
+}
+
+// Return the number of indexed commits.
+func (index *CommitIndex) Len() (int, error) {
+	if err := index.refresh(); err != nil {
+		return 0, err
+	}
+
+	index.lock.RLock()
+	defer index.lock.RUnlock()
+
+	return len(index.commits), nil
+}
+
+// Return the path of the index's journal.
+func (index *CommitIndex) journalPath() string {
+	return index.path + ".journal"
+}
+
+// Return the path of the lock file that is held while the journal is
+// appended to or rotated.
+func (index *CommitIndex) journalLockPath() string {
+	return index.journalPath() + ".lock"
+}
+
+// Return the path that the journal is moved to while it is compacted.
+func (index *CommitIndex) rotatedJournalPath() string {
+	return index.journalPath() + ".compacting"
+}
+
+// Bring the index in memory up to date with the files on disk.
+//
+// The index file is only read when it is first used or when it has been
+// replaced (e.g., by `rb-gateway reindex`). Otherwise, only the commits
+// appended to the journal since it was last read are added. A missing index
+// file, or one in an older format, results in an empty index.
+func (index *CommitIndex) refresh() error {
+	info, err := os.Stat(index.path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	journal, err := os.Stat(index.journalPath())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	index.lock.RLock()
+	current := index.isCurrent(info, journal)
+	index.lock.RUnlock()
+
+	if current {
+		return nil
+	}
+
+	index.lock.Lock()
+	defer index.lock.Unlock()
+
+	if index.isCurrent(info, journal) {
+		return nil
+	}
+
+	if !index.loaded || !fileModTime(info).Equal(index.modTime) {
+		if err = index.loadFile(); err != nil {
+			return err
+		}
+	}
+
+	if err = index.readJournal(); err != nil {
+		return fmt.Errorf(`Could not read commit index journal "%s": %s`, index.journalPath(), err.Error())
+	}
+
+	if index.journalEntries >= maxJournalEntries && atomic.CompareAndSwapInt32(&index.compacting, 0, 1) {
+		go func() {
+			defer atomic.StoreInt32(&index.compacting, 0)
+
+			if err := index.compact(); err != nil {
+				log.Printf(`Could not compact commit index "%s": %s`, index.path, err.Error())
+			}
+		}()
+	}
+
+	return nil
+}
+
+// Return whether or not the index in memory matches the given index file and
+// journal, either of which may be nil if it does not exist.
+//
+// The caller must hold the read lock.
+func (index *CommitIndex) isCurrent(info, journal os.FileInfo) bool {
+	if !index.loaded || !fileModTime(info).Equal(index.modTime) {
+		return false
+	} else if journal == nil || index.journal == nil {
+		return journal == nil && index.journal == nil
+	}
+
+	return os.SameFile(journal, index.journal) && journal.Size() == index.journalOffset
+}
+
+// Return the modification time of a file, or the zero time if it does not
+// exist.
+func fileModTime(info os.FileInfo) time.Time {
+	if info == nil {
+		return time.Time{}
+	}
+
+	return info.ModTime()
+}
+
+// Load the index file, replacing the index in memory.
+//
+// The journal will be read again from the start. The caller must hold the
+// write lock.
+func (index *CommitIndex) loadFile() error {
+	var contents commitIndexFile
+	var modTime time.Time
+
+	file, err := os.Open(index.path)
+	if err == nil {
+		var info os.FileInfo
+		if info, err = file.Stat(); err == nil {
+			modTime = info.ModTime()
+			err = gob.NewDecoder(file).Decode(&contents)
+		}
+		file.Close()
+
+		if err != nil {
+			return fmt.Errorf(`Could not read commit index "%s": %s`, index.path, err.Error())
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	index.commits = nil
+	index.ids = make(map[plumbing.Hash]int)
+	index.modTime = modTime
+	index.journal = nil
+	index.journalOffset = 0
+	index.journalEntries = 0
+
+	if contents.Version == commitIndexVersion {
+		index.add(contents.Commits)
+	}
+
+	index.loaded = true
+	return nil
+}
+
+// Add the commits appended to the journal since it was last read.
+//
+// Only complete lines are read, so that a commit that is still being written
+// is picked up the next time. Lines that cannot be decoded are logged and
+// skipped; their commits are still found by walking the repository, and are
+// added to the index by the next update. The caller must hold the write lock.
+func (index *CommitIndex) readJournal() error {
+	file, err := os.Open(index.journalPath())
+	if os.IsNotExist(err) {
+		index.journal = nil
+		index.journalOffset = 0
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	journal, err := file.Stat()
+	if err != nil {
+		return err
+	} else if index.journal == nil || !os.SameFile(journal, index.journal) || journal.Size() < index.journalOffset {
+		// The journal has been replaced since it was last read.
+		index.journalOffset = 0
+		index.journalEntries = 0
+	}
+
+	if _, err = file.Seek(index.journalOffset, io.SeekStart); err != nil {
+		return err
+	}
+
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		return err
+	}
+
+	end := bytes.LastIndexByte(data, '\n') + 1
+	var added []indexedCommit
+
+	offset := index.journalOffset
+	for _, line := range bytes.Split(data[:end], []byte("\n")) {
+		var entry indexedCommit
+		if len(line) == 0 {
+			// The end of the data.
+		} else if err := json.Unmarshal(line, &entry); err != nil {
+			log.Printf(`WARNING: Skipping invalid entry at offset %d of commit index journal "%s": %s`,
+				offset, index.journalPath(), err.Error())
+		} else {
+			added = append(added, entry)
+		}
+
+		offset += int64(len(line)) + 1
+	}
+
+	index.add(added)
+	index.journal = journal
+	index.journalOffset += int64(end)
+	index.journalEntries += len(added)
+
+	return nil
+}
+
+// Add commits to the index in memory.
+//
+// Commits that are already in the index are skipped. The caller must hold the
+// write lock.
+func (index *CommitIndex) add(commits []indexedCommit) {
+	for _, commit := range commits {
+		hash := plumbing.NewHash(commit.Info.Id)
+		if _, ok := index.ids[hash]; ok {
+			continue
+		}
+
+		commit.message = strings.ToLower(commit.Info.Message)
+		commit.author = strings.ToLower(commit.Info.Author)
+		commit.paths = strings.ToLower(strings.Join(commit.Paths, "\n"))
+		commit.parents = nil
+
+		index.ids[hash] = len(index.commits)
+		index.commits = append(index.commits, commit)
+	}
+
+	// Parents are resolved once every commit has been added, since commits
+	// may be added before their parents.
+	for i := range index.commits {
+		commit := &index.commits[i]
+		if len(commit.parents) == len(commit.Parents) {
+			continue
+		}
+
+		commit.parents = commit.parents[:0]
+		for _, parent := range commit.Parents {
+			if position, ok := index.ids[parent]; ok {
+				commit.parents = append(commit.parents, position)
+			}
+		}
+	}
+}
+
+// Write the index to disk.
+//
+// The index is written to a temporary file first, so that readers never see
+// a partially written index. The caller must hold the read lock.
+func (index *CommitIndex) save() error {
+	dir := filepath.Dir(index.path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	temp, err := ioutil.TempFile(dir, filepath.Base(index.path)+".")
+	if err != nil {
+		return err
+	}
+
+	err = gob.NewEncoder(temp).Encode(commitIndexFile{
+		Version: commitIndexVersion,
+		Commits: index.commits,
+	})
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = os.Rename(temp.Name(), index.path)
+	}
+
+	if err != nil {
+		os.Remove(temp.Name())
+	}
+
+	return err
+}
+
+// Write the index to disk, including every commit in the journal, and remove
+// the journal.
+//
+// The journal is moved aside while its lock is held, after any commits the
+// post-receive hook appended to it have been read, so that commits appended
+// while the index is written go to a new journal. If the index cannot be
+// written, the commits are returned to the journal. The caller must hold the
+// update lock and the write lock.
+func (index *CommitIndex) compactLocked() error {
+	rotated, err := index.rotateJournal()
+	if err != nil {
+		return fmt.Errorf(`Could not rotate commit index journal "%s": %s`, index.journalPath(), err.Error())
+	}
+
+	if err = index.save(); err != nil {
+		if rotated {
+			if restoreErr := index.restoreJournal(); restoreErr != nil {
+				log.Printf(`Could not restore commit index journal "%s": %s`, index.journalPath(), restoreErr.Error())
+			}
+		}
+
+		return fmt.Errorf(`Could not write commit index "%s": %s`, index.path, err.Error())
+	}
+
+	if rotated {
+		if err = os.Remove(index.rotatedJournalPath()); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	info, err := os.Stat(index.path)
+	if err != nil {
+		return err
+	}
+
+	index.modTime = info.ModTime()
+	index.journal = nil
+	index.journalOffset = 0
+	index.journalEntries = 0
+
+	return nil
+}
+
+// Read the rest of the journal and move it aside, returning whether or not
+// there was a journal.
+//
+// The caller must hold the write lock.
+func (index *CommitIndex) rotateJournal() (bool, error) {
+	if err := os.MkdirAll(filepath.Dir(index.path), 0700); err != nil {
+		return false, err
+	}
+
+	lock, err := filelock.Acquire(index.journalLockPath())
+	if err != nil {
+		return false, err
+	}
+	defer lock.Release()
+
+	// A journal that was moved aside by a compaction that did not finish
+	// (e.g., because the server exited) is moved back first. Its commits may
+	// already be in the index file, but they are skipped if they are.
+	if data, err := ioutil.ReadFile(index.rotatedJournalPath()); err == nil {
+		if err = index.writeJournalLocked(data); err != nil {
+			return false, err
+		} else if err = os.Remove(index.rotatedJournalPath()); err != nil {
+			return false, err
+		}
+	} else if !os.IsNotExist(err) {
+		return false, err
+	}
+
+	if err = index.readJournal(); err != nil {
+		return false, err
+	} else if index.journal == nil {
+		return false, nil
+	}
+
+	if err = os.Rename(index.journalPath(), index.rotatedJournalPath()); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// Append a journal that was moved aside by rotateJournal() back onto the
+// journal.
+//
+// This is used when the index could not be written, so that the commits in
+// the journal are not lost.
+func (index *CommitIndex) restoreJournal() error {
+	lock, err := filelock.Acquire(index.journalLockPath())
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	data, err := ioutil.ReadFile(index.rotatedJournalPath())
+	if err != nil {
+		return err
+	}
+
+	if err = index.writeJournalLocked(data); err != nil {
+		return err
+	}
+
+	return os.Remove(index.rotatedJournalPath())
+}
+
+// Compact the journal into the index file.
+func (index *CommitIndex) compact() error {
+	index.updateLock.Lock()
+	defer index.updateLock.Unlock()
+
+	if err := index.refresh(); err != nil {
+		return err
+	}
+
+	index.lock.Lock()
+	defer index.lock.Unlock()
+
+	if index.journal == nil {
+		return nil
+	}
+
+	return index.compactLocked()
+}
+
+// Append commits to the journal.
+//
+// The commits are written in a single append, so that a concurrent reader
+// never sees part of a commit.
+func (index *CommitIndex) appendJournal(commits []indexedCommit) error {
+	var data bytes.Buffer
+	encoder := json.NewEncoder(&data)
+
+	for _, commit := range commits {
+		if err := encoder.Encode(commit); err != nil {
+			return err
+		}
+	}
+
+	return index.appendJournalData(data.Bytes())
+}
+
+// Append encoded commits to the journal while holding its lock.
+func (index *CommitIndex) appendJournalData(data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(index.path), 0700); err != nil {
+		return err
+	}
+
+	lock, err := filelock.Acquire(index.journalLockPath())
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	return index.writeJournalLocked(data)
+}
+
+// Append encoded commits to the journal.
+//
+// The caller must hold the journal's lock.
+func (index *CommitIndex) writeJournalLocked(data []byte) error {
+	file, err := os.OpenFile(index.journalPath(), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// Return the position of a commit in the index.
+//
+// The caller must hold the read lock.
+func (index *CommitIndex) position(hash plumbing.Hash) (int, bool) {
+	if index == nil {
+		return 0, false
+	}
+
+	position, ok := index.ids[hash]
+	return position, ok
+}
+
+// Update the index with the commits on a repository's branches that have not
+// been indexed yet, returning how many were added.
+//
+// Commits that are no longer on any branch are kept, but are never returned
+// by searches.
+func (repo *GitRepository) UpdateIndex() (int, error) {
+	index := repo.Index
+	if index == nil {
+		return 0, fmt.Errorf(`Repository "%s" does not have a commit index.`, repo.Name)
+	}
+
+	index.updateLock.Lock()
+	defer index.updateLock.Unlock()
+
+	if err := index.refresh(); err != nil {
+		return 0, err
+	}
+
+	gitRepo, err := repo.open()
+	if err != nil {
+		return 0, err
+	}
+
+	heads, err := gitBranchHeads(gitRepo)
+	if err != nil {
+		return 0, err
+	}
+
+	var added []indexedCommit
+
+	index.lock.RLock()
+	_, err = walkUnindexedCommits(gitRepo, index, heads, func(commit *object.Commit) error {
+		entry, err := newIndexedCommit(commit)
+		if err != nil {
+			return err
+		}
+
+		added = append(added, entry)
+		return nil
+	})
+	index.lock.RUnlock()
+
+	if err != nil {
+		return 0, err
+	}
+
+	index.lock.Lock()
+	defer index.lock.Unlock()
+
+	if len(added) == 0 && index.journal == nil {
+		return 0, nil
+	}
+
+	index.add(added)
+
+	if err = index.compactLocked(); err != nil {
+		return 0, err
+	}
+
+	return len(added), nil
+}
+
+// Rebuild a repository's commit index from scratch, returning how many
+// commits were indexed.
+//
+// Unlike UpdateIndex, the existing index and its journal are discarded, so
+// commits that are no longer on any branch are removed.
+func (repo *GitRepository) RebuildIndex() (int, error) {
+	index := repo.Index
+	if index == nil {
+		return 0, fmt.Errorf(`Repository "%s" does not have a commit index.`, repo.Name)
+	}
+
+	index.updateLock.Lock()
+	defer index.updateLock.Unlock()
+
+	gitRepo, err := repo.open()
+	if err != nil {
+		return 0, err
+	}
+
+	heads, err := gitBranchHeads(gitRepo)
+	if err != nil {
+		return 0, err
+	}
+
+	var commits []indexedCommit
+	_, err = walkUnindexedCommits(gitRepo, nil, heads, func(commit *object.Commit) error {
+		entry, err := newIndexedCommit(commit)
+		if err != nil {
+			return err
+		}
+
+		commits = append(commits, entry)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	index.lock.Lock()
+	defer index.lock.Unlock()
+
+	index.commits = nil
+	index.ids = make(map[plumbing.Hash]int)
+	index.loaded = true
+	index.add(commits)
+
+	if err = index.compactLocked(); err != nil {
+		return 0, err
+	}
+
+	return len(commits), nil
+}
+
+// Add the commits in a push to a repository's commit index, returning how
+// many were added.
+//
+// This is run by the post-receive hook, so the commits are appended to the
+// index's journal rather than loading and rewriting the whole index. The
+// server adds them to the index in memory the next time it is used.
+func (repo *GitRepository) IndexPushedCommits(payload events.PushPayload) (int, error) {
+	index := repo.Index
+	if index == nil {
+		return 0, fmt.Errorf(`Repository "%s" does not have a commit index.`, repo.Name)
+	}
+
+	if len(payload.Commits) == 0 {
+		return 0, nil
+	}
+
+	gitRepo, err := repo.open()
+	if err != nil {
+		return 0, err
+	}
+
+	commits := make([]indexedCommit, 0, len(payload.Commits))
+	for _, pushed := range payload.Commits {
+		commit, err := object.GetCommit(gitRepo.Storer, plumbing.NewHash(pushed.Id))
+		if err != nil {
+			return 0, err
+		}
+
+		entry, err := newIndexedCommit(commit)
+		if err != nil {
+			return 0, err
+		}
+
+		commits = append(commits, entry)
+	}
+
+	if err = index.appendJournal(commits); err != nil {
+		return 0, fmt.Errorf(`Could not write commit index journal "%s": %s`, index.journalPath(), err.Error())
+	}
+
+	return len(commits), nil
+}
+
+// Return an index entry for a commit.
+func newIndexedCommit(commit *object.Commit) (indexedCommit, error) {
+	added, modified, removed, err := gitCommitFileChanges(commit)
+	if err != nil {
+		return indexedCommit{}, err
+	}
+
+	paths := make([]string, 0, len(added)+len(modified)+len(removed))
+	paths = append(paths, added...)
+	paths = append(paths, modified...)
+	paths = append(paths, removed...)
+
+	return indexedCommit{
+		Info:    newGitCommitInfo(commit),
+		Parents: commit.ParentHashes,
+		Time:    commit.Committer.When.Unix(),
+		Paths:   paths,
+	}, nil
+}
+
+// Return the heads of every branch in a repository.
+func gitBranchHeads(gitRepo *git.Repository) ([]plumbing.Hash, error) {
+	refs, err := gitRepo.Branches()
+	if err != nil {
+		return nil, err
+	}
+
+	var heads []plumbing.Hash
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		heads = append(heads, ref.Hash())
+		return nil
+	})
+
+	return heads, err
+}
+
+// Call a function for each commit reachable from the given heads that is not
+// in the index.
+//
+// The history behind indexed commits is not walked, except for parents that
+// are not indexed (e.g., because the post-receive hook only journaled the
+// pushed commits); instead, the indexed commits that were reached are
+// returned. The index may be nil, in which case every reachable commit is
+// visited. The caller must hold the index's read lock.
+func walkUnindexedCommits(gitRepo *git.Repository, index *CommitIndex, heads []plumbing.Hash, fn func(commit *object.Commit) error) ([]plumbing.Hash, error) {
+	seen := make(map[plumbing.Hash]bool)
+	stack := append([]plumbing.Hash(nil), heads...)
+	var indexed []plumbing.Hash
+
+	for len(stack) > 0 {
+		hash := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		if seen[hash] {
+			continue
+		}
+		seen[hash] = true
+
+		if position, ok := index.position(hash); ok {
+			indexed = append(indexed, hash)
+
+			for _, parent := range index.commits[position].Parents {
+				if _, ok := index.position(parent); !ok {
+					stack = append(stack, parent)
+				}
+			}
+
+			continue
+		}
+
+		commit, err := object.GetCommit(gitRepo.Storer, hash)
+		if err != nil {
+			return nil, err
+		}
+
+		if err = fn(commit); err != nil {
+			return nil, err
+		}
+
+		stack = append(stack, commit.ParentHashes...)
+	}
+
+	return indexed, nil
+}
+
+// A commit that matched a search.
+type commitSearchResult struct {
+	info CommitInfo
+	time int64
+}
+
+// Return the indexed commits reachable from the given commits that match a
+// query.
+//
+// The query must be lowercase. The caller must hold the read lock.
+func (index *CommitIndex) search(heads []plumbing.Hash, query string, authors, paths bool) []commitSearchResult {
+	var results []commitSearchResult
+	visited := make([]bool, len(index.commits))
+
+	var stack []int
+	for _, head := range heads {
+		if position, ok := index.position(head); ok {
+			stack = append(stack, position)
+		}
+	}
+
+	for len(stack) > 0 {
+		position := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		if visited[position] {
+			continue
+		}
+		visited[position] = true
+
+		commit := &index.commits[position]
+		if strings.Contains(commit.message, query) ||
+			(authors && strings.Contains(commit.author, query)) ||
+			(paths && strings.Contains(commit.paths, query)) {
+			results = append(results, commitSearchResult{commit.Info, commit.Time})
+		}
+
+		stack = append(stack, commit.parents...)
+	}
+
+	return results
+}
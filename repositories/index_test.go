@@ -0,0 +1,292 @@
+package repositories_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+
+	"github.com/reviewboard/rb-gateway/helpers"
+	"github.com/reviewboard/rb-gateway/repositories"
+	"github.com/reviewboard/rb-gateway/repositories/events"
+)
+
+func TestSearchCommitsIndexed(t *testing.T) {
+	assert := assert.New(t)
+
+	repo, rawRepo := helpers.CreateGitRepo(t, "repo")
+	defer helpers.CleanupRepository(t, repo.Path)
+
+	seedId := helpers.SeedGitRepo(t, repo, rawRepo)
+	branch := helpers.CreateGitBranch(t, repo, rawRepo)
+
+	indexDir, err := ioutil.TempDir("", "rb-gateway-index-")
+	assert.Nil(err)
+	defer os.RemoveAll(indexDir)
+
+	indexPath := filepath.Join(indexDir, "repo.idx")
+	repo.Index = repositories.OpenCommitIndex(indexPath)
+
+	added, err := repo.UpdateIndex()
+	assert.Nil(err)
+	assert.Equal(2, added)
+	assert.FileExists(indexPath)
+
+	// Commits made after the index was updated are still found.
+	worktree, err := rawRepo.Worktree()
+	assert.Nil(err)
+
+	fixId, err := worktree.Commit("Fix the frobnicator", &git.CommitOptions{
+		Author: &object.Signature{
+			Name:  "Someone Else",
+			Email: "someone@example.com",
+			When:  time.Now().Add(time.Second),
+		},
+	})
+	assert.Nil(err)
+
+	commits, err := repo.SearchCommits("COMMIT", "", false, false)
+	assert.Nil(err)
+	if assert.Equal(1, len(commits)) {
+		assert.Equal(seedId.String(), commits[0].Id)
+	}
+
+	commits, err = repo.SearchCommits("frob", "", false, false)
+	assert.Nil(err)
+	if assert.Equal(1, len(commits)) {
+		assert.Equal(fixId.String(), commits[0].Id)
+	}
+
+	commits, err = repo.SearchCommits("frob", "master", false, false)
+	assert.Nil(err)
+	assert.Equal(0, len(commits))
+
+	commits, err = repo.SearchCommits("someone", "", true, false)
+	assert.Nil(err)
+	if assert.Equal(1, len(commits)) {
+		assert.Equal(fixId.String(), commits[0].Id)
+	}
+
+	// Searching paths.
+	commits, err = repo.SearchCommits("authors", "", false, false)
+	assert.Nil(err)
+	assert.Equal(0, len(commits))
+
+	commits, err = repo.SearchCommits("authors", "", false, true)
+	assert.Nil(err)
+	if assert.Equal(1, len(commits)) {
+		assert.Equal(branch.Hash().String(), commits[0].Id)
+	}
+
+	commits, err = repo.SearchCommits("copying", "master", false, true)
+	assert.Nil(err)
+	if assert.Equal(1, len(commits)) {
+		assert.Equal(seedId.String(), commits[0].Id)
+	}
+
+	// Only new commits are added.
+	added, err = repo.UpdateIndex()
+	assert.Nil(err)
+	assert.Equal(1, added)
+
+	added, err = repo.UpdateIndex()
+	assert.Nil(err)
+	assert.Equal(0, added)
+
+	count, err := repo.Index.Len()
+	assert.Nil(err)
+	assert.Equal(3, count)
+
+	commits, err = repo.SearchCommits("frob", "", false, false)
+	assert.Nil(err)
+	if assert.Equal(1, len(commits)) {
+		assert.Equal(fixId.String(), commits[0].Id)
+	}
+}
+
+func TestIndexPushedCommits(t *testing.T) {
+	assert := assert.New(t)
+
+	repo, rawRepo := helpers.CreateGitRepo(t, "repo")
+	defer helpers.CleanupRepository(t, repo.Path)
+
+	helpers.SeedGitRepo(t, repo, rawRepo)
+
+	indexDir, err := ioutil.TempDir("", "rb-gateway-index-")
+	assert.Nil(err)
+	defer os.RemoveAll(indexDir)
+
+	indexPath := filepath.Join(indexDir, "repo.idx")
+	journalPath := indexPath + ".journal"
+	repo.Index = repositories.OpenCommitIndex(indexPath)
+
+	added, err := repo.UpdateIndex()
+	assert.Nil(err)
+	assert.Equal(1, added)
+
+	worktree, err := rawRepo.Worktree()
+	assert.Nil(err)
+
+	fixId, err := worktree.Commit("Fix the frobnicator", &git.CommitOptions{
+		Author: &object.Signature{
+			Name:  "Someone Else",
+			Email: "someone@example.com",
+			When:  time.Now().Add(time.Second),
+		},
+	})
+	assert.Nil(err)
+
+	added, err = repo.IndexPushedCommits(events.PushPayload{
+		Repository: repo.Name,
+		Commits: []events.PushPayloadCommit{
+			{Id: fixId.String()},
+		},
+	})
+	assert.Nil(err)
+	assert.Equal(1, added)
+	assert.FileExists(journalPath)
+
+	// The journal is read without rewriting the index.
+	count, err := repo.Index.Len()
+	assert.Nil(err)
+	assert.Equal(2, count)
+
+	commits, err := repo.SearchCommits("frob", "", false, false)
+	assert.Nil(err)
+	if assert.Equal(1, len(commits)) {
+		assert.Equal(fixId.String(), commits[0].Id)
+	}
+
+	// A commit that is still being written is not read.
+	journal, err := os.OpenFile(journalPath, os.O_WRONLY|os.O_APPEND, 0600)
+	assert.Nil(err)
+	_, err = journal.Write([]byte(`{"Info":`))
+	assert.Nil(err)
+	assert.Nil(journal.Close())
+
+	count, err = repo.Index.Len()
+	assert.Nil(err)
+	assert.Equal(2, count)
+
+	// Updating the index compacts the journal into the index file.
+	added, err = repo.UpdateIndex()
+	assert.Nil(err)
+	assert.Equal(0, added)
+
+	_, err = os.Stat(journalPath)
+	assert.True(os.IsNotExist(err))
+
+	count, err = repo.Index.Len()
+	assert.Nil(err)
+	assert.Equal(2, count)
+}
+
+func TestRebuildIndex(t *testing.T) {
+	assert := assert.New(t)
+
+	repo, rawRepo := helpers.CreateGitRepo(t, "repo")
+	defer helpers.CleanupRepository(t, repo.Path)
+
+	helpers.SeedGitRepo(t, repo, rawRepo)
+	branch := helpers.CreateGitBranch(t, repo, rawRepo)
+
+	indexDir, err := ioutil.TempDir("", "rb-gateway-index-")
+	assert.Nil(err)
+	defer os.RemoveAll(indexDir)
+
+	indexPath := filepath.Join(indexDir, "repo.idx")
+	repo.Index = repositories.OpenCommitIndex(indexPath)
+
+	added, err := repo.UpdateIndex()
+	assert.Nil(err)
+	assert.Equal(2, added)
+
+	// Commits that are no longer on any branch are dropped.
+	assert.Nil(rawRepo.Storer.RemoveReference(branch.Name()))
+
+	count, err := repo.RebuildIndex()
+	assert.Nil(err)
+	assert.Equal(1, count)
+
+	count, err = repo.Index.Len()
+	assert.Nil(err)
+	assert.Equal(1, count)
+
+	commits, err := repo.SearchCommits("authors", "", false, true)
+	assert.Nil(err)
+	assert.Equal(0, len(commits))
+}
+
+func TestIndexPushedCommitsUnindexedParents(t *testing.T) {
+	assert := assert.New(t)
+
+	repo, rawRepo := helpers.CreateGitRepo(t, "repo")
+	defer helpers.CleanupRepository(t, repo.Path)
+
+	seedId := helpers.SeedGitRepo(t, repo, rawRepo)
+
+	indexDir, err := ioutil.TempDir("", "rb-gateway-index-")
+	assert.Nil(err)
+	defer os.RemoveAll(indexDir)
+
+	indexPath := filepath.Join(indexDir, "repo.idx")
+	journalPath := indexPath + ".journal"
+	repo.Index = repositories.OpenCommitIndex(indexPath)
+
+	worktree, err := rawRepo.Worktree()
+	assert.Nil(err)
+
+	fixId, err := worktree.Commit("Fix the frobnicator", &git.CommitOptions{
+		Author: &object.Signature{
+			Name:  "Someone Else",
+			Email: "someone@example.com",
+			When:  time.Now().Add(time.Second),
+		},
+	})
+	assert.Nil(err)
+
+	// An entry that cannot be decoded is skipped, and the entries after it
+	// are still read.
+	assert.Nil(ioutil.WriteFile(journalPath, []byte("not json\n"), 0600))
+
+	// Only the pushed commit is journaled, so its parent is not indexed.
+	added, err := repo.IndexPushedCommits(events.PushPayload{
+		Repository: repo.Name,
+		Commits: []events.PushPayloadCommit{
+			{Id: fixId.String()},
+		},
+	})
+	assert.Nil(err)
+	assert.Equal(1, added)
+
+	count, err := repo.Index.Len()
+	assert.Nil(err)
+	assert.Equal(1, count)
+
+	// The history behind the indexed commit is still searched.
+	commits, err := repo.SearchCommits("initial", "", false, false)
+	assert.Nil(err)
+	if assert.Equal(1, len(commits)) {
+		assert.Equal(seedId.String(), commits[0].Id)
+	}
+
+	// And it is added to the index by the next update.
+	added, err = repo.UpdateIndex()
+	assert.Nil(err)
+	assert.Equal(1, added)
+
+	count, err = repo.Index.Len()
+	assert.Nil(err)
+	assert.Equal(2, count)
+
+	_, err = os.Stat(journalPath)
+	assert.True(os.IsNotExist(err))
+
+	_, err = os.Stat(journalPath + ".compacting")
+	assert.True(os.IsNotExist(err))
+}
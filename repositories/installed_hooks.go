@@ -0,0 +1,127 @@
+package repositories
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/go-ini/ini"
+)
+
+// A hook that rb-gateway installs into repositories.
+type InstalledHook struct {
+	// The name of the hook (e.g., `post-receive`).
+	Hook string `json:"hook"`
+
+	// The event the hook dispatches.
+	Event string `json:"event"`
+
+	// Whether or not the hook is installed.
+	Installed bool `json:"installed"`
+
+	// The command the hook runs, if it is installed.
+	Command string `json:"command,omitempty"`
+}
+
+// Return the state of the hooks that rb-gateway installs into a repository.
+//
+// This reads the repository's hook files without changing them, so that
+// problems with webhooks not being triggered can be diagnosed (e.g., hooks
+// that still point at a previous configuration file).
+func GetInstalledHooks(repo Repository) ([]InstalledHook, error) {
+	switch repo := repo.(type) {
+	case *GitRepository:
+		return repo.installedHooks()
+
+	case *HgRepository:
+		return repo.installedHooks()
+
+	default:
+		return nil, fmt.Errorf(`Unknown SCM "%s"`, repo.GetScm())
+	}
+}
+
+// Return the state of the hooks installed by InstallHooks.
+func (repo *GitRepository) installedHooks() ([]InstalledHook, error) {
+	hookDir, shared, err := repo.hookDir()
+	if err != nil {
+		return nil, err
+	}
+
+	installed := []InstalledHook{}
+
+	for event, hookName := range gitEvents {
+		hook := InstalledHook{
+			Hook:  hookName,
+			Event: event,
+		}
+
+		dispatchPath := filepath.Join(hookDir, hookName)
+		scriptPath := filepath.Join(hookDir, fmt.Sprintf("%s.d", hookName), gitHookScriptName(repo.Name, event, shared))
+
+		if _, err := os.Stat(dispatchPath); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		} else if err == nil {
+			script, err := ioutil.ReadFile(scriptPath)
+			if err != nil && !os.IsNotExist(err) {
+				return nil, err
+			} else if err == nil {
+				// The script is a shebang followed by the command, which may be
+				// preceded by a check for the repository.
+				lines := strings.Split(strings.TrimSpace(string(script)), "\n")
+
+				hook.Installed = true
+				hook.Command = strings.TrimPrefix(lines[len(lines)-1], "exec ")
+			}
+		}
+
+		installed = append(installed, hook)
+	}
+
+	sortInstalledHooks(installed)
+	return installed, nil
+}
+
+// Return the state of the hooks installed by InstallHooks.
+func (repo *HgRepository) installedHooks() ([]InstalledHook, error) {
+	hgrc, err := ini.Load(filepath.Join(repo.Path, ".hg", "hgrc"))
+	if os.IsNotExist(err) {
+		hgrc = ini.Empty()
+	} else if err != nil {
+		return nil, err
+	}
+
+	hookSection := hgrc.Section("hooks")
+	installed := []InstalledHook{}
+
+	for _, eventHooks := range []map[string][]string{hgEvents, hgGatingEvents} {
+		for event, hookNames := range eventHooks {
+			for _, hookName := range hookNames {
+				hook := InstalledHook{
+					Hook:  hookName,
+					Event: event,
+				}
+
+				if key := fmt.Sprintf("%s.rbgateway", hookName); hookSection.HasKey(key) {
+					hook.Installed = true
+					hook.Command = hookSection.Key(key).String()
+				}
+
+				installed = append(installed, hook)
+			}
+		}
+	}
+
+	sortInstalledHooks(installed)
+	return installed, nil
+}
+
+// Sort hooks by name.
+func sortInstalledHooks(hooks []InstalledHook) {
+	sort.Slice(hooks, func(i, j int) bool {
+		return hooks[i].Hook < hooks[j].Hook
+	})
+}
@@ -2,22 +2,223 @@ package repositories
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/reviewboard/rb-gateway/repositories/events"
 	"github.com/reviewboard/rb-gateway/repositories/hooks"
 )
 
+const (
+	// The default number of webhooks that will be dispatched concurrently.
+	DefaultWebhookWorkers = 4
+
+	// The default number of times a delivery that failed is retried before
+	// it is kept as a dead letter.
+	DefaultDeliveryRetries = 2
+
+	// The default delay before the first retry of a delivery. Each later
+	// retry waits twice as long as the one before.
+	DefaultRetryDelay = time.Second
+
+	// The maximum size of a response to a gating event that will be read.
+	maxGatingResponseSize = 64 * 1024
+)
+
+// An error indicating that a webhook rejected a gating event.
+type HookRejectedErr struct {
+	// The ID of the webhook.
+	HookId string
+
+	// The reason given by the webhook, if any.
+	Message string
+}
+
+// Return the error message.
+func (e *HookRejectedErr) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf(`Rejected by webhook "%s".`, e.HookId)
+	}
+
+	return fmt.Sprintf(`Rejected by webhook "%s": %s`, e.HookId, e.Message)
+}
+
+// An error indicating that webhooks rejected a gating event.
+//
+// The message includes the reason given by each webhook, so that it can be
+// shown to the user whose operation was rejected.
+type PushRejectedErr struct {
+	// The rejections, in the order the webhooks responded.
+	Rejections []*HookRejectedErr
+}
+
+// Return the error message.
+func (e *PushRejectedErr) Error() string {
+	messages := make([]string, len(e.Rejections))
+	for i, rejection := range e.Rejections {
+		messages[i] = rejection.Error()
+	}
+
+	return strings.Join(messages, "\n")
+}
+
+// An error indicating that a webhook responded with a non-2XX status code.
+type HTTPStatusErr struct {
+	// The status code of the response.
+	StatusCode int
+
+	// The status line of the response.
+	Status string
+}
+
+// Return the error message.
+func (e *HTTPStatusErr) Error() string {
+	return fmt.Sprintf("Expected status 2XX, received %s.", e.Status)
+}
+
+// The response to a gating event.
+type gatingResponse struct {
+	// Whether or not the operation should be allowed.
+	//
+	// If absent, the operation is allowed.
+	Accept *bool `json:"accept"`
+
+	// An optional message to show the user.
+	Message string `json:"message"`
+}
+
+// A dispatcher for webhooks.
+//
+// Webhooks are delivered concurrently by a bounded pool of workers so that a
+// push with many configured webhooks, or slow webhook endpoints, does not
+// delay the client for the sum of all delivery times.
+type Dispatcher struct {
+	// The client used to deliver webhooks.
+	Client *http.Client
+
+	// The maximum number of webhooks to deliver concurrently.
+	Workers int
+
+	// The maximum time to wait for a single webhook to be delivered.
+	//
+	// Hooks may override this with their own timeout. If zero, there is no
+	// timeout.
+	Timeout time.Duration
+
+	// The number of times a delivery is retried after a failure that may be
+	// temporary (e.g., a timeout or an HTTP 503).
+	//
+	// Deliveries of gating events, which must not hold up the operation, and
+	// redrives are never retried.
+	Retries int
+
+	// The delay before the first retry, which is doubled for each retry
+	// after it.
+	RetryDelay time.Duration
+
+	// An optional notifier for operators when deliveries fail.
+	Notifier Notifier
+
+	// The fraction of deliveries for a single event that must fail before
+	// Notifier is notified.
+	//
+	// If zero, any failure results in a notification.
+	ErrorRateThreshold float64
+
+	// An optional store to record the result of each delivery in.
+	StatusStore *hooks.DeliveryStatusStore
+
+	// An optional store to keep payloads that could not be delivered in, so
+	// that they can be redriven later.
+	DeadLetters *hooks.DeadLetterStore
+
+	// The default secrets for hooks that do not have their own.
+	Secrets hooks.SecretDefaults
+
+	// The key for decrypting hook secrets that are encrypted at rest.
+	//
+	// If nil, hooks with encrypted secrets cannot be delivered.
+	SecretsKey *hooks.SecretsKey
+
+	// Whether or not gating events are rejected when a webhook cannot be
+	// delivered (e.g., because it could not be reached or responded with a
+	// non-2XX status code).
+	//
+	// By default, only webhooks that explicitly reject a gating event (see
+	// checkGatingResponse()) reject the operation, so an unavailable webhook
+	// does not block every push.
+	RejectOnDeliveryFailure bool
+
+	// Artificial failures and latency to inject into deliveries, for testing.
+	//
+	// NewDispatcher sets this from the environment. See FaultInjectionVar.
+	Faults *FaultInjection
+}
+
+// A webhook delivery queued by a Dispatcher.
+type webhookJob struct {
+	hook    hooks.Webhook
+	payload []byte
+}
+
+// Create a new webhook dispatcher.
+//
+// If `workers` is not positive, DefaultWebhookWorkers will be used. If
+// FaultInjectionVar is set, faults are injected into deliveries.
+func NewDispatcher(client *http.Client, workers int, timeout time.Duration) *Dispatcher {
+	if workers <= 0 {
+		workers = DefaultWebhookWorkers
+	}
+
+	faults, err := FaultInjectionFromEnv()
+	if err != nil {
+		log.Printf("Not injecting delivery faults: %s", err.Error())
+	}
+
+	return &Dispatcher{
+		Client:     client,
+		Workers:    workers,
+		Timeout:    timeout,
+		Retries:    DefaultDeliveryRetries,
+		RetryDelay: DefaultRetryDelay,
+		Faults:     faults,
+	}
+}
+
 // Invoke all webhooks that match the given event and repository.
+//
+// The webhooks are delivered with a default Dispatcher that has no timeout.
 func InvokeAllHooks(
 	client *http.Client,
 	store hooks.WebhookStore,
 	event string,
 	repository Repository,
 	payload events.Payload,
+) error {
+	return NewDispatcher(client, DefaultWebhookWorkers, 0).InvokeAllHooks(store, event, repository, payload)
+}
+
+// Invoke all webhooks that match the given event and repository.
+//
+// This returns once every webhook has either been delivered, failed, or timed
+// out. Callers that must not wait for delivery (e.g., hooks) queue events or
+// call this from a background process instead.
+func (d *Dispatcher) InvokeAllHooks(
+	store hooks.WebhookStore,
+	event string,
+	repository Repository,
+	payload events.Payload,
 ) error {
 	if !events.IsValidEvent(event) {
 		return fmt.Errorf(`Unknown event type "%s"`, event)
@@ -28,59 +229,458 @@ func InvokeAllHooks(
 		return err
 	}
 
+	jobs := []webhookJob{}
 	errs := store.ForEach(event, repository.GetName(), func(hook hooks.Webhook) error {
-		err := invokeHook(client, event, repository, hook, rawPayload)
-		if err != nil {
-			log.Printf(`Error ocurred while processing hook "%s" for URL "%s": %s`,
-				hook.Id, hook.Url, err.Error())
+		hookPayloads := [][]byte{rawPayload}
+
+		if hook.HasFilters() || hook.HasCustomPayload() {
+			filtered := hook.FilterPayload(payload)
+			if filtered == nil {
+				return nil
+			}
+
+			var err error
+			if hookPayloads, err = hook.MarshalPayloads(filtered); err != nil {
+				return err
+			}
 		}
 
-		return err
+		for _, hookPayload := range hookPayloads {
+			jobs = append(jobs, webhookJob{hook, hookPayload})
+		}
+
+		return nil
 	})
 
-	if errs != nil {
+	failures := d.run(event, repository, jobs)
+	for _, failure := range failures {
+		errs = append(errs, failure.err)
+	}
+
+	deliveryFailures := 0
+	for _, failure := range failures {
+		if _, rejected := failure.err.(*HookRejectedErr); !rejected {
+			deliveryFailures++
+		}
+	}
+
+	if d.Notifier != nil && deliveryFailures != 0 &&
+		float64(deliveryFailures)/float64(len(jobs)) >= d.ErrorRateThreshold {
+		notification := Notification{
+			Event:      event,
+			Repository: repository.GetName(),
+			Total:      len(jobs),
+			Failures:   make([]DeliveryFailure, 0, deliveryFailures),
+		}
+
+		for _, failure := range failures {
+			if _, rejected := failure.err.(*HookRejectedErr); rejected {
+				continue
+			}
+
+			notification.Failures = append(notification.Failures, DeliveryFailure{
+				HookId: failure.hook.Id,
+				Url:    failure.hook.DisplayUrl(event, repository.GetName()),
+				Error:  failure.err.Error(),
+			})
+		}
+
+		if err := d.Notifier.Notify(notification); err != nil {
+			log.Printf("Could not send delivery failure notification: %s", err.Error())
+		}
+	}
+
+	if events.IsGatingEvent(event) {
+		return d.gatingResult(errs, failures)
+	}
+
+	if len(errs) != 0 {
 		return fmt.Errorf("%d errors occurred wihle processing webhooks", len(errs))
 	}
 
 	return nil
 }
 
+// Return whether the operation that triggered a gating event is rejected.
+//
+// If any webhooks rejected the event, a PushRejectedErr with their reasons is
+// returned. Other errors only reject the operation if
+// RejectOnDeliveryFailure is set.
+func (d *Dispatcher) gatingResult(errs []error, failures []webhookFailure) error {
+	rejected := &PushRejectedErr{}
+	for _, failure := range failures {
+		if rejection, ok := failure.err.(*HookRejectedErr); ok {
+			rejected.Rejections = append(rejected.Rejections, rejection)
+		}
+	}
+
+	if len(rejected.Rejections) != 0 {
+		return rejected
+	}
+
+	deliveryErrs := len(errs)
+	if deliveryErrs == 0 {
+		return nil
+	} else if d.RejectOnDeliveryFailure {
+		return fmt.Errorf("%d webhooks could not be delivered: %s", deliveryErrs, errs[0].Error())
+	}
+
+	log.Printf("Accepting the operation even though %d webhooks could not be delivered.", deliveryErrs)
+	return nil
+}
+
+// A failed webhook delivery.
+type webhookFailure struct {
+	hook hooks.Webhook
+	err  error
+}
+
+// Deliver the queued webhooks using the worker pool.
+//
+// All failed deliveries are returned.
+func (d *Dispatcher) run(event string, repository Repository, jobs []webhookJob) []webhookFailure {
+	queue := make(chan webhookJob)
+	results := make(chan webhookFailure, len(jobs))
+
+	workers := d.Workers
+	if workers > len(jobs) {
+		workers = len(jobs)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(workers)
+
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+
+			for job := range queue {
+				attempts, err := d.deliverWithRetries(event, repository, job)
+				if err != nil {
+					log.Printf(`Error ocurred while processing hook "%s" for URL "%s": %s`,
+						job.hook.Id, job.hook.DisplayUrl(event, repository.GetName()), err.Error())
+				}
+
+				d.recordStatus(event, repository, job.hook, err)
+
+				if err != nil {
+					d.addDeadLetter(event, repository, job, attempts, err)
+				}
+
+				results <- webhookFailure{job.hook, err}
+			}
+		}()
+	}
+
+	for _, job := range jobs {
+		queue <- job
+	}
+	close(queue)
+
+	wg.Wait()
+	close(results)
+
+	failures := []webhookFailure{}
+	for result := range results {
+		if result.err != nil {
+			failures = append(failures, result)
+		}
+	}
+
+	return failures
+}
+
+// Deliver a webhook, retrying failures that may be temporary.
+//
+// This returns the number of deliveries that were attempted and the error of
+// the last one.
+func (d *Dispatcher) deliverWithRetries(event string, repository Repository, job webhookJob) (int, error) {
+	delay := d.RetryDelay
+
+	for attempt := 1; ; attempt++ {
+		err := d.deliver(event, repository, job)
+		if err == nil || attempt > d.Retries || events.IsGatingEvent(event) || !isRetryable(err) {
+			return attempt, err
+		}
+
+		log.Printf(`Retrying hook "%s" in %s: %s`, job.hook.Id, delay, err.Error())
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// Return whether or not a failed delivery may succeed if it is retried.
+//
+// Rejections and client errors are not retried, since the webhook would
+// respond the same way again.
+func isRetryable(err error) bool {
+	reason, statusCode := classifyDeliveryError(err)
+
+	switch reason {
+	case hooks.DeliveryReasonDNS, hooks.DeliveryReasonTimeout, hooks.DeliveryReasonConnection:
+		return true
+
+	case hooks.DeliveryReasonHTTPStatus:
+		return statusCode >= 500 ||
+			statusCode == http.StatusRequestTimeout ||
+			statusCode == http.StatusTooManyRequests
+
+	default:
+		return false
+	}
+}
+
+// Record the result of a delivery in the status store, if there is one.
+func (d *Dispatcher) recordStatus(event string, repository Repository, hook hooks.Webhook, err error) {
+	if d.StatusStore == nil {
+		return
+	}
+
+	status := hooks.DeliveryStatus{
+		Time:       time.Now().UTC(),
+		Event:      event,
+		Repository: repository.GetName(),
+		Success:    err == nil,
+	}
+
+	if err != nil {
+		status.Reason, status.StatusCode = classifyDeliveryError(err)
+		status.Error = err.Error()
+	}
+
+	if recordErr := d.StatusStore.Record(hook.Id, status); recordErr != nil {
+		log.Printf(`Could not record delivery status for hook "%s": %s`, hook.Id, recordErr.Error())
+	}
+}
+
+// Keep a payload that could not be delivered in the dead letter store, if there
+// is one.
+//
+// Payloads for gating events are not kept, since they cannot be delivered
+// after the operation has completed.
+func (d *Dispatcher) addDeadLetter(event string, repository Repository, job webhookJob, attempts int, err error) {
+	if d.DeadLetters == nil || events.IsGatingEvent(event) {
+		return
+	}
+
+	letter := hooks.DeadLetter{
+		HookId:     job.hook.Id,
+		Event:      event,
+		Repository: repository.GetName(),
+		Time:       time.Now().UTC(),
+		Attempts:   attempts,
+		Error:      err.Error(),
+		Payload:    string(job.payload),
+	}
+	letter.Reason, letter.StatusCode = classifyDeliveryError(err)
+
+	if addErr := d.DeadLetters.Add(&letter); addErr != nil {
+		log.Printf(`Could not keep undelivered payload for hook "%s": %s`, job.hook.Id, addErr.Error())
+	}
+}
+
+// Deliver a payload from the dead letter store again.
+//
+// The dead letter is claimed first, so that it is only delivered once if it
+// is redriven more than once at the same time. If it has already been claimed
+// or removed, an error satisfying `os.IsNotExist` is returned. If the delivery
+// succeeds, the dead letter is removed from the store. Otherwise, it is
+// updated with the new error and kept.
+func (d *Dispatcher) Redrive(letter *hooks.DeadLetter, hook hooks.Webhook, repository Repository) error {
+	if d.DeadLetters != nil {
+		claimed, err := d.DeadLetters.Claim(letter.Id)
+		if err != nil {
+			return err
+		}
+
+		*letter = *claimed
+	}
+
+	err := d.deliver(letter.Event, repository, webhookJob{hook, []byte(letter.Payload)})
+	d.recordStatus(letter.Event, repository, hook, err)
+
+	if d.DeadLetters == nil {
+		return err
+	}
+
+	if err == nil {
+		if removeErr := d.DeadLetters.RemoveClaimed(letter.Id); removeErr != nil {
+			log.Printf(`Could not remove dead letter "%s": %s`, letter.Id, removeErr.Error())
+		}
+
+		return nil
+	}
+
+	letter.Time = time.Now().UTC()
+	letter.Attempts++
+	letter.Reason, letter.StatusCode = classifyDeliveryError(err)
+	letter.Error = err.Error()
+
+	if releaseErr := d.DeadLetters.Release(letter); releaseErr != nil {
+		log.Printf(`Could not update dead letter "%s": %s`, letter.Id, releaseErr.Error())
+	}
+
+	return err
+}
+
+// Return why a delivery failed and the HTTP status code, if any.
+func classifyDeliveryError(err error) (reason string, statusCode int) {
+	var statusErr *HTTPStatusErr
+	var rejectedErr *HookRejectedErr
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	var opErr *net.OpError
+
+	switch {
+	case errors.As(err, &statusErr):
+		return hooks.DeliveryReasonHTTPStatus, statusErr.StatusCode
+
+	case errors.As(err, &rejectedErr):
+		return hooks.DeliveryReasonRejected, 0
+
+	case errors.As(err, &dnsErr):
+		return hooks.DeliveryReasonDNS, 0
+
+	case errors.Is(err, context.DeadlineExceeded),
+		errors.As(err, &netErr) && netErr.Timeout():
+		return hooks.DeliveryReasonTimeout, 0
+
+	case errors.As(err, &opErr):
+		return hooks.DeliveryReasonConnection, 0
+
+	default:
+		return hooks.DeliveryReasonOther, 0
+	}
+}
+
+// Deliver a single webhook, subject to the hook's or the dispatcher's timeout.
+//
+// The payload is signed with the hook's effective secret for the repository,
+// and with its previous secret while the secret is being rotated. Payloads are
+// never sent unsigned.
+func (d *Dispatcher) deliver(event string, repository Repository, job webhookJob) error {
+	hook, err := job.hook.DecryptSecrets(d.SecretsKey)
+	if err != nil {
+		return fmt.Errorf(`Could not decrypt the secret of hook "%s": %s`, hook.Id, err.Error())
+	}
+
+	if !hook.IsSigned() {
+		hook.Secret = ""
+	} else if hook.Secret = hook.EffectiveSecret(d.Secrets, repository.GetName()); hook.Secret == "" {
+		return fmt.Errorf(`Hook "%s" has no secret, and repository "%s" has no default secret.`,
+			hook.Id, repository.GetName())
+	} else {
+		hook.PreviousSecret = hook.EffectivePreviousSecret(d.Secrets, repository.GetName(), time.Now())
+	}
+
+	ctx := context.Background()
+
+	if timeout := job.hook.TimeoutDuration(d.Timeout); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	// Gating events are never faulted, since a failed delivery would reject
+	// a real push.
+	if d.Faults != nil && !events.IsGatingEvent(event) {
+		if err := d.Faults.inject(ctx, hook.Id); err != nil {
+			return err
+		}
+	}
+
+	return invokeHook(ctx, d.Client, event, repository, hook, job.payload)
+}
+
 // Invoke a webhook.
 func invokeHook(
+	ctx context.Context,
 	client *http.Client,
 	event string,
 	repository Repository,
 	hook hooks.Webhook,
 	rawPayload []byte,
 ) error {
-	req, err := http.NewRequest("POST", hook.Url, bytes.NewBuffer(rawPayload))
+	hookUrl := hook.ExpandUrl(event, repository.GetName())
+
+	req, err := http.NewRequestWithContext(ctx, "POST", hookUrl, bytes.NewBuffer(rawPayload))
 	if err != nil {
 		return err
 	}
 
-	signature := hook.SignPayload(rawPayload)
+	hook.ApplyRequestAuth(req)
+
+	if hook.IsSigned() {
+		for header, signature := range hook.SignatureHeaders(rawPayload) {
+			req.Header.Set(header, signature)
+		}
+	}
 
-	req.Header.Set("X-RBG-Signature", signature)
 	req.Header.Set("X-RBG-Event", event)
 	req.Header.Set("Content-Type", "application/json")
 
+	if hook.Format == hooks.FormatGitHub {
+		req.Header.Set(hooks.GitHubEventHeader, events.GitHubEventName(event))
+	}
+
+	displayUrl := hook.DisplayUrl(event, repository.GetName())
+
 	log.Printf(`Dispatching webhook "%s" for event "%s" for repository "%s" to URL "%s"`,
-		hook.Id, event, repository.GetName(), hook.Url)
+		hook.Id, event, repository.GetName(), displayUrl)
 
 	rsp, err := client.Do(req)
 	if err != nil {
+		// Errors from the client include the URL, which would otherwise be
+		// logged and recorded.
+		if urlErr, ok := err.(*url.Error); ok {
+			urlErr.URL = displayUrl
+		}
+
 		return err
 	}
 
 	defer rsp.Body.Close()
 	if rsp.StatusCode < 200 || rsp.StatusCode > 299 {
-		log.Printf("Expected status 2XX, received %s.", rsp.Status)
 		body, err := ioutil.ReadAll(rsp.Body)
 		if err != nil {
 			return err
 		}
 
 		log.Printf("Response body: %s", body)
+		return &HTTPStatusErr{
+			StatusCode: rsp.StatusCode,
+			Status:     rsp.Status,
+		}
+	}
+
+	if events.IsGatingEvent(event) {
+		return checkGatingResponse(hook, rsp.Body)
+	}
+
+	return nil
+}
+
+// Check whether a webhook accepted a gating event.
+//
+// A webhook rejects the event by responding with a JSON object with `accept`
+// set to `false`, optionally including a `message` explaining why. Any other
+// successful response accepts the event.
+func checkGatingResponse(hook hooks.Webhook, body io.Reader) error {
+	content, err := ioutil.ReadAll(io.LimitReader(body, maxGatingResponseSize))
+	if err != nil {
+		return err
+	}
+
+	var rsp gatingResponse
+	if err = json.Unmarshal(content, &rsp); err != nil {
+		return nil
+	}
+
+	if rsp.Accept != nil && !*rsp.Accept {
+		return &HookRejectedErr{
+			HookId:  hook.Id,
+			Message: rsp.Message,
+		}
 	}
 
 	return nil
@@ -1,14 +1,22 @@
 package repositories_test
 
 import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"sort"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 
 	"github.com/reviewboard/rb-gateway/helpers"
 	"github.com/reviewboard/rb-gateway/repositories"
 	"github.com/reviewboard/rb-gateway/repositories/events"
+	"github.com/reviewboard/rb-gateway/repositories/hooks"
 )
 
 func TestInvokeAllHooks(t *testing.T) {
@@ -59,10 +67,11 @@ func TestInvokeAllHooks(t *testing.T) {
 	expectedSignature := store["webhook-1"].SignPayload(json)
 
 	assert.Equal(expectedSignature, request.Request.Header.Get("X-RBG-Signature"))
+	assert.Equal(store["webhook-1"].SignPayloadSHA256(json), request.Request.Header.Get("X-RBG-Signature-256"))
 	assert.Equal(json, request.Body)
 }
 
-func TestInvokeAllHooksMultiple(t *testing.T) {
+func TestInvokeAllHooksSHA256(t *testing.T) {
 	assert := assert.New(t)
 
 	repo := &repositories.GitRepository{
@@ -89,8 +98,7 @@ func TestInvokeAllHooksMultiple(t *testing.T) {
 	}
 
 	store := helpers.CreateTestWebhookStore(server.URL)
-	hook := store["webhook-3"]
-	hook.Enabled = true
+	store["webhook-1"].SignatureAlgorithm = hooks.SignatureAlgorithmSHA256
 
 	err := repositories.InvokeAllHooks(
 		server.Client(),
@@ -101,31 +109,1173 @@ func TestInvokeAllHooksMultiple(t *testing.T) {
 
 	assert.Nil(err)
 
-	requests := helpers.AssertNumRequests(t, 2, requestsChan)
+	request := helpers.AssertNumRequests(t, 1, requestsChan)[0]
 
-	// The underlying implementation for dispatching webhooks iterates over a
-	// map, for which iteration order is random. Sort the requests by URL so
-	// that we can compare them to what we expect.
-	sort.Slice(requests, func(i, j int) bool {
-		return requests[i].Request.URL.Path < requests[j].Request.URL.Path
-	})
+	json, err := events.MarshalPayload(payload)
+	assert.Nil(err)
 
-	rawJson, err := events.MarshalPayload(payload)
+	assert.Equal("", request.Request.Header.Get("X-RBG-Signature"))
+	assert.Equal(store["webhook-1"].SignPayloadSHA256(json), request.Request.Header.Get("X-RBG-Signature-256"))
+}
+
+func TestInvokeAllHooksRotatedSecret(t *testing.T) {
+	assert := assert.New(t)
+
+	repo := &repositories.GitRepository{
+		RepositoryInfo: repositories.RepositoryInfo{
+			Name: "git-repo",
+			Path: "does-not-exist",
+		},
+	}
+
+	server, requestsChan := helpers.CreateRequestRecorder(t)
+	defer server.Close()
+
+	payload := events.PushPayload{
+		Repository: "git-repo",
+		Commits: []events.PushPayloadCommit{
+			{
+				Id:      "f00f00",
+				Message: "Commit message",
+				Target: events.PushPayloadCommitTarget{
+					Branch: "master",
+				},
+			},
+		},
+	}
+
+	json, err := events.MarshalPayload(payload)
 	assert.Nil(err)
-	json := string(rawJson)
 
-	expectedHooks := []string{"webhook-1", "webhook-3"}
+	store := helpers.CreateTestWebhookStore(server.URL)
+	hook := store["webhook-1"]
 
-	for i, r := range requests {
-		request := r.Request
+	rotated, err := hook.RotateSecret(time.Hour)
+	assert.Nil(err)
+	assert.NotEqual(hook.Secret, rotated.Secret)
+	assert.Equal(hook.Secret, rotated.PreviousSecret)
+	store["webhook-1"] = &rotated
 
-		expectedHookId := expectedHooks[i]
+	// During the grace period, payloads are signed with both secrets.
+	assert.Nil(repositories.InvokeAllHooks(server.Client(), store, events.PushEvent, repo, payload))
 
-		assert.Equal("/"+expectedHookId, request.URL.Path)
+	request := helpers.AssertNumRequests(t, 1, requestsChan)[0]
+	assert.Equal(rotated.SignPayload(json), request.Request.Header.Get("X-RBG-Signature"))
+	assert.Equal(rotated.SignPayloadSHA256(json), request.Request.Header.Get("X-RBG-Signature-256"))
+	assert.Equal(hook.SignPayload(json), request.Request.Header.Get("X-RBG-Signature-Previous"))
+	assert.Equal(hook.SignPayloadSHA256(json), request.Request.Header.Get("X-RBG-Signature-256-Previous"))
 
-		hook := store[expectedHookId]
-		assert.Equal(request.Header.Get("X-RBG-Signature"), hook.SignPayload(rawJson))
-		assert.Equal(json, string(r.Body))
+	// Afterwards, only the new secret is used.
+	expired := time.Now().Add(-time.Second)
+	rotated.PreviousSecretExpires = &expired
+
+	assert.Nil(repositories.InvokeAllHooks(server.Client(), store, events.PushEvent, repo, payload))
+
+	request = helpers.AssertNumRequests(t, 1, requestsChan)[0]
+	assert.Equal(rotated.SignPayloadSHA256(json), request.Request.Header.Get("X-RBG-Signature-256"))
+	assert.Equal("", request.Request.Header.Get("X-RBG-Signature-Previous"))
+	assert.Equal("", request.Request.Header.Get("X-RBG-Signature-256-Previous"))
+}
+
+func TestInvokeAllHooksEncryptedSecret(t *testing.T) {
+	assert := assert.New(t)
+
+	repo := &repositories.GitRepository{
+		RepositoryInfo: repositories.RepositoryInfo{
+			Name: "git-repo",
+			Path: "does-not-exist",
+		},
+	}
+
+	server, requestsChan := helpers.CreateRequestRecorder(t)
+	defer server.Close()
+
+	payload := events.PushPayload{
+		Repository: "git-repo",
+		Commits: []events.PushPayloadCommit{
+			{
+				Id:      "f00f00",
+				Message: "Commit message",
+				Target: events.PushPayloadCommitTarget{
+					Branch: "master",
+				},
+			},
+		},
+	}
+
+	json, err := events.MarshalPayload(payload)
+	assert.Nil(err)
+
+	keyDir, err := ioutil.TempDir("", "rb-gateway-secrets-")
+	assert.Nil(err)
+	defer os.RemoveAll(keyDir)
+
+	keyPath := filepath.Join(keyDir, "secrets.key")
+	assert.Nil(hooks.GenerateSecretsKey(keyPath))
+
+	key, err := hooks.LoadSecretsKey(keyPath)
+	assert.Nil(err)
+
+	store := helpers.CreateTestWebhookStore(server.URL)
+	hook := *store["webhook-1"]
+	assert.Nil(store["webhook-1"].EncryptSecrets(key))
+	assert.NotEqual(hook.Secret, store["webhook-1"].Secret)
+
+	// Payloads are signed with the decrypted secret.
+	dispatcher := repositories.NewDispatcher(server.Client(), 1, 0)
+	dispatcher.SecretsKey = key
+
+	assert.Nil(dispatcher.InvokeAllHooks(store, events.PushEvent, repo, payload))
+
+	request := helpers.AssertNumRequests(t, 1, requestsChan)[0]
+	assert.Equal(hook.SignPayloadSHA256(json), request.Request.Header.Get("X-RBG-Signature-256"))
+
+	// Without the key, the hook cannot be delivered.
+	dispatcher.SecretsKey = nil
+	assert.NotNil(dispatcher.InvokeAllHooks(store, events.PushEvent, repo, payload))
+	helpers.AssertNumRequests(t, 0, requestsChan)
+}
+
+func TestInvokeAllHooksGitHubFormat(t *testing.T) {
+	assert := assert.New(t)
+
+	repo := &repositories.GitRepository{
+		RepositoryInfo: repositories.RepositoryInfo{
+			Name: "git-repo",
+			Path: "does-not-exist",
+		},
+	}
+
+	server, requestsChan := helpers.CreateRequestRecorder(t)
+	defer server.Close()
+
+	payload := events.PushPayload{
+		Repository: "git-repo",
+		Commits: []events.PushPayloadCommit{
+			{
+				Id:      "f00f00",
+				Message: "Commit message",
+				Target: events.PushPayloadCommitTarget{
+					Branch: "master",
+				},
+			},
+		},
+	}
+
+	store := helpers.CreateTestWebhookStore(server.URL)
+	store["webhook-1"].Format = hooks.FormatGitHub
+
+	err := repositories.InvokeAllHooks(
+		server.Client(),
+		store,
+		events.PushEvent,
+		repo,
+		payload)
+
+	assert.Nil(err)
+
+	request := helpers.AssertNumRequests(t, 1, requestsChan)[0]
+
+	blobs, err := events.MarshalGitHubPayloads(payload)
+	assert.Nil(err)
+	assert.Equal(1, len(blobs))
+
+	json := blobs[0]
+
+	assert.Equal(json, request.Body)
+	assert.Equal("push", request.Request.Header.Get("X-GitHub-Event"))
+	assert.Equal("sha1="+store["webhook-1"].SignPayload(json), request.Request.Header.Get("X-Hub-Signature"))
+	assert.Equal("sha256="+store["webhook-1"].SignPayloadSHA256(json), request.Request.Header.Get("X-Hub-Signature-256"))
+	assert.Equal("", request.Request.Header.Get("X-RBG-Signature"))
+	assert.Equal("", request.Request.Header.Get("X-RBG-Signature-256"))
+}
+
+func TestInvokeAllHooksSlack(t *testing.T) {
+	assert := assert.New(t)
+
+	repo := &repositories.GitRepository{
+		RepositoryInfo: repositories.RepositoryInfo{
+			Name: "git-repo",
+			Path: "does-not-exist",
+		},
+	}
+
+	server, requestsChan := helpers.CreateRequestRecorder(t)
+	defer server.Close()
+
+	payload := events.PushPayload{
+		Repository: "git-repo",
+		Commits: []events.PushPayloadCommit{
+			{
+				Id:      "f00f00",
+				Message: "Commit message",
+				Target: events.PushPayloadCommitTarget{
+					Branch: "master",
+				},
+			},
+		},
+	}
+
+	store := helpers.CreateTestWebhookStore(server.URL)
+	store["webhook-1"].Type = hooks.TypeSlack
+	store["webhook-1"].Secret = ""
+
+	err := repositories.InvokeAllHooks(
+		server.Client(),
+		store,
+		events.PushEvent,
+		repo,
+		payload)
+
+	assert.Nil(err)
+
+	request := helpers.AssertNumRequests(t, 1, requestsChan)[0]
+
+	json, err := events.MarshalSlackPayload(payload)
+	assert.Nil(err)
+
+	assert.Equal(json, request.Body)
+	assert.Equal("application/json", request.Request.Header.Get("Content-Type"))
+	assert.Equal("", request.Request.Header.Get("X-RBG-Signature"))
+	assert.Equal("", request.Request.Header.Get("X-RBG-Signature-256"))
+
+	// The URL of a Slack hook is a secret.
+	assert.Equal("(redacted)", store["webhook-1"].DisplayUrl(events.PushEvent, "git-repo"))
+
+	// Pushes without commits are not announced.
+	err = repositories.InvokeAllHooks(
+		server.Client(),
+		store,
+		events.PushEvent,
+		repo,
+		events.PushPayload{Repository: "git-repo"})
+
+	assert.Nil(err)
+	helpers.AssertNumRequests(t, 0, requestsChan)
+}
+
+func TestDispatcherDefaultSecret(t *testing.T) {
+	assert := assert.New(t)
+
+	repo := &repositories.GitRepository{
+		RepositoryInfo: repositories.RepositoryInfo{
+			Name: "git-repo",
+			Path: "does-not-exist",
+		},
+	}
+
+	server, requestsChan := helpers.CreateRequestRecorder(t)
+	defer server.Close()
+
+	payload := events.PushPayload{
+		Repository: "git-repo",
+		Commits: []events.PushPayloadCommit{
+			{
+				Id:      "f00f00",
+				Message: "Commit message",
+				Target: events.PushPayloadCommitTarget{
+					Branch: "master",
+				},
+			},
+		},
+	}
+
+	store := helpers.CreateTestWebhookStore(server.URL)
+	store["webhook-1"].Secret = ""
+
+	dispatcher := repositories.NewDispatcher(server.Client(), 1, 0)
+
+	// Payloads are never sent unsigned.
+	assert.NotNil(dispatcher.InvokeAllHooks(store, events.PushEvent, repo, payload))
+
+	dispatcher.Secrets = hooks.SecretDefaults{
+		Global: strings.Repeat("g", 20),
+		Repositories: map[string]string{
+			"git-repo": strings.Repeat("r", 20),
+		},
 	}
 
+	assert.Nil(dispatcher.InvokeAllHooks(store, events.PushEvent, repo, payload))
+
+	request := helpers.AssertNumRequests(t, 1, requestsChan)[0]
+
+	json, err := events.MarshalPayload(payload)
+	assert.Nil(err)
+
+	signingHook := *store["webhook-1"]
+	signingHook.Secret = strings.Repeat("r", 20)
+	assert.Equal(signingHook.SignPayload(json), request.Request.Header.Get("X-RBG-Signature"))
+}
+
+func TestInvokeAllHooksMultiple(t *testing.T) {
+	assert := assert.New(t)
+
+	repo := &repositories.GitRepository{
+		RepositoryInfo: repositories.RepositoryInfo{
+			Name: "git-repo",
+			Path: "does-not-exist",
+		},
+	}
+
+	server, requestsChan := helpers.CreateRequestRecorder(t)
+	defer server.Close()
+
+	payload := events.PushPayload{
+		Repository: "git-repo",
+		Commits: []events.PushPayloadCommit{
+			{
+				Id:      "f00f00",
+				Message: "Commit message",
+				Target: events.PushPayloadCommitTarget{
+					Branch: "master",
+				},
+			},
+		},
+	}
+
+	store := helpers.CreateTestWebhookStore(server.URL)
+	hook := store["webhook-3"]
+	hook.Enabled = true
+
+	err := repositories.InvokeAllHooks(
+		server.Client(),
+		store,
+		events.PushEvent,
+		repo,
+		payload)
+
+	assert.Nil(err)
+
+	requests := helpers.AssertNumRequests(t, 2, requestsChan)
+
+	// The underlying implementation for dispatching webhooks iterates over a
+	// map, for which iteration order is random. Sort the requests by URL so
+	// that we can compare them to what we expect.
+	sort.Slice(requests, func(i, j int) bool {
+		return requests[i].Request.URL.Path < requests[j].Request.URL.Path
+	})
+
+	rawJson, err := events.MarshalPayload(payload)
+	assert.Nil(err)
+	json := string(rawJson)
+
+	expectedHooks := []string{"webhook-1", "webhook-3"}
+
+	for i, r := range requests {
+		request := r.Request
+
+		expectedHookId := expectedHooks[i]
+
+		assert.Equal("/"+expectedHookId, request.URL.Path)
+
+		hook := store[expectedHookId]
+		assert.Equal(request.Header.Get("X-RBG-Signature"), hook.SignPayload(rawJson))
+		assert.Equal(json, string(r.Body))
+	}
+
+}
+
+func TestInvokeAllHooksBookmarkFilter(t *testing.T) {
+	assert := assert.New(t)
+
+	repo := &repositories.HgRepository{
+		RepositoryInfo: repositories.RepositoryInfo{
+			Name: "hg-repo",
+			Path: "does-not-exist",
+		},
+	}
+
+	server, requestsChan := helpers.CreateRequestRecorder(t)
+	defer server.Close()
+
+	payload := events.PushPayload{
+		Repository: "hg-repo",
+		Commits: []events.PushPayloadCommit{
+			{
+				Id:      "f00f00",
+				Message: "Commit message 1",
+				Target: events.PushPayloadCommitTarget{
+					Branch:    "default",
+					Bookmarks: []string{"feature"},
+				},
+			},
+			{
+				Id:      "b4rb4r",
+				Message: "Commit message 2",
+				Target: events.PushPayloadCommitTarget{
+					Branch:    "default",
+					Bookmarks: []string{"stable"},
+				},
+			},
+		},
+	}
+
+	store := helpers.CreateTestWebhookStore(server.URL)
+	store["webhook-2"].Bookmarks = []string{"stable"}
+
+	err := repositories.InvokeAllHooks(
+		server.Client(),
+		store,
+		events.PushEvent,
+		repo,
+		payload)
+
+	assert.Nil(err)
+
+	request := helpers.AssertNumRequests(t, 1, requestsChan)[0]
+	assert.Equal("/webhook-2", request.Request.URL.Path)
+
+	expected, err := events.MarshalPayload(events.PushPayload{
+		Repository: "hg-repo",
+		Commits:    payload.Commits[1:],
+	})
+	assert.Nil(err)
+	assert.Equal(string(expected), string(request.Body))
+
+	// No commits match the filter, so the hook should not be dispatched.
+	store["webhook-2"].Bookmarks = []string{"other"}
+
+	err = repositories.InvokeAllHooks(
+		server.Client(),
+		store,
+		events.PushEvent,
+		repo,
+		payload)
+
+	assert.Nil(err)
+	assert.Equal(0, len(requestsChan))
+}
+
+func TestDispatcherTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	repo := &repositories.GitRepository{
+		RepositoryInfo: repositories.RepositoryInfo{
+			Name: "git-repo",
+			Path: "does-not-exist",
+		},
+	}
+
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-done:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(done)
+
+	payload := events.PushPayload{
+		Repository: "git-repo",
+		Commits: []events.PushPayloadCommit{
+			{
+				Id:      "f00f00",
+				Message: "Commit message",
+				Target: events.PushPayloadCommitTarget{
+					Branch: "master",
+				},
+			},
+		},
+	}
+
+	store := helpers.CreateTestWebhookStore(server.URL)
+	store["webhook-3"].Enabled = true
+
+	dispatcher := repositories.NewDispatcher(server.Client(), 1, 100*time.Millisecond)
+	dispatcher.Retries = 0
+
+	start := time.Now()
+	err := dispatcher.InvokeAllHooks(store, events.PushEvent, repo, payload)
+
+	assert.NotNil(err)
+	assert.Equal("2 errors occurred wihle processing webhooks", err.Error())
+	assert.True(time.Since(start) < 5*time.Second)
+}
+
+func TestDispatcherHookTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	repo := &repositories.GitRepository{
+		RepositoryInfo: repositories.RepositoryInfo{
+			Name: "git-repo",
+			Path: "does-not-exist",
+		},
+	}
+
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-done:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(done)
+
+	payload := events.PushPayload{
+		Repository: "git-repo",
+		Commits: []events.PushPayloadCommit{
+			{
+				Id:      "f00f00",
+				Message: "Commit message",
+				Target: events.PushPayloadCommitTarget{
+					Branch: "master",
+				},
+			},
+		},
+	}
+
+	store := helpers.CreateTestWebhookStore(server.URL)
+	for _, hook := range store {
+		hook.Timeout = 1
+	}
+
+	// The dispatcher has no timeout of its own, so only the hooks' timeouts
+	// stop the deliveries.
+	dispatcher := repositories.NewDispatcher(server.Client(), 0, 0)
+	dispatcher.Retries = 0
+
+	start := time.Now()
+	err := dispatcher.InvokeAllHooks(store, events.PushEvent, repo, payload)
+
+	assert.NotNil(err)
+	assert.True(time.Since(start) < 5*time.Second)
+}
+
+func TestInvokeAllHooksHeaders(t *testing.T) {
+	assert := assert.New(t)
+
+	repo := &repositories.GitRepository{
+		RepositoryInfo: repositories.RepositoryInfo{
+			Name: "git-repo",
+			Path: "does-not-exist",
+		},
+	}
+
+	server, requestsChan := helpers.CreateRequestRecorder(t)
+	defer server.Close()
+
+	payload := events.PushPayload{
+		Repository: "git-repo",
+		Commits: []events.PushPayloadCommit{
+			{
+				Id:      "f00f00",
+				Message: "Commit message",
+				Target: events.PushPayloadCommitTarget{
+					Branch: "master",
+				},
+			},
+		},
+	}
+
+	store := helpers.CreateTestWebhookStore(server.URL)
+	store["webhook-1"].Headers = map[string]string{"X-Proxy-Token": "token"}
+	store["webhook-1"].BasicAuth = &hooks.WebhookBasicAuth{
+		Username: "user",
+		Password: "pass",
+	}
+
+	err := repositories.InvokeAllHooks(
+		server.Client(),
+		store,
+		events.PushEvent,
+		repo,
+		payload)
+
+	assert.Nil(err)
+
+	request := helpers.AssertNumRequests(t, 1, requestsChan)[0]
+
+	assert.Equal("token", request.Request.Header.Get("X-Proxy-Token"))
+
+	username, password, ok := request.Request.BasicAuth()
+	assert.True(ok)
+	assert.Equal("user", username)
+	assert.Equal("pass", password)
+}
+
+func TestInvokeAllHooksUrlTemplate(t *testing.T) {
+	assert := assert.New(t)
+
+	repo := &repositories.GitRepository{
+		RepositoryInfo: repositories.RepositoryInfo{
+			Name: "git-repo",
+			Path: "does-not-exist",
+		},
+	}
+
+	server, requestsChan := helpers.CreateRequestRecorder(t)
+	defer server.Close()
+
+	payload := events.PushPayload{
+		Repository: "git-repo",
+		Commits: []events.PushPayloadCommit{
+			{
+				Id:      "f00f00",
+				Message: "Commit message",
+				Target: events.PushPayloadCommitTarget{
+					Branch: "master",
+				},
+			},
+		},
+	}
+
+	store := helpers.CreateTestWebhookStore(server.URL)
+	store["webhook-1"].Url = server.URL + "/hooks/{repository}/{event}"
+
+	err := repositories.InvokeAllHooks(
+		server.Client(),
+		store,
+		events.PushEvent,
+		repo,
+		payload)
+
+	assert.Nil(err)
+
+	request := helpers.AssertNumRequests(t, 1, requestsChan)[0]
+	assert.Equal("/hooks/git-repo/push", request.Request.URL.Path)
+}
+
+type recordingNotifier struct {
+	notifications []repositories.Notification
+}
+
+func (n *recordingNotifier) Notify(notification repositories.Notification) error {
+	n.notifications = append(n.notifications, notification)
+	return nil
+}
+
+func TestDispatcherNotifier(t *testing.T) {
+	assert := assert.New(t)
+
+	repo := &repositories.GitRepository{
+		RepositoryInfo: repositories.RepositoryInfo{
+			Name: "git-repo",
+			Path: "does-not-exist",
+		},
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/webhook-3" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	payload := events.PushPayload{
+		Repository: "git-repo",
+		Commits: []events.PushPayloadCommit{
+			{
+				Id:      "f00f00",
+				Message: "Commit message",
+				Target: events.PushPayloadCommitTarget{
+					Branch: "master",
+				},
+			},
+		},
+	}
+
+	store := helpers.CreateTestWebhookStore(server.URL)
+	store["webhook-3"].Enabled = true
+
+	notifier := &recordingNotifier{}
+	dispatcher := repositories.NewDispatcher(server.Client(), 2, 0)
+	dispatcher.RetryDelay = time.Millisecond
+	dispatcher.Notifier = notifier
+	dispatcher.ErrorRateThreshold = 0.5
+
+	err := dispatcher.InvokeAllHooks(store, events.PushEvent, repo, payload)
+	assert.NotNil(err)
+
+	assert.Equal(1, len(notifier.notifications))
+
+	notification := notifier.notifications[0]
+	assert.Equal("git-repo", notification.Repository)
+	assert.Equal(events.PushEvent, notification.Event)
+	assert.Equal(2, notification.Total)
+	assert.Equal(1, len(notification.Failures))
+	assert.Equal(store["webhook-3"].Id, notification.Failures[0].HookId)
+	assert.Equal("Expected status 2XX, received 500 Internal Server Error.", notification.Failures[0].Error)
+
+	// Below the threshold, no notification is sent.
+	dispatcher.ErrorRateThreshold = 0.75
+
+	err = dispatcher.InvokeAllHooks(store, events.PushEvent, repo, payload)
+	assert.NotNil(err)
+	assert.Equal(1, len(notifier.notifications))
+}
+
+func TestInvokeAllHooksBranchFilter(t *testing.T) {
+	assert := assert.New(t)
+
+	repo := &repositories.GitRepository{
+		RepositoryInfo: repositories.RepositoryInfo{
+			Name: "git-repo",
+			Path: "does-not-exist",
+		},
+	}
+
+	server, requestsChan := helpers.CreateRequestRecorder(t)
+	defer server.Close()
+
+	payload := events.PushPayload{
+		Repository: "git-repo",
+		Commits: []events.PushPayloadCommit{
+			{
+				Id:      "f00f00",
+				Message: "Commit message 1",
+				Target: events.PushPayloadCommitTarget{
+					Branch: "master",
+				},
+			},
+			{
+				Id:      "b4rb4r",
+				Message: "Commit message 2",
+				Target: events.PushPayloadCommitTarget{
+					Branch: "release/1.0",
+				},
+			},
+			{
+				Id:      "b4zb4z",
+				Message: "Commit message 3",
+				Target: events.PushPayloadCommitTarget{
+					Branch: "release-2.0",
+				},
+			},
+		},
+	}
+
+	store := helpers.CreateTestWebhookStore(server.URL)
+
+	testCases := []struct {
+		branches []string
+		expected []events.PushPayloadCommit
+	}{
+		{[]string{"release/*"}, payload.Commits[1:2]},
+		{[]string{`regex:^release[/-]\d`}, payload.Commits[1:]},
+		{[]string{"master", "release-*"}, []events.PushPayloadCommit{payload.Commits[0], payload.Commits[2]}},
+		{[]string{"feature/*"}, nil},
+	}
+
+	for _, testCase := range testCases {
+		store["webhook-1"].Branches = testCase.branches
+
+		err := repositories.InvokeAllHooks(
+			server.Client(),
+			store,
+			events.PushEvent,
+			repo,
+			payload)
+
+		assert.Nil(err)
+
+		if testCase.expected == nil {
+			assert.Equal(0, len(requestsChan))
+			continue
+		}
+
+		request := helpers.AssertNumRequests(t, 1, requestsChan)[0]
+
+		expected, err := events.MarshalPayload(events.PushPayload{
+			Repository: "git-repo",
+			Commits:    testCase.expected,
+		})
+		assert.Nil(err)
+		assert.Equal(string(expected), string(request.Body), "Branches: %v", testCase.branches)
+	}
+}
+
+func TestInvokeAllHooksGating(t *testing.T) {
+	assert := assert.New(t)
+
+	repo := &repositories.HgRepository{
+		RepositoryInfo: repositories.RepositoryInfo{
+			Name: "hg-repo",
+			Path: "does-not-exist",
+		},
+	}
+
+	var response string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(response))
+	}))
+	defer server.Close()
+
+	payload := events.PrePushPayload{
+		PushPayload: events.PushPayload{
+			Repository: "hg-repo",
+			Commits: []events.PushPayloadCommit{
+				{
+					Id:      "f00f00",
+					Message: "Commit message",
+					Target: events.PushPayloadCommitTarget{
+						Branch: "default",
+					},
+				},
+			},
+		},
+	}
+
+	store := helpers.CreateTestWebhookStore(server.URL)
+	store["webhook-2"].Events = []string{events.PrePushEvent}
+
+	notifier := &recordingNotifier{}
+	dispatcher := repositories.NewDispatcher(server.Client(), 1, 0)
+	dispatcher.RetryDelay = time.Millisecond
+	dispatcher.Notifier = notifier
+
+	testCases := []struct {
+		response string
+		rejected string
+	}{
+		{"", ""},
+		{"OK", ""},
+		{`{"accept": true}`, ""},
+		{`{"accept": false}`, `Rejected by webhook "wehook-2".`},
+		{`{"accept": false, "message": "No review request."}`, `Rejected by webhook "wehook-2": No review request.`},
+	}
+
+	for _, testCase := range testCases {
+		response = testCase.response
+
+		err := dispatcher.InvokeAllHooks(store, events.PrePushEvent, repo, payload)
+		if testCase.rejected == "" {
+			assert.Nil(err, "Response: %s", testCase.response)
+		} else if assert.IsType(&repositories.PushRejectedErr{}, err, "Response: %s", testCase.response) {
+			// The reason is returned so that it can be shown to the user
+			// who pushed.
+			assert.Equal(testCase.rejected, err.Error())
+		}
+	}
+
+	// Rejections are not delivery failures.
+	assert.Equal(0, len(notifier.notifications))
+
+	// Webhooks that cannot be delivered do not reject the push unless the
+	// dispatcher is configured to.
+	unreachable := helpers.CreateTestWebhookStore("http://127.0.0.1:0")
+	unreachable["webhook-2"].Events = []string{events.PrePushEvent}
+
+	assert.Nil(dispatcher.InvokeAllHooks(unreachable, events.PrePushEvent, repo, payload))
+
+	dispatcher.RejectOnDeliveryFailure = true
+	assert.NotNil(dispatcher.InvokeAllHooks(unreachable, events.PrePushEvent, repo, payload))
+}
+
+func TestDispatcherStatusStore(t *testing.T) {
+	assert := assert.New(t)
+
+	repo := &repositories.GitRepository{
+		RepositoryInfo: repositories.RepositoryInfo{
+			Name: "git-repo",
+			Path: "does-not-exist",
+		},
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/webhook-3" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	// A server that is no longer listening, to trigger a connection error.
+	closedServer := httptest.NewServer(http.NotFoundHandler())
+	closedServer.Close()
+
+	statusDir, err := ioutil.TempDir("", "rb-gateway-status-")
+	assert.Nil(err)
+	defer os.RemoveAll(statusDir)
+
+	payload := events.PushPayload{
+		Repository: "git-repo",
+		Commits: []events.PushPayloadCommit{
+			{
+				Id:      "f00f00",
+				Message: "Commit message",
+				Target: events.PushPayloadCommitTarget{
+					Branch: "master",
+				},
+			},
+		},
+	}
+
+	store := helpers.CreateTestWebhookStore(server.URL)
+	store["webhook-3"].Enabled = true
+	store["webhook-4"].Enabled = true
+	store["webhook-4"].Events = []string{events.PushEvent}
+	store["webhook-4"].Url = closedServer.URL
+
+	// Give webhook-4 its own ID; the test store shares it with webhook-3.
+	store["webhook-4"].Id = "webhook-4"
+
+	statusStore := &hooks.DeliveryStatusStore{Dir: statusDir}
+	dispatcher := repositories.NewDispatcher(server.Client(), 2, 0)
+	dispatcher.RetryDelay = time.Millisecond
+	dispatcher.StatusStore = statusStore
+
+	err = dispatcher.InvokeAllHooks(store, events.PushEvent, repo, payload)
+	assert.NotNil(err)
+
+	status, err := statusStore.Load(store["webhook-1"].Id)
+	assert.Nil(err)
+	assert.True(status.LastDelivery.Success)
+	assert.Equal("git-repo", status.LastDelivery.Repository)
+	assert.Nil(status.LastError)
+
+	status, err = statusStore.Load(store["webhook-3"].Id)
+	assert.Nil(err)
+	assert.False(status.LastDelivery.Success)
+	assert.Equal(hooks.DeliveryReasonHTTPStatus, status.LastError.Reason)
+	assert.Equal(http.StatusNotFound, status.LastError.StatusCode)
+
+	status, err = statusStore.Load(store["webhook-4"].Id)
+	assert.Nil(err)
+	assert.False(status.LastDelivery.Success)
+	assert.Equal(hooks.DeliveryReasonConnection, status.LastError.Reason)
+	assert.NotEqual("", status.LastError.Error)
+}
+
+func TestDispatcherDeadLetters(t *testing.T) {
+	assert := assert.New(t)
+
+	repo := &repositories.GitRepository{
+		RepositoryInfo: repositories.RepositoryInfo{
+			Name: "git-repo",
+			Path: "does-not-exist",
+		},
+	}
+
+	failing := true
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+
+		if failing {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	deadLetterDir, err := ioutil.TempDir("", "rb-gateway-dead-letters-")
+	assert.Nil(err)
+	defer os.RemoveAll(deadLetterDir)
+
+	payload := events.PushPayload{
+		Repository: "git-repo",
+		Commits: []events.PushPayloadCommit{
+			{
+				Id:      "f00f00",
+				Message: "Commit message",
+				Target: events.PushPayloadCommitTarget{
+					Branch: "master",
+				},
+			},
+		},
+	}
+
+	rawPayload, err := events.MarshalPayload(payload)
+	assert.Nil(err)
+
+	store := helpers.CreateTestWebhookStore(server.URL)
+	hook := store["webhook-1"]
+
+	deadLetters := &hooks.DeadLetterStore{Dir: deadLetterDir}
+	dispatcher := repositories.NewDispatcher(server.Client(), 1, 0)
+	dispatcher.DeadLetters = deadLetters
+	dispatcher.RetryDelay = time.Millisecond
+
+	// Temporary failures are retried before the payload is kept.
+	assert.NotNil(dispatcher.InvokeAllHooks(store, events.PushEvent, repo, payload))
+	assert.Equal(1+repositories.DefaultDeliveryRetries, requests)
+
+	letters, err := deadLetters.List()
+	assert.Nil(err)
+	if !assert.Equal(1, len(letters)) {
+		return
+	}
+
+	letter := letters[0]
+	assert.Equal(hook.Id, letter.HookId)
+	assert.Equal(events.PushEvent, letter.Event)
+	assert.Equal("git-repo", letter.Repository)
+	assert.Equal(1+repositories.DefaultDeliveryRetries, letter.Attempts)
+	assert.Equal(hooks.DeliveryReasonHTTPStatus, letter.Reason)
+	assert.Equal(http.StatusServiceUnavailable, letter.StatusCode)
+	assert.Equal(string(rawPayload), letter.Payload)
+
+	// A failed redrive is not retried, and updates the dead letter.
+	requests = 0
+	assert.NotNil(dispatcher.Redrive(&letter, *hook, repo))
+	assert.Equal(1, requests)
+
+	updated, err := deadLetters.Load(letter.Id)
+	assert.Nil(err)
+	assert.Equal(2+repositories.DefaultDeliveryRetries, updated.Attempts)
+
+	// A dead letter that is being redriven is not delivered again.
+	claimed, err := deadLetters.Claim(letter.Id)
+	assert.Nil(err)
+
+	requests = 0
+	assert.True(os.IsNotExist(dispatcher.Redrive(updated, *hook, repo)))
+	assert.Equal(0, requests)
+	assert.Nil(deadLetters.Release(claimed))
+
+	// A successful redrive removes it.
+	failing = false
+	assert.Nil(dispatcher.Redrive(updated, *hook, repo))
+	assert.True(os.IsNotExist(dispatcher.Redrive(updated, *hook, repo)))
+
+	letters, err = deadLetters.List()
+	assert.Nil(err)
+	assert.Equal(0, len(letters))
+
+	// Deliveries of gating events are not retried, and their payloads are
+	// not kept.
+	failing = true
+	requests = 0
+	store["webhook-1"].Events = []string{events.PrePushEvent}
+	dispatcher.RejectOnDeliveryFailure = true
+	assert.NotNil(dispatcher.InvokeAllHooks(store, events.PrePushEvent, repo, events.PrePushPayload{PushPayload: payload}))
+	assert.Equal(1, requests)
+
+	letters, err = deadLetters.List()
+	assert.Nil(err)
+	assert.Equal(0, len(letters))
+}
+
+func TestParseFaultInjection(t *testing.T) {
+	assert := assert.New(t)
+
+	faults, err := repositories.ParseFaultInjection("")
+	assert.Nil(err)
+	assert.Equal(1.0, faults.FailureRate)
+	assert.Equal(http.StatusServiceUnavailable, faults.StatusCode)
+	assert.Equal(time.Duration(0), faults.Latency)
+	assert.Equal(0, len(faults.Hooks))
+
+	faults, err = repositories.ParseFaultInjection("rate=0.25, status=502,latency=500ms,hook=a,hook=b")
+	assert.Nil(err)
+	assert.Equal(0.25, faults.FailureRate)
+	assert.Equal(http.StatusBadGateway, faults.StatusCode)
+	assert.Equal(500*time.Millisecond, faults.Latency)
+	assert.Equal([]string{"a", "b"}, faults.Hooks)
+
+	for _, spec := range []string{"rate", "rate=2", "status=200", "status=abc", "latency=-1s", "unknown=1"} {
+		_, err = repositories.ParseFaultInjection(spec)
+		assert.NotNil(err, spec)
+	}
+
+	helpers.WithEnv(t, map[string]string{repositories.FaultInjectionVar: "rate=0.5"}, func() {
+		faults, err := repositories.FaultInjectionFromEnv()
+		assert.Nil(err)
+		assert.Equal(0.5, faults.FailureRate)
+
+		dispatcher := repositories.NewDispatcher(http.DefaultClient, 1, 0)
+		assert.Equal(faults, dispatcher.Faults)
+	})
+
+	assert.Nil(os.Unsetenv(repositories.FaultInjectionVar))
+
+	faults, err = repositories.FaultInjectionFromEnv()
+	assert.Nil(err)
+	assert.Nil(faults)
+}
+
+func TestDispatcherFaults(t *testing.T) {
+	assert := assert.New(t)
+
+	repo := &repositories.GitRepository{
+		RepositoryInfo: repositories.RepositoryInfo{
+			Name: "git-repo",
+			Path: "does-not-exist",
+		},
+	}
+
+	requests := make(chan string, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- r.URL.Path
+	}))
+	defer server.Close()
+
+	statusDir, err := ioutil.TempDir("", "rb-gateway-status-")
+	assert.Nil(err)
+	defer os.RemoveAll(statusDir)
+
+	payload := events.PushPayload{
+		Repository: "git-repo",
+		Commits: []events.PushPayloadCommit{
+			{
+				Id:      "f00f00",
+				Message: "Commit message",
+				Target: events.PushPayloadCommitTarget{
+					Branch: "master",
+				},
+			},
+		},
+	}
+
+	store := helpers.CreateTestWebhookStore(server.URL)
+	store["webhook-3"].Enabled = true
+
+	// Only webhook-1 has a failure injected, and it is never sent.
+	statusStore := &hooks.DeliveryStatusStore{Dir: statusDir}
+	dispatcher := repositories.NewDispatcher(server.Client(), 2, 0)
+	dispatcher.RetryDelay = time.Millisecond
+	dispatcher.StatusStore = statusStore
+	dispatcher.Faults, err = repositories.ParseFaultInjection("status=502,hook=" + store["webhook-1"].Id)
+	assert.Nil(err)
+
+	err = dispatcher.InvokeAllHooks(store, events.PushEvent, repo, payload)
+	assert.NotNil(err)
+
+	close(requests)
+	paths := []string{}
+	for path := range requests {
+		paths = append(paths, path)
+	}
+	assert.Equal([]string{"/webhook-3"}, paths)
+
+	status, err := statusStore.Load(store["webhook-1"].Id)
+	assert.Nil(err)
+	assert.False(status.LastDelivery.Success)
+	assert.Equal(hooks.DeliveryReasonHTTPStatus, status.LastError.Reason)
+	assert.Equal(http.StatusBadGateway, status.LastError.StatusCode)
+	assert.Contains(status.LastError.Error, "(injected)")
+
+	status, err = statusStore.Load(store["webhook-3"].Id)
+	assert.Nil(err)
+	assert.True(status.LastDelivery.Success)
+
+	// Latency counts towards the timeout.
+	dispatcher = repositories.NewDispatcher(server.Client(), 2, 50*time.Millisecond)
+	dispatcher.RetryDelay = time.Millisecond
+	dispatcher.StatusStore = statusStore
+	dispatcher.Faults, err = repositories.ParseFaultInjection("rate=0,latency=10s")
+	assert.Nil(err)
+
+	start := time.Now()
+	err = dispatcher.InvokeAllHooks(store, events.PushEvent, repo, payload)
+	assert.NotNil(err)
+	assert.True(time.Since(start) < 5*time.Second)
+
+	status, err = statusStore.Load(store["webhook-3"].Id)
+	assert.Nil(err)
+	assert.False(status.LastDelivery.Success)
+	assert.Equal(hooks.DeliveryReasonTimeout, status.LastError.Reason)
+
+	// Gating events are never faulted, so real pushes are not rejected.
+	gatingServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer gatingServer.Close()
+
+	store = helpers.CreateTestWebhookStore(gatingServer.URL)
+	store["webhook-1"].Events = []string{events.PrePushEvent}
+
+	dispatcher = repositories.NewDispatcher(gatingServer.Client(), 2, 0)
+	dispatcher.Faults, err = repositories.ParseFaultInjection("")
+	assert.Nil(err)
+
+	assert.Nil(dispatcher.InvokeAllHooks(store, events.PrePushEvent, repo, events.PrePushPayload{PushPayload: payload}))
 }
@@ -0,0 +1,152 @@
+package repositories
+
+import (
+	"path"
+	"sort"
+	"strings"
+)
+
+var (
+	// Languages detected by file extension.
+	languageExtensions = map[string]string{
+		".bash":   "Shell",
+		".c":      "C",
+		".cc":     "C++",
+		".cjs":    "JavaScript",
+		".clj":    "Clojure",
+		".cmake":  "CMake",
+		".cpp":    "C++",
+		".cs":     "C#",
+		".css":    "CSS",
+		".cxx":    "C++",
+		".dart":   "Dart",
+		".erl":    "Erlang",
+		".ex":     "Elixir",
+		".exs":    "Elixir",
+		".fs":     "F#",
+		".go":     "Go",
+		".groovy": "Groovy",
+		".h":      "C",
+		".hh":     "C++",
+		".hpp":    "C++",
+		".hs":     "Haskell",
+		".htm":    "HTML",
+		".html":   "HTML",
+		".java":   "Java",
+		".js":     "JavaScript",
+		".json":   "JSON",
+		".jsx":    "JavaScript",
+		".kt":     "Kotlin",
+		".kts":    "Kotlin",
+		".less":   "Less",
+		".lua":    "Lua",
+		".m":      "Objective-C",
+		".md":     "Markdown",
+		".mjs":    "JavaScript",
+		".ml":     "OCaml",
+		".mm":     "Objective-C++",
+		".php":    "PHP",
+		".pl":     "Perl",
+		".pm":     "Perl",
+		".proto":  "Protocol Buffers",
+		".ps1":    "PowerShell",
+		".py":     "Python",
+		".r":      "R",
+		".rb":     "Ruby",
+		".rs":     "Rust",
+		".rst":    "reStructuredText",
+		".sass":   "Sass",
+		".scala":  "Scala",
+		".scss":   "SCSS",
+		".sh":     "Shell",
+		".sql":    "SQL",
+		".swift":  "Swift",
+		".tf":     "HCL",
+		".toml":   "TOML",
+		".ts":     "TypeScript",
+		".tsx":    "TypeScript",
+		".vue":    "Vue",
+		".xml":    "XML",
+		".yaml":   "YAML",
+		".yml":    "YAML",
+		".zsh":    "Shell",
+	}
+
+	// Languages detected by the (lowercase) file name.
+	//
+	// These are checked before the extension, so that (e.g.)
+	// `CMakeLists.txt` is not detected by its `.txt` extension.
+	languageFilenames = map[string]string{
+		"cmakelists.txt": "CMake",
+		"dockerfile":     "Dockerfile",
+		"gemfile":        "Ruby",
+		"gnumakefile":    "Makefile",
+		"makefile":       "Makefile",
+		"rakefile":       "Ruby",
+	}
+)
+
+// The size of the files of a language in a tree.
+type LanguageStats struct {
+	// The name of the language.
+	Language string `json:"language"`
+
+	// The total size of the files, in bytes.
+	Bytes int64 `json:"bytes"`
+
+	// The number of files.
+	Files int `json:"files"`
+}
+
+// Return the language of a file, based on its name.
+//
+// If the language is unknown, an empty string is returned.
+func DetectLanguage(filePath string) string {
+	name := strings.ToLower(path.Base(filePath))
+
+	if language, ok := languageFilenames[name]; ok {
+		return language
+	}
+
+	return languageExtensions[path.Ext(name)]
+}
+
+// Return the size of the files of each language, given the size of each file
+// keyed by path (e.g., from `Repository.GetFileSizes`).
+//
+// Files whose language is unknown are not counted. The languages are sorted
+// by size, largest first.
+func CountLanguages(sizes map[string]int64) []LanguageStats {
+	byLanguage := make(map[string]*LanguageStats)
+
+	for filePath, size := range sizes {
+		language := DetectLanguage(filePath)
+		if language == "" {
+			continue
+		}
+
+		stats, ok := byLanguage[language]
+		if !ok {
+			stats = &LanguageStats{Language: language}
+			byLanguage[language] = stats
+		}
+
+		stats.Bytes += size
+		stats.Files++
+	}
+
+	languages := make([]LanguageStats, 0, len(byLanguage))
+	for _, stats := range byLanguage {
+		languages = append(languages, *stats)
+	}
+
+	sort.Slice(languages, func(i, j int) bool {
+		if languages[i].Bytes != languages[j].Bytes {
+			return languages[i].Bytes > languages[j].Bytes
+		}
+
+		return languages[i].Language < languages[j].Language
+	})
+
+	return languages
+}
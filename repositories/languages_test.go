@@ -0,0 +1,41 @@
+package repositories_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/reviewboard/rb-gateway/repositories"
+)
+
+func TestDetectLanguage(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("Go", repositories.DetectLanguage("api/routes.go"))
+	assert.Equal("Python", repositories.DetectLanguage("setup.PY"))
+	assert.Equal("Makefile", repositories.DetectLanguage("docs/Makefile"))
+	assert.Equal("Dockerfile", repositories.DetectLanguage("Dockerfile"))
+	assert.Equal("", repositories.DetectLanguage("README"))
+	assert.Equal("", repositories.DetectLanguage("logo.png"))
+}
+
+func TestCountLanguages(t *testing.T) {
+	assert := assert.New(t)
+
+	languages := repositories.CountLanguages(map[string]int64{
+		"main.go":        100,
+		"api/routes.go":  300,
+		"scripts/run.py": 50,
+		"setup.py":       350,
+		"Makefile":       20,
+		"logo.png":       10000,
+	})
+
+	assert.Equal([]repositories.LanguageStats{
+		{Language: "Go", Bytes: 400, Files: 2},
+		{Language: "Python", Bytes: 400, Files: 2},
+		{Language: "Makefile", Bytes: 20, Files: 1},
+	}, languages)
+
+	assert.Equal(0, len(repositories.CountLanguages(nil)))
+}
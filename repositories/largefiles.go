@@ -0,0 +1,206 @@
+package repositories
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	hg "bitbucket.org/gohg/gohg"
+)
+
+const (
+	// The largest file that may be a pointer to a large file.
+	//
+	// Git LFS pointers are always smaller than this, and Mercurial largefiles
+	// standins are much smaller.
+	MaxLargeFilePointerSize = 1024
+
+	// The directory that Mercurial largefiles standins are stored under.
+	hgStandinDir = ".hglf/"
+)
+
+var (
+	// The versions of the Git LFS pointer format.
+	lfsPointerVersions = []string{
+		"version https://git-lfs.github.com/spec/v1",
+		"version https://hawser.github.com/spec/v1",
+	}
+
+	// A pattern matching the object ID in a Git LFS pointer.
+	lfsOidPattern = regexp.MustCompile(`^oid sha256:([0-9a-f]{64})$`)
+
+	// A pattern matching a Mercurial largefiles standin.
+	hgStandinPattern = regexp.MustCompile(`^([0-9a-f]{40})\n?$`)
+)
+
+// A large file stored outside of a repository's history.
+//
+// The caller is responsible for closing it.
+type LargeFile struct {
+	io.ReadCloser
+
+	// The ID of the file in the large file store (e.g., the SHA-256 hash of a
+	// Git LFS object).
+	Id string
+
+	// The size of the file in bytes.
+	Size int64
+}
+
+// Open a large file from a local store, if it exists.
+//
+// If the file does not exist, or its size is not the expected size, nil is
+// returned. The size is not checked if it is -1.
+func openLargeFile(path, id string, size int64) (*LargeFile, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	} else if size != -1 && info.Size() != size {
+		file.Close()
+		return nil, nil
+	}
+
+	return &LargeFile{
+		ReadCloser: file,
+		Id:         id,
+		Size:       info.Size(),
+	}, nil
+}
+
+// Return the ID of the large file that a file's contents point to.
+//
+// This does not check whether the large file is available. If the contents
+// are not a pointer for the SCM (e.g., a Git LFS pointer for `git`), an empty
+// string is returned.
+func LargeFilePointerId(scm string, contents []byte) string {
+	switch scm {
+	case "git":
+		if oid, _, ok := parseLfsPointer(contents); ok {
+			return oid
+		}
+
+	case "hg":
+		if len(contents) < MaxLargeFilePointerSize {
+			if match := hgStandinPattern.FindSubmatch(contents); match != nil {
+				return string(match[1])
+			}
+		}
+	}
+
+	return ""
+}
+
+// Parse a Git LFS pointer, returning the object ID and size.
+//
+// If the contents are not a pointer, false is returned.
+func parseLfsPointer(contents []byte) (string, int64, bool) {
+	if len(contents) >= MaxLargeFilePointerSize {
+		return "", 0, false
+	}
+
+	lines := strings.Split(strings.TrimSuffix(string(contents), "\n"), "\n")
+
+	version := false
+	for _, candidate := range lfsPointerVersions {
+		version = version || lines[0] == candidate
+	}
+
+	if !version {
+		return "", 0, false
+	}
+
+	var oid string
+	size := int64(-1)
+
+	for _, line := range lines[1:] {
+		if match := lfsOidPattern.FindStringSubmatch(line); match != nil {
+			oid = match[1]
+		} else if strings.HasPrefix(line, "size ") {
+			if parsed, err := strconv.ParseInt(line[len("size "):], 10, 64); err == nil && parsed >= 0 {
+				size = parsed
+			}
+		}
+	}
+
+	if oid == "" || size == -1 {
+		return "", 0, false
+	}
+
+	return oid, size, true
+}
+
+// OpenLargeFile is a Repository implementation that returns the Git LFS object
+// that a file's contents point to.
+//
+// Objects are read from the repository's local LFS store (i.e.,
+// `lfs/objects` in the Git directory); they are never fetched from an LFS
+// server. If large files are disabled for the repository, the contents are
+// not an LFS pointer, or the object is not in the local store, nil is
+// returned. On failure, the error will be returned.
+func (repo *GitRepository) OpenLargeFile(contents []byte) (*LargeFile, error) {
+	if !repo.LargeFiles {
+		return nil, nil
+	}
+
+	oid, size, ok := parseLfsPointer(contents)
+	if !ok {
+		return nil, nil
+	}
+
+	gitDir, err := repo.commonDir()
+	if err != nil {
+		return nil, err
+	}
+
+	return openLargeFile(filepath.Join(gitDir, "lfs", "objects", oid[0:2], oid[2:4], oid), oid, size)
+}
+
+// Return the largefile that a standin's contents refer to.
+//
+// Largefiles are read from the repository's local store (i.e.,
+// `.hg/largefiles`); they are never fetched from the largefiles server or the
+// user cache. If large files are disabled for the repository, the contents
+// are not a standin, or the largefile is not in the local store, nil is
+// returned. On failure, the error will be returned.
+func (repo *HgRepository) OpenLargeFile(contents []byte) (*LargeFile, error) {
+	if !repo.LargeFiles || len(contents) >= MaxLargeFilePointerSize {
+		return nil, nil
+	}
+
+	match := hgStandinPattern.FindSubmatch(contents)
+	if match == nil {
+		return nil, nil
+	}
+
+	hash := string(match[1])
+	return openLargeFile(filepath.Join(repo.Path, ".hg", "largefiles", hash), hash, -1)
+}
+
+// Run `hg cat` for a file, falling back to its largefiles standin.
+//
+// Without the largefiles extension, a largefile only exists in the repository
+// as a standin under `.hglf/`. If large files are enabled for the repository
+// and the file does not exist, the standin is returned instead.
+func (repo *HgRepository) cat(client *hg.HgClient, args []string, filepath string) ([]byte, error) {
+	command := append([]string{"cat"}, args...)
+
+	contents, err := hgExec(client, append(command, filepath))
+	if err != nil && repo.LargeFiles && isNotExist(err) {
+		if standin, standinErr := hgExec(client, append(command, hgStandinDir+filepath)); standinErr == nil {
+			return standin, nil
+		}
+	}
+
+	return contents, err
+}
@@ -0,0 +1,71 @@
+package repositories_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/src-d/go-git.v4"
+
+	"github.com/reviewboard/rb-gateway/helpers"
+)
+
+func TestGitOpenLargeFile(t *testing.T) {
+	assert := assert.New(t)
+
+	repo, rawRepo := helpers.CreateGitRepo(t, "repo")
+	defer helpers.CleanupRepository(t, repo.Path)
+
+	helpers.SeedGitRepo(t, repo, rawRepo)
+
+	content := []byte("A large file.\n")
+	commitId, oid := helpers.CreateGitLfsFile(t, repo, rawRepo, "large.bin", content)
+
+	pointer, err := repo.GetFileByCommit(commitId.String(), "large.bin")
+	assert.Nil(err)
+
+	// Large files are disabled by default.
+	largeFile, err := repo.OpenLargeFile(pointer)
+	assert.Nil(err)
+	assert.Nil(largeFile)
+
+	repo.LargeFiles = true
+	assert.True(repo.GetFeatures().LargeFiles)
+
+	largeFile, err = repo.OpenLargeFile(pointer)
+	assert.Nil(err)
+	if assert.NotNil(largeFile) {
+		defer largeFile.Close()
+
+		assert.Equal(oid, largeFile.Id)
+		assert.Equal(int64(len(content)), largeFile.Size)
+
+		read, err := ioutil.ReadAll(largeFile)
+		assert.Nil(err)
+		assert.Equal(content, read)
+	}
+
+	// Files that are not pointers are not resolved.
+	readme, err := repo.GetFileByCommit(commitId.String(), "README")
+	assert.Nil(err)
+
+	largeFile, err = repo.OpenLargeFile(readme)
+	assert.Nil(err)
+	assert.Nil(largeFile)
+
+	// Pointers to objects that are not in the local store are not resolved.
+	objectPath := filepath.Join(repo.Path, git.GitDirName, "lfs", "objects", oid[0:2], oid[2:4], oid)
+	assert.Nil(ioutil.WriteFile(objectPath, []byte("Truncated"), 0644))
+
+	largeFile, err = repo.OpenLargeFile(pointer)
+	assert.Nil(err)
+	assert.Nil(largeFile)
+
+	assert.Nil(os.Remove(objectPath))
+
+	largeFile, err = repo.OpenLargeFile(pointer)
+	assert.Nil(err)
+	assert.Nil(largeFile)
+}
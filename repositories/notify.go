@@ -0,0 +1,118 @@
+package repositories
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// A notification to operators that webhook deliveries are failing.
+type Notification struct {
+	// The event that was being dispatched.
+	Event string `json:"event"`
+
+	// The name of the repository the event occurred in.
+	Repository string `json:"repository"`
+
+	// The total number of webhooks the event was dispatched to.
+	Total int `json:"total"`
+
+	// The deliveries that failed.
+	Failures []DeliveryFailure `json:"failures"`
+}
+
+// A failed webhook delivery.
+type DeliveryFailure struct {
+	// The ID of the webhook.
+	HookId string `json:"hook_id"`
+
+	// The URL of the webhook.
+	Url string `json:"url"`
+
+	// The error that caused the delivery to fail.
+	Error string `json:"error"`
+}
+
+// A transport for operator notifications.
+type Notifier interface {
+	// Send the notification.
+	Notify(notification Notification) error
+}
+
+// Return a human-readable summary of the notification.
+func (n Notification) String() string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, `%d of %d webhooks failed for event "%s" in repository "%s":`,
+		len(n.Failures), n.Total, n.Event, n.Repository)
+
+	for _, failure := range n.Failures {
+		fmt.Fprintf(&b, "\n- %s (%s): %s", failure.HookId, failure.Url, failure.Error)
+	}
+
+	return b.String()
+}
+
+// A Notifier that writes notifications to the log at error level.
+type LogNotifier struct{}
+
+// Log the notification.
+func (_ LogNotifier) Notify(notification Notification) error {
+	log.Printf("ERROR: %s", notification.String())
+	return nil
+}
+
+// A Notifier that posts notifications to a chat service.
+//
+// Notifications are sent as a JSON object with a `text` field, which is the
+// format accepted by Slack and Mattermost incoming webhooks.
+type ChatNotifier struct {
+	// The client used to send notifications.
+	Client *http.Client
+
+	// The incoming webhook URL of the chat service.
+	Url string
+}
+
+// Post the notification to the chat service.
+func (n ChatNotifier) Notify(notification Notification) error {
+	body, err := json.Marshal(struct {
+		Text string `json:"text"`
+	}{
+		Text: notification.String(),
+	})
+	if err != nil {
+		return err
+	}
+
+	rsp, err := n.Client.Post(n.Url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+
+	if rsp.StatusCode < 200 || rsp.StatusCode > 299 {
+		return fmt.Errorf("Expected status 2XX, received %s.", rsp.Status)
+	}
+
+	return nil
+}
+
+// A Notifier that sends notifications to several Notifiers.
+type MultiNotifier []Notifier
+
+// Send the notification with every Notifier.
+//
+// Every Notifier is attempted. The first error encountered is returned.
+func (notifiers MultiNotifier) Notify(notification Notification) (err error) {
+	for _, notifier := range notifiers {
+		if notifyErr := notifier.Notify(notification); notifyErr != nil && err == nil {
+			err = notifyErr
+		}
+	}
+
+	return
+}
@@ -0,0 +1,208 @@
+package repositories
+
+import (
+	"bufio"
+	"bytes"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/reviewboard/rb-gateway/repositories/events"
+)
+
+// A parsed owners file (e.g., a CODEOWNERS file).
+//
+// Each line of an owners file is a pattern followed by the owners (users,
+// groups, or email addresses) of the files it matches. When several patterns
+// match a file, the last one takes precedence. A pattern without any owners
+// leaves the files it matches unowned.
+//
+// Patterns follow the gitignore-style syntax used by CODEOWNERS files:
+//
+//   - A pattern that starts with or contains a `/` is matched relative to the
+//     root of the repository; otherwise, it is matched at any depth.
+//   - A pattern that ends with a `/` only matches the files in a directory.
+//   - A pattern matching a directory matches every file in it, unless the
+//     pattern ends in a wildcard (e.g., `docs/*`).
+//   - `*` and `?` do not match a `/`, and `**` matches any number of
+//     directories.
+//
+// As with CODEOWNERS files, negated patterns (`!`) and character ranges are
+// not supported. Section headers (e.g., `[Docs]`) are ignored.
+type OwnersFile struct {
+	rules []ownersRule
+}
+
+// A line of an owners file.
+type ownersRule struct {
+	pattern *regexp.Regexp
+	owners  []string
+}
+
+// Parse the contents of an owners file.
+//
+// Lines that cannot be used (e.g., negated patterns) are skipped.
+func ParseOwnersFile(contents []byte) *OwnersFile {
+	owners := &OwnersFile{}
+
+	scanner := bufio.NewScanner(bytes.NewReader(contents))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "!") ||
+			strings.HasPrefix(line, "[") || strings.HasPrefix(line, "^[") {
+			continue
+		}
+
+		// Comments may also follow the owners.
+		if index := strings.Index(line, " #"); index != -1 {
+			line = line[:index]
+		}
+
+		fields := strings.Fields(line)
+		pattern := strings.Replace(fields[0], `\#`, "#", 1)
+
+		owners.rules = append(owners.rules, ownersRule{
+			pattern: compileOwnersPattern(pattern),
+			owners:  fields[1:],
+		})
+	}
+
+	return owners
+}
+
+// Return the owners of a file.
+//
+// If the file is unowned, an empty list is returned.
+func (f *OwnersFile) Owners(path string) []string {
+	path = strings.TrimPrefix(path, "/")
+
+	for i := len(f.rules) - 1; i >= 0; i-- {
+		if f.rules[i].pattern.MatchString(path) {
+			return append([]string{}, f.rules[i].owners...)
+		}
+	}
+
+	return []string{}
+}
+
+// Return every owner of any of the given files, sorted and without
+// duplicates.
+func (f *OwnersFile) OwnersOf(paths []string) []string {
+	seen := make(map[string]bool)
+	owners := []string{}
+
+	for _, path := range paths {
+		for _, owner := range f.Owners(path) {
+			if !seen[owner] {
+				seen[owner] = true
+				owners = append(owners, owner)
+			}
+		}
+	}
+	sort.Strings(owners)
+
+	return owners
+}
+
+// Load the owners file at a commit.
+//
+// The given paths are tried in order and the first one that exists is used.
+// If none exist, an empty path and nil are returned. Any other error (e.g.,
+// the commit cannot be read) is returned. The commit must be a full commit ID.
+func LoadOwnersFile(repo Repository, commitId string, paths []string) (string, *OwnersFile, error) {
+	for _, path := range paths {
+		// Git reports a missing file (or parent directory) as an error.
+		if exists, err := repo.FileExistsByCommit(commitId, path); isMissingFileErr(err) || (err == nil && !exists) {
+			continue
+		} else if err != nil {
+			return "", nil, err
+		}
+
+		contents, err := repo.GetFileByCommit(commitId, path)
+		if err != nil {
+			return "", nil, err
+		}
+
+		return path, ParseOwnersFile(contents), nil
+	}
+
+	return "", nil, nil
+}
+
+// Add the suggested reviewers for each commit in a push payload.
+//
+// A commit's suggested reviewers are the owners of the files it changed,
+// according to the first of the given owners files that exists at the
+// commit. The payload's commits are updated in place. On failure, the error
+// will be returned.
+func SuggestReviewers(repo Repository, ownersPaths []string, payload events.PushPayload) error {
+	for i := range payload.Commits {
+		commit := &payload.Commits[i]
+
+		_, ownersFile, err := LoadOwnersFile(repo, commit.Id, ownersPaths)
+		if err != nil {
+			return err
+		} else if ownersFile == nil {
+			continue
+		}
+
+		paths := make([]string, 0, len(commit.Added)+len(commit.Modified)+len(commit.Removed))
+		paths = append(paths, commit.Added...)
+		paths = append(paths, commit.Modified...)
+		paths = append(paths, commit.Removed...)
+
+		commit.SuggestedReviewers = ownersFile.OwnersOf(paths)
+	}
+
+	return nil
+}
+
+// Compile an owners file pattern into a regular expression matching paths.
+func compileOwnersPattern(pattern string) *regexp.Regexp {
+	directoryOnly := strings.HasSuffix(pattern, "/")
+	pattern = strings.TrimSuffix(pattern, "/")
+
+	anchored := strings.Contains(pattern, "/")
+	pattern = strings.TrimPrefix(pattern, "/")
+
+	var expr strings.Builder
+	expr.WriteString("^")
+
+	if !anchored {
+		expr.WriteString("(?:.*/)?")
+	}
+
+	for i := 0; i < len(pattern); i++ {
+		switch {
+		case strings.HasPrefix(pattern[i:], "**/"):
+			expr.WriteString("(?:.*/)?")
+			i += 2
+
+		case strings.HasPrefix(pattern[i:], "**"):
+			expr.WriteString(".*")
+			i++
+
+		case pattern[i] == '*':
+			expr.WriteString("[^/]*")
+
+		case pattern[i] == '?':
+			expr.WriteString("[^/]")
+
+		default:
+			expr.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		}
+	}
+
+	lastSegment := pattern[strings.LastIndex(pattern, "/")+1:]
+
+	if directoryOnly {
+		expr.WriteString("/.*")
+	} else if !strings.ContainsAny(lastSegment, "*?") {
+		expr.WriteString("(?:/.*)?")
+	}
+
+	expr.WriteString("$")
+
+	return regexp.MustCompile(expr.String())
+}
@@ -0,0 +1,121 @@
+package repositories_test
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+
+	"github.com/reviewboard/rb-gateway/helpers"
+	"github.com/reviewboard/rb-gateway/repositories"
+	"github.com/reviewboard/rb-gateway/repositories/events"
+)
+
+func TestOwnersFile(t *testing.T) {
+	assert := assert.New(t)
+
+	owners := repositories.ParseOwnersFile([]byte(`
+# Everything is owned by the core team, unless it is matched below.
+*                @core
+
+[Documentation]
+*.md             @docs docs@example.com
+/docs/           @docs
+docs/internal/*  @security
+!docs/public.md  @nobody
+
+/api/**/routes.go @api
+build/           @build # Any build directory.
+/vendor/
+Makefile         @build
+`))
+
+	expected := map[string][]string{
+		"main.go":                {"@core"},
+		"README.md":              {"@docs", "docs@example.com"},
+		"api/README.md":          {"@docs", "docs@example.com"},
+		"docs/index.rst":         {"@docs"},
+		"docs/public.md":         {"@docs"},
+		"docs/internal/keys.txt": {"@security"},
+		"docs/internal/a/b.txt":  {"@docs"},
+		"src/docs/index.rst":     {"@core"},
+		"api/routes.go":          {"@api"},
+		"api/v1/v2/routes.go":    {"@api"},
+		"src/api/routes.go":      {"@core"},
+		"build/out.o":            {"@build"},
+		"src/build/out.o":        {"@build"},
+		"build":                  {"@core"},
+		"vendor/lib/lib.go":      {},
+		"Makefile":               {"@build"},
+		"/main.go":               {"@core"},
+	}
+
+	for path, pathOwners := range expected {
+		assert.Equal(pathOwners, owners.Owners(path), path)
+	}
+
+	// Files are unowned when nothing matches.
+	assert.Equal([]string{}, repositories.ParseOwnersFile(nil).Owners("main.go"))
+}
+
+func TestSuggestReviewers(t *testing.T) {
+	assert := assert.New(t)
+
+	repo, rawRepo := helpers.CreateGitRepo(t, "repo")
+	defer helpers.CleanupRepository(t, repo.Path)
+
+	seedId := helpers.SeedGitRepo(t, repo, rawRepo)
+
+	worktree, err := rawRepo.Worktree()
+	assert.Nil(err)
+
+	assert.Nil(ioutil.WriteFile(filepath.Join(repo.Path, "CODEOWNERS"), []byte("README @docs\nCOPYING @legal alice\n"), 0644))
+	_, err = worktree.Add("CODEOWNERS")
+	assert.Nil(err)
+
+	ownersId, err := worktree.Commit("Add owners", &git.CommitOptions{
+		Author: &object.Signature{
+			Name:  "Author",
+			Email: "author@example.com",
+			When:  time.Now(),
+		},
+	})
+	assert.Nil(err)
+
+	payload := events.PushPayload{
+		Repository: repo.Name,
+		Commits: []events.PushPayloadCommit{
+			{
+				Id:    seedId.String(),
+				Added: []string{"COPYING", "README"},
+			},
+			{
+				Id:       ownersId.String(),
+				Added:    []string{"CODEOWNERS"},
+				Modified: []string{"README"},
+				Removed:  []string{"COPYING"},
+			},
+		},
+	}
+
+	assert.Nil(repositories.SuggestReviewers(repo, []string{".github/CODEOWNERS", "CODEOWNERS"}, payload))
+
+	// The owners file did not exist at the first commit.
+	assert.Nil(payload.Commits[0].SuggestedReviewers)
+	assert.Equal([]string{"@docs", "@legal", "alice"}, payload.Commits[1].SuggestedReviewers)
+
+	// Errors other than a missing owners file are returned.
+	missing := &repositories.GitRepository{
+		RepositoryInfo: repositories.RepositoryInfo{
+			Name: "missing",
+			Path: filepath.Join(repo.Path, "does-not-exist"),
+		},
+	}
+
+	_, _, err = repositories.LoadOwnersFile(missing, ownersId.String(), []string{"CODEOWNERS"})
+	assert.NotNil(err)
+}
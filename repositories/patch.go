@@ -0,0 +1,402 @@
+package repositories
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// How a patch changes a file.
+const (
+	PatchAdded    = "added"
+	PatchCopied   = "copied"
+	PatchDeleted  = "deleted"
+	PatchModified = "modified"
+	PatchRenamed  = "renamed"
+)
+
+// The exit code of `git apply` when it cannot read the patch at all.
+const gitApplyFatalExitCode = 128
+
+var (
+	// An error returned when a patch does not change any files.
+	EmptyPatchErr = errors.New("The patch does not change any files.")
+
+	// The failure of a hunk in the output of `git apply --check -v`.
+	gitApplyHunkFailedRegexp = regexp.MustCompile(`^error: patch failed: (.*):(\d+)$`)
+
+	// A file that is added or deleted in the output of `git apply --summary`.
+	// Patches without `diff --git` headers have no modes.
+	gitApplySummaryModeRegexp = regexp.MustCompile(`^ (create|delete) (?:mode \d+ )?(.*)$`)
+
+	// A rename or copy in the output of `git apply --summary`.
+	gitApplySummaryMoveRegexp = regexp.MustCompile(`^ (rename|copy) (.*) \(\d+%\)$`)
+)
+
+// An error returned when a patch cannot be parsed.
+type InvalidPatchErr struct {
+	// Why the patch cannot be parsed, as reported by Git.
+	Message string
+}
+
+func (e *InvalidPatchErr) Error() string {
+	return fmt.Sprintf("The patch is invalid: %s", e.Message)
+}
+
+// The result of checking whether a patch applies to a commit.
+type PatchCheck struct {
+	// Whether or not every file in the patch applies cleanly.
+	Applies bool `json:"applies"`
+
+	// The results for each file in the patch, in order.
+	Files []FilePatchCheck `json:"files"`
+}
+
+// The result of checking whether a patch to a single file applies.
+type FilePatchCheck struct {
+	// The path of the file: the new path, or the old path if the file is
+	// deleted.
+	Path string `json:"path"`
+
+	// The path of the file before it was renamed or copied, if it was.
+	OldPath string `json:"old_path,omitempty"`
+
+	// How the patch changes the file. This is one of the `Patch` constants.
+	Status string `json:"status"`
+
+	// Whether or not the patch applies cleanly to the file.
+	Applies bool `json:"applies"`
+
+	// Why the patch does not apply, if it does not.
+	Conflicts []PatchConflict `json:"conflicts,omitempty"`
+}
+
+// A reason why a patch to a file does not apply.
+type PatchConflict struct {
+	// The line in the original file that the hunk that does not apply was
+	// expected at, or 0 if the conflict is with the file as a whole (e.g., it
+	// does not exist).
+	Line int `json:"line,omitempty"`
+
+	// A description of the conflict.
+	Message string `json:"message"`
+
+	// The lines that the hunk expected to find.
+	Expected []string `json:"expected,omitempty"`
+}
+
+// Check whether a patch applies cleanly with `git apply --check`.
+//
+// The command is run in `dir`, with the additional environment variables in
+// `env`. If `cached` is true, the patch is checked against the index (see
+// `GIT_INDEX_FILE`) rather than the files in `dir`. If the patch cannot be
+// parsed, an *InvalidPatchErr or EmptyPatchErr is returned.
+func checkPatchWithGit(dir string, env []string, diff []byte, cached bool) (*PatchCheck, error) {
+	cfg := currentGitConfig()
+
+	summary, _, err := cfg.runWithInput(dir, env, diff,
+		"-c", "core.quotePath=false", "apply", "--summary", "-")
+	if err != nil {
+		return nil, gitApplyError(err)
+	}
+
+	args := []string{"-c", "core.quotePath=false", "apply", "--check", "--verbose"}
+	if cached {
+		args = append(args, "--cached")
+	}
+
+	_, output, err := cfg.runWithInput(dir, env, diff, append(args, "-")...)
+	if gitErr, ok := err.(*GitError); ok && gitErr.ExitCode == 1 {
+		// Some of the files do not apply, which is described by the output.
+	} else if err != nil {
+		return nil, gitApplyError(err)
+	}
+
+	check := parseGitApplyCheck(string(output), string(summary))
+	if len(check.Files) == 0 {
+		return nil, EmptyPatchErr
+	}
+
+	return check, nil
+}
+
+// Return the error for a failure of `git apply`.
+//
+// Failures to read the patch are returned as an *InvalidPatchErr or
+// EmptyPatchErr.
+func gitApplyError(err error) error {
+	gitErr, ok := err.(*GitError)
+	if !ok || gitErr.ExitCode != gitApplyFatalExitCode {
+		return err
+	}
+
+	message := strings.TrimPrefix(gitErr.Output, "error: ")
+	if strings.HasPrefix(message, "No valid patches in input") {
+		return EmptyPatchErr
+	}
+
+	return &InvalidPatchErr{message}
+}
+
+// Parse the output of `git apply --check --verbose` into a PatchCheck.
+//
+// Each file is introduced by a `Checking patch <path>...` line, and any
+// errors that follow it are conflicts with that file. `summary` is the output
+// of `git apply --summary`, which says which files are added, deleted, or
+// copied.
+func parseGitApplyCheck(output, summary string) *PatchCheck {
+	added, deleted, copied := parseGitApplySummary(summary)
+
+	check := &PatchCheck{
+		Applies: true,
+		Files:   []FilePatchCheck{},
+	}
+
+	var current *FilePatchCheck
+	var expected []string
+	searching := false
+
+	for _, line := range strings.Split(strings.TrimRight(output, "\n"), "\n") {
+		if searching {
+			if line == "" {
+				searching = false
+			} else {
+				expected = append(expected, line)
+			}
+
+			continue
+		}
+
+		if strings.HasPrefix(line, "Checking patch ") && strings.HasSuffix(line, "...") {
+			oldPath, newPath := parseGitApplyPaths(line[len("Checking patch ") : len(line)-len("...")])
+
+			check.Files = append(check.Files, FilePatchCheck{
+				Path:    newPath,
+				Status:  PatchModified,
+				Applies: true,
+			})
+			current = &check.Files[len(check.Files)-1]
+
+			switch {
+			case oldPath != newPath && copied[newPath]:
+				current.OldPath = oldPath
+				current.Status = PatchCopied
+			case oldPath != newPath:
+				current.OldPath = oldPath
+				current.Status = PatchRenamed
+			case added[newPath]:
+				current.Status = PatchAdded
+			case deleted[newPath]:
+				current.Status = PatchDeleted
+			}
+
+			continue
+		} else if !strings.HasPrefix(line, "error: ") {
+			continue
+		}
+
+		check.Applies = false
+		if current == nil {
+			continue
+		}
+
+		current.Applies = false
+
+		if line == "error: while searching for:" {
+			searching = true
+			expected = nil
+		} else if match := gitApplyHunkFailedRegexp.FindStringSubmatch(line); match != nil {
+			lineNumber, _ := strconv.Atoi(match[2])
+
+			current.Conflicts = append(current.Conflicts, PatchConflict{
+				Line:     lineNumber,
+				Message:  "The lines the hunk changes do not match the file.",
+				Expected: expected,
+			})
+			expected = nil
+		} else if message := gitApplyConflictMessage(line, current); message != "" {
+			current.Conflicts = append(current.Conflicts, PatchConflict{Message: message})
+		}
+	}
+
+	return check
+}
+
+// Return the description of a conflict with a whole file from an error line
+// of `git apply --check`.
+//
+// The error that says a file's patch does not apply only summarizes the
+// conflicts before it, so an empty string is returned for it if the file
+// already has conflicts.
+func gitApplyConflictMessage(line string, file *FilePatchCheck) string {
+	message := strings.TrimPrefix(line, "error: ")
+
+	for _, path := range []string{file.Path, file.OldPath} {
+		if path != "" && strings.HasPrefix(message, path+": ") {
+			message = message[len(path)+2:]
+			break
+		}
+	}
+
+	switch message {
+	case "does not exist in index", "No such file or directory":
+		return "The file does not exist."
+
+	case "already exists in index", "already exists in working directory":
+		return "The file already exists."
+
+	case "patch does not apply":
+		if len(file.Conflicts) != 0 {
+			return ""
+		}
+
+		return "The patch does not apply."
+	}
+
+	return message
+}
+
+// Parse the output of `git apply --summary`, returning the paths of the files
+// that are added, deleted, and copied (by their new paths).
+func parseGitApplySummary(summary string) (added, deleted, copied map[string]bool) {
+	added = make(map[string]bool)
+	deleted = make(map[string]bool)
+	copied = make(map[string]bool)
+
+	for _, line := range strings.Split(summary, "\n") {
+		if match := gitApplySummaryModeRegexp.FindStringSubmatch(line); match != nil {
+			if match[1] == "create" {
+				added[unquoteGitPath(match[2])] = true
+			} else {
+				deleted[unquoteGitPath(match[2])] = true
+			}
+		} else if match := gitApplySummaryMoveRegexp.FindStringSubmatch(line); match != nil && match[1] == "copy" {
+			_, newPath := parseGitApplyPaths(match[2])
+			copied[newPath] = true
+		}
+	}
+
+	return added, deleted, copied
+}
+
+// Parse the paths of a file from the output of `git apply`, returning its old
+// and new paths.
+//
+// Renamed and copied files are given as `<old> => <new>`, and the summary
+// abbreviates their common prefix and suffix (e.g., `src/{a => b}.go`).
+// Other files have the same old and new path.
+func parseGitApplyPaths(display string) (string, string) {
+	if open := strings.Index(display, "{"); open != -1 {
+		if end := strings.Index(display[open:], "}"); end != -1 {
+			end += open
+
+			if parts := strings.SplitN(display[open+1:end], " => ", 2); len(parts) == 2 {
+				prefix := display[:open]
+				suffix := display[end+1:]
+
+				return joinGitApplyPath(prefix, parts[0], suffix), joinGitApplyPath(prefix, parts[1], suffix)
+			}
+		}
+	}
+
+	if parts := strings.SplitN(display, " => ", 2); len(parts) == 2 {
+		return unquoteGitPath(parts[0]), unquoteGitPath(parts[1])
+	}
+
+	path := unquoteGitPath(display)
+	return path, path
+}
+
+// Join the parts of an abbreviated path from `git apply --summary`.
+//
+// A part may be empty (e.g., `{ => src}/main.go`), which leaves a doubled or
+// leading slash.
+func joinGitApplyPath(prefix, part, suffix string) string {
+	path := prefix + part + suffix
+	path = strings.Replace(path, "//", "/", -1)
+	return strings.TrimPrefix(path, "/")
+}
+
+// Unquote a path that Git has quoted because it has special characters.
+func unquoteGitPath(path string) string {
+	if strings.HasPrefix(path, `"`) {
+		if unquoted, err := strconv.Unquote(path); err == nil {
+			return unquoted
+		}
+	}
+
+	return path
+}
+
+// Check whether a patch applies to the files in a repository at a commit, by
+// writing them to a temporary directory and running `git apply --check`
+// there.
+//
+// This is for repositories that Git cannot read. Only the files that the
+// patch names are written.
+func checkPatchInDirectory(repo Repository, commitId string, diff []byte) (*PatchCheck, error) {
+	tempDir, err := ioutil.TempDir("", "rb-gateway-apply-check-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tempDir)
+
+	// Git must not treat the temporary directory as part of a repository that
+	// contains it.
+	env := []string{"GIT_CEILING_DIRECTORIES=" + filepath.Dir(tempDir)}
+
+	numstat, _, err := currentGitConfig().runWithInput(tempDir, env, diff,
+		"-c", "core.quotePath=false", "apply", "--numstat", "-")
+	if err != nil {
+		return nil, gitApplyError(err)
+	}
+
+	for _, line := range strings.Split(strings.TrimRight(string(numstat), "\n"), "\n") {
+		// Each line is `<added>\t<removed>\t<path>`.
+		fields := strings.SplitN(line, "\t", 3)
+		if len(fields) != 3 {
+			continue
+		}
+
+		oldPath, newPath := parseGitApplyPaths(fields[2])
+		for _, path := range []string{oldPath, newPath} {
+			if err := writePatchedFile(repo, commitId, tempDir, path); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return checkPatchWithGit(tempDir, env, diff, false)
+}
+
+// Write a file at a commit to a directory, if it exists at the commit.
+func writePatchedFile(repo Repository, commitId, dir, path string) error {
+	cleaned := filepath.Clean(filepath.FromSlash(path))
+	if filepath.IsAbs(cleaned) || cleaned == ".." || strings.HasPrefix(cleaned, ".."+string(filepath.Separator)) {
+		return &InvalidPatchErr{fmt.Sprintf(`The path "%s" is outside of the repository.`, path)}
+	}
+
+	// Git reports a missing file (or parent directory) as an error.
+	if exists, err := repo.FileExistsByCommit(commitId, path); isMissingFileErr(err) || (err == nil && !exists) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	contents, err := repo.GetFileByCommit(commitId, path)
+	if err != nil {
+		return err
+	}
+
+	target := filepath.Join(dir, cleaned)
+	if err = os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(target, contents, 0600)
+}
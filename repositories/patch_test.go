@@ -0,0 +1,158 @@
+package repositories_test
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+
+	"github.com/reviewboard/rb-gateway/helpers"
+	"github.com/reviewboard/rb-gateway/repositories"
+)
+
+func TestCheckPatch(t *testing.T) {
+	assert := assert.New(t)
+
+	repo, rawRepo := helpers.CreateGitRepo(t, "repo")
+	defer helpers.CleanupRepository(t, repo.Path)
+
+	helpers.SeedGitRepo(t, repo, rawRepo)
+
+	worktree, err := rawRepo.Worktree()
+	assert.Nil(err)
+
+	assert.Nil(ioutil.WriteFile(filepath.Join(repo.Path, "lines.txt"), []byte("1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n"), 0644))
+	_, err = worktree.Add("lines.txt")
+	assert.Nil(err)
+
+	commitId, err := worktree.Commit("Add lines", &git.CommitOptions{
+		Author: &object.Signature{
+			Name:  "Author",
+			Email: "author@example.com",
+			When:  time.Now(),
+		},
+	})
+	assert.Nil(err)
+
+	check := func(diff string) *repositories.PatchCheck {
+		t.Helper()
+
+		result, err := repo.CheckPatch(commitId.String(), []byte(diff))
+		assert.Nil(err)
+		return result
+	}
+
+	// The second hunk's header is two lines off, which is allowed.
+	result := check(`--- a/lines.txt
++++ b/lines.txt
+@@ -1,2 +1,2 @@
+-1
++one
+ 2
+@@ -6,3 +6,3 @@
+ 8
+-9
++nine
+ 10
+--- a/README
++++ /dev/null
+@@ -1 +0,0 @@
+-README
+--- /dev/null
++++ b/NEWS
+@@ -0,0 +1 @@
++NEWS
+`)
+	assert.True(result.Applies)
+	if assert.Equal(3, len(result.Files)) {
+		assert.Equal(repositories.FilePatchCheck{
+			Path:    "lines.txt",
+			Status:  repositories.PatchModified,
+			Applies: true,
+		}, result.Files[0])
+		assert.Equal(repositories.PatchDeleted, result.Files[1].Status)
+		assert.Equal(repositories.PatchAdded, result.Files[2].Status)
+	}
+
+	result = check(`--- a/lines.txt
++++ b/lines.txt
+@@ -3,2 +3,2 @@
+ 3
+-four
++4
+--- /dev/null
++++ b/README
+@@ -0,0 +1 @@
++README
+--- a/missing.txt
++++ b/missing.txt
+@@ -1 +1 @@
+-a
++b
+`)
+	assert.False(result.Applies)
+	if assert.Equal(3, len(result.Files)) {
+		assert.Equal(repositories.FilePatchCheck{
+			Path:   "lines.txt",
+			Status: repositories.PatchModified,
+			Conflicts: []repositories.PatchConflict{
+				{
+					Line:     3,
+					Message:  "The lines the hunk changes do not match the file.",
+					Expected: []string{"3", "four"},
+				},
+			},
+		}, result.Files[0])
+
+		assert.Equal("The file already exists.", result.Files[1].Conflicts[0].Message)
+		assert.Equal("The file does not exist.", result.Files[2].Conflicts[0].Message)
+	}
+
+	// A missing newline at the end of the file must match.
+	result = check(`--- a/README
++++ b/README
+@@ -1 +1 @@
+-README
+\ No newline at end of file
++readme
+`)
+	assert.False(result.Applies)
+
+	// Renaming a file over another is not allowed.
+	result = check(`diff --git a/README b/COPYING
+similarity index 100%
+rename from README
+rename to COPYING
+`)
+	assert.False(result.Applies)
+	if assert.Equal(1, len(result.Files)) {
+		assert.Equal("COPYING", result.Files[0].Path)
+		assert.Equal("README", result.Files[0].OldPath)
+		assert.Equal(repositories.PatchRenamed, result.Files[0].Status)
+	}
+
+	// Copies are reported as such.
+	result = check(`diff --git a/README b/docs/README
+similarity index 100%
+copy from README
+copy to docs/README
+`)
+	assert.True(result.Applies)
+	if assert.Equal(1, len(result.Files)) {
+		assert.Equal("docs/README", result.Files[0].Path)
+		assert.Equal("README", result.Files[0].OldPath)
+		assert.Equal(repositories.PatchCopied, result.Files[0].Status)
+	}
+
+	// Patches that cannot be parsed are invalid.
+	_, err = repo.CheckPatch(commitId.String(), []byte("not a diff"))
+	assert.Equal(repositories.EmptyPatchErr, err)
+
+	_, err = repo.CheckPatch(commitId.String(), []byte("--- a/README\n+++ b/README\n@@ -1,3 +1 @@\n-README\n"))
+	_, invalid := err.(*repositories.InvalidPatchErr)
+	assert.True(invalid, "%v", err)
+}
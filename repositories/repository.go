@@ -1,16 +1,42 @@
 package repositories
 
 import (
+	"errors"
+	"fmt"
 	"io"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/reviewboard/rb-gateway/repositories/events"
 )
 
+var (
+	// An error returned when an operation is not supported by an SCM.
+	UnsupportedErr = errors.New("Operation not supported by this SCM.")
+)
+
+// An error indicating that a range of commits contains more commits than
+// allowed.
+type TooManyCommitsErr struct {
+	// The maximum number of commits allowed.
+	Limit int
+}
+
+// Return the error message.
+func (e *TooManyCommitsErr) Error() string {
+	return fmt.Sprintf("The range contains more than %d commits.", e.Limit)
+}
+
 // RepositoryInfo is a generic representation of a repository, containing
 // a name and a path to the repository.
 type RepositoryInfo struct {
 	Name string
 	Path string
+
+	// Whether large files stored outside the repository's history (e.g., Git
+	// LFS objects) are returned in place of the pointers to them.
+	LargeFiles bool
 }
 
 // Repository is an interface that contains functions to perform actions on
@@ -30,11 +56,40 @@ type Repository interface {
 	// If an error occurs, it will also be returned.
 	GetFile(id string) ([]byte, error)
 
+	// OpenFile takes a file ID and returns a reader for the file contents and
+	// the size of the file in bytes. The size will be -1 if it cannot be
+	// determined up front. The caller is responsible for closing the reader.
+	// If an error occurs, it will also be returned.
+	OpenFile(id string) (io.ReadCloser, int64, error)
+
 	// GetFileByCommit takes a commit and a file path pair, and returns the
 	// file contents as a byte array. If an error occurs, it will also be
 	// returned.
 	GetFileByCommit(commit, filepath string) ([]byte, error)
 
+	// GetFileModeByCommit takes a commit and a file path pair, and returns
+	// the mode of the file (e.g., whether it is a symlink). If an error
+	// occurs, it will also be returned.
+	GetFileModeByCommit(commit, filepath string) (FileMode, error)
+
+	// GetFileSizeByCommit takes a commit and a file path pair, and returns
+	// the size of the file in bytes without reading its contents. If an
+	// error occurs, it will also be returned.
+	GetFileSizeByCommit(commit, filepath string) (int64, error)
+
+	// OpenLargeFile takes the contents of a file and, if they are a pointer to
+	// a large file stored outside the repository's history (e.g., a Git LFS
+	// pointer), returns the large file. If large files are disabled for the
+	// repository, the contents are not a pointer, or the large file is not
+	// available locally, nil is returned. If an error occurs, it will also be
+	// returned.
+	OpenLargeFile(contents []byte) (*LargeFile, error)
+
+	// ResolveRef takes a symbolic ref (such as a branch, bookmark, or tag
+	// name) or a commit ID and returns the ID of the commit it points to. If
+	// an error occurs, it will also be returned.
+	ResolveRef(ref string) (string, error)
+
 	// FileExists takes a file ID and returns true if the file is found in the
 	// repository; false otherwise. If an error occurs, it will also be
 	// returned.
@@ -45,32 +100,152 @@ type Repository interface {
 	// occurs, it will also be returned.
 	FileExistsByCommit(commit, filepath string) (bool, error)
 
-	// GetBranches returns all the branches in the repository as a JSON byte
-	// array. If an error occurs, it will also be returned.
-	GetBranches() ([]Branch, error)
+	// GetBranches returns all the branches in the repository, ordered by
+	// `sort`. If an error occurs, it will also be returned.
+	GetBranches(sort BranchSort) ([]Branch, error)
+
+	// GetRefs returns all the refs in the repository (e.g., branches, tags,
+	// and notes), along with the commit IDs they point to. If an error occurs,
+	// it will also be returned.
+	GetRefs() ([]Ref, error)
 
 	// GetCommit returns all the commits in the repository starting at the
 	// specified branch as a JSON byte array. It also takes an optional start
 	// commit id, which will return all commits starting from the start commit
-	// id instead. If an error occurs, it will also be returned.
-	GetCommits(branch string, start string) ([]CommitInfo, error)
+	// id instead. The commits are ordered by `order`, and only those matching
+	// `filter` are returned. If an error occurs, it will also be returned.
+	GetCommits(branch string, start string, order CommitOrder, filter CommitFilter) ([]CommitInfo, error)
 
 	// GetCommit returns the commit in the repository provided by the commit
 	// id as a JSON byte array. If an error occurs, it will also be returned.
 	GetCommit(commitId string) (*Commit, error)
 
+	// GetCommitRange returns the commits that are reachable from `until` but
+	// not from `since`, newest first. Both may be commit IDs or symbolic refs.
+	// If an error occurs, it will also be returned.
+	GetCommitRange(since, until string) ([]CommitInfo, error)
+
+	// GetMergeBase returns the ID of the best common ancestor of `a` and `b`,
+	// which may be commit IDs or symbolic refs. If they have no common
+	// ancestor, an empty string is returned. If an error occurs, it will also
+	// be returned.
+	GetMergeBase(a, b string) (string, error)
+
+	// GetFileLog returns the commits reachable from `branch` that changed the
+	// file or directory at `path`, newest first. Renames and copies of files
+	// are followed, and each entry has the path the file had at that commit.
+	// At most one page of commits is returned. If an error occurs, it will
+	// also be returned.
+	GetFileLog(branch, path string) ([]FileLogEntry, error)
+
+	// SearchCommits returns the commits whose messages contain `query`
+	// (case-insensitively), newest first. If `authors` is true, commits whose
+	// author contains `query` are also returned, and if `paths` is true,
+	// commits that changed a file whose path contains `query` are also
+	// returned. If `branch` is non-empty, only commits reachable from it are
+	// searched; otherwise all branches are searched. At most one page of
+	// commits is returned. If an error occurs, it will also be returned.
+	SearchCommits(query, branch string, authors, paths bool) ([]CommitInfo, error)
+
+	// WriteArchive writes an archive of the files at the given commit to `w`
+	// in the given format, which must be one of the `ArchiveFormat`
+	// constants. Every file is placed under the `prefix` directory. If an
+	// error occurs, it will also be returned.
+	WriteArchive(w io.Writer, commitId, format, prefix string) error
+
+	// GetFileSizes returns the size in bytes of every file in the tree at the
+	// given commit, keyed by path. The commit may be a commit ID or a symbolic
+	// ref. If an error occurs, it will also be returned.
+	GetFileSizes(commitId string) (map[string]int64, error)
+
+	// CheckPatch returns whether or not a unified diff applies cleanly to the
+	// files at the given commit, which must be a resolved commit ID. This
+	// requires the Git executable. If the diff cannot be parsed, an
+	// *InvalidPatchErr or EmptyPatchErr is returned. If another error occurs,
+	// it will also be returned.
+	CheckPatch(commitId string, diff []byte) (*PatchCheck, error)
+
+	// GetChangedFiles returns the paths of the files added, modified, or
+	// removed by the given commit, relative to its first parent. The commit
+	// may be a commit ID or a symbolic ref. If an error occurs, it will also
+	// be returned.
+	GetChangedFiles(commitId string) ([]string, error)
+
+	// GetNotes returns all the notes attached to the given commit. If the SCM
+	// does not support notes, UnsupportedErr will be returned.
+	GetNotes(commitId string) ([]Note, error)
+
+	// GetFeatures returns the optional features supported by the repository.
+	GetFeatures() Features
+
 	// Parse the raw payload from the given event.
+	//
+	// If the event does not correspond to any changes that webhooks should be
+	// notified about, a nil payload will be returned without an error.
 	ParseEventPayload(event string, input io.Reader) (events.Payload, error)
 
+	// Parse the payload for an event from the input and environment of a
+	// hook, with environment variables looked up with `getenv`.
+	//
+	// This allows payloads to be parsed by a process other than the hook
+	// (e.g., the server, when hooks post events to it).
+	ParseHookEvent(event string, input io.Reader, getenv func(string) string) (events.Payload, error)
+
+	// Create a payload for the commits in a range, as if they had just been
+	// pushed.
+	//
+	// This allows events that webhooks missed to be sent again. If `limit` is
+	// positive and the range contains more commits than that, a
+	// *TooManyCommitsErr is returned before their changes are loaded.
+	ParseCommitRange(event, start, end string, limit int) (events.Payload, error)
+
+	// Create a push payload for the commits added to branches between two
+	// snapshots of their heads, which map branch names to commit IDs. For
+	// Mercurial, the heads may include bookmarks.
+	//
+	// This allows pushes to repositories that cannot have hooks installed to
+	// be found by polling.
+	ParseBranchChanges(oldHeads, newHeads map[string]string) (events.Payload, error)
+
 	// Install scripts to trigger webhooks.
 	InstallHooks(cfgPath string, force bool) error
 }
 
+// The maximum number of commits returned by a single call to the methods that
+// list commits a page at a time (e.g., GetCommits).
+const CommitsPageSize = commitsPageSize
+
+// The maximum number of commits searched for matches by a single call to
+// GetCommits with a filter.
+//
+// This keeps a filter that matches few or no commits from walking the entire
+// history of a branch. If fewer than a page of the commits searched match,
+// fewer are returned.
+const MaxFilteredCommits = 10000
+
+// The format of commit dates, which is the same for every type of repository.
+const commitDateFormat = "2006-01-02T15:04:05-0700"
+
 // Metadata about a commit.
+//
+// Names and email addresses are given separately, and dates are formatted
+// with commitDateFormat, regardless of the type of repository.
 type CommitInfo struct {
-	// The author of the commit.
+	// The name of the author of the commit.
 	Author string `json:"author"`
 
+	// The email address of the author of the commit.
+	AuthorEmail string `json:"author_email"`
+
+	// The committer of the commit.
+	Committer string `json:"committer"`
+
+	// The email address of the committer of the commit.
+	CommitterEmail string `json:"committer_email"`
+
+	// The date the commit was committed.
+	CommitterDate string `json:"committer_date"`
+
 	// The unique identifier of the commit.
 	Id string `json:"id"`
 
@@ -84,6 +259,45 @@ type CommitInfo struct {
 	ParentId string `json:"parent_id"`
 }
 
+// A commit in the history of a file or directory.
+type FileLogEntry struct {
+	CommitInfo
+
+	// The path of the file at the commit. This differs from the path whose
+	// history was requested if the file was later renamed or copied.
+	Path string `json:"path"`
+
+	// The path the file was renamed or copied from, if the commit renamed or
+	// copied it.
+	OldPath string `json:"old_path,omitempty"`
+
+	// How the commit changed the file. This is one of the Patch* status
+	// constants (e.g., PatchRenamed).
+	Status string `json:"status"`
+}
+
+// The optional features supported by a repository.
+//
+// Clients can use these to avoid requesting operations that the repository's
+// SCM does not support.
+type Features struct {
+	// Whether or not archives of the repository can be downloaded.
+	Archive bool `json:"archive"`
+
+	// Whether or not per-line annotations (blame) are available.
+	Blame bool `json:"blame"`
+
+	// Whether or not the repository has bookmarks.
+	Bookmarks bool `json:"bookmarks"`
+
+	// Whether or not large files stored outside the repository (e.g., Git LFS
+	// or Mercurial largefiles) can be retrieved.
+	LargeFiles bool `json:"large_files"`
+
+	// Whether or not commits can have notes attached.
+	Notes bool `json:"notes"`
+}
+
 // A commit with metadata and a diff.
 type Commit struct {
 	// Commit metadata.
@@ -101,3 +315,137 @@ type Branch struct {
 	// The commit ID the branch points to.
 	Id string `json:"id"`
 }
+
+// How Repository.GetBranches orders branches.
+type BranchSort string
+
+const (
+	// The order the SCM lists branches in.
+	BranchSortDefault BranchSort = ""
+
+	// By name, in ascending order.
+	BranchSortName BranchSort = "name"
+
+	// By the date of the commit each branch points to, oldest first.
+	BranchSortDate BranchSort = "last-commit-date"
+)
+
+// Return whether or not the branch sort is supported.
+func IsValidBranchSort(sort BranchSort) bool {
+	return sort == BranchSortDefault || sort == BranchSortName || sort == BranchSortDate
+}
+
+// Sort branches in place.
+//
+// The dates of the commits the branches point to (keyed by commit ID) are
+// only required for BranchSortDate. Branches with the same date are ordered by
+// name.
+func sortBranches(branches []Branch, order BranchSort, dates map[string]time.Time) {
+	switch order {
+	case BranchSortName:
+		sort.Slice(branches, func(i, j int) bool {
+			return branches[i].Name < branches[j].Name
+		})
+
+	case BranchSortDate:
+		sort.Slice(branches, func(i, j int) bool {
+			a := dates[branches[i].Id]
+			b := dates[branches[j].Id]
+
+			if a.Equal(b) {
+				return branches[i].Name < branches[j].Name
+			}
+
+			return a.Before(b)
+		})
+	}
+}
+
+// How Repository.GetCommits orders commits. Commits are always listed newest
+// first.
+type CommitOrder string
+
+const (
+	// The order the SCM lists commits in. This is CommitOrderDate for Git and
+	// CommitOrderTopological for Mercurial.
+	CommitOrderDefault CommitOrder = ""
+
+	// By commit date.
+	CommitOrderDate CommitOrder = "date"
+
+	// No commit is listed before any of its children.
+	CommitOrderTopological CommitOrder = "topological"
+)
+
+// Return whether or not the commit order is supported.
+func IsValidCommitOrder(order CommitOrder) bool {
+	return order == CommitOrderDefault || order == CommitOrderDate || order == CommitOrderTopological
+}
+
+// Which commits Repository.GetCommits returns.
+//
+// The zero value matches every commit.
+type CommitFilter struct {
+	// Text that the author's name or email address must contain, ignoring
+	// case. If empty, commits by any author match.
+	Author string
+
+	// The earliest author date of matching commits. If zero, there is no
+	// earliest date.
+	Since time.Time
+
+	// The latest author date of matching commits. If zero, there is no latest
+	// date.
+	Until time.Time
+}
+
+// Return whether or not a commit by `name <email>` authored at `date` matches
+// the filter.
+func (f CommitFilter) Matches(name, email string, date time.Time) bool {
+	if f.Author != "" {
+		author := strings.ToLower(f.Author)
+		if !strings.Contains(strings.ToLower(name), author) &&
+			!strings.Contains(strings.ToLower(email), author) {
+			return false
+		}
+	}
+
+	return (f.Since.IsZero() || !date.Before(f.Since)) &&
+		(f.Until.IsZero() || !date.After(f.Until))
+}
+
+// Return whether or not the filter matches every commit.
+func (f CommitFilter) IsEmpty() bool {
+	return f.Author == "" && f.Since.IsZero() && f.Until.IsZero()
+}
+
+// The types of refs that may be returned by Repository.GetRefs.
+const (
+	RefTypeBranch   = "branch"
+	RefTypeBookmark = "bookmark"
+	RefTypeNote     = "note"
+	RefTypeTag      = "tag"
+)
+
+// Information about a ref in an SCM.
+type Ref struct {
+	// The name of the ref.
+	Name string `json:"name"`
+
+	// The type of the ref.
+	//
+	// This will be one of the `RefType` constants.
+	Type string `json:"type"`
+
+	// The object ID the ref points to.
+	Id string `json:"id"`
+}
+
+// A note attached to a commit.
+type Note struct {
+	// The name of the notes ref the note belongs to.
+	Ref string `json:"ref"`
+
+	// The contents of the note.
+	Message string `json:"message"`
+}
@@ -0,0 +1,109 @@
+package repositories
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// The mode of a file in a repository.
+//
+// Modes use Git's octal values. Mercurial's file flags are mapped to the
+// equivalent Git modes.
+type FileMode uint32
+
+const (
+	RegularFileMode    FileMode = 0100644
+	ExecutableFileMode FileMode = 0100755
+	SymlinkFileMode    FileMode = 0120000
+	SubmoduleFileMode  FileMode = 0160000
+	DirectoryFileMode  FileMode = 0040000
+
+	// The maximum number of symlinks followed when resolving a path, which
+	// stops symlink loops from being followed forever.
+	maxSymlinkDepth = 16
+)
+
+var (
+	// An error returned when a symlink points outside of the repository.
+	SymlinkOutsideRepoErr = errors.New("Symlink points outside of the repository.")
+
+	// An error returned when too many symlinks are followed.
+	SymlinkLoopErr = errors.New("Too many levels of symlinks.")
+)
+
+// Return the mode in octal, as Git shows it (e.g., `100644`).
+func (mode FileMode) String() string {
+	return fmt.Sprintf("%06o", uint32(mode))
+}
+
+// Return the type of file with the mode.
+//
+// This is one of `file`, `executable`, `symlink`, `submodule`, or
+// `directory`.
+func (mode FileMode) Type() string {
+	switch mode {
+	case ExecutableFileMode:
+		return "executable"
+
+	case SymlinkFileMode:
+		return "symlink"
+
+	case SubmoduleFileMode:
+		return "submodule"
+
+	case DirectoryFileMode:
+		return "directory"
+
+	default:
+		return "file"
+	}
+}
+
+// Return the path that a symlink's target refers to.
+//
+// Relative targets are relative to the directory containing the symlink.
+// Targets that leave the repository (including absolute paths) produce
+// SymlinkOutsideRepoErr.
+func resolveSymlinkTarget(linkPath, target string) (string, error) {
+	if target == "" || strings.HasPrefix(target, "/") {
+		return "", SymlinkOutsideRepoErr
+	}
+
+	resolved := path.Join(path.Dir(linkPath), target)
+	if resolved == ".." || strings.HasPrefix(resolved, "../") || resolved == "." {
+		return "", SymlinkOutsideRepoErr
+	}
+
+	return resolved, nil
+}
+
+// Follow the symlinks at a path at a commit.
+//
+// The path and mode of the first file that is not a symlink are returned.
+// Only the file itself is followed; symlinks to directories that contain the
+// file are not. Symlinks that point outside of the repository produce
+// SymlinkOutsideRepoErr, and chains of more than 16 symlinks produce
+// SymlinkLoopErr. If any other error occurs, it will also be returned.
+func ResolveSymlinks(repo Repository, commit, filepath string) (string, FileMode, error) {
+	for depth := 0; ; depth++ {
+		mode, err := repo.GetFileModeByCommit(commit, filepath)
+		if err != nil {
+			return "", 0, err
+		} else if mode != SymlinkFileMode {
+			return filepath, mode, nil
+		} else if depth == maxSymlinkDepth {
+			return "", 0, SymlinkLoopErr
+		}
+
+		target, err := repo.GetFileByCommit(commit, filepath)
+		if err != nil {
+			return "", 0, err
+		}
+
+		if filepath, err = resolveSymlinkTarget(filepath, string(target)); err != nil {
+			return "", 0, err
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package repositories_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/reviewboard/rb-gateway/helpers"
+	"github.com/reviewboard/rb-gateway/repositories"
+)
+
+func TestFileMode(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("100644", repositories.RegularFileMode.String())
+	assert.Equal("file", repositories.RegularFileMode.Type())
+	assert.Equal("100755", repositories.ExecutableFileMode.String())
+	assert.Equal("executable", repositories.ExecutableFileMode.Type())
+	assert.Equal("120000", repositories.SymlinkFileMode.String())
+	assert.Equal("symlink", repositories.SymlinkFileMode.Type())
+	assert.Equal("040000", repositories.DirectoryFileMode.String())
+	assert.Equal("directory", repositories.DirectoryFileMode.Type())
+}
+
+func TestResolveSymlinks(t *testing.T) {
+	assert := assert.New(t)
+
+	repo, rawRepo := helpers.CreateGitRepo(t, "repo")
+	defer helpers.CleanupRepository(t, repo.Path)
+
+	helpers.SeedGitRepo(t, repo, rawRepo)
+	commitId := helpers.CreateGitSymlinks(t, repo, rawRepo, map[string]string{
+		"LICENSE":          "COPYING",
+		"docs/readme":      "../README",
+		"docs/license":     "../LICENSE",
+		"docs/absolute":    "/etc/passwd",
+		"docs/outside":     "../../README",
+		"loop/a":           "b",
+		"loop/b":           "a",
+		"docs/missing":     "../MISSING",
+		"docs/self-parent": "..",
+	}).String()
+
+	mode, err := repo.GetFileModeByCommit(commitId, "README")
+	assert.Nil(err)
+	assert.Equal(repositories.RegularFileMode, mode)
+
+	mode, err = repo.GetFileModeByCommit(commitId, "LICENSE")
+	assert.Nil(err)
+	assert.Equal(repositories.SymlinkFileMode, mode)
+
+	mode, err = repo.GetFileModeByCommit(commitId, "docs")
+	assert.Nil(err)
+	assert.Equal(repositories.DirectoryFileMode, mode)
+
+	_, err = repo.GetFileModeByCommit(commitId, "MISSING")
+	assert.NotNil(err)
+
+	path, mode, err := repositories.ResolveSymlinks(repo, commitId, "README")
+	assert.Nil(err)
+	assert.Equal("README", path)
+	assert.Equal(repositories.RegularFileMode, mode)
+
+	path, mode, err = repositories.ResolveSymlinks(repo, commitId, "docs/readme")
+	assert.Nil(err)
+	assert.Equal("README", path)
+	assert.Equal(repositories.RegularFileMode, mode)
+
+	path, _, err = repositories.ResolveSymlinks(repo, commitId, "docs/license")
+	assert.Nil(err)
+	assert.Equal("COPYING", path)
+
+	for _, link := range []string{"docs/absolute", "docs/outside", "docs/self-parent"} {
+		_, _, err = repositories.ResolveSymlinks(repo, commitId, link)
+		assert.Equal(repositories.SymlinkOutsideRepoErr, err, link)
+	}
+
+	_, _, err = repositories.ResolveSymlinks(repo, commitId, "loop/a")
+	assert.Equal(repositories.SymlinkLoopErr, err)
+
+	_, _, err = repositories.ResolveSymlinks(repo, commitId, "docs/missing")
+	assert.NotNil(err)
+}
@@ -0,0 +1,124 @@
+package version
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// The name of the release manifest written by `rb-gateway release`.
+const ManifestFileName = "release.json"
+
+// A description of a release, which `rb-gateway self-update` checks for new
+// versions.
+type Manifest struct {
+	// The version of the release.
+	Version string `json:"version"`
+
+	// The release's binaries, by platform (see Platform()).
+	Artifacts map[string]Artifact `json:"artifacts"`
+}
+
+// A binary in a release.
+type Artifact struct {
+	// The URL to download the binary from.
+	Url string `json:"url"`
+
+	// The SHA-256 checksum of the binary, in hex.
+	Sha256 string `json:"sha256"`
+}
+
+// Parse a release manifest.
+func ParseManifest(data []byte) (*Manifest, error) {
+	var manifest Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, err
+	} else if manifest.Version == "" {
+		return nil, errors.New("The release manifest does not have a version.")
+	}
+
+	return &manifest, nil
+}
+
+// Create the manifest for the binaries of a release in a directory.
+//
+// Binaries must be named `rb-gateway_<version>_<os>_<arch>` (with `.exe` on
+// Windows), as they are by the Makefile's `release` target. Their URLs are
+// relative to `baseUrl` or, if it is empty, to the manifest itself.
+func NewManifest(dir, version, baseUrl string) (*Manifest, error) {
+	prefix := "rb-gateway_" + version + "_"
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := Manifest{
+		Version:   version,
+		Artifacts: make(map[string]Artifact),
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+
+		checksum, err := fileSha256(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+
+		platform := strings.TrimSuffix(strings.TrimPrefix(name, prefix), ".exe")
+		artifactUrl := name
+		if baseUrl != "" {
+			artifactUrl = strings.TrimSuffix(baseUrl, "/") + "/" + name
+		}
+
+		manifest.Artifacts[platform] = Artifact{
+			Url:    artifactUrl,
+			Sha256: checksum,
+		}
+	}
+
+	if len(manifest.Artifacts) == 0 {
+		return nil, fmt.Errorf(`No binaries for version %s were found in "%s".`, version, dir)
+	}
+
+	return &manifest, nil
+}
+
+// Return the platforms that a manifest has binaries for, sorted.
+func (m *Manifest) Platforms() []string {
+	platforms := make([]string, 0, len(m.Artifacts))
+	for platform := range m.Artifacts {
+		platforms = append(platforms, platform)
+	}
+
+	sort.Strings(platforms)
+	return platforms
+}
+
+// Return the SHA-256 checksum of a file, in hex.
+func fileSha256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	if _, err = io.Copy(hash, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,76 @@
+package version
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// The name of the detached signature of the release manifest, which is
+// published beside it.
+const SignatureFileName = ManifestFileName + ".sig"
+
+// The base64-encoded Ed25519 public key that release manifests must be signed
+// with, embedded at build time with
+// `-ldflags "-X github.com/reviewboard/rb-gateway/version.PublicKey=..."`.
+//
+// The Makefile sets this from the RELEASE_PUBLIC_KEY variable. Builds without
+// a public key cannot update themselves, since they have no way to tell
+// whether a release is genuine.
+var PublicKey = ""
+
+// Verify the detached signature of a release manifest against PublicKey.
+//
+// The signature is base64-encoded, as written by SignManifest().
+func VerifyManifest(data, signature []byte) error {
+	if PublicKey == "" {
+		return errors.New("This build of rb-gateway has no release signing key, so releases cannot be verified.")
+	}
+
+	key, err := base64.StdEncoding.DecodeString(PublicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return errors.New("The release signing key embedded in this build of rb-gateway is invalid.")
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(signature)))
+	if err != nil {
+		return fmt.Errorf("The release manifest signature is not valid base64: %s", err.Error())
+	}
+
+	if !ed25519.Verify(ed25519.PublicKey(key), data, sig) {
+		return errors.New("The release manifest signature does not match the release signing key.")
+	}
+
+	return nil
+}
+
+// Sign a release manifest, returning the base64-encoded detached signature.
+//
+// The key file contains the base64-encoded Ed25519 private key, as written by
+// GenerateSigningKey().
+func SignManifest(data, keyFile []byte) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(keyFile)))
+	if err != nil || len(key) != ed25519.PrivateKeySize {
+		return nil, errors.New("The release signing key is not a base64-encoded Ed25519 private key.")
+	}
+
+	signature := ed25519.Sign(ed25519.PrivateKey(key), data)
+	return []byte(base64.StdEncoding.EncodeToString(signature) + "\n"), nil
+}
+
+// Generate a release signing key.
+//
+// This returns the contents of the private key file and the base64-encoded
+// public key to embed in builds.
+func GenerateSigningKey() (keyFile []byte, publicKey string, err error) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, "", err
+	}
+
+	keyFile = []byte(base64.StdEncoding.EncodeToString(private) + "\n")
+	return keyFile, base64.StdEncoding.EncodeToString(public), nil
+}
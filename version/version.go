@@ -0,0 +1,173 @@
+// Package version describes the build of rb-gateway and the releases it can
+// update to.
+package version
+
+import (
+	"fmt"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// Build information, embedded at build time with
+// `-ldflags "-X github.com/reviewboard/rb-gateway/version.Version=..."`.
+//
+// The Makefile's `build` and `release` targets set these from the VERSION file
+// and the Git checkout. They are empty for builds made with plain `go build`.
+var (
+	// The version of rb-gateway (e.g., `2.0` or `2.0alpha0`).
+	Version = ""
+
+	// The Git commit that rb-gateway was built from.
+	Commit = ""
+
+	// When rb-gateway was built, in RFC 3339 format.
+	BuildDate = ""
+)
+
+// Information about the running build of rb-gateway.
+type Info struct {
+	// The version of rb-gateway, if it was embedded.
+	Version string `json:"version"`
+
+	// The Git commit that rb-gateway was built from, if it was embedded.
+	Commit string `json:"commit,omitempty"`
+
+	// When rb-gateway was built, if it was embedded.
+	BuildDate string `json:"build_date,omitempty"`
+
+	// The Go version rb-gateway was built with.
+	Go string `json:"go"`
+
+	// The platform rb-gateway was built for. See Platform().
+	Platform string `json:"platform"`
+}
+
+// Return information about the running build.
+func Get() Info {
+	return Info{
+		Version:   Version,
+		Commit:    Commit,
+		BuildDate: BuildDate,
+		Go:        runtime.Version(),
+		Platform:  Platform(),
+	}
+}
+
+// Return a human-readable description of the running build (e.g., for
+// `rb-gateway --version`).
+func String() string {
+	if Version == "" {
+		return "rb-gateway (development build)"
+	}
+
+	var details []string
+	if Commit != "" {
+		details = append(details, Commit)
+	}
+
+	if BuildDate != "" {
+		details = append(details, "built "+BuildDate)
+	}
+
+	if len(details) == 0 {
+		return "rb-gateway " + Version
+	}
+
+	return fmt.Sprintf("rb-gateway %s (%s)", Version, strings.Join(details, ", "))
+}
+
+// Return the platform of the running build, as used to name release
+// artifacts (e.g., `linux_amd64`).
+func Platform() string {
+	return runtime.GOOS + "_" + runtime.GOARCH
+}
+
+// The stages of pre-release versions, and their order.
+//
+// The short forms used by Python packages (e.g., Review Board's `5.0b1`) are
+// also accepted. Longer names come first, so that they are matched before
+// their short forms.
+var preReleaseStages = []struct {
+	name  string
+	stage int
+}{
+	{"alpha", 1},
+	{"beta", 2},
+	{"dev", 0},
+	{"rc", 3},
+	{"a", 1},
+	{"b", 2},
+}
+
+// The stage of releases, which comes after every pre-release stage.
+const releaseStage = 4
+
+// Compare two versions.
+//
+// Versions are dotted numbers, optionally followed by a pre-release stage and
+// number (e.g., `2.0`, `2.0.1`, `2.0beta2`, or `2.0b2`). A pre-release comes before the
+// release it leads up to. The result is negative if `a` comes before `b`,
+// positive if it comes after, and zero if they are the same.
+func Compare(a, b string) int {
+	aNumbers, aStage, aStageNumber := parseVersion(a)
+	bNumbers, bStage, bStageNumber := parseVersion(b)
+
+	for i := 0; i < len(aNumbers) || i < len(bNumbers); i++ {
+		var x, y int
+		if i < len(aNumbers) {
+			x = aNumbers[i]
+		}
+
+		if i < len(bNumbers) {
+			y = bNumbers[i]
+		}
+
+		if x != y {
+			return x - y
+		}
+	}
+
+	if aStage != bStage {
+		return aStage - bStage
+	}
+
+	return aStageNumber - bStageNumber
+}
+
+// Parse a version into its numbers, pre-release stage, and pre-release number.
+//
+// Releases have a stage after every pre-release stage. Parts that cannot be
+// parsed are treated as zero.
+func parseVersion(v string) ([]int, int, int) {
+	v = strings.TrimPrefix(strings.TrimSpace(v), "v")
+
+	end := strings.IndexFunc(v, func(r rune) bool {
+		return r != '.' && (r < '0' || r > '9')
+	})
+
+	release, suffix := v, ""
+	if end != -1 {
+		release, suffix = v[:end], v[end:]
+	}
+
+	var numbers []int
+	for _, part := range strings.Split(strings.Trim(release, "."), ".") {
+		n, _ := strconv.Atoi(part)
+		numbers = append(numbers, n)
+	}
+
+	if suffix == "" {
+		return numbers, releaseStage, 0
+	}
+
+	suffix = strings.ToLower(strings.TrimLeft(suffix, ".-"))
+	for _, stage := range preReleaseStages {
+		if strings.HasPrefix(suffix, stage.name) {
+			n, _ := strconv.Atoi(strings.TrimLeft(suffix[len(stage.name):], ".-"))
+			return numbers, stage.stage, n
+		}
+	}
+
+	return numbers, 0, 0
+}
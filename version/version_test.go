@@ -0,0 +1,131 @@
+package version_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/reviewboard/rb-gateway/version"
+)
+
+func TestCompare(t *testing.T) {
+	assert := assert.New(t)
+
+	ordered := []string{
+		"1.0",
+		"1.0.1",
+		"2.0alpha0",
+		"2.0alpha1",
+		"2.0beta1",
+		"2.0rc1",
+		"2.0",
+		"v2.0.1",
+		"2.1",
+		"10.0",
+	}
+
+	for i, a := range ordered {
+		for j, b := range ordered {
+			result := version.Compare(a, b)
+
+			switch {
+			case i < j:
+				assert.True(result < 0, "%s < %s", a, b)
+			case i > j:
+				assert.True(result > 0, "%s > %s", a, b)
+			default:
+				assert.Equal(0, result, "%s == %s", a, b)
+			}
+		}
+	}
+
+	assert.Equal(0, version.Compare("2.0", "2.0.0"))
+	assert.Equal(0, version.Compare("5.0b2", "5.0beta2"))
+	assert.True(version.Compare("5.0a1", "5.0b1") < 0)
+	assert.True(version.Compare("5.0b1", "5.0rc1") < 0)
+}
+
+func TestManifest(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "rb-gateway-release-")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"rb-gateway_2.0_linux_amd64":       "linux",
+		"rb-gateway_2.0_windows_amd64.exe": "windows",
+		"rb-gateway_1.0_linux_amd64":       "old",
+		"release.json":                     "{}",
+	}
+
+	for name, content := range files {
+		assert.Nil(ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644))
+	}
+
+	manifest, err := version.NewManifest(dir, "2.0", "https://example.com/releases/2.0/")
+	assert.Nil(err)
+	assert.Equal(&version.Manifest{
+		Version: "2.0",
+		Artifacts: map[string]version.Artifact{
+			"linux_amd64": {
+				Url:    "https://example.com/releases/2.0/rb-gateway_2.0_linux_amd64",
+				Sha256: "caf90169eefa5f807d577486b9f795ab86ae2983c5c20806cff959117e90af18",
+			},
+			"windows_amd64": {
+				Url:    "https://example.com/releases/2.0/rb-gateway_2.0_windows_amd64.exe",
+				Sha256: "340d600392818df2413382dc7d8325c360d83ea49a262d31760348484bbc10b5",
+			},
+		},
+	}, manifest)
+	assert.Equal([]string{"linux_amd64", "windows_amd64"}, manifest.Platforms())
+
+	manifest, err = version.NewManifest(dir, "2.0", "")
+	assert.Nil(err)
+	assert.Equal("rb-gateway_2.0_linux_amd64", manifest.Artifacts["linux_amd64"].Url)
+
+	_, err = version.NewManifest(dir, "3.0", "")
+	assert.NotNil(err)
+
+	parsed, err := version.ParseManifest([]byte(`{"version": "2.0", "artifacts": {}}`))
+	assert.Nil(err)
+	assert.Equal("2.0", parsed.Version)
+
+	_, err = version.ParseManifest([]byte(`{"artifacts": {}}`))
+	assert.NotNil(err)
+}
+
+func TestSignManifest(t *testing.T) {
+	assert := assert.New(t)
+
+	keyFile, publicKey, err := version.GenerateSigningKey()
+	assert.Nil(err)
+
+	otherKeyFile, _, err := version.GenerateSigningKey()
+	assert.Nil(err)
+
+	defer func(original string) { version.PublicKey = original }(version.PublicKey)
+
+	data := []byte(`{"version": "2.0", "artifacts": {}}`)
+
+	signature, err := version.SignManifest(data, keyFile)
+	assert.Nil(err)
+
+	otherSignature, err := version.SignManifest(data, otherKeyFile)
+	assert.Nil(err)
+
+	version.PublicKey = ""
+	assert.NotNil(version.VerifyManifest(data, signature))
+
+	version.PublicKey = publicKey
+	assert.Nil(version.VerifyManifest(data, signature))
+	assert.NotNil(version.VerifyManifest(data, otherSignature))
+	assert.NotNil(version.VerifyManifest([]byte(`{"version": "99.0", "artifacts": {}}`), signature))
+	assert.NotNil(version.VerifyManifest(data, []byte("not base64")))
+
+	_, err = version.SignManifest(data, []byte("not a key"))
+	assert.NotNil(err)
+}